@@ -0,0 +1,722 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"encoding/json"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Customers open accounts by applying. An application is submitted with
+// the applicant's details, completed with an identity document, and sent
+// for KYC review; admins approve or reject it, and an approved applicant
+// activates it to get their account. Applicants come back to an incomplete
+// application with the resume token they were given when submitting it.
+const createAccountApplicationsTable = `
+        CREATE TABLE IF NOT EXISTS account_applications (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            state TEXT NOT NULL,
+            email TEXT NOT NULL,
+            phone TEXT NOT NULL DEFAULT '',
+            password TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            currency TEXT NOT NULL,
+            date_of_birth DATE,
+            address TEXT NOT NULL DEFAULT '',
+            document_key TEXT NOT NULL DEFAULT '',
+            document_name TEXT NOT NULL DEFAULT '',
+            document_type TEXT NOT NULL DEFAULT '',
+            resume_token_hash TEXT NOT NULL UNIQUE,
+            rejection_reason TEXT NOT NULL DEFAULT '',
+            account_id INT REFERENCES accounts(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Every change of state of an application is kept as an event.
+const createAccountApplicationEventsTable = `
+        CREATE TABLE IF NOT EXISTS account_application_events (
+            id SERIAL PRIMARY KEY,
+            application_id INT NOT NULL REFERENCES account_applications(id) ON DELETE CASCADE,
+            from_state TEXT NOT NULL DEFAULT '',
+            to_state TEXT NOT NULL,
+            actor_id INT REFERENCES accounts(id),
+            reason TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// States of an account application. Only submitted applications can be
+// changed by the applicant.
+const (
+	applicationSubmitted  = "submitted"
+	applicationKYCPending = "kyc_pending"
+	applicationApproved   = "approved"
+	applicationRejected   = "rejected"
+	applicationActivated  = "activated"
+)
+
+// applicationTransitions are the states each state can move to.
+var applicationTransitions = map[string][]string{
+	applicationSubmitted:  {applicationKYCPending},
+	applicationKYCPending: {applicationApproved, applicationRejected},
+	applicationApproved:   {applicationActivated},
+}
+
+const (
+	applicationTokenHeader = "X-Application-Token"
+	// minApplicantAge is how old applicants must be to open an account.
+	minApplicantAge = 18
+	// accountNumberDigits is the length of the numbers given to accounts
+	// opened by application.
+	accountNumberDigits = 12
+)
+
+var errApplicationState = errors.New("account application changed state")
+
+// accountApplication is a customer's application for an account.
+type accountApplication struct {
+	ID              int                        `json:"id"`
+	TenantID        int                        `json:"tenant_id"`
+	State           string                     `json:"state"`
+	Email           string                     `json:"email"`
+	Phone           string                     `json:"phone,omitempty"`
+	Name            string                     `json:"name"`
+	Currency        string                     `json:"currency"`
+	ProductID       *int                       `json:"product_id,omitempty"`
+	DateOfBirth     *string                    `json:"date_of_birth,omitempty"`
+	Address         string                     `json:"address,omitempty"`
+	Document        string                     `json:"document,omitempty"`
+	RejectionReason string                     `json:"rejection_reason,omitempty"`
+	AccountID       *int                       `json:"account_id,omitempty"`
+	CreatedAt       time.Time                  `json:"created_at"`
+	UpdatedAt       time.Time                  `json:"updated_at"`
+	Events          []*accountApplicationEvent `json:"events,omitempty"`
+
+	password     string
+	documentKey  string
+	documentType string
+}
+
+// accountApplicationEvent is a change of state of an application.
+type accountApplicationEvent struct {
+	ID        int       `json:"id"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	ActorID   *int      `json:"actor_id,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccountApplicationRequest submits an application, or on an update
+// changes the fields given.
+type AccountApplicationRequest struct {
+	Email       string `json:"email"`
+	Phone       string `json:"phone,omitempty"`
+	Password    string `json:"password,omitempty"`
+	Name        string `json:"name"`
+	Currency    string `json:"currency,omitempty"`
+	Product     string `json:"product,omitempty"`
+	DateOfBirth string `json:"date_of_birth,omitempty"`
+	Address     string `json:"address,omitempty"`
+}
+
+// AccountApplicationResponse answers a new application with the token that
+// resumes it. The token is only ever shown here.
+type AccountApplicationResponse struct {
+	Application *accountApplication `json:"application"`
+	ResumeToken string              `json:"resume_token"`
+}
+
+type RejectApplicationRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AccountApplicationStorage holds the account application storage
+// operations.
+type AccountApplicationStorage interface {
+	CreateAccountApplication(a *accountApplication, tokenHash string) error
+	GetAccountApplication(tenantID, id int) (*accountApplication, error)
+	GetAccountApplicationByToken(tokenHash string) (*accountApplication, error)
+	GetAccountApplications(tenantID int, state string) ([]*accountApplication, error)
+	GetAccountApplicationEvents(id int) ([]*accountApplicationEvent, error)
+	// UpdateAccountApplication saves the details of a submitted
+	// application, failing with errApplicationState once it is not.
+	UpdateAccountApplication(*accountApplication) error
+	// TransitionAccountApplication moves an application on from its
+	// current state, failing with errApplicationState if that changed.
+	TransitionAccountApplication(a *accountApplication, to string, actorID *int, reason string) error
+	// ActivateAccountApplication opens acc for an approved application
+	// and marks it activated.
+	ActivateAccountApplication(a *accountApplication, acc *account) error
+}
+
+const selectAccountApplications = `
+        SELECT id, tenant_id, state, email, phone, password, name, currency, product_id, to_char(date_of_birth, 'YYYY-MM-DD'), address,
+            document_key, document_name, document_type, rejection_reason, account_id, created_at, updated_at
+        FROM account_applications `
+
+func scanAccountApplication(row interface{ Scan(...any) error }) (*accountApplication, error) {
+	a := &accountApplication{}
+	err := row.Scan(&a.ID, &a.TenantID, &a.State, &a.Email, &a.Phone, &a.password, &a.Name, &a.Currency, &a.ProductID, &a.DateOfBirth, &a.Address,
+		&a.documentKey, &a.Document, &a.documentType, &a.RejectionReason, &a.AccountID, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// recordApplicationEvent stores a change of state of an application.
+func recordApplicationEvent(tx *sql.Tx, id int, from, to string, actorID *int, reason string, now time.Time) error {
+	_, err := tx.Exec("INSERT INTO account_application_events (application_id, from_state, to_state, actor_id, reason, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		id, from, to, actorID, reason, now)
+	return err
+}
+
+func (s *PostgresStorage) CreateAccountApplication(a *accountApplication, tokenHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := clock.Now()
+	err = tx.QueryRow(`
+        INSERT INTO account_applications (tenant_id, state, email, phone, password, name, currency, product_id, date_of_birth, address, resume_token_hash, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12) RETURNING id, created_at, updated_at`,
+		a.TenantID, a.State, a.Email, a.Phone, a.password, a.Name, a.Currency, a.ProductID, a.DateOfBirth, a.Address, tokenHash, now,
+	).Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if err := recordApplicationEvent(tx, a.ID, "", a.State, nil, "", now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) GetAccountApplication(tenantID, id int) (*accountApplication, error) {
+	return scanAccountApplication(s.db.QueryRow(selectAccountApplications+"WHERE tenant_id = $1 AND id = $2", tenantID, id))
+}
+
+func (s *PostgresStorage) GetAccountApplicationByToken(tokenHash string) (*accountApplication, error) {
+	return scanAccountApplication(s.db.QueryRow(selectAccountApplications+"WHERE resume_token_hash = $1", tokenHash))
+}
+
+// GetAccountApplications lists a tenant's applications in a state, or in
+// any state, oldest first as they are reviewed.
+func (s *PostgresStorage) GetAccountApplications(tenantID int, state string) ([]*accountApplication, error) {
+	rows, err := s.db.Query(selectAccountApplications+"WHERE tenant_id = $1 AND ($2 = '' OR state = $2) ORDER BY updated_at, id LIMIT 500", tenantID, state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applications := make([]*accountApplication, 0)
+	for rows.Next() {
+		a, err := scanAccountApplication(rows)
+		if err != nil {
+			return nil, err
+		}
+		applications = append(applications, a)
+	}
+	return applications, rows.Err()
+}
+
+func (s *PostgresStorage) GetAccountApplicationEvents(id int) ([]*accountApplicationEvent, error) {
+	rows, err := s.db.Query("SELECT id, from_state, to_state, actor_id, reason, created_at FROM account_application_events WHERE application_id = $1 ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*accountApplicationEvent, 0)
+	for rows.Next() {
+		e := &accountApplicationEvent{}
+		if err := rows.Scan(&e.ID, &e.From, &e.To, &e.ActorID, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresStorage) UpdateAccountApplication(a *accountApplication) error {
+	res, err := s.db.Exec(`
+        UPDATE account_applications SET email = $2, phone = $3, password = $4, name = $5, currency = $6, date_of_birth = $7, address = $8,
+            document_key = $9, document_name = $10, document_type = $11, updated_at = $12, product_id = $14
+        WHERE id = $1 AND state = $13`,
+		a.ID, a.Email, a.Phone, a.password, a.Name, a.Currency, a.DateOfBirth, a.Address, a.documentKey, a.Document, a.documentType, clock.Now(), applicationSubmitted, a.ProductID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errApplicationState
+	}
+	return nil
+}
+
+func (s *PostgresStorage) TransitionAccountApplication(a *accountApplication, to string, actorID *int, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := transitionApplication(tx, a, to, actorID, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionApplication moves a on to the state to within tx, keeping the
+// rejection reason of rejected applications.
+func transitionApplication(tx *sql.Tx, a *accountApplication, to string, actorID *int, reason string) error {
+	now := clock.Now()
+	rejection := ""
+	if to == applicationRejected {
+		rejection = reason
+	}
+	res, err := tx.Exec("UPDATE account_applications SET state = $2, rejection_reason = $3, account_id = $4, updated_at = $5 WHERE id = $1 AND state = $6",
+		a.ID, to, rejection, a.AccountID, now, a.State)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errApplicationState
+	}
+	if err := recordApplicationEvent(tx, a.ID, a.State, to, actorID, reason, now); err != nil {
+		return err
+	}
+	a.State, a.RejectionReason, a.UpdatedAt = to, rejection, now
+	return nil
+}
+
+func (s *PostgresStorage) ActivateAccountApplication(a *accountApplication, acc *account) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO accounts (tenant_id, email, phone, password, name, number, balance, role, currency, product_id, overdraft_limit) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, 0, $7, $8, $9, $10) RETURNING id",
+		acc.TenantID, acc.Email, acc.Phone, acc.Password, acc.Name, acc.Number, acc.Role, acc.Currency, acc.ProductID, acc.OverdraftLimit,
+	).Scan(&acc.ID)
+	if err != nil {
+		return err
+	}
+	a.AccountID = &acc.ID
+	if err := transitionApplication(tx, a, applicationActivated, &acc.ID, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// newAccountNumber returns a random account number.
+func newAccountNumber() (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(accountNumberDigits), nil))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", accountNumberDigits, n), nil
+}
+
+// applyApplicationRequest copies the fields given in req onto a, checking
+// each.
+func applyApplicationRequest(a *accountApplication, req *AccountApplicationRequest) error {
+	if req.Email = strings.TrimSpace(req.Email); req.Email != "" {
+		email, ok := normalizeContact(req.Email)
+		if !ok || !strings.Contains(email, "@") {
+			return newAPIError(http.StatusBadRequest, "invalid_email", req.Email)
+		}
+		a.Email = email
+	}
+	if req.Phone != "" {
+		phone, ok := normalizeContact(req.Phone)
+		if !ok || strings.Contains(phone, "@") {
+			return newAPIError(http.StatusBadRequest, "invalid_phone", req.Phone)
+		}
+		a.Phone = phone
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		a.password = string(hash)
+	}
+	if req.Name = strings.TrimSpace(req.Name); req.Name != "" {
+		a.Name = req.Name
+	}
+	if req.Currency != "" {
+		if _, ok := currencies[req.Currency]; !ok {
+			return newAPIError(http.StatusBadRequest, "unsupported_currency", req.Currency)
+		}
+		a.Currency = req.Currency
+	}
+	if req.DateOfBirth != "" {
+		born, err := time.Parse(time.DateOnly, req.DateOfBirth)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_date", req.DateOfBirth)
+		}
+		if born.AddDate(minApplicantAge, 0, 0).After(clock.Now()) {
+			return newAPIError(http.StatusUnprocessableEntity, "applicant_too_young", minApplicantAge)
+		}
+		a.DateOfBirth = &req.DateOfBirth
+	}
+	if req.Address = strings.TrimSpace(req.Address); req.Address != "" {
+		a.Address = req.Address
+	}
+	return nil
+}
+
+// applyApplicationProduct puts a on the product req names, if any, and
+// keeps its currency that of its product.
+func (s *Apiserver) applyApplicationProduct(a *accountApplication, req *AccountApplicationRequest) error {
+	if req.Product != "" {
+		p, err := s.openingProduct(a.TenantID, req.Product, req.Currency)
+		if err != nil {
+			return err
+		}
+		a.ProductID, a.Currency = &p.ID, p.Currency
+		return nil
+	}
+	if a.ProductID == nil {
+		return nil
+	}
+	p, err := s.store.GetProduct(a.TenantID, *a.ProductID)
+	if err != nil {
+		return err
+	}
+	if a.Currency != p.Currency {
+		return newAPIError(http.StatusBadRequest, "product_currency_mismatch", p.Code, p.Currency)
+	}
+	return nil
+}
+
+// handleCreateAccountApplication submits an application for an account.
+// Only the email and password are needed to start one; the rest can be
+// filled in later with the resume token.
+func (s *Apiserver) handleCreateAccountApplication(w http.ResponseWriter, r *http.Request) error {
+	req := AccountApplicationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if strings.TrimSpace(req.Email) == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "email")
+	}
+	if req.Password == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "password")
+	}
+	a := &accountApplication{TenantID: requestTenant(r).ID, State: applicationSubmitted, Currency: defaultCurrency}
+	if err := applyApplicationRequest(a, &req); err != nil {
+		return err
+	}
+	if err := s.applyApplicationProduct(a, &req); err != nil {
+		return err
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := "apt_" + hex.EncodeToString(b)
+	if err := s.store.CreateAccountApplication(a, hashAPIKey(token)); err != nil {
+		return err
+	}
+	s.audit(r, "account_application."+a.State, "account_application", a.ID, a)
+	return writeJSON(w, http.StatusCreated, &AccountApplicationResponse{Application: a, ResumeToken: token})
+}
+
+// applicantApplication loads the application in the {id} path for the
+// applicant holding its resume token.
+func (s *Apiserver) applicantApplication(r *http.Request) (*accountApplication, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	token := r.Header.Get(applicationTokenHeader)
+	if token == "" {
+		return nil, newAPIError(http.StatusUnauthorized, "missing_application_token")
+	}
+	a, err := s.store.GetAccountApplicationByToken(hashAPIKey(token))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (a.ID != id || a.TenantID != requestTenant(r).ID)) {
+		return nil, newAPIError(http.StatusNotFound, "account_application_not_found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// withApplicationEvents loads the state history of a.
+func (s *Apiserver) withApplicationEvents(a *accountApplication) (*accountApplication, error) {
+	events, err := s.store.GetAccountApplicationEvents(a.ID)
+	if err != nil {
+		return nil, err
+	}
+	a.Events = events
+	return a, nil
+}
+
+// handleAccountApplication returns (GET) the caller's application with
+// its history, or completes it (PUT) while it is still submitted.
+func (s *Apiserver) handleAccountApplication(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.applicantApplication(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "PUT" {
+		req := AccountApplicationRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		if a.State != applicationSubmitted {
+			return newAPIError(http.StatusConflict, "account_application_locked", a.ID, a.State)
+		}
+		if err := applyApplicationRequest(a, &req); err != nil {
+			return err
+		}
+		if err := s.applyApplicationProduct(a, &req); err != nil {
+			return err
+		}
+		if err := s.store.UpdateAccountApplication(a); errors.Is(err, errApplicationState) {
+			return newAPIError(http.StatusConflict, "account_application_locked", a.ID, a.State)
+		} else if err != nil {
+			return err
+		}
+	}
+	if a, err = s.withApplicationEvents(a); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// handleApplicationDocument uploads the identity document of a submitted
+// application, replacing any uploaded before.
+func (s *Apiserver) handleApplicationDocument(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.applicantApplication(r)
+	if err != nil {
+		return err
+	}
+	if a.State != applicationSubmitted {
+		return newAPIError(http.StatusConflict, "account_application_locked", a.ID, a.State)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, "attachment_too_large", maxAttachmentSize>>20)
+	} else if err != nil {
+		return newAPIError(http.StatusBadRequest, "required_field", "file")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxAttachmentSize {
+		return newAPIError(http.StatusRequestEntityTooLarge, "attachment_too_large", maxAttachmentSize>>20)
+	}
+	// Identity documents are scans or PDFs, so plain text is refused.
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !attachmentTypes[contentType] || contentType == "text/plain" {
+		return newAPIError(http.StatusUnsupportedMediaType, "unsupported_attachment_type", contentType)
+	}
+	name := filepath.Base(strings.TrimSpace(header.Filename))
+	if name == "." || name == string(filepath.Separator) || len(name) > maxAttachmentNameLength {
+		name = "document"
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	previous := a.documentKey
+	a.documentKey, a.Document, a.documentType = fmt.Sprintf("applications/%d/%s", a.ID, hex.EncodeToString(b)), name, contentType
+	if err := s.files.Put(a.documentKey, data); err != nil {
+		return err
+	}
+	if err := s.store.UpdateAccountApplication(a); err != nil {
+		if err := s.files.Delete(a.documentKey); err != nil {
+			logf("applications: failed to delete %s: %v\n", a.documentKey, err)
+		}
+		if errors.Is(err, errApplicationState) {
+			return newAPIError(http.StatusConflict, "account_application_locked", a.ID, a.State)
+		}
+		return err
+	}
+	if previous != "" {
+		if err := s.files.Delete(previous); err != nil {
+			logf("applications: failed to delete %s: %v\n", previous, err)
+		}
+	}
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// handleSubmitApplicationForKYC sends a complete application for review.
+func (s *Apiserver) handleSubmitApplicationForKYC(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.applicantApplication(r)
+	if err != nil {
+		return err
+	}
+	if a.State != applicationSubmitted {
+		return newAPIError(http.StatusConflict, "account_application_locked", a.ID, a.State)
+	}
+	switch {
+	case a.Name == "":
+		return newAPIError(http.StatusUnprocessableEntity, "account_application_incomplete", "name")
+	case a.DateOfBirth == nil:
+		return newAPIError(http.StatusUnprocessableEntity, "account_application_incomplete", "date_of_birth")
+	case a.Address == "":
+		return newAPIError(http.StatusUnprocessableEntity, "account_application_incomplete", "address")
+	case a.documentKey == "":
+		return newAPIError(http.StatusUnprocessableEntity, "account_application_incomplete", "document")
+	}
+	return s.transitionApplication(w, r, a, applicationKYCPending, nil, "")
+}
+
+// handleActivateApplication opens the account of an approved application.
+func (s *Apiserver) handleActivateApplication(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.applicantApplication(r)
+	if err != nil {
+		return err
+	}
+	if a.State != applicationApproved {
+		return newAPIError(http.StatusConflict, "account_application_not_approved", a.ID, a.State)
+	}
+	number, err := newAccountNumber()
+	if err != nil {
+		return err
+	}
+	acc := &account{TenantID: a.TenantID, Email: a.Email, Phone: a.Phone, Password: a.password, Name: a.Name, Number: number, Role: roleCustomer, Currency: a.Currency}
+	if a.ProductID != nil {
+		p, err := s.store.GetProduct(a.TenantID, *a.ProductID)
+		if err != nil {
+			return err
+		}
+		applyProduct(acc, p)
+	}
+	if err := s.store.ActivateAccountApplication(a, acc); errors.Is(err, errApplicationState) {
+		return newAPIError(http.StatusConflict, "account_application_not_approved", a.ID, a.State)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "account.created", "account", acc.ID, accountProfile{Email: acc.Email, Name: acc.Name, Number: acc.Number, Role: acc.Role, Currency: acc.Currency})
+	s.audit(r, "account_application."+a.State, "account_application", a.ID, a)
+	s.screenAccount(acc)
+	infof("applications: application %d opened account %d\n", a.ID, acc.ID)
+	// The applicant is not signed in yet but holds the new account.
+	return writeJSON(&viewerWriter{ResponseWriter: w, viewer: viewer{accountID: acc.ID}}, http.StatusCreated, acc)
+}
+
+// transitionApplication moves a to the state to and answers with it.
+func (s *Apiserver) transitionApplication(w http.ResponseWriter, r *http.Request, a *accountApplication, to string, actorID *int, reason string) error {
+	from := a.State
+	if err := s.store.TransitionAccountApplication(a, to, actorID, reason); errors.Is(err, errApplicationState) {
+		return newAPIError(http.StatusConflict, "account_application_state", a.ID, from, to)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "account_application."+to, "account_application", a.ID, a)
+	infof("applications: application %d moved from %s to %s\n", a.ID, from, to)
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// handleAdminAccountApplications lists the tenant's applications, those in
+// ?state= if given, such as kyc_pending for the review queue.
+func (s *Apiserver) handleAdminAccountApplications(w http.ResponseWriter, r *http.Request) error {
+	state := r.URL.Query().Get("state")
+	if _, ok := applicationTransitions[state]; !ok && state != "" && state != applicationRejected && state != applicationActivated {
+		return newAPIError(http.StatusBadRequest, "invalid_application_state", state)
+	}
+	applications, err := s.store.GetAccountApplications(requestTenant(r).ID, state)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, applications)
+}
+
+// adminApplication loads the application in the {id} path from the
+// caller's tenant.
+func (s *Apiserver) adminApplication(r *http.Request) (*accountApplication, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.store.GetAccountApplication(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, newAPIError(http.StatusNotFound, "account_application_not_found", id)
+	}
+	return a, err
+}
+
+// handleAdminAccountApplication returns an application with its history.
+func (s *Apiserver) handleAdminAccountApplication(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.adminApplication(r)
+	if err != nil {
+		return err
+	}
+	if a, err = s.withApplicationEvents(a); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// handleAdminApplicationDocument downloads the identity document of an
+// application for review.
+func (s *Apiserver) handleAdminApplicationDocument(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.adminApplication(r)
+	if err != nil {
+		return err
+	}
+	if a.documentKey == "" {
+		return newAPIError(http.StatusNotFound, "account_application_incomplete", "document")
+	}
+	data, err := s.files.Get(a.documentKey)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", a.documentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Document}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
+
+// reviewAccountApplication decides on an application pending KYC review,
+// approving it or rejecting it with a reason the applicant is shown.
+func (s *Apiserver) reviewAccountApplication(to string) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		a, err := s.adminApplication(r)
+		if err != nil {
+			return err
+		}
+		reviewer, err := s.currentAccount(r)
+		if err != nil {
+			return err
+		}
+		req := RejectApplicationRequest{}
+		if to == applicationRejected {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return err
+			}
+			if req.Reason = strings.TrimSpace(req.Reason); req.Reason == "" {
+				return newAPIError(http.StatusBadRequest, "required_field", "reason")
+			}
+		}
+		if a.State != applicationKYCPending {
+			return newAPIError(http.StatusConflict, "account_application_state", a.ID, a.State, to)
+		}
+		return s.transitionApplication(w, r, a, to, &reviewer.ID, req.Reason)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// accountProfile is the part of an account its audit trail can reconstruct.
+type accountProfile struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Number   string `json:"number"`
+	Role     string `json:"role"`
+	Currency string `json:"currency"`
+	Locale   string `json:"locale"`
+}
+
+// fieldChange is how an account.updated audit entry records a profile field.
+type fieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AccountAsOf is the state of an account at a past time.
+type AccountAsOf struct {
+	AccountID int       `json:"account_id"`
+	At        time.Time `json:"at"`
+	accountProfile
+	Balance          int    `json:"balance"`
+	BalanceFormatted string `json:"balance_formatted,omitempty"`
+	// ChangesUndone counts the audited profile changes made after At.
+	ChangesUndone int `json:"changes_undone"`
+}
+
+func (a *AccountAsOf) formatMoney(locale string) {
+	a.BalanceFormatted = formatMoney(a.Balance, a.Currency, locale)
+}
+
+// AccountHistoryStorage holds the storage operations behind the as-of view.
+type AccountHistoryStorage interface {
+	GetAccountProfile(id int) (*accountProfile, error)
+	GetAuditEntriesSince(tenantID int, entityType string, entityID int, since time.Time) ([]*auditEntry, error)
+}
+
+// GetAccountProfile retrieves the current profile of an account.
+func (s *PostgresStorage) GetAccountProfile(id int) (*accountProfile, error) {
+	p := &accountProfile{}
+	err := s.db.QueryRow("SELECT email, COALESCE(name, ''), COALESCE(number, ''), role, currency, locale FROM accounts WHERE id = $1", id).
+		Scan(&p.Email, &p.Name, &p.Number, &p.Role, &p.Currency, &p.Locale)
+	return p, err
+}
+
+// GetAuditEntriesSince returns the audit trail of an entity after a time,
+// newest first.
+func (s *PostgresStorage) GetAuditEntriesSince(tenantID int, entityType string, entityID int, since time.Time) ([]*auditEntry, error) {
+	rows, err := s.db.Query(
+		"SELECT id, tenant_id, actor_id, action, entity_type, entity_id, details, created_at FROM audit_log WHERE tenant_id = $1 AND entity_type = $2 AND entity_id = $3 AND created_at > $4 ORDER BY created_at DESC, id DESC",
+		tenantID, entityType, entityID, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*auditEntry, 0)
+	for rows.Next() {
+		e := &auditEntry{}
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.TenantID, &e.ActorID, &e.Action, &e.EntityType, &e.EntityID, &details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Details = details
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// undo reverts the profile fields changed by an account.updated entry.
+func (p *accountProfile) undo(changes map[string]fieldChange) {
+	fields := map[string]*string{
+		"email": &p.Email, "name": &p.Name, "number": &p.Number,
+		"role": &p.Role, "currency": &p.Currency, "locale": &p.Locale,
+	}
+	for name, c := range changes {
+		if f, ok := fields[name]; ok {
+			*f = c.From
+		}
+	}
+}
+
+// handleAccountAsOf reconstructs an account as it was at ?ts= (RFC 3339) for
+// compliance investigations: the current profile with every audited change
+// made since undone, and the balance from the ledger. Changes made before
+// they were audited cannot be undone.
+func (s *Apiserver) handleAccountAsOf(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	tenantID := requestTenant(r).ID
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != tenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	v := r.URL.Query().Get("ts")
+	at, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_timestamp", v)
+	}
+
+	profile, err := s.store.GetAccountProfile(id)
+	if err != nil {
+		return err
+	}
+	entries, err := s.store.GetAuditEntriesSince(tenantID, "account", id, at)
+	if err != nil {
+		return err
+	}
+	asOf := &AccountAsOf{AccountID: id, At: at}
+	for _, e := range entries {
+		switch e.Action {
+		case "account.created":
+			return newAPIError(http.StatusNotFound, "account_not_opened", id, at.Format(time.RFC3339))
+		case "account.updated":
+			changes := map[string]fieldChange{}
+			if err := json.Unmarshal(e.Details, &changes); err != nil {
+				return err
+			}
+			profile.undo(changes)
+			asOf.ChangesUndone++
+		}
+	}
+	asOf.accountProfile = *profile
+	if asOf.Balance, err = s.store.GetBalanceAt(id, at); err != nil {
+		return err
+	}
+	s.audit(r, "account.viewed_as_of", "account", id, map[string]time.Time{"at": at})
+	return s.writeLocalizedJSON(w, r, http.StatusOK, asOf)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const createAccountActivityTable = `
+        CREATE TABLE IF NOT EXISTS account_activity (
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            day DATE NOT NULL,
+            endpoint TEXT NOT NULL,
+            count INT NOT NULL,
+            last_at TIMESTAMPTZ NOT NULL,
+            PRIMARY KEY (account_id, day, endpoint)
+        )
+    `
+
+// activityLogin is the endpoint under which sign-ins are counted. Every
+// other endpoint is a method and route template, such as
+// GET /account/{id}/transactions.
+const activityLogin = "login"
+
+// Activity windows, in days, and the number of rows in admin rankings.
+const (
+	defaultActivityDays = 30
+	maxActivityDays     = 90
+	activityTop         = 20
+)
+
+// activityCount is how often an account used an endpoint on one day.
+type activityCount struct {
+	Day      time.Time
+	Endpoint string
+	Count    int
+	LastAt   time.Time
+}
+
+type endpointActivity struct {
+	Endpoint string    `json:"endpoint"`
+	Count    int       `json:"count"`
+	Accounts int       `json:"accounts,omitempty"`
+	LastAt   time.Time `json:"last_at"`
+}
+
+type activityDay struct {
+	Day            string `json:"day"`
+	ActiveAccounts int    `json:"active_accounts,omitempty"`
+	Requests       int    `json:"requests"`
+	Logins         int    `json:"logins"`
+}
+
+// accountActivity sums up an account's use of the API over a window.
+type accountActivity struct {
+	AccountID    int                 `json:"account_id"`
+	Days         int                 `json:"days"`
+	LastActiveAt *time.Time          `json:"last_active_at"`
+	LastLoginAt  *time.Time          `json:"last_login_at"`
+	Logins       int                 `json:"logins"`
+	Requests     int                 `json:"requests"`
+	Endpoints    []*endpointActivity `json:"endpoints"`
+	Daily        []*activityDay      `json:"daily"`
+}
+
+type activeAccount struct {
+	AccountID    int       `json:"account_id"`
+	Email        string    `json:"email"`
+	Requests     int       `json:"requests"`
+	Logins       int       `json:"logins"`
+	LastActiveAt time.Time `json:"last_active_at"`
+}
+
+// tenantActivity sums up the use of the API by a tenant's accounts.
+type tenantActivity struct {
+	Days         int                 `json:"days"`
+	Daily        []*activityDay      `json:"daily"`
+	TopEndpoints []*endpointActivity `json:"top_endpoints"`
+	MostActive   []*activeAccount    `json:"most_active"`
+}
+
+// ActivityStorage holds the per-account API activity counters.
+type ActivityStorage interface {
+	RecordAccountActivity(accountID int, endpoint string, at time.Time) error
+	GetAccountActivity(accountID int, since time.Time) ([]*activityCount, error)
+	GetTenantActivity(tenantID int, since time.Time, top int) (*tenantActivity, error)
+}
+
+// RecordAccountActivity counts one use of an endpoint by an account on the
+// UTC day of at.
+func (s *PostgresStorage) RecordAccountActivity(accountID int, endpoint string, at time.Time) error {
+	_, err := s.db.Exec(`
+        INSERT INTO account_activity (account_id, day, endpoint, count, last_at) VALUES ($1, $2, $3, 1, $4)
+        ON CONFLICT (account_id, day, endpoint) DO UPDATE SET count = account_activity.count + 1, last_at = GREATEST(account_activity.last_at, EXCLUDED.last_at)`,
+		accountID, at.UTC().Format(time.DateOnly), endpoint, at)
+	return err
+}
+
+// GetAccountActivity returns an account's counters from the day of since
+// on, oldest day first.
+func (s *PostgresStorage) GetAccountActivity(accountID int, since time.Time) ([]*activityCount, error) {
+	rows, err := s.db.Query(`
+        SELECT day, endpoint, count, last_at FROM account_activity
+        WHERE account_id = $1 AND day >= $2
+        ORDER BY day, endpoint`,
+		accountID, since.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]*activityCount, 0)
+	for rows.Next() {
+		c := &activityCount{}
+		if err := rows.Scan(&c.Day, &c.Endpoint, &c.Count, &c.LastAt); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// GetTenantActivity sums up the counters of the tenant's accounts from the
+// day of since on: per day, and the top endpoints and accounts by requests.
+func (s *PostgresStorage) GetTenantActivity(tenantID int, since time.Time, top int) (*tenantActivity, error) {
+	day := since.UTC().Format(time.DateOnly)
+	activity := &tenantActivity{Daily: make([]*activityDay, 0), TopEndpoints: make([]*endpointActivity, 0), MostActive: make([]*activeAccount, 0)}
+
+	rows, err := s.db.Query(`
+        SELECT v.day, COUNT(DISTINCT v.account_id),
+            COALESCE(SUM(v.count) FILTER (WHERE v.endpoint <> $3), 0),
+            COALESCE(SUM(v.count) FILTER (WHERE v.endpoint = $3), 0)
+        FROM account_activity v JOIN accounts a ON a.id = v.account_id
+        WHERE a.tenant_id = $1 AND v.day >= $2
+        GROUP BY v.day ORDER BY v.day`,
+		tenantID, day, activityLogin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := &activityDay{}
+		var date time.Time
+		if err := rows.Scan(&date, &d.ActiveAccounts, &d.Requests, &d.Logins); err != nil {
+			return nil, err
+		}
+		d.Day = date.Format(time.DateOnly)
+		activity.Daily = append(activity.Daily, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`
+        SELECT v.endpoint, SUM(v.count), COUNT(DISTINCT v.account_id), MAX(v.last_at)
+        FROM account_activity v JOIN accounts a ON a.id = v.account_id
+        WHERE a.tenant_id = $1 AND v.day >= $2 AND v.endpoint <> $3
+        GROUP BY v.endpoint ORDER BY 2 DESC, 1 LIMIT $4`,
+		tenantID, day, activityLogin, top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &endpointActivity{}
+		if err := rows.Scan(&e.Endpoint, &e.Count, &e.Accounts, &e.LastAt); err != nil {
+			return nil, err
+		}
+		activity.TopEndpoints = append(activity.TopEndpoints, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`
+        SELECT a.id, a.email,
+            COALESCE(SUM(v.count) FILTER (WHERE v.endpoint <> $3), 0),
+            COALESCE(SUM(v.count) FILTER (WHERE v.endpoint = $3), 0),
+            MAX(v.last_at)
+        FROM account_activity v JOIN accounts a ON a.id = v.account_id
+        WHERE a.tenant_id = $1 AND v.day >= $2
+        GROUP BY a.id ORDER BY 3 DESC, 1 LIMIT $4`,
+		tenantID, day, activityLogin, top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := &activeAccount{}
+		if err := rows.Scan(&a.AccountID, &a.Email, &a.Requests, &a.Logins, &a.LastActiveAt); err != nil {
+			return nil, err
+		}
+		activity.MostActive = append(activity.MostActive, a)
+	}
+	return activity, rows.Err()
+}
+
+// activityRecorder counts an authenticated request towards its caller's
+// activity. activityMiddleware hands it to authenticate through the
+// request context.
+type activityRecorder func(r *http.Request, claims jwt.MapClaims)
+
+const activityContextKey contextKey = "activity"
+
+func (s *Apiserver) activityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), activityContextKey, activityRecorder(s.recordRequest))))
+	})
+}
+
+// trackActivity counts a request authenticated with claims, if the
+// server tracks activity.
+func trackActivity(r *http.Request, claims jwt.MapClaims) {
+	if record, ok := r.Context().Value(activityContextKey).(activityRecorder); ok {
+		record(r, claims)
+	}
+}
+
+// recordRequest counts a request under its method and route template.
+// Failing to count it does not fail the request.
+func (s *Apiserver) recordRequest(r *http.Request, claims jwt.MapClaims) {
+	sub, _ := claims["sub"].(string)
+	accountID, err := strconv.Atoi(sub)
+	if err != nil {
+		return
+	}
+	s.recordActivity(accountID, r.Method+" "+quotaScope(r))
+}
+
+func (s *Apiserver) recordActivity(accountID int, endpoint string) {
+	if err := s.store.RecordAccountActivity(accountID, endpoint, clock.Now()); err != nil {
+		logf("activity: account %d: %v\n", accountID, err)
+	}
+}
+
+// activityDays reads the ?days= window of the activity endpoints.
+func activityDays(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("days")
+	if v == "" {
+		return defaultActivityDays, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 1 || days > maxActivityDays {
+		return 0, newAPIError(http.StatusBadRequest, "invalid_activity_days", v, maxActivityDays)
+	}
+	return days, nil
+}
+
+// activitySince is the first day of a window of days ending today.
+func activitySince(days int) time.Time {
+	return clock.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+}
+
+// accountActivityOver sums up an account's activity over the last days.
+func (s *Apiserver) accountActivityOver(accountID, days int) (*accountActivity, error) {
+	counts, err := s.store.GetAccountActivity(accountID, activitySince(days))
+	if err != nil {
+		return nil, err
+	}
+	activity := &accountActivity{AccountID: accountID, Days: days, Endpoints: make([]*endpointActivity, 0), Daily: make([]*activityDay, 0)}
+	endpoints := map[string]*endpointActivity{}
+	var day *activityDay
+	for _, c := range counts {
+		if activity.LastActiveAt == nil || c.LastAt.After(*activity.LastActiveAt) {
+			activity.LastActiveAt = &c.LastAt
+		}
+		if date := c.Day.Format(time.DateOnly); day == nil || day.Day != date {
+			day = &activityDay{Day: date}
+			activity.Daily = append(activity.Daily, day)
+		}
+		if c.Endpoint == activityLogin {
+			activity.Logins += c.Count
+			day.Logins += c.Count
+			if activity.LastLoginAt == nil || c.LastAt.After(*activity.LastLoginAt) {
+				activity.LastLoginAt = &c.LastAt
+			}
+			continue
+		}
+		activity.Requests += c.Count
+		day.Requests += c.Count
+		e, ok := endpoints[c.Endpoint]
+		if !ok {
+			e = &endpointActivity{Endpoint: c.Endpoint}
+			endpoints[c.Endpoint] = e
+			activity.Endpoints = append(activity.Endpoints, e)
+		}
+		e.Count += c.Count
+		if c.LastAt.After(e.LastAt) {
+			e.LastAt = c.LastAt
+		}
+	}
+	slices.SortFunc(activity.Endpoints, func(a, b *endpointActivity) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Endpoint, b.Endpoint))
+	})
+	return activity, nil
+}
+
+// handleMyActivity shows the caller when and how they used the API over
+// the last ?days= (30 by default): sign-ins, requests per endpoint and
+// per day.
+func (s *Apiserver) handleMyActivity(w http.ResponseWriter, r *http.Request) error {
+	days, err := activityDays(r)
+	if err != nil {
+		return err
+	}
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	activity, err := s.accountActivityOver(caller.ID, days)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, activity)
+}
+
+// handleAccountActivity shows an admin the activity of one of the
+// tenant's accounts, as the account holder sees it in /me/activity.
+func (s *Apiserver) handleAccountActivity(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	days, err := activityDays(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != requestTenant(r).ID {
+		return newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	activity, err := s.accountActivityOver(acc.ID, days)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, activity)
+}
+
+// handleTenantActivity sums up how the tenant's accounts used the API over
+// the last ?days=: active accounts, requests and sign-ins per day, and the
+// busiest endpoints and accounts.
+func (s *Apiserver) handleTenantActivity(w http.ResponseWriter, r *http.Request) error {
+	days, err := activityDays(r)
+	if err != nil {
+		return err
+	}
+	activity, err := s.store.GetTenantActivity(requestTenant(r).ID, activitySince(days), activityTop)
+	if err != nil {
+		return err
+	}
+	activity.Days = days
+	return writeJSON(w, http.StatusOK, activity)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createAdjustmentsTable = `
+        CREATE TABLE IF NOT EXISTS adjustments (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL DEFAULT 1,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL,
+            reason_code TEXT NOT NULL,
+            note TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'pending',
+            maker_id INT NOT NULL REFERENCES accounts(id),
+            ledger_entry_id INT REFERENCES ledger_entries(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            decided_at TIMESTAMPTZ
+        )
+    `
+
+const createAdjustmentApprovalsTable = `
+        CREATE TABLE IF NOT EXISTS adjustment_approvals (
+            adjustment_id INT NOT NULL REFERENCES adjustments(id) ON DELETE CASCADE,
+            admin_id INT NOT NULL REFERENCES accounts(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (adjustment_id, admin_id)
+        )
+    `
+
+const (
+	adjustmentPending  = "pending"
+	adjustmentPosted   = "posted"
+	adjustmentRejected = "rejected"
+)
+
+// adjustmentRequiredApprovals is the number of distinct admins that must
+// approve an adjustment before it is posted. The maker's submission counts
+// as the first approval, so at least one other admin has to check it.
+const adjustmentRequiredApprovals = 2
+
+// adjustmentReasons are the reason codes accepted for manual adjustments.
+var adjustmentReasons = map[string]bool{
+	"fee_reversal":        true,
+	"interest_correction": true,
+	"chargeback":          true,
+	"operational_error":   true,
+	"goodwill":            true,
+}
+
+var (
+	errAdjustmentDecided   = errors.New("adjustment has already been decided")
+	errAdjustmentDuplicate = errors.New("admin has already approved this adjustment")
+)
+
+// adjustment is a manual credit (positive amount) or debit (negative amount)
+// waiting for, or posted after, maker-checker approval.
+type adjustment struct {
+	ID            int        `json:"id"`
+	TenantID      int        `json:"tenant_id"`
+	AccountID     int        `json:"account_id"`
+	Amount        int        `json:"amount"`
+	ReasonCode    string     `json:"reason_code"`
+	Note          string     `json:"note"`
+	Status        string     `json:"status"`
+	MakerID       int        `json:"maker_id"`
+	ApproverIDs   []int      `json:"approver_ids"`
+	LedgerEntryID *int       `json:"ledger_entry_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+}
+
+type CreateAdjustmentRequest struct {
+	AccountID  int    `json:"account_id"`
+	Amount     int    `json:"amount"`
+	ReasonCode string `json:"reason_code"`
+	Note       string `json:"note"`
+}
+
+// AdjustmentStorage holds the balance adjustment storage operations.
+type AdjustmentStorage interface {
+	CreateAdjustment(*adjustment) error
+	GetAdjustment(int) (*adjustment, error)
+	GetAdjustments(tenantID int, status string, page pageRequest) ([]*adjustment, int, error)
+	ApproveAdjustment(id, adminID int) (*adjustment, error)
+	RejectAdjustment(int) (*adjustment, error)
+}
+
+// CreateAdjustment inserts a pending adjustment with the maker's approval.
+func (s *PostgresStorage) CreateAdjustment(a *adjustment) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO adjustments (tenant_id, account_id, amount, reason_code, note, maker_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, status, created_at",
+		a.TenantID, a.AccountID, a.Amount, a.ReasonCode, a.Note, a.MakerID,
+	).Scan(&a.ID, &a.Status, &a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO adjustment_approvals (adjustment_id, admin_id) VALUES ($1, $2)", a.ID, a.MakerID); err != nil {
+		return err
+	}
+	a.ApproverIDs = []int{a.MakerID}
+	return tx.Commit()
+}
+
+// GetAdjustment retrieves an adjustment and its approvers by ID.
+func (s *PostgresStorage) GetAdjustment(id int) (*adjustment, error) {
+	return getAdjustment(s.db, id)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(string, ...any) *sql.Row
+	Query(string, ...any) (*sql.Rows, error)
+}
+
+const selectAdjustments = `
+        SELECT a.id, a.tenant_id, a.account_id, a.amount, a.reason_code, a.note, a.status, a.maker_id,
+               a.ledger_entry_id, a.created_at, a.decided_at,
+               COALESCE(array_agg(p.admin_id ORDER BY p.created_at) FILTER (WHERE p.admin_id IS NOT NULL), '{}')
+        FROM adjustments a
+        LEFT JOIN adjustment_approvals p ON p.adjustment_id = a.id
+    `
+
+func scanAdjustment(row interface{ Scan(...any) error }) (*adjustment, error) {
+	a := &adjustment{}
+	var ledgerEntryID sql.NullInt64
+	var approvers []int64
+	err := row.Scan(&a.ID, &a.TenantID, &a.AccountID, &a.Amount, &a.ReasonCode, &a.Note, &a.Status, &a.MakerID,
+		&ledgerEntryID, &a.CreatedAt, &a.DecidedAt, pq.Array(&approvers))
+	if err != nil {
+		return nil, err
+	}
+	if ledgerEntryID.Valid {
+		entryID := int(ledgerEntryID.Int64)
+		a.LedgerEntryID = &entryID
+	}
+	for _, approver := range approvers {
+		a.ApproverIDs = append(a.ApproverIDs, int(approver))
+	}
+	return a, nil
+}
+
+func getAdjustment(q queryer, id int) (*adjustment, error) {
+	return scanAdjustment(q.QueryRow(selectAdjustments+" WHERE a.id = $1 GROUP BY a.id", id))
+}
+
+// GetAdjustments returns a page of a tenant's adjustments, optionally
+// filtered by status, newest first.
+func (s *PostgresStorage) GetAdjustments(tenantID int, status string, page pageRequest) ([]*adjustment, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM adjustments WHERE tenant_id = $1 AND ($2 = '' OR status = $2)", tenantID, status)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(3, "a")
+	rows, err := s.db.Query(selectAdjustments+" WHERE a.tenant_id = $1 AND ($2 = '' OR a.status = $2) AND "+cond+" GROUP BY a.id "+order, append([]any{tenantID, status}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	adjustments := make([]*adjustment, 0)
+	for rows.Next() {
+		a, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		adjustments = append(adjustments, a)
+	}
+	return adjustments, total, rows.Err()
+}
+
+// ApproveAdjustment records an admin's approval and, once enough distinct
+// admins have approved, posts the adjustment to the ledger in the same
+// transaction.
+func (s *PostgresStorage) ApproveAdjustment(id, adminID int) (*adjustment, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT 1 FROM adjustments WHERE id = $1 FOR UPDATE", id); err != nil {
+		return nil, err
+	}
+	a, err := getAdjustment(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if a.Status != adjustmentPending {
+		return nil, errAdjustmentDecided
+	}
+	for _, approver := range a.ApproverIDs {
+		if approver == adminID {
+			return nil, errAdjustmentDuplicate
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO adjustment_approvals (adjustment_id, admin_id) VALUES ($1, $2)", id, adminID); err != nil {
+		return nil, err
+	}
+	a.ApproverIDs = append(a.ApproverIDs, adminID)
+
+	if len(a.ApproverIDs) >= adjustmentRequiredApprovals {
+		entry := &ledgerEntry{
+			AccountID:   a.AccountID,
+			Amount:      a.Amount,
+			Kind:        entryAdjustment,
+			Description: fmt.Sprintf("Manual adjustment #%d (%s)", a.ID, a.ReasonCode),
+		}
+		if err := postEntries(tx, entry); err != nil {
+			return nil, err
+		}
+		err = tx.QueryRow(
+			"UPDATE adjustments SET status = $1, ledger_entry_id = $2, decided_at = now() WHERE id = $3 RETURNING decided_at",
+			adjustmentPosted, entry.ID, id,
+		).Scan(&a.DecidedAt)
+		if err != nil {
+			return nil, err
+		}
+		a.Status, a.LedgerEntryID = adjustmentPosted, &entry.ID
+	}
+	return a, tx.Commit()
+}
+
+// RejectAdjustment closes a pending adjustment without posting it.
+func (s *PostgresStorage) RejectAdjustment(id int) (*adjustment, error) {
+	res, err := s.db.Exec("UPDATE adjustments SET status = $1, decided_at = now() WHERE id = $2 AND status = $3", adjustmentRejected, id, adjustmentPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errAdjustmentDecided
+	}
+	return s.GetAdjustment(id)
+}
+
+// handleAdjustments lists (GET, ?status=) or submits (POST) manual adjustments.
+func (s *Apiserver) handleAdjustments(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		adjustments, total, err := s.store.GetAdjustments(requestTenant(r).ID, r.URL.Query().Get("status"), page)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, paginate(adjustments, total, page, func(a *adjustment) cursor { return cursor{a.CreatedAt, a.ID} }))
+	}
+
+	maker, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := CreateAdjustmentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Amount == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "amount")
+	}
+	if !adjustmentReasons[req.ReasonCode] {
+		return newAPIError(http.StatusBadRequest, "unknown_reason_code", req.ReasonCode)
+	}
+	acc, err := s.store.GetAccountByID(req.AccountID)
+	if err != nil || acc.TenantID != maker.TenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", req.AccountID)
+	}
+
+	a := &adjustment{
+		TenantID:   maker.TenantID,
+		AccountID:  req.AccountID,
+		Amount:     req.Amount,
+		ReasonCode: req.ReasonCode,
+		Note:       req.Note,
+		MakerID:    maker.ID,
+	}
+	if err := s.store.CreateAdjustment(a); err != nil {
+		return err
+	}
+	s.audit(r, "adjustment.created", "adjustment", a.ID, a)
+	return writeJSON(w, http.StatusCreated, a)
+}
+
+// handleApproveAdjustment adds the caller's approval to an adjustment.
+func (s *Apiserver) handleApproveAdjustment(w http.ResponseWriter, r *http.Request) error {
+	id, admin, err := s.loadAdjustmentDecision(r)
+	if err != nil {
+		return err
+	}
+	a, err := s.store.ApproveAdjustment(id, admin.ID)
+	if errors.Is(err, errAdjustmentDecided) || errors.Is(err, errAdjustmentDuplicate) {
+		return newAPIError(http.StatusConflict, "adjustment_conflict", err.Error())
+	}
+	if err != nil {
+		return transferFailed(err)
+	}
+
+	s.audit(r, "adjustment.approved", "adjustment", a.ID, a)
+	if a.Status == adjustmentPosted {
+		s.audit(r, "adjustment.posted", "adjustment", a.ID, a)
+		s.notifyAdjustment(a)
+		s.checkBalanceAlerts(a.AccountID)
+	}
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// notifyAdjustment tells the account holder of a posted adjustment, in the
+// account's currency and locale.
+func (s *Apiserver) notifyAdjustment(a *adjustment) {
+	acc, err := s.store.GetAccountContact(a.AccountID)
+	if err != nil {
+		logf("failed to load account %d for its adjustment notice: %v\n", a.AccountID, err)
+		s.notify(a.AccountID, "balance_adjusted", fmt.Sprintf("Your balance was adjusted (%s)", a.ReasonCode))
+		return
+	}
+	amount := formatMoney(a.Amount, acc.Currency, cmp.Or(acc.Locale, defaultLocale))
+	s.notify(a.AccountID, "balance_adjusted", fmt.Sprintf("Your balance was adjusted by %s (%s)", amount, a.ReasonCode))
+}
+
+// handleRejectAdjustment rejects a pending adjustment.
+func (s *Apiserver) handleRejectAdjustment(w http.ResponseWriter, r *http.Request) error {
+	id, _, err := s.loadAdjustmentDecision(r)
+	if err != nil {
+		return err
+	}
+	a, err := s.store.RejectAdjustment(id)
+	if errors.Is(err, errAdjustmentDecided) {
+		return newAPIError(http.StatusConflict, "adjustment_conflict", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(r, "adjustment.rejected", "adjustment", a.ID, a)
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// loadAdjustmentDecision resolves the adjustment in the path and the deciding admin.
+func (s *Apiserver) loadAdjustmentDecision(r *http.Request) (int, *account, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	admin, err := s.currentAccount(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	a, err := s.store.GetAdjustment(id)
+	if err != nil || a.TenantID != admin.TenantID {
+		return 0, nil, newAPIError(http.StatusNotFound, "adjustment_not_found", id)
+	}
+	return id, admin, nil
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createExternalLinksTable = `
+        CREATE TABLE IF NOT EXISTS external_links (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            provider TEXT NOT NULL,
+            institution TEXT NOT NULL,
+            access_token TEXT NOT NULL,
+            last_synced_at TIMESTAMPTZ,
+            sync_error TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createExternalAccountsTable = `
+        CREATE TABLE IF NOT EXISTS external_accounts (
+            id SERIAL PRIMARY KEY,
+            link_id INT NOT NULL REFERENCES external_links(id) ON DELETE CASCADE,
+            external_id TEXT NOT NULL,
+            name TEXT NOT NULL,
+            currency TEXT NOT NULL,
+            balance INT NOT NULL,
+            UNIQUE (link_id, external_id)
+        )
+    `
+
+// external_transactions.created_at is when the provider booked the
+// transaction, not when it was synced.
+const createExternalTransactionsTable = `
+        CREATE TABLE IF NOT EXISTS external_transactions (
+            id SERIAL PRIMARY KEY,
+            external_account_id INT NOT NULL REFERENCES external_accounts(id) ON DELETE CASCADE,
+            external_id TEXT NOT NULL,
+            amount INT NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL,
+            UNIQUE (external_account_id, external_id)
+        )
+    `
+
+// externalHistory is how far back the first sync of a link fetches
+// transactions.
+const externalHistory = 90 * 24 * time.Hour
+
+// externalLink is a customer's connection to another bank through an
+// aggregation provider. Its accounts are shown read-only: no money moves
+// through them.
+type externalLink struct {
+	ID           int                `json:"id"`
+	AccountID    int                `json:"account_id"`
+	Provider     string             `json:"provider"`
+	Institution  string             `json:"institution"`
+	LastSyncedAt *time.Time         `json:"last_synced_at,omitempty"`
+	SyncError    string             `json:"sync_error,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+	Accounts     []*externalAccount `json:"accounts"`
+
+	accessToken string
+}
+
+// externalAccount is an account held at another bank, as of the last sync.
+type externalAccount struct {
+	ID         int    `json:"id"`
+	LinkID     int    `json:"link_id"`
+	ExternalID string `json:"external_id"`
+	Name       string `json:"name"`
+	Currency   string `json:"currency"`
+	Balance    int    `json:"balance"`
+}
+
+type externalTransaction struct {
+	ID                int       `json:"id"`
+	ExternalAccountID int       `json:"external_account_id"`
+	ExternalID        string    `json:"external_id"`
+	Amount            int       `json:"amount"`
+	Description       string    `json:"description"`
+	CreatedAt         time.Time `json:"created_at"`
+
+	accountExternalID string // provider's ID of the account, see SaveExternalSync
+}
+
+type LinkExternalRequest struct {
+	Token string `json:"token"`
+}
+
+// AccountAggregator reads accounts held at other banks through an
+// aggregation provider. The server uses a mock provider unless a real one
+// is plugged in.
+type AccountAggregator interface {
+	Provider() string
+	// Institution names the bank a link token grants access to.
+	Institution(token string) (string, error)
+	// Accounts lists the accounts a link token grants access to, with
+	// their current balances.
+	Accounts(token string) ([]*externalAccount, error)
+	// Transactions lists the transactions of one of those accounts booked
+	// since the given time.
+	Transactions(token, externalID string, since time.Time) ([]*externalTransaction, error)
+}
+
+var errInvalidLinkToken = errors.New("invalid link token")
+
+// mockAggregator links two made-up accounts for any token starting with
+// "mock_", with balances derived from the token and one card payment a day.
+type mockAggregator struct{}
+
+func (mockAggregator) Provider() string { return "mock" }
+
+func (mockAggregator) Institution(token string) (string, error) {
+	if !strings.HasPrefix(token, "mock_") {
+		return "", errInvalidLinkToken
+	}
+	return "Mock Bank", nil
+}
+
+func (mockAggregator) Accounts(token string) ([]*externalAccount, error) {
+	if !strings.HasPrefix(token, "mock_") {
+		return nil, errInvalidLinkToken
+	}
+	sum := sha256.Sum256([]byte(token))
+	seed := int(binary.BigEndian.Uint16(sum[:]))
+	return []*externalAccount{
+		{ExternalID: "chk", Name: "Mock Checking", Currency: defaultCurrency, Balance: 100000 + seed},
+		{ExternalID: "sav", Name: "Mock Savings", Currency: defaultCurrency, Balance: 1000000 + seed*10},
+	}, nil
+}
+
+func (mockAggregator) Transactions(token, externalID string, since time.Time) ([]*externalTransaction, error) {
+	if !strings.HasPrefix(token, "mock_") {
+		return nil, errInvalidLinkToken
+	}
+	txns := make([]*externalTransaction, 0)
+	if externalID != "chk" {
+		return txns, nil
+	}
+	for day := since.UTC().Truncate(24 * time.Hour).Add(12 * time.Hour); day.Before(clock.Now()); day = day.AddDate(0, 0, 1) {
+		if day.Before(since) {
+			continue
+		}
+		txns = append(txns, &externalTransaction{
+			ExternalID:  day.Format("20060102"),
+			Amount:      -450,
+			Description: "CARD Mock Coffee",
+			CreatedAt:   day,
+		})
+	}
+	return txns, nil
+}
+
+// AggregationStorage holds the external account storage operations.
+type AggregationStorage interface {
+	CreateExternalLink(*externalLink) error
+	GetExternalLinks(accountID int) ([]*externalLink, error)
+	GetTenantExternalLinks(tenantID int) ([]*externalLink, error)
+	DeleteExternalLink(accountID, id int) error
+	SaveExternalSync(l *externalLink, accounts []*externalAccount, txns []*externalTransaction, syncErr string) error
+	GetExternalTransactions(accountID, externalAccountID int, page pageRequest) ([]*externalTransaction, int, error)
+}
+
+// CreateExternalLink stores a new link; its accounts are added by its
+// first sync.
+func (s *PostgresStorage) CreateExternalLink(l *externalLink) error {
+	return s.db.QueryRow(
+		"INSERT INTO external_links (account_id, provider, institution, access_token) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		l.AccountID, l.Provider, l.Institution, l.accessToken,
+	).Scan(&l.ID, &l.CreatedAt)
+}
+
+// GetExternalLinks lists an account's links with their accounts.
+func (s *PostgresStorage) GetExternalLinks(accountID int) ([]*externalLink, error) {
+	return s.queryExternalLinks("l.account_id = $1", accountID)
+}
+
+// GetTenantExternalLinks lists every link of a tenant's accounts, for the
+// sync job.
+func (s *PostgresStorage) GetTenantExternalLinks(tenantID int) ([]*externalLink, error) {
+	return s.queryExternalLinks("l.account_id IN (SELECT id FROM accounts WHERE tenant_id = $1)", tenantID)
+}
+
+func (s *PostgresStorage) queryExternalLinks(where string, arg any) ([]*externalLink, error) {
+	rows, err := s.db.Query(`
+        SELECT l.id, l.account_id, l.provider, l.institution, l.access_token, l.last_synced_at, l.sync_error, l.created_at,
+            a.id, a.external_id, a.name, a.currency, a.balance
+        FROM external_links l LEFT JOIN external_accounts a ON a.link_id = l.id
+        WHERE `+where+`
+        ORDER BY l.id, a.id`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]*externalLink, 0)
+	for rows.Next() {
+		l := &externalLink{}
+		var id sql.NullInt64
+		var externalID, name, currency sql.NullString
+		var balance sql.NullInt64
+		if err := rows.Scan(&l.ID, &l.AccountID, &l.Provider, &l.Institution, &l.accessToken, &l.LastSyncedAt, &l.SyncError, &l.CreatedAt,
+			&id, &externalID, &name, &currency, &balance); err != nil {
+			return nil, err
+		}
+		if n := len(links); n > 0 && links[n-1].ID == l.ID {
+			l = links[n-1]
+		} else {
+			l.Accounts = make([]*externalAccount, 0)
+			links = append(links, l)
+		}
+		if id.Valid {
+			l.Accounts = append(l.Accounts, &externalAccount{ID: int(id.Int64), LinkID: l.ID, ExternalID: externalID.String, Name: name.String, Currency: currency.String, Balance: int(balance.Int64)})
+		}
+	}
+	return links, rows.Err()
+}
+
+// DeleteExternalLink removes one of an account's links with its accounts
+// and their transactions.
+func (s *PostgresStorage) DeleteExternalLink(accountID, id int) error {
+	res, err := s.db.Exec("DELETE FROM external_links WHERE id = $1 AND account_id = $2", id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SaveExternalSync records the outcome of syncing a link: on success the
+// accounts are added or their balances refreshed and the transactions not
+// seen before stored; on failure only the error is kept, leaving the last
+// synced data in place.
+func (s *PostgresStorage) SaveExternalSync(l *externalLink, accounts []*externalAccount, txns []*externalTransaction, syncErr string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if syncErr != "" {
+		if _, err := tx.Exec("UPDATE external_links SET sync_error = $2 WHERE id = $1", l.ID, syncErr); err != nil {
+			return err
+		}
+		l.SyncError = syncErr
+		return tx.Commit()
+	}
+
+	ids := make(map[string]int, len(accounts))
+	for _, a := range accounts {
+		a.LinkID = l.ID
+		err := tx.QueryRow(`
+            INSERT INTO external_accounts (link_id, external_id, name, currency, balance) VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (link_id, external_id) DO UPDATE SET name = EXCLUDED.name, currency = EXCLUDED.currency, balance = EXCLUDED.balance
+            RETURNING id`,
+			l.ID, a.ExternalID, a.Name, a.Currency, a.Balance,
+		).Scan(&a.ID)
+		if err != nil {
+			return err
+		}
+		ids[a.ExternalID] = a.ID
+	}
+	for _, t := range txns {
+		t.ExternalAccountID = ids[t.accountExternalID]
+		_, err := tx.Exec(`
+            INSERT INTO external_transactions (external_account_id, external_id, amount, description, created_at) VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (external_account_id, external_id) DO NOTHING`,
+			t.ExternalAccountID, t.ExternalID, t.Amount, t.Description, t.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow("UPDATE external_links SET last_synced_at = now(), sync_error = '' WHERE id = $1 RETURNING last_synced_at", l.ID).Scan(&l.LastSyncedAt)
+	if err != nil {
+		return err
+	}
+	l.Accounts, l.SyncError = accounts, ""
+	return tx.Commit()
+}
+
+// GetExternalTransactions lists the transactions of an external account
+// linked by the account, newest first. It returns sql.ErrNoRows if the
+// account did not link it.
+func (s *PostgresStorage) GetExternalTransactions(accountID, externalAccountID int, page pageRequest) ([]*externalTransaction, int, error) {
+	var linked bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM external_accounts a JOIN external_links l ON l.id = a.link_id WHERE a.id = $1 AND l.account_id = $2)",
+		externalAccountID, accountID,
+	).Scan(&linked)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !linked {
+		return nil, 0, sql.ErrNoRows
+	}
+	total, err := s.count("SELECT COUNT(*) FROM external_transactions WHERE external_account_id = $1", externalAccountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	rows, err := s.db.Query(
+		"SELECT id, external_account_id, external_id, amount, description, created_at FROM external_transactions WHERE external_account_id = $1 AND "+cond+" "+order,
+		append([]any{externalAccountID}, args...)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	txns := make([]*externalTransaction, 0)
+	for rows.Next() {
+		t := &externalTransaction{}
+		if err := rows.Scan(&t.ID, &t.ExternalAccountID, &t.ExternalID, &t.Amount, &t.Description, &t.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		txns = append(txns, t)
+	}
+	return txns, total, rows.Err()
+}
+
+// syncExternalLink fetches the balances of a link's accounts and their
+// transactions since the last sync from the provider.
+func (s *Apiserver) syncExternalLink(l *externalLink) error {
+	since := l.CreatedAt.Add(-externalHistory)
+	if l.LastSyncedAt != nil {
+		since = *l.LastSyncedAt
+	}
+	accounts, err := s.aggregator.Accounts(l.accessToken)
+	var txns []*externalTransaction
+	for _, a := range accounts {
+		if err != nil {
+			break
+		}
+		var fetched []*externalTransaction
+		fetched, err = s.aggregator.Transactions(l.accessToken, a.ExternalID, since)
+		for _, t := range fetched {
+			t.accountExternalID = a.ExternalID
+		}
+		txns = append(txns, fetched...)
+	}
+	if err != nil {
+		logf("aggregation: link %d failed to sync: %v\n", l.ID, err)
+		return s.store.SaveExternalSync(l, nil, nil, err.Error())
+	}
+	return s.store.SaveExternalSync(l, accounts, txns, "")
+}
+
+// syncExternalLinks syncs every link of a tenant's accounts.
+func (s *Apiserver) syncExternalLinks(tenantID int) ([]*externalLink, error) {
+	links, err := s.store.GetTenantExternalLinks(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		if err := s.syncExternalLink(l); err != nil {
+			return nil, err
+		}
+	}
+	return links, nil
+}
+
+// startAggregationJob syncs the linked external accounts in the background
+// on a fixed interval. A zero interval disables the job.
+func (s *Apiserver) startAggregationJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("aggregation: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.syncExternalLinks(t.ID); err != nil {
+					logf("aggregation: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleExternalLinks lists the caller's links to other banks (GET) or
+// links the accounts a provider's link token grants access to (POST),
+// syncing them right away.
+func (s *Apiserver) handleExternalLinks(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		links, err := s.store.GetExternalLinks(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, links)
+	}
+
+	req := LinkExternalRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Token == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "token")
+	}
+	institution, err := s.aggregator.Institution(req.Token)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_link_token", s.aggregator.Provider())
+	}
+	l := &externalLink{AccountID: acc.ID, Provider: s.aggregator.Provider(), Institution: institution, Accounts: []*externalAccount{}, accessToken: req.Token}
+	if err := s.store.CreateExternalLink(l); err != nil {
+		return err
+	}
+	if err := s.syncExternalLink(l); err != nil {
+		return err
+	}
+	s.audit(r, "external_link.created", "external_link", l.ID, l)
+	return writeJSON(w, http.StatusCreated, l)
+}
+
+// handleDeleteExternalLink unlinks one of the caller's links, deleting the
+// data synced from it.
+func (s *Apiserver) handleDeleteExternalLink(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteExternalLink(acc.ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "external_link_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "external_link.deleted", "external_link", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// handleSyncExternalLink syncs one of the caller's links now instead of
+// waiting for the job.
+func (s *Apiserver) handleSyncExternalLink(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	links, err := s.store.GetExternalLinks(acc.ID)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if l.ID == id {
+			if err := s.syncExternalLink(l); err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusOK, l)
+		}
+	}
+	return newAPIError(http.StatusNotFound, "external_link_not_found", id)
+}
+
+// handleExternalTransactions lists the synced transactions of one of the
+// caller's external accounts, newest first, a page at a time.
+func (s *Apiserver) handleExternalTransactions(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	txns, total, err := s.store.GetExternalTransactions(acc.ID, id, page)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "external_account_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(txns, total, page, func(t *externalTransaction) cursor { return cursor{t.CreatedAt, t.ID} }))
+}
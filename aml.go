@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// Limits of the transfer graph: how many hops it follows from the account
+// and how many accounts it returns.
+const (
+	defaultGraphDepth = 2
+	maxGraphDepth     = 4
+	maxGraphNodes     = 500
+)
+
+// graphNode is an account in a transfer graph. Depth is the fewest transfers
+// between it and the account at the centre.
+type graphNode struct {
+	AccountID int    `json:"account_id"`
+	Name      string `json:"name"`
+	Number    string `json:"number"`
+	Depth     int    `json:"depth"`
+}
+
+// graphEdge sums the transfers from one account of the graph to another.
+type graphEdge struct {
+	From      int `json:"from"`
+	To        int `json:"to"`
+	Transfers int `json:"transfers"`
+	Total     int `json:"total"`
+}
+
+// transferGraph is the network of transfers around an account, shaped for
+// graph visualisation libraries. Truncated is set when accounts at the
+// outer depths were dropped to stay within maxGraphNodes.
+type transferGraph struct {
+	AccountID int          `json:"account_id"`
+	Depth     int          `json:"depth"`
+	Nodes     []*graphNode `json:"nodes"`
+	Edges     []*graphEdge `json:"edges"`
+	Truncated bool         `json:"truncated"`
+}
+
+// AMLStorage holds the anti-money-laundering storage operations.
+type AMLStorage interface {
+	GetTransferGraph(tenantID, accountID, depth int) (*transferGraph, error)
+}
+
+// GetTransferGraph walks the transfers of a tenant outwards from an account,
+// in either direction, up to depth hops.
+func (s *PostgresStorage) GetTransferGraph(tenantID, accountID, depth int) (*transferGraph, error) {
+	rows, err := s.db.Query(`
+        WITH RECURSIVE reach (account_id, depth) AS (
+            SELECT $2::int, 0
+            UNION
+            SELECT CASE WHEN t.from_account_id = r.account_id THEN t.to_account_id ELSE t.from_account_id END, r.depth + 1
+            FROM reach r JOIN transfers t ON t.from_account_id = r.account_id OR t.to_account_id = r.account_id
+            WHERE r.depth < $3 AND t.tenant_id = $1
+        )
+        SELECT a.id, COALESCE(a.name, ''), COALESCE(a.number, ''), MIN(r.depth) AS depth
+        FROM reach r JOIN accounts a ON a.id = r.account_id
+        GROUP BY a.id ORDER BY depth, a.id LIMIT $4`,
+		tenantID, accountID, depth, maxGraphNodes+1,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	g := &transferGraph{AccountID: accountID, Depth: depth, Nodes: []*graphNode{}, Edges: []*graphEdge{}}
+	ids := []int{}
+	for rows.Next() {
+		n := &graphNode{}
+		if err := rows.Scan(&n.AccountID, &n.Name, &n.Number, &n.Depth); err != nil {
+			return nil, err
+		}
+		g.Nodes = append(g.Nodes, n)
+		ids = append(ids, n.AccountID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(g.Nodes) > maxGraphNodes {
+		g.Nodes, ids, g.Truncated = g.Nodes[:maxGraphNodes], ids[:maxGraphNodes], true
+	}
+
+	edgeRows, err := s.db.Query(`
+        SELECT from_account_id, to_account_id, COUNT(*), SUM(amount)
+        FROM transfers
+        WHERE tenant_id = $1 AND from_account_id = ANY($2) AND to_account_id = ANY($2)
+        GROUP BY from_account_id, to_account_id ORDER BY from_account_id, to_account_id`,
+		tenantID, pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer edgeRows.Close()
+	for edgeRows.Next() {
+		e := &graphEdge{}
+		if err := edgeRows.Scan(&e.From, &e.To, &e.Transfers, &e.Total); err != nil {
+			return nil, err
+		}
+		g.Edges = append(g.Edges, e)
+	}
+	return g, edgeRows.Err()
+}
+
+// handleTransferGraph returns the transfer graph around an account up to
+// ?depth= hops (2 by default) for anti-money-laundering reviews.
+func (s *Apiserver) handleTransferGraph(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	tenantID := requestTenant(r).ID
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != tenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	depth := defaultGraphDepth
+	if v := r.URL.Query().Get("depth"); v != "" {
+		if depth, err = strconv.Atoi(v); err != nil || depth < 1 || depth > maxGraphDepth {
+			return newAPIError(http.StatusBadRequest, "invalid_depth", maxGraphDepth)
+		}
+	}
+
+	g, err := s.store.GetTransferGraph(tenantID, id, depth)
+	if err != nil {
+		return err
+	}
+	s.audit(r, "account.graph_viewed", "account", id, map[string]int{"depth": depth})
+	return writeJSON(w, http.StatusOK, g)
+}
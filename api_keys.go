@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const createAPIKeysTable = `
+        CREATE TABLE IF NOT EXISTS api_keys (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            prefix TEXT NOT NULL,
+            key_hash TEXT UNIQUE NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            revoked_at TIMESTAMPTZ
+        )
+    `
+
+// apiKeyHeader carries the secret key of server-to-server clients such as
+// merchants, which call the API without a user session.
+const apiKeyHeader = "X-API-Key"
+
+// API key kinds. Merchant keys call the merchant and open banking APIs; ATM
+// keys belong to ATM operators and can only pay out cash codes.
+const (
+	apiKeyMerchant = "merchant"
+	apiKeyATM      = "atm"
+)
+
+// apiKey authenticates a client acting on behalf of an account. Only a hash
+// of the key is stored; Key is set once, in the response that creates it.
+type apiKey struct {
+	ID        int        `json:"id"`
+	TenantID  int        `json:"tenant_id"`
+	AccountID int        `json:"account_id"`
+	Name      string     `json:"name"`
+	Kind      string     `json:"kind"`
+	Prefix    string     `json:"prefix"`
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	AccountID int    `json:"account_id"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind,omitempty"`
+}
+
+// APIKeyStorage holds the API key storage operations.
+type APIKeyStorage interface {
+	CreateAPIKey(k *apiKey, keyHash string) error
+	GetAPIKeys(tenantID int) ([]*apiKey, error)
+	GetAPIKeyByHash(keyHash string) (*apiKey, error)
+	GetAPIKey(tenantID, id int) (*apiKey, error)
+	RevokeAPIKey(tenantID, id int) error
+}
+
+// CreateAPIKey stores a new key by its hash.
+func (s *PostgresStorage) CreateAPIKey(k *apiKey, keyHash string) error {
+	return s.db.QueryRow(
+		"INSERT INTO api_keys (tenant_id, account_id, name, kind, prefix, key_hash) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		k.TenantID, k.AccountID, k.Name, k.Kind, k.Prefix, keyHash,
+	).Scan(&k.ID, &k.CreatedAt)
+}
+
+// GetAPIKeys lists a tenant's keys, revoked ones included.
+func (s *PostgresStorage) GetAPIKeys(tenantID int) ([]*apiKey, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, account_id, name, kind, prefix, created_at, revoked_at FROM api_keys WHERE tenant_id = $1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*apiKey, 0)
+	for rows.Next() {
+		k := &apiKey{}
+		if err := rows.Scan(&k.ID, &k.TenantID, &k.AccountID, &k.Name, &k.Kind, &k.Prefix, &k.CreatedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByHash retrieves an unrevoked key by its hash.
+func (s *PostgresStorage) GetAPIKeyByHash(keyHash string) (*apiKey, error) {
+	k := &apiKey{}
+	err := s.db.QueryRow("SELECT id, tenant_id, account_id, name, kind, prefix, created_at FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", keyHash).
+		Scan(&k.ID, &k.TenantID, &k.AccountID, &k.Name, &k.Kind, &k.Prefix, &k.CreatedAt)
+	return k, err
+}
+
+// GetAPIKey retrieves a tenant's key, revoked or not.
+func (s *PostgresStorage) GetAPIKey(tenantID, id int) (*apiKey, error) {
+	k := &apiKey{}
+	err := s.db.QueryRow("SELECT id, tenant_id, account_id, name, kind, prefix, created_at, revoked_at FROM api_keys WHERE id = $1 AND tenant_id = $2", id, tenantID).
+		Scan(&k.ID, &k.TenantID, &k.AccountID, &k.Name, &k.Kind, &k.Prefix, &k.CreatedAt, &k.RevokedAt)
+	return k, err
+}
+
+// RevokeAPIKey disables a tenant's key for good.
+func (s *PostgresStorage) RevokeAPIKey(tenantID, id int) error {
+	_, err := s.db.Exec("UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND tenant_id = $2 AND revoked_at IS NULL", id, tenantID)
+	return err
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateAPIKey authenticates the request by its X-API-Key header,
+// which must belong to the request's tenant, and responds as the key's
+// account sees things.
+func (s *Apiserver) authenticateAPIKey(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get(apiKeyHeader)
+		if key == "" {
+			return newAPIError(http.StatusUnauthorized, "missing_api_key")
+		}
+		k, err := s.store.GetAPIKeyByHash(hashAPIKey(key))
+		if err != nil || k.TenantID != requestTenant(r).ID {
+			return newAPIError(http.StatusUnauthorized, "invalid_api_key")
+		}
+		r = setRequestAPIKey(r, k)
+		return next(&viewerWriter{ResponseWriter: w, viewer: viewer{accountID: k.AccountID}}, r)
+	}
+}
+
+// enforceQuota counts the request against the quotas of its API key. It
+// runs after authenticateAPIKey.
+func (s *Apiserver) enforceQuota(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.useQuota(w, r, requestAPIKey(r)); err != nil {
+			return err
+		}
+		return next(w, r)
+	}
+}
+
+// requireATMKey lets only ATM operators' keys through. It runs after
+// authenticateAPIKey.
+func requireATMKey(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if requestAPIKey(r).Kind != apiKeyATM {
+			return newAPIError(http.StatusForbidden, "atm_key_required")
+		}
+		return next(w, r)
+	}
+}
+
+// handleAPIKeys lists the tenant's API keys (GET) or issues a key acting for
+// one of its accounts (POST). The key itself is only ever returned on creation.
+func (s *Apiserver) handleAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		keys, err := s.store.GetAPIKeys(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, keys)
+	}
+
+	req := CreateAPIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	req.Kind = cmp.Or(req.Kind, apiKeyMerchant)
+	if req.Kind != apiKeyMerchant && req.Kind != apiKeyATM {
+		return newAPIError(http.StatusBadRequest, "unknown_api_key_kind", req.Kind)
+	}
+	acc, err := s.store.GetAccountByID(req.AccountID)
+	if err != nil || acc.TenantID != tenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", req.AccountID)
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	key := "sk_" + hex.EncodeToString(b)
+	k := &apiKey{TenantID: tenantID, AccountID: acc.ID, Name: req.Name, Kind: req.Kind, Prefix: key[:10]}
+	if err := s.store.CreateAPIKey(k, hashAPIKey(key)); err != nil {
+		return err
+	}
+	s.audit(r, "api_key.created", "api_key", k.ID, k)
+	k.Key = key
+	return writeJSON(w, http.StatusCreated, k)
+}
+
+// handleRevokeAPIKey revokes a key of the tenant.
+func (s *Apiserver) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.RevokeAPIKey(requestTenant(r).ID, id); err != nil {
+		return err
+	}
+	s.audit(r, "api_key.revoked", "api_key", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"revoked": id})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createAttachmentsTable = `
+        CREATE TABLE IF NOT EXISTS attachments (
+            id SERIAL PRIMARY KEY,
+            ledger_entry_id INT NOT NULL REFERENCES ledger_entries(id),
+            filename TEXT NOT NULL,
+            content_type TEXT NOT NULL,
+            size INT NOT NULL,
+            sha256 TEXT NOT NULL,
+            storage_key TEXT NOT NULL,
+            uploaded_by INT NOT NULL REFERENCES accounts(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const (
+	maxAttachmentSize            = 10 << 20
+	maxAttachmentsPerTransaction = 10
+	maxAttachmentNameLength      = 255
+)
+
+// attachmentTypes are the file types accepted as attachments, detected
+// from the content rather than trusted from the client.
+var attachmentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/webp":      true,
+	"text/plain":      true,
+}
+
+var errTooManyAttachments = errors.New("too many attachments")
+
+// FileStore keeps uploaded files under keys chosen by the server. Files are
+// kept on local disk unless an object store is plugged in.
+type FileStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// diskFileStore keeps files in a directory, for single-instance
+// deployments and local development.
+type diskFileStore struct {
+	dir string
+}
+
+func (d diskFileStore) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d diskFileStore) Put(key string, data []byte) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o600)
+}
+
+func (d diskFileStore) Get(key string) ([]byte, error) {
+	return os.ReadFile(d.path(key))
+}
+
+func (d diskFileStore) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// attachment is a file attached to a transaction, such as an invoice.
+type attachment struct {
+	ID            int    `json:"id"`
+	LedgerEntryID int    `json:"transaction_id"`
+	Filename      string `json:"filename"`
+	ContentType   string `json:"content_type"`
+	Size          int    `json:"size"`
+	SHA256        string `json:"sha256"`
+	UploadedBy    int    `json:"uploaded_by"`
+	// ScanStatus is pending until the file has been scanned; only clean
+	// files can be downloaded. See scanUpload.
+	ScanStatus string     `json:"scan_status"`
+	ScanResult string     `json:"scan_result,omitempty"`
+	ScannedAt  *time.Time `json:"scanned_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	storageKey string
+}
+
+// AttachmentStorage holds the transaction attachment storage operations.
+type AttachmentStorage interface {
+	CreateAttachment(*attachment) error
+	GetAttachments(entryID int) ([]*attachment, error)
+	GetAttachment(entryID, id int) (*attachment, error)
+	DeleteAttachment(entryID, id int) error
+	GetTenantAttachment(tenantID, id int) (*attachment, error)
+	GetAttachmentsByStatus(tenantID int, status string) ([]*attachment, error)
+	SetAttachmentScan(id int, status, result string) error
+}
+
+// CreateAttachment stores an attachment's details. It returns
+// errTooManyAttachments if the transaction already has the most allowed.
+func (s *PostgresStorage) CreateAttachment(a *attachment) error {
+	err := s.db.QueryRow(`
+        INSERT INTO attachments (ledger_entry_id, filename, content_type, size, sha256, storage_key, uploaded_by)
+        SELECT $1, $2, $3, $4, $5, $6, $7
+        WHERE (SELECT COUNT(*) FROM attachments WHERE ledger_entry_id = $1) < $8
+        RETURNING id, scan_status, created_at`,
+		a.LedgerEntryID, a.Filename, a.ContentType, a.Size, a.SHA256, a.storageKey, a.UploadedBy, maxAttachmentsPerTransaction,
+	).Scan(&a.ID, &a.ScanStatus, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errTooManyAttachments
+	}
+	return err
+}
+
+const selectAttachments = "SELECT t.id, t.ledger_entry_id, t.filename, t.content_type, t.size, t.sha256, t.storage_key, t.uploaded_by, t.scan_status, t.scan_result, t.scanned_at, t.created_at FROM attachments t "
+
+func scanAttachment(row interface{ Scan(...any) error }) (*attachment, error) {
+	a := &attachment{}
+	err := row.Scan(&a.ID, &a.LedgerEntryID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.storageKey, &a.UploadedBy, &a.ScanStatus, &a.ScanResult, &a.ScannedAt, &a.CreatedAt)
+	return a, err
+}
+
+// GetAttachments lists a transaction's attachments, oldest first.
+func (s *PostgresStorage) GetAttachments(entryID int) ([]*attachment, error) {
+	rows, err := s.db.Query(selectAttachments+"WHERE t.ledger_entry_id = $1 ORDER BY t.id", entryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]*attachment, 0)
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// GetAttachment retrieves an attachment of a transaction.
+func (s *PostgresStorage) GetAttachment(entryID, id int) (*attachment, error) {
+	return scanAttachment(s.db.QueryRow(selectAttachments+"WHERE t.id = $1 AND t.ledger_entry_id = $2", id, entryID))
+}
+
+// DeleteAttachment deletes an attachment's details. It returns
+// sql.ErrNoRows if the transaction has no such attachment.
+func (s *PostgresStorage) DeleteAttachment(entryID, id int) error {
+	res, err := s.db.Exec("DELETE FROM attachments WHERE id = $1 AND ledger_entry_id = $2", id, entryID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// attachmentTenant limits attachments, aliased t, to those on ledger
+// entries of the tenant's accounts.
+const attachmentTenant = `t.ledger_entry_id IN (
+    SELECT e.id FROM ledger_entries e JOIN accounts a ON a.id = e.account_id WHERE a.tenant_id = $1
+)`
+
+// GetTenantAttachment retrieves an attachment on a transaction of the tenant.
+func (s *PostgresStorage) GetTenantAttachment(tenantID, id int) (*attachment, error) {
+	return scanAttachment(s.db.QueryRow(selectAttachments+"WHERE "+attachmentTenant+" AND t.id = $2", tenantID, id))
+}
+
+// GetAttachmentsByStatus lists the tenant's attachments with a scan
+// status, oldest first.
+func (s *PostgresStorage) GetAttachmentsByStatus(tenantID int, status string) ([]*attachment, error) {
+	rows, err := s.db.Query(selectAttachments+"WHERE "+attachmentTenant+" AND t.scan_status = $2 ORDER BY t.id", tenantID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]*attachment, 0)
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// SetAttachmentScan records the outcome of scanning an attachment.
+func (s *PostgresStorage) SetAttachmentScan(id int, status, result string) error {
+	_, err := s.db.Exec("UPDATE attachments SET scan_status = $1, scan_result = $2, scanned_at = now() WHERE id = $3", status, result, id)
+	return err
+}
+
+// authorizedEntry loads the ledger entry in the path if it belongs to the
+// caller's account, or to any account of the tenant for admins, along with
+// that account.
+func (s *Apiserver) authorizedEntry(r *http.Request) (*ledgerEntry, *account, error) {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := s.store.GetLedgerEntry(id)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusNotFound, "transaction_not_found", id)
+	}
+	acc, err := s.store.GetAccountByID(e.AccountID)
+	if err != nil || acc.TenantID != caller.TenantID || (acc.ID != caller.ID && !isAdmin(r)) {
+		return nil, nil, newAPIError(http.StatusNotFound, "transaction_not_found", id)
+	}
+	return e, acc, nil
+}
+
+// handleAttachments lists a transaction's attachments (GET) or attaches a
+// file sent as the "file" field of a multipart form (POST).
+func (s *Apiserver) handleAttachments(w http.ResponseWriter, r *http.Request) error {
+	e, _, err := s.authorizedEntry(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		attachments, err := s.store.GetAttachments(e.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, attachments)
+	}
+
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, "attachment_too_large", maxAttachmentSize>>20)
+	} else if err != nil {
+		return newAPIError(http.StatusBadRequest, "required_field", "file")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxAttachmentSize {
+		return newAPIError(http.StatusRequestEntityTooLarge, "attachment_too_large", maxAttachmentSize>>20)
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !attachmentTypes[contentType] {
+		return newAPIError(http.StatusUnsupportedMediaType, "unsupported_attachment_type", contentType)
+	}
+	name := filepath.Base(strings.TrimSpace(header.Filename))
+	if name == "." || name == string(filepath.Separator) || len(name) > maxAttachmentNameLength {
+		name = "attachment"
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	a := &attachment{
+		LedgerEntryID: e.ID,
+		Filename:      name,
+		ContentType:   contentType,
+		Size:          len(data),
+		SHA256:        hex.EncodeToString(sum[:]),
+		UploadedBy:    caller.ID,
+		storageKey:    fmt.Sprintf("attachments/%d/%s", e.ID, hex.EncodeToString(b)),
+	}
+	if err := s.files.Put(a.storageKey, data); err != nil {
+		return err
+	}
+	if err := s.store.CreateAttachment(a); err != nil {
+		if err := s.files.Delete(a.storageKey); err != nil {
+			logf("attachments: failed to delete %s: %v\n", a.storageKey, err)
+		}
+		if errors.Is(err, errTooManyAttachments) {
+			return newAPIError(http.StatusConflict, "too_many_attachments", maxAttachmentsPerTransaction)
+		}
+		return err
+	}
+	if err := s.scanUpload(a, data); err != nil {
+		return err
+	}
+	s.audit(r, "attachment.created", "attachment", a.ID, a)
+	return writeJSON(w, http.StatusCreated, a)
+}
+
+// handleAttachment downloads an attachment (GET) or deletes it (DELETE).
+func (s *Apiserver) handleAttachment(w http.ResponseWriter, r *http.Request) error {
+	e, _, err := s.authorizedEntry(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("attachment"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("attachment"))
+	}
+	a, err := s.store.GetAttachment(e.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "attachment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+
+	if r.Method == "DELETE" {
+		if err := s.store.DeleteAttachment(e.ID, id); errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "attachment_not_found", id)
+		} else if err != nil {
+			return err
+		}
+		if err := s.files.Delete(a.storageKey); err != nil {
+			logf("attachments: failed to delete %s: %v\n", a.storageKey, err)
+		}
+		s.audit(r, "attachment.deleted", "attachment", id, nil)
+		return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+	}
+
+	if a.ScanStatus != scanClean {
+		return newAPIError(http.StatusConflict, "attachment_quarantined", id, a.ScanStatus)
+	}
+	data, err := s.files.Get(a.storageKey)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const createAuditLogTable = `
+        CREATE TABLE IF NOT EXISTS audit_log (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL DEFAULT 1,
+            actor_id INT,
+            action TEXT NOT NULL,
+            entity_type TEXT NOT NULL,
+            entity_id INT NOT NULL,
+            details JSONB NOT NULL DEFAULT '{}',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// auditEntry records who did what to which entity.
+type auditEntry struct {
+	ID         int             `json:"id"`
+	TenantID   int             `json:"tenant_id"`
+	ActorID    *int            `json:"actor_id,omitempty"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	Details    json.RawMessage `json:"details"`
+	CreatedAt  time.Time       `json:"created_at"`
+	PrevHash   string          `json:"prev_hash,omitempty"`
+	Hash       string          `json:"hash,omitempty"`
+}
+
+// AuditStorage holds the audit log storage operations.
+type AuditStorage interface {
+	CreateAuditEntry(*auditEntry) error
+	GetAuditEntries(tenantID int, entityType string, entityID int, page pageRequest) ([]*auditEntry, int, error)
+}
+
+// CreateAuditEntry appends an entry to the audit log, chained onto the
+// tenant's previous entry.
+func (s *PostgresStorage) CreateAuditEntry(e *auditEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := appendAuditEntry(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAuditEntries returns a page of the audit trail of an entity, newest first.
+func (s *PostgresStorage) GetAuditEntries(tenantID int, entityType string, entityID int, page pageRequest) ([]*auditEntry, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM audit_log WHERE tenant_id = $1 AND entity_type = $2 AND entity_id = $3", tenantID, entityType, entityID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(4, "")
+	rows, err := s.db.Query(
+		"SELECT id, tenant_id, actor_id, action, entity_type, entity_id, details, created_at FROM audit_log WHERE tenant_id = $1 AND entity_type = $2 AND entity_id = $3 AND "+cond+" "+order,
+		append([]any{tenantID, entityType, entityID}, args...)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := make([]*auditEntry, 0)
+	for rows.Next() {
+		e := &auditEntry{}
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.TenantID, &e.ActorID, &e.Action, &e.EntityType, &e.EntityID, &details, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		e.Details = details
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+// audit records an action taken by the caller, with secrets redacted and
+// account numbers masked in the details. Like notify, failures are logged
+// rather than failing the request.
+func (s *Apiserver) audit(r *http.Request, action, entityType string, entityID int, details any) {
+	e := &auditEntry{TenantID: requestTenant(r).ID, Action: action, EntityType: entityType, EntityID: entityID}
+	if acc, err := s.currentAccount(r); err == nil {
+		e.ActorID = &acc.ID
+	}
+	data, err := json.Marshal(details)
+	if err != nil {
+		data = []byte("{}")
+	}
+	e.Details = scrubJSON(data)
+	if err := s.store.CreateAuditEntry(e); err != nil {
+		logf("failed to write audit entry %s %s/%d: %v\n", action, entityType, entityID, err)
+	}
+}
+
+// handleGetAuditLog returns the audit trail of ?entity_type=&entity_id=.
+func (s *Apiserver) handleGetAuditLog(w http.ResponseWriter, r *http.Request) error {
+	entityType := r.URL.Query().Get("entity_type")
+	entityID, err := strconv.Atoi(r.URL.Query().Get("entity_id"))
+	if entityType == "" || err != nil {
+		return newAPIError(http.StatusBadRequest, "required_field", "entity_type and entity_id")
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	entries, total, err := s.store.GetAuditEntries(requestTenant(r).ID, entityType, entityID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(entries, total, page, func(e *auditEntry) cursor { return cursor{e.CreatedAt, e.ID} }))
+}
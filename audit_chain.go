@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Each audit entry of a tenant carries the hash of the one before it, so
+// editing, inserting or deleting an entry breaks the chain from there on.
+// Entries written before chaining was introduced have no hash and are left
+// out of it.
+//
+// Anchors pin the head of a tenant's chain at a point in time. They are
+// signed and written to the FileStore, out of reach of anyone able to
+// rewrite the database alone.
+const createAuditAnchorsTable = `
+        CREATE TABLE IF NOT EXISTS audit_anchors (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            entry_id INT NOT NULL,
+            hash TEXT NOT NULL,
+            file_key TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const tokenAuditAnchor = "audit_anchor"
+
+// maxAuditBreaks caps the breaks a verification reports.
+const maxAuditBreaks = 100
+
+// auditChainBatch is how many entries verification reads at a time.
+const auditChainBatch = 1000
+
+// auditAnchor is a signed record of the head of a tenant's audit chain.
+type auditAnchor struct {
+	ID        int       `json:"id"`
+	TenantID  int       `json:"tenant_id"`
+	EntryID   int       `json:"entry_id"`
+	Hash      string    `json:"hash"`
+	FileKey   string    `json:"file_key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type auditAnchorClaims struct {
+	Type     string `json:"typ"`
+	TenantID int    `json:"tenant_id"`
+	EntryID  int    `json:"entry_id"`
+	Hash     string `json:"hash"`
+	jwt.RegisteredClaims
+}
+
+// auditBreak is a point where the chain or an anchor does not hold.
+type auditBreak struct {
+	EntryID  int    `json:"entry_id"`
+	AnchorID int    `json:"anchor_id,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// auditVerification is the outcome of checking a tenant's audit chain.
+type auditVerification struct {
+	TenantID       int           `json:"tenant_id"`
+	Valid          bool          `json:"valid"`
+	EntriesChecked int           `json:"entries_checked"`
+	AnchorsChecked int           `json:"anchors_checked"`
+	HeadEntryID    int           `json:"head_entry_id,omitempty"`
+	Breaks         []*auditBreak `json:"breaks"`
+	CheckedAt      time.Time     `json:"checked_at"`
+}
+
+// AuditChainStorage holds the storage operations behind the audit chain.
+type AuditChainStorage interface {
+	GetAuditChain(tenantID, afterID, limit int) ([]*auditEntry, error)
+	GetAuditChainHead(tenantID int) (*auditEntry, error)
+	CreateAuditAnchor(*auditAnchor) error
+	GetAuditAnchors(tenantID int) ([]*auditAnchor, error)
+}
+
+// chainHash is the hash of an entry, covering every field and the hash of
+// the entry before it.
+func (e *auditEntry) chainHash() string {
+	var actor any
+	if e.ActorID != nil {
+		actor = *e.ActorID
+	}
+	data, _ := json.Marshal([]any{e.PrevHash, e.ID, e.TenantID, actor, e.Action, e.EntityType, e.EntityID, e.Details, e.CreatedAt.UTC().Format(time.RFC3339Nano)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAuditEntry links an entry onto its tenant's chain. Appends to a
+// chain are serialized by a lock held until tx ends. The entry is hashed as
+// stored, since JSONB normalizes the details.
+func appendAuditEntry(tx *sql.Tx, e *auditEntry) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('audit_log'), $1)", e.TenantID); err != nil {
+		return err
+	}
+	err := tx.QueryRow("SELECT hash FROM audit_log WHERE tenant_id = $1 AND hash IS NOT NULL ORDER BY id DESC LIMIT 1", e.TenantID).Scan(&e.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	var details string
+	err = tx.QueryRow(
+		"INSERT INTO audit_log (tenant_id, actor_id, action, entity_type, entity_id, details, prev_hash) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, details::text, created_at",
+		e.TenantID, e.ActorID, e.Action, e.EntityType, e.EntityID, []byte(e.Details), e.PrevHash,
+	).Scan(&e.ID, &details, &e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	e.Details = json.RawMessage(details)
+	e.Hash = e.chainHash()
+	_, err = tx.Exec("UPDATE audit_log SET hash = $2 WHERE id = $1", e.ID, e.Hash)
+	return err
+}
+
+const selectAuditChain = "SELECT id, tenant_id, actor_id, action, entity_type, entity_id, details::text, created_at, COALESCE(prev_hash, ''), COALESCE(hash, '') FROM audit_log "
+
+// GetAuditChain returns a tenant's audit entries after an ID, oldest first.
+func (s *PostgresStorage) GetAuditChain(tenantID, afterID, limit int) ([]*auditEntry, error) {
+	rows, err := s.db.Query(selectAuditChain+"WHERE tenant_id = $1 AND id > $2 ORDER BY id LIMIT $3", tenantID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*auditEntry, 0)
+	for rows.Next() {
+		e, err := scanAuditChainEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// GetAuditChainHead returns the latest chained entry of a tenant.
+func (s *PostgresStorage) GetAuditChainHead(tenantID int) (*auditEntry, error) {
+	return scanAuditChainEntry(s.db.QueryRow(selectAuditChain+"WHERE tenant_id = $1 AND hash IS NOT NULL ORDER BY id DESC LIMIT 1", tenantID))
+}
+
+func scanAuditChainEntry(row interface{ Scan(...any) error }) (*auditEntry, error) {
+	e := &auditEntry{}
+	var details string
+	if err := row.Scan(&e.ID, &e.TenantID, &e.ActorID, &e.Action, &e.EntityType, &e.EntityID, &details, &e.CreatedAt, &e.PrevHash, &e.Hash); err != nil {
+		return nil, err
+	}
+	e.Details = json.RawMessage(details)
+	return e, nil
+}
+
+// CreateAuditAnchor records an anchor written to the FileStore.
+func (s *PostgresStorage) CreateAuditAnchor(a *auditAnchor) error {
+	return s.db.QueryRow(
+		"INSERT INTO audit_anchors (tenant_id, entry_id, hash, file_key, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		a.TenantID, a.EntryID, a.Hash, a.FileKey, a.CreatedAt,
+	).Scan(&a.ID)
+}
+
+// GetAuditAnchors lists a tenant's anchors, oldest first.
+func (s *PostgresStorage) GetAuditAnchors(tenantID int) ([]*auditAnchor, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, entry_id, hash, file_key, created_at FROM audit_anchors WHERE tenant_id = $1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	anchors := make([]*auditAnchor, 0)
+	for rows.Next() {
+		a := &auditAnchor{}
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.EntryID, &a.Hash, &a.FileKey, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, a)
+	}
+	return anchors, rows.Err()
+}
+
+// anchorAuditChain signs the head of a tenant's chain and writes it to the
+// FileStore. It returns nil without anchoring when the chain is empty or
+// its head is anchored already.
+func (s *Apiserver) anchorAuditChain(tenantID int) (*auditAnchor, error) {
+	head, err := s.store.GetAuditChainHead(tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	anchors, err := s.store.GetAuditAnchors(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(anchors); n > 0 && anchors[n-1].EntryID == head.ID {
+		return nil, nil
+	}
+
+	a := &auditAnchor{TenantID: tenantID, EntryID: head.ID, Hash: head.Hash, CreatedAt: clock.Now()}
+	signed, err := signClaims(&auditAnchorClaims{
+		Type:     tokenAuditAnchor,
+		TenantID: tenantID,
+		EntryID:  head.ID,
+		Hash:     head.Hash,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   tokenSettings.Issuer,
+			IssuedAt: jwt.NewNumericDate(a.CreatedAt),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.FileKey = fmt.Sprintf("audit-anchors/%d/%d.jwt", tenantID, head.ID)
+	if err := s.files.Put(a.FileKey, []byte(signed)); err != nil {
+		return nil, err
+	}
+	return a, s.store.CreateAuditAnchor(a)
+}
+
+// verifyAuditAnchor checks an anchor's file is signed by us and pins the
+// hash its record claims.
+func (s *Apiserver) verifyAuditAnchor(a *auditAnchor) error {
+	data, err := s.files.Get(a.FileKey)
+	if err != nil {
+		return fmt.Errorf("anchor file unreadable: %v", err)
+	}
+	claims := &auditAnchorClaims{}
+	_, err = jwt.ParseWithClaims(string(data), claims, verificationKey,
+		jwt.WithValidMethods(tokenMethods()),
+		jwt.WithIssuer(tokenSettings.Issuer),
+	)
+	if err != nil || claims.Type != tokenAuditAnchor {
+		return errors.New("anchor signature invalid")
+	}
+	if claims.TenantID != a.TenantID || claims.EntryID != a.EntryID || claims.Hash != a.Hash {
+		return errors.New("anchor record does not match its signed file")
+	}
+	return nil
+}
+
+// verifyAuditChain walks a tenant's chain, recomputing every hash, and
+// checks each anchor against the chain.
+func (s *Apiserver) verifyAuditChain(tenantID int) (*auditVerification, error) {
+	v := &auditVerification{TenantID: tenantID, Breaks: make([]*auditBreak, 0), CheckedAt: clock.Now()}
+	fail := func(b *auditBreak) {
+		if len(v.Breaks) < maxAuditBreaks {
+			v.Breaks = append(v.Breaks, b)
+		}
+	}
+
+	hashes := make(map[int]string)
+	prev, chained := "", false
+	for afterID := 0; ; {
+		entries, err := s.store.GetAuditChain(tenantID, afterID, auditChainBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			afterID = e.ID
+			if e.Hash == "" {
+				if chained {
+					fail(&auditBreak{EntryID: e.ID, Reason: "entry is not chained"})
+				}
+				continue
+			}
+			chained = true
+			v.EntriesChecked++
+			if e.PrevHash != prev {
+				fail(&auditBreak{EntryID: e.ID, Reason: "previous hash does not match the entry before"})
+			}
+			if e.chainHash() != e.Hash {
+				fail(&auditBreak{EntryID: e.ID, Reason: "entry does not match its hash"})
+			}
+			prev, v.HeadEntryID = e.Hash, e.ID
+			hashes[e.ID] = e.Hash
+		}
+		if len(entries) < auditChainBatch {
+			break
+		}
+	}
+
+	anchors, err := s.store.GetAuditAnchors(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range anchors {
+		v.AnchorsChecked++
+		if err := s.verifyAuditAnchor(a); err != nil {
+			fail(&auditBreak{EntryID: a.EntryID, AnchorID: a.ID, Reason: err.Error()})
+		} else if hash, ok := hashes[a.EntryID]; !ok {
+			fail(&auditBreak{EntryID: a.EntryID, AnchorID: a.ID, Reason: "anchored entry is missing"})
+		} else if hash != a.Hash {
+			fail(&auditBreak{EntryID: a.EntryID, AnchorID: a.ID, Reason: "anchored entry was rewritten"})
+		}
+	}
+	v.Valid = len(v.Breaks) == 0
+	return v, nil
+}
+
+// runAuditAnchors anchors and verifies every tenant's chain, alerting the
+// tenant's admins when it is broken.
+func (s *Apiserver) runAuditAnchors() {
+	tenants, err := s.store.GetTenants()
+	if err != nil {
+		logf("audit chain: failed to load tenants: %v\n", err)
+		return
+	}
+	for _, t := range tenants {
+		if _, err := s.anchorAuditChain(t.ID); err != nil {
+			logf("audit chain: anchoring tenant %s failed: %v\n", t.Slug, err)
+		}
+		v, err := s.verifyAuditChain(t.ID)
+		if err != nil {
+			logf("audit chain: verifying tenant %s failed: %v\n", t.Slug, err)
+			continue
+		}
+		if !v.Valid {
+			s.alertAdmins(t.ID, fmt.Sprintf("Audit log chain broken at entry %d: %s", v.Breaks[0].EntryID, v.Breaks[0].Reason))
+		}
+	}
+}
+
+// startAuditAnchorJob anchors and verifies the audit chains in the
+// background on a fixed interval. A zero interval disables the job.
+func (s *Apiserver) startAuditAnchorJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.runAuditAnchors()
+		}
+	}()
+}
+
+// handleAuditAnchor anchors the head of the tenant's chain right away.
+func (s *Apiserver) handleAuditAnchor(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.anchorAuditChain(requestTenant(r).ID)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return writeJSON(w, http.StatusOK, map[string]any{"anchored": false})
+	}
+	return writeJSON(w, http.StatusCreated, a)
+}
+
+// handleVerifyAuditChain checks the tenant's audit chain and its anchors.
+func (s *Apiserver) handleVerifyAuditChain(w http.ResponseWriter, r *http.Request) error {
+	v, err := s.verifyAuditChain(requestTenant(r).ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, v)
+}
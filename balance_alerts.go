@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const createBalanceAlertsTable = `
+        CREATE TABLE IF NOT EXISTS balance_alerts (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            threshold INT NOT NULL,
+            triggered BOOLEAN NOT NULL DEFAULT false,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// balanceAlert notifies an account holder when their balance drops below a
+// threshold. Triggered is set when the alert fires and cleared once the
+// balance is back at or above the threshold, so each crossing alerts once.
+type balanceAlert struct {
+	AccountID int       `json:"account_id"`
+	Threshold int       `json:"threshold"`
+	Triggered bool      `json:"triggered"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type BalanceAlertRequest struct {
+	Threshold int `json:"threshold"`
+}
+
+// BalanceAlertStorage holds the low-balance alert storage operations.
+type BalanceAlertStorage interface {
+	SetBalanceAlert(*balanceAlert) error
+	GetBalanceAlert(accountID int) (*balanceAlert, error)
+	DeleteBalanceAlert(accountID int) error
+	CheckBalanceAlert(accountID int) (alert *balanceAlert, fired bool, err error)
+}
+
+// SetBalanceAlert creates or replaces the alert of an account and re-arms it.
+func (s *PostgresStorage) SetBalanceAlert(a *balanceAlert) error {
+	a.Triggered = false
+	return s.db.QueryRow(`
+        INSERT INTO balance_alerts (account_id, threshold) VALUES ($1, $2)
+        ON CONFLICT (account_id) DO UPDATE SET threshold = EXCLUDED.threshold, triggered = false, updated_at = now()
+        RETURNING updated_at`,
+		a.AccountID, a.Threshold,
+	).Scan(&a.UpdatedAt)
+}
+
+// GetBalanceAlert retrieves the alert of an account.
+func (s *PostgresStorage) GetBalanceAlert(accountID int) (*balanceAlert, error) {
+	a := &balanceAlert{}
+	err := s.db.QueryRow("SELECT account_id, threshold, triggered, updated_at FROM balance_alerts WHERE account_id = $1", accountID).
+		Scan(&a.AccountID, &a.Threshold, &a.Triggered, &a.UpdatedAt)
+	return a, err
+}
+
+// DeleteBalanceAlert removes the alert of an account.
+func (s *PostgresStorage) DeleteBalanceAlert(accountID int) error {
+	_, err := s.db.Exec("DELETE FROM balance_alerts WHERE account_id = $1", accountID)
+	return err
+}
+
+// CheckBalanceAlert brings the alert of an account in line with its current
+// balance. fired is true only for the single call that sees the balance
+// cross below the threshold; concurrent callers cannot both fire because
+// the update only matches while the flag still has its old value.
+func (s *PostgresStorage) CheckBalanceAlert(accountID int) (*balanceAlert, bool, error) {
+	a := &balanceAlert{AccountID: accountID}
+	err := s.db.QueryRow(`
+        UPDATE balance_alerts b SET triggered = a.balance < b.threshold, updated_at = now()
+        FROM accounts a
+        WHERE a.id = b.account_id AND b.account_id = $1 AND b.triggered <> (a.balance < b.threshold)
+        RETURNING b.threshold, b.triggered, b.updated_at`,
+		accountID,
+	).Scan(&a.Threshold, &a.Triggered, &a.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return a, a.Triggered, nil
+}
+
+// checkBalanceAlerts runs after every balance change: it notifies holders
+// whose balance just dropped below their threshold and re-arms the alerts of
+// those back above it. Failures are logged like notify's.
+func (s *Apiserver) checkBalanceAlerts(accountIDs ...int) {
+	for _, id := range accountIDs {
+		alert, fired, err := s.store.CheckBalanceAlert(id)
+		if err != nil {
+			logf("failed to check balance alert of account %d: %v\n", id, err)
+			continue
+		}
+		if fired {
+			s.notifyBalanceAlert(id, alert)
+		}
+	}
+}
+
+// notifyBalanceAlert notifies the holder of a fired alert, by email with
+// the balance alert template and by text in their language when they get
+// low balance alerts on those channels.
+func (s *Apiserver) notifyBalanceAlert(id int, alert *balanceAlert) {
+	content := notificationContent{Message: fmt.Sprintf("Your balance is below your alert threshold of %d", alert.Threshold)}
+	acc, err := s.store.GetAccountContact(id)
+	if err != nil {
+		logf("failed to load account %d for its balance alert: %v\n", id, err)
+		s.notifyContent(id, "low_balance", content)
+		return
+	}
+	locale := acc.Locale
+	if locale == "" {
+		locale = defaultLocale
+	}
+	balance, threshold := formatMoney(acc.Balance, acc.Currency, locale), formatMoney(alert.Threshold, acc.Currency, locale)
+	content.Email = &notificationEmail{Template: "balance_alert", Data: balanceAlertEmail{Balance: balance, Threshold: threshold}}
+	content.SMS = translate(accountLanguage(acc), "sms_low_balance", balance, threshold)
+	s.notifyContent(id, "low_balance", content)
+}
+
+// handleBalanceAlert returns (GET), sets (PUT) or removes (DELETE) the
+// low-balance alert of an account.
+func (s *Apiserver) handleBalanceAlert(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		alert, err := s.store.GetBalanceAlert(acc.ID)
+		if err != nil {
+			return newAPIError(http.StatusNotFound, "balance_alert_not_found", acc.ID)
+		}
+		return writeJSON(w, http.StatusOK, alert)
+	case "DELETE":
+		if err := s.store.DeleteBalanceAlert(acc.ID); err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]int{"deleted": acc.ID})
+	}
+
+	req := BalanceAlertRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	alert := &balanceAlert{AccountID: acc.ID, Threshold: req.Threshold}
+	if err := s.store.SetBalanceAlert(alert); err != nil {
+		return err
+	}
+	// A balance already below the new threshold alerts straight away.
+	s.checkBalanceAlerts(acc.ID)
+	if current, err := s.store.GetBalanceAlert(acc.ID); err == nil {
+		alert = current
+	}
+	return writeJSON(w, http.StatusOK, alert)
+}
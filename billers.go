@@ -0,0 +1,735 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createBillersTable = `
+        CREATE TABLE IF NOT EXISTS billers (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            name TEXT NOT NULL,
+            category TEXT NOT NULL DEFAULT '',
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            reference_label TEXT NOT NULL DEFAULT 'Reference',
+            reference_pattern TEXT NOT NULL DEFAULT '',
+            active BOOLEAN NOT NULL DEFAULT TRUE,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createSavedBillersTable = `
+        CREATE TABLE IF NOT EXISTS saved_billers (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            biller_id INT NOT NULL REFERENCES billers(id) ON DELETE CASCADE,
+            reference TEXT NOT NULL,
+            nickname TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (account_id, biller_id, reference)
+        )
+    `
+
+const createBillPaymentsTable = `
+        CREATE TABLE IF NOT EXISTS bill_payments (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            biller_id INT NOT NULL REFERENCES billers(id) ON DELETE CASCADE,
+            reference TEXT NOT NULL,
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            status TEXT NOT NULL,
+            scheduled_for DATE,
+            receipt_number TEXT UNIQUE,
+            transfer_id INT REFERENCES transfers(id),
+            failure TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            paid_at TIMESTAMPTZ
+        )
+    `
+
+// Bill payment statuses. A one-off payment is paid at once; a scheduled
+// one waits for its date and is then paid or fails, unless the customer
+// cancels it first.
+const (
+	billScheduled = "scheduled"
+	billPaid      = "paid"
+	billFailed    = "failed"
+	billCancelled = "cancelled"
+)
+
+var (
+	errSavedBillerExists = errors.New("biller reference already saved")
+	errBillNotScheduled  = errors.New("bill payment is not scheduled")
+)
+
+// biller is an organisation customers pay bills to, such as a utility. Its
+// payments are collected in one of the tenant's accounts. A bill reference,
+// such as a consumer number, identifies the customer to the biller and must
+// match the reference pattern if there is one.
+type biller struct {
+	ID               int       `json:"id"`
+	TenantID         int       `json:"tenant_id"`
+	Name             string    `json:"name"`
+	Category         string    `json:"category"`
+	AccountID        int       `json:"account_id"`
+	ReferenceLabel   string    `json:"reference_label"`
+	ReferencePattern string    `json:"reference_pattern,omitempty"`
+	Active           bool      `json:"active"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// savedBiller is a biller and reference a customer pays regularly.
+type savedBiller struct {
+	ID         int       `json:"id"`
+	AccountID  int       `json:"account_id"`
+	BillerID   int       `json:"biller_id"`
+	BillerName string    `json:"biller_name"`
+	Reference  string    `json:"reference"`
+	Nickname   string    `json:"nickname,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// billPayment is a payment of a bill, confirmed by its receipt number once
+// paid.
+type billPayment struct {
+	ID            int        `json:"id"`
+	AccountID     int        `json:"account_id"`
+	BillerID      int        `json:"biller_id"`
+	BillerName    string     `json:"biller_name"`
+	Reference     string     `json:"reference"`
+	Amount        int        `json:"amount"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	ScheduledFor  *string    `json:"scheduled_for,omitempty"`
+	ReceiptNumber *string    `json:"receipt_number,omitempty"`
+	TransferID    *int       `json:"transfer_id,omitempty"`
+	Failure       string     `json:"failure,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	PaidAt        *time.Time `json:"paid_at,omitempty"`
+}
+
+type SaveBillerRequest struct {
+	BillerID  int    `json:"biller_id"`
+	Reference string `json:"reference"`
+	Nickname  string `json:"nickname,omitempty"`
+}
+
+// PayBillRequest names the biller and reference directly or through a
+// saved biller. A payment with ScheduledFor (YYYY-MM-DD, in the holder's
+// time zone) after today is made on that day; any other is made at once.
+type PayBillRequest struct {
+	SavedBillerID int    `json:"saved_biller_id,omitempty"`
+	BillerID      int    `json:"biller_id,omitempty"`
+	Reference     string `json:"reference,omitempty"`
+	Amount        int    `json:"amount"`
+	ScheduledFor  string `json:"scheduled_for,omitempty"`
+}
+
+// BillerStorage holds the biller and bill payment storage operations.
+type BillerStorage interface {
+	CreateBiller(*biller) error
+	GetBillers(tenantID int, activeOnly bool) ([]*biller, error)
+	GetBiller(tenantID, id int) (*biller, error)
+	DeactivateBiller(tenantID, id int) error
+	SaveBiller(*savedBiller) error
+	GetSavedBillers(accountID int) ([]*savedBiller, error)
+	GetSavedBiller(accountID, id int) (*savedBiller, error)
+	DeleteSavedBiller(accountID, id int) error
+	CreateBillPayment(*billPayment) error
+	PayBill(p *billPayment, t *transfer, receipt string) error
+	FailBillPayment(p *billPayment, status, failure string) error
+	GetBillPayments(accountID int, page pageRequest) ([]*billPayment, int, error)
+	GetBillPayment(accountID, id int) (*billPayment, error)
+	GetDueBillPayments(tenantID int, now time.Time) ([]*billPayment, error)
+}
+
+const selectBillers = "SELECT id, tenant_id, name, category, account_id, reference_label, reference_pattern, active, created_at FROM billers "
+
+func scanBiller(row interface{ Scan(...any) error }) (*biller, error) {
+	b := &biller{}
+	err := row.Scan(&b.ID, &b.TenantID, &b.Name, &b.Category, &b.AccountID, &b.ReferenceLabel, &b.ReferencePattern, &b.Active, &b.CreatedAt)
+	return b, err
+}
+
+// CreateBiller adds a biller to a tenant's directory.
+func (s *PostgresStorage) CreateBiller(b *biller) error {
+	return s.db.QueryRow(
+		"INSERT INTO billers (tenant_id, name, category, account_id, reference_label, reference_pattern) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, active, created_at",
+		b.TenantID, b.Name, b.Category, b.AccountID, b.ReferenceLabel, b.ReferencePattern,
+	).Scan(&b.ID, &b.Active, &b.CreatedAt)
+}
+
+// GetBillers lists a tenant's billers by name, leaving out the removed ones
+// if asked to.
+func (s *PostgresStorage) GetBillers(tenantID int, activeOnly bool) ([]*biller, error) {
+	rows, err := s.db.Query(selectBillers+"WHERE tenant_id = $1 AND (active OR NOT $2) ORDER BY name, id", tenantID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	billers := make([]*biller, 0)
+	for rows.Next() {
+		b, err := scanBiller(rows)
+		if err != nil {
+			return nil, err
+		}
+		billers = append(billers, b)
+	}
+	return billers, rows.Err()
+}
+
+// GetBiller retrieves one of a tenant's billers.
+func (s *PostgresStorage) GetBiller(tenantID, id int) (*biller, error) {
+	return scanBiller(s.db.QueryRow(selectBillers+"WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+// DeactivateBiller removes a biller from the directory. Its past payments
+// are kept; the ones still scheduled fail when due.
+func (s *PostgresStorage) DeactivateBiller(tenantID, id int) error {
+	res, err := s.db.Exec("UPDATE billers SET active = FALSE WHERE id = $1 AND tenant_id = $2 AND active", id, tenantID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SaveBiller stores a biller reference of an account.
+func (s *PostgresStorage) SaveBiller(sb *savedBiller) error {
+	err := s.db.QueryRow(
+		"INSERT INTO saved_billers (account_id, biller_id, reference, nickname) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING id, created_at",
+		sb.AccountID, sb.BillerID, sb.Reference, sb.Nickname,
+	).Scan(&sb.ID, &sb.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errSavedBillerExists
+	}
+	return err
+}
+
+const selectSavedBillers = "SELECT sb.id, sb.account_id, sb.biller_id, b.name, sb.reference, sb.nickname, sb.created_at FROM saved_billers sb JOIN billers b ON b.id = sb.biller_id "
+
+func scanSavedBiller(row interface{ Scan(...any) error }) (*savedBiller, error) {
+	sb := &savedBiller{}
+	err := row.Scan(&sb.ID, &sb.AccountID, &sb.BillerID, &sb.BillerName, &sb.Reference, &sb.Nickname, &sb.CreatedAt)
+	return sb, err
+}
+
+// GetSavedBillers lists an account's saved billers of active billers.
+func (s *PostgresStorage) GetSavedBillers(accountID int) ([]*savedBiller, error) {
+	rows, err := s.db.Query(selectSavedBillers+"WHERE sb.account_id = $1 AND b.active ORDER BY sb.id", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	saved := make([]*savedBiller, 0)
+	for rows.Next() {
+		sb, err := scanSavedBiller(rows)
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, sb)
+	}
+	return saved, rows.Err()
+}
+
+// GetSavedBiller retrieves one of an account's saved billers.
+func (s *PostgresStorage) GetSavedBiller(accountID, id int) (*savedBiller, error) {
+	return scanSavedBiller(s.db.QueryRow(selectSavedBillers+"WHERE sb.id = $1 AND sb.account_id = $2", id, accountID))
+}
+
+// DeleteSavedBiller removes one of an account's saved billers.
+func (s *PostgresStorage) DeleteSavedBiller(accountID, id int) error {
+	res, err := s.db.Exec("DELETE FROM saved_billers WHERE id = $1 AND account_id = $2", id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateBillPayment stores a bill payment before it is paid.
+func (s *PostgresStorage) CreateBillPayment(p *billPayment) error {
+	return s.db.QueryRow(
+		"INSERT INTO bill_payments (account_id, biller_id, reference, amount, currency, status, scheduled_for) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+		p.AccountID, p.BillerID, p.Reference, p.Amount, p.Currency, p.Status, p.ScheduledFor,
+	).Scan(&p.ID, &p.CreatedAt)
+}
+
+// PayBill pays a scheduled bill payment with t and gives it the receipt
+// number, all or nothing.
+func (s *PostgresStorage) PayBill(p *billPayment, t *transfer, receipt string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM bill_payments WHERE id = $1 FOR UPDATE", p.ID).Scan(&status); err != nil {
+		return err
+	}
+	if status != billScheduled {
+		return errBillNotScheduled
+	}
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	err = tx.QueryRow(
+		"UPDATE bill_payments SET status = $2, receipt_number = $3, transfer_id = $4, paid_at = now() WHERE id = $1 RETURNING status, receipt_number, transfer_id, paid_at",
+		p.ID, billPaid, receipt, t.ID,
+	).Scan(&p.Status, &p.ReceiptNumber, &p.TransferID, &p.PaidAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FailBillPayment ends a scheduled bill payment unpaid, as failed with the
+// reason or as cancelled.
+func (s *PostgresStorage) FailBillPayment(p *billPayment, status, failure string) error {
+	err := s.db.QueryRow(
+		"UPDATE bill_payments SET status = $2, failure = $3 WHERE id = $1 AND status = $4 RETURNING status, failure",
+		p.ID, status, failure, billScheduled,
+	).Scan(&p.Status, &p.Failure)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errBillNotScheduled
+	}
+	return err
+}
+
+const selectBillPayments = `
+        SELECT p.id, p.account_id, p.biller_id, b.name, p.reference, p.amount, p.currency, p.status, to_char(p.scheduled_for, 'YYYY-MM-DD'),
+            p.receipt_number, p.transfer_id, p.failure, p.created_at, p.paid_at
+        FROM bill_payments p JOIN billers b ON b.id = p.biller_id `
+
+func scanBillPayment(row interface{ Scan(...any) error }) (*billPayment, error) {
+	p := &billPayment{}
+	err := row.Scan(&p.ID, &p.AccountID, &p.BillerID, &p.BillerName, &p.Reference, &p.Amount, &p.Currency, &p.Status, &p.ScheduledFor,
+		&p.ReceiptNumber, &p.TransferID, &p.Failure, &p.CreatedAt, &p.PaidAt)
+	return p, err
+}
+
+func (s *PostgresStorage) queryBillPayments(where string, args ...any) ([]*billPayment, error) {
+	rows, err := s.db.Query(selectBillPayments+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := make([]*billPayment, 0)
+	for rows.Next() {
+		p, err := scanBillPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// GetBillPayments lists an account's bill payments, newest first.
+func (s *PostgresStorage) GetBillPayments(accountID int, page pageRequest) ([]*billPayment, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM bill_payments WHERE account_id = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "p")
+	payments, err := s.queryBillPayments("WHERE p.account_id = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return payments, total, err
+}
+
+// GetBillPayment retrieves one of an account's bill payments.
+func (s *PostgresStorage) GetBillPayment(accountID, id int) (*billPayment, error) {
+	return scanBillPayment(s.db.QueryRow(selectBillPayments+"WHERE p.id = $1 AND p.account_id = $2", id, accountID))
+}
+
+// GetDueBillPayments lists a tenant's scheduled bill payments whose date
+// has come by now in the time zone of their account.
+func (s *PostgresStorage) GetDueBillPayments(tenantID int, now time.Time) ([]*billPayment, error) {
+	return s.queryBillPayments(`WHERE b.tenant_id = $1 AND p.status = $2
+        AND p.scheduled_for <= ($3::timestamptz AT TIME ZONE (SELECT COALESCE(NULLIF(timezone, ''), 'UTC') FROM accounts WHERE id = p.account_id))::date
+        ORDER BY p.scheduled_for, p.id`, tenantID, billScheduled, now)
+}
+
+// checkBillReference validates a bill reference against the biller's
+// pattern, returning it trimmed.
+func checkBillReference(b *biller, reference string) (string, error) {
+	reference = strings.TrimSpace(reference)
+	if reference == "" {
+		return "", newAPIError(http.StatusBadRequest, "required_field", b.ReferenceLabel)
+	}
+	if b.ReferencePattern != "" {
+		if ok, err := regexp.MatchString("^(?:"+b.ReferencePattern+")$", reference); err != nil || !ok {
+			return "", newAPIError(http.StatusBadRequest, "invalid_bill_reference", b.ReferenceLabel, b.Name)
+		}
+	}
+	return reference, nil
+}
+
+// activeBiller loads a biller customers can pay.
+func (s *Apiserver) activeBiller(tenantID, id int) (*biller, error) {
+	b, err := s.store.GetBiller(tenantID, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !b.Active) {
+		return nil, newAPIError(http.StatusNotFound, "biller_not_found", id)
+	}
+	return b, err
+}
+
+// payBill pays a stored bill payment from its account into the biller's
+// account and sends the confirmation with the receipt number.
+func (s *Apiserver) payBill(p *billPayment) error {
+	acc, err := s.store.GetAccountByID(p.AccountID)
+	if err != nil {
+		return err
+	}
+	b, err := s.activeBiller(acc.TenantID, p.BillerID)
+	if err != nil {
+		return err
+	}
+	t, err := s.newTransfer(acc, b.AccountID, p.Amount, fmt.Sprintf("Bill: %s %s", b.Name, p.Reference))
+	if err != nil {
+		return err
+	}
+	if err := s.checkCosignerThreshold(acc.ID, t.Amount); err != nil {
+		return err
+	}
+	receipt, err := newReference("BPR-", clock.Now())
+	if err != nil {
+		return err
+	}
+	if err := s.store.PayBill(p, t, receipt); errors.Is(err, errBillNotScheduled) {
+		return newAPIError(http.StatusConflict, "bill_payment_not_scheduled", p.ID)
+	} else if err != nil {
+		return transferFailed(err)
+	}
+	s.transferCompleted(t)
+	s.notify(acc.ID, "bill_paid", fmt.Sprintf("You paid %s to %s for %s. Receipt number: %s",
+		formatMoney(p.Amount, p.Currency, defaultLocale), b.Name, p.Reference, receipt))
+	return nil
+}
+
+// runBillPayments makes the tenant's scheduled bill payments that are due,
+// failing the ones that cannot be paid.
+func (s *Apiserver) runBillPayments(tenantID int) ([]*billPayment, error) {
+	due, err := s.store.GetDueBillPayments(tenantID, clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range due {
+		err := s.payBill(p)
+		if err == nil {
+			continue
+		}
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			logf("bill payments: payment %d failed: %v\n", p.ID, err)
+			continue
+		}
+		if err := s.store.FailBillPayment(p, billFailed, apiErr.Code); err != nil && !errors.Is(err, errBillNotScheduled) {
+			logf("bill payments: failed to record failure of payment %d: %v\n", p.ID, err)
+			continue
+		}
+		s.notify(p.AccountID, "bill_payment_failed", fmt.Sprintf("Your scheduled payment of %s to %s could not be made (%s)",
+			formatMoney(p.Amount, p.Currency, defaultLocale), p.BillerName, apiErr.Code))
+	}
+	return due, nil
+}
+
+// startBillPaymentJob makes the scheduled bill payments in the background
+// on a fixed interval. A zero interval disables the job.
+func (s *Apiserver) startBillPaymentJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.pausedForReadOnly("bill payments") {
+				continue
+			}
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("bill payments: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runBillPayments(t.ID); err != nil {
+					logf("bill payments: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleBillers lists the tenant's billers customers can pay, optionally
+// only those in ?category=.
+func (s *Apiserver) handleBillers(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	billers, err := s.store.GetBillers(caller.TenantID, true)
+	if err != nil {
+		return err
+	}
+	if category := r.URL.Query().Get("category"); category != "" {
+		filtered := make([]*biller, 0, len(billers))
+		for _, b := range billers {
+			if strings.EqualFold(b.Category, category) {
+				filtered = append(filtered, b)
+			}
+		}
+		billers = filtered
+	}
+	return writeJSON(w, http.StatusOK, billers)
+}
+
+// handleAdminBillers lists the tenant's billers, removed ones included
+// (GET), or adds one collected in one of the tenant's accounts (POST).
+func (s *Apiserver) handleAdminBillers(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		billers, err := s.store.GetBillers(tenantID, false)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, billers)
+	}
+
+	b := &biller{}
+	if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+		return err
+	}
+	b.TenantID = tenantID
+	b.Name, b.Category = strings.TrimSpace(b.Name), strings.ToLower(strings.TrimSpace(b.Category))
+	b.ReferenceLabel = cmp.Or(strings.TrimSpace(b.ReferenceLabel), "Reference")
+	if b.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if _, err := regexp.Compile(b.ReferencePattern); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_pattern", b.ReferencePattern)
+	}
+	acc, err := s.store.GetAccountByID(b.AccountID)
+	if err != nil || acc.TenantID != tenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", b.AccountID)
+	}
+	if err := s.store.CreateBiller(b); err != nil {
+		return err
+	}
+	s.audit(r, "biller.created", "biller", b.ID, b)
+	return writeJSON(w, http.StatusCreated, b)
+}
+
+// handleDeleteBiller removes a biller from the directory.
+func (s *Apiserver) handleDeleteBiller(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeactivateBiller(requestTenant(r).ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "biller_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "biller.deleted", "biller", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// handleSavedBillers lists an account's saved billers (GET) or saves a
+// biller reference (POST).
+func (s *Apiserver) handleSavedBillers(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		saved, err := s.store.GetSavedBillers(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, saved)
+	}
+
+	req := SaveBillerRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	b, err := s.activeBiller(acc.TenantID, req.BillerID)
+	if err != nil {
+		return err
+	}
+	reference, err := checkBillReference(b, req.Reference)
+	if err != nil {
+		return err
+	}
+	sb := &savedBiller{AccountID: acc.ID, BillerID: b.ID, BillerName: b.Name, Reference: reference, Nickname: strings.TrimSpace(req.Nickname)}
+	if err := s.store.SaveBiller(sb); errors.Is(err, errSavedBillerExists) {
+		return newAPIError(http.StatusConflict, "saved_biller_exists", b.Name, reference)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, sb)
+}
+
+// handleDeleteSavedBiller removes one of an account's saved billers.
+func (s *Apiserver) handleDeleteSavedBiller(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("biller"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("biller"))
+	}
+	if err := s.store.DeleteSavedBiller(acc.ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "saved_biller_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// handleBillPayments lists an account's bill payments (GET) or pays a bill
+// from it, now or on a later date (POST).
+func (s *Apiserver) handleBillPayments(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		payments, total, err := s.store.GetBillPayments(acc.ID, page)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, paginate(payments, total, page, func(p *billPayment) cursor { return cursor{p.CreatedAt, p.ID} }))
+	}
+
+	req := PayBillRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.SavedBillerID != 0 {
+		sb, err := s.store.GetSavedBiller(acc.ID, req.SavedBillerID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "saved_biller_not_found", req.SavedBillerID)
+		} else if err != nil {
+			return err
+		}
+		req.BillerID, req.Reference = sb.BillerID, sb.Reference
+	}
+	b, err := s.activeBiller(acc.TenantID, req.BillerID)
+	if err != nil {
+		return err
+	}
+	reference, err := checkBillReference(b, req.Reference)
+	if err != nil {
+		return err
+	}
+	// Validate the transfer up front so a scheduled payment that could
+	// never be made is refused now rather than failing on its date.
+	if _, err := s.newTransfer(acc, b.AccountID, req.Amount, ""); err != nil {
+		return err
+	}
+	if err := s.checkCosignerThreshold(acc.ID, req.Amount); err != nil {
+		return err
+	}
+
+	p := &billPayment{AccountID: acc.ID, BillerID: b.ID, BillerName: b.Name, Reference: reference, Amount: req.Amount, Currency: acc.Currency, Status: billScheduled}
+	if req.ScheduledFor != "" {
+		day, err := time.Parse(time.DateOnly, req.ScheduledFor)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_date", req.ScheduledFor)
+		}
+		if day.Format(time.DateOnly) > localDate(acc, clock.Now()) {
+			p.ScheduledFor = &req.ScheduledFor
+		}
+	}
+	if err := s.store.CreateBillPayment(p); err != nil {
+		return err
+	}
+	if p.ScheduledFor != nil {
+		s.audit(r, "bill_payment.scheduled", "bill_payment", p.ID, p)
+		return writeJSON(w, http.StatusCreated, p)
+	}
+	if err := s.payBill(p); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			if err := s.store.FailBillPayment(p, billFailed, apiErr.Code); err != nil && !errors.Is(err, errBillNotScheduled) {
+				return err
+			}
+		}
+		return err
+	}
+	s.audit(r, "bill_payment.paid", "bill_payment", p.ID, p)
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// handleGetBillPayment returns one of an account's bill payments, the
+// receipt once it is paid.
+func (s *Apiserver) handleGetBillPayment(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("payment"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("payment"))
+	}
+	p, err := s.store.GetBillPayment(acc.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "bill_payment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, p)
+}
+
+// handleCancelBillPayment cancels a scheduled bill payment before its date.
+func (s *Apiserver) handleCancelBillPayment(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("payment"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("payment"))
+	}
+	p, err := s.store.GetBillPayment(acc.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "bill_payment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	if err := s.store.FailBillPayment(p, billCancelled, ""); errors.Is(err, errBillNotScheduled) {
+		return newAPIError(http.StatusConflict, "bill_payment_not_scheduled", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "bill_payment.cancelled", "bill_payment", p.ID, nil)
+	return writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+var cacheLookups = expvar.NewMap("cache_lookups")
+
+// flight is one in-progress load shared by every caller asking for its key.
+type flight[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// ttlCache is an in-process cache whose entries expire ttl after they were
+// loaded. Concurrent misses of the same key are coalesced into a single
+// load, so a burst of identical requests reaches the database once.
+type ttlCache[T any] struct {
+	name string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[T]
+	flights map[string]*flight[T]
+	// gen is bumped whenever entries are dropped, so loads that started
+	// before are not cached.
+	gen int
+}
+
+type cacheEntry[T any] struct {
+	value   T
+	expires time.Time
+}
+
+func newTTLCache[T any](name string, ttl time.Duration) *ttlCache[T] {
+	return &ttlCache[T]{name: name, ttl: ttl, entries: map[string]cacheEntry[T]{}, flights: map[string]*flight[T]{}}
+}
+
+// Get returns the cached value of key, or loads it. Errors are returned to
+// every waiting caller but not cached.
+func (c *ttlCache[T]) Get(key string, load func() (T, error)) (T, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && clock.Now().Before(e.expires) {
+		c.mu.Unlock()
+		cacheLookups.Add(c.name+":hit", 1)
+		return e.value, nil
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		cacheLookups.Add(c.name+":shared", 1)
+		<-f.done
+		return f.value, f.err
+	}
+	f := &flight[T]{done: make(chan struct{})}
+	c.flights[key] = f
+	gen := c.gen
+	c.mu.Unlock()
+	cacheLookups.Add(c.name+":miss", 1)
+
+	f.value, f.err = load()
+	c.mu.Lock()
+	delete(c.flights, key)
+	if f.err == nil && gen == c.gen {
+		c.entries[key] = cacheEntry[T]{value: f.value, expires: clock.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.value, f.err
+}
+
+// Delete drops key from the cache.
+func (c *ttlCache[T]) Delete(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.gen++
+	c.mu.Unlock()
+}
+
+// Purge drops every entry.
+func (c *ttlCache[T]) Purge() {
+	c.mu.Lock()
+	clear(c.entries)
+	c.gen++
+	c.mu.Unlock()
+}
+
+// cachedStorage is a Storage decorator caching the hot lookups of tenants
+// by slug, accounts by number and exchange rates for a short ttl. Writes
+// going through it drop the entries they affect; changes made elsewhere,
+// such as balances moved by transfers, show up once entries expire, so
+// callers that need exact balances read the account inside their
+// transaction as before.
+type cachedStorage struct {
+	Storage
+	tenants *ttlCache[*tenant]
+	numbers *ttlCache[*account]
+	fxRates *ttlCache[[]*fxRate]
+}
+
+// cacheStorage wraps the store with caching, or returns it unchanged when
+// ttl is not positive.
+func cacheStorage(store Storage, ttl time.Duration) Storage {
+	if ttl <= 0 {
+		return store
+	}
+	return &cachedStorage{
+		Storage: store,
+		tenants: newTTLCache[*tenant]("tenants", ttl),
+		numbers: newTTLCache[*account]("account_numbers", ttl),
+		fxRates: newTTLCache[[]*fxRate]("fx_rates", ttl),
+	}
+}
+
+func (c *cachedStorage) GetTenantBySlug(slug string) (*tenant, error) {
+	t, err := c.tenants.Get(slug, func() (*tenant, error) { return c.Storage.GetTenantBySlug(slug) })
+	if err != nil {
+		return nil, err
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (c *cachedStorage) GetAccountByNumber(tenantID int, number string) (*account, error) {
+	acc, err := c.numbers.Get(fmt.Sprintf("%d/%s", tenantID, number), func() (*account, error) {
+		return c.Storage.GetAccountByNumber(tenantID, number)
+	})
+	if err != nil {
+		return nil, err
+	}
+	copied := *acc
+	copied.Metadata = maps.Clone(acc.Metadata)
+	return &copied, nil
+}
+
+func (c *cachedStorage) GetFXRates(tenantID int) ([]*fxRate, error) {
+	rates, err := c.fxRates.Get(fmt.Sprint(tenantID), func() ([]*fxRate, error) { return c.Storage.GetFXRates(tenantID) })
+	if err != nil {
+		return nil, err
+	}
+	copied := make([]*fxRate, len(rates))
+	for i, rate := range rates {
+		r := *rate
+		copied[i] = &r
+	}
+	return copied, nil
+}
+
+func (c *cachedStorage) SetFXRate(tenantID int, rate *fxRate) error {
+	defer c.fxRates.Delete(fmt.Sprint(tenantID))
+	return c.Storage.SetFXRate(tenantID, rate)
+}
+
+// The account writes below may change or free account numbers. They are
+// rare next to lookups, so they drop every cached account.
+
+func (c *cachedStorage) UpdateAccount(a *account) error {
+	defer c.numbers.Purge()
+	return c.Storage.UpdateAccount(a)
+}
+
+func (c *cachedStorage) DeleteAccount(id int) error {
+	defer c.numbers.Purge()
+	return c.Storage.DeleteAccount(id)
+}
+
+func (c *cachedStorage) UpsertAccountByExternalID(a *account) (bool, error) {
+	defer c.numbers.Purge()
+	return c.Storage.UpsertAccountByExternalID(a)
+}
+
+func (c *cachedStorage) UpdateAccountMetadata(id int, set map[string]string, remove []string) (map[string]string, error) {
+	defer c.numbers.Purge()
+	return c.Storage.UpdateAccountMetadata(id, set, remove)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createHolidaysTable = `
+        CREATE TABLE IF NOT EXISTS holidays (
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            day DATE NOT NULL,
+            name TEXT NOT NULL,
+            PRIMARY KEY (tenant_id, day)
+        )
+    `
+
+// maxCalendarSearch bounds how far the calendar looks for a business day, so
+// a misconfigured calendar (every day a holiday) cannot loop forever.
+const maxCalendarSearch = 366
+
+// holiday is a public holiday of a tenant on which nothing settles.
+type holiday struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// HolidayStorage holds the holiday calendar storage operations.
+type HolidayStorage interface {
+	GetHolidays(tenantID int) ([]*holiday, error)
+	SetHoliday(tenantID int, h *holiday) error
+	DeleteHoliday(tenantID int, date string) error
+}
+
+// GetHolidays lists a tenant's holidays by date.
+func (s *PostgresStorage) GetHolidays(tenantID int) ([]*holiday, error) {
+	rows, err := s.db.Query("SELECT to_char(day, 'YYYY-MM-DD'), name FROM holidays WHERE tenant_id = $1 ORDER BY day", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holidays := make([]*holiday, 0)
+	for rows.Next() {
+		h := &holiday{}
+		if err := rows.Scan(&h.Date, &h.Name); err != nil {
+			return nil, err
+		}
+		holidays = append(holidays, h)
+	}
+	return holidays, rows.Err()
+}
+
+// SetHoliday creates or renames a holiday.
+func (s *PostgresStorage) SetHoliday(tenantID int, h *holiday) error {
+	_, err := s.db.Exec("INSERT INTO holidays (tenant_id, day, name) VALUES ($1, $2, $3) ON CONFLICT (tenant_id, day) DO UPDATE SET name = EXCLUDED.name", tenantID, h.Date, h.Name)
+	return err
+}
+
+// DeleteHoliday removes a holiday.
+func (s *PostgresStorage) DeleteHoliday(tenantID int, date string) error {
+	_, err := s.db.Exec("DELETE FROM holidays WHERE tenant_id = $1 AND day = $2", tenantID, date)
+	return err
+}
+
+// businessCalendar tells business days from weekends and holidays. Dates
+// are calendar days; only their year, month and day are used.
+type businessCalendar struct {
+	weekend  map[time.Weekday]bool
+	holidays map[string]string
+}
+
+// IsBusinessDay reports whether d is neither a weekend day nor a holiday.
+func (c *businessCalendar) IsBusinessDay(d time.Time) bool {
+	_, holiday := c.holidays[d.Format(time.DateOnly)]
+	return !c.weekend[d.Weekday()] && !holiday
+}
+
+// RollForward returns d if it is a business day, else the next one.
+func (c *businessCalendar) RollForward(d time.Time) time.Time {
+	for i := 0; i < maxCalendarSearch && !c.IsBusinessDay(d); i++ {
+		d = d.AddDate(0, 0, 1)
+	}
+	return d
+}
+
+// AddBusinessDays returns the nth business day after d.
+func (c *businessCalendar) AddBusinessDays(d time.Time, n int) time.Time {
+	for ; n > 0; n-- {
+		d = c.RollForward(d.AddDate(0, 0, 1))
+	}
+	return d
+}
+
+// parseWeekend reads a comma separated list of weekday names, such as
+// "sat,sun", as configured by BUSINESS_WEEKEND.
+func parseWeekend(days string) map[time.Weekday]bool {
+	weekend := map[time.Weekday]bool{}
+	for _, name := range strings.Split(strings.ToLower(days), ",") {
+		name = strings.TrimSpace(name)
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if name != "" && strings.HasPrefix(strings.ToLower(d.String()), name) {
+				weekend[d] = true
+			}
+		}
+	}
+	return weekend
+}
+
+// calendar loads the business calendar of a tenant.
+func (s *Apiserver) calendar(tenantID int) (*businessCalendar, error) {
+	holidays, err := s.store.GetHolidays(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	c := &businessCalendar{weekend: parseWeekend(s.cfg().BusinessWeekend), holidays: make(map[string]string, len(holidays))}
+	for _, h := range holidays {
+		c.holidays[h.Date] = h.Name
+	}
+	return c, nil
+}
+
+// handleHolidays lists the tenant's holidays (GET) or adds one (POST).
+func (s *Apiserver) handleHolidays(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		holidays, err := s.store.GetHolidays(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, holidays)
+	}
+
+	h := &holiday{}
+	if err := json.NewDecoder(r.Body).Decode(h); err != nil {
+		return err
+	}
+	if _, err := time.Parse(time.DateOnly, h.Date); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_date", h.Date)
+	}
+	if h.Name = strings.TrimSpace(h.Name); h.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if err := s.store.SetHoliday(tenantID, h); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, h)
+}
+
+// handleDeleteHoliday removes one of the tenant's holidays.
+func (s *Apiserver) handleDeleteHoliday(w http.ResponseWriter, r *http.Request) error {
+	date := r.PathValue("date")
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_date", date)
+	}
+	if err := s.store.DeleteHoliday(requestTenant(r).ID, date); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]string{"deleted": date})
+}
+
+// BusinessDayResponse answers whether a date is a business day.
+type BusinessDayResponse struct {
+	Date            string `json:"date"`
+	BusinessDay     bool   `json:"business_day"`
+	NextBusinessDay string `json:"next_business_day"`
+}
+
+// handleBusinessDay reports whether ?date= (today by default) is a business
+// day and which business day follows it.
+func (s *Apiserver) handleBusinessDay(w http.ResponseWriter, r *http.Request) error {
+	day := clock.Now().UTC().Truncate(24 * time.Hour)
+	if v := r.URL.Query().Get("date"); v != "" {
+		var err error
+		if day, err = time.Parse(time.DateOnly, v); err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_date", v)
+		}
+	}
+	c, err := s.calendar(requestTenant(r).ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, BusinessDayResponse{
+		Date:            day.Format(time.DateOnly),
+		BusinessDay:     c.IsBusinessDay(day),
+		NextBusinessDay: c.AddBusinessDays(day, 1).Format(time.DateOnly),
+	})
+}
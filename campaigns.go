@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createCampaignsTable = `
+        CREATE TABLE IF NOT EXISTS campaigns (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            subject TEXT NOT NULL,
+            message TEXT NOT NULL,
+            channels TEXT[] NOT NULL,
+            segment JSONB NOT NULL,
+            status TEXT NOT NULL DEFAULT 'queued',
+            created_by INT NOT NULL REFERENCES accounts(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            completed_at TIMESTAMPTZ
+        )
+    `
+
+const createCampaignRecipientsTable = `
+        CREATE TABLE IF NOT EXISTS campaign_recipients (
+            id SERIAL PRIMARY KEY,
+            campaign_id INT NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            status TEXT NOT NULL DEFAULT 'pending',
+            error TEXT NOT NULL DEFAULT '',
+            sent_at TIMESTAMPTZ,
+            UNIQUE (campaign_id, account_id)
+        )
+    `
+
+const (
+	campaignQueued    = "queued"
+	campaignCompleted = "completed"
+)
+
+const (
+	recipientPending = "pending"
+	recipientSent    = "sent"
+	recipientFailed  = "failed"
+)
+
+// campaignBatchSize is how many recipients the campaign job loads at once.
+const campaignBatchSize = 200
+
+// maxCampaignMessageLength bounds the text of a campaign.
+const maxCampaignMessageLength = 2000
+
+// campaign is a message sent by admins to a segment of customers. The
+// recipients are fixed when it is created; the campaign job then delivers
+// it to each of them in the background.
+type campaign struct {
+	ID          int           `json:"id"`
+	TenantID    int           `json:"tenant_id"`
+	Subject     string        `json:"subject"`
+	Message     string        `json:"message"`
+	Channels    []string      `json:"channels"`
+	SegmentID   *int          `json:"segment_id,omitempty"`
+	Segment     segmentFilter `json:"segment"`
+	Status      string        `json:"status"`
+	CreatedBy   int           `json:"created_by"`
+	Recipients  int           `json:"recipients"`
+	Sent        int           `json:"sent"`
+	Failed      int           `json:"failed"`
+	CreatedAt   time.Time     `json:"created_at"`
+	CompletedAt *time.Time    `json:"completed_at,omitempty"`
+}
+
+// campaignRecipient is the delivery status of a campaign to one customer.
+type campaignRecipient struct {
+	ID        int        `json:"id"`
+	AccountID int        `json:"account_id"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	account   *account
+}
+
+type CreateCampaignRequest struct {
+	Subject  string   `json:"subject"`
+	Message  string   `json:"message"`
+	Channels []string `json:"channels"`
+	// SegmentID sends the campaign to a saved segment instead of Segment.
+	SegmentID int           `json:"segment_id,omitempty"`
+	Segment   segmentFilter `json:"segment"`
+}
+
+// CampaignSender emails campaigns to customers. The server logs them
+// unless an email provider is plugged in.
+type CampaignSender interface {
+	SendCampaign(acc *account, subject, message string) error
+}
+
+// logCampaignSender prints campaign emails to the server log, for local
+// development.
+type logCampaignSender struct{}
+
+func (logCampaignSender) SendCampaign(acc *account, subject, message string) error {
+	fmt.Printf("campaign %q for account %d (%s)\n", subject, acc.ID, acc.Email)
+	return nil
+}
+
+// CampaignStorage holds the campaign storage operations.
+type CampaignStorage interface {
+	CreateCampaign(*campaign) error
+	GetCampaign(tenantID, id int) (*campaign, error)
+	GetCampaigns(tenantID int) ([]*campaign, error)
+	GetCampaignRecipients(campaignID int, status string, page pageRequest) ([]*campaignRecipient, int, error)
+	GetPendingRecipients(campaignID, limit int) ([]*campaignRecipient, error)
+	UpdateCampaignRecipient(*campaignRecipient) error
+	CompleteCampaign(id int) error
+}
+
+// CreateCampaign stores a campaign and a pending recipient for every
+// customer in its segment, in one transaction.
+func (s *PostgresStorage) CreateCampaign(c *campaign) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	segment, err := json.Marshal(c.Segment)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(
+		"INSERT INTO campaigns (tenant_id, subject, message, channels, segment, segment_id, created_by) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, status, created_at",
+		c.TenantID, c.Subject, c.Message, pq.Array(c.Channels), segment, c.SegmentID, c.CreatedBy,
+	).Scan(&c.ID, &c.Status, &c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	cond, args := c.Segment.where(3, clock.Now())
+	res, err := tx.Exec(
+		"INSERT INTO campaign_recipients (campaign_id, account_id) SELECT $1, a.id FROM accounts a WHERE a.tenant_id = $2 AND "+cond,
+		append([]any{c.ID, c.TenantID}, args...)...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	c.Recipients = int(n)
+	return tx.Commit()
+}
+
+const selectCampaigns = `
+    SELECT c.id, c.tenant_id, c.subject, c.message, c.channels, c.segment, c.segment_id, c.status, c.created_by, c.created_at, c.completed_at,
+        COUNT(r.id), COUNT(r.id) FILTER (WHERE r.status = 'sent'), COUNT(r.id) FILTER (WHERE r.status = 'failed')
+    FROM campaigns c LEFT JOIN campaign_recipients r ON r.campaign_id = c.id `
+
+func (s *PostgresStorage) queryCampaigns(where string, args ...any) ([]*campaign, error) {
+	rows, err := s.db.Query(selectCampaigns+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := make([]*campaign, 0)
+	for rows.Next() {
+		c := &campaign{}
+		var segment []byte
+		if err := rows.Scan(&c.ID, &c.TenantID, &c.Subject, &c.Message, pq.Array(&c.Channels), &segment, &c.SegmentID, &c.Status, &c.CreatedBy, &c.CreatedAt, &c.CompletedAt,
+			&c.Recipients, &c.Sent, &c.Failed); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(segment, &c.Segment); err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+// GetCampaign retrieves a campaign of a tenant with its delivery counts.
+func (s *PostgresStorage) GetCampaign(tenantID, id int) (*campaign, error) {
+	campaigns, err := s.queryCampaigns("WHERE c.id = $1 AND c.tenant_id = $2 GROUP BY c.id", id, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if len(campaigns) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return campaigns[0], nil
+}
+
+// GetCampaigns lists the tenant's campaigns, newest first.
+func (s *PostgresStorage) GetCampaigns(tenantID int) ([]*campaign, error) {
+	return s.queryCampaigns("WHERE c.tenant_id = $1 GROUP BY c.id ORDER BY c.id DESC", tenantID)
+}
+
+// GetCampaignRecipients returns a page of a campaign's recipients in id
+// order, optionally only those with a status, and their total count.
+func (s *PostgresStorage) GetCampaignRecipients(campaignID int, status string, page pageRequest) ([]*campaignRecipient, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM campaign_recipients WHERE campaign_id = $1 AND ($2 = '' OR status = $2)", campaignID, status)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keysetByID(3)
+	rows, err := s.db.Query(
+		"SELECT id, account_id, status, error, sent_at FROM campaign_recipients WHERE campaign_id = $1 AND ($2 = '' OR status = $2) AND "+cond+" "+order,
+		append([]any{campaignID, status}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	recipients := make([]*campaignRecipient, 0)
+	for rows.Next() {
+		r := &campaignRecipient{}
+		if err := rows.Scan(&r.ID, &r.AccountID, &r.Status, &r.Error, &r.SentAt); err != nil {
+			return nil, 0, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, total, rows.Err()
+}
+
+// GetPendingRecipients returns up to limit recipients a campaign has not
+// been delivered to yet, with their accounts.
+func (s *PostgresStorage) GetPendingRecipients(campaignID, limit int) ([]*campaignRecipient, error) {
+	rows, err := s.db.Query(`
+        SELECT r.id, r.account_id, r.status, a.tenant_id, a.email, a.name, a.locale
+        FROM campaign_recipients r JOIN accounts a ON a.id = r.account_id
+        WHERE r.campaign_id = $1 AND r.status = 'pending' ORDER BY r.id LIMIT $2`,
+		campaignID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := make([]*campaignRecipient, 0)
+	for rows.Next() {
+		r := &campaignRecipient{account: &account{}}
+		if err := rows.Scan(&r.ID, &r.AccountID, &r.Status, &r.account.TenantID, &r.account.Email, &r.account.Name, &r.account.Locale); err != nil {
+			return nil, err
+		}
+		r.account.ID = r.AccountID
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
+
+// UpdateCampaignRecipient stores the outcome of a delivery.
+func (s *PostgresStorage) UpdateCampaignRecipient(r *campaignRecipient) error {
+	_, err := s.db.Exec("UPDATE campaign_recipients SET status = $1, error = $2, sent_at = $3 WHERE id = $4", r.Status, r.Error, r.SentAt, r.ID)
+	return err
+}
+
+// CompleteCampaign marks a campaign completed once no recipient is pending.
+func (s *PostgresStorage) CompleteCampaign(id int) error {
+	_, err := s.db.Exec(`
+        UPDATE campaigns SET status = 'completed', completed_at = now()
+        WHERE id = $1 AND status <> 'completed'
+            AND NOT EXISTS (SELECT 1 FROM campaign_recipients WHERE campaign_id = $1 AND status = 'pending')`,
+		id)
+	return err
+}
+
+// runCampaigns delivers the tenant's queued campaigns to their pending
+// recipients and returns the campaigns it worked on.
+func (s *Apiserver) runCampaigns(tenantID int) ([]*campaign, error) {
+	campaigns, err := s.store.GetCampaigns(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	done := make([]*campaign, 0)
+	for _, c := range campaigns {
+		if c.Status != campaignQueued {
+			continue
+		}
+		for {
+			recipients, err := s.store.GetPendingRecipients(c.ID, campaignBatchSize)
+			if err != nil {
+				return nil, err
+			}
+			if len(recipients) == 0 {
+				break
+			}
+			for _, r := range recipients {
+				s.deliverCampaign(c, r)
+				if err := s.store.UpdateCampaignRecipient(r); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := s.store.CompleteCampaign(c.ID); err != nil {
+			return nil, err
+		}
+		done = append(done, c)
+	}
+	return done, nil
+}
+
+// deliverCampaign sends a campaign to one recipient on every channel and
+// sets the recipient's status.
+func (s *Apiserver) deliverCampaign(c *campaign, r *campaignRecipient) {
+	var errs []string
+	for _, channel := range c.Channels {
+		var err error
+		switch channel {
+		case channelInApp:
+			n := &notification{AccountID: r.AccountID, Kind: "campaign", Message: c.Subject + ": " + c.Message}
+			if err = s.store.CreateNotification(n); err == nil {
+				s.publishEvent(r.AccountID, "notification.campaign", n)
+			}
+		case channelEmail:
+			err = s.campaigns.SendCampaign(r.account, c.Subject, c.Message)
+		}
+		if err != nil {
+			errs = append(errs, channel+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		r.Status, r.Error = recipientFailed, strings.Join(errs, "; ")
+		return
+	}
+	now := clock.Now()
+	r.Status, r.Error, r.SentAt = recipientSent, "", &now
+}
+
+// startCampaignJob delivers queued campaigns in the background.
+func (s *Apiserver) startCampaignJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("campaigns: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runCampaigns(t.ID); err != nil {
+					logf("campaigns: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleCampaigns lists the tenant's campaigns (GET) or queues a new one
+// to a segment of customers (POST). Delivery happens in the background;
+// the response tells how many customers the segment matched.
+func (s *Apiserver) handleCampaigns(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		campaigns, err := s.store.GetCampaigns(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, campaigns)
+	}
+
+	admin, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := CreateCampaignRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Subject, req.Message = strings.TrimSpace(req.Subject), strings.TrimSpace(req.Message)
+	if req.Subject == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "subject")
+	}
+	if req.Message == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "message")
+	}
+	if len([]rune(req.Message)) > maxCampaignMessageLength {
+		return newAPIError(http.StatusBadRequest, "campaign_message_too_long", maxCampaignMessageLength)
+	}
+	if len(req.Channels) == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "channels")
+	}
+	for _, channel := range req.Channels {
+		if channel != channelInApp && channel != channelEmail {
+			return newAPIError(http.StatusBadRequest, "invalid_channel", channel)
+		}
+	}
+
+	c := &campaign{TenantID: tenantID, Subject: req.Subject, Message: req.Message, Channels: req.Channels, Segment: req.Segment, CreatedBy: admin.ID}
+	if req.SegmentID != 0 {
+		seg, err := s.store.GetSegment(tenantID, req.SegmentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "segment_not_found", req.SegmentID)
+		} else if err != nil {
+			return err
+		}
+		c.SegmentID, c.Segment = &seg.ID, seg.Filter
+	}
+	if err := s.store.CreateCampaign(c); err != nil {
+		return err
+	}
+	s.audit(r, "campaign.created", "campaign", c.ID, c)
+	return writeJSON(w, http.StatusAccepted, c)
+}
+
+// handleGetCampaign shows a campaign with its delivery counts.
+func (s *Apiserver) handleGetCampaign(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	c, err := s.store.GetCampaign(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "campaign_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleCampaignRecipients pages through the delivery status of a campaign
+// per recipient, optionally only those with ?status=.
+func (s *Apiserver) handleCampaignRecipients(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.GetCampaign(requestTenant(r).ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "campaign_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	recipients, total, err := s.store.GetCampaignRecipients(id, r.URL.Query().Get("status"), page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(recipients, total, page, func(r *campaignRecipient) cursor { return cursor{ID: r.ID} }))
+}
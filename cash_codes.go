@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const createCashCodesTable = `
+        CREATE TABLE IF NOT EXISTS cash_codes (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            reference TEXT UNIQUE NOT NULL,
+            code_hash TEXT NOT NULL,
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending',
+            expires_at TIMESTAMPTZ NOT NULL,
+            resolved_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// cash_code_attempts counts the wrong codes entered at ATMs for an account
+// since its last redemption or lockout.
+const createCashCodeAttemptsTable = `
+        CREATE TABLE IF NOT EXISTS cash_code_attempts (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            attempts INT NOT NULL DEFAULT 0,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Ledger entry kinds of a cardless cash withdrawal. The amount is held in
+// the cash codes GL account when the code is generated; an ATM paying it
+// out moves it on to cash, and a code that is not used releases it back to
+// the account.
+const (
+	entryCashHold    = "cash_hold"
+	entryCashRelease = "cash_release"
+)
+
+const (
+	// cashCodeTTL is how long a cash code can be redeemed.
+	cashCodeTTL = 30 * time.Minute
+	// maxCashCodeAttempts cancels an account's pending codes after this many
+	// wrong codes were entered for it.
+	maxCashCodeAttempts = 3
+)
+
+// Cash code statuses.
+const (
+	cashCodePending   = "pending"
+	cashCodeRedeemed  = "redeemed"
+	cashCodeExpired   = "expired"
+	cashCodeCancelled = "cancelled"
+)
+
+var (
+	errCashCodeNotFound = errors.New("cash code not found")
+	errCashCodeWrong    = errors.New("wrong cash code")
+)
+
+// cashCode is a one-time code for withdrawing cash at an ATM without a
+// card. The code itself is only shown when it is generated and is stored
+// hashed.
+type cashCode struct {
+	ID         int        `json:"id"`
+	TenantID   int        `json:"tenant_id"`
+	AccountID  int        `json:"account_id"`
+	Reference  string     `json:"reference"`
+	Code       string     `json:"code,omitempty"`
+	CodeHash   string     `json:"-"`
+	Amount     int        `json:"amount"`
+	Currency   string     `json:"currency"`
+	Status     string     `json:"status"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreateCashCodeRequest struct {
+	Amount int `json:"amount"`
+}
+
+type ATMWithdrawalRequest struct {
+	AccountNumber string `json:"account_number"`
+	Code          string `json:"code"`
+}
+
+// CashCodeStorage holds the cardless cash withdrawal storage operations.
+type CashCodeStorage interface {
+	CreateCashCode(*cashCode) error
+	GetCashCodes(accountID int) ([]*cashCode, error)
+	CancelCashCode(accountID, id int) (*cashCode, error)
+	RedeemCashCode(tenantID int, number, code string) (*cashCode, error)
+	ExpireCashCodes(tenantID int) ([]*cashCode, error)
+}
+
+const cashCodeColumns = "id, tenant_id, account_id, reference, code_hash, amount, currency, status, expires_at, resolved_at, created_at"
+
+func scanCashCode(row interface{ Scan(...any) error }) (*cashCode, error) {
+	c := &cashCode{}
+	err := row.Scan(&c.ID, &c.TenantID, &c.AccountID, &c.Reference, &c.CodeHash, &c.Amount, &c.Currency, &c.Status, &c.ExpiresAt, &c.ResolvedAt, &c.CreatedAt)
+	return c, err
+}
+
+func queryCashCodes(q queryer, where string, args ...any) ([]*cashCode, error) {
+	rows, err := q.Query("SELECT "+cashCodeColumns+" FROM cash_codes "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := make([]*cashCode, 0)
+	for rows.Next() {
+		c, err := scanCashCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+// CreateCashCode stores a new cash code and holds its amount.
+func (s *PostgresStorage) CreateCashCode(c *cashCode) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO cash_codes (tenant_id, account_id, reference, code_hash, amount, currency, status, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at",
+		c.TenantID, c.AccountID, c.Reference, c.CodeHash, c.Amount, c.Currency, c.Status, c.ExpiresAt,
+	).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	err = postEntries(tx, &ledgerEntry{AccountID: c.AccountID, Amount: -c.Amount, Kind: entryCashHold, Description: "ATM cash code", Reference: c.Reference})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetCashCodes returns an account's cash codes, newest first.
+func (s *PostgresStorage) GetCashCodes(accountID int) ([]*cashCode, error) {
+	return queryCashCodes(s.db, "WHERE account_id = $1 ORDER BY id DESC", accountID)
+}
+
+// CancelCashCode withdraws an account's pending code and releases its hold.
+func (s *PostgresStorage) CancelCashCode(accountID, id int) (*cashCode, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	c, err := scanCashCode(tx.QueryRow(
+		"SELECT "+cashCodeColumns+" FROM cash_codes WHERE id = $1 AND account_id = $2 AND status = $3 FOR UPDATE",
+		id, accountID, cashCodePending,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errCashCodeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := releaseCashCode(tx, c, cashCodeCancelled); err != nil {
+		return nil, err
+	}
+	return c, tx.Commit()
+}
+
+// RedeemCashCode pays out the pending, unexpired code of the account with
+// the given number that matches code. Wrong codes are counted once per
+// account, however many codes are pending; the maxCashCodeAttempts-th
+// cancels all of them.
+func (s *PostgresStorage) RedeemCashCode(tenantID int, number, code string) (*cashCode, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := clock.Now()
+	pending, err := queryCashCodes(tx,
+		"WHERE tenant_id = $1 AND account_id = (SELECT id FROM accounts WHERE tenant_id = $1 AND number = $2) AND status = $3 AND expires_at > $4 ORDER BY id FOR UPDATE",
+		tenantID, number, cashCodePending, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, errCashCodeNotFound
+	}
+
+	for _, c := range pending {
+		if bcrypt.CompareHashAndPassword([]byte(c.CodeHash), []byte(code)) != nil {
+			continue
+		}
+		c.Status, c.ResolvedAt = cashCodeRedeemed, &now
+		if _, err := tx.Exec("UPDATE cash_codes SET status = $1, resolved_at = $2 WHERE id = $3", c.Status, now, c.ID); err != nil {
+			return nil, err
+		}
+		if err := postGLMove(tx, tenantID, entryCashHold, entryWithdrawal, c.Amount, now); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM cash_code_attempts WHERE account_id = $1", c.AccountID); err != nil {
+			return nil, err
+		}
+		return c, tx.Commit()
+	}
+
+	accountID := pending[0].AccountID
+	var attempts int
+	if err := tx.QueryRow(
+		"INSERT INTO cash_code_attempts (account_id, attempts, updated_at) VALUES ($1, 1, $2) ON CONFLICT (account_id) DO UPDATE SET attempts = cash_code_attempts.attempts + 1, updated_at = $2 RETURNING attempts",
+		accountID, now,
+	).Scan(&attempts); err != nil {
+		return nil, err
+	}
+	if attempts >= maxCashCodeAttempts {
+		for _, c := range pending {
+			if err := releaseCashCode(tx, c, cashCodeCancelled); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM cash_code_attempts WHERE account_id = $1", accountID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return nil, errCashCodeWrong
+}
+
+// ExpireCashCodes releases the holds of a tenant's expired pending codes.
+func (s *PostgresStorage) ExpireCashCodes(tenantID int) ([]*cashCode, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	expired, err := queryCashCodes(tx,
+		"WHERE tenant_id = $1 AND status = $2 AND expires_at <= $3 ORDER BY id FOR UPDATE SKIP LOCKED",
+		tenantID, cashCodePending, clock.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range expired {
+		if err := releaseCashCode(tx, c, cashCodeExpired); err != nil {
+			return nil, err
+		}
+	}
+	return expired, tx.Commit()
+}
+
+// releaseCashCode resolves a pending code without paying it out and
+// returns the held amount to its account.
+func releaseCashCode(tx *sql.Tx, c *cashCode, status string) error {
+	now := clock.Now()
+	c.Status, c.ResolvedAt = status, &now
+	if _, err := tx.Exec("UPDATE cash_codes SET status = $1, resolved_at = $2 WHERE id = $3", c.Status, now, c.ID); err != nil {
+		return err
+	}
+	return postEntries(tx, &ledgerEntry{AccountID: c.AccountID, Amount: c.Amount, Kind: entryCashRelease, Description: "ATM cash code " + status, Reference: c.Reference})
+}
+
+// handleCashCodes lists an account's cash codes (GET) or generates one
+// (POST), holding the amount until an ATM pays it out or the code expires.
+// The code is only returned on creation.
+func (s *Apiserver) handleCashCodes(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		codes, err := s.store.GetCashCodes(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, codes)
+	}
+
+	req := CreateCashCodeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Amount <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if err := s.checkScreening(acc.ID); err != nil {
+		return err
+	}
+	if err := s.checkDormancy(acc.ID); err != nil {
+		return err
+	}
+	// Cash cannot wait for a co-signer, so codes stay below the threshold.
+	if err := s.checkCosignerThreshold(acc.ID, req.Amount); err != nil {
+		return err
+	}
+	code, err := newOTP()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	reference, err := newReference("ATM-", now)
+	if err != nil {
+		return err
+	}
+	c := &cashCode{
+		TenantID:  acc.TenantID,
+		AccountID: acc.ID,
+		Reference: reference,
+		CodeHash:  string(hash),
+		Amount:    req.Amount,
+		Currency:  acc.Currency,
+		Status:    cashCodePending,
+		ExpiresAt: now.Add(cashCodeTTL),
+	}
+	if err := s.store.CreateCashCode(c); err != nil {
+		return transferFailed(err)
+	}
+	s.checkBalanceAlerts(acc.ID)
+	s.audit(r, "cash_code.created", "cash_code", c.ID, nil)
+	c.Code = code
+	return writeJSON(w, http.StatusCreated, c)
+}
+
+// handleCancelCashCode withdraws a pending cash code, releasing its hold.
+func (s *Apiserver) handleCancelCashCode(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("code"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("code"))
+	}
+	c, err := s.store.CancelCashCode(acc.ID, id)
+	if errors.Is(err, errCashCodeNotFound) {
+		return newAPIError(http.StatusNotFound, "cash_code_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "cash_code.cancelled", "cash_code", c.ID, nil)
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleATMWithdrawal is called by an ATM, or a simulator standing in for
+// one, authenticated with its operator's ATM API key, when a customer enters
+// their account number and cash code. It pays out the code's full amount.
+func (s *Apiserver) handleATMWithdrawal(w http.ResponseWriter, r *http.Request) error {
+	req := ATMWithdrawalRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	c, err := s.store.RedeemCashCode(requestTenant(r).ID, req.AccountNumber, req.Code)
+	if errors.Is(err, errCashCodeNotFound) || errors.Is(err, errCashCodeWrong) {
+		return newAPIError(http.StatusUnprocessableEntity, "cash_code_invalid")
+	} else if err != nil {
+		return err
+	}
+	s.notify(c.AccountID, "cash_withdrawn", fmt.Sprintf("%s was withdrawn at an ATM with your cash code (ref %s)", formatMoney(c.Amount, c.Currency, defaultLocale), c.Reference))
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// expireCashCodes releases the holds of expired cash codes.
+func (s *Apiserver) expireCashCodes(tenantID int) ([]*cashCode, error) {
+	expired, err := s.store.ExpireCashCodes(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range expired {
+		s.checkBalanceAlerts(c.AccountID)
+	}
+	return expired, nil
+}
+
+// startCashCodeExpiryJob releases expired cash codes in the background on a
+// fixed interval. A zero interval disables the job.
+func (s *Apiserver) startCashCodeExpiryJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.pausedForReadOnly("cash code expiry") {
+				continue
+			}
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("cash code expiry: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.expireCashCodes(t.ID); err != nil {
+					logf("cash code expiry: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
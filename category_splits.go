@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const createTransactionSplitsTable = `
+        CREATE TABLE IF NOT EXISTS transaction_splits (
+            ledger_entry_id INT NOT NULL REFERENCES ledger_entries(id) ON DELETE CASCADE,
+            category TEXT NOT NULL,
+            amount INT NOT NULL CHECK (amount > 0),
+            PRIMARY KEY (ledger_entry_id, category)
+        )
+    `
+
+// maxCategorySplits caps the categories one transaction is split across.
+const maxCategorySplits = 10
+
+// categorySplit is the part of a ledger entry allocated to a category.
+// Amounts are the size of the part, whichever the direction of the entry,
+// and the splits of an entry add up to its size.
+type categorySplit struct {
+	Category string `json:"category"`
+	Amount   int    `json:"amount"`
+}
+
+type CategorySplitsRequest struct {
+	Splits []categorySplit `json:"splits"`
+}
+
+// categoryTotal is what an account spent on a category: Amount from its
+// ledger and Imported at other banks, per the statements it imported.
+type categoryTotal struct {
+	Category string `json:"category"`
+	Amount   int    `json:"amount"`
+	Imported int    `json:"imported,omitempty"`
+}
+
+// CategorySplitStorage holds the storage operations on category splits.
+type CategorySplitStorage interface {
+	SetCategorySplits(entryID int, splits []categorySplit) error
+	GetCategorySplits(entryIDs []int) (map[int][]categorySplit, error)
+}
+
+// SetCategorySplits replaces the splits of an entry. No splits leaves it
+// whole again.
+func (s *PostgresStorage) SetCategorySplits(entryID int, splits []categorySplit) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM transaction_splits WHERE ledger_entry_id = $1", entryID); err != nil {
+		return err
+	}
+	for _, sp := range splits {
+		_, err := tx.Exec("INSERT INTO transaction_splits (ledger_entry_id, category, amount) VALUES ($1, $2, $3)", entryID, sp.Category, sp.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCategorySplits returns the splits of the entries, largest first,
+// keyed by entry. Entries that are not split are left out.
+func (s *PostgresStorage) GetCategorySplits(entryIDs []int) (map[int][]categorySplit, error) {
+	rows, err := s.db.Query(
+		"SELECT ledger_entry_id, category, amount FROM transaction_splits WHERE ledger_entry_id = ANY($1) ORDER BY amount DESC, category",
+		pq.Array(entryIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	splits := make(map[int][]categorySplit)
+	for rows.Next() {
+		var id int
+		sp := categorySplit{}
+		if err := rows.Scan(&id, &sp.Category, &sp.Amount); err != nil {
+			return nil, err
+		}
+		splits[id] = append(splits[id], sp)
+	}
+	return splits, rows.Err()
+}
+
+// loadCategorySplits attaches their splits to the entries.
+func (s *PostgresStorage) loadCategorySplits(entries []*ledgerEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ids := make([]int, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+	splits, err := s.GetCategorySplits(ids)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.Splits = splits[e.ID]
+	}
+	return nil
+}
+
+// validateCategorySplits normalizes the categories of the splits of e and checks
+// they are distinct and add up to its size.
+func validateCategorySplits(e *ledgerEntry, splits []categorySplit) error {
+	if len(splits) == 0 {
+		return nil
+	}
+	if len(splits) == 1 || len(splits) > maxCategorySplits {
+		return newAPIError(http.StatusBadRequest, "invalid_split_count", maxCategorySplits)
+	}
+	total := 0
+	seen := make(map[string]bool, len(splits))
+	for i := range splits {
+		sp := &splits[i]
+		sp.Category = strings.ToLower(strings.TrimSpace(sp.Category))
+		if sp.Category == "" {
+			return newAPIError(http.StatusBadRequest, "required_field", "category")
+		}
+		if seen[sp.Category] {
+			return newAPIError(http.StatusBadRequest, "duplicate_split_category", sp.Category)
+		}
+		seen[sp.Category] = true
+		if sp.Amount <= 0 {
+			return newAPIError(http.StatusBadRequest, "invalid_amount")
+		}
+		total += sp.Amount
+	}
+	if size := abs(e.Amount); total != size {
+		return newAPIError(http.StatusBadRequest, "split_total_mismatch", total, size)
+	}
+	return nil
+}
+
+// handleCategorySplits splits a transaction across categories for the
+// spending breakdown, replacing any earlier splits. An empty list undoes
+// the split.
+func (s *Apiserver) handleCategorySplits(w http.ResponseWriter, r *http.Request) error {
+	e, acc, err := s.authorizedEntry(r)
+	if err != nil {
+		return err
+	}
+	req := CategorySplitsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if err := validateCategorySplits(e, req.Splits); err != nil {
+		return err
+	}
+	if err := s.store.SetCategorySplits(e.ID, req.Splits); err != nil {
+		return err
+	}
+	e.Splits = req.Splits
+	if err := s.enrich(acc.TenantID, []*ledgerEntry{e}); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, e)
+}
+
+// handleSpending breaks down what an account spent between ?from= and ?to=
+// by category, largest first. Split transactions count towards each of
+// their categories, the others towards their enriched category. Imported
+// transactions are categorized through the merchant directory and counted
+// apart.
+func (s *Apiserver) handleSpending(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	filter, err := parseTransactionFilter(r)
+	if err != nil {
+		return err
+	}
+	filter.personal = responseViewer(w).accountID == acc.ID
+	entries, _, err := s.store.SearchLedgerEntries(acc.ID, filter, pageRequest{Limit: maxExportRows})
+	if err != nil {
+		return err
+	}
+	if len(entries) > maxExportRows {
+		entries = entries[:maxExportRows]
+	}
+	if err := s.enrich(acc.TenantID, entries); err != nil {
+		return err
+	}
+	imported, err := s.store.GetImportedTransactionsBetween(acc.ID, filter.From, filter.To)
+	if err != nil {
+		return err
+	}
+	directory, err := s.store.GetMerchantDirectory(acc.TenantID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, spendingByCategory(entries, imported, directory))
+}
+
+func spendingByCategory(entries []*ledgerEntry, imported []*importedTransaction, directory []*directoryEntry) []*categoryTotal {
+	totals := make(map[string]*categoryTotal)
+	total := func(category string) *categoryTotal {
+		if totals[category] == nil {
+			totals[category] = &categoryTotal{Category: category}
+		}
+		return totals[category]
+	}
+	for _, e := range entries {
+		if e.Amount >= 0 {
+			continue
+		}
+		if len(e.Splits) > 0 {
+			for _, sp := range e.Splits {
+				total(sp.Category).Amount += sp.Amount
+			}
+			continue
+		}
+		category := defaultCategory
+		if e.Enrichment != nil {
+			category = e.Enrichment.Category
+		}
+		total(category).Amount -= e.Amount
+	}
+	for _, t := range imported {
+		if t.Amount < 0 {
+			en := enrichEntry(&ledgerEntry{Description: t.Description}, "", directory)
+			total(en.Category).Imported -= t.Amount
+		}
+	}
+	spending := make([]*categoryTotal, 0, len(totals))
+	for _, t := range totals {
+		spending = append(spending, t)
+	}
+	slices.SortFunc(spending, func(a, b *categoryTotal) int {
+		return cmp.Or(cmp.Compare(b.Amount+b.Imported, a.Amount+a.Imported), cmp.Compare(a.Category, b.Category))
+	})
+	return spending
+}
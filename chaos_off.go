@@ -0,0 +1,9 @@
+//go:build !chaos
+
+package main
+
+// wrapStorage returns the store unchanged. Build with -tags chaos to wrap it
+// with fault injection instead.
+func wrapStorage(store Storage) Storage {
+	return store
+}
@@ -0,0 +1,142 @@
+//go:build chaos
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chaosStorage is a Storage decorator for dev and test builds (go build
+// -tags chaos) that injects latency, errors and partial failures into the
+// hot storage paths, so handler error handling and retries can be exercised
+// against a real database.
+//
+//	CHAOS_LATENCY       maximum random delay added to each call, e.g. 200ms
+//	CHAOS_ERROR_RATE    probability (0-1) that a call fails before running
+//	CHAOS_PARTIAL_RATE  probability (0-1) that a write runs but reports failure
+//	CHAOS_SEED          seed for reproducible runs
+type chaosStorage struct {
+	Storage
+	latency     time.Duration
+	errorRate   float64
+	partialRate float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+var errChaos = errors.New("chaos: injected storage failure")
+
+// wrapStorage wraps the store with fault injection configured from the environment.
+func wrapStorage(store Storage) Storage {
+	seed := time.Now().UnixNano()
+	if v, err := strconv.ParseInt(os.Getenv("CHAOS_SEED"), 10, 64); err == nil {
+		seed = v
+	}
+	c := &chaosStorage{
+		Storage:     store,
+		latency:     getEnvDuration("CHAOS_LATENCY", 0),
+		errorRate:   getEnvFloat("CHAOS_ERROR_RATE", 0),
+		partialRate: getEnvFloat("CHAOS_PARTIAL_RATE", 0),
+		rng:         rand.New(rand.NewSource(seed)),
+	}
+	logf("chaos storage enabled: latency<=%s error_rate=%.2f partial_rate=%.2f seed=%d\n", c.latency, c.errorRate, c.partialRate, seed)
+	return c
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func (c *chaosStorage) roll() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64()
+}
+
+// before sleeps for a random latency and may fail the call outright.
+func (c *chaosStorage) before(op string) error {
+	if c.latency > 0 {
+		time.Sleep(time.Duration(c.roll() * float64(c.latency)))
+	}
+	if c.roll() < c.errorRate {
+		return fmt.Errorf("%w in %s", errChaos, op)
+	}
+	return nil
+}
+
+// after may turn a successful write into a reported failure, simulating a
+// commit whose acknowledgement was lost.
+func (c *chaosStorage) after(op string, err error) error {
+	if err == nil && c.roll() < c.partialRate {
+		return fmt.Errorf("%w after %s committed", errChaos, op)
+	}
+	return err
+}
+
+func (c *chaosStorage) CheckAuth(tenantID int, email, password string) error {
+	if err := c.before("CheckAuth"); err != nil {
+		return err
+	}
+	return c.Storage.CheckAuth(tenantID, email, password)
+}
+
+func (c *chaosStorage) CreateAccount(a *account) error {
+	if err := c.before("CreateAccount"); err != nil {
+		return err
+	}
+	return c.after("CreateAccount", c.Storage.CreateAccount(a))
+}
+
+func (c *chaosStorage) GetAccountByID(id int) (*account, error) {
+	if err := c.before("GetAccountByID"); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetAccountByID(id)
+}
+
+func (c *chaosStorage) GetAccountByEmail(tenantID int, email string) (*account, error) {
+	if err := c.before("GetAccountByEmail"); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetAccountByEmail(tenantID, email)
+}
+
+func (c *chaosStorage) GetUsers(tenantID int, page pageRequest) ([]*account, int, error) {
+	if err := c.before("GetUsers"); err != nil {
+		return nil, 0, err
+	}
+	return c.Storage.GetUsers(tenantID, page)
+}
+
+func (c *chaosStorage) PostLedgerEntries(entries ...*ledgerEntry) error {
+	if err := c.before("PostLedgerEntries"); err != nil {
+		return err
+	}
+	return c.after("PostLedgerEntries", c.Storage.PostLedgerEntries(entries...))
+}
+
+func (c *chaosStorage) ApproveAdjustment(id, adminID int) (*adjustment, error) {
+	if err := c.before("ApproveAdjustment"); err != nil {
+		return nil, err
+	}
+	a, err := c.Storage.ApproveAdjustment(id, adminID)
+	return a, c.after("ApproveAdjustment", err)
+}
+
+func (c *chaosStorage) CreateWebhookEvent(ev *webhookEvent) error {
+	if err := c.before("CreateWebhookEvent"); err != nil {
+		return err
+	}
+	return c.after("CreateWebhookEvent", c.Storage.CreateWebhookEvent(ev))
+}
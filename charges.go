@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const createChargesTable = `
+        CREATE TABLE IF NOT EXISTS charges (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+            customer_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            mandate_id INT REFERENCES mandates(id),
+            amount INT NOT NULL CHECK (amount > 0),
+            fee INT NOT NULL DEFAULT 0,
+            currency TEXT NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'pending',
+            transfer_id INT REFERENCES transfers(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            completed_at TIMESTAMPTZ
+        )
+    `
+
+// Charge statuses. A charge is pending until the customer approves or
+// declines it; charges under a mandate are captured at once and either
+// succeed or fail.
+const (
+	chargePending   = "pending"
+	chargeSucceeded = "succeeded"
+	chargeDeclined  = "declined"
+	chargeFailed    = "failed"
+)
+
+// entryFee is the merchant fee taken from a settlement account. The fee
+// leaves the customer accounts of the bank, so it is an external entry.
+const entryFee = "fee"
+
+var errChargeNotPending = errors.New("charge is not pending")
+
+// charge is a payment a merchant requests from a customer. The amount is paid
+// into the merchant's settlement account, which is then debited the fee.
+type charge struct {
+	ID                int        `json:"id"`
+	TenantID          int        `json:"tenant_id"`
+	MerchantID        int        `json:"merchant_id"`
+	CustomerAccountID int        `json:"customer_account_id"`
+	MandateID         *int       `json:"mandate_id,omitempty"`
+	Amount            int        `json:"amount"`
+	Fee               int        `json:"fee"`
+	Refunded          int        `json:"refunded"`
+	Currency          string     `json:"currency"`
+	Description       string     `json:"description"`
+	Status            string     `json:"status"`
+	TransferID        *int       `json:"transfer_id,omitempty"`
+	Reference         string     `json:"reference,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty"`
+}
+
+// CreateChargeRequest may name the country the payment is made in, which
+// the geographic fraud rules check against the customer's restrictions and
+// travel notices.
+type CreateChargeRequest struct {
+	Customer    SplitParticipant `json:"customer"`
+	MandateID   int              `json:"mandate_id"`
+	Amount      int              `json:"amount"`
+	Description string           `json:"description"`
+	Country     string           `json:"country,omitempty"`
+}
+
+// settlementReport totals what a merchant's charges settled on one day
+// (UTC), less the refunds made that day. The net is paid out on the next
+// business day of the tenant's calendar.
+type settlementReport struct {
+	MerchantID     int    `json:"merchant_id"`
+	Date           string `json:"date"`
+	PayoutDate     string `json:"payout_date"`
+	Currency       string `json:"currency"`
+	Charges        int    `json:"charges"`
+	Gross          int    `json:"gross"`
+	Fees           int    `json:"fees"`
+	Refunds        int    `json:"refunds"`
+	Net            int    `json:"net"`
+	GrossDisplay   string `json:"gross_formatted,omitempty"`
+	FeesDisplay    string `json:"fees_formatted,omitempty"`
+	RefundsDisplay string `json:"refunds_formatted,omitempty"`
+	NetDisplay     string `json:"net_formatted,omitempty"`
+}
+
+func (s *settlementReport) formatMoney(locale string) {
+	s.GrossDisplay = formatMoney(s.Gross, s.Currency, locale)
+	s.FeesDisplay = formatMoney(s.Fees, s.Currency, locale)
+	s.RefundsDisplay = formatMoney(s.Refunds, s.Currency, locale)
+	s.NetDisplay = formatMoney(s.Net, s.Currency, locale)
+}
+
+// ChargeStorage holds the charge storage operations.
+type ChargeStorage interface {
+	CreateCharge(*charge) error
+	GetCharge(id int) (*charge, error)
+	GetChargesByMerchant(merchantID int, page pageRequest) ([]*charge, int, error)
+	GetChargesByCustomer(accountID int, page pageRequest) ([]*charge, int, error)
+	CaptureCharge(c *charge, t *transfer) error
+	CloseCharge(c *charge, status string) error
+	GetSettlementReport(r *settlementReport, day time.Time) error
+}
+
+const selectCharges = `
+        SELECT c.id, c.tenant_id, c.merchant_id, c.customer_account_id, c.mandate_id, c.amount, c.fee, c.refunded, c.currency,
+            c.description, c.status, c.transfer_id, COALESCE(t.reference, ''), c.created_at, c.completed_at
+        FROM charges c LEFT JOIN transfers t ON t.id = c.transfer_id `
+
+func scanCharge(row interface{ Scan(...any) error }) (*charge, error) {
+	c := &charge{}
+	var mandateID, transferID sql.NullInt64
+	err := row.Scan(&c.ID, &c.TenantID, &c.MerchantID, &c.CustomerAccountID, &mandateID, &c.Amount, &c.Fee, &c.Refunded, &c.Currency, &c.Description, &c.Status, &transferID, &c.Reference, &c.CreatedAt, &c.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if mandateID.Valid {
+		id := int(mandateID.Int64)
+		c.MandateID = &id
+	}
+	if transferID.Valid {
+		id := int(transferID.Int64)
+		c.TransferID = &id
+	}
+	return c, nil
+}
+
+// CreateCharge stores a pending charge.
+func (s *PostgresStorage) CreateCharge(c *charge) error {
+	return s.db.QueryRow(
+		"INSERT INTO charges (tenant_id, merchant_id, customer_account_id, mandate_id, amount, fee, currency, description, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at",
+		c.TenantID, c.MerchantID, c.CustomerAccountID, c.MandateID, c.Amount, c.Fee, c.Currency, c.Description, c.Status,
+	).Scan(&c.ID, &c.CreatedAt)
+}
+
+// GetCharge retrieves a charge by its ID.
+func (s *PostgresStorage) GetCharge(id int) (*charge, error) {
+	return scanCharge(s.db.QueryRow(selectCharges+"WHERE c.id = $1", id))
+}
+
+// GetChargesByMerchant returns a page of a merchant's charges, newest first,
+// and their total count.
+func (s *PostgresStorage) GetChargesByMerchant(merchantID int, page pageRequest) ([]*charge, int, error) {
+	return s.queryCharges("merchant_id", merchantID, page)
+}
+
+// GetChargesByCustomer returns a page of the charges made to a customer,
+// newest first, and their total count.
+func (s *PostgresStorage) GetChargesByCustomer(accountID int, page pageRequest) ([]*charge, int, error) {
+	return s.queryCharges("customer_account_id", accountID, page)
+}
+
+func (s *PostgresStorage) queryCharges(column string, id int, page pageRequest) ([]*charge, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM charges WHERE "+column+" = $1", id)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "c")
+	rows, err := s.db.Query(selectCharges+"WHERE c."+column+" = $1 AND "+cond+" "+order, append([]any{id}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	charges := make([]*charge, 0)
+	for rows.Next() {
+		c, err := scanCharge(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, total, rows.Err()
+}
+
+// CaptureCharge pays a pending charge with t, under its mandate if it has
+// one, takes the fee from the settlement account and marks the charge
+// succeeded, all or nothing.
+func (s *PostgresStorage) CaptureCharge(c *charge, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM charges WHERE id = $1 FOR UPDATE", c.ID).Scan(&status); err != nil {
+		return err
+	}
+	if status != chargePending {
+		return errChargeNotPending
+	}
+	if c.MandateID != nil {
+		err = collectMandate(tx, *c.MandateID, t)
+	} else {
+		err = createTransfer(tx, t)
+	}
+	if err != nil {
+		return err
+	}
+	if c.Fee > 0 {
+		err := postEntries(tx, &ledgerEntry{
+			AccountID:   t.ToAccountID,
+			Amount:      -c.Fee,
+			Kind:        entryFee,
+			Description: fmt.Sprintf("Fee for charge %d", c.ID),
+			Reference:   t.Reference,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(
+		"UPDATE charges SET status = $2, transfer_id = $3, completed_at = now() WHERE id = $1 RETURNING status, transfer_id, completed_at",
+		c.ID, chargeSucceeded, t.ID,
+	).Scan(&c.Status, &c.TransferID, &c.CompletedAt)
+	if err != nil {
+		return err
+	}
+	c.Reference = t.Reference
+	return tx.Commit()
+}
+
+// CloseCharge ends a pending charge without payment.
+func (s *PostgresStorage) CloseCharge(c *charge, status string) error {
+	err := s.db.QueryRow(
+		"UPDATE charges SET status = $2, completed_at = now() WHERE id = $1 AND status = $3 RETURNING status, completed_at",
+		c.ID, status, chargePending,
+	).Scan(&c.Status, &c.CompletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errChargeNotPending
+	}
+	return err
+}
+
+// GetSettlementReport fills in the totals of the charges of r.MerchantID
+// that succeeded on day and of the refunds made on day.
+func (s *PostgresStorage) GetSettlementReport(r *settlementReport, day time.Time) error {
+	err := s.db.QueryRow(`
+        SELECT COUNT(*), COALESCE(SUM(amount), 0), COALESCE(SUM(fee), 0)
+        FROM charges
+        WHERE merchant_id = $1 AND status = $2 AND completed_at >= $3 AND completed_at < $4`,
+		r.MerchantID, chargeSucceeded, day, day.AddDate(0, 0, 1),
+	).Scan(&r.Charges, &r.Gross, &r.Fees)
+	if err != nil {
+		return err
+	}
+	err = s.db.QueryRow(`
+        SELECT COALESCE(SUM(rf.amount), 0)
+        FROM refunds rf JOIN charges c ON c.id = rf.charge_id
+        WHERE c.merchant_id = $1 AND rf.created_at >= $2 AND rf.created_at < $3`,
+		r.MerchantID, day, day.AddDate(0, 0, 1),
+	).Scan(&r.Refunds)
+	r.Net = r.Gross - r.Fees - r.Refunds
+	return err
+}
+
+// captureCharge pays a charge from the customer's account into the
+// merchant's settlement account and runs the side effects.
+func (s *Apiserver) captureCharge(c *charge, m *merchant) error {
+	customer, err := s.store.GetAccountByID(c.CustomerAccountID)
+	if err != nil {
+		return err
+	}
+	memo := c.Description
+	if memo == "" {
+		memo = m.Name
+	}
+	t, err := s.newTransfer(customer, m.SettlementAccountID, c.Amount, memo)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CaptureCharge(c, t); errors.Is(err, errChargeNotPending) {
+		return newAPIError(http.StatusConflict, "charge_not_pending", c.ID)
+	} else if err != nil {
+		return err
+	}
+	s.transferCompleted(t)
+	s.notify(m.AccountID, "charge_succeeded", fmt.Sprintf("Charge %d of %s succeeded (ref %s)", c.ID, formatMoney(c.Amount, c.Currency, defaultLocale), t.Reference))
+	return nil
+}
+
+// handleMerchantCharges lists the merchant's charges (GET) or charges a
+// customer (POST). A charge under one of the merchant's mandates is captured
+// at once; any other charge waits for the customer's approval.
+func (s *Apiserver) handleMerchantCharges(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.currentMerchant(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		charges, total, err := s.store.GetChargesByMerchant(m.ID, page)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, paginate(charges, total, page, func(c *charge) cursor { return cursor{c.CreatedAt, c.ID} }))
+	}
+
+	req := CreateChargeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if req.Amount <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if utf8.RuneCountInString(req.Description) > maxMemoLength {
+		return newAPIError(http.StatusBadRequest, "memo_too_long", maxMemoLength)
+	}
+	settlement, err := s.store.GetAccountByID(m.SettlementAccountID)
+	if err != nil {
+		return err
+	}
+
+	c := &charge{
+		TenantID:    m.TenantID,
+		MerchantID:  m.ID,
+		Amount:      req.Amount,
+		Fee:         m.chargeFee(req.Amount),
+		Currency:    settlement.Currency,
+		Description: req.Description,
+		Status:      chargePending,
+	}
+	var md *mandate
+	if req.MandateID != 0 {
+		md, err = s.store.GetMandate(req.MandateID)
+		if err != nil || md.MerchantAccountID != m.AccountID {
+			return newAPIError(http.StatusNotFound, "mandate_not_found", req.MandateID)
+		}
+		c.MandateID = &md.ID
+		c.CustomerAccountID = md.CustomerAccountID
+	} else {
+		customer, err := s.resolveParticipant(m.TenantID, req.Customer)
+		if err != nil {
+			return err
+		}
+		if customer.ID == m.SettlementAccountID {
+			return newAPIError(http.StatusBadRequest, "same_account_transfer")
+		}
+		if customer.Currency != c.Currency {
+			return newAPIError(http.StatusBadRequest, "currency_mismatch", c.Currency, customer.Currency)
+		}
+		c.CustomerAccountID = customer.ID
+	}
+	country := strings.ToUpper(strings.TrimSpace(req.Country))
+	if country != "" && !countryPattern.MatchString(country) {
+		return newAPIError(http.StatusBadRequest, "invalid_country", req.Country)
+	}
+	geo, err := s.checkGeo(c.CustomerAccountID, country)
+	if err != nil {
+		return err
+	}
+	if geo == geoDeny {
+		s.notify(c.CustomerAccountID, "geo_blocked", fmt.Sprintf("A charge of %s by %s in %s was declined by your geographic restrictions",
+			formatMoney(c.Amount, c.Currency, defaultLocale), m.Name, country))
+		return newAPIError(http.StatusForbidden, "geo_declined", country)
+	}
+	if err := s.store.CreateCharge(c); err != nil {
+		return err
+	}
+	if geo == geoReview {
+		s.notifyGeoReview(c.CustomerAccountID, country, fmt.Sprintf("%s charged you %s", m.Name, formatMoney(c.Amount, c.Currency, defaultLocale)))
+	}
+
+	if md == nil {
+		s.notify(c.CustomerAccountID, "charge_requested", fmt.Sprintf("%s requested %s for %q. Approve: POST /charges/%d/approve",
+			m.Name, formatMoney(c.Amount, c.Currency, defaultLocale), c.Description, c.ID))
+		return writeJSON(w, http.StatusCreated, c)
+	}
+	if err := s.captureCharge(c, m); err != nil {
+		if closeErr := s.store.CloseCharge(c, chargeFailed); closeErr != nil {
+			return closeErr
+		}
+		return collectFailed(err, md)
+	}
+	return writeJSON(w, http.StatusCreated, c)
+}
+
+// handleSettlementReport returns the merchant's settlement totals for
+// ?date=YYYY-MM-DD (UTC), today by default.
+func (s *Apiserver) handleSettlementReport(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.currentMerchant(r)
+	if err != nil {
+		return err
+	}
+	settlement, err := s.store.GetAccountByID(m.SettlementAccountID)
+	if err != nil {
+		return err
+	}
+	day := clock.Now().UTC().Truncate(24 * time.Hour)
+	if v := r.URL.Query().Get("date"); v != "" {
+		if day, err = time.Parse(time.DateOnly, v); err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_date", v)
+		}
+	}
+
+	calendar, err := s.calendar(m.TenantID)
+	if err != nil {
+		return err
+	}
+
+	report := &settlementReport{
+		MerchantID: m.ID,
+		Date:       day.Format(time.DateOnly),
+		PayoutDate: calendar.AddBusinessDays(day, 1).Format(time.DateOnly),
+		Currency:   settlement.Currency,
+	}
+	if err := s.store.GetSettlementReport(report, day); err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, report)
+}
+
+// customerCharge loads a charge made to the caller, with its merchant.
+func (s *Apiserver) customerCharge(r *http.Request) (*charge, *merchant, error) {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := s.store.GetCharge(id)
+	if err != nil || c.CustomerAccountID != caller.ID {
+		return nil, nil, newAPIError(http.StatusNotFound, "charge_not_found", id)
+	}
+	m, err := s.store.GetMerchant(c.MerchantID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, m, nil
+}
+
+// handleCharges lists the charges made to the caller, newest first.
+func (s *Apiserver) handleCharges(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	charges, total, err := s.store.GetChargesByCustomer(caller.ID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(charges, total, page, func(c *charge) cursor { return cursor{c.CreatedAt, c.ID} }))
+}
+
+// handleApproveCharge pays a pending charge from the caller's account.
+func (s *Apiserver) handleApproveCharge(w http.ResponseWriter, r *http.Request) error {
+	c, m, err := s.customerCharge(r)
+	if err != nil {
+		return err
+	}
+	if err := s.captureCharge(c, m); err != nil {
+		return transferFailed(err)
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleDeclineCharge refuses a pending charge.
+func (s *Apiserver) handleDeclineCharge(w http.ResponseWriter, r *http.Request) error {
+	c, m, err := s.customerCharge(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CloseCharge(c, chargeDeclined); errors.Is(err, errChargeNotPending) {
+		return newAPIError(http.StatusConflict, "charge_not_pending", c.ID)
+	} else if err != nil {
+		return err
+	}
+	s.notify(m.AccountID, "charge_declined", fmt.Sprintf("Charge %d was declined by the customer", c.ID))
+	return writeJSON(w, http.StatusOK, c)
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const createTransferClaimsTable = `
+        CREATE TABLE IF NOT EXISTS transfer_claims (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            reference TEXT UNIQUE NOT NULL,
+            from_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            contact TEXT NOT NULL,
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            memo TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'pending',
+            claimed_by INT REFERENCES accounts(id) ON DELETE SET NULL,
+            expires_at TIMESTAMPTZ NOT NULL,
+            resolved_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createClaimChallengesTable = `
+        CREATE TABLE IF NOT EXISTS claim_challenges (
+            id SERIAL PRIMARY KEY,
+            claim_id INT NOT NULL REFERENCES transfer_claims(id) ON DELETE CASCADE,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            code_hash TEXT NOT NULL,
+            attempts INT NOT NULL DEFAULT 0,
+            expires_at TIMESTAMPTZ NOT NULL,
+            verified_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// maxClaimChallenges caps the codes sent for one claim, so its contact
+// cannot be flooded and codes cannot be guessed by asking for more.
+const maxClaimChallenges = 5
+
+// Ledger entry kinds of a transfer to a contact without an account. The
+// sender is debited into the pending claims GL account when the transfer is
+// made, and the money leaves it again to the recipient or back to the
+// sender.
+const (
+	entryClaimHold   = "claim_hold"
+	entryClaimPayout = "claim_payout"
+	entryClaimReturn = "claim_return"
+)
+
+// defaultClaimExpiry is how long a claim waits for its recipient unless
+// CLAIM_EXPIRY says otherwise.
+const defaultClaimExpiry = 14 * 24 * time.Hour
+
+// Claim statuses.
+const (
+	claimPending = "pending"
+	claimClaimed = "claimed"
+	claimExpired = "expired"
+)
+
+var (
+	errClaimNotFound = errors.New("claim not found")
+	errClaimCurrency = errors.New("claim is in another currency")
+)
+
+// phonePattern is a phone number once spaces, dashes, dots and brackets are
+// removed: an optional + and 7 to 15 digits.
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+
+// normalizeContact returns the canonical form of an email address or phone
+// number a transfer can be addressed to.
+func normalizeContact(contact string) (string, bool) {
+	contact = strings.TrimSpace(contact)
+	if strings.Contains(contact, "@") {
+		local, domain, _ := strings.Cut(contact, "@")
+		if local == "" || !strings.Contains(domain, ".") {
+			return "", false
+		}
+		return strings.ToLower(contact), true
+	}
+	phone := strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(contact)
+	if !phonePattern.MatchString(phone) {
+		return "", false
+	}
+	return phone, true
+}
+
+// transferClaim is money sent to an email or phone number no account has
+// yet. It waits for the recipient to sign up and collect it, and goes back
+// to the sender when it expires.
+type transferClaim struct {
+	ID            int        `json:"id"`
+	TenantID      int        `json:"tenant_id"`
+	Reference     string     `json:"reference"`
+	FromAccountID int        `json:"from_account_id"`
+	Contact       string     `json:"contact"`
+	Amount        int        `json:"amount"`
+	Currency      string     `json:"currency"`
+	Memo          string     `json:"memo"`
+	Status        string     `json:"status"`
+	ClaimedBy     *int       `json:"claimed_by,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// claimChallenge is a code sent to the contact of a claim, which the
+// account collecting the claim must enter to prove the contact is theirs.
+type claimChallenge struct {
+	ID        int       `json:"challenge_id"`
+	ClaimID   int       `json:"-"`
+	AccountID int       `json:"-"`
+	CodeHash  string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type CollectClaimRequest struct {
+	ChallengeID int    `json:"challenge_id"`
+	Code        string `json:"code"`
+}
+
+// ClaimStorage holds the storage operations of transfers by contact.
+type ClaimStorage interface {
+	GetAccountByContact(tenantID int, contact string) (*account, error)
+	CreateClaim(*transferClaim) error
+	GetClaimsForAccount(acc *account) ([]*transferClaim, error)
+	CreateClaimChallenge(*claimChallenge) error
+	VerifyClaimChallenge(id, claimID, accountID int, code string) error
+	CollectClaim(id int, acc *account) (*transferClaim, error)
+	ExpireClaims(tenantID int) ([]*transferClaim, error)
+}
+
+const claimColumns = "id, tenant_id, reference, from_account_id, contact, amount, currency, memo, status, claimed_by, expires_at, resolved_at, created_at"
+
+func scanClaim(row interface{ Scan(...any) error }) (*transferClaim, error) {
+	c := &transferClaim{}
+	err := row.Scan(&c.ID, &c.TenantID, &c.Reference, &c.FromAccountID, &c.Contact, &c.Amount, &c.Currency, &c.Memo, &c.Status, &c.ClaimedBy, &c.ExpiresAt, &c.ResolvedAt, &c.CreatedAt)
+	return c, err
+}
+
+// GetAccountByContact retrieves a tenant's account by its email address or
+// phone number, as normalized by normalizeContact.
+func (s *PostgresStorage) GetAccountByContact(tenantID int, contact string) (*account, error) {
+	a := &account{}
+	err := s.db.QueryRow(
+		"SELECT id, tenant_id, email, COALESCE(phone, ''), name, number, balance, role, currency FROM accounts WHERE tenant_id = $1 AND (LOWER(email) = $2 OR phone = $2) LIMIT 1",
+		tenantID, contact,
+	).Scan(&a.ID, &a.TenantID, &a.Email, &a.Phone, &a.Name, &a.Number, &a.Balance, &a.Role, &a.Currency)
+	return a, err
+}
+
+// CreateClaim records a transfer to a contact and debits the sender.
+func (s *PostgresStorage) CreateClaim(c *transferClaim) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO transfer_claims (tenant_id, reference, from_account_id, contact, amount, currency, memo, status, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at",
+		c.TenantID, c.Reference, c.FromAccountID, c.Contact, c.Amount, c.Currency, c.Memo, claimPending, c.ExpiresAt,
+	).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	err = postEntries(tx, &ledgerEntry{AccountID: c.FromAccountID, Amount: -c.Amount, Kind: entryClaimHold, Description: c.Memo, Reference: c.Reference})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetClaimsForAccount returns the unexpired pending claims addressed to an
+// account's email address or phone number.
+func (s *PostgresStorage) GetClaimsForAccount(acc *account) ([]*transferClaim, error) {
+	rows, err := s.db.Query(
+		"SELECT "+claimColumns+" FROM transfer_claims WHERE tenant_id = $1 AND contact IN (LOWER($2), $3) AND status = $4 AND expires_at > $5 ORDER BY id",
+		acc.TenantID, acc.Email, acc.Phone, claimPending, clock.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := make([]*transferClaim, 0)
+	for rows.Next() {
+		c, err := scanClaim(rows)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, c)
+	}
+	return claims, rows.Err()
+}
+
+// CreateClaimChallenge stores a challenge, unless its claim has had
+// maxClaimChallenges already, which fails with errChallengeLocked.
+func (s *PostgresStorage) CreateClaimChallenge(c *claimChallenge) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the claim keeps concurrent requests from overshooting the cap.
+	if _, err := tx.Exec("SELECT 1 FROM transfer_claims WHERE id = $1 FOR UPDATE", c.ClaimID); err != nil {
+		return err
+	}
+	var sent int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM claim_challenges WHERE claim_id = $1", c.ClaimID).Scan(&sent); err != nil {
+		return err
+	}
+	if sent >= maxClaimChallenges {
+		return errChallengeLocked
+	}
+	err = tx.QueryRow(
+		"INSERT INTO claim_challenges (claim_id, account_id, code_hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		c.ClaimID, c.AccountID, c.CodeHash, c.ExpiresAt,
+	).Scan(&c.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyClaimChallenge checks a code against a challenge of an account for
+// a claim and uses the challenge up when it matches. Wrong codes count
+// towards the lockout.
+func (s *PostgresStorage) VerifyClaimChallenge(id, claimID, accountID int, code string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var codeHash string
+	var attempts int
+	var expiresAt time.Time
+	var verifiedAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT code_hash, attempts, expires_at, verified_at FROM claim_challenges WHERE id = $1 AND claim_id = $2 AND account_id = $3 FOR UPDATE",
+		id, claimID, accountID,
+	).Scan(&codeHash, &attempts, &expiresAt, &verifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errChallengeNotFound
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case verifiedAt.Valid:
+		return errChallengeUsed
+	case !clock.Now().Before(expiresAt):
+		return errChallengeExpired
+	case attempts >= maxChallengeAttempts:
+		return errChallengeLocked
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(code)) != nil {
+		if _, err := tx.Exec("UPDATE claim_challenges SET attempts = attempts + 1 WHERE id = $1", id); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return errChallengeCode
+	}
+	if _, err := tx.Exec("UPDATE claim_challenges SET verified_at = now() WHERE id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CollectClaim pays a pending claim out to the account it is addressed to.
+// Claims that are not pending, have expired or are addressed to someone
+// else fail with errClaimNotFound.
+func (s *PostgresStorage) CollectClaim(id int, acc *account) (*transferClaim, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := clock.Now()
+	c, err := scanClaim(tx.QueryRow(
+		"SELECT "+claimColumns+" FROM transfer_claims WHERE id = $1 AND tenant_id = $2 AND contact IN (LOWER($3), $4) AND status = $5 AND expires_at > $6 FOR UPDATE",
+		id, acc.TenantID, acc.Email, acc.Phone, claimPending, now,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errClaimNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if c.Currency != acc.Currency {
+		return nil, errClaimCurrency
+	}
+
+	c.Status, c.ClaimedBy, c.ResolvedAt = claimClaimed, &acc.ID, &now
+	if _, err := tx.Exec("UPDATE transfer_claims SET status = $1, claimed_by = $2, resolved_at = $3 WHERE id = $4", c.Status, acc.ID, now, c.ID); err != nil {
+		return nil, err
+	}
+	err = postEntries(tx, &ledgerEntry{AccountID: acc.ID, Amount: c.Amount, Kind: entryClaimPayout, Description: c.Memo, Reference: c.Reference})
+	if err != nil {
+		return nil, err
+	}
+	return c, tx.Commit()
+}
+
+// ExpireClaims returns the money of a tenant's expired pending claims to
+// their senders.
+func (s *PostgresStorage) ExpireClaims(tenantID int) ([]*transferClaim, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := clock.Now()
+	rows, err := tx.Query(
+		"SELECT "+claimColumns+" FROM transfer_claims WHERE tenant_id = $1 AND status = $2 AND expires_at <= $3 ORDER BY id FOR UPDATE SKIP LOCKED",
+		tenantID, claimPending, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]*transferClaim, 0)
+	for rows.Next() {
+		c, err := scanClaim(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range expired {
+		c.Status, c.ResolvedAt = claimExpired, &now
+		if _, err := tx.Exec("UPDATE transfer_claims SET status = $1, resolved_at = $2 WHERE id = $3", c.Status, now, c.ID); err != nil {
+			return nil, err
+		}
+		err := postEntries(tx, &ledgerEntry{AccountID: c.FromAccountID, Amount: c.Amount, Kind: entryClaimReturn, Description: "Unclaimed transfer returned", Reference: c.Reference})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expired, tx.Commit()
+}
+
+// newClaim validates a transfer from an account to a contact without an
+// account and assigns it a reference. The claim is not stored.
+func (s *Apiserver) newClaim(from *account, contact string, amount int, memo string) (*transferClaim, error) {
+	memo = strings.TrimSpace(memo)
+	if amount <= 0 {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if utf8.RuneCountInString(memo) > maxMemoLength {
+		return nil, newAPIError(http.StatusBadRequest, "memo_too_long", maxMemoLength)
+	}
+	if err := s.checkScreening(from.ID); err != nil {
+		return nil, err
+	}
+	if err := s.checkDormancy(from.ID); err != nil {
+		return nil, err
+	}
+	reference, err := newTransferReference(clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &transferClaim{
+		TenantID:      from.TenantID,
+		Reference:     reference,
+		FromAccountID: from.ID,
+		Contact:       contact,
+		Amount:        amount,
+		Currency:      from.Currency,
+		Memo:          memo,
+		Status:        claimPending,
+		ExpiresAt:     clock.Now().Add(cmp.Or(s.cfg().ClaimExpiry, defaultClaimExpiry)),
+	}, nil
+}
+
+// handleTransferToContact sends money to an email address or phone number.
+// If an account of the tenant has it, this is an ordinary transfer to that
+// account; otherwise the money is parked in a claim the recipient can
+// collect after signing up, until it expires back to the sender.
+func (s *Apiserver) handleTransferToContact(w http.ResponseWriter, r *http.Request, from *account, req TransferRequest) error {
+	contact, ok := normalizeContact(req.ToContact)
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "invalid_contact", req.ToContact)
+	}
+	to, err := s.store.GetAccountByContact(from.TenantID, contact)
+	if err == nil {
+		t, err := s.newTransfer(from, to.ID, req.Amount, req.Memo)
+		if err != nil {
+			return err
+		}
+		if err := s.checkTrustedPayee(from.ID, to.ID); err != nil {
+			return err
+		}
+		if a, err := s.holdForCosigner(r, t); err != nil {
+			return err
+		} else if a != nil {
+			return writeJSON(w, http.StatusAccepted, a)
+		}
+		if err := s.store.CreateTransfer(t); err != nil {
+			return transferFailed(err)
+		}
+		s.transferCompleted(t)
+		return writeJSON(w, http.StatusCreated, t)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// A contact without an account cannot be a trusted payee.
+	if err := s.checkTrustedPayee(from.ID, 0); err != nil {
+		return err
+	}
+	c, err := s.newClaim(from, contact, req.Amount, req.Memo)
+	if err != nil {
+		return err
+	}
+	// Claims cannot wait for a co-signer, so they stay below the threshold.
+	if err := s.checkCosignerThreshold(from.ID, c.Amount); err != nil {
+		return err
+	}
+	if err := s.store.CreateClaim(c); err != nil {
+		return transferFailed(err)
+	}
+	s.checkBalanceAlerts(from.ID)
+	s.audit(r, "claim.created", "claim", c.ID, c)
+	return writeJSON(w, http.StatusAccepted, c)
+}
+
+// handleGetClaims lists the pending claims addressed to the caller.
+func (s *Apiserver) handleGetClaims(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	claims, err := s.store.GetClaimsForAccount(acc)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, claims)
+}
+
+// pendingClaim returns the pending claim of the request path, which must be
+// addressed to acc.
+func (s *Apiserver) pendingClaim(r *http.Request, acc *account) (*transferClaim, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := s.store.GetClaimsForAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range claims {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, newAPIError(http.StatusNotFound, "claim_not_found", id)
+}
+
+// sendClaimCode sends a code to the contact of a claim: by text to a phone
+// number, and through the OTP sender to an email address.
+func (s *Apiserver) sendClaimCode(acc *account, c *transferClaim, code string) error {
+	if strings.Contains(c.Contact, "@") {
+		// Without a phone, an SMS sender falls back to email.
+		to := *acc
+		to.Phone = ""
+		return s.otp.SendOTP(&to, code)
+	}
+	if s.sms == nil {
+		return newAPIError(http.StatusServiceUnavailable, "claim_sms_unavailable")
+	}
+	return s.sendSMS(acc, "claim_code", translate(accountLanguage(acc), "sms_claim_code", code, int(challengeTTL.Minutes())))
+}
+
+// handleClaimChallenge sends the caller a code to the contact of a pending
+// claim addressed to them, which collecting the claim requires.
+func (s *Apiserver) handleClaimChallenge(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	c, err := s.pendingClaim(r, acc)
+	if err != nil {
+		return err
+	}
+	code, err := newOTP()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	ch := &claimChallenge{ClaimID: c.ID, AccountID: acc.ID, CodeHash: string(hash), ExpiresAt: clock.Now().Add(challengeTTL)}
+	if err := s.store.CreateClaimChallenge(ch); errors.Is(err, errChallengeLocked) {
+		return newAPIError(http.StatusTooManyRequests, "challenge_locked")
+	} else if err != nil {
+		return err
+	}
+	if err := s.sendClaimCode(acc, c, code); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusAccepted, ch)
+}
+
+// handleCollectClaim pays a pending claim addressed to the caller into
+// their account, once they enter the code sent to its contact.
+func (s *Apiserver) handleCollectClaim(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	pending, err := s.pendingClaim(r, acc)
+	if err != nil {
+		return err
+	}
+	req := CollectClaimRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	err = s.store.VerifyClaimChallenge(req.ChallengeID, pending.ID, acc.ID, req.Code)
+	switch {
+	case errors.Is(err, errChallengeNotFound), errors.Is(err, errChallengeUsed), errors.Is(err, errChallengeExpired):
+		return newAPIError(http.StatusUnauthorized, "challenge_invalid")
+	case errors.Is(err, errChallengeLocked):
+		return newAPIError(http.StatusTooManyRequests, "challenge_locked")
+	case errors.Is(err, errChallengeCode):
+		return newAPIError(http.StatusUnauthorized, "challenge_wrong_code")
+	case err != nil:
+		return err
+	}
+
+	c, err := s.store.CollectClaim(pending.ID, acc)
+	switch {
+	case errors.Is(err, errClaimNotFound):
+		return newAPIError(http.StatusNotFound, "claim_not_found", pending.ID)
+	case errors.Is(err, errClaimCurrency):
+		return newAPIError(http.StatusBadRequest, "claim_currency_mismatch", acc.Currency)
+	case err != nil:
+		return transferFailed(err)
+	}
+	s.audit(r, "claim.collected", "claim", c.ID, nil)
+	s.checkBalanceAlerts(acc.ID)
+	s.notify(c.FromAccountID, "claim_collected", fmt.Sprintf("%s collected the %s you sent (ref %s)", c.Contact, formatMoney(c.Amount, c.Currency, defaultLocale), c.Reference))
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// expireClaims returns expired claims to their senders and tells them.
+func (s *Apiserver) expireClaims(tenantID int) ([]*transferClaim, error) {
+	expired, err := s.store.ExpireClaims(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range expired {
+		s.checkBalanceAlerts(c.FromAccountID)
+		s.notify(c.FromAccountID, "claim_expired", fmt.Sprintf("%s sent to %s was not collected and has been returned (ref %s)", formatMoney(c.Amount, c.Currency, defaultLocale), c.Contact, c.Reference))
+	}
+	return expired, nil
+}
+
+// startClaimExpiryJob returns expired claims in the background on a fixed
+// interval. A zero interval disables the job.
+func (s *Apiserver) startClaimExpiryJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.pausedForReadOnly("claim expiry") {
+				continue
+			}
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("claim expiry: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.expireClaims(t.ID); err != nil {
+					logf("claim expiry: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,240 @@
+// Package bankclient is a Go client for the bank API.
+//
+//	c := bankclient.New("https://bank.example.com", bankclient.WithTenant("acme"))
+//	if err := c.Login(ctx, "ada@example.com", "s3cret"); err != nil {
+//		return err
+//	}
+//	page, err := c.ListTransactions(ctx, accountID, bankclient.PageOptions{Limit: 20})
+//
+// Requests are authenticated with the token obtained by Login (or set with
+// WithToken). Idempotent requests are retried with backoff on network
+// errors and 5xx responses; writes are never retried.
+package bankclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client calls the bank API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	tenant     string
+	retries    int
+	backoff    time.Duration
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTenant sends every request to the given tenant via the X-Tenant header.
+func WithTenant(slug string) Option {
+	return func(c *Client) { c.tenant = slug }
+}
+
+// WithToken authenticates with an existing bearer token instead of Login.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries sets how many times idempotent requests are retried and the
+// delay before the first retry, which doubles on every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// New returns a client for the API at baseURL.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    2,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token returns the bearer token in use, if any.
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+// Error is an error response from the API.
+type Error struct {
+	Status    int    `json:"-"`
+	Message   string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("bank api: %d %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("bank api: %d: %s", e.Status, e.Message)
+}
+
+// IsCode reports whether err is an API error with the given code, such as
+// "insufficient_funds" or "account_not_found".
+func IsCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+type envelope struct {
+	Data       json.RawMessage `json:"data"`
+	Pagination *struct {
+		NextCursor string `json:"next_cursor"`
+		Total      int    `json:"total"`
+	} `json:"pagination"`
+	RequestID string `json:"request_id"`
+}
+
+// do sends a request and decodes the data of the response envelope into
+// out, returning the envelope for its pagination.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) (*envelope, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	attempts := 1
+	if method == http.MethodGet || method == http.MethodPut || method == http.MethodDelete {
+		attempts += c.retries
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(c.backoff << (attempt - 1)):
+			}
+		}
+		env, retry, err := c.send(ctx, method, u, payload, out)
+		if err == nil || !retry {
+			return env, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// send makes one attempt and reports whether a failure is worth retrying.
+func (c *Client) send(ctx context.Context, method, u string, payload []byte, out any) (*envelope, bool, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant", c.tenant)
+	}
+	if token := c.Token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode >= 400 {
+		apiErr := &Error{Status: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, resp.StatusCode >= 500, apiErr
+	}
+
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, false, fmt.Errorf("bank api: invalid response: %w", err)
+	}
+	if out != nil && len(env.Data) > 0 {
+		if err := json.Unmarshal(env.Data, out); err != nil {
+			return nil, false, fmt.Errorf("bank api: invalid response data: %w", err)
+		}
+	}
+	return env, false, nil
+}
+
+// PageOptions selects a page of a list endpoint. The zero value asks for
+// the first page at the server's default size.
+type PageOptions struct {
+	Limit  int
+	Cursor string
+}
+
+func (p PageOptions) query() url.Values {
+	q := url.Values{}
+	if p.Limit > 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Cursor != "" {
+		q.Set("cursor", p.Cursor)
+	}
+	return q
+}
+
+// Page is one page of a list. NextCursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T
+	NextCursor string
+	Total      int
+}
+
+func list[T any](ctx context.Context, c *Client, path string, query url.Values) (*Page[T], error) {
+	page := &Page[T]{}
+	env, err := c.do(ctx, http.MethodGet, path, query, nil, &page.Items)
+	if err != nil {
+		return nil, err
+	}
+	if env.Pagination != nil {
+		page.NextCursor, page.Total = env.Pagination.NextCursor, env.Pagination.Total
+	}
+	return page, nil
+}
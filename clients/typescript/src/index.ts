@@ -0,0 +1,350 @@
+// TypeScript client for the bank API. It mirrors the Go client in
+// clients/go: same methods, same retry rules (idempotent requests are
+// retried on network errors and 5xx responses, writes never are).
+
+export interface Account {
+  id: number;
+  tenant_id: number;
+  email?: string;
+  name: string;
+  number: string;
+  balance: number;
+  role?: string;
+  currency: string;
+  locale?: string;
+  timezone?: string;
+  balance_formatted?: string;
+}
+
+export interface CreateAccountRequest {
+  email: string;
+  password: string;
+  name: string;
+  number: string;
+  balance: number;
+  currency?: string;
+  /** The code of the product to open the account on. */
+  product?: string;
+}
+
+/** A ledger entry: a signed movement in minor units and the balance it left. */
+export interface Transaction {
+  id: number;
+  account_id: number;
+  amount: number;
+  balance_after: number;
+  kind: string;
+  description: string;
+  reference?: string;
+  created_at: string;
+}
+
+export interface Transfer {
+  id: number;
+  reference: string;
+  from_account_id: number;
+  to_account_id: number;
+  amount: number;
+  currency: string;
+  memo: string;
+  created_at: string;
+}
+
+export interface TransferRequest {
+  to_account_id: number;
+  amount: number;
+  memo?: string;
+}
+
+export interface AccountOverview {
+  account: Account;
+  recent_transactions: Transaction[];
+  pending: PendingItems;
+}
+
+/** Money waiting to move in or out of an account. */
+export interface PendingItem {
+  id: number;
+  reference: string;
+  amount: number;
+  currency: string;
+  status: string;
+  expires_at: string;
+}
+
+/**
+ * The transfers waiting for a co-signer, the unused cash codes and the
+ * uncollected transfers to the holder's email or phone.
+ */
+export interface PendingItems {
+  approvals: PendingItem[];
+  cash_codes: PendingItem[];
+  claims: PendingItem[];
+}
+
+export interface LookupResult {
+  accounts: Account[];
+  missing: number[];
+}
+
+/** Notifies the holder once each time the balance drops below threshold. */
+export interface BalanceAlert {
+  account_id: number;
+  threshold: number;
+  triggered: boolean;
+  updated_at: string;
+}
+
+export interface Notification {
+  id: number;
+  account_id: number;
+  kind: string;
+  message: string;
+  created_at: string;
+}
+
+export interface TicketMessage {
+  id: number;
+  ticket_id: number;
+  author_id: number;
+  from_admin: boolean;
+  body: string;
+  created_at: string;
+}
+
+export interface Ticket {
+  id: number;
+  account_id: number;
+  transaction_id?: number;
+  subject: string;
+  status: string;
+  created_at: string;
+  updated_at: string;
+  messages?: TicketMessage[];
+}
+
+export interface CreateTicketRequest {
+  subject: string;
+  message: string;
+  transaction_id?: number;
+}
+
+export interface WebhookEndpoint {
+  id: number;
+  url: string;
+  secret?: string;
+  event_types: string[];
+  active: boolean;
+  created_at: string;
+}
+
+export interface PageOptions {
+  limit?: number;
+  cursor?: string;
+}
+
+/** One page of a list; nextCursor is empty on the last page. */
+export interface Page<T> {
+  items: T[];
+  nextCursor: string;
+  total: number;
+}
+
+interface Envelope<T> {
+  data: T;
+  pagination?: { next_cursor?: string; total: number };
+  request_id?: string;
+}
+
+/** An error response from the API. */
+export class BankApiError extends Error {
+  constructor(
+    readonly status: number,
+    message: string,
+    readonly code?: string,
+    readonly requestId?: string,
+  ) {
+    super(`bank api: ${status}${code ? " " + code : ""}: ${message}`);
+    this.name = "BankApiError";
+  }
+}
+
+export interface ClientOptions {
+  /** Tenant slug sent as X-Tenant. */
+  tenant?: string;
+  /** Existing bearer token, instead of calling login. */
+  token?: string;
+  /** Retries of idempotent requests (default 2). */
+  retries?: number;
+  /** Delay before the first retry in ms, doubled on every attempt (default 200). */
+  backoffMs?: number;
+  fetch?: typeof fetch;
+}
+
+const idempotent = new Set(["GET", "PUT", "DELETE"]);
+
+export class BankClient {
+  private readonly baseUrl: string;
+  private readonly opts: ClientOptions;
+  private token?: string;
+
+  constructor(baseUrl: string, opts: ClientOptions = {}) {
+    this.baseUrl = baseUrl.replace(/\/+$/, "");
+    this.opts = opts;
+    this.token = opts.token;
+  }
+
+  /** The bearer token in use, if any. */
+  getToken(): string | undefined {
+    return this.token;
+  }
+
+  private async request<T>(method: string, path: string, body?: unknown, query?: Record<string, string>): Promise<Envelope<T>> {
+    const qs = query && Object.keys(query).length ? "?" + new URLSearchParams(query).toString() : "";
+    const attempts = 1 + (idempotent.has(method) ? this.opts.retries ?? 2 : 0);
+    const backoff = this.opts.backoffMs ?? 200;
+    let lastError: unknown;
+    for (let attempt = 0; attempt < attempts; attempt++) {
+      if (attempt > 0) {
+        await new Promise((resolve) => setTimeout(resolve, backoff * 2 ** (attempt - 1)));
+      }
+      try {
+        return await this.send<T>(method, this.baseUrl + path + qs, body);
+      } catch (err) {
+        lastError = err;
+        if (err instanceof BankApiError && err.status < 500) {
+          throw err;
+        }
+      }
+    }
+    throw lastError;
+  }
+
+  private async send<T>(method: string, url: string, body?: unknown): Promise<Envelope<T>> {
+    const headers: Record<string, string> = { Accept: "application/json" };
+    if (body !== undefined) headers["Content-Type"] = "application/json";
+    if (this.opts.tenant) headers["X-Tenant"] = this.opts.tenant;
+    if (this.token) headers["Authorization"] = `Bearer ${this.token}`;
+
+    const doFetch = this.opts.fetch ?? fetch;
+    const resp = await doFetch(url, { method, headers, body: body === undefined ? undefined : JSON.stringify(body) });
+    const text = await resp.text();
+    if (!resp.ok) {
+      let parsed: { error?: string; code?: string; request_id?: string } = {};
+      try {
+        parsed = JSON.parse(text);
+      } catch {
+        // Not JSON; fall back to the raw text.
+      }
+      throw new BankApiError(resp.status, parsed.error ?? text.trim(), parsed.code, parsed.request_id);
+    }
+    return JSON.parse(text) as Envelope<T>;
+  }
+
+  private async list<T>(path: string, opts: PageOptions = {}): Promise<Page<T>> {
+    const query: Record<string, string> = {};
+    if (opts.limit) query.limit = String(opts.limit);
+    if (opts.cursor) query.cursor = opts.cursor;
+    const env = await this.request<T[]>("GET", path, undefined, query);
+    return { items: env.data, nextCursor: env.pagination?.next_cursor ?? "", total: env.pagination?.total ?? env.data.length };
+  }
+
+  /** Exchanges credentials for a token used by later requests. */
+  async login(email: string, password: string): Promise<void> {
+    const env = await this.request<{ token: string }>("POST", "/login", { email, password });
+    this.token = env.data.token;
+  }
+
+  /**
+   * Opens a new account. It does not log in. Servers in production refuse
+   * it; accounts there are opened by applying.
+   */
+  async createAccount(req: CreateAccountRequest): Promise<void> {
+    await this.request("POST", "/account/create", req);
+  }
+
+  async getAccount(id: number): Promise<Account> {
+    return (await this.request<Account>("GET", `/account/${id}`)).data;
+  }
+
+  async deleteAccount(id: number): Promise<void> {
+    await this.request("DELETE", `/account/${id}`);
+  }
+
+  /** An account with its latest transactions and pending items. */
+  async getAccountOverview(id: number): Promise<AccountOverview> {
+    return (await this.request<AccountOverview>("GET", `/account/${id}/overview`)).data;
+  }
+
+  /** A page of an account's history, newest first. */
+  listTransactions(accountId: number, opts?: PageOptions): Promise<Page<Transaction>> {
+    return this.list<Transaction>(`/account/${accountId}/transactions`, opts);
+  }
+
+  /** Moves money from the caller's account; the result carries the reference. */
+  async transfer(req: TransferRequest): Promise<Transfer> {
+    return (await this.request<Transfer>("POST", "/transfer", req)).data;
+  }
+
+  async getTransferByReference(reference: string): Promise<Transfer> {
+    return (await this.request<Transfer>("GET", `/transactions/by-reference/${encodeURIComponent(reference)}`)).data;
+  }
+
+  /** Fetches up to 100 accounts by ID in one request. */
+  async lookupAccounts(ids: number[]): Promise<LookupResult> {
+    return (await this.request<LookupResult>("POST", "/accounts/lookup", { ids })).data;
+  }
+
+  async getBalanceAlert(accountId: number): Promise<BalanceAlert> {
+    return (await this.request<BalanceAlert>("GET", `/account/${accountId}/balance-alert`)).data;
+  }
+
+  /** Sets the low-balance threshold of an account, in minor units. */
+  async setBalanceAlert(accountId: number, threshold: number): Promise<BalanceAlert> {
+    return (await this.request<BalanceAlert>("PUT", `/account/${accountId}/balance-alert`, { threshold })).data;
+  }
+
+  async deleteBalanceAlert(accountId: number): Promise<void> {
+    await this.request("DELETE", `/account/${accountId}/balance-alert`);
+  }
+
+  /** Saves the locale amounts are formatted in, e.g. "en-IN". */
+  async setLocale(locale: string): Promise<void> {
+    await this.request("PUT", "/me/preferences", { locale });
+  }
+
+  /** Saves the IANA time zone scheduled payments and statements follow, e.g. "Asia/Kathmandu". */
+  async setTimezone(timezone: string): Promise<void> {
+    await this.request("PUT", "/me/preferences", { timezone });
+  }
+
+  listNotifications(opts?: PageOptions): Promise<Page<Notification>> {
+    return this.list<Notification>("/notifications", opts);
+  }
+
+  listTickets(opts?: PageOptions): Promise<Page<Ticket>> {
+    return this.list<Ticket>("/tickets", opts);
+  }
+
+  async createTicket(req: CreateTicketRequest): Promise<Ticket> {
+    return (await this.request<Ticket>("POST", "/tickets", req)).data;
+  }
+
+  /** A ticket with its messages. */
+  async getTicket(id: number): Promise<Ticket> {
+    return (await this.request<Ticket>("GET", `/tickets/${id}`)).data;
+  }
+
+  async replyTicket(id: number, message: string): Promise<TicketMessage> {
+    return (await this.request<TicketMessage>("POST", `/tickets/${id}/replies`, { message })).data;
+  }
+
+  async listWebhooks(): Promise<WebhookEndpoint[]> {
+    return (await this.request<WebhookEndpoint[]>("GET", "/webhooks")).data;
+  }
+
+  /** Registers an endpoint. The returned secret signs deliveries and is only shown once. */
+  async createWebhook(url: string, eventTypes: string[] = []): Promise<WebhookEndpoint> {
+    return (await this.request<WebhookEndpoint>("POST", "/webhooks", { url, event_types: eventTypes })).data;
+  }
+}
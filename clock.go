@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clock tells the time to everything that depends on the date: token expiry,
+// ledger posting dates, end-of-day processing and the background jobs'
+// notion of today.
+type Clock interface {
+	Now() time.Time
+}
+
+// clock is the time source of the process. Tests and sandbox deployments
+// replace it with a fakeClock to travel in time.
+var clock Clock = systemClock{}
+
+// systemClock is the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// Set moves the clock to t, which may be in the past.
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+type ClockRequest struct {
+	Advance string `json:"advance"`
+}
+
+type ClockResponse struct {
+	Now time.Time `json:"now"`
+}
+
+// handleSandboxClock returns the server time (GET) or fast-forwards it by a
+// duration such as "36h" (POST). Only deployments started with a fake clock
+// can travel in time, and only forwards.
+func (s *Apiserver) handleSandboxClock(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return writeJSON(w, http.StatusOK, ClockResponse{Now: clock.Now()})
+	}
+	fake, ok := clock.(*fakeClock)
+	if !ok {
+		return newAPIError(http.StatusConflict, "clock_not_adjustable")
+	}
+	req := ClockRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(req.Advance)
+	if err != nil || d <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_duration", req.Advance)
+	}
+	now := fake.Advance(d)
+	s.audit(r, "clock.advanced", "tenant", requestTenant(r).ID, req)
+	return writeJSON(w, http.StatusOK, ClockResponse{Now: now})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	envDevelopment = "development"
+	envProduction  = "production"
+)
+
+// Config holds the settings read from the environment at startup.
+type Config struct {
+	Environment       string
+	ListenAddress     string
+	DatabaseDSN       string
+	TLSCertFile       string
+	TLSKeyFile        string
+	ReadOnly          bool
+	ReconcileInterval time.Duration
+	InvariantInterval time.Duration
+	SnapshotInterval  time.Duration
+	BusinessWeekend   string
+	EODInterval       time.Duration
+	FakeClock         bool
+	// Serve admins the runtime profiles under /debug/pprof/.
+	Pprof bool
+	// Security headers sent with every response.
+	HSTSMaxAge            time.Duration
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+	// Brute-force protection of /login.
+	LoginDelayBase       time.Duration
+	LoginDelayMax        time.Duration
+	CaptchaAfterFailures int
+	HCaptchaSecret       string
+	// Requests a client IP may make per minute, in bursts of up to
+	// RateLimitBurst. Zero turns rate limiting off.
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	// Password changes.
+	PasswordHistoryDepth int
+	PasswordMinAge       time.Duration
+	// Issued tokens.
+	JWTIssuer       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	JWTLeeway       time.Duration
+	// Comma separated PEM private key files. The first signs tokens, the
+	// rest are retired keys still accepted. Empty signs with HS256.
+	JWTSigningKeyFiles string
+	// Transfers to contacts without an account.
+	ClaimExpiry            time.Duration
+	ClaimExpiryInterval    time.Duration
+	PayeeCoolingOff        time.Duration
+	GeoCountryHeader       string
+	BillingInterval        time.Duration
+	CashCodeExpiryInterval time.Duration
+	ExportInterval         time.Duration
+	AggregationInterval    time.Duration
+	BillPaymentInterval    time.Duration
+	// Requests an API key may make per UTC day across all endpoints,
+	// unless an admin sets its own quota. Zero leaves keys unlimited.
+	APIKeyDailyQuota int
+	// Accounts go dormant after DormancyMonths without activity, having
+	// been warned DormancyNotice before. Zero months turns dormancy off.
+	DormancyMonths   int
+	DormancyNotice   time.Duration
+	DormancyInterval time.Duration
+	// Months an account must have been dormant before admins can move
+	// its balance to unclaimed funds.
+	EscheatmentMonths int
+	// How often queued admin campaigns are delivered.
+	CampaignInterval time.Duration
+	// How often notifications held for quiet hours and digests are
+	// checked for delivery.
+	NotificationOutboxInterval time.Duration
+	// Changes younger than SyncSettle are held back from the sync feeds
+	// so rows of transactions still committing are not skipped.
+	SyncSettle time.Duration
+	// Directory holding uploaded files such as transaction attachments.
+	FileStoreDir string
+	// Uploads are scanned by the ClamAV daemon at ClamAVAddress, if set;
+	// those it could not scan are retried every ScanInterval.
+	ClamAVAddress string
+	ScanInterval  time.Duration
+	// How long hot lookups such as tenants, accounts by number and
+	// exchange rates are cached in process. Zero turns caching off.
+	CacheTTL time.Duration
+	// How often the head of each tenant's audit chain is anchored and
+	// the chain verified.
+	AuditAnchorInterval time.Duration
+	// File of KEY=VALUE lines applied over the environment at startup
+	// and again on each reload.
+	ConfigFile string
+	// Least severe level written to the server log: debug, info or warn.
+	LogLevel string
+	// Emails are sent through the SMTP server at SMTPAddress, if set,
+	// from MailFrom. Otherwise what they would say is only logged.
+	SMTPAddress  string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	// Text messages go out through SMSProvider, "twilio" or "console",
+	// from SMSSenderID, a phone number or an alphanumeric sender ID.
+	// Twilio reports deliveries to SMSStatusCallbackURL, the public URL
+	// of /sms/status/twilio. No provider sends no texts.
+	SMSProvider          string
+	SMSSenderID          string
+	SMSStatusCallbackURL string
+	TwilioAccountSID     string
+	TwilioAuthToken      string
+}
+
+// LoadConfig reads the configuration from src, usually the environment,
+// falling back to defaults suitable for local development.
+func LoadConfig(src configSource) Config {
+	env := src.get("BANK_ENV", envDevelopment)
+	hsts := time.Duration(0)
+	if env == envProduction {
+		hsts = 2 * 365 * 24 * time.Hour
+	}
+	return Config{
+		Environment:                env,
+		ListenAddress:              src.get("LISTEN_ADDRESS", ":3000"),
+		DatabaseDSN:                src.get("DATABASE_DSN", "user=postgres password=postgres sslmode=disable"),
+		TLSCertFile:                src.get("TLS_CERT_FILE", ""),
+		TLSKeyFile:                 src.get("TLS_KEY_FILE", ""),
+		ReadOnly:                   src.getBool("BANK_READ_ONLY", false),
+		ReconcileInterval:          src.getDuration("RECONCILE_INTERVAL", time.Hour),
+		InvariantInterval:          src.getDuration("INVARIANT_CHECK_INTERVAL", 5*time.Minute),
+		SnapshotInterval:           src.getDuration("BALANCE_SNAPSHOT_INTERVAL", time.Hour),
+		BusinessWeekend:            src.get("BUSINESS_WEEKEND", "sat,sun"),
+		EODInterval:                src.getDuration("EOD_CHECK_INTERVAL", 15*time.Minute),
+		FakeClock:                  src.getBool("BANK_FAKE_CLOCK", false),
+		Pprof:                      src.getBool("PPROF_ENABLED", false),
+		HSTSMaxAge:                 src.getDuration("HSTS_MAX_AGE", hsts),
+		ContentSecurityPolicy:      src.get("CONTENT_SECURITY_POLICY", defaultContentSecurityPolicy),
+		ReferrerPolicy:             src.get("REFERRER_POLICY", defaultReferrerPolicy),
+		LoginDelayBase:             src.getDuration("LOGIN_DELAY_BASE", 250*time.Millisecond),
+		LoginDelayMax:              src.getDuration("LOGIN_DELAY_MAX", 8*time.Second),
+		CaptchaAfterFailures:       src.getInt("CAPTCHA_AFTER_FAILURES", 3),
+		HCaptchaSecret:             src.get("HCAPTCHA_SECRET", ""),
+		RateLimitPerMinute:         src.getInt("RATE_LIMIT_PER_MINUTE", 600),
+		RateLimitBurst:             src.getInt("RATE_LIMIT_BURST", 100),
+		PasswordHistoryDepth:       src.getInt("PASSWORD_HISTORY_DEPTH", 5),
+		PasswordMinAge:             src.getDuration("PASSWORD_MIN_AGE", 24*time.Hour),
+		JWTIssuer:                  src.get("JWT_ISSUER", tokenSettings.Issuer),
+		AccessTokenTTL:             src.getDuration("ACCESS_TOKEN_TTL", tokenSettings.AccessTTL),
+		RefreshTokenTTL:            src.getDuration("REFRESH_TOKEN_TTL", tokenSettings.RefreshTTL),
+		JWTLeeway:                  src.getDuration("JWT_LEEWAY", tokenSettings.Leeway),
+		JWTSigningKeyFiles:         src.get("JWT_SIGNING_KEY_FILES", ""),
+		ClaimExpiry:                src.getDuration("CLAIM_EXPIRY", defaultClaimExpiry),
+		ClaimExpiryInterval:        src.getDuration("CLAIM_EXPIRY_CHECK_INTERVAL", 15*time.Minute),
+		PayeeCoolingOff:            src.getDuration("PAYEE_COOLING_OFF", defaultPayeeCoolingOff),
+		GeoCountryHeader:           src.get("GEO_COUNTRY_HEADER", defaultGeoCountryHeader),
+		BillingInterval:            src.getDuration("BILLING_CHECK_INTERVAL", 15*time.Minute),
+		CashCodeExpiryInterval:     src.getDuration("CASH_CODE_EXPIRY_CHECK_INTERVAL", time.Minute),
+		ExportInterval:             src.getDuration("EXPORT_CHECK_INTERVAL", time.Hour),
+		AggregationInterval:        src.getDuration("AGGREGATION_SYNC_INTERVAL", 6*time.Hour),
+		BillPaymentInterval:        src.getDuration("BILL_PAYMENT_CHECK_INTERVAL", 15*time.Minute),
+		APIKeyDailyQuota:           src.getInt("API_KEY_DAILY_QUOTA", 10000),
+		DormancyMonths:             src.getInt("DORMANCY_AFTER_MONTHS", 12),
+		DormancyNotice:             src.getDuration("DORMANCY_NOTICE", 30*24*time.Hour),
+		DormancyInterval:           src.getDuration("DORMANCY_CHECK_INTERVAL", 6*time.Hour),
+		EscheatmentMonths:          src.getInt("ESCHEATMENT_AFTER_MONTHS", 36),
+		CampaignInterval:           src.getDuration("CAMPAIGN_INTERVAL", time.Minute),
+		NotificationOutboxInterval: src.getDuration("NOTIFICATION_OUTBOX_INTERVAL", time.Minute),
+		SyncSettle:                 src.getDuration("SYNC_SETTLE", 5*time.Second),
+		FileStoreDir:               src.get("FILE_STORE_DIR", "data/files"),
+		ClamAVAddress:              src.get("CLAMAV_ADDRESS", ""),
+		ScanInterval:               src.getDuration("SCAN_RETRY_INTERVAL", 5*time.Minute),
+		CacheTTL:                   src.getDuration("CACHE_TTL", 2*time.Second),
+		AuditAnchorInterval:        src.getDuration("AUDIT_ANCHOR_INTERVAL", time.Hour),
+		ConfigFile:                 src.get("CONFIG_FILE", ""),
+		LogLevel:                   src.get("LOG_LEVEL", logInfo),
+		SMTPAddress:                src.get("SMTP_ADDRESS", ""),
+		SMTPUsername:               src.get("SMTP_USERNAME", ""),
+		SMTPPassword:               src.get("SMTP_PASSWORD", ""),
+		MailFrom:                   src.get("MAIL_FROM", "no-reply@bank.local"),
+		SMSProvider:                src.get("SMS_PROVIDER", ""),
+		SMSSenderID:                src.get("SMS_SENDER_ID", ""),
+		SMSStatusCallbackURL:       src.get("SMS_STATUS_CALLBACK_URL", ""),
+		TwilioAccountSID:           src.get("TWILIO_ACCOUNT_SID", ""),
+		TwilioAuthToken:            src.get("TWILIO_AUTH_TOKEN", ""),
+	}
+}
+
+// configSource looks settings up by environment variable name.
+type configSource func(key string) (string, bool)
+
+func (src configSource) get(key, fallback string) string {
+	if v, ok := src(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (src configSource) getBool(key string, fallback bool) bool {
+	v, _ := src(key)
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+func (src configSource) getInt(key string, fallback int) int {
+	v, _ := src(key)
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func (src configSource) getDuration(key string, fallback time.Duration) time.Duration {
+	v, _ := src(key)
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+func getEnv(key, fallback string) string {
+	return configSource(os.LookupEnv).get(key, fallback)
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	return configSource(os.LookupEnv).getDuration(key, fallback)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadableSettings are the settings a reload applies, by environment
+// variable and Config field. The rest, such as addresses, keys and job
+// intervals, are wired up at startup and need a restart to change.
+var reloadableSettings = []struct{ env, field string }{
+	{"HSTS_MAX_AGE", "HSTSMaxAge"},
+	{"CONTENT_SECURITY_POLICY", "ContentSecurityPolicy"},
+	{"REFERRER_POLICY", "ReferrerPolicy"},
+	{"LOGIN_DELAY_BASE", "LoginDelayBase"},
+	{"LOGIN_DELAY_MAX", "LoginDelayMax"},
+	{"CAPTCHA_AFTER_FAILURES", "CaptchaAfterFailures"},
+	{"RATE_LIMIT_PER_MINUTE", "RateLimitPerMinute"},
+	{"RATE_LIMIT_BURST", "RateLimitBurst"},
+	{"PASSWORD_HISTORY_DEPTH", "PasswordHistoryDepth"},
+	{"PASSWORD_MIN_AGE", "PasswordMinAge"},
+	{"CLAIM_EXPIRY", "ClaimExpiry"},
+	{"PAYEE_COOLING_OFF", "PayeeCoolingOff"},
+	{"GEO_COUNTRY_HEADER", "GeoCountryHeader"},
+	{"BUSINESS_WEEKEND", "BusinessWeekend"},
+	{"API_KEY_DAILY_QUOTA", "APIKeyDailyQuota"},
+	{"DORMANCY_AFTER_MONTHS", "DormancyMonths"},
+	{"DORMANCY_NOTICE", "DormancyNotice"},
+	{"ESCHEATMENT_AFTER_MONTHS", "EscheatmentMonths"},
+	{"SYNC_SETTLE", "SyncSettle"},
+	{"LOG_LEVEL", "LogLevel"},
+}
+
+// configReloadMu serializes reloads, so two at once cannot both start from
+// the same snapshot and lose one's changes.
+var configReloadMu sync.Mutex
+
+// configReload reports what a reload changed.
+type configReload struct {
+	// Changed lists the Config fields the reload applied new values to.
+	Changed []string `json:"changed"`
+	// RestartRequired lists the fields whose new value was not applied.
+	RestartRequired []string  `json:"restart_required"`
+	ReloadedAt      time.Time `json:"reloaded_at"`
+}
+
+// configFileSource reads settings from a file of KEY=VALUE lines, blank
+// lines and # comments aside, in preference to the environment.
+// Deployments that cannot change the environment of a running process
+// point CONFIG_FILE at one to reload. A setting dropped from the file falls
+// back to the environment, then the default. No path reads the environment
+// alone.
+func configFileSource(path string) (configSource, error) {
+	if path == "" {
+		return os.LookupEnv, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return func(key string) (string, bool) {
+		if v, ok := settings[key]; ok {
+			return v, true
+		}
+		return os.LookupEnv(key)
+	}, nil
+}
+
+// validateReloadable checks that the reloadable settings of src parse,
+// which LoadConfig would otherwise quietly replace with defaults, and that
+// c, the config loaded from src, is coherent.
+func validateReloadable(c *Config, src configSource) error {
+	v := reflect.ValueOf(c).Elem()
+	var errs []error
+	for _, rs := range reloadableSettings {
+		raw, _ := src(rs.env)
+		if raw == "" {
+			continue
+		}
+		var err error
+		switch f := v.FieldByName(rs.field); {
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			var d time.Duration
+			if d, err = time.ParseDuration(raw); err == nil && d < 0 {
+				err = errors.New("must not be negative")
+			}
+		case f.Kind() == reflect.Int:
+			var n int
+			if n, err = strconv.Atoi(raw); err == nil && n < 0 {
+				err = errors.New("must not be negative")
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q: %v", rs.env, raw, err))
+		}
+	}
+	if !slices.Contains(logLevels, c.LogLevel) {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL=%q: want one of %v", c.LogLevel, logLevels))
+	}
+	if c.LoginDelayBase > c.LoginDelayMax {
+		errs = append(errs, errors.New("LOGIN_DELAY_BASE must not exceed LOGIN_DELAY_MAX"))
+	}
+	return errors.Join(errs...)
+}
+
+// reloadConfig re-reads the configuration into a candidate and, once every
+// setting of it is valid, swaps in a snapshot with the reloadable settings
+// updated, then refreshes the feature flags. The environment is left as is.
+func (s *Apiserver) reloadConfig() (*configReload, error) {
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+
+	cur := s.cfg()
+	src, err := configFileSource(cur.ConfigFile)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_config", err.Error())
+	}
+	loaded := LoadConfig(src)
+	if err := validateReloadable(&loaded, src); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_config", err.Error())
+	}
+
+	next := *cur
+	reload := &configReload{Changed: make([]string, 0), RestartRequired: make([]string, 0), ReloadedAt: clock.Now()}
+	reloadable := make(map[string]bool, len(reloadableSettings))
+	for _, rs := range reloadableSettings {
+		reloadable[rs.field] = true
+	}
+	from, to, dst := reflect.ValueOf(cur).Elem(), reflect.ValueOf(&loaded).Elem(), reflect.ValueOf(&next).Elem()
+	for i := range from.NumField() {
+		name := from.Type().Field(i).Name
+		if reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			continue
+		}
+		if reloadable[name] {
+			dst.Field(i).Set(to.Field(i))
+			reload.Changed = append(reload.Changed, name)
+		} else {
+			reload.RestartRequired = append(reload.RestartRequired, name)
+		}
+	}
+	s.config.Store(&next)
+	if slices.Contains(reload.Changed, "LogLevel") {
+		setLogLevel(next.LogLevel)
+	}
+
+	if s.flags != nil {
+		if err := s.flags.Reload(); err != nil {
+			logf("config reload: failed to refresh feature flags: %v\n", err)
+		}
+	}
+	return reload, nil
+}
+
+// watchConfigReload reloads the configuration on SIGHUP.
+func (s *Apiserver) watchConfigReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload, err := s.reloadConfig()
+			if err != nil {
+				logf("config reload rejected: %v\n", err)
+				continue
+			}
+			infof("config reloaded: changed %v, restart required for %v\n", reload.Changed, reload.RestartRequired)
+		}
+	}()
+}
+
+// handleReloadConfig reloads the configuration, as SIGHUP does. The
+// configuration is the deployment's, so only admins of the default tenant
+// reload it.
+func (s *Apiserver) handleReloadConfig(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "config_default_only")
+	}
+	reload, err := s.reloadConfig()
+	if err != nil {
+		return err
+	}
+	s.audit(r, "config.reloaded", "tenant", requestTenant(r).ID, reload)
+	return writeJSON(w, http.StatusOK, reload)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const createCosignersTable = `
+        CREATE TABLE IF NOT EXISTS cosigners (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            cosigner_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            threshold INT NOT NULL CHECK (threshold > 0),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createTransferApprovalsTable = `
+        CREATE TABLE IF NOT EXISTS transfer_approvals (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            reference TEXT UNIQUE NOT NULL,
+            from_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            to_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            cosigner_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            memo TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'pending_approval',
+            transfer_id INT REFERENCES transfers(id),
+            expires_at TIMESTAMPTZ NOT NULL,
+            decided_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// approvalTTL is how long a co-signer has to approve a transfer.
+const approvalTTL = 48 * time.Hour
+
+// Transfer approval statuses. An approval is expired once it is past its
+// expiry while still pending; that status is derived, not stored.
+const (
+	approvalPending  = "pending_approval"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+)
+
+var errApprovalNotPending = errors.New("transfer approval is not pending")
+
+// cosignerSettings make transfers from an account above the threshold wait
+// for a second account holder to approve them.
+type cosignerSettings struct {
+	AccountID         int       `json:"account_id"`
+	CosignerAccountID int       `json:"cosigner_account_id"`
+	Threshold         int       `json:"threshold"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+type CosignerRequest struct {
+	Cosigner  SplitParticipant `json:"cosigner"`
+	Threshold int              `json:"threshold"`
+}
+
+// transferApproval is a transfer waiting for the sender's co-signer. It
+// keeps the reference the transfer is made with once approved.
+type transferApproval struct {
+	ID                int        `json:"id"`
+	TenantID          int        `json:"tenant_id"`
+	Reference         string     `json:"reference"`
+	FromAccountID     int        `json:"from_account_id"`
+	ToAccountID       int        `json:"to_account_id"`
+	CosignerAccountID int        `json:"cosigner_account_id"`
+	Amount            int        `json:"amount"`
+	Currency          string     `json:"currency"`
+	Memo              string     `json:"memo"`
+	Status            string     `json:"status"`
+	TransferID        *int       `json:"transfer_id,omitempty"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	DecidedAt         *time.Time `json:"decided_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// CosignerStorage holds the co-signer and transfer approval storage
+// operations.
+type CosignerStorage interface {
+	SetCosigner(*cosignerSettings) error
+	GetCosigner(accountID int) (*cosignerSettings, error)
+	DeleteCosigner(accountID int) error
+	CreateTransferApproval(*transferApproval) error
+	GetTransferApproval(id int) (*transferApproval, error)
+	GetTransferApprovals(accountID int) ([]*transferApproval, error)
+	ApproveTransfer(a *transferApproval, t *transfer) error
+	RejectTransfer(*transferApproval) error
+}
+
+// SetCosigner creates or replaces the co-signer of an account.
+func (s *PostgresStorage) SetCosigner(c *cosignerSettings) error {
+	return s.db.QueryRow(`
+        INSERT INTO cosigners (account_id, cosigner_account_id, threshold) VALUES ($1, $2, $3)
+        ON CONFLICT (account_id) DO UPDATE SET cosigner_account_id = EXCLUDED.cosigner_account_id, threshold = EXCLUDED.threshold, updated_at = now()
+        RETURNING updated_at`,
+		c.AccountID, c.CosignerAccountID, c.Threshold,
+	).Scan(&c.UpdatedAt)
+}
+
+// GetCosigner retrieves the co-signer settings of an account.
+func (s *PostgresStorage) GetCosigner(accountID int) (*cosignerSettings, error) {
+	c := &cosignerSettings{}
+	err := s.db.QueryRow("SELECT account_id, cosigner_account_id, threshold, updated_at FROM cosigners WHERE account_id = $1", accountID).
+		Scan(&c.AccountID, &c.CosignerAccountID, &c.Threshold, &c.UpdatedAt)
+	return c, err
+}
+
+// DeleteCosigner removes the co-signer of an account.
+func (s *PostgresStorage) DeleteCosigner(accountID int) error {
+	_, err := s.db.Exec("DELETE FROM cosigners WHERE account_id = $1", accountID)
+	return err
+}
+
+const approvalColumns = "id, tenant_id, reference, from_account_id, to_account_id, cosigner_account_id, amount, currency, memo, status, transfer_id, expires_at, decided_at, created_at"
+
+func scanApproval(row interface{ Scan(...any) error }) (*transferApproval, error) {
+	a := &transferApproval{}
+	err := row.Scan(&a.ID, &a.TenantID, &a.Reference, &a.FromAccountID, &a.ToAccountID, &a.CosignerAccountID, &a.Amount, &a.Currency, &a.Memo, &a.Status, &a.TransferID, &a.ExpiresAt, &a.DecidedAt, &a.CreatedAt)
+	if a.Status == approvalPending && !clock.Now().Before(a.ExpiresAt) {
+		a.Status = approvalExpired
+	}
+	return a, err
+}
+
+// CreateTransferApproval stores a transfer waiting for its co-signer.
+func (s *PostgresStorage) CreateTransferApproval(a *transferApproval) error {
+	return s.db.QueryRow(
+		"INSERT INTO transfer_approvals (tenant_id, reference, from_account_id, to_account_id, cosigner_account_id, amount, currency, memo, status, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at",
+		a.TenantID, a.Reference, a.FromAccountID, a.ToAccountID, a.CosignerAccountID, a.Amount, a.Currency, a.Memo, a.Status, a.ExpiresAt,
+	).Scan(&a.ID, &a.CreatedAt)
+}
+
+// GetTransferApproval retrieves a transfer approval by its ID.
+func (s *PostgresStorage) GetTransferApproval(id int) (*transferApproval, error) {
+	return scanApproval(s.db.QueryRow("SELECT "+approvalColumns+" FROM transfer_approvals WHERE id = $1", id))
+}
+
+// GetTransferApprovals returns the approvals an account is the sender or
+// co-signer of, newest first.
+func (s *PostgresStorage) GetTransferApprovals(accountID int) ([]*transferApproval, error) {
+	rows, err := s.db.Query("SELECT "+approvalColumns+" FROM transfer_approvals WHERE from_account_id = $1 OR cosigner_account_id = $1 ORDER BY id DESC", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvals := make([]*transferApproval, 0)
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, a)
+	}
+	return approvals, rows.Err()
+}
+
+// ApproveTransfer makes an approved transfer and marks its approval
+// decided, all or nothing. An approval decided or expired since it was
+// loaded fails with errApprovalNotPending.
+func (s *PostgresStorage) ApproveTransfer(a *transferApproval, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := decideApproval(tx, a, approvalApproved); err != nil {
+		return err
+	}
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	a.TransferID = &t.ID
+	if _, err := tx.Exec("UPDATE transfer_approvals SET transfer_id = $1 WHERE id = $2", t.ID, a.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RejectTransfer marks a pending approval rejected.
+func (s *PostgresStorage) RejectTransfer(a *transferApproval) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := decideApproval(tx, a, approvalRejected); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func decideApproval(tx *sql.Tx, a *transferApproval, status string) error {
+	now := clock.Now()
+	res, err := tx.Exec(
+		"UPDATE transfer_approvals SET status = $1, decided_at = $2 WHERE id = $3 AND status = $4 AND expires_at > $2",
+		status, now, a.ID, approvalPending,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errApprovalNotPending
+	}
+	a.Status, a.DecidedAt = status, &now
+	return nil
+}
+
+// holdForCosigner parks a transfer above the sender's co-signer threshold
+// and asks the co-signer to approve it. It returns nil when the transfer
+// needs no approval.
+func (s *Apiserver) holdForCosigner(r *http.Request, t *transfer) (*transferApproval, error) {
+	c, err := s.store.GetCosigner(t.FromAccountID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && t.Amount <= c.Threshold) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	a := &transferApproval{
+		TenantID:          t.TenantID,
+		Reference:         t.Reference,
+		FromAccountID:     t.FromAccountID,
+		ToAccountID:       t.ToAccountID,
+		CosignerAccountID: c.CosignerAccountID,
+		Amount:            t.Amount,
+		Currency:          t.Currency,
+		Memo:              t.Memo,
+		Status:            approvalPending,
+		ExpiresAt:         clock.Now().Add(approvalTTL),
+	}
+	if err := s.store.CreateTransferApproval(a); err != nil {
+		return nil, err
+	}
+	s.audit(r, "transfer.approval_requested", "transfer_approval", a.ID, a)
+	s.notify(a.CosignerAccountID, "transfer_approval_requested", fmt.Sprintf("A transfer of %s (ref %s) is waiting for your approval until %s",
+		formatMoney(a.Amount, a.Currency, defaultLocale), a.Reference, a.ExpiresAt.UTC().Format(time.DateTime)))
+	return a, nil
+}
+
+// checkCosignerThreshold refuses a debit above the co-signer threshold of
+// the account, for payments that cannot wait for the co-signer's approval.
+func (s *Apiserver) checkCosignerThreshold(accountID, amount int) error {
+	if cs, err := s.store.GetCosigner(accountID); err == nil && amount > cs.Threshold {
+		return newAPIError(http.StatusForbidden, "cosigner_required")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return nil
+}
+
+// handleCosigner shows (GET), sets (PUT) or removes (DELETE) the co-signer
+// of an account. Once an account has a co-signer only an admin can change
+// or remove it, so the holder cannot lift the control on their own.
+func (s *Apiserver) handleCosigner(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	current, err := s.store.GetCosigner(acc.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	exists := err == nil
+
+	if r.Method == "GET" {
+		if !exists {
+			return newAPIError(http.StatusNotFound, "cosigner_not_found", acc.ID)
+		}
+		return writeJSON(w, http.StatusOK, current)
+	}
+	if exists && !isAdmin(r) {
+		return newAPIError(http.StatusForbidden, "cosigner_locked")
+	}
+	if r.Method == "DELETE" {
+		if err := s.store.DeleteCosigner(acc.ID); err != nil {
+			return err
+		}
+		s.audit(r, "cosigner.removed", "account", acc.ID, nil)
+		return writeJSON(w, http.StatusOK, map[string]int{"deleted": acc.ID})
+	}
+
+	req := CosignerRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Threshold <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	cosigner, err := s.resolveParticipant(acc.TenantID, req.Cosigner)
+	if err != nil {
+		return err
+	}
+	if cosigner.ID == acc.ID {
+		return newAPIError(http.StatusBadRequest, "cosigner_self")
+	}
+	settings := &cosignerSettings{AccountID: acc.ID, CosignerAccountID: cosigner.ID, Threshold: req.Threshold}
+	if err := s.store.SetCosigner(settings); err != nil {
+		return err
+	}
+	s.audit(r, "cosigner.set", "account", acc.ID, settings)
+	s.notify(cosigner.ID, "cosigner_added", fmt.Sprintf("You are now the co-signer of account %s for transfers above %s",
+		acc.Number, formatMoney(settings.Threshold, acc.Currency, defaultLocale)))
+	return writeJSON(w, http.StatusOK, settings)
+}
+
+// handleTransferApprovals lists the transfer approvals the caller sent or
+// is asked to co-sign.
+func (s *Apiserver) handleTransferApprovals(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	approvals, err := s.store.GetTransferApprovals(acc.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, approvals)
+}
+
+// pendingApproval loads a pending approval the caller co-signs.
+func (s *Apiserver) pendingApproval(r *http.Request) (*transferApproval, error) {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.store.GetTransferApproval(id)
+	if err != nil || a.CosignerAccountID != acc.ID {
+		return nil, newAPIError(http.StatusNotFound, "approval_not_found", id)
+	}
+	if a.Status != approvalPending {
+		return nil, newAPIError(http.StatusConflict, "approval_not_pending", id, a.Status)
+	}
+	return a, nil
+}
+
+// handleApproveTransfer makes a transfer its co-signer approves.
+func (s *Apiserver) handleApproveTransfer(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.pendingApproval(r)
+	if err != nil {
+		return err
+	}
+	from, err := s.store.GetAccountByID(a.FromAccountID)
+	if err != nil {
+		return err
+	}
+	t, err := s.newTransfer(from, a.ToAccountID, a.Amount, a.Memo)
+	if err != nil {
+		return err
+	}
+	t.Reference = a.Reference
+	err = s.store.ApproveTransfer(a, t)
+	if errors.Is(err, errApprovalNotPending) {
+		return newAPIError(http.StatusConflict, "approval_not_pending", a.ID, a.Status)
+	} else if err != nil {
+		return transferFailed(err)
+	}
+	s.transferCompleted(t)
+	s.audit(r, "transfer.approved", "transfer_approval", a.ID, nil)
+	s.notify(a.FromAccountID, "transfer_approved", fmt.Sprintf("Your transfer of %s (ref %s) was approved and sent", formatMoney(a.Amount, a.Currency, defaultLocale), a.Reference))
+	return writeJSON(w, http.StatusOK, a)
+}
+
+// handleRejectTransfer declines a transfer waiting for the caller's
+// approval.
+func (s *Apiserver) handleRejectTransfer(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.pendingApproval(r)
+	if err != nil {
+		return err
+	}
+	err = s.store.RejectTransfer(a)
+	if errors.Is(err, errApprovalNotPending) {
+		return newAPIError(http.StatusConflict, "approval_not_pending", a.ID, a.Status)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "transfer.rejected", "transfer_approval", a.ID, nil)
+	s.notify(a.FromAccountID, "transfer_rejected", fmt.Sprintf("Your co-signer rejected the transfer of %s (ref %s)", formatMoney(a.Amount, a.Currency, defaultLocale), a.Reference))
+	return writeJSON(w, http.StatusOK, a)
+}
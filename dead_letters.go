@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createWebhookErrorsTable = `
+        CREATE TABLE IF NOT EXISTS webhook_errors (
+            id SERIAL PRIMARY KEY,
+            event_id INT NOT NULL REFERENCES webhook_events(id) ON DELETE CASCADE,
+            error TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// webhookError is one failed delivery attempt of an event.
+type webhookError struct {
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// deadLetter is an event whose every delivery attempt failed, with the
+// endpoint it was meant for and the errors of all its attempts, oldest
+// first.
+type deadLetter struct {
+	*webhookEvent
+	AccountID int             `json:"account_id"`
+	URL       string          `json:"url"`
+	Errors    []*webhookError `json:"errors"`
+}
+
+type RequeueRequest struct {
+	EventIDs []int `json:"event_ids"`
+}
+
+// PurgeRequest selects dead letters to delete: the listed events, or every
+// one created before a point in time.
+type PurgeRequest struct {
+	EventIDs []int     `json:"event_ids"`
+	Before   time.Time `json:"before"`
+}
+
+// DeadLetterStorage holds the storage operations on failed webhook events.
+type DeadLetterStorage interface {
+	RecordWebhookError(eventID int, msg string) error
+	GetDeadLetters(tenantID int, page pageRequest) ([]*deadLetter, int, error)
+	RequeueDeadLetters(tenantID int, ids []int) ([]*webhookEvent, error)
+	PurgeDeadLetters(tenantID int, ids []int, before time.Time) (int, error)
+}
+
+// deadLetterScope limits webhook events, aliased e, to the failed ones of
+// the tenant's endpoints.
+const deadLetterScope = `
+    e.status = 'failed' AND e.endpoint_id IN (
+        SELECT w.id FROM webhook_endpoints w JOIN accounts a ON a.id = w.account_id WHERE a.tenant_id = $1
+    )`
+
+// RecordWebhookError adds a failed attempt to an event's error history.
+func (s *PostgresStorage) RecordWebhookError(eventID int, msg string) error {
+	_, err := s.db.Exec("INSERT INTO webhook_errors (event_id, error) VALUES ($1, $2)", eventID, msg)
+	return err
+}
+
+// GetDeadLetters returns a page of the tenant's failed events, newest first.
+func (s *PostgresStorage) GetDeadLetters(tenantID int, page pageRequest) ([]*deadLetter, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM webhook_events e WHERE"+deadLetterScope, tenantID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "e")
+	rows, err := s.db.Query(`
+        SELECT e.id, e.endpoint_id, e.event_type, e.payload, e.status, e.attempts, e.last_error, e.created_at, w.account_id, w.url
+        FROM webhook_events e JOIN webhook_endpoints w ON w.id = e.endpoint_id
+        WHERE`+deadLetterScope+" AND "+cond+" "+order,
+		append([]any{tenantID}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	letters := make([]*deadLetter, 0)
+	byEvent := map[int]*deadLetter{}
+	ids := []int{}
+	for rows.Next() {
+		d := &deadLetter{webhookEvent: &webhookEvent{}, Errors: []*webhookError{}}
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.LastError, &d.CreatedAt, &d.AccountID, &d.URL); err != nil {
+			return nil, 0, err
+		}
+		d.Payload = payload
+		letters = append(letters, d)
+		byEvent[d.ID] = d
+		ids = append(ids, d.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	errs, err := s.db.Query("SELECT event_id, error, created_at FROM webhook_errors WHERE event_id = ANY($1) ORDER BY id", pq.Array(ids))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer errs.Close()
+	for errs.Next() {
+		var eventID int
+		e := &webhookError{}
+		if err := errs.Scan(&eventID, &e.Error, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		byEvent[eventID].Errors = append(byEvent[eventID].Errors, e)
+	}
+	return letters, total, errs.Err()
+}
+
+// RequeueDeadLetters marks the listed failed events of the tenant pending
+// again and returns them. Events of deactivated endpoints stay dead.
+func (s *PostgresStorage) RequeueDeadLetters(tenantID int, ids []int) ([]*webhookEvent, error) {
+	rows, err := s.db.Query(`
+        UPDATE webhook_events e SET status = 'pending'
+        WHERE e.id = ANY($2) AND e.endpoint_id IN (SELECT id FROM webhook_endpoints WHERE active) AND`+deadLetterScope+`
+        RETURNING e.id, e.endpoint_id, e.event_type, e.payload, e.status, e.attempts, e.last_error, e.created_at`,
+		tenantID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*webhookEvent, 0)
+	for rows.Next() {
+		ev := &webhookEvent{}
+		var payload []byte
+		if err := rows.Scan(&ev.ID, &ev.EndpointID, &ev.EventType, &payload, &ev.Status, &ev.Attempts, &ev.LastError, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		ev.Payload = payload
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// PurgeDeadLetters deletes the tenant's failed events that are listed or,
+// without IDs, were created before the given time. It returns how many
+// were deleted.
+func (s *PostgresStorage) PurgeDeadLetters(tenantID int, ids []int, before time.Time) (int, error) {
+	res, err := s.db.Exec(`
+        DELETE FROM webhook_events e
+        WHERE (e.id = ANY($2) OR (cardinality($2::INT[]) = 0 AND e.created_at < $3)) AND`+deadLetterScope,
+		tenantID, pq.Array(ids), before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// handleDeadLetters lists the tenant's webhook events that failed every
+// delivery attempt, with their error history.
+func (s *Apiserver) handleDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	letters, total, err := s.store.GetDeadLetters(requestTenant(r).ID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(letters, total, page, func(d *deadLetter) cursor { return cursor{d.CreatedAt, d.ID} }))
+}
+
+// handleRequeueDeadLetters queues the listed dead letters for delivery
+// again, in the background.
+func (s *Apiserver) handleRequeueDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	req := RequeueRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.EventIDs) == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "event_ids")
+	}
+	events, err := s.store.RequeueDeadLetters(requestTenant(r).ID, req.EventIDs)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		e, err := s.store.GetWebhookEndpoint(ev.EndpointID)
+		if err != nil {
+			return err
+		}
+		go s.deliverWebhook(e, ev)
+	}
+	s.audit(r, "dead_letter.requeued", "webhook_event", 0, req)
+	return writeJSON(w, http.StatusAccepted, map[string]int{"requeued": len(events)})
+}
+
+// handlePurgeDeadLetters deletes dead letters for good.
+func (s *Apiserver) handlePurgeDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	req := PurgeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.EventIDs) == 0 && req.Before.IsZero() {
+		return newAPIError(http.StatusBadRequest, "required_field", "event_ids")
+	}
+	n, err := s.store.PurgeDeadLetters(requestTenant(r).ID, req.EventIDs, req.Before)
+	if err != nil {
+		return err
+	}
+	s.audit(r, "dead_letter.purged", "webhook_event", 0, req)
+	return writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const createKnownDevicesTable = `
+        CREATE TABLE IF NOT EXISTS known_devices (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            fingerprint TEXT NOT NULL,
+            user_agent TEXT NOT NULL DEFAULT '',
+            ip TEXT NOT NULL DEFAULT '',
+            first_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (account_id, fingerprint)
+        )
+    `
+
+const createLoginChallengesTable = `
+        CREATE TABLE IF NOT EXISTS login_challenges (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            fingerprint TEXT NOT NULL,
+            user_agent TEXT NOT NULL DEFAULT '',
+            ip TEXT NOT NULL DEFAULT '',
+            code_hash TEXT NOT NULL,
+            attempts INT NOT NULL DEFAULT 0,
+            expires_at TIMESTAMPTZ NOT NULL,
+            verified_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const (
+	// challengeTTL is how long a step-up code stays valid.
+	challengeTTL = 10 * time.Minute
+	// maxChallengeAttempts locks a challenge after this many wrong codes.
+	maxChallengeAttempts = 5
+)
+
+var (
+	errChallengeNotFound = errors.New("login challenge not found")
+	errChallengeUsed     = errors.New("login challenge already used")
+	errChallengeExpired  = errors.New("login challenge expired")
+	errChallengeLocked   = errors.New("too many wrong codes")
+	errChallengeCode     = errors.New("wrong code")
+)
+
+// knownDevice is a device an account holder has logged in from. The
+// fingerprint is stored hashed.
+type knownDevice struct {
+	ID          int       `json:"id"`
+	AccountID   int       `json:"account_id"`
+	Fingerprint string    `json:"-"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// loginChallenge is a pending step-up verification of a login from an
+// unknown device. Each challenge can be verified once.
+type loginChallenge struct {
+	ID        int
+	AccountID int
+	Device    knownDevice
+	CodeHash  string
+	ExpiresAt time.Time
+}
+
+type StepUpResponse struct {
+	StepUpRequired bool      `json:"step_up_required"`
+	ChallengeID    int       `json:"challenge_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+type VerifyLoginRequest struct {
+	ChallengeID int    `json:"challenge_id"`
+	Code        string `json:"code"`
+	Session     bool   `json:"session,omitempty"`
+}
+
+// OTPSender delivers step-up codes to account holders. The server logs them
+// unless an email or SMS provider is plugged in.
+type OTPSender interface {
+	SendOTP(acc *account, code string) error
+}
+
+// logOTPSender writes codes to the server log, for local development. The
+// server refuses to start in production without a real channel.
+type logOTPSender struct{}
+
+func (logOTPSender) SendOTP(acc *account, code string) error {
+	logf("login code for account %d (%s): %s\n", acc.ID, acc.Email, code)
+	return nil
+}
+
+// DeviceStorage holds the known device and login challenge storage
+// operations.
+type DeviceStorage interface {
+	GetDevices(accountID int) ([]*knownDevice, error)
+	SaveDevice(*knownDevice) error
+	CreateLoginChallenge(*loginChallenge) error
+	VerifyLoginChallenge(tenantID, id int, code string) (*loginChallenge, error)
+}
+
+// GetDevices returns the known devices of an account, most recently used
+// first.
+func (s *PostgresStorage) GetDevices(accountID int) ([]*knownDevice, error) {
+	rows, err := s.db.Query("SELECT id, account_id, fingerprint, user_agent, ip, first_seen_at, last_seen_at FROM known_devices WHERE account_id = $1 ORDER BY last_seen_at DESC", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]*knownDevice, 0)
+	for rows.Next() {
+		d := &knownDevice{}
+		if err := rows.Scan(&d.ID, &d.AccountID, &d.Fingerprint, &d.UserAgent, &d.IP, &d.FirstSeenAt, &d.LastSeenAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// SaveDevice records a login from a device, adding it to the account's known
+// devices if it is new.
+func (s *PostgresStorage) SaveDevice(d *knownDevice) error {
+	return s.db.QueryRow(`
+        INSERT INTO known_devices (account_id, fingerprint, user_agent, ip) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (account_id, fingerprint) DO UPDATE SET user_agent = EXCLUDED.user_agent, ip = EXCLUDED.ip, last_seen_at = now()
+        RETURNING id, first_seen_at, last_seen_at`,
+		d.AccountID, d.Fingerprint, d.UserAgent, d.IP,
+	).Scan(&d.ID, &d.FirstSeenAt, &d.LastSeenAt)
+}
+
+// CreateLoginChallenge stores a new step-up challenge.
+func (s *PostgresStorage) CreateLoginChallenge(c *loginChallenge) error {
+	return s.db.QueryRow(
+		"INSERT INTO login_challenges (account_id, fingerprint, user_agent, ip, code_hash, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		c.AccountID, c.Device.Fingerprint, c.Device.UserAgent, c.Device.IP, c.CodeHash, c.ExpiresAt,
+	).Scan(&c.ID)
+}
+
+// VerifyLoginChallenge checks a code against one of a tenant's challenges
+// and uses the challenge up when it matches. Wrong codes count towards the
+// lockout.
+func (s *PostgresStorage) VerifyLoginChallenge(tenantID, id int, code string) (*loginChallenge, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	c := &loginChallenge{ID: id}
+	var attempts int
+	var verifiedAt sql.NullTime
+	err = tx.QueryRow(`
+        SELECT c.account_id, c.fingerprint, c.user_agent, c.ip, c.code_hash, c.attempts, c.expires_at, c.verified_at
+        FROM login_challenges c JOIN accounts a ON a.id = c.account_id
+        WHERE c.id = $1 AND a.tenant_id = $2 FOR UPDATE OF c`,
+		id, tenantID,
+	).Scan(&c.AccountID, &c.Device.Fingerprint, &c.Device.UserAgent, &c.Device.IP, &c.CodeHash, &attempts, &c.ExpiresAt, &verifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case verifiedAt.Valid:
+		return nil, errChallengeUsed
+	case !clock.Now().Before(c.ExpiresAt):
+		return nil, errChallengeExpired
+	case attempts >= maxChallengeAttempts:
+		return nil, errChallengeLocked
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(c.CodeHash), []byte(code)) != nil {
+		if _, err := tx.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = $1", id); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errChallengeCode
+	}
+	if _, err := tx.Exec("UPDATE login_challenges SET verified_at = now() WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+	c.Device.AccountID = c.AccountID
+	return c, tx.Commit()
+}
+
+// requestDevice describes the device a login comes from. Clients should send
+// a stable fingerprint; without one the user agent stands in for it.
+func requestDevice(r *http.Request, accountID int, fingerprint string) *knownDevice {
+	ua := r.UserAgent()
+	if fingerprint == "" {
+		fingerprint = "ua:" + ua
+	}
+	return &knownDevice{AccountID: accountID, Fingerprint: hashAPIKey(fingerprint), UserAgent: ua, IP: clientIP(r)}
+}
+
+// clientIP returns the address of the client that sent a request.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// newOTP returns a random six-digit code.
+func newOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// startStepUp sends a step-up code to the holder of an account already
+// signed in, for actions that need them to prove it is still them.
+func (s *Apiserver) startStepUp(r *http.Request, acc *account) (*StepUpResponse, error) {
+	code, err := newOTP()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	c := &loginChallenge{AccountID: acc.ID, Device: *requestDevice(r, acc.ID, ""), CodeHash: string(hash), ExpiresAt: clock.Now().Add(challengeTTL)}
+	if err := s.store.CreateLoginChallenge(c); err != nil {
+		return nil, err
+	}
+	if err := s.otp.SendOTP(acc, code); err != nil {
+		return nil, err
+	}
+	return &StepUpResponse{StepUpRequired: true, ChallengeID: c.ID, ExpiresAt: c.ExpiresAt}, nil
+}
+
+// verifyStepUp checks the code of a challenge started by startStepUp.
+func (s *Apiserver) verifyStepUp(acc *account, challengeID int, code string) error {
+	c, err := s.store.VerifyLoginChallenge(acc.TenantID, challengeID, code)
+	switch {
+	case errors.Is(err, errChallengeNotFound), errors.Is(err, errChallengeUsed), errors.Is(err, errChallengeExpired):
+		return newAPIError(http.StatusUnauthorized, "challenge_invalid")
+	case errors.Is(err, errChallengeLocked):
+		return newAPIError(http.StatusTooManyRequests, "challenge_locked")
+	case errors.Is(err, errChallengeCode):
+		return newAPIError(http.StatusUnauthorized, "challenge_wrong_code")
+	case err != nil:
+		return err
+	}
+	if c.AccountID != acc.ID {
+		return newAPIError(http.StatusUnauthorized, "challenge_invalid")
+	}
+	return nil
+}
+
+// checkDevice lets a login through from a known device, or from the first
+// device an account ever uses. Logins from any other device, or from a
+// country the geographic rules send for review, get a step-up challenge,
+// whose code is sent to the account holder, instead of a token. Logins
+// from a country the account is restricted from are refused.
+func (s *Apiserver) checkDevice(r *http.Request, acc *account, fingerprint string) (*StepUpResponse, error) {
+	country := s.requestCountry(r)
+	geo, err := s.checkGeo(acc.ID, country)
+	if err != nil {
+		return nil, err
+	}
+	if geo == geoDeny {
+		s.notify(acc.ID, "geo_blocked", fmt.Sprintf("A login from %s was blocked by your geographic restrictions", country))
+		return nil, newAPIError(http.StatusForbidden, "geo_blocked", country)
+	}
+
+	device := requestDevice(r, acc.ID, fingerprint)
+	devices, err := s.store.GetDevices(acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	known := len(devices) == 0
+	for _, d := range devices {
+		known = known || d.Fingerprint == device.Fingerprint
+	}
+	if known && geo != geoReview {
+		if err := s.store.SaveDevice(device); err != nil {
+			return nil, err
+		}
+		return nil, s.recordCountry(acc.ID, country)
+	}
+
+	code, err := newOTP()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	c := &loginChallenge{AccountID: acc.ID, Device: *device, CodeHash: string(hash), ExpiresAt: clock.Now().Add(challengeTTL)}
+	if err := s.store.CreateLoginChallenge(c); err != nil {
+		return nil, err
+	}
+	if err := s.otp.SendOTP(acc, code); err != nil {
+		return nil, err
+	}
+	if geo == geoReview {
+		s.notifyGeoReview(acc.ID, country, "A login is waiting for verification")
+	} else {
+		s.notify(acc.ID, "new_device", fmt.Sprintf("A login from a new device (%s, %s) is waiting for verification", device.UserAgent, device.IP))
+	}
+	return &StepUpResponse{StepUpRequired: true, ChallengeID: c.ID, ExpiresAt: c.ExpiresAt}, nil
+}
+
+// handleVerifyLogin completes a login from a new device with the code sent
+// to the account holder, remembering the device for next time.
+func (s *Apiserver) handleVerifyLogin(w http.ResponseWriter, r *http.Request) error {
+	req := VerifyLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	t := requestTenant(r)
+	c, err := s.store.VerifyLoginChallenge(t.ID, req.ChallengeID, req.Code)
+	switch {
+	case errors.Is(err, errChallengeNotFound), errors.Is(err, errChallengeUsed), errors.Is(err, errChallengeExpired):
+		return newAPIError(http.StatusUnauthorized, "challenge_invalid")
+	case errors.Is(err, errChallengeLocked):
+		return newAPIError(http.StatusTooManyRequests, "challenge_locked")
+	case errors.Is(err, errChallengeCode):
+		return newAPIError(http.StatusUnauthorized, "challenge_wrong_code")
+	case err != nil:
+		return err
+	}
+
+	acc, err := s.store.GetAccountByID(c.AccountID)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SaveDevice(&c.Device); err != nil {
+		return err
+	}
+	if err := s.recordCountry(acc.ID, s.requestCountry(r)); err != nil {
+		return err
+	}
+	return s.writeLogin(w, r, acc, t, req.Session)
+}
+
+// handleDevices lists the caller's known devices.
+func (s *Apiserver) handleDevices(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	devices, err := s.store.GetDevices(acc.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, devices)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// accountLastActivity is when the account holder, aliased a, last did
+// something themselves: logged in, moved money out, or, for accounts that
+// never did either, opened the account. Money coming in does not count.
+const accountLastActivity = `GREATEST(
+    a.password_changed_at,
+    (SELECT MAX(d.last_seen_at) FROM known_devices d WHERE d.account_id = a.id),
+    (SELECT MAX(e.created_at) FROM ledger_entries e WHERE e.account_id = a.id AND e.amount < 0)
+)`
+
+// dormancyRun is the outcome of one dormancy check of a tenant.
+type dormancyRun struct {
+	Warned  []int `json:"warned"`
+	Dormant []int `json:"dormant"`
+}
+
+type ReactivateRequest struct {
+	ChallengeID int    `json:"challenge_id"`
+	Code        string `json:"code"`
+}
+
+// DormancyStorage holds the account dormancy storage operations.
+type DormancyStorage interface {
+	WarnDormancy(tenantID int, inactiveSince, now time.Time) ([]int, error)
+	MarkDormant(tenantID int, inactiveSince, warnedBefore, now time.Time) ([]int, error)
+	IsDormant(id int) (bool, error)
+	Reactivate(id int) error
+}
+
+// WarnDormancy flags the tenant's active customer accounts without activity
+// since inactiveSince that have not been warned since their last activity,
+// and returns their IDs.
+func (s *PostgresStorage) WarnDormancy(tenantID int, inactiveSince, now time.Time) ([]int, error) {
+	return s.queryIDs(`
+        UPDATE accounts a SET dormancy_warned_at = $3
+        WHERE a.tenant_id = $1 AND a.role = 'customer' AND a.dormant_at IS NULL
+            AND `+accountLastActivity+` < $2
+            AND (a.dormancy_warned_at IS NULL OR a.dormancy_warned_at < `+accountLastActivity+`)
+        RETURNING a.id`,
+		tenantID, inactiveSince, now)
+}
+
+// MarkDormant makes the tenant's customer accounts without activity since
+// inactiveSince dormant, if they were warned before warnedBefore and have
+// not been active since. It returns their IDs.
+func (s *PostgresStorage) MarkDormant(tenantID int, inactiveSince, warnedBefore, now time.Time) ([]int, error) {
+	return s.queryIDs(`
+        UPDATE accounts a SET dormant_at = $4
+        WHERE a.tenant_id = $1 AND a.role = 'customer' AND a.dormant_at IS NULL
+            AND `+accountLastActivity+` < $2
+            AND a.dormancy_warned_at >= `+accountLastActivity+` AND a.dormancy_warned_at < $3
+        RETURNING a.id`,
+		tenantID, inactiveSince, warnedBefore, now)
+}
+
+func (s *PostgresStorage) queryIDs(query string, args ...any) ([]int, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// IsDormant reports whether an account is dormant.
+func (s *PostgresStorage) IsDormant(id int) (bool, error) {
+	var dormant bool
+	err := s.db.QueryRow("SELECT dormant_at IS NOT NULL FROM accounts WHERE id = $1", id).Scan(&dormant)
+	return dormant, err
+}
+
+// Reactivate makes a dormant account active again. It returns
+// sql.ErrNoRows if the account is not dormant.
+func (s *PostgresStorage) Reactivate(id int) error {
+	res, err := s.db.Exec("UPDATE accounts SET dormant_at = NULL, dormancy_warned_at = NULL WHERE id = $1 AND dormant_at IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// runDormancy warns the tenant's customers DormancyNotice before their
+// accounts go dormant, then makes accounts dormant once they have been
+// inactive for DormancyMonths and the notice has run out.
+func (s *Apiserver) runDormancy(tenantID int) (*dormancyRun, error) {
+	run := &dormancyRun{Warned: []int{}, Dormant: []int{}}
+	if s.cfg().DormancyMonths <= 0 {
+		return run, nil
+	}
+	now := clock.Now()
+	cutoff := now.AddDate(0, -s.cfg().DormancyMonths, 0)
+
+	dormant, err := s.store.MarkDormant(tenantID, cutoff, now.Add(-s.cfg().DormancyNotice), now)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range dormant {
+		s.notify(id, "account_dormant", "Your account is now dormant after a long period without activity. Reactivate it to send money again.")
+	}
+	run.Dormant = dormant
+
+	warned, err := s.store.WarnDormancy(tenantID, cutoff.Add(s.cfg().DormancyNotice), now)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range warned {
+		s.notify(id, "dormancy_warning", fmt.Sprintf("Your account will become dormant on %s unless you log in or make a payment", now.Add(s.cfg().DormancyNotice).Format(time.DateOnly)))
+	}
+	run.Warned = warned
+	if len(dormant) > 0 || len(warned) > 0 {
+		infof("dormancy: tenant %d: %d warned, %d dormant\n", tenantID, len(warned), len(dormant))
+	}
+	return run, nil
+}
+
+// startDormancyJob checks for dormant accounts in the background.
+func (s *Apiserver) startDormancyJob(interval time.Duration) {
+	if interval <= 0 || s.cfg().DormancyMonths <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.pausedForReadOnly("dormancy") {
+				continue
+			}
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("dormancy: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runDormancy(t.ID); err != nil {
+					logf("dormancy: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
+
+// checkDormancy refuses to move money out of a dormant account.
+func (s *Apiserver) checkDormancy(id int) error {
+	dormant, err := s.store.IsDormant(id)
+	if err != nil {
+		return err
+	}
+	if dormant {
+		return newAPIError(http.StatusForbidden, "account_dormant", id)
+	}
+	return nil
+}
+
+// handleReactivate starts the reactivation of the caller's dormant account
+// by sending a step-up code to the account holder.
+func (s *Apiserver) handleReactivate(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	if !acc.Dormant {
+		return newAPIError(http.StatusConflict, "account_not_dormant")
+	}
+	stepUp, err := s.startStepUp(r, acc)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusAccepted, stepUp)
+}
+
+// handleVerifyReactivation completes a reactivation with the code sent to
+// the account holder.
+func (s *Apiserver) handleVerifyReactivation(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := ReactivateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if err := s.verifyStepUp(acc, req.ChallengeID, req.Code); err != nil {
+		return err
+	}
+
+	if err := s.store.Reactivate(acc.ID); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusConflict, "account_not_dormant")
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "account.reactivated", "account", acc.ID, nil)
+	s.notify(acc.ID, "account_reactivated", "Your account is active again")
+	acc, err = s.store.GetAccountByID(acc.ID)
+	if err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, acc)
+}
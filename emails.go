@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Emails are rendered from the templates in emails/, one file per template
+// and language named <template>.<language>.html, each defining the
+// "subject" and the "content" laid out by layout.html. A template missing
+// in a language falls back to English.
+//
+//go:embed emails/*.html
+var emailFiles embed.FS
+
+var emailTemplates = loadEmailTemplates()
+
+func loadEmailTemplates() map[string]map[string]*template.Template {
+	files, err := fs.Glob(emailFiles, "emails/*.*.html")
+	if err != nil {
+		panic(err)
+	}
+	templates := make(map[string]map[string]*template.Template)
+	for _, file := range files {
+		name, lang, _ := strings.Cut(strings.TrimSuffix(path.Base(file), ".html"), ".")
+		t, err := template.ParseFS(emailFiles, "emails/layout.html", file)
+		if err != nil {
+			panic(fmt.Sprintf("invalid email template %s: %v", file, err))
+		}
+		if templates[name] == nil {
+			templates[name] = make(map[string]*template.Template)
+		}
+		templates[name][lang] = t
+	}
+	return templates
+}
+
+// What each email template is given as .Data.
+type (
+	loginCodeEmail struct {
+		Code    string
+		Minutes int
+	}
+	statementExportEmail struct {
+		Name     string
+		Filename string
+	}
+	balanceAlertEmail struct {
+		Balance   string
+		Threshold string
+	}
+	campaignEmail struct {
+		Subject string
+		Message string
+	}
+	notificationEmailData struct {
+		Message string
+	}
+	notificationDigestEmail struct {
+		Items []notificationDigestItem
+	}
+)
+
+type notificationDigestItem struct {
+	Kind    string
+	Message string
+	At      time.Time
+}
+
+// emailPreviews are the sample data the templates are previewed with.
+var emailPreviews = map[string]any{
+	"login_code":       loginCodeEmail{Code: "123456", Minutes: int(challengeTTL.Minutes())},
+	"statement_export": statementExportEmail{Name: "Monthly groceries", Filename: "statement-2024-01-31.csv"},
+	"balance_alert":    balanceAlertEmail{Balance: formatMoney(45000, "INR", defaultLocale), Threshold: formatMoney(100000, "INR", defaultLocale)},
+	"campaign":         campaignEmail{Subject: "New savings pots", Message: "Set money aside for what matters.\nOpen a pot from your account page."},
+	"notification":     notificationEmailData{Message: "You received 500.00 from account 100200300"},
+	"notification_digest": notificationDigestEmail{Items: []notificationDigestItem{
+		{Kind: "transfer_received", Message: "You received 500.00 from account 100200300"},
+		{Kind: "bill_paid", Message: "Your electricity bill of 1,200.00 was paid"},
+	}},
+}
+
+// emailPage is what a template is executed with.
+type emailPage struct {
+	Lang    string
+	Account *account
+	Data    any
+}
+
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// emailMessage is a rendered email.
+type emailMessage struct {
+	To          string
+	Subject     string
+	HTML        string
+	Attachments []emailAttachment
+}
+
+// accountLanguage is the language acc is written to in: that of its locale
+// preference, or the default.
+func accountLanguage(acc *account) string {
+	lang := strings.ToLower(strings.SplitN(acc.Locale, "-", 2)[0])
+	if _, ok := catalogs[lang]; ok {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// renderEmail renders the template name for acc in lang.
+func renderEmail(name, lang string, acc *account, data any) (*emailMessage, error) {
+	variants, ok := emailTemplates[name]
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "email_template_not_found", name)
+	}
+	t, ok := variants[lang]
+	if !ok {
+		lang, t = defaultLanguage, variants[defaultLanguage]
+	}
+	page := emailPage{Lang: lang, Account: acc, Data: data}
+	var subject, body bytes.Buffer
+	if err := t.ExecuteTemplate(&subject, "subject", page); err != nil {
+		return nil, err
+	}
+	if err := t.ExecuteTemplate(&body, "layout", page); err != nil {
+		return nil, err
+	}
+	return &emailMessage{To: acc.Email, Subject: strings.TrimSpace(html.UnescapeString(subject.String())), HTML: body.String()}, nil
+}
+
+// Mailer delivers rendered emails.
+type Mailer interface {
+	Send(*emailMessage) error
+}
+
+// smtpTimeout bounds a whole SMTP exchange, from dialing to QUIT, so a
+// stalled mail server cannot hold up the request sending the email.
+const smtpTimeout = 30 * time.Second
+
+// smtpMailer sends emails through an SMTP server, authenticating when it
+// has a username.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(cfg *Config) *smtpMailer {
+	m := &smtpMailer{addr: cfg.SMTPAddress, from: cfg.MailFrom}
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddress)
+		m.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return m
+}
+
+func (m *smtpMailer) Send(msg *emailMessage) error {
+	data, err := encodeEmail(m.from, msg)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", m.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(m.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// encodeEmail writes msg as a MIME message: its HTML alone, or followed
+// by its attachments in a multipart/mixed body.
+func encodeEmail(from string, msg *emailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		from, msg.To, mime.QEncoding.Encode("utf-8", msg.Subject), clock.Now().Format(time.RFC1123Z))
+	htmlHeader := textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if len(msg.Attachments) == 0 {
+		for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, htmlHeader.Get(k))
+		}
+		buf.WriteString("\r\n")
+		writeBase64Lines(&buf, []byte(msg.HTML))
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+	part, err := mw.CreatePart(htmlHeader)
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(part, []byte(msg.HTML))
+	for _, a := range msg.Attachments {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64Lines(part, a.Data)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines writes data in base64 lines of 76 characters, as MIME
+// requires.
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
+
+// emailSender delivers codes, exports and campaigns as emails rendered in
+// the language of their recipient.
+type emailSender struct {
+	mailer Mailer
+}
+
+func (e emailSender) send(name string, acc *account, data any, attachments ...emailAttachment) error {
+	msg, err := renderEmail(name, accountLanguage(acc), acc, data)
+	if err != nil {
+		return err
+	}
+	msg.Attachments = attachments
+	return e.mailer.Send(msg)
+}
+
+func (e emailSender) SendOTP(acc *account, code string) error {
+	return e.send("login_code", acc, loginCodeEmail{Code: code, Minutes: int(challengeTTL.Minutes())})
+}
+
+func (e emailSender) SendExport(acc *account, search *savedSearch, filename string, data []byte) error {
+	format := strings.TrimPrefix(path.Ext(filename), ".")
+	return e.send("statement_export", acc, statementExportEmail{Name: search.Name, Filename: filename},
+		emailAttachment{Filename: filename, ContentType: exportContentTypes[format], Data: data})
+}
+
+func (e emailSender) SendCampaign(acc *account, subject, message string) error {
+	return e.send("campaign", acc, campaignEmail{Subject: subject, Message: message})
+}
+
+// EmailTemplate names a template and the languages it is written in.
+type EmailTemplate struct {
+	Name      string   `json:"name"`
+	Languages []string `json:"languages"`
+}
+
+// handleEmailTemplates lists the email templates. Like the previews, it is
+// only available in development.
+func (s *Apiserver) handleEmailTemplates(w http.ResponseWriter, r *http.Request) error {
+	if s.cfg().Environment != envDevelopment {
+		return newAPIError(http.StatusForbidden, "dev_only")
+	}
+	list := make([]EmailTemplate, 0, len(emailTemplates))
+	for name, variants := range emailTemplates {
+		t := EmailTemplate{Name: name}
+		for lang := range variants {
+			t.Languages = append(t.Languages, lang)
+		}
+		slices.Sort(t.Languages)
+		list = append(list, t)
+	}
+	slices.SortFunc(list, func(a, b EmailTemplate) int { return strings.Compare(a.Name, b.Name) })
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// handleEmailPreview renders an email template with sample data, addressed
+// to the caller, in ?lang= or the caller's language. The subject is sent in
+// the X-Email-Subject header.
+func (s *Apiserver) handleEmailPreview(w http.ResponseWriter, r *http.Request) error {
+	if s.cfg().Environment != envDevelopment {
+		return newAPIError(http.StatusForbidden, "dev_only")
+	}
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = accountLanguage(acc)
+	}
+	name := r.PathValue("name")
+	msg, err := renderEmail(name, lang, acc, emailPreviews[name])
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Email-Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.WriteString(w, msg.HTML)
+	return err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createMerchantDirectoryTable = `
+        CREATE TABLE IF NOT EXISTS merchant_directory (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            pattern TEXT NOT NULL,
+            name TEXT NOT NULL,
+            category TEXT NOT NULL DEFAULT '',
+            logo_url TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createLedgerEnrichmentsTable = `
+        CREATE TABLE IF NOT EXISTS ledger_enrichments (
+            ledger_entry_id INT PRIMARY KEY REFERENCES ledger_entries(id) ON DELETE CASCADE,
+            counterparty TEXT NOT NULL DEFAULT '',
+            category TEXT NOT NULL DEFAULT '',
+            logo_url TEXT NOT NULL DEFAULT '',
+            enriched_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// directoryEntry maps counterparty names containing Pattern, matched
+// case-insensitively, to a clean merchant name, category and logo.
+type directoryEntry struct {
+	ID        int       `json:"id"`
+	TenantID  int       `json:"-"`
+	Pattern   string    `json:"pattern"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	LogoURL   string    `json:"logo_url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// enrichment is the readable view of a ledger entry shown in the history.
+// It is stored next to the raw entry, which is never rewritten.
+type enrichment struct {
+	EntryID      int       `json:"-"`
+	Counterparty string    `json:"counterparty"`
+	Category     string    `json:"category"`
+	LogoURL      string    `json:"logo_url,omitempty"`
+	EnrichedAt   time.Time `json:"enriched_at"`
+}
+
+type DirectoryEntryRequest struct {
+	Pattern  string `json:"pattern"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	LogoURL  string `json:"logo_url"`
+}
+
+// EnrichmentStorage holds the transaction enrichment storage operations.
+type EnrichmentStorage interface {
+	CreateDirectoryEntry(*directoryEntry) error
+	GetMerchantDirectory(tenantID int) ([]*directoryEntry, error)
+	DeleteDirectoryEntry(tenantID, id int) error
+	GetCounterparties(entryIDs []int) (map[int]string, error)
+	SaveEnrichments(...*enrichment) error
+}
+
+// kindCategories is the category of entries no directory entry matches.
+var kindCategories = map[string]string{
+	entryTransferIn:  "transfers",
+	entryTransferOut: "transfers",
+	entryClaimHold:   "transfers",
+	entryClaimPayout: "transfers",
+	entryClaimReturn: "transfers",
+	entryDeposit:     "income",
+	entryWithdrawal:  "cash",
+	entryCashHold:    "cash",
+	entryCashRelease: "cash",
+	entryRoundUpOut:  "savings",
+	entryRoundUpIn:   "savings",
+	entryFee:         "fees",
+}
+
+const defaultCategory = "other"
+
+var (
+	counterpartyPrefix    = regexp.MustCompile(`(?i)^(?:(?:pos|card|purchase)\s+|[a-z]{0,3}\s*\*\s*)+`)
+	counterpartyReference = regexp.MustCompile(`(\s+#?\d[\d-]*|\s*#\d[\d-]*)$`)
+)
+
+// normalizeCounterparty turns a raw name like "POS *ACME COFFEE #1234" into
+// "Acme Coffee": payment prefixes and trailing reference numbers are
+// dropped, spacing collapsed and the words title-cased.
+func normalizeCounterparty(raw string) string {
+	name := strings.TrimSpace(raw)
+	name = counterpartyPrefix.ReplaceAllString(name, "")
+	name = counterpartyReference.ReplaceAllString(name, "")
+	words := strings.Fields(name)
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + strings.ToLower(w[1:])
+	}
+	return strings.Join(words, " ")
+}
+
+// enrichEntry runs the pipeline on one entry: the counterparty of its
+// transfer, or failing that its description, is normalized and looked up in
+// the directory, falling back to a category by entry kind.
+func enrichEntry(e *ledgerEntry, counterparty string, directory []*directoryEntry) *enrichment {
+	raw := cmp.Or(counterparty, e.Description)
+	en := &enrichment{EntryID: e.ID, Counterparty: normalizeCounterparty(raw), Category: kindCategories[e.Kind], EnrichedAt: clock.Now()}
+	for _, d := range directory {
+		pattern := strings.ToLower(d.Pattern)
+		if strings.Contains(strings.ToLower(raw), pattern) || strings.Contains(strings.ToLower(en.Counterparty), pattern) {
+			en.Counterparty, en.LogoURL = d.Name, d.LogoURL
+			if d.Category != "" {
+				en.Category = d.Category
+			}
+			break
+		}
+	}
+	if en.Category == "" {
+		en.Category = defaultCategory
+	}
+	return en
+}
+
+// enrich fills in the enrichment of the entries that have none yet and
+// stores it, so each entry goes through the pipeline once until the
+// directory changes.
+func (s *Apiserver) enrich(tenantID int, entries []*ledgerEntry) error {
+	var ids []int
+	for _, e := range entries {
+		if e.Enrichment == nil {
+			ids = append(ids, e.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	counterparties, err := s.store.GetCounterparties(ids)
+	if err != nil {
+		return err
+	}
+	directory, err := s.store.GetMerchantDirectory(tenantID)
+	if err != nil {
+		return err
+	}
+	var enriched []*enrichment
+	for _, e := range entries {
+		if e.Enrichment == nil {
+			e.Enrichment = enrichEntry(e, counterparties[e.ID], directory)
+			enriched = append(enriched, e.Enrichment)
+		}
+	}
+	return s.store.SaveEnrichments(enriched...)
+}
+
+// CreateDirectoryEntry adds an entry to a tenant's merchant directory and
+// clears the tenant's stored enrichments so they are recomputed with it.
+func (s *PostgresStorage) CreateDirectoryEntry(d *directoryEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO merchant_directory (tenant_id, pattern, name, category, logo_url) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		d.TenantID, d.Pattern, d.Name, d.Category, d.LogoURL,
+	).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := clearEnrichments(tx, d.TenantID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetMerchantDirectory lists a tenant's merchant directory in match order.
+func (s *PostgresStorage) GetMerchantDirectory(tenantID int) ([]*directoryEntry, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, pattern, name, category, logo_url, created_at FROM merchant_directory WHERE tenant_id = $1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	directory := make([]*directoryEntry, 0)
+	for rows.Next() {
+		d := &directoryEntry{}
+		if err := rows.Scan(&d.ID, &d.TenantID, &d.Pattern, &d.Name, &d.Category, &d.LogoURL, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		directory = append(directory, d)
+	}
+	return directory, rows.Err()
+}
+
+// DeleteDirectoryEntry removes an entry from a tenant's merchant directory
+// and clears the tenant's stored enrichments.
+func (s *PostgresStorage) DeleteDirectoryEntry(tenantID, id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM merchant_directory WHERE id = $1 AND tenant_id = $2", id, tenantID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := clearEnrichments(tx, tenantID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func clearEnrichments(tx *sql.Tx, tenantID int) error {
+	_, err := tx.Exec(`
+        DELETE FROM ledger_enrichments le USING ledger_entries e, accounts a
+        WHERE le.ledger_entry_id = e.id AND e.account_id = a.id AND a.tenant_id = $1`,
+		tenantID,
+	)
+	return err
+}
+
+// GetCounterparties returns the raw name of the other party of the transfer
+// behind each of the entries, keyed by entry. A merchant is named by its
+// merchant name rather than its account holder's.
+func (s *PostgresStorage) GetCounterparties(entryIDs []int) (map[int]string, error) {
+	rows, err := s.db.Query(`
+        SELECT e.id, COALESCE(m.name, a.name, '')
+        FROM ledger_entries e
+        JOIN transfers t ON t.reference = e.reference
+        JOIN accounts a ON a.id = CASE WHEN t.from_account_id = e.account_id THEN t.to_account_id ELSE t.from_account_id END
+        LEFT JOIN merchants m ON m.account_id = a.id
+        WHERE e.id = ANY($1) AND e.kind IN ($2, $3)`,
+		pq.Array(entryIDs), entryTransferIn, entryTransferOut,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// SaveEnrichments stores the enrichments, replacing any existing ones.
+func (s *PostgresStorage) SaveEnrichments(enrichments ...*enrichment) error {
+	for _, en := range enrichments {
+		_, err := s.db.Exec(`
+            INSERT INTO ledger_enrichments (ledger_entry_id, counterparty, category, logo_url, enriched_at) VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (ledger_entry_id) DO UPDATE SET counterparty = $2, category = $3, logo_url = $4, enriched_at = $5`,
+			en.EntryID, en.Counterparty, en.Category, en.LogoURL, en.EnrichedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleMerchantDirectory lists the tenant's merchant directory (GET) or
+// adds an entry to it (POST).
+func (s *Apiserver) handleMerchantDirectory(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		directory, err := s.store.GetMerchantDirectory(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, directory)
+	}
+
+	req := DirectoryEntryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	d := &directoryEntry{
+		TenantID: tenantID,
+		Pattern:  strings.TrimSpace(req.Pattern),
+		Name:     strings.TrimSpace(req.Name),
+		Category: strings.ToLower(strings.TrimSpace(req.Category)),
+		LogoURL:  strings.TrimSpace(req.LogoURL),
+	}
+	if d.Pattern == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "pattern")
+	}
+	if d.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if err := s.store.CreateDirectoryEntry(d); err != nil {
+		return err
+	}
+	s.audit(r, "merchant_directory.added", "merchant_directory", d.ID, d)
+	return writeJSON(w, http.StatusCreated, d)
+}
+
+// handleDeleteDirectoryEntry removes an entry from the tenant's merchant
+// directory.
+func (s *Apiserver) handleDeleteDirectoryEntry(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteDirectoryEntry(requestTenant(r).ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "directory_entry_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "merchant_directory.removed", "merchant_directory", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
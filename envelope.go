@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries the ID of a request. Clients may send their own,
+// otherwise one is generated; either way it is echoed in the response
+// header and body so support can trace a request across logs.
+const requestIDHeader = "X-Request-ID"
+
+// envelope is the body of every successful response. Single resources only
+// fill Data; list endpoints also fill Pagination.
+type envelope struct {
+	Data       any         `json:"data"`
+	Pagination *pagination `json:"pagination,omitempty"`
+	RequestID  string      `json:"request_id,omitempty"`
+}
+
+type pagination struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	Total      int    `json:"total"`
+}
+
+// requestIDMiddleware assigns every request an ID.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, withRequestContext(r, newRequestContext(r, id)))
+	})
+}
+
+// validRequestID accepts client IDs of up to 64 printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
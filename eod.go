@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const createLedgerDaysTable = `
+        CREATE TABLE IF NOT EXISTS ledger_days (
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            day DATE NOT NULL,
+            accounts INT NOT NULL DEFAULT 0,
+            entries INT NOT NULL DEFAULT 0,
+            credits BIGINT NOT NULL DEFAULT 0,
+            debits BIGINT NOT NULL DEFAULT 0,
+            closed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (tenant_id, day)
+        )
+    `
+
+const createDailyAccountTotalsTable = `
+        CREATE TABLE IF NOT EXISTS daily_account_totals (
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            day DATE NOT NULL,
+            entries INT NOT NULL,
+            credits INT NOT NULL,
+            debits INT NOT NULL,
+            closing_balance INT NOT NULL,
+            PRIMARY KEY (account_id, day)
+        )
+    `
+
+var (
+	errDayClosed        = errors.New("ledger day is closed")
+	errDayAlreadyClosed = errors.New("ledger day has already been closed")
+)
+
+// ledgerDay is a closed day (UTC) of a tenant's ledger. Once closed, no
+// entry can be posted into it.
+type ledgerDay struct {
+	TenantID int       `json:"tenant_id"`
+	Day      string    `json:"day"`
+	Accounts int       `json:"accounts"`
+	Entries  int       `json:"entries"`
+	Credits  int64     `json:"credits"`
+	Debits   int64     `json:"debits"`
+	ClosedAt time.Time `json:"closed_at"`
+}
+
+// EODStatus is the end-of-day state of a tenant's ledger.
+type EODStatus struct {
+	LastClosedDay string       `json:"last_closed_day,omitempty"`
+	OpenDay       string       `json:"open_day"`
+	Days          []*ledgerDay `json:"days"`
+}
+
+// EODStorage holds the end-of-day storage operations.
+type EODStorage interface {
+	CloseLedgerDay(tenantID int, day time.Time) (*ledgerDay, error)
+	GetLedgerDays(tenantID, limit int) ([]*ledgerDay, error)
+}
+
+// CloseLedgerDay totals each account's entries of a day and closes the day.
+// It holds off new postings while it runs, so transactions that started
+// before midnight either land in the totals or fail with errDayClosed.
+func (s *PostgresStorage) CloseLedgerDay(tenantID int, day time.Time) (*ledgerDay, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("LOCK TABLE ledger_entries IN SHARE MODE"); err != nil {
+		return nil, err
+	}
+	d := &ledgerDay{TenantID: tenantID, Day: day.Format(time.DateOnly)}
+	err = tx.QueryRow("INSERT INTO ledger_days (tenant_id, day) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING closed_at", tenantID, d.Day).Scan(&d.ClosedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errDayAlreadyClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO daily_account_totals (account_id, day, entries, credits, debits, closing_balance)
+        SELECT l.account_id, $2, COUNT(*),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.amount > 0), 0),
+            COALESCE(-SUM(l.amount) FILTER (WHERE l.amount < 0), 0),
+            (array_agg(l.balance_after ORDER BY l.id DESC))[1]
+        FROM ledger_entries l JOIN accounts a ON a.id = l.account_id
+        WHERE a.tenant_id = $1 AND l.created_at >= $3 AND l.created_at < $4
+        GROUP BY l.account_id`,
+		tenantID, d.Day, day, day.AddDate(0, 0, 1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`
+        UPDATE ledger_days SET (accounts, entries, credits, debits) = (
+            SELECT COUNT(*), COALESCE(SUM(t.entries), 0), COALESCE(SUM(t.credits), 0), COALESCE(SUM(t.debits), 0)
+            FROM daily_account_totals t JOIN accounts a ON a.id = t.account_id
+            WHERE a.tenant_id = $1 AND t.day = $2
+        ) WHERE tenant_id = $1 AND day = $2
+        RETURNING accounts, entries, credits, debits`,
+		tenantID, d.Day,
+	).Scan(&d.Accounts, &d.Entries, &d.Credits, &d.Debits)
+	if err != nil {
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+// GetLedgerDays returns the most recently closed days of a tenant.
+func (s *PostgresStorage) GetLedgerDays(tenantID, limit int) ([]*ledgerDay, error) {
+	rows, err := s.db.Query("SELECT tenant_id, to_char(day, 'YYYY-MM-DD'), accounts, entries, credits, debits, closed_at FROM ledger_days WHERE tenant_id = $1 ORDER BY day DESC LIMIT $2", tenantID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make([]*ledgerDay, 0)
+	for rows.Next() {
+		d := &ledgerDay{}
+		if err := rows.Scan(&d.TenantID, &d.Day, &d.Accounts, &d.Entries, &d.Credits, &d.Debits, &d.ClosedAt); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// closeLedgerDays closes every day of a tenant from the one after the last
+// closed day up to yesterday (UTC). A tenant that never closed a day starts
+// with yesterday.
+func (s *Apiserver) closeLedgerDays(tenantID int) ([]*ledgerDay, error) {
+	today := clock.Now().UTC().Truncate(24 * time.Hour)
+	day := today.AddDate(0, 0, -1)
+	last, err := s.store.GetLedgerDays(tenantID, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(last) > 0 {
+		lastDay, err := time.Parse(time.DateOnly, last[0].Day)
+		if err != nil {
+			return nil, err
+		}
+		day = lastDay.AddDate(0, 0, 1)
+	}
+
+	closed := make([]*ledgerDay, 0)
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		d, err := s.store.CloseLedgerDay(tenantID, day)
+		if errors.Is(err, errDayAlreadyClosed) {
+			continue
+		}
+		if err != nil {
+			return closed, err
+		}
+		closed = append(closed, d)
+	}
+	return closed, nil
+}
+
+// runEndOfDay closes the past days of every tenant and archives them.
+func (s *Apiserver) runEndOfDay() {
+	tenants, err := s.store.GetTenants()
+	if err != nil {
+		logf("end of day: failed to load tenants: %v\n", err)
+		return
+	}
+	for _, t := range tenants {
+		if _, err := s.closeLedgerDays(t.ID); err != nil {
+			logf("end of day: tenant %s failed: %v\n", t.Slug, err)
+		}
+		if _, err := s.archiveClosedPeriods(t.ID); err != nil {
+			logf("end of day: archiving tenant %s failed: %v\n", t.Slug, err)
+		}
+	}
+}
+
+// startEndOfDayJob checks for days to close in the background on a fixed
+// interval. A zero interval disables the job.
+func (s *Apiserver) startEndOfDayJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.pausedForReadOnly("end of day") {
+				continue
+			}
+			s.runEndOfDay()
+		}
+	}()
+}
+
+// handleEndOfDay returns the end-of-day status of the caller's tenant (GET)
+// or closes and archives its past days right away (POST).
+func (s *Apiserver) handleEndOfDay(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "POST" {
+		closed, err := s.closeLedgerDays(tenantID)
+		if err != nil {
+			return err
+		}
+		for _, d := range closed {
+			s.audit(r, "ledger_day.closed", "tenant", tenantID, d)
+		}
+		archives, err := s.archiveClosedPeriods(tenantID)
+		for _, a := range archives {
+			s.audit(r, "ledger_archive.created", "tenant", tenantID, a)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	status, err := s.eodStatus(tenantID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, status)
+}
+
+// eodStatus returns the open day and the last 30 closed days of a tenant.
+func (s *Apiserver) eodStatus(tenantID int) (*EODStatus, error) {
+	days, err := s.store.GetLedgerDays(tenantID, 30)
+	if err != nil {
+		return nil, err
+	}
+	status := &EODStatus{OpenDay: clock.Now().UTC().Format(time.DateOnly), Days: days}
+	if len(days) > 0 {
+		status.LastClosedDay = days[0].Day
+	}
+	return status, nil
+}
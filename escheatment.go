@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const createEscheatmentsTable = `
+        CREATE TABLE IF NOT EXISTS escheatments (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT NOT NULL REFERENCES accounts(id),
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'escheated',
+            note TEXT NOT NULL DEFAULT '',
+            escheated_by INT NOT NULL REFERENCES accounts(id),
+            ledger_entry_id INT NOT NULL REFERENCES ledger_entries(id),
+            reclaim_requested_at TIMESTAMPTZ,
+            reclaimed_by INT REFERENCES accounts(id),
+            reclaim_entry_id INT REFERENCES ledger_entries(id),
+            reclaimed_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Ledger entry kinds of escheatment. The balance of a long dormant account
+// is moved to the unclaimed funds GL account, where it stays owed to the
+// holder until they reclaim it.
+const (
+	entryEscheat = "escheat"
+	entryReclaim = "escheat_reclaim"
+)
+
+const (
+	escheatmentEscheated        = "escheated"
+	escheatmentReclaimRequested = "reclaim_requested"
+	escheatmentReclaimed        = "reclaimed"
+)
+
+var (
+	errNotEscheatable     = errors.New("account has not been dormant long enough")
+	errNothingToEscheat   = errors.New("account has no balance to escheat")
+	errEscheatmentDecided = errors.New("escheated funds have already been reclaimed")
+)
+
+// escheatment is the balance of a dormant account moved to unclaimed funds.
+type escheatment struct {
+	ID                 int        `json:"id"`
+	TenantID           int        `json:"tenant_id"`
+	AccountID          int        `json:"account_id"`
+	Amount             int        `json:"amount"`
+	Currency           string     `json:"currency"`
+	Status             string     `json:"status"`
+	Note               string     `json:"note"`
+	EscheatedBy        int        `json:"escheated_by"`
+	LedgerEntryID      int        `json:"ledger_entry_id"`
+	ReclaimRequestedAt *time.Time `json:"reclaim_requested_at,omitempty"`
+	ReclaimedBy        *int       `json:"reclaimed_by,omitempty"`
+	ReclaimEntryID     *int       `json:"reclaim_entry_id,omitempty"`
+	ReclaimedAt        *time.Time `json:"reclaimed_at,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+type EscheatRequest struct {
+	AccountID int    `json:"account_id"`
+	Note      string `json:"note"`
+}
+
+// EscheatmentStorage holds the unclaimed funds storage operations.
+type EscheatmentStorage interface {
+	GetEscheatableAccounts(tenantID int, dormantBefore time.Time) ([]*account, error)
+	Escheat(e *escheatment, dormantBefore time.Time) error
+	GetEscheatment(tenantID, id int) (*escheatment, error)
+	GetEscheatments(tenantID int, status string) ([]*escheatment, error)
+	GetAccountEscheatments(accountID int) ([]*escheatment, error)
+	RequestReclaim(accountID, id int) (*escheatment, error)
+	Reclaim(tenantID, id, adminID int) (*escheatment, error)
+}
+
+// GetEscheatableAccounts lists the tenant's accounts dormant since before
+// the given time that still hold money.
+func (s *PostgresStorage) GetEscheatableAccounts(tenantID int, dormantBefore time.Time) ([]*account, error) {
+	rows, err := s.db.Query(
+		"SELECT id, tenant_id, name, number, balance, currency, dormant_at FROM accounts WHERE tenant_id = $1 AND dormant_at < $2 AND balance > 0 ORDER BY dormant_at, id",
+		tenantID, dormantBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*account, 0)
+	for rows.Next() {
+		a := &account{}
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.Name, &a.Number, &a.Balance, &a.Currency, &a.DormantAt); err != nil {
+			return nil, err
+		}
+		a.Dormant = true
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// Escheat moves the whole balance of an account dormant since before the
+// given time to unclaimed funds, recording the escheatment with its
+// ledger entry in one transaction.
+func (s *PostgresStorage) Escheat(e *escheatment, dormantBefore time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var dormantAt sql.NullTime
+	err = tx.QueryRow("SELECT balance, currency, dormant_at FROM accounts WHERE id = $1 AND tenant_id = $2 FOR UPDATE", e.AccountID, e.TenantID).
+		Scan(&e.Amount, &e.Currency, &dormantAt)
+	if err != nil {
+		return err
+	}
+	if !dormantAt.Valid || !dormantAt.Time.Before(dormantBefore) {
+		return errNotEscheatable
+	}
+	if e.Amount <= 0 {
+		return errNothingToEscheat
+	}
+
+	entry := &ledgerEntry{AccountID: e.AccountID, Amount: -e.Amount, Kind: entryEscheat, Description: "Transferred to unclaimed funds"}
+	if err := postEntries(tx, entry); err != nil {
+		return err
+	}
+	e.LedgerEntryID = entry.ID
+	err = tx.QueryRow(`
+        INSERT INTO escheatments (tenant_id, account_id, amount, currency, note, escheated_by, ledger_entry_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, status, created_at`,
+		e.TenantID, e.AccountID, e.Amount, e.Currency, e.Note, e.EscheatedBy, e.LedgerEntryID,
+	).Scan(&e.ID, &e.Status, &e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const selectEscheatments = `
+    SELECT id, tenant_id, account_id, amount, currency, status, note, escheated_by, ledger_entry_id,
+        reclaim_requested_at, reclaimed_by, reclaim_entry_id, reclaimed_at, created_at
+    FROM escheatments `
+
+func scanEscheatment(row interface{ Scan(...any) error }) (*escheatment, error) {
+	e := &escheatment{}
+	err := row.Scan(&e.ID, &e.TenantID, &e.AccountID, &e.Amount, &e.Currency, &e.Status, &e.Note, &e.EscheatedBy, &e.LedgerEntryID,
+		&e.ReclaimRequestedAt, &e.ReclaimedBy, &e.ReclaimEntryID, &e.ReclaimedAt, &e.CreatedAt)
+	return e, err
+}
+
+func (s *PostgresStorage) queryEscheatments(where string, args ...any) ([]*escheatment, error) {
+	rows, err := s.db.Query(selectEscheatments+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	escheatments := make([]*escheatment, 0)
+	for rows.Next() {
+		e, err := scanEscheatment(rows)
+		if err != nil {
+			return nil, err
+		}
+		escheatments = append(escheatments, e)
+	}
+	return escheatments, rows.Err()
+}
+
+// GetEscheatment retrieves an escheatment of a tenant.
+func (s *PostgresStorage) GetEscheatment(tenantID, id int) (*escheatment, error) {
+	return scanEscheatment(s.db.QueryRow(selectEscheatments+"WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+// GetEscheatments lists the tenant's escheatments, newest first, optionally
+// only those with a status.
+func (s *PostgresStorage) GetEscheatments(tenantID int, status string) ([]*escheatment, error) {
+	return s.queryEscheatments("WHERE tenant_id = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC", tenantID, status)
+}
+
+// GetAccountEscheatments lists an account's escheatments, newest first.
+func (s *PostgresStorage) GetAccountEscheatments(accountID int) ([]*escheatment, error) {
+	return s.queryEscheatments("WHERE account_id = $1 ORDER BY id DESC", accountID)
+}
+
+// RequestReclaim records that the holder of an account asks for its
+// escheated funds back.
+func (s *PostgresStorage) RequestReclaim(accountID, id int) (*escheatment, error) {
+	e, err := scanEscheatment(s.db.QueryRow(`
+        UPDATE escheatments SET status = $1, reclaim_requested_at = now()
+        WHERE id = $2 AND account_id = $3 AND status = $4
+        RETURNING id, tenant_id, account_id, amount, currency, status, note, escheated_by, ledger_entry_id,
+            reclaim_requested_at, reclaimed_by, reclaim_entry_id, reclaimed_at, created_at`,
+		escheatmentReclaimRequested, id, accountID, escheatmentEscheated))
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := scanEscheatment(s.db.QueryRow(selectEscheatments+"WHERE id = $1 AND account_id = $2", id, accountID)); err != nil {
+			return nil, err
+		}
+		return nil, errEscheatmentDecided
+	}
+	return e, err
+}
+
+// Reclaim pays escheated funds back into the account they came from.
+func (s *PostgresStorage) Reclaim(tenantID, id, adminID int) (*escheatment, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	e, err := scanEscheatment(tx.QueryRow(selectEscheatments+"WHERE id = $1 AND tenant_id = $2 FOR UPDATE", id, tenantID))
+	if err != nil {
+		return nil, err
+	}
+	if e.Status == escheatmentReclaimed {
+		return nil, errEscheatmentDecided
+	}
+	entry := &ledgerEntry{AccountID: e.AccountID, Amount: e.Amount, Kind: entryReclaim, Description: "Reclaimed from unclaimed funds"}
+	if err := postEntries(tx, entry); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(
+		"UPDATE escheatments SET status = $1, reclaimed_by = $2, reclaim_entry_id = $3, reclaimed_at = now() WHERE id = $4 RETURNING reclaimed_at",
+		escheatmentReclaimed, adminID, entry.ID, id,
+	).Scan(&e.ReclaimedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.Status, e.ReclaimedBy, e.ReclaimEntryID = escheatmentReclaimed, &adminID, &entry.ID
+	return e, tx.Commit()
+}
+
+// escheatableBefore is the time accounts must have been dormant since to
+// be escheated.
+func (s *Apiserver) escheatableBefore() time.Time {
+	return clock.Now().AddDate(0, -s.cfg().EscheatmentMonths, 0)
+}
+
+// handleEscheatableAccounts lists the accounts dormant for long enough to
+// have their balance escheated.
+func (s *Apiserver) handleEscheatableAccounts(w http.ResponseWriter, r *http.Request) error {
+	accounts, err := s.store.GetEscheatableAccounts(requestTenant(r).ID, s.escheatableBefore())
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, accounts)
+}
+
+// handleEscheatments lists the tenant's escheatments (GET, ?status=) or
+// moves the balance of a long dormant account to unclaimed funds (POST).
+func (s *Apiserver) handleEscheatments(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		escheatments, err := s.store.GetEscheatments(tenantID, r.URL.Query().Get("status"))
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, escheatments)
+	}
+
+	admin, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := EscheatRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	e := &escheatment{TenantID: tenantID, AccountID: req.AccountID, Note: req.Note, EscheatedBy: admin.ID}
+	switch err := s.store.Escheat(e, s.escheatableBefore()); {
+	case errors.Is(err, sql.ErrNoRows):
+		return newAPIError(http.StatusNotFound, "account_not_found", req.AccountID)
+	case errors.Is(err, errNotEscheatable):
+		return newAPIError(http.StatusConflict, "account_not_escheatable", req.AccountID, s.cfg().EscheatmentMonths)
+	case errors.Is(err, errNothingToEscheat):
+		return newAPIError(http.StatusConflict, "nothing_to_escheat", req.AccountID)
+	case err != nil:
+		return transferFailed(err)
+	}
+	s.audit(r, "escheatment.created", "escheatment", e.ID, e)
+	s.notify(e.AccountID, "funds_escheated", fmt.Sprintf("%s from your dormant account was transferred to unclaimed funds. You can reclaim it at any time.", formatMoney(e.Amount, e.Currency, defaultLocale)))
+	return writeJSON(w, http.StatusCreated, e)
+}
+
+// handleReclaimEscheatment pays escheated funds back to their account once
+// an admin has confirmed the holder's claim.
+func (s *Apiserver) handleReclaimEscheatment(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	admin, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	e, err := s.store.Reclaim(requestTenant(r).ID, id, admin.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return newAPIError(http.StatusNotFound, "escheatment_not_found", id)
+	case errors.Is(err, errEscheatmentDecided):
+		return newAPIError(http.StatusConflict, "escheatment_reclaimed", id)
+	case err != nil:
+		return transferFailed(err)
+	}
+	s.audit(r, "escheatment.reclaimed", "escheatment", e.ID, e)
+	s.notify(e.AccountID, "funds_reclaimed", fmt.Sprintf("%s was returned to your account from unclaimed funds", formatMoney(e.Amount, e.Currency, defaultLocale)))
+	return writeJSON(w, http.StatusOK, e)
+}
+
+// handleUnclaimedFunds lists the caller's escheated funds.
+func (s *Apiserver) handleUnclaimedFunds(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	escheatments, err := s.store.GetAccountEscheatments(acc.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, escheatments)
+}
+
+// handleRequestReclaim asks for escheated funds of the caller back. An
+// admin checks the claim and pays the funds out with
+// handleReclaimEscheatment.
+func (s *Apiserver) handleRequestReclaim(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	e, err := s.store.RequestReclaim(acc.ID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return newAPIError(http.StatusNotFound, "escheatment_not_found", id)
+	case errors.Is(err, errEscheatmentDecided):
+		return newAPIError(http.StatusConflict, "escheatment_reclaimed", id)
+	case err != nil:
+		return err
+	}
+	s.audit(r, "escheatment.reclaim_requested", "escheatment", e.ID, nil)
+	return writeJSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxExternalIDLength bounds the identifiers upstream systems key accounts by.
+const maxExternalIDLength = 100
+
+var errEmailTaken = errors.New("email already used by another account")
+
+// UpsertAccountRequest is the state of an account in an upstream system.
+// Currency only applies when the account is created.
+type UpsertAccountRequest struct {
+	Email    string `json:"email"`
+	Phone    string `json:"phone,omitempty"`
+	Name     string `json:"name"`
+	Number   string `json:"number"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// ExternalIDStorage holds the storage operations on accounts keyed by an
+// upstream system's identifier.
+type ExternalIDStorage interface {
+	UpsertAccountByExternalID(a *account) (created bool, err error)
+}
+
+// UpsertAccountByExternalID creates the tenant's account with a's external
+// ID or updates its email, phone, name and number, and fills in a from
+// the stored account. It returns errEmailTaken if another account of the
+// tenant has the email.
+func (s *PostgresStorage) UpsertAccountByExternalID(a *account) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM accounts WHERE tenant_id = $1 AND email = $2 AND external_id IS DISTINCT FROM $3)",
+		a.TenantID, a.Email, a.ExternalID,
+	).Scan(&taken)
+	if err != nil {
+		return false, err
+	}
+	if taken {
+		return false, errEmailTaken
+	}
+
+	// xmax is zero for freshly inserted rows and set for updated ones.
+	var created bool
+	err = tx.QueryRow(`
+        INSERT INTO accounts (tenant_id, external_id, email, phone, password, name, number, balance, role, currency)
+        VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, 0, $8, $9)
+        ON CONFLICT (tenant_id, external_id) WHERE external_id IS NOT NULL
+        DO UPDATE SET email = EXCLUDED.email, phone = EXCLUDED.phone, name = EXCLUDED.name, number = EXCLUDED.number
+        RETURNING id, balance, role, currency, dormant_at, xmax = 0`,
+		a.TenantID, a.ExternalID, a.Email, a.Phone, a.Password, a.Name, a.Number, a.Role, a.Currency,
+	).Scan(&a.ID, &a.Balance, &a.Role, &a.Currency, &a.DormantAt, &created)
+	if err != nil {
+		return false, err
+	}
+	a.Dormant = a.DormantAt != nil
+	return created, tx.Commit()
+}
+
+// handleUpsertAccountByExternalID creates or updates the account an
+// upstream system knows by the external ID in the path, so the system can
+// push its customers repeatedly without creating duplicates. Created
+// accounts get a random password nobody knows, as their holders sign in
+// through the upstream system's own onboarding.
+func (s *Apiserver) handleUpsertAccountByExternalID(w http.ResponseWriter, r *http.Request) error {
+	externalID := strings.TrimSpace(r.PathValue("externalID"))
+	if externalID == "" || len(externalID) > maxExternalIDLength {
+		return newAPIError(http.StatusBadRequest, "invalid_external_id", externalID)
+	}
+	req := UpsertAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "email")
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(b)), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	acc := &account{TenantID: requestTenant(r).ID, ExternalID: externalID, Email: req.Email, Password: string(hash), Name: req.Name, Number: req.Number, Role: roleCustomer, Currency: defaultCurrency}
+	if req.Phone != "" {
+		phone, ok := normalizeContact(req.Phone)
+		if !ok || strings.Contains(phone, "@") {
+			return newAPIError(http.StatusBadRequest, "invalid_phone", req.Phone)
+		}
+		acc.Phone = phone
+	}
+	if req.Currency != "" {
+		if _, ok := currencies[req.Currency]; !ok {
+			return newAPIError(http.StatusBadRequest, "unsupported_currency", req.Currency)
+		}
+		acc.Currency = req.Currency
+	}
+
+	created, err := s.store.UpsertAccountByExternalID(acc)
+	if errors.Is(err, errEmailTaken) {
+		return newAPIError(http.StatusConflict, "email_taken", acc.Email)
+	} else if err != nil {
+		return err
+	}
+	acc.Password = ""
+	profile := accountProfile{Email: acc.Email, Name: acc.Name, Number: acc.Number, Role: acc.Role, Currency: acc.Currency}
+	if !created {
+		s.audit(r, "account.synced", "account", acc.ID, profile)
+		return s.writeLocalizedJSON(w, r, http.StatusOK, acc)
+	}
+	s.audit(r, "account.created", "account", acc.ID, profile)
+	s.screenAccount(acc)
+	return s.writeLocalizedJSON(w, r, http.StatusCreated, acc)
+}
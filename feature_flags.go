@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const createFeatureFlagsTable = `
+        CREATE TABLE IF NOT EXISTS feature_flags (
+            name TEXT PRIMARY KEY,
+            enabled BOOLEAN NOT NULL DEFAULT true,
+            message TEXT NOT NULL DEFAULT '',
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Known feature names. Endpoints guarded by a flag stay enabled until a row
+// switches them off.
+const (
+	featureTransfers       = "transfers"
+	featureAccountCreation = "account_creation"
+	featureSupportTickets  = "support_tickets"
+	// featureWrites is switched off by read-only mode; see isReadOnly.
+	featureWrites = "writes"
+)
+
+// flagRefreshInterval bounds how stale the cache can get when another
+// instance toggles a flag.
+const flagRefreshInterval = 30 * time.Second
+
+// featureFlag is a runtime switch for a feature.
+type featureFlag struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	Message   string    `json:"message"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SetFeatureFlagRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// FeatureFlagError is the payload returned when a disabled feature is called.
+type FeatureFlagError struct {
+	Error     string `json:"error"`
+	Feature   string `json:"feature"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// FeatureFlagStorage holds the feature flag storage operations.
+type FeatureFlagStorage interface {
+	GetFeatureFlags() ([]*featureFlag, error)
+	SetFeatureFlag(*featureFlag) error
+}
+
+// GetFeatureFlags returns every stored flag.
+func (s *PostgresStorage) GetFeatureFlags() ([]*featureFlag, error) {
+	rows, err := s.db.Query("SELECT name, enabled, message, updated_at FROM feature_flags ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := make([]*featureFlag, 0)
+	for rows.Next() {
+		f := &featureFlag{}
+		if err := rows.Scan(&f.Name, &f.Enabled, &f.Message, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		flags = append(flags, f)
+	}
+	return flags, rows.Err()
+}
+
+// SetFeatureFlag creates or updates a flag.
+func (s *PostgresStorage) SetFeatureFlag(f *featureFlag) error {
+	return s.db.QueryRow(`
+        INSERT INTO feature_flags (name, enabled, message) VALUES ($1, $2, $3)
+        ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, message = EXCLUDED.message, updated_at = now()
+        RETURNING updated_at`,
+		f.Name, f.Enabled, f.Message,
+	).Scan(&f.UpdatedAt)
+}
+
+// featureFlags is an in-memory cache of the feature_flags table.
+type featureFlags struct {
+	store  FeatureFlagStorage
+	mu     sync.RWMutex
+	flags  map[string]*featureFlag
+	loaded time.Time
+}
+
+func newFeatureFlags(store FeatureFlagStorage) *featureFlags {
+	return &featureFlags{store: store, flags: map[string]*featureFlag{}}
+}
+
+// Reload replaces the cache with the current contents of the table.
+func (f *featureFlags) Reload() error {
+	flags, err := f.store.GetFeatureFlags()
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*featureFlag, len(flags))
+	for _, flag := range flags {
+		m[flag.Name] = flag
+	}
+
+	f.mu.Lock()
+	f.flags = m
+	f.loaded = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+// Get returns the flag for a feature. Unknown features are enabled.
+func (f *featureFlags) Get(name string) featureFlag {
+	f.mu.RLock()
+	stale := time.Since(f.loaded) > flagRefreshInterval
+	flag, ok := f.flags[name]
+	f.mu.RUnlock()
+
+	if stale {
+		if err := f.Reload(); err != nil {
+			logf("failed to refresh feature flags: %v\n", err)
+		} else {
+			f.mu.RLock()
+			flag, ok = f.flags[name]
+			f.mu.RUnlock()
+		}
+	}
+	if !ok {
+		return featureFlag{Name: name, Enabled: true}
+	}
+	return *flag
+}
+
+// Set persists a flag and updates the cache.
+func (f *featureFlags) Set(flag *featureFlag) error {
+	if err := f.store.SetFeatureFlag(flag); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.flags[flag.Name] = flag
+	f.mu.Unlock()
+	return nil
+}
+
+// requireFeature answers 503 while the feature is disabled.
+func (s *Apiserver) requireFeature(name string) middleware {
+	return func(next apiFunc) apiFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			flag := s.flags.Get(name)
+			if !flag.Enabled {
+				message := flag.Message
+				if message == "" {
+					message = translate(requestLanguage(r), "feature_disabled")
+				}
+				return encodeJSON(w, http.StatusServiceUnavailable, FeatureFlagError{
+					Error:     "feature disabled",
+					Feature:   name,
+					Message:   message,
+					RequestID: requestID(r),
+				})
+			}
+			return next(w, r)
+		}
+	}
+}
+
+// handleGetFeatureFlags lists all stored flags. Flags switch features off
+// for the whole deployment, so only admins of the default tenant manage
+// them.
+func (s *Apiserver) handleGetFeatureFlags(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "flags_default_only")
+	}
+	flags, err := s.store.GetFeatureFlags()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, flags)
+}
+
+// handleSetFeatureFlag turns a feature on or off at runtime.
+func (s *Apiserver) handleSetFeatureFlag(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "flags_default_only")
+	}
+	req := SetFeatureFlagRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	flag := &featureFlag{Name: r.PathValue("name"), Enabled: req.Enabled, Message: req.Message}
+	if err := s.flags.Set(flag); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, flag)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Forecast horizons accepted by ?days=, the first being the default.
+var forecastHorizons = []int{30, 60, 90}
+
+// Forecast item sources.
+const (
+	forecastSubscription = "subscription"
+	forecastRecurring    = "recurring"
+)
+
+// scheduledFlow is money the bank already knows will move on a schedule:
+// the renewals of a subscription, debited from the customer and credited to
+// the merchant. The first occurrence carries any proration.
+type scheduledFlow struct {
+	Next        time.Time
+	FirstAmount int
+	Amount      int
+	Interval    string
+	Description string
+}
+
+// forecastItem is one projected movement of the forecast.
+type forecastItem struct {
+	AccountID   int    `json:"account_id"`
+	Date        string `json:"date"`
+	Amount      int    `json:"amount"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+// forecastPoint is the projected end-of-day balance of one day.
+type forecastPoint struct {
+	Date    string `json:"date"`
+	Balance int    `json:"balance"`
+}
+
+// balanceForecast projects an account's balance a day at a time from its
+// current balance and the movements expected over the horizon.
+type balanceForecast struct {
+	AccountID       int              `json:"account_id"`
+	Currency        string           `json:"currency"`
+	Days            int              `json:"days"`
+	StartingBalance int              `json:"starting_balance"`
+	LowestBalance   int              `json:"lowest_balance"`
+	LowestOn        string           `json:"lowest_on"`
+	Items           []*forecastItem  `json:"items"`
+	Series          []*forecastPoint `json:"series"`
+}
+
+// ForecastStorage holds the balance forecast storage operations.
+type ForecastStorage interface {
+	GetScheduledFlows(accountID int) ([]*scheduledFlow, error)
+}
+
+// GetScheduledFlows lists the live subscriptions an account pays or is paid
+// by, signed from the account's side.
+func (s *PostgresStorage) GetScheduledFlows(accountID int) ([]*scheduledFlow, error) {
+	rows, err := s.db.Query(`
+        SELECT sub.next_charge_at, p.amount + sub.proration, p.amount, p.billing_interval, p.name, m.customer_account_id = $1
+        FROM subscriptions sub
+        JOIN plans p ON p.id = sub.plan_id
+        JOIN mandates m ON m.id = sub.mandate_id
+        WHERE sub.status <> $2 AND (m.customer_account_id = $1 OR m.merchant_account_id = $1)`,
+		accountID, subscriptionCancelled,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := make([]*scheduledFlow, 0)
+	for rows.Next() {
+		f := &scheduledFlow{}
+		var paying bool
+		if err := rows.Scan(&f.Next, &f.FirstAmount, &f.Amount, &f.Interval, &f.Description, &paying); err != nil {
+			return nil, err
+		}
+		if paying {
+			f.FirstAmount, f.Amount = -f.FirstAmount, -f.Amount
+		}
+		flows = append(flows, f)
+	}
+	return flows, rows.Err()
+}
+
+// projectedItems lists the movements expected on an account from now up to
+// until, in date order: the renewals of its subscriptions and its detected
+// recurring payments. Renewals already due are dated today.
+func (s *Apiserver) projectedItems(acc *account, now, until time.Time) ([]*forecastItem, error) {
+	items := make([]*forecastItem, 0)
+	flows, err := s.store.GetScheduledFlows(acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range flows {
+		amount := f.FirstAmount
+		for at := f.Next; at.Before(until); at = nextPeriod(at, f.Interval) {
+			if amount != 0 {
+				date := at
+				if date.Before(now) {
+					date = now
+				}
+				items = append(items, &forecastItem{AccountID: acc.ID, Date: date.UTC().Format(time.DateOnly), Amount: amount, Source: forecastSubscription, Description: f.Description})
+			}
+			amount = f.Amount
+		}
+	}
+
+	payments, err := s.recurringPayments(acc, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payments {
+		for at := p.NextAt; at.Before(until); at = nextPeriod(at, p.Interval) {
+			if at.After(now) {
+				items = append(items, &forecastItem{AccountID: acc.ID, Date: at.UTC().Format(time.DateOnly), Amount: p.Amount, Source: forecastRecurring, Description: p.Counterparty})
+			}
+		}
+	}
+	slices.SortStableFunc(items, func(a, b *forecastItem) int { return strings.Compare(a.Date, b.Date) })
+	return items, nil
+}
+
+// handleForecast projects the balance of an account over the next ?days=
+// (30, 60 or 90) from its subscriptions and the income and expenses that
+// recur in its history, returning a daily series for charting.
+func (s *Apiserver) handleForecast(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	days := forecastHorizons[0]
+	if v := r.URL.Query().Get("days"); v != "" {
+		if days, err = strconv.Atoi(v); err != nil || !slices.Contains(forecastHorizons, days) {
+			return newAPIError(http.StatusBadRequest, "invalid_forecast_days", v)
+		}
+	}
+
+	now := clock.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	until := today.AddDate(0, 0, days+1)
+	items, err := s.projectedItems(acc, now, until)
+	if err != nil {
+		return err
+	}
+
+	f := &balanceForecast{AccountID: acc.ID, Currency: acc.Currency, Days: days, StartingBalance: acc.Balance, LowestBalance: acc.Balance, LowestOn: today.Format(time.DateOnly), Items: items}
+	balance, next := acc.Balance, 0
+	for d := 0; d <= days; d++ {
+		date := today.AddDate(0, 0, d).Format(time.DateOnly)
+		for ; next < len(items) && items[next].Date <= date; next++ {
+			balance += items[next].Amount
+		}
+		f.Series = append(f.Series, &forecastPoint{Date: date, Balance: balance})
+		if balance < f.LowestBalance {
+			f.LowestBalance, f.LowestOn = balance, date
+		}
+	}
+	return writeJSON(w, http.StatusOK, f)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const createFundsChecksTable = `
+        CREATE TABLE IF NOT EXISTS ob_funds_checks (
+            id SERIAL PRIMARY KEY,
+            consent_id INT NOT NULL REFERENCES ob_consents(id) ON DELETE CASCADE,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL,
+            funds_available BOOLEAN NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// maxFundsChecks caps the funds checks of a consent on one account in a
+// day. Without it a third party could bisect the amount to learn the
+// balance the answer is meant to hide.
+const maxFundsChecks = 10
+
+// fundsConfirmation answers whether an account could pay an amount right
+// now, without telling how much it holds.
+type fundsConfirmation struct {
+	AccountID      int       `json:"account_id"`
+	Amount         int       `json:"amount"`
+	Currency       string    `json:"currency"`
+	FundsAvailable bool      `json:"funds_available"`
+	At             time.Time `json:"at"`
+}
+
+// FundsCheckStorage holds the storage operations behind funds checks.
+type FundsCheckStorage interface {
+	// GetSpendableFunds is what a debit of the account may take: its
+	// balance less its pots plus its overdraft limit, as postEntries
+	// enforces.
+	GetSpendableFunds(accountID int) (int, error)
+	RecordFundsCheck(consentID int, f *fundsConfirmation) error
+	CountFundsChecks(consentID, accountID int, since time.Time) (int, error)
+}
+
+func (s *PostgresStorage) GetSpendableFunds(accountID int) (int, error) {
+	var funds int
+	err := s.db.QueryRow(`
+        SELECT balance - (SELECT COALESCE(SUM(balance), 0) FROM pots WHERE account_id = $1) + overdraft_limit
+        FROM accounts WHERE id = $1`,
+		accountID,
+	).Scan(&funds)
+	return funds, err
+}
+
+// RecordFundsCheck keeps a funds check, counted towards the daily limit.
+func (s *PostgresStorage) RecordFundsCheck(consentID int, f *fundsConfirmation) error {
+	_, err := s.db.Exec(
+		"INSERT INTO ob_funds_checks (consent_id, account_id, amount, funds_available, created_at) VALUES ($1, $2, $3, $4, $5)",
+		consentID, f.AccountID, f.Amount, f.FundsAvailable, f.At,
+	)
+	return err
+}
+
+// CountFundsChecks counts the funds checks of a consent on an account since
+// the given time.
+func (s *PostgresStorage) CountFundsChecks(consentID, accountID int, since time.Time) (int, error) {
+	return s.count("SELECT COUNT(*) FROM ob_funds_checks WHERE consent_id = $1 AND account_id = $2 AND created_at >= $3", consentID, accountID, since)
+}
+
+// handleOBFundsConfirmation tells a third party, such as a merchant about to
+// take a payment, whether an account the consent covers has the ?amount=
+// available, counting its overdraft and leaving out its pots.
+func (s *Apiserver) handleOBFundsConfirmation(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.consentAccount(r)
+	if err != nil {
+		return err
+	}
+	amount, err := strconv.Atoi(r.URL.Query().Get("amount"))
+	if err != nil || amount <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if currency := r.URL.Query().Get("currency"); currency != "" && currency != acc.Currency {
+		return newAPIError(http.StatusBadRequest, "unsupported_currency", currency)
+	}
+	c := requestConsent(r)
+	now := clock.Now()
+	checks, err := s.store.CountFundsChecks(c.ID, acc.ID, now.Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	if checks >= maxFundsChecks {
+		return newAPIError(http.StatusTooManyRequests, "funds_check_limit", maxFundsChecks)
+	}
+	funds, err := s.store.GetSpendableFunds(acc.ID)
+	if err != nil {
+		return err
+	}
+	f := &fundsConfirmation{AccountID: acc.ID, Amount: amount, Currency: acc.Currency, FundsAvailable: funds >= amount, At: now}
+	if err := s.store.RecordFundsCheck(c.ID, f); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, f)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createFXRatesTable = `
+        CREATE TABLE IF NOT EXISTS fx_rates (
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            currency TEXT NOT NULL,
+            base TEXT NOT NULL,
+            rate NUMERIC NOT NULL CHECK (rate > 0),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (tenant_id, currency, base)
+        )
+    `
+
+// fxRate is how many units of Base one unit of Currency is worth, set by
+// the tenant's admins. Rates are only used to show balances in a common
+// currency; no money is exchanged at them.
+type fxRate struct {
+	Currency  string    `json:"currency"`
+	Base      string    `json:"base"`
+	Rate      float64   `json:"rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FXStorage holds the exchange rate storage operations.
+type FXStorage interface {
+	SetFXRate(tenantID int, rate *fxRate) error
+	GetFXRates(tenantID int) ([]*fxRate, error)
+}
+
+// SetFXRate adds or replaces one of a tenant's exchange rates.
+func (s *PostgresStorage) SetFXRate(tenantID int, rate *fxRate) error {
+	return s.db.QueryRow(`
+        INSERT INTO fx_rates (tenant_id, currency, base, rate, updated_at) VALUES ($1, $2, $3, $4, now())
+        ON CONFLICT (tenant_id, currency, base) DO UPDATE SET rate = EXCLUDED.rate, updated_at = EXCLUDED.updated_at
+        RETURNING updated_at`,
+		tenantID, rate.Currency, rate.Base, rate.Rate,
+	).Scan(&rate.UpdatedAt)
+}
+
+// GetFXRates lists a tenant's exchange rates.
+func (s *PostgresStorage) GetFXRates(tenantID int) ([]*fxRate, error) {
+	rows, err := s.db.Query("SELECT currency, base, rate, updated_at FROM fx_rates WHERE tenant_id = $1 ORDER BY base, currency", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := make([]*fxRate, 0)
+	for rows.Next() {
+		rate := &fxRate{}
+		if err := rows.Scan(&rate.Currency, &rate.Base, &rate.Rate, &rate.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+// convertMoney converts an amount in minor units of one currency to minor
+// units of another at the rate, rounding to the nearest unit.
+func convertMoney(amount int, from, to string, rate float64) int {
+	major := float64(amount) / math.Pow10(currencies[from].Exponent)
+	return int(math.Round(major * rate * math.Pow10(currencies[to].Exponent)))
+}
+
+// handleFXRates lists the tenant's exchange rates (GET) or sets one (POST).
+func (s *Apiserver) handleFXRates(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		rates, err := s.store.GetFXRates(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, rates)
+	}
+
+	rate := &fxRate{}
+	if err := json.NewDecoder(r.Body).Decode(rate); err != nil {
+		return err
+	}
+	rate.Currency, rate.Base = strings.ToUpper(rate.Currency), strings.ToUpper(rate.Base)
+	for _, c := range []string{rate.Currency, rate.Base} {
+		if _, ok := currencies[c]; !ok {
+			return newAPIError(http.StatusBadRequest, "unsupported_currency", c)
+		}
+	}
+	if rate.Rate <= 0 || rate.Currency == rate.Base {
+		return newAPIError(http.StatusBadRequest, "invalid_fx_rate")
+	}
+	if err := s.store.SetFXRate(tenantID, rate); err != nil {
+		return err
+	}
+	s.audit(r, "fx_rate.set", "fx_rate", 0, rate)
+	return writeJSON(w, http.StatusOK, rate)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createGeoControlsTable = `
+        CREATE TABLE IF NOT EXISTS geo_controls (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            allowed_countries TEXT[] NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createTravelNoticesTable = `
+        CREATE TABLE IF NOT EXISTS travel_notices (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            countries TEXT[] NOT NULL,
+            starts_on DATE NOT NULL,
+            ends_on DATE NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createAccountCountriesTable = `
+        CREATE TABLE IF NOT EXISTS account_countries (
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            country TEXT NOT NULL,
+            first_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (account_id, country)
+        )
+    `
+
+// defaultGeoCountryHeader is the request header the edge proxy puts the
+// client's country in unless GEO_COUNTRY_HEADER says otherwise.
+const defaultGeoCountryHeader = "CF-IPCountry"
+
+// maxTravelNoticeDays caps how far ahead and how long a travel notice runs.
+const maxTravelNoticeDays = 365
+
+// Outcomes of the geographic fraud rules.
+const (
+	geoAllow  = "allow"
+	geoReview = "review"
+	geoDeny   = "deny"
+)
+
+// countryPattern is an ISO 3166-1 alpha-2 country code.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// geoControls restrict an account to a set of countries. Activity from
+// anywhere else is declined unless a travel notice covers it.
+type geoControls struct {
+	AccountID        int       `json:"account_id"`
+	AllowedCountries []string  `json:"allowed_countries"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// travelNotice tells the bank an account holder will be in some countries
+// between two dates (UTC, inclusive).
+type travelNotice struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"account_id"`
+	Countries []string  `json:"countries"`
+	StartsOn  string    `json:"starts_on"`
+	EndsOn    string    `json:"ends_on"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GeoControlsRequest struct {
+	AllowedCountries []string `json:"allowed_countries"`
+}
+
+type TravelNoticeRequest struct {
+	Countries []string `json:"countries"`
+	StartsOn  string   `json:"starts_on"`
+	EndsOn    string   `json:"ends_on"`
+}
+
+// geoProfile is what the geographic rules know about an account: its
+// restrictions, where its travel notices cover it today and the countries
+// it has logged in from.
+type geoProfile struct {
+	Allowed    []string
+	Travelling []string
+	Seen       []string
+}
+
+// GeoStorage holds the travel notice and geographic control storage
+// operations.
+type GeoStorage interface {
+	GetGeoControls(accountID int) (*geoControls, error)
+	SetGeoControls(*geoControls) error
+	DeleteGeoControls(accountID int) error
+	CreateTravelNotice(*travelNotice) error
+	GetTravelNotices(accountID int) ([]*travelNotice, error)
+	DeleteTravelNotice(accountID, id int) error
+	GetGeoProfile(accountID int, day time.Time) (*geoProfile, error)
+	RecordAccountCountry(accountID int, country string) error
+}
+
+// GetGeoControls retrieves the geographic restrictions of an account.
+func (s *PostgresStorage) GetGeoControls(accountID int) (*geoControls, error) {
+	g := &geoControls{}
+	err := s.db.QueryRow("SELECT account_id, allowed_countries, updated_at FROM geo_controls WHERE account_id = $1", accountID).
+		Scan(&g.AccountID, pq.Array(&g.AllowedCountries), &g.UpdatedAt)
+	return g, err
+}
+
+// SetGeoControls creates or replaces the geographic restrictions of an
+// account.
+func (s *PostgresStorage) SetGeoControls(g *geoControls) error {
+	return s.db.QueryRow(`
+        INSERT INTO geo_controls (account_id, allowed_countries) VALUES ($1, $2)
+        ON CONFLICT (account_id) DO UPDATE SET allowed_countries = EXCLUDED.allowed_countries, updated_at = now()
+        RETURNING updated_at`,
+		g.AccountID, pq.Array(g.AllowedCountries),
+	).Scan(&g.UpdatedAt)
+}
+
+// DeleteGeoControls lifts the geographic restrictions of an account.
+func (s *PostgresStorage) DeleteGeoControls(accountID int) error {
+	_, err := s.db.Exec("DELETE FROM geo_controls WHERE account_id = $1", accountID)
+	return err
+}
+
+// CreateTravelNotice stores a travel notice.
+func (s *PostgresStorage) CreateTravelNotice(n *travelNotice) error {
+	return s.db.QueryRow(
+		"INSERT INTO travel_notices (account_id, countries, starts_on, ends_on) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		n.AccountID, pq.Array(n.Countries), n.StartsOn, n.EndsOn,
+	).Scan(&n.ID, &n.CreatedAt)
+}
+
+// GetTravelNotices lists an account's travel notices that have not ended,
+// soonest first.
+func (s *PostgresStorage) GetTravelNotices(accountID int) ([]*travelNotice, error) {
+	rows, err := s.db.Query(
+		"SELECT id, account_id, countries, to_char(starts_on, 'YYYY-MM-DD'), to_char(ends_on, 'YYYY-MM-DD'), created_at FROM travel_notices WHERE account_id = $1 AND ends_on >= $2::date ORDER BY starts_on, id",
+		accountID, clock.Now().UTC().Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notices := make([]*travelNotice, 0)
+	for rows.Next() {
+		n := &travelNotice{}
+		if err := rows.Scan(&n.ID, &n.AccountID, pq.Array(&n.Countries), &n.StartsOn, &n.EndsOn, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		notices = append(notices, n)
+	}
+	return notices, rows.Err()
+}
+
+// DeleteTravelNotice withdraws a travel notice of an account.
+func (s *PostgresStorage) DeleteTravelNotice(accountID, id int) error {
+	res, err := s.db.Exec("DELETE FROM travel_notices WHERE id = $1 AND account_id = $2", id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetGeoProfile gathers what the geographic rules need to know about an
+// account on a day (UTC).
+func (s *PostgresStorage) GetGeoProfile(accountID int, day time.Time) (*geoProfile, error) {
+	p := &geoProfile{}
+	err := s.db.QueryRow(`
+        SELECT
+            COALESCE((SELECT allowed_countries FROM geo_controls WHERE account_id = $1), '{}'),
+            ARRAY(SELECT DISTINCT unnest(countries) FROM travel_notices WHERE account_id = $1 AND $2::date BETWEEN starts_on AND ends_on),
+            ARRAY(SELECT country FROM account_countries WHERE account_id = $1)`,
+		accountID, day.UTC().Format(time.DateOnly),
+	).Scan(pq.Array(&p.Allowed), pq.Array(&p.Travelling), pq.Array(&p.Seen))
+	return p, err
+}
+
+// RecordAccountCountry remembers a country an account holder logged in from.
+func (s *PostgresStorage) RecordAccountCountry(accountID int, country string) error {
+	_, err := s.db.Exec("INSERT INTO account_countries (account_id, country) VALUES ($1, $2) ON CONFLICT DO NOTHING", accountID, country)
+	return err
+}
+
+// geoRule is the geographic fraud rule. Activity from a country a travel
+// notice covers is always allowed. Otherwise it is denied outside the
+// account's allowed countries, if it has any, and sent for review from a
+// country it has never been used in.
+func geoRule(country string, p *geoProfile) string {
+	switch {
+	case country == "" || slices.Contains(p.Travelling, country):
+		return geoAllow
+	case len(p.Allowed) > 0 && !slices.Contains(p.Allowed, country):
+		return geoDeny
+	case len(p.Seen) > 0 && !slices.Contains(p.Seen, country) && !slices.Contains(p.Allowed, country):
+		return geoReview
+	}
+	return geoAllow
+}
+
+// requestCountry returns the client's country as set by the edge proxy, or
+// "" when it is unknown.
+func (s *Apiserver) requestCountry(r *http.Request) string {
+	country := strings.ToUpper(strings.TrimSpace(r.Header.Get(cmp.Or(s.cfg().GeoCountryHeader, defaultGeoCountryHeader))))
+	if !countryPattern.MatchString(country) || country == "XX" {
+		return ""
+	}
+	return country
+}
+
+// checkGeo runs the geographic rule for an account acting from a country.
+func (s *Apiserver) checkGeo(accountID int, country string) (string, error) {
+	if country == "" {
+		return geoAllow, nil
+	}
+	p, err := s.store.GetGeoProfile(accountID, clock.Now())
+	if err != nil {
+		return "", err
+	}
+	return geoRule(country, p), nil
+}
+
+// recordCountry remembers that an account logged in from a country, if it
+// is known.
+func (s *Apiserver) recordCountry(accountID int, country string) error {
+	if country == "" {
+		return nil
+	}
+	return s.store.RecordAccountCountry(accountID, country)
+}
+
+// parseCountries validates and normalizes a list of country codes.
+func parseCountries(countries []string) ([]string, error) {
+	parsed := make([]string, 0, len(countries))
+	for _, c := range countries {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if !countryPattern.MatchString(c) {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_country", c)
+		}
+		if !slices.Contains(parsed, c) {
+			parsed = append(parsed, c)
+		}
+	}
+	if len(parsed) == 0 {
+		return nil, newAPIError(http.StatusBadRequest, "required_field", "countries")
+	}
+	return parsed, nil
+}
+
+// handleGeoControls shows (GET), sets (PUT) or lifts (DELETE) the countries
+// an account can be used in.
+func (s *Apiserver) handleGeoControls(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		g, err := s.store.GetGeoControls(acc.ID)
+		if err != nil {
+			return newAPIError(http.StatusNotFound, "geo_controls_not_found", acc.ID)
+		}
+		return writeJSON(w, http.StatusOK, g)
+	case "DELETE":
+		if err := s.store.DeleteGeoControls(acc.ID); err != nil {
+			return err
+		}
+		s.audit(r, "geo_controls.deleted", "account", acc.ID, nil)
+		return writeJSON(w, http.StatusOK, map[string]int{"deleted": acc.ID})
+	}
+
+	req := GeoControlsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	countries, err := parseCountries(req.AllowedCountries)
+	if err != nil {
+		return err
+	}
+	g := &geoControls{AccountID: acc.ID, AllowedCountries: countries}
+	if err := s.store.SetGeoControls(g); err != nil {
+		return err
+	}
+	s.audit(r, "geo_controls.set", "account", acc.ID, g)
+	return writeJSON(w, http.StatusOK, g)
+}
+
+// handleTravelNotices lists an account's current and upcoming travel
+// notices (GET) or files one (POST).
+func (s *Apiserver) handleTravelNotices(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		notices, err := s.store.GetTravelNotices(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, notices)
+	}
+
+	req := TravelNoticeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	countries, err := parseCountries(req.Countries)
+	if err != nil {
+		return err
+	}
+	start, err := time.Parse(time.DateOnly, req.StartsOn)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_date", req.StartsOn)
+	}
+	end, err := time.Parse(time.DateOnly, req.EndsOn)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_date", req.EndsOn)
+	}
+	today := clock.Now().UTC().Truncate(24 * time.Hour)
+	limit := today.AddDate(0, 0, maxTravelNoticeDays)
+	if end.Before(start) || end.Before(today) || end.After(limit) {
+		return newAPIError(http.StatusBadRequest, "invalid_travel_dates", maxTravelNoticeDays)
+	}
+
+	n := &travelNotice{AccountID: acc.ID, Countries: countries, StartsOn: req.StartsOn, EndsOn: req.EndsOn}
+	if err := s.store.CreateTravelNotice(n); err != nil {
+		return err
+	}
+	s.audit(r, "travel_notice.created", "travel_notice", n.ID, n)
+	return writeJSON(w, http.StatusCreated, n)
+}
+
+// handleDeleteTravelNotice withdraws a travel notice.
+func (s *Apiserver) handleDeleteTravelNotice(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("notice"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("notice"))
+	}
+	if err := s.store.DeleteTravelNotice(acc.ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "travel_notice_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "travel_notice.deleted", "travel_notice", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// notifyGeoReview tells an account holder about activity from a country the
+// account has not been used in.
+func (s *Apiserver) notifyGeoReview(accountID int, country, activity string) {
+	s.notify(accountID, "geo_review", fmt.Sprintf("%s from %s, where your account has not been used before. File a travel notice if you are travelling", activity, country))
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createGLEntriesTable = `
+        CREATE TABLE IF NOT EXISTS gl_entries (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            gl_code TEXT NOT NULL,
+            amount INT NOT NULL,
+            ledger_entry_id INT UNIQUE REFERENCES ledger_entries(id) ON DELETE CASCADE,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createGLAccountsTable = `
+        CREATE TABLE IF NOT EXISTS gl_accounts (
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            code TEXT NOT NULL,
+            name TEXT NOT NULL,
+            type TEXT NOT NULL CHECK (type IN ('asset', 'liability', 'equity', 'income', 'expense')),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (tenant_id, code)
+        )
+    `
+
+const createGLMappingsTable = `
+        CREATE TABLE IF NOT EXISTS gl_mappings (
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            entry_kind TEXT NOT NULL,
+            gl_code TEXT NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (tenant_id, entry_kind)
+        )
+    `
+
+// Codes of the built-in general ledger accounts. Customer accounts are not
+// GL accounts of their own: together they make up the customer deposits
+// liability.
+const (
+	glCash             = "1000"
+	glCustomerDeposits = "2000"
+	glPendingClaims    = "2100"
+	glCashCodes        = "2200"
+	glUnclaimedFunds   = "2300"
+	glAdjustments      = "3000"
+	glFeeIncome        = "4000"
+	glInterestExpense  = "5000"
+)
+
+// GL account types.
+const (
+	glAsset     = "asset"
+	glLiability = "liability"
+	glEquity    = "equity"
+	glIncome    = "income"
+	glExpense   = "expense"
+)
+
+var glTypes = []string{glAsset, glLiability, glEquity, glIncome, glExpense}
+
+// glAccount is an account of the general ledger.
+type glAccount struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// glChart is the built-in part of every tenant's chart of accounts. Tenants
+// add their own accounts next to it.
+var glChart = []glAccount{
+	{glCash, "Cash", glAsset},
+	{glCustomerDeposits, "Customer deposits", glLiability},
+	{glPendingClaims, "Unclaimed transfers", glLiability},
+	{glCashCodes, "ATM cash codes", glLiability},
+	{glUnclaimedFunds, "Unclaimed funds", glLiability},
+	{glAdjustments, "Manual adjustments", glEquity},
+	{glFeeIncome, "Fee income", glIncome},
+	{glInterestExpense, "Interest expense", glExpense},
+}
+
+// glOffsets names the GL account that balances each kind of ledger entry
+// bringing money into or out of the customer accounts, unless the tenant
+// maps the kind elsewhere. Every other kind moves money between customer
+// accounts and balances on its own.
+//
+// Amounts on both sides are signed with credits positive: a deposit credits
+// the customer (+) and debits cash (-), so every posting sums to zero.
+var glOffsets = map[string]string{
+	entryOpening:    glCash,
+	entryDeposit:    glCash,
+	entryWithdrawal: glCash,
+	entryAdjustment: glAdjustments,
+	entryFee:        glFeeIncome,
+	// Money sent to a contact without an account is owed to them, or back
+	// to the sender, until the claim is collected or expires.
+	entryClaimHold:   glPendingClaims,
+	entryClaimPayout: glPendingClaims,
+	entryClaimReturn: glPendingClaims,
+	// Cash held for a cardless withdrawal is owed to the customer until an
+	// ATM pays it out, see postGLMove, or the code lapses.
+	entryCashHold:    glCashCodes,
+	entryCashRelease: glCashCodes,
+	// Balances of long dormant accounts are owed to their holders until
+	// reclaimed.
+	entryEscheat: glUnclaimedFunds,
+	entryReclaim: glUnclaimedFunds,
+}
+
+// glOffsetKinds returns the entry kinds that have a GL offset.
+func glOffsetKinds() []string {
+	kinds := make([]string, 0, len(glOffsets))
+	for kind := range glOffsets {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// postGLOffset posts the GL line balancing a customer ledger entry, if its
+// kind needs one, within the caller's transaction.
+func postGLOffset(tx *sql.Tx, tenantID int, e *ledgerEntry) error {
+	code, ok := glOffsets[e.Kind]
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(`
+        INSERT INTO gl_entries (tenant_id, gl_code, amount, ledger_entry_id, created_at)
+        VALUES ($1, COALESCE((SELECT gl_code FROM gl_mappings WHERE tenant_id = $1 AND entry_kind = $2), $3), $4, $5, $6)`,
+		tenantID, e.Kind, code, -e.Amount, e.ID, e.CreatedAt,
+	)
+	return err
+}
+
+// postGLMove moves an amount between the GL offsets of two entry kinds
+// without touching a customer account, debiting the first and crediting the
+// second, within the caller's transaction.
+func postGLMove(tx *sql.Tx, tenantID int, debitKind, creditKind string, amount int, at time.Time) error {
+	for _, line := range []struct {
+		kind   string
+		amount int
+	}{{debitKind, -amount}, {creditKind, amount}} {
+		_, err := tx.Exec(`
+            INSERT INTO gl_entries (tenant_id, gl_code, amount, created_at)
+            VALUES ($1, COALESCE((SELECT gl_code FROM gl_mappings WHERE tenant_id = $1 AND entry_kind = $2), $3), $4, $5)`,
+			tenantID, line.kind, glOffsets[line.kind], line.amount, at,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// glBackfill posts the missing GL offsets of entries recorded before the
+// ledger was double-entry.
+func glBackfill() string {
+	cases := make([]string, 0, len(glOffsets))
+	for _, kind := range glOffsetKinds() {
+		cases = append(cases, fmt.Sprintf("WHEN '%s' THEN '%s'", kind, glOffsets[kind]))
+	}
+	return `
+        INSERT INTO gl_entries (tenant_id, gl_code, amount, ledger_entry_id, created_at)
+        SELECT a.tenant_id, CASE l.kind ` + strings.Join(cases, " ") + ` END, -l.amount, l.id, l.created_at
+        FROM ledger_entries l JOIN accounts a ON a.id = l.account_id
+        WHERE l.kind IN ('` + strings.Join(glOffsetKinds(), "', '") + `')
+        ON CONFLICT (ledger_entry_id) DO NOTHING`
+}
+
+// glMapping routes the GL offset of an entry kind to a tenant's account.
+type glMapping struct {
+	EntryKind string `json:"entry_kind"`
+	GLCode    string `json:"gl_code"`
+	Default   bool   `json:"default"`
+}
+
+// glTotals are the debits and credits of one GL account.
+type glTotals struct {
+	Debits  int64
+	Credits int64
+}
+
+// GLStorage holds the general ledger storage operations.
+type GLStorage interface {
+	GetGLAccounts(tenantID int) ([]glAccount, error)
+	CreateGLAccount(tenantID int, acc glAccount) error
+	GetGLMappings(tenantID int) ([]*glMapping, error)
+	SetGLMapping(tenantID int, m *glMapping) error
+	GetGLTotals(tenantID int, since, until time.Time) (map[string]glTotals, error)
+}
+
+// GetGLAccounts returns a tenant's chart of accounts, built-in accounts
+// included, ordered by code.
+func (s *PostgresStorage) GetGLAccounts(tenantID int) ([]glAccount, error) {
+	rows, err := s.db.Query("SELECT code, name, type FROM gl_accounts WHERE tenant_id = $1", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chart := slices.Clone(glChart)
+	for rows.Next() {
+		acc := glAccount{}
+		if err := rows.Scan(&acc.Code, &acc.Name, &acc.Type); err != nil {
+			return nil, err
+		}
+		chart = append(chart, acc)
+	}
+	sort.Slice(chart, func(i, j int) bool { return chart[i].Code < chart[j].Code })
+	return chart, rows.Err()
+}
+
+// CreateGLAccount adds an account to a tenant's chart.
+func (s *PostgresStorage) CreateGLAccount(tenantID int, acc glAccount) error {
+	_, err := s.db.Exec("INSERT INTO gl_accounts (tenant_id, code, name, type) VALUES ($1, $2, $3, $4)", tenantID, acc.Code, acc.Name, acc.Type)
+	return err
+}
+
+// GetGLMappings returns where the GL offset of each entry kind is posted for
+// a tenant.
+func (s *PostgresStorage) GetGLMappings(tenantID int) ([]*glMapping, error) {
+	rows, err := s.db.Query("SELECT entry_kind, gl_code FROM gl_mappings WHERE tenant_id = $1", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	custom := map[string]string{}
+	for rows.Next() {
+		var kind, code string
+		if err := rows.Scan(&kind, &code); err != nil {
+			return nil, err
+		}
+		custom[kind] = code
+	}
+	mappings := make([]*glMapping, 0, len(glOffsets))
+	for _, kind := range glOffsetKinds() {
+		code, ok := custom[kind]
+		if !ok {
+			code = glOffsets[kind]
+		}
+		mappings = append(mappings, &glMapping{EntryKind: kind, GLCode: code, Default: !ok})
+	}
+	return mappings, rows.Err()
+}
+
+// SetGLMapping routes the GL offsets of future entries of a kind to another
+// account. Entries already posted keep their GL lines.
+func (s *PostgresStorage) SetGLMapping(tenantID int, m *glMapping) error {
+	_, err := s.db.Exec(`
+        INSERT INTO gl_mappings (tenant_id, entry_kind, gl_code) VALUES ($1, $2, $3)
+        ON CONFLICT (tenant_id, entry_kind) DO UPDATE SET gl_code = EXCLUDED.gl_code, updated_at = now()`,
+		tenantID, m.EntryKind, m.GLCode,
+	)
+	return err
+}
+
+// GetGLTotals returns the debits and credits of each GL account of a tenant
+// posted in [since, until), customer deposits included, from one consistent
+// snapshot.
+func (s *PostgresStorage) GetGLTotals(tenantID int, since, until time.Time) (map[string]glTotals, error) {
+	rows, err := s.db.Query(`
+        SELECT gl_code, COALESCE(-SUM(amount) FILTER (WHERE amount < 0), 0), COALESCE(SUM(amount) FILTER (WHERE amount > 0), 0)
+        FROM gl_entries WHERE tenant_id = $1 AND created_at >= $3 AND created_at < $4 GROUP BY gl_code
+        UNION ALL
+        SELECT $2, COALESCE(-SUM(l.amount) FILTER (WHERE l.amount < 0), 0), COALESCE(SUM(l.amount) FILTER (WHERE l.amount > 0), 0)
+        FROM ledger_entries l JOIN accounts a ON a.id = l.account_id
+        WHERE a.tenant_id = $1 AND l.created_at >= $3 AND l.created_at < $4`,
+		tenantID, glCustomerDeposits, since, until,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]glTotals{}
+	for rows.Next() {
+		var code string
+		t := glTotals{}
+		if err := rows.Scan(&code, &t.Debits, &t.Credits); err != nil {
+			return nil, err
+		}
+		totals[code] = t
+	}
+	return totals, rows.Err()
+}
+
+// trialBalanceLine is the debit and credit totals of one GL account.
+type trialBalanceLine struct {
+	glAccount
+	Debits  int64 `json:"debits"`
+	Credits int64 `json:"credits"`
+	Balance int64 `json:"balance"`
+}
+
+// TrialBalance lists every GL account of a tenant. The books balance when
+// total debits equal total credits.
+type TrialBalance struct {
+	Lines        []*trialBalanceLine `json:"lines"`
+	TotalDebits  int64               `json:"total_debits"`
+	TotalCredits int64               `json:"total_credits"`
+	Balanced     bool                `json:"balanced"`
+}
+
+// glReport returns a tenant's chart with the totals posted in [since, until).
+func (s *Apiserver) glReport(tenantID int, since, until time.Time) ([]*trialBalanceLine, error) {
+	chart, err := s.store.GetGLAccounts(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	totals, err := s.store.GetGLTotals(tenantID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]*trialBalanceLine, 0, len(chart))
+	for _, acc := range chart {
+		t := totals[acc.Code]
+		lines = append(lines, &trialBalanceLine{glAccount: acc, Debits: t.Debits, Credits: t.Credits, Balance: t.Credits - t.Debits})
+	}
+	return lines, nil
+}
+
+// trialBalance builds the trial balance of a tenant as of now.
+func (s *Apiserver) trialBalance(tenantID int) (*TrialBalance, error) {
+	lines, err := s.glReport(tenantID, time.Time{}, clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	tb := &TrialBalance{Lines: lines}
+	for _, l := range lines {
+		tb.TotalDebits += l.Debits
+		tb.TotalCredits += l.Credits
+	}
+	tb.Balanced = tb.TotalDebits == tb.TotalCredits
+	return tb, nil
+}
+
+// ProfitAndLoss is the income and expenses of a tenant over a period.
+// Income accounts count credits as positive, expense accounts debits.
+type ProfitAndLoss struct {
+	From      string              `json:"from"`
+	To        string              `json:"to"`
+	Income    []*trialBalanceLine `json:"income"`
+	Expenses  []*trialBalanceLine `json:"expenses"`
+	NetIncome int64               `json:"net_income"`
+}
+
+// reportFormat reads ?format= of a report: json (the default) or csv.
+func reportFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "json":
+		return "json", nil
+	case "csv":
+		return f, nil
+	default:
+		return "", newAPIError(http.StatusBadRequest, "invalid_format", f)
+	}
+}
+
+// writeCSV writes a report as a CSV attachment.
+func writeCSV(w http.ResponseWriter, filename string, records [][]string) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(records)
+	return cw.Error()
+}
+
+func (l *trialBalanceLine) record() []string {
+	return []string{l.Code, l.Name, l.Type, strconv.FormatInt(l.Debits, 10), strconv.FormatInt(l.Credits, 10), strconv.FormatInt(l.Balance, 10)}
+}
+
+// handleTrialBalance returns the trial balance of the caller's tenant as
+// JSON or, with ?format=csv, as a spreadsheet.
+func (s *Apiserver) handleTrialBalance(w http.ResponseWriter, r *http.Request) error {
+	format, err := reportFormat(r)
+	if err != nil {
+		return err
+	}
+	tb, err := s.trialBalance(requestTenant(r).ID)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return writeJSON(w, http.StatusOK, tb)
+	}
+
+	records := [][]string{{"code", "name", "type", "debits", "credits", "balance"}}
+	for _, l := range tb.Lines {
+		records = append(records, l.record())
+	}
+	records = append(records, []string{"", "Total", "", strconv.FormatInt(tb.TotalDebits, 10), strconv.FormatInt(tb.TotalCredits, 10), ""})
+	return writeCSV(w, "trial-balance.csv", records)
+}
+
+// handleProfitAndLoss returns the income and expenses of the caller's tenant
+// between ?from= and ?to= (inclusive UTC dates, the current month by
+// default) as JSON or CSV.
+func (s *Apiserver) handleProfitAndLoss(w http.ResponseWriter, r *http.Request) error {
+	format, err := reportFormat(r)
+	if err != nil {
+		return err
+	}
+	now := clock.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now.Truncate(24 * time.Hour)
+	for param, day := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(param); v != "" {
+			if *day, err = time.Parse(time.DateOnly, v); err != nil {
+				return newAPIError(http.StatusBadRequest, "invalid_date", v)
+			}
+		}
+	}
+
+	lines, err := s.glReport(requestTenant(r).ID, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	pl := &ProfitAndLoss{From: from.Format(time.DateOnly), To: to.Format(time.DateOnly), Income: []*trialBalanceLine{}, Expenses: []*trialBalanceLine{}}
+	for _, l := range lines {
+		switch l.Type {
+		case glIncome:
+			pl.Income = append(pl.Income, l)
+			pl.NetIncome += l.Balance
+		case glExpense:
+			l.Balance = -l.Balance
+			pl.Expenses = append(pl.Expenses, l)
+			pl.NetIncome -= l.Balance
+		}
+	}
+	if format == "json" {
+		return writeJSON(w, http.StatusOK, pl)
+	}
+
+	records := [][]string{{"code", "name", "type", "debits", "credits", "amount"}}
+	for _, l := range append(pl.Income, pl.Expenses...) {
+		records = append(records, l.record())
+	}
+	records = append(records, []string{"", "Net income", "", "", "", strconv.FormatInt(pl.NetIncome, 10)})
+	return writeCSV(w, fmt.Sprintf("profit-and-loss-%s-%s.csv", pl.From, pl.To), records)
+}
+
+// handleGLAccounts lists (GET) or adds to (POST) the tenant's chart of
+// accounts.
+func (s *Apiserver) handleGLAccounts(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	chart, err := s.store.GetGLAccounts(tenantID)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		return writeJSON(w, http.StatusOK, chart)
+	}
+
+	acc := glAccount{}
+	if err := json.NewDecoder(r.Body).Decode(&acc); err != nil {
+		return err
+	}
+	acc.Code, acc.Name = strings.TrimSpace(acc.Code), strings.TrimSpace(acc.Name)
+	if acc.Code == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "code")
+	}
+	if acc.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if !slices.Contains(glTypes, acc.Type) {
+		return newAPIError(http.StatusBadRequest, "invalid_gl_type", acc.Type)
+	}
+	if slices.ContainsFunc(chart, func(a glAccount) bool { return a.Code == acc.Code }) {
+		return newAPIError(http.StatusConflict, "gl_account_exists", acc.Code)
+	}
+	if err := s.store.CreateGLAccount(tenantID, acc); err != nil {
+		return err
+	}
+	s.audit(r, "gl_account.created", "gl_account", 0, acc)
+	return writeJSON(w, http.StatusCreated, acc)
+}
+
+// handleGLMappings lists (GET) or changes (PUT) which GL account offsets
+// each kind of entry. Customer deposits are derived from the customer
+// ledger, so nothing can be mapped to them.
+func (s *Apiserver) handleGLMappings(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		mappings, err := s.store.GetGLMappings(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, mappings)
+	}
+
+	m := &glMapping{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		return err
+	}
+	if _, ok := glOffsets[m.EntryKind]; !ok {
+		return newAPIError(http.StatusBadRequest, "invalid_entry_kind", m.EntryKind)
+	}
+	chart, err := s.store.GetGLAccounts(tenantID)
+	if err != nil {
+		return err
+	}
+	if m.GLCode == glCustomerDeposits || !slices.ContainsFunc(chart, func(a glAccount) bool { return a.Code == m.GLCode }) {
+		return newAPIError(http.StatusBadRequest, "gl_account_not_found", m.GLCode)
+	}
+	if err := s.store.SetGLMapping(tenantID, m); err != nil {
+		return err
+	}
+	m.Default = m.GLCode == glOffsets[m.EntryKind]
+	s.audit(r, "gl_mapping.updated", "gl_mapping", 0, m)
+	return writeJSON(w, http.StatusOK, m)
+}
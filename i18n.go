@@ -0,0 +1,87 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:embed i18n/*.json
+var catalogFiles embed.FS
+
+const defaultLanguage = "en"
+
+// catalogs maps a language to its message templates keyed by error code.
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := catalogFiles.ReadDir("i18n")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]map[string]string, len(files))
+	for _, f := range files {
+		data, err := catalogFiles.ReadFile(path.Join("i18n", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("invalid message catalog %s: %v", f.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = messages
+	}
+	return catalogs
+}
+
+// apiError is an error with a stable code whose message is translated into
+// the caller's language when written.
+type apiError struct {
+	Status int
+	Code   string
+	Args   []any
+}
+
+func newAPIError(status int, code string, args ...any) *apiError {
+	return &apiError{Status: status, Code: code, Args: args}
+}
+
+func (e *apiError) Error() string {
+	return translate(defaultLanguage, e.Code, e.Args...)
+}
+
+// translate renders the message for code in lang, falling back to English
+// and finally to the code itself.
+func translate(lang, code string, args ...any) string {
+	template, ok := catalogs[lang][code]
+	if !ok {
+		template, ok = catalogs[defaultLanguage][code]
+	}
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		return template
+	}
+	return fmt.Sprintf(template, args...)
+}
+
+// writeError writes err as an ApiError. Coded errors keep their status and
+// are translated; anything else is a 400 with the raw message. Either way
+// the message is scrubbed of secrets before it leaves the server.
+func writeError(w http.ResponseWriter, r *http.Request, err error) error {
+	requestID := requestID(r)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return encodeJSON(w, apiErr.Status, ApiError{
+			Error:     scrub(translate(requestLanguage(r), apiErr.Code, apiErr.Args...)),
+			Code:      apiErr.Code,
+			RequestID: requestID,
+		})
+	}
+	return encodeJSON(w, http.StatusBadRequest, ApiError{Error: scrub(err.Error()), RequestID: requestID})
+}
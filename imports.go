@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imported_transactions.created_at is when the other bank booked the
+// transaction, not when it was imported.
+const createImportedTransactionsTable = `
+        CREATE TABLE IF NOT EXISTS imported_transactions (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            source TEXT NOT NULL,
+            external_id TEXT NOT NULL,
+            amount INT NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL,
+            imported_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (account_id, source, external_id)
+        )
+    `
+
+// Limits of a statement file.
+const (
+	maxImportSize = 5 << 20
+	maxImportRows = 5000
+)
+
+// importJobBatch is how many transactions an import job stores at a time.
+const importJobBatch = 500
+
+// Statement file formats.
+const (
+	importCSV = "csv"
+	importOFX = "ofx"
+)
+
+// importedTransaction is a transaction of an account at another bank, read
+// from a statement the holder uploaded. Imported transactions live apart
+// from the ledger: they count in the spending breakdown but never in a
+// balance.
+type importedTransaction struct {
+	ID          int       `json:"id"`
+	AccountID   int       `json:"account_id"`
+	Source      string    `json:"source"`
+	ExternalID  string    `json:"external_id"`
+	Amount      int       `json:"amount"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	ImportedAt  time.Time `json:"imported_at"`
+}
+
+// importResult is the outcome of importing a statement. Transactions
+// already imported from the same source are skipped, so overlapping
+// statements can be uploaded safely.
+type importResult struct {
+	Source   string `json:"source"`
+	Format   string `json:"format"`
+	Imported int    `json:"imported"`
+	Skipped  int    `json:"skipped"`
+}
+
+// ImportStorage holds the imported transaction storage operations.
+type ImportStorage interface {
+	ImportTransactions(txns []*importedTransaction) (int, error)
+	GetImportedTransactions(accountID int, page pageRequest) ([]*importedTransaction, int, error)
+	GetImportedTransactionsBetween(accountID int, from, to *time.Time) ([]*importedTransaction, error)
+}
+
+// ImportTransactions stores the transactions not imported before and
+// returns how many were new.
+func (s *PostgresStorage) ImportTransactions(txns []*importedTransaction) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for _, t := range txns {
+		res, err := tx.Exec(`
+            INSERT INTO imported_transactions (account_id, source, external_id, amount, description, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (account_id, source, external_id) DO NOTHING`,
+			t.AccountID, t.Source, t.ExternalID, t.Amount, t.Description, t.CreatedAt,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		imported += int(n)
+	}
+	return imported, tx.Commit()
+}
+
+const selectImportedTransactions = "SELECT id, account_id, source, external_id, amount, description, created_at, imported_at FROM imported_transactions "
+
+// GetImportedTransactions returns a page of an account's imported
+// transactions, newest first, and their total count.
+func (s *PostgresStorage) GetImportedTransactions(accountID int, page pageRequest) ([]*importedTransaction, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM imported_transactions WHERE account_id = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	txns, err := s.queryImportedTransactions("WHERE account_id = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return txns, total, err
+}
+
+// GetImportedTransactionsBetween returns an account's imported transactions
+// booked in [from, to), either end being open when nil.
+func (s *PostgresStorage) GetImportedTransactionsBetween(accountID int, from, to *time.Time) ([]*importedTransaction, error) {
+	return s.queryImportedTransactions(`
+        WHERE account_id = $1 AND ($2::timestamptz IS NULL OR created_at >= $2) AND ($3::timestamptz IS NULL OR created_at < $3)
+        ORDER BY created_at, id`,
+		accountID, from, to,
+	)
+}
+
+func (s *PostgresStorage) queryImportedTransactions(where string, args ...any) ([]*importedTransaction, error) {
+	rows, err := s.db.Query(selectImportedTransactions+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txns := make([]*importedTransaction, 0)
+	for rows.Next() {
+		t := &importedTransaction{}
+		if err := rows.Scan(&t.ID, &t.AccountID, &t.Source, &t.ExternalID, &t.Amount, &t.Description, &t.CreatedAt, &t.ImportedAt); err != nil {
+			return nil, err
+		}
+		txns = append(txns, t)
+	}
+	return txns, rows.Err()
+}
+
+// importFormat is the format of a statement file: ?format= if given, else
+// its extension, else a sniff of its content.
+func importFormat(r *http.Request, filename string, data []byte) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".csv":
+			format = importCSV
+		case ".ofx", ".qfx":
+			format = importOFX
+		default:
+			if bytes.Contains(bytes.ToUpper(data), []byte("<OFX>")) {
+				format = importOFX
+			} else {
+				format = importCSV
+			}
+		}
+	}
+	if format != importCSV && format != importOFX {
+		return "", newAPIError(http.StatusBadRequest, "unsupported_import_format", format)
+	}
+	return format, nil
+}
+
+// csvColumns are the header names bank exports use for each field.
+var csvColumns = map[string][]string{
+	"date":        {"date", "transaction date", "posted", "posting date", "booking date", "value date"},
+	"amount":      {"amount", "transaction amount"},
+	"debit":       {"debit", "withdrawal", "withdrawals", "paid out"},
+	"credit":      {"credit", "deposit", "deposits", "paid in"},
+	"description": {"description", "narration", "details", "payee", "memo", "name"},
+	"id":          {"id", "transaction id", "reference", "fitid"},
+}
+
+var importDateLayouts = []string{time.RFC3339, time.DateOnly, "2006/01/02", "02-Jan-2006", "02 Jan 2006", "20060102"}
+
+// parseStatementCSV reads a CSV statement with a header row. Amounts come
+// either signed in one column or as separate debit and credit columns.
+// Rows without an ID column are identified by their content.
+func parseStatementCSV(data []byte, exponent int) ([]*importedTransaction, error) {
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_import_row", 1)
+	}
+	col := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for field, names := range csvColumns {
+			if _, ok := col[field]; !ok && slices.Contains(names, name) {
+				col[field] = i
+			}
+		}
+	}
+	_, hasAmount := col["amount"]
+	_, hasDebit := col["debit"]
+	_, hasCredit := col["credit"]
+	if _, ok := col["date"]; !ok {
+		return nil, newAPIError(http.StatusBadRequest, "missing_import_column", "date")
+	}
+	if !hasAmount && !(hasDebit || hasCredit) {
+		return nil, newAPIError(http.StatusBadRequest, "missing_import_column", "amount")
+	}
+
+	field := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	txns := make([]*importedTransaction, 0)
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_import_row", line)
+		}
+		if len(strings.Join(row, "")) == 0 {
+			continue
+		}
+		t := &importedTransaction{Description: field(row, "description"), ExternalID: field(row, "id")}
+		if t.CreatedAt, err = parseImportDate(field(row, "date")); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_import_row", line)
+		}
+		if hasAmount {
+			t.Amount, err = parseDecimalAmount(field(row, "amount"), exponent)
+		} else {
+			var debit, credit int
+			debit, err = parseDecimalAmount(zeroIfEmpty(field(row, "debit")), exponent)
+			if err == nil {
+				credit, err = parseDecimalAmount(zeroIfEmpty(field(row, "credit")), exponent)
+			}
+			t.Amount = credit - abs(debit)
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_import_row", line)
+		}
+		txns = append(txns, t)
+	}
+	return txns, nil
+}
+
+// zeroIfEmpty reads an empty debit or credit cell as zero.
+func zeroIfEmpty(v string) string {
+	if v == "" {
+		return "0"
+	}
+	return v
+}
+
+func parseImportDate(v string) (time.Time, error) {
+	for _, layout := range importDateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown date %q", v)
+}
+
+var decimalAmount = regexp.MustCompile(`^([+-]?)(\d+)(?:\.(\d+))?$`)
+
+// parseDecimalAmount converts an amount written in major units, like
+// "-1,234.50", to minor units of a currency with the given exponent.
+// Amounts in parentheses are negative, as accountants write them.
+func parseDecimalAmount(v string, exponent int) (int, error) {
+	v = strings.NewReplacer(",", "", " ", "").Replace(v)
+	negative := strings.HasPrefix(v, "(") && strings.HasSuffix(v, ")")
+	v = strings.TrimSuffix(strings.TrimPrefix(v, "("), ")")
+	m := decimalAmount.FindStringSubmatch(v)
+	if m == nil || len(m[3]) > exponent {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	n, err := strconv.Atoi(m[2] + m[3] + strings.Repeat("0", exponent-len(m[3])))
+	if err != nil {
+		return 0, err
+	}
+	if negative != (m[1] == "-") {
+		n = -n
+	}
+	return n, nil
+}
+
+var (
+	ofxTransaction = regexp.MustCompile(`(?is)<STMTTRN>(.*?)(?:</STMTTRN>|$)`)
+	ofxField       = regexp.MustCompile(`(?i)<(TRNAMT|DTPOSTED|FITID|NAME|MEMO)>([^<\r\n]*)`)
+)
+
+// parseStatementOFX reads the transactions of an OFX or QFX statement, in
+// either the SGML or the XML flavour.
+func parseStatementOFX(data []byte, exponent int) ([]*importedTransaction, error) {
+	if !bytes.Contains(bytes.ToUpper(data), []byte("<OFX>")) {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_import_row", 1)
+	}
+	txns := make([]*importedTransaction, 0)
+	for i, m := range ofxTransaction.FindAllSubmatch(data, -1) {
+		fields := make(map[string]string)
+		for _, f := range ofxField.FindAllSubmatch(m[1], -1) {
+			fields[strings.ToUpper(string(f[1]))] = strings.TrimSpace(string(f[2]))
+		}
+		t := &importedTransaction{ExternalID: fields["FITID"], Description: fields["NAME"]}
+		if t.Description == "" {
+			t.Description = fields["MEMO"]
+		}
+		posted := fields["DTPOSTED"]
+		var err error
+		if len(posted) >= 14 {
+			t.CreatedAt, err = time.Parse("20060102150405", posted[:14])
+		} else if len(posted) >= 8 {
+			t.CreatedAt, err = time.Parse("20060102", posted[:8])
+		} else {
+			err = errors.New("missing date")
+		}
+		if err == nil {
+			t.Amount, err = parseDecimalAmount(fields["TRNAMT"], exponent)
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_import_row", i+1)
+		}
+		txns = append(txns, t)
+	}
+	return txns, nil
+}
+
+// identifyImported fills in the ID of transactions the statement gave none,
+// from their content and how many identical ones came before, so the same
+// row imported twice is recognized while identical rows stay distinct.
+func identifyImported(txns []*importedTransaction) {
+	seen := make(map[string]int)
+	for _, t := range txns {
+		if t.ExternalID != "" {
+			continue
+		}
+		key := fmt.Sprintf("%s|%d|%s", t.CreatedAt.Format(time.RFC3339), t.Amount, t.Description)
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", key, seen[key])))
+		seen[key]++
+		t.ExternalID = "sha256:" + hex.EncodeToString(sum[:12])
+	}
+}
+
+// handleImportTransactions imports a CSV or OFX statement of an account
+// held at another bank, sent as the "file" field of a multipart form.
+// ?source= names that account, defaulting to the file name; amounts are
+// read in the currency of the account they are imported into. With
+// ?async=true the file is checked at once and imported by a job.
+func (s *Apiserver) handleImportTransactions(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize+1<<20)
+	file, header, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, "import_too_large", maxImportSize>>20)
+	} else if err != nil {
+		return newAPIError(http.StatusBadRequest, "required_field", "file")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxImportSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxImportSize {
+		return newAPIError(http.StatusRequestEntityTooLarge, "import_too_large", maxImportSize>>20)
+	}
+
+	result := &importResult{Source: strings.TrimSpace(r.URL.Query().Get("source"))}
+	if result.Source == "" {
+		result.Source = filepath.Base(strings.TrimSpace(header.Filename))
+	}
+	if result.Format, err = importFormat(r, header.Filename, data); err != nil {
+		return err
+	}
+	exponent := 2
+	if cur, ok := currencies[acc.Currency]; ok {
+		exponent = cur.Exponent
+	}
+	var txns []*importedTransaction
+	if result.Format == importOFX {
+		txns, err = parseStatementOFX(data, exponent)
+	} else {
+		txns, err = parseStatementCSV(data, exponent)
+	}
+	if err != nil {
+		return err
+	}
+	if len(txns) > maxImportRows {
+		return newAPIError(http.StatusRequestEntityTooLarge, "too_many_import_rows", maxImportRows)
+	}
+	identifyImported(txns)
+	for _, t := range txns {
+		t.AccountID, t.Source = acc.ID, result.Source
+	}
+	if r.URL.Query().Get("async") == "true" {
+		return s.startImport(w, r, acc, txns, result)
+	}
+	if result.Imported, err = s.store.ImportTransactions(txns); err != nil {
+		return err
+	}
+	result.Skipped = len(txns) - result.Imported
+	s.audit(r, "transactions.imported", "account", acc.ID, result)
+	return writeJSON(w, http.StatusCreated, result)
+}
+
+// startImport imports txns into acc in a job, a batch at a time. A job
+// that fails part way keeps the batches it stored; importing the file
+// again skips them.
+func (s *Apiserver) startImport(w http.ResponseWriter, r *http.Request, acc *account, txns []*importedTransaction, result *importResult) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	j, err := s.startJob(jobTransactionsImport, caller, func(run *jobRun) error {
+		for start := 0; start < len(txns); start += importJobBatch {
+			batch := txns[start:min(start+importJobBatch, len(txns))]
+			n, err := s.store.ImportTransactions(batch)
+			if err != nil {
+				return err
+			}
+			result.Imported += n
+			run.progress((start + len(batch)) * 100 / len(txns))
+		}
+		result.Skipped = len(txns) - result.Imported
+		s.audit(r, "transactions.imported", "account", acc.ID, result)
+		return run.result(result)
+	})
+	if err != nil {
+		return err
+	}
+	return writeJobAccepted(w, j)
+}
+
+// handleImportedTransactions lists an account's imported transactions,
+// newest first, a page at a time.
+func (s *Apiserver) handleImportedTransactions(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	txns, total, err := s.store.GetImportedTransactions(acc.ID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(txns, total, page, func(t *importedTransaction) cursor { return cursor{t.CreatedAt, t.ID} }))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// externalEntryKinds are ledger entries that bring money into or take it out
+// of the bank, i.e. those with a GL offset. Every other kind moves money
+// between accounts and must net to zero, so the sum of all balances has to
+// equal the sum of these entries.
+var externalEntryKinds = glOffsetKinds()
+
+var (
+	invariantChecks     = expvar.NewInt("invariant_checks")
+	invariantViolations = expvar.NewMap("invariant_violations")
+)
+
+// invariantResult is the outcome of one invariant for one tenant.
+type invariantResult struct {
+	Name     string `json:"name"`
+	TenantID int    `json:"tenant_id"`
+	OK       bool   `json:"ok"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// InvariantStorage holds the invariant checking storage operations.
+type InvariantStorage interface {
+	CheckInvariants(tenantID int) ([]*invariantResult, error)
+	GetAdmins(tenantID int) ([]*account, error)
+}
+
+// CheckInvariants evaluates the global money invariants of a tenant against
+// a single consistent snapshot.
+func (s *PostgresStorage) CheckInvariants(tenantID int) ([]*invariantResult, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		return nil, err
+	}
+
+	var balances, ledger, external int64
+	if err := tx.QueryRow("SELECT COALESCE(SUM(balance), 0) FROM accounts WHERE tenant_id = $1", tenantID).Scan(&balances); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`
+        SELECT COALESCE(SUM(l.amount), 0), COALESCE(SUM(l.amount) FILTER (WHERE l.kind = ANY($2)), 0)
+        FROM ledger_entries l JOIN accounts a ON a.id = l.account_id
+        WHERE a.tenant_id = $1`, tenantID, pq.Array(externalEntryKinds),
+	).Scan(&ledger, &external)
+	if err != nil {
+		return nil, err
+	}
+	var gl int64
+	if err := tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM gl_entries WHERE tenant_id = $1", tenantID).Scan(&gl); err != nil {
+		return nil, err
+	}
+	var overdrawn int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM accounts WHERE tenant_id = $1 AND balance < -overdraft_limit", tenantID).Scan(&overdrawn); err != nil {
+		return nil, err
+	}
+
+	return []*invariantResult{
+		{
+			Name:     "balances_match_ledger",
+			TenantID: tenantID,
+			OK:       balances == ledger,
+			Detail:   fmt.Sprintf("balances sum to %d, ledger sums to %d", balances, ledger),
+		},
+		{
+			Name:     "balances_match_external_flows",
+			TenantID: tenantID,
+			OK:       balances == external,
+			Detail:   fmt.Sprintf("balances sum to %d, deposits minus withdrawals sum to %d", balances, external),
+		},
+		{
+			Name:     "books_balance",
+			TenantID: tenantID,
+			OK:       ledger+gl == 0,
+			Detail:   fmt.Sprintf("customer ledger sums to %d, GL offsets sum to %d", ledger, gl),
+		},
+		{
+			Name:     "no_unauthorized_overdrafts",
+			TenantID: tenantID,
+			OK:       overdrawn == 0,
+			Detail:   fmt.Sprintf("%d accounts below their overdraft limit", overdrawn),
+		},
+	}, nil
+}
+
+// GetAdmins returns the admin accounts of a tenant.
+func (s *PostgresStorage) GetAdmins(tenantID int) ([]*account, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, email, name FROM accounts WHERE tenant_id = $1 AND role = $2", tenantID, roleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	admins := make([]*account, 0)
+	for rows.Next() {
+		a := &account{}
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.Email, &a.Name); err != nil {
+			return nil, err
+		}
+		admins = append(admins, a)
+	}
+	return admins, rows.Err()
+}
+
+// invariantAuditor keeps the latest invariant results in memory.
+type invariantAuditor struct {
+	mu      sync.RWMutex
+	results []*invariantResult
+	checked time.Time
+}
+
+// runInvariantChecks checks every tenant, records metrics and alerts the
+// tenant's admins about each violated invariant.
+func (s *Apiserver) runInvariantChecks() []*invariantResult {
+	tenants, err := s.store.GetTenants()
+	if err != nil {
+		logf("invariants: failed to load tenants: %v\n", err)
+		return nil
+	}
+
+	all := make([]*invariantResult, 0)
+	for _, t := range tenants {
+		results, err := s.store.CheckInvariants(t.ID)
+		if err != nil {
+			logf("invariants: tenant %s failed: %v\n", t.Slug, err)
+			continue
+		}
+		invariantChecks.Add(1)
+		for _, res := range results {
+			if res.OK {
+				continue
+			}
+			invariantViolations.Add(res.Name, 1)
+			s.alertAdmins(t.ID, fmt.Sprintf("Invariant %s violated: %s", res.Name, res.Detail))
+		}
+		all = append(all, results...)
+	}
+
+	s.auditor.mu.Lock()
+	s.auditor.results, s.auditor.checked = all, time.Now()
+	s.auditor.mu.Unlock()
+	return all
+}
+
+// alertAdmins logs an alert and notifies every admin of the tenant.
+func (s *Apiserver) alertAdmins(tenantID int, message string) {
+	logf("ALERT tenant %d: %s\n", tenantID, message)
+	admins, err := s.store.GetAdmins(tenantID)
+	if err != nil {
+		logf("failed to load admins of tenant %d: %v\n", tenantID, err)
+		return
+	}
+	for _, admin := range admins {
+		s.notify(admin.ID, "alert", message)
+	}
+}
+
+// startInvariantAuditor checks the invariants in the background on a fixed
+// interval. A zero interval disables the auditor.
+func (s *Apiserver) startInvariantAuditor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.runInvariantChecks()
+		}
+	}()
+}
+
+// handleInvariants returns the latest results of the caller's tenant (GET)
+// or runs the checks right away (POST).
+func (s *Apiserver) handleInvariants(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "POST" {
+		s.runInvariantChecks()
+	}
+
+	s.auditor.mu.RLock()
+	defer s.auditor.mu.RUnlock()
+	tenantID := requestTenant(r).ID
+	results := make([]*invariantResult, 0)
+	for _, res := range s.auditor.results {
+		if res.TenantID == tenantID {
+			results = append(results, res)
+		}
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{"checked_at": s.auditor.checked, "results": results})
+}
+
+// handleMetrics exposes the expvar counters to admins. The counters are
+// the whole process's, across tenants, so only admins of the default
+// tenant see them.
+func (s *Apiserver) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "metrics_default_only")
+	}
+	expvar.Handler().ServeHTTP(w, r)
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createInvoicesTable = `
+        CREATE TABLE IF NOT EXISTS invoices (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            reference TEXT UNIQUE NOT NULL,
+            issuer_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            customer_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            description TEXT NOT NULL DEFAULT '',
+            total INT NOT NULL CHECK (total > 0),
+            currency TEXT NOT NULL,
+            due_date DATE NOT NULL,
+            status TEXT NOT NULL DEFAULT 'open',
+            paid_transfer_id INT REFERENCES transfers(id),
+            paid_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createInvoiceLinesTable = `
+        CREATE TABLE IF NOT EXISTS invoice_lines (
+            id SERIAL PRIMARY KEY,
+            invoice_id INT NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+            description TEXT NOT NULL,
+            quantity INT NOT NULL CHECK (quantity > 0),
+            unit_amount INT NOT NULL CHECK (unit_amount > 0),
+            amount INT NOT NULL
+        )
+    `
+
+// maxInvoiceLines caps the line items of an invoice.
+const maxInvoiceLines = 100
+
+// invoiceReferencePrefix starts every invoice reference, e.g.
+// INV-20240115-7KQ3M9XA.
+const invoiceReferencePrefix = "INV-"
+
+// Invoice statuses. Overdue is not stored: an open invoice is reported as
+// overdue once its due date has passed.
+const (
+	invoiceOpen    = "open"
+	invoiceOverdue = "overdue"
+	invoicePaid    = "paid"
+)
+
+var errInvoiceNotOpen = errors.New("invoice is not open")
+
+// invoice bills a customer for line items on behalf of a business account.
+// The customer pays it with a transfer to the issuer quoting the invoice
+// reference in its memo; such a transfer for the full total marks the
+// invoice paid, whichever way it was made.
+type invoice struct {
+	ID             int            `json:"id"`
+	TenantID       int            `json:"tenant_id"`
+	Reference      string         `json:"reference"`
+	IssuerID       int            `json:"issuer_id"`
+	CustomerID     int            `json:"customer_id"`
+	Description    string         `json:"description"`
+	Lines          []*invoiceLine `json:"lines"`
+	Total          int            `json:"total"`
+	Currency       string         `json:"currency"`
+	DueDate        string         `json:"due_date"`
+	Status         string         `json:"status"`
+	PaidTransferID *int           `json:"paid_transfer_id,omitempty"`
+	PaidAt         *time.Time     `json:"paid_at,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+type invoiceLine struct {
+	ID          int    `json:"id"`
+	InvoiceID   int    `json:"invoice_id"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitAmount  int    `json:"unit_amount"`
+	Amount      int    `json:"amount"`
+}
+
+type InvoiceLineRequest struct {
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitAmount  int    `json:"unit_amount"`
+}
+
+type CreateInvoiceRequest struct {
+	CustomerEmail  string               `json:"customer_email"`
+	CustomerNumber string               `json:"customer_number"`
+	Description    string               `json:"description"`
+	DueDate        string               `json:"due_date"`
+	Lines          []InvoiceLineRequest `json:"lines"`
+}
+
+// InvoiceStorage holds the invoicing storage operations.
+type InvoiceStorage interface {
+	CreateInvoice(*invoice) error
+	GetInvoice(id int) (*invoice, error)
+	GetInvoicesByAccount(accountID int, issued bool, page pageRequest) ([]*invoice, int, error)
+	PayInvoice(id int, t *transfer) error
+}
+
+// CreateInvoice inserts an invoice with its lines.
+func (s *PostgresStorage) CreateInvoice(inv *invoice) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO invoices (tenant_id, reference, issuer_id, customer_id, description, total, currency, due_date, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at",
+		inv.TenantID, inv.Reference, inv.IssuerID, inv.CustomerID, inv.Description, inv.Total, inv.Currency, inv.DueDate, inv.Status,
+	).Scan(&inv.ID, &inv.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, line := range inv.Lines {
+		line.InvoiceID = inv.ID
+		err := tx.QueryRow(
+			"INSERT INTO invoice_lines (invoice_id, description, quantity, unit_amount, amount) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			line.InvoiceID, line.Description, line.Quantity, line.UnitAmount, line.Amount,
+		).Scan(&line.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const selectInvoices = "SELECT id, tenant_id, reference, issuer_id, customer_id, description, total, currency, to_char(due_date, 'YYYY-MM-DD'), status, paid_transfer_id, paid_at, created_at FROM invoices "
+
+// GetInvoice retrieves an invoice with its lines.
+func (s *PostgresStorage) GetInvoice(id int) (*invoice, error) {
+	invoices, err := s.queryInvoices("WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(invoices) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return invoices[0], nil
+}
+
+// GetInvoicesByAccount returns a page of the invoices an account issued or,
+// unless issued, received, newest first, and their total count.
+func (s *PostgresStorage) GetInvoicesByAccount(accountID int, issued bool, page pageRequest) ([]*invoice, int, error) {
+	column := "customer_id"
+	if issued {
+		column = "issuer_id"
+	}
+	total, err := s.count("SELECT COUNT(*) FROM invoices WHERE "+column+" = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	invoices, err := s.queryInvoices("WHERE "+column+" = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return invoices, total, err
+}
+
+// queryInvoices loads invoices and, in one more query, their lines.
+func (s *PostgresStorage) queryInvoices(where string, args ...any) ([]*invoice, error) {
+	rows, err := s.db.Query(selectInvoices+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoices := make([]*invoice, 0)
+	byID := map[int]*invoice{}
+	ids := []int{}
+	for rows.Next() {
+		inv := &invoice{Lines: []*invoiceLine{}}
+		err := rows.Scan(&inv.ID, &inv.TenantID, &inv.Reference, &inv.IssuerID, &inv.CustomerID, &inv.Description, &inv.Total, &inv.Currency, &inv.DueDate, &inv.Status, &inv.PaidTransferID, &inv.PaidAt, &inv.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, inv)
+		byID[inv.ID] = inv
+		ids = append(ids, inv.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return invoices, nil
+	}
+
+	lineRows, err := s.db.Query("SELECT id, invoice_id, description, quantity, unit_amount, amount FROM invoice_lines WHERE invoice_id = ANY($1) ORDER BY id", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer lineRows.Close()
+	for lineRows.Next() {
+		line := &invoiceLine{}
+		if err := lineRows.Scan(&line.ID, &line.InvoiceID, &line.Description, &line.Quantity, &line.UnitAmount, &line.Amount); err != nil {
+			return nil, err
+		}
+		byID[line.InvoiceID].Lines = append(byID[line.InvoiceID].Lines, line)
+	}
+	return invoices, lineRows.Err()
+}
+
+// PayInvoice makes the transfer paying an open invoice, which marks it paid
+// through matchInvoice, all or nothing.
+func (s *PostgresStorage) PayInvoice(id int, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM invoices WHERE id = $1 FOR UPDATE", id).Scan(&status); err != nil {
+		return err
+	}
+	if status != invoiceOpen {
+		return errInvoiceNotOpen
+	}
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	if t.invoiceID != id {
+		return fmt.Errorf("transfer %s did not match invoice %d", t.Reference, id)
+	}
+	return tx.Commit()
+}
+
+// matchInvoice marks the open invoice a transfer pays as paid, within the
+// transfer's transaction: one issued by the recipient for exactly the
+// amount, whose reference the memo quotes. Other transfers are left alone.
+func matchInvoice(tx *sql.Tx, t *transfer) error {
+	if !strings.Contains(strings.ToUpper(t.Memo), invoiceReferencePrefix) {
+		return nil
+	}
+	err := tx.QueryRow(`
+        UPDATE invoices SET status = $1, paid_transfer_id = $2, paid_at = $3
+        WHERE id = (
+            SELECT id FROM invoices
+            WHERE tenant_id = $4 AND issuer_id = $5 AND status = $6 AND total = $7 AND currency = $8
+                AND strpos(upper($9), reference) > 0
+            ORDER BY id LIMIT 1 FOR UPDATE
+        )
+        RETURNING id`,
+		invoicePaid, t.ID, t.CreatedAt, t.TenantID, t.ToAccountID, invoiceOpen, t.Amount, t.Currency, t.Memo,
+	).Scan(&t.invoiceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// present fills in the status an invoice is reported with.
+func (inv *invoice) present(now time.Time) *invoice {
+	if inv.Status == invoiceOpen && inv.DueDate < now.UTC().Format(time.DateOnly) {
+		inv.Status = invoiceOverdue
+	}
+	return inv
+}
+
+// handleInvoices lists the invoices the caller issued, or with
+// ?role=customer received (GET), or issues a new invoice (POST). Only
+// business accounts, i.e. those registered as merchants, issue invoices.
+func (s *Apiserver) handleInvoices(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		issued := r.URL.Query().Get("role") != "customer"
+		invoices, total, err := s.store.GetInvoicesByAccount(caller.ID, issued, page)
+		if err != nil {
+			return err
+		}
+		for _, inv := range invoices {
+			inv.present(clock.Now())
+		}
+		return writeJSON(w, http.StatusOK, paginate(invoices, total, page, func(inv *invoice) cursor { return cursor{inv.CreatedAt, inv.ID} }))
+	}
+
+	if _, err := s.store.GetMerchantByAccount(caller.ID); err != nil {
+		return newAPIError(http.StatusForbidden, "business_account_required")
+	}
+	req := CreateInvoiceRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.Lines) == 0 || len(req.Lines) > maxInvoiceLines {
+		return newAPIError(http.StatusBadRequest, "invoice_lines_range", maxInvoiceLines)
+	}
+	due, err := time.Parse(time.DateOnly, req.DueDate)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_date", req.DueDate)
+	}
+	if due.Format(time.DateOnly) < clock.Now().UTC().Format(time.DateOnly) {
+		return newAPIError(http.StatusBadRequest, "due_date_past", req.DueDate)
+	}
+	customer, err := s.resolveParticipant(caller.TenantID, SplitParticipant{Email: req.CustomerEmail, Number: req.CustomerNumber})
+	if err != nil {
+		return err
+	}
+	if customer.ID == caller.ID {
+		return newAPIError(http.StatusBadRequest, "same_account_transfer")
+	}
+	if customer.Currency != caller.Currency {
+		return newAPIError(http.StatusBadRequest, "currency_mismatch", caller.Currency, customer.Currency)
+	}
+
+	reference, err := newReference(invoiceReferencePrefix, clock.Now())
+	if err != nil {
+		return err
+	}
+	inv := &invoice{
+		TenantID:    caller.TenantID,
+		Reference:   reference,
+		IssuerID:    caller.ID,
+		CustomerID:  customer.ID,
+		Description: strings.TrimSpace(req.Description),
+		Currency:    caller.Currency,
+		DueDate:     req.DueDate,
+		Status:      invoiceOpen,
+	}
+	for _, l := range req.Lines {
+		description := strings.TrimSpace(l.Description)
+		if description == "" {
+			return newAPIError(http.StatusBadRequest, "required_field", "line description")
+		}
+		if l.Quantity <= 0 || l.UnitAmount <= 0 {
+			return newAPIError(http.StatusBadRequest, "invalid_amount")
+		}
+		amount := l.Quantity * l.UnitAmount
+		inv.Lines = append(inv.Lines, &invoiceLine{Description: description, Quantity: l.Quantity, UnitAmount: l.UnitAmount, Amount: amount})
+		inv.Total += amount
+	}
+	if err := s.store.CreateInvoice(inv); err != nil {
+		return err
+	}
+
+	s.audit(r, "invoice.created", "invoice", inv.ID, inv)
+	s.notify(customer.ID, "invoice_received", fmt.Sprintf("%s sent you invoice %s for %s, due %s. Pay: POST /invoices/%d/pay, or transfer the amount quoting %s",
+		caller.Name, inv.Reference, formatMoney(inv.Total, inv.Currency, defaultLocale), inv.DueDate, inv.ID, inv.Reference))
+	return writeJSON(w, http.StatusCreated, inv)
+}
+
+// handleGetInvoice returns an invoice to its issuer or customer.
+func (s *Apiserver) handleGetInvoice(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	inv, err := s.store.GetInvoice(id)
+	if err != nil || (inv.IssuerID != caller.ID && inv.CustomerID != caller.ID) {
+		return newAPIError(http.StatusNotFound, "invoice_not_found", id)
+	}
+	return writeJSON(w, http.StatusOK, inv.present(clock.Now()))
+}
+
+// handlePayInvoice pays an invoice addressed to the caller in full.
+func (s *Apiserver) handlePayInvoice(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	inv, err := s.store.GetInvoice(id)
+	if err != nil || inv.CustomerID != caller.ID {
+		return newAPIError(http.StatusNotFound, "invoice_not_found", id)
+	}
+	if inv.Status != invoiceOpen {
+		return newAPIError(http.StatusConflict, "invoice_already_paid", inv.Reference)
+	}
+
+	t, err := s.newTransfer(caller, inv.IssuerID, inv.Total, inv.Reference)
+	if err != nil {
+		return err
+	}
+	if err := s.checkTrustedPayee(caller.ID, inv.IssuerID); err != nil {
+		return err
+	}
+	if err := s.checkCosignerThreshold(caller.ID, t.Amount); err != nil {
+		return err
+	}
+	if err := s.store.PayInvoice(inv.ID, t); errors.Is(err, errInvoiceNotOpen) {
+		return newAPIError(http.StatusConflict, "invoice_already_paid", inv.Reference)
+	} else if err != nil {
+		return transferFailed(err)
+	}
+	s.transferCompleted(t)
+	return writeJSON(w, http.StatusOK, t)
+}
+
+// notifyInvoicePaid tells the issuer that a transfer paid one of their
+// invoices.
+func (s *Apiserver) notifyInvoicePaid(t *transfer) {
+	inv, err := s.store.GetInvoice(t.invoiceID)
+	if err != nil {
+		logf("failed to load paid invoice %d: %v\n", t.invoiceID, err)
+		return
+	}
+	s.notify(inv.IssuerID, "invoice_paid", fmt.Sprintf("Invoice %s for %s was paid (transfer %s)", inv.Reference, formatMoney(inv.Total, inv.Currency, defaultLocale), t.Reference))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Jobs track work that outlasts its request, such as statement exports and
+// transaction imports. The request answers 202 with the job, which clients
+// poll at /jobs/{id} or follow as server-sent events at /jobs/{id}/events.
+// Jobs run in the instance that started them, which keeps their heartbeat
+// up; jobs whose instance stopped without finishing them are failed once
+// their heartbeat goes stale.
+const createJobsTable = `
+        CREATE TABLE IF NOT EXISTS jobs (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            kind TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'queued',
+            progress INT NOT NULL DEFAULT 0,
+            error TEXT NOT NULL DEFAULT '',
+            result JSONB,
+            file_key TEXT NOT NULL DEFAULT '',
+            filename TEXT NOT NULL DEFAULT '',
+            content_type TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            started_at TIMESTAMPTZ,
+            finished_at TIMESTAMPTZ,
+            heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Kinds of job.
+const (
+	jobStatementExport    = "statement_export"
+	jobTransactionsImport = "transactions_import"
+)
+
+// maxRunningJobs bounds the jobs an instance runs at once; the rest wait
+// queued.
+const maxRunningJobs = 4
+
+// jobPollInterval is how often the event stream of a job checks on it.
+const jobPollInterval = 500 * time.Millisecond
+
+// jobHeartbeat is how often an unfinished job is marked alive. Jobs not
+// marked for jobStaleAfter were abandoned by their instance.
+const (
+	jobHeartbeat  = time.Minute
+	jobStaleAfter = 5 * jobHeartbeat
+)
+
+// job is a unit of background work started by an account holder. Progress
+// is a percentage. Download is set once a finished job has a file.
+type job struct {
+	ID          int             `json:"id"`
+	TenantID    int             `json:"tenant_id"`
+	AccountID   int             `json:"account_id"`
+	Kind        string          `json:"kind"`
+	Status      string          `json:"status"`
+	Progress    int             `json:"progress"`
+	Error       string          `json:"error,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Download    string          `json:"download,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	fileKey     string
+	filename    string
+	contentType string
+}
+
+func (j *job) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed
+}
+
+// JobStorage holds the job storage operations.
+type JobStorage interface {
+	CreateJob(*job) error
+	GetJob(id int) (*job, error)
+	UpdateJob(*job) error
+	TouchJob(id int, now time.Time) error
+	// FailStaleJobs fails the unfinished jobs without a heartbeat since
+	// before and returns how many.
+	FailStaleJobs(before time.Time, reason string, now time.Time) (int, error)
+}
+
+func (s *PostgresStorage) CreateJob(j *job) error {
+	return s.db.QueryRow(
+		"INSERT INTO jobs (tenant_id, account_id, kind, status, created_at, heartbeat_at) VALUES ($1, $2, $3, $4, $5, $5) RETURNING id",
+		j.TenantID, j.AccountID, j.Kind, j.Status, j.CreatedAt,
+	).Scan(&j.ID)
+}
+
+func (s *PostgresStorage) GetJob(id int) (*job, error) {
+	j := &job{}
+	var result []byte
+	err := s.db.QueryRow(`
+        SELECT id, tenant_id, account_id, kind, status, progress, error, result, file_key, filename, content_type, created_at, started_at, finished_at
+        FROM jobs WHERE id = $1`, id,
+	).Scan(&j.ID, &j.TenantID, &j.AccountID, &j.Kind, &j.Status, &j.Progress, &j.Error, &result, &j.fileKey, &j.filename, &j.contentType, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	j.Result = result
+	if j.fileKey != "" {
+		j.Download = fmt.Sprintf("/jobs/%d/file", j.ID)
+	}
+	return j, nil
+}
+
+func (s *PostgresStorage) UpdateJob(j *job) error {
+	var result any
+	if j.Result != nil {
+		result = []byte(j.Result)
+	}
+	_, err := s.db.Exec(`
+        UPDATE jobs SET status = $2, progress = $3, error = $4, result = $5, file_key = $6, filename = $7, content_type = $8, started_at = $9, finished_at = $10
+        WHERE id = $1`,
+		j.ID, j.Status, j.Progress, j.Error, result, j.fileKey, j.filename, j.contentType, j.StartedAt, j.FinishedAt,
+	)
+	return err
+}
+
+func (s *PostgresStorage) TouchJob(id int, now time.Time) error {
+	_, err := s.db.Exec("UPDATE jobs SET heartbeat_at = $2 WHERE id = $1", id, now)
+	return err
+}
+
+func (s *PostgresStorage) FailStaleJobs(before time.Time, reason string, now time.Time) (int, error) {
+	res, err := s.db.Exec("UPDATE jobs SET status = 'failed', error = $2, finished_at = $3 WHERE status IN ('queued', 'running') AND heartbeat_at < $1", before, reason, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// jobRun is a running job as its work sees it.
+type jobRun struct {
+	s   *Apiserver
+	job *job
+}
+
+// progress records the percentage of the work done so far.
+func (run *jobRun) progress(percent int) {
+	if percent <= run.job.Progress || percent >= 100 {
+		return
+	}
+	run.job.Progress = percent
+	if err := run.s.store.UpdateJob(run.job); err != nil {
+		logf("job %d: failed to record progress: %v\n", run.job.ID, err)
+	}
+}
+
+// result records what the job produced.
+func (run *jobRun) result(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	run.job.Result = data
+	return nil
+}
+
+// file stores a file for the job holder to download once it is done.
+func (run *jobRun) file(filename, contentType string, data []byte) error {
+	key := fmt.Sprintf("jobs/%d/%d/%s", run.job.TenantID, run.job.ID, filename)
+	if err := run.s.files.Put(key, data); err != nil {
+		return err
+	}
+	run.job.fileKey, run.job.filename, run.job.contentType = key, filename, contentType
+	return nil
+}
+
+// startJob queues work as a job of kind for the account and runs it in the
+// background.
+func (s *Apiserver) startJob(kind string, acc *account, work func(*jobRun) error) (*job, error) {
+	j := &job{TenantID: acc.TenantID, AccountID: acc.ID, Kind: kind, Status: jobQueued, CreatedAt: clock.Now()}
+	if err := s.store.CreateJob(j); err != nil {
+		return nil, err
+	}
+	go s.runJob(&jobRun{s: s, job: j}, work)
+	return j, nil
+}
+
+func (s *Apiserver) runJob(run *jobRun, work func(*jobRun) error) {
+	j := run.job
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.store.TouchJob(j.ID, clock.Now()); err != nil {
+					logf("job %d: failed to record heartbeat: %v\n", j.ID, err)
+				}
+			}
+		}
+	}()
+
+	s.jobSlots <- struct{}{}
+	defer func() { <-s.jobSlots }()
+
+	started := clock.Now()
+	j.Status, j.StartedAt = jobRunning, &started
+	if err := s.store.UpdateJob(j); err != nil {
+		logf("job %d: failed to start: %v\n", j.ID, err)
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("job panicked: %v", v)
+			}
+		}()
+		return work(run)
+	}()
+	finished := clock.Now()
+	j.FinishedAt = &finished
+	if err != nil {
+		j.Status, j.Error = jobFailed, err.Error()
+		logf("job %d (%s) failed: %v\n", j.ID, j.Kind, err)
+	} else {
+		j.Status, j.Progress = jobDone, 100
+	}
+	if err := s.store.UpdateJob(j); err != nil {
+		logf("job %d: failed to record outcome: %v\n", j.ID, err)
+	}
+}
+
+// failStaleJobs fails the jobs whose instance stopped running them.
+func (s *Apiserver) failStaleJobs() {
+	now := clock.Now()
+	n, err := s.store.FailStaleJobs(now.Add(-jobStaleAfter), "abandoned by a stopped server", now)
+	if err != nil {
+		logf("jobs: failed to fail stale jobs: %v\n", err)
+	} else if n > 0 {
+		infof("jobs: failed %d stale jobs\n", n)
+	}
+}
+
+// startJobSweeper fails stale jobs in the background.
+func (s *Apiserver) startJobSweeper() {
+	go func() {
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.failStaleJobs()
+		}
+	}()
+}
+
+// writeJobAccepted answers a request that started a job.
+func writeJobAccepted(w http.ResponseWriter, j *job) error {
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", j.ID))
+	return writeJSON(w, http.StatusAccepted, j)
+}
+
+// callerJob loads the job in the {id} path if the caller started it or is
+// an admin of its tenant.
+func (s *Apiserver) callerJob(r *http.Request) (*job, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.store.GetJob(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, newAPIError(http.StatusNotFound, "job_not_found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	caller := requestCaller(r)
+	if j.TenantID != requestTenant(r).ID || (j.AccountID != caller.accountID && !caller.admin) {
+		return nil, newAPIError(http.StatusNotFound, "job_not_found", id)
+	}
+	return j, nil
+}
+
+// handleGetJob returns the status of a job.
+func (s *Apiserver) handleGetJob(w http.ResponseWriter, r *http.Request) error {
+	j, err := s.callerJob(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, j)
+}
+
+// handleJobEvents streams the status of a job as server-sent events, one
+// "status" event when it changes, until the job finishes or the request
+// times out. EventSource clients reconnect on their own after a timeout.
+func (s *Apiserver) handleJobEvents(w http.ResponseWriter, r *http.Request) error {
+	j, err := s.callerJob(r)
+	if err != nil {
+		return err
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		data, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		if string(data) != string(last) {
+			if _, err := fmt.Fprintf(w, "event: status\nid: %d\ndata: %s\n\n", j.ID, data); err != nil {
+				return nil
+			}
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+			last = data
+		}
+		if j.finished() {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+		next, err := s.store.GetJob(j.ID)
+		if err != nil {
+			logf("job %d: event stream failed: %v\n", j.ID, err)
+			return nil
+		}
+		j = next
+	}
+}
+
+// handleJobFile downloads the file a finished job produced.
+func (s *Apiserver) handleJobFile(w http.ResponseWriter, r *http.Request) error {
+	j, err := s.callerJob(r)
+	if err != nil {
+		return err
+	}
+	if j.Status != jobDone || j.fileKey == "" {
+		return newAPIError(http.StatusConflict, "job_file_unavailable", j.ID)
+	}
+	data, err := s.files.Get(j.fileKey)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", j.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", j.filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a private key tokens can be signed with. Its public half is
+// published through /.well-known/jwks.json under id, the kid header of the
+// tokens it signs.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// signingKeys enables asymmetric signing when set. The first key signs new
+// tokens; the others are retired keys still accepted and published until the
+// tokens they signed have expired. Without keys tokens are signed with the
+// shared secretKey.
+var signingKeys []*signingKey
+
+// loadSigningKeys reads PEM encoded RSA or P-256 private keys from a comma
+// separated list of files.
+func loadSigningKeys(files string) ([]*signingKey, error) {
+	keys := []*signingKey{}
+	for _, path := range strings.Split(files, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		k, err := parseSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func parseSigningKey(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	var private any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &signingKey{}
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		k.method, k.private = jwt.SigningMethodRS256, key
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		k.method, k.private = jwt.SigningMethodES256, key
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	der, err := x509.MarshalPKIXPublicKey(k.private.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	k.id = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return k, nil
+}
+
+// tokenMethods lists the algorithms tokens are accepted with.
+func tokenMethods() []string {
+	if len(signingKeys) == 0 {
+		return []string{jwt.SigningMethodHS256.Alg()}
+	}
+	methods := []string{}
+	for _, k := range signingKeys {
+		methods = append(methods, k.method.Alg())
+	}
+	return methods
+}
+
+// verificationKey is the jwt.Keyfunc of parseToken: the public key named
+// by the kid header, or the shared secret when signing is symmetric.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if len(signingKeys) == 0 {
+		return secretKey, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	for _, k := range signingKeys {
+		if k.id == kid && k.method.Alg() == token.Method.Alg() {
+			return k.private.Public(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func (k *signingKey) jwk() jwk {
+	b64 := func(n *big.Int, size int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, max(size, (n.BitLen()+7)/8))))
+	}
+	key := jwk{Kid: k.id, Use: "sig", Alg: k.method.Alg()}
+	switch pub := k.private.Public().(type) {
+	case *rsa.PublicKey:
+		key.Kty, key.N, key.E = "RSA", b64(pub.N, 0), b64(big.NewInt(int64(pub.E)), 0)
+	case *ecdsa.PublicKey:
+		key.Kty, key.Crv, key.X, key.Y = "EC", "P-256", b64(pub.X, 32), b64(pub.Y, 32)
+	}
+	return key
+}
+
+// handleJWKS publishes the public keys tokens are signed with, so other
+// services can verify bank-issued tokens without sharing a secret. It is
+// only available with asymmetric signing.
+func (s *Apiserver) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	if len(signingKeys) == 0 {
+		return newAPIError(http.StatusNotFound, "jwks_disabled")
+	}
+	keys := make([]jwk, 0, len(signingKeys))
+	for _, k := range signingKeys {
+		keys = append(keys, k.jwk())
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return encodeJSON(w, http.StatusOK, map[string][]jwk{"keys": keys})
+}
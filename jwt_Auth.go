@@ -2,7 +2,10 @@ package main
 
 // LoginService to provide user login with JWT token support
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -12,28 +15,114 @@ var (
 	secretKey = []byte("secret -key")
 )
 
-func CreateToken(email string) (string, error) {
+// Token types, carried in the typ claim so a refresh token is never
+// accepted where an access token is expected, or the other way round.
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+)
+
+// tokenSettings are the issuer, lifetimes and clock skew tolerance of the
+// tokens this server issues and accepts. main overrides them from the
+// config.
+var tokenSettings = struct {
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	Leeway     time.Duration
+}{
+	Issuer:     "go_backend_bank",
+	AccessTTL:  24 * time.Hour,
+	RefreshTTL: 30 * 24 * time.Hour,
+	Leeway:     30 * time.Second,
+}
+
+// CreateToken issues an access token for an account of a tenant.
+func CreateToken(acc *account, t *tenant) (string, error) {
+	return signToken(acc, t, tokenAccess, tokenSettings.AccessTTL)
+}
+
+// createRefreshToken issues a long-lived token that can only be exchanged
+// for new access tokens.
+func createRefreshToken(acc *account, t *tenant) (string, error) {
+	return signToken(acc, t, tokenRefresh, tokenSettings.RefreshTTL)
+}
+
+func signToken(acc *account, t *tenant, typ string, ttl time.Duration) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := clock.Now()
 	claims := jwt.MapClaims{
-		"email": email,
-		"exp":   time.Now().Add(time.Hour * 24).Unix(),
+		"email":  acc.Email,
+		"role":   acc.Role,
+		"tenant": t.ID,
+		"typ":    typ,
+		"iss":    tokenSettings.Issuer,
+		"aud":    t.JWTAudience,
+		"sub":    strconv.Itoa(acc.ID),
+		"jti":    hex.EncodeToString(jti),
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    now.Add(ttl).Unix(),
+	}
+	return signClaims(claims)
+}
+
+// signClaims signs claims with the current signing key, or the shared
+// secret when signing is symmetric.
+func signClaims(claims jwt.Claims) (string, error) {
+	var tokenString string
+	var err error
+	if len(signingKeys) > 0 {
+		k := signingKeys[0]
+		token := jwt.NewWithClaims(k.method, claims)
+		token.Header["kid"] = k.id
+		tokenString, err = token.SignedString(k.private)
+	} else {
+		tokenString, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretKey)
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(secretKey)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %v", err)
 	}
 	return tokenString, nil
 }
 
-func verifyToken(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
+// verifyToken checks that an access token is signed by us, was issued by us
+// for the given audience and is within its lifetime, give or take the
+// clock skew tolerance.
+func verifyToken(tokenString string, audience string) (jwt.MapClaims, error) {
+	return parseToken(tokenString, audience, tokenAccess)
+}
+
+// verifyRefreshToken is verifyToken for refresh tokens.
+func verifyRefreshToken(tokenString string, audience string) (jwt.MapClaims, error) {
+	return parseToken(tokenString, audience, tokenRefresh)
+}
+
+func parseToken(tokenString, audience, typ string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, verificationKey,
+		jwt.WithValidMethods(tokenMethods()),
+		jwt.WithAudience(audience),
+		jwt.WithIssuer(tokenSettings.Issuer),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(tokenSettings.Leeway),
+		jwt.WithTimeFunc(clock.Now),
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !token.Valid {
-		return fmt.Errorf("Invalid token")
+		return nil, fmt.Errorf("Invalid token")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("Invalid token claims")
+	}
+	if claims["typ"] != typ {
+		return nil, fmt.Errorf("not an %s token", typ)
 	}
-	return nil
+	return claims, nil
 }
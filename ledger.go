@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createLedgerEntriesTable = `
+        CREATE TABLE IF NOT EXISTS ledger_entries (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL,
+            balance_after INT NOT NULL,
+            kind TEXT NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Ledger entry kinds.
+const (
+	entryOpening    = "opening"
+	entryAdjustment = "adjustment"
+)
+
+var errInsufficientFunds = errors.New("insufficient funds")
+
+// ledgerEntry is a single signed movement on an account. Credits are
+// positive, debits negative; the account balance is always the sum of its
+// entries.
+type ledgerEntry struct {
+	ID           int         `json:"id"`
+	AccountID    int         `json:"account_id"`
+	Amount       int         `json:"amount"`
+	BalanceAfter int         `json:"balance_after"`
+	Kind         string      `json:"kind"`
+	Description  string      `json:"description"`
+	Reference    string      `json:"reference,omitempty"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Enrichment   *enrichment `json:"enrichment,omitempty"`
+	Note         string      `json:"note,omitempty"`
+	Tags         []string    `json:"tags,omitempty"`
+	// Splits allocate the entry to several categories, overriding the
+	// category of its enrichment in the spending breakdown.
+	Splits []categorySplit `json:"splits,omitempty"`
+}
+
+// LedgerStorage holds the ledger storage operations.
+type LedgerStorage interface {
+	PostLedgerEntries(...*ledgerEntry) error
+	GetLedgerEntries(accountID int, page pageRequest) ([]*ledgerEntry, int, error)
+	GetLedgerEntry(id int) (*ledgerEntry, error)
+}
+
+// PostLedgerEntries applies the entries to their account balances and
+// records them, all or nothing.
+func (s *PostgresStorage) PostLedgerEntries(entries ...*ledgerEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := postEntries(tx, entries...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postEntries is the single place balances change. It runs inside the
+// caller's transaction so other records can be written atomically with the
+// money movement. Entries that bring money in or take it out get their GL
+// offset posted alongside, keeping the books double-entry. Debits that would
+// take the available balance (the balance less the funds set aside in pots)
+// below the account's overdraft limit fail with errInsufficientFunds, and
+// entries dated into a day the end-of-day close has already closed fail with
+// errDayClosed. Entries are dated by the process clock.
+func postEntries(tx *sql.Tx, entries ...*ledgerEntry) error {
+	now := clock.Now()
+	for _, e := range entries {
+		var tenantID, overdraftLimit, potFunds int
+		var dayClosed bool
+		err := tx.QueryRow(`
+            UPDATE accounts SET balance = balance + $1 WHERE id = $2
+            RETURNING tenant_id, balance, overdraft_limit,
+                (SELECT COALESCE(SUM(balance), 0) FROM pots WHERE account_id = $2),
+                EXISTS (SELECT 1 FROM ledger_days WHERE tenant_id = accounts.tenant_id AND day >= ($3 AT TIME ZONE 'UTC')::date)`,
+			e.Amount, e.AccountID, now,
+		).Scan(&tenantID, &e.BalanceAfter, &overdraftLimit, &potFunds, &dayClosed)
+		if err != nil {
+			return err
+		}
+		if dayClosed {
+			return errDayClosed
+		}
+		if e.Amount < 0 && e.BalanceAfter-potFunds < -overdraftLimit {
+			return errInsufficientFunds
+		}
+		err = tx.QueryRow(
+			"INSERT INTO ledger_entries (account_id, amount, balance_after, kind, description, reference, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+			e.AccountID, e.Amount, e.BalanceAfter, e.Kind, e.Description, e.Reference, now,
+		).Scan(&e.ID, &e.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if err := postGLOffset(tx, tenantID, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLedgerEntries returns a page of an account's entries, newest first,
+// and their total count. Entries carry their stored enrichment, if any.
+func (s *PostgresStorage) GetLedgerEntries(accountID int, page pageRequest) ([]*ledgerEntry, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM ledger_entries WHERE account_id = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "e")
+	entries, err := s.queryLedgerEntries("WHERE e.account_id = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return entries, total, err
+}
+
+// GetLedgerEntry retrieves an entry with its stored enrichment.
+func (s *PostgresStorage) GetLedgerEntry(id int) (*ledgerEntry, error) {
+	entries, err := s.queryLedgerEntries("WHERE e.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return entries[0], nil
+}
+
+// queryLedgerEntries selects entries with their stored enrichment, the
+// holder's note and their category splits, aliased e, n and tn for the
+// condition.
+func (s *PostgresStorage) queryLedgerEntries(where string, args ...any) ([]*ledgerEntry, error) {
+	rows, err := s.db.Query(`
+        SELECT e.id, e.account_id, e.amount, e.balance_after, e.kind, e.description, e.reference, e.created_at,
+            n.counterparty, n.category, n.logo_url, n.enriched_at, COALESCE(tn.note, ''), COALESCE(tn.tags, '{}')
+        FROM ledger_entries e LEFT JOIN ledger_enrichments n ON n.ledger_entry_id = e.id
+        LEFT JOIN transaction_notes tn ON tn.ledger_entry_id = e.id `+where,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*ledgerEntry, 0)
+	for rows.Next() {
+		e := &ledgerEntry{}
+		var counterparty, category, logoURL sql.NullString
+		var enrichedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Amount, &e.BalanceAfter, &e.Kind, &e.Description, &e.Reference, &e.CreatedAt, &counterparty, &category, &logoURL, &enrichedAt, &e.Note, pq.Array(&e.Tags)); err != nil {
+			return nil, err
+		}
+		if enrichedAt.Valid {
+			e.Enrichment = &enrichment{EntryID: e.ID, Counterparty: counterparty.String, Category: category.String, LogoURL: logoURL.String, EnrichedAt: enrichedAt.Time}
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, s.loadCategorySplits(entries)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, most verbose first. Lines written with logf are warnings and
+// always shown; infof lines are routine and debugf lines diagnostic.
+const (
+	logDebug = "debug"
+	logInfo  = "info"
+	logWarn  = "warn"
+)
+
+var logLevels = []string{logDebug, logInfo, logWarn}
+
+// logThreshold is the index in logLevels of the least severe level shown.
+var logThreshold atomic.Int32
+
+func init() {
+	logThreshold.Store(1)
+}
+
+// setLogLevel changes the level of the server log.
+func setLogLevel(level string) error {
+	i := slices.Index(logLevels, level)
+	if i < 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_log_level", level)
+	}
+	logThreshold.Store(int32(i))
+	return nil
+}
+
+func currentLogLevel() string {
+	return logLevels[logThreshold.Load()]
+}
+
+// infof is logf for routine events, hidden at the warn level.
+func infof(format string, args ...any) {
+	if logThreshold.Load() <= 1 {
+		logf(format, args...)
+	}
+}
+
+// debugf is logf for diagnostics, shown only at the debug level.
+func debugf(format string, args ...any) {
+	if logThreshold.Load() == 0 {
+		logf(format, args...)
+	}
+}
+
+// Request captures log the bodies of matching requests for a while, to
+// debug an issue in production without a redeploy.
+const (
+	defaultCaptureTTL = 15 * time.Minute
+	maxCaptureTTL     = time.Hour
+	maxCapturedBody   = 16 << 10
+)
+
+// logCapture logs the requests of an account, to a route, or both.
+type logCapture struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"account_id,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy int       `json:"created_by"`
+}
+
+type CreateLogCaptureRequest struct {
+	AccountID int    `json:"account_id"`
+	Route     string `json:"route"`
+	// Minutes the capture lasts, 15 unless set.
+	Minutes int `json:"minutes"`
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// LoggingStatus is the logging state of the server.
+type LoggingStatus struct {
+	Level    string        `json:"level"`
+	Captures []*logCapture `json:"captures"`
+}
+
+// logCaptures holds the active captures of this instance. Like read-only
+// mode, they are not shared with other instances.
+type logCaptures struct {
+	mu       sync.Mutex
+	nextID   int
+	captures []*logCapture
+	// any is set while captures exist, so requests skip the lock
+	// when nothing is captured.
+	any atomic.Bool
+}
+
+func (c *logCaptures) add(capture *logCapture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	capture.ID = c.nextID
+	c.captures = append(c.captures, capture)
+	c.any.Store(true)
+}
+
+func (c *logCaptures) remove(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.captures)
+	c.captures = slices.DeleteFunc(c.captures, func(capture *logCapture) bool { return capture.ID == id })
+	c.any.Store(len(c.captures) > 0)
+	return len(c.captures) < n
+}
+
+// active drops expired captures and returns the rest.
+func (c *logCaptures) active(now time.Time) []*logCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.captures = slices.DeleteFunc(c.captures, func(capture *logCapture) bool { return !now.Before(capture.ExpiresAt) })
+	c.any.Store(len(c.captures) > 0)
+	return slices.Clone(c.captures)
+}
+
+// match returns the capture covering a request, if any.
+func (c *logCaptures) match(now time.Time, accountID int, route string) *logCapture {
+	for _, capture := range c.active(now) {
+		if (capture.AccountID == 0 || capture.AccountID == accountID) && (capture.Route == "" || capture.Route == route) {
+			return capture
+		}
+	}
+	return nil
+}
+
+// statusWriter records the status code a handler responds with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestLogMiddleware logs a summary of each request at the debug level,
+// and the body of requests an active capture covers. The caller is read
+// from the request context once the handler has authenticated them, so
+// bodies are read ahead whenever any capture is active.
+func (s *Apiserver) requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capturing := s.captures.any.Load()
+		if logThreshold.Load() != 0 && !capturing {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := clock.Now()
+		r, rc := contextOf(r)
+		var body []byte
+		if capturing && r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, maxCapturedBody))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		elapsed := clock.Now().Sub(start)
+		accountID, route := rc.caller.accountID, quotaScope(r)
+		debugf("%s %s account=%d status=%d trace=%s in %s\n", r.Method, route, accountID, sw.status, rc.trace.traceID, elapsed)
+		if capture := s.captures.match(start, accountID, route); capturing && capture != nil {
+			if json.Valid(body) {
+				body = scrubJSON(body)
+			}
+			logf("capture %d: %s %s account=%d status=%d body=%s\n", capture.ID, r.Method, r.URL.Path, accountID, sw.status, body)
+		}
+	})
+}
+
+// handleLogging returns the log level and active captures (GET) or sets the
+// log level (PUT). Logging is the deployment's, so only admins of the
+// default tenant control it.
+func (s *Apiserver) handleLogging(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "logging_default_only")
+	}
+	if r.Method == "PUT" {
+		req := LogLevelRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		if err := setLogLevel(req.Level); err != nil {
+			return err
+		}
+		s.audit(r, "logging.level_changed", "tenant", defaultTenantID, req)
+	}
+	return writeJSON(w, http.StatusOK, LoggingStatus{Level: currentLogLevel(), Captures: s.captures.active(clock.Now())})
+}
+
+// handleCreateLogCapture starts logging the bodies of an account's requests,
+// of requests to a route template such as /account/{id}, or both.
+func (s *Apiserver) handleCreateLogCapture(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "logging_default_only")
+	}
+	req := CreateLogCaptureRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.AccountID == 0 && req.Route == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "account_id or route")
+	}
+	ttl := defaultCaptureTTL
+	if req.Minutes != 0 {
+		ttl = time.Duration(req.Minutes) * time.Minute
+	}
+	if ttl <= 0 || ttl > maxCaptureTTL {
+		return newAPIError(http.StatusBadRequest, "invalid_capture_duration", int(maxCaptureTTL.Minutes()))
+	}
+	admin, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	capture := &logCapture{AccountID: req.AccountID, Route: req.Route, ExpiresAt: clock.Now().Add(ttl), CreatedBy: admin.ID}
+	s.captures.add(capture)
+	s.audit(r, "logging.capture_started", "tenant", defaultTenantID, capture)
+	return writeJSON(w, http.StatusCreated, capture)
+}
+
+// handleDeleteLogCapture stops a capture before it expires.
+func (s *Apiserver) handleDeleteLogCapture(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "logging_default_only")
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if !s.captures.remove(id) {
+		return newAPIError(http.StatusNotFound, "capture_not_found", id)
+	}
+	s.audit(r, "logging.capture_stopped", "tenant", defaultTenantID, map[string]any{"capture_id": id})
+	return writeJSON(w, http.StatusOK, map[string]int{"stopped": id})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loginFailureWindow is how long a failed login counts against its IP
+	// and email after the most recent failure.
+	loginFailureWindow = 15 * time.Minute
+	// maxTrackedLogins bounds the failure table; expired rows are pruned
+	// once it grows past this.
+	maxTrackedLogins  = 10_000
+	hcaptchaVerifyURL = "https://api.hcaptcha.com/siteverify"
+)
+
+// loginFailures counts the recent failed logins of one IP or email.
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// loginThrottle tracks failed logins per client IP and per email in memory.
+// Every further failure is answered more slowly, and past a threshold the
+// client has to solve a CAPTCHA before its credentials are even checked.
+type loginThrottle struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{failures: map[string]*loginFailures{}}
+}
+
+// loginKeys names the counters a login attempt is tracked under.
+func loginKeys(r *http.Request, tenantID int, email string) (ip, account string) {
+	return "ip:" + clientIP(r), fmt.Sprintf("email:%d:%s", tenantID, strings.ToLower(email))
+}
+
+// Failures returns the highest recent failure count of the keys.
+func (t *loginThrottle) Failures(keys ...string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, k := range keys {
+		if f, ok := t.failures[k]; ok && clock.Now().Sub(f.last) < loginFailureWindow {
+			n = max(n, f.count)
+		}
+	}
+	return n
+}
+
+// Fail records a failed login under every key and returns the new highest
+// count.
+func (t *loginThrottle) Fail(keys ...string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := clock.Now()
+	if len(t.failures) > maxTrackedLogins {
+		for k, f := range t.failures {
+			if now.Sub(f.last) >= loginFailureWindow {
+				delete(t.failures, k)
+			}
+		}
+	}
+	n := 0
+	for _, k := range keys {
+		f, ok := t.failures[k]
+		if !ok || now.Sub(f.last) >= loginFailureWindow {
+			f = &loginFailures{}
+			t.failures[k] = f
+		}
+		f.count++
+		f.last = now
+		n = max(n, f.count)
+	}
+	return n
+}
+
+// Reset forgets failures after a successful login. Callers pass only the
+// email key: logging into one account must not wipe the record of an IP
+// guessing at others.
+func (t *loginThrottle) Reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		delete(t.failures, k)
+	}
+}
+
+// loginDelay is how long to hold the answer to the nth failed login in a
+// row: the base delay, doubled for every earlier failure, up to the cap.
+func loginDelay(base, limit time.Duration, failures int) time.Duration {
+	if base <= 0 || failures <= 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// sleepContext waits for d or until the client goes away.
+func sleepContext(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// CaptchaVerifier checks the CAPTCHA response token a client solved.
+type CaptchaVerifier interface {
+	Verify(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// hcaptchaVerifier checks tokens with hCaptcha.
+type hcaptchaVerifier struct {
+	secret string
+	client *outboundClient
+}
+
+func newHCaptchaVerifier(secret string) *hcaptchaVerifier {
+	return &hcaptchaVerifier{secret: secret, client: newOutboundClient(5*time.Second, 2)}
+}
+
+func (v *hcaptchaVerifier) Verify(ctx context.Context, token, remoteIP string) (bool, error) {
+	form := url.Values{"secret": {v.secret}, "response": {token}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hcaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Success bool `json:"success"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// checkCaptcha requires a solved CAPTCHA from clients with too many recent
+// failed logins. Without a configured verifier only the delays apply.
+func (s *Apiserver) checkCaptcha(r *http.Request, failures int, token string) error {
+	if s.captcha == nil || s.cfg().CaptchaAfterFailures <= 0 || failures < s.cfg().CaptchaAfterFailures {
+		return nil
+	}
+	if token == "" {
+		return newAPIError(http.StatusUnauthorized, "captcha_required")
+	}
+	ok, err := s.captcha.Verify(r.Context(), token, clientIP(r))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return newAPIError(http.StatusUnauthorized, "captcha_invalid")
+	}
+	return nil
+}
@@ -2,40 +2,407 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"flag"
 
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
-	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
 // Apiserver struct holds the server's address and a storage interface.
 type Apiserver struct {
 	listenAddress string
+	config        atomic.Pointer[Config]
 	store         Storage
+	flags         *featureFlags
+	auditor       invariantAuditor
+	screener      Screener
+	otp           OTPSender
+	exports       ExportSender
+	aggregator    AccountAggregator
+	logins        *loginThrottle
+	limits        *rateLimiter
+	captcha       CaptchaVerifier
+	campaigns     CampaignSender
+	files         FileStore
+	virusScanner  VirusScanner
+	captures      *logCaptures
+	jobSlots      chan struct{}
+	mailer        Mailer
+	sms           SMSSender
+	push          PushSender
 }
 
-// NewApiServer initializes a new instance of Apiserver with the provided address.
-func NewApiServer(listenAddress string) *Apiserver {
-	return &Apiserver{listenAddress: listenAddress}
+// NewApiServer initializes a new instance of Apiserver from the provided config.
+func NewApiServer(cfg Config) *Apiserver {
+	s := &Apiserver{listenAddress: cfg.ListenAddress}
+	s.config.Store(&cfg)
+	allowLoopbackWebhooks.Store(cfg.Environment == envDevelopment)
+	return s
 }
 
-// Run starts the API server and sets up the routes.
-func (s *Apiserver) Run() {
-	router := mux.NewRouter()
-	router.HandleFunc("/account", makeHandler(s.handleAccount)).Methods("GET", "POST")
+// cfg returns the current configuration snapshot. Reloads swap in a new
+// snapshot rather than changing this one.
+func (s *Apiserver) cfg() *Config {
+	return s.config.Load()
+}
 
-	router.Handle("/login", makeHandler(s.handleLogin)).Methods("POST")
+// Run starts the background jobs and serves the API.
+func (s *Apiserver) Run() {
+	s.startReconciliationJob(s.cfg().ReconcileInterval)
+	s.startInvariantAuditor(s.cfg().InvariantInterval)
+	s.startBalanceSnapshotJob(s.cfg().SnapshotInterval)
+	s.startEndOfDayJob(s.cfg().EODInterval)
+	s.startClaimExpiryJob(s.cfg().ClaimExpiryInterval)
+	s.startBillingJob(s.cfg().BillingInterval)
+	s.startCashCodeExpiryJob(s.cfg().CashCodeExpiryInterval)
+	s.startExportJob(s.cfg().ExportInterval)
+	s.startAggregationJob(s.cfg().AggregationInterval)
+	s.startBillPaymentJob(s.cfg().BillPaymentInterval)
+	s.startDormancyJob(s.cfg().DormancyInterval)
+	s.startCampaignJob(s.cfg().CampaignInterval)
+	s.startScanJob(s.cfg().ScanInterval)
+	s.startAuditAnchorJob(s.cfg().AuditAnchorInterval)
+	s.startNotificationOutboxJob(s.cfg().NotificationOutboxInterval)
+	s.startJobSweeper()
+	s.watchConfigReload()
+
+	server := &http.Server{
+		Addr:              s.listenAddress,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+	}
+	// With TLS configured, HTTP/2 is negotiated via ALPN and clients can
+	// multiplex requests over one kept-alive connection.
+	if s.cfg().TLSCertFile != "" && s.cfg().TLSKeyFile != "" {
+		logln(server.ListenAndServeTLS(s.cfg().TLSCertFile, s.cfg().TLSKeyFile))
+		return
+	}
+	logln(server.ListenAndServe())
+}
 
-	router.HandleFunc("/account/users", makeHandler(s.handleGetUsers)).Methods("GET")
-	router.HandleFunc("/account/{id}", ProtectedHandler(s.handleGetAccountById)).Methods("GET", "DELETE")
-	router.HandleFunc("/account/create", makeHandler(s.handleCreateAccount)).Methods("POST")
+// Handler loads the feature flags and sets up the routes.
+func (s *Apiserver) Handler() http.Handler {
+	s.flags = newFeatureFlags(s.store)
+	if err := s.flags.Reload(); err != nil {
+		logln("Failed to load feature flags:", err)
+	}
+	if s.screener == nil {
+		s.screener = &denylistScreener{store: s.store}
+	}
+	if s.mailer == nil && s.cfg().SMTPAddress != "" {
+		s.mailer = newSMTPMailer(s.cfg())
+	}
+	if s.mailer != nil {
+		mail := emailSender{mailer: s.mailer}
+		if s.otp == nil {
+			s.otp = mail
+		}
+		if s.exports == nil {
+			s.exports = mail
+		}
+		if s.campaigns == nil {
+			s.campaigns = mail
+		}
+	}
+	if s.otp == nil {
+		s.otp = logOTPSender{}
+	}
+	if s.sms == nil {
+		s.sms = newSMSSender(s.cfg())
+	}
+	if s.push == nil {
+		s.push = logPushSender{}
+	}
+	if s.sms != nil {
+		s.otp = smsOTPSender{s: s, fallback: s.otp}
+	}
+	if s.exports == nil {
+		s.exports = logExportSender{}
+	}
+	if s.files == nil {
+		s.files = diskFileStore{dir: s.cfg().FileStoreDir}
+	}
+	if s.virusScanner == nil && s.cfg().ClamAVAddress != "" {
+		s.virusScanner = newClamdScanner(s.cfg().ClamAVAddress)
+	}
+	if s.campaigns == nil {
+		s.campaigns = logCampaignSender{}
+	}
+	if s.aggregator == nil {
+		s.aggregator = mockAggregator{}
+	}
+	s.logins = newLoginThrottle()
+	s.limits = newRateLimiter()
+	s.captures = &logCaptures{}
+	s.jobSlots = make(chan struct{}, maxRunningJobs)
+	if s.captcha == nil && s.cfg().HCaptchaSecret != "" {
+		s.captcha = newHCaptchaVerifier(s.cfg().HCaptchaSecret)
+	}
 
-	router.HandleFunc("/transfer", makeHandler(s.handleTransfer)).Methods("POST")
+	router := newRouteMux()
+	public := newRouteGroup(router, recoverPanic, trace, withTimeout(requestTimeout), s.rateLimit)
+	user := public.with(authenticate)
+	admin := user.with(requireAdmin)
+	apiKey := public.with(s.authenticateAPIKey, s.enforceQuota)
+	sandbox, sandboxAdmin := user.with(sandboxOnly), admin.with(sandboxOnly)
+	// Disabled features answer before the caller is authenticated, so
+	// they use no quota.
+	transfers := public.with(s.requireFeature(featureTransfers))
+	userTransfers := transfers.with(authenticate)
+	keyTransfers := transfers.with(s.authenticateAPIKey, s.enforceQuota)
+	tickets := public.with(s.requireFeature(featureSupportTickets), authenticate)
+	accountCreation := public.with(s.requireFeature(featureAccountCreation))
+
+	public.handle("/account", s.handleAccount, "GET", "POST")
+
+	public.handle("/login", s.handleLogin, "POST")
+	public.handle("/login/verify", s.handleVerifyLogin, "POST")
+	public.handle("/token/refresh", s.handleRefreshToken, "POST")
+	public.handle("/.well-known/jwks.json", s.handleJWKS, "GET")
+	public.handle("/logout", s.handleLogout, "POST")
+	user.handle("/account/devices", s.handleDevices, "GET")
+	user.handle("/account/password", s.handleChangePassword, "POST")
+	user.handle("/account/claims", s.handleGetClaims, "GET")
+	user.handle("/account/claims/{id}/challenge", s.handleClaimChallenge, "POST")
+	user.handle("/account/claims/{id}/collect", s.handleCollectClaim, "POST")
+
+	public.handle("/account/users", s.handleGetUsers, "GET")
+	user.handle("/account/{id}", s.handleGetAccountById, "GET", "DELETE")
+	user.handle("/account/{id}/overview", s.handleAccountOverview, "GET")
+	user.handle("/account/{id}/transactions", s.handleAccountTransactions, "GET")
+	user.handle("/account/{id}/tags", s.handleAccountTags, "GET")
+	user.handle("/account/{id}/spending", s.handleSpending, "GET")
+	user.handle("/account/{id}/import-transactions", s.handleImportTransactions, "POST")
+	user.handle("/account/{id}/imported-transactions", s.handleImportedTransactions, "GET")
+	user.handle("/account/{id}/forecast", s.handleForecast, "GET")
+	user.handle("/account/{id}/recurring", s.handleRecurringPayments, "GET")
+	user.handle("/account/{id}/saved-searches", s.handleSavedSearches, "GET", "POST")
+	user.handle("/account/{id}/saved-searches/{search}", s.handleDeleteSavedSearch, "DELETE")
+	user.handle("/account/{id}/saved-searches/{search}/transactions", s.handleSavedSearchTransactions, "GET")
+	user.handle("/account/{id}/saved-searches/{search}/export", s.handleSearchExport, "PUT", "DELETE")
+	user.handle("/account/{id}/balance", s.handleBalanceAt, "GET")
+	user.handle("/account/{id}/balance-alert", s.handleBalanceAlert, "GET", "PUT", "DELETE")
+	user.handle("/account/{id}/round-up", s.handleRoundUp, "GET", "PUT", "DELETE")
+	user.handle("/account/{id}/round-up/summary", s.handleRoundUpSummary, "GET")
+	userTransfers.handle("/account/{id}/cash-code", s.handleCashCodes, "GET", "POST")
+	user.handle("/account/{id}/cash-code/{code}/cancel", s.handleCancelCashCode, "POST")
+	user.handle("/account/{id}/payees", s.handlePayees, "GET", "POST")
+	user.handle("/account/{id}/payees/{payee}", s.handleDeletePayee, "DELETE")
+	user.handle("/account/{id}/payee-allowlist", s.handlePayeeAllowlist, "GET", "PUT", "DELETE")
+	user.handle("/account/{id}/geo-controls", s.handleGeoControls, "GET", "PUT", "DELETE")
+	user.handle("/account/{id}/travel-notices", s.handleTravelNotices, "GET", "POST")
+	user.handle("/account/{id}/travel-notices/{notice}", s.handleDeleteTravelNotice, "DELETE")
+	user.handle("/account/{id}/cosigner", s.handleCosigner, "GET", "PUT", "DELETE")
+	user.handle("/account/{id}/reveal", s.handleRevealNumber, "POST")
+	user.handle("/account/{id}/metadata", s.handleAccountMetadata, "GET", "PATCH")
+	user.handle("/account/{id}/billers", s.handleSavedBillers, "GET", "POST")
+	user.handle("/account/{id}/billers/{biller}", s.handleDeleteSavedBiller, "DELETE")
+	userTransfers.handle("/account/{id}/bill-payments", s.handleBillPayments, "GET", "POST")
+	user.handle("/account/{id}/bill-payments/{payment}", s.handleGetBillPayment, "GET")
+	user.handle("/account/{id}/bill-payments/{payment}/cancel", s.handleCancelBillPayment, "POST")
+	user.handle("/account/{id}/pots", s.handlePots, "GET", "POST")
+	user.handle("/account/{id}/pots/{pot}", s.handleDeletePot, "DELETE")
+	user.handle("/account/{id}/pots/{pot}/deposit", s.handlePotDeposit, "POST")
+	user.handle("/account/{id}/pots/{pot}/withdraw", s.handlePotWithdraw, "POST")
+	user.handle("/accounts/lookup", s.handleLookupAccounts, "POST")
+	user.handle("/jobs/{id}", s.handleGetJob, "GET")
+	user.handle("/jobs/{id}/events", s.handleJobEvents, "GET")
+	user.handle("/jobs/{id}/file", s.handleJobFile, "GET")
+	accountCreation.handle("/account/create", s.handleCreateAccount, "POST")
+	accountCreation.handle("/account-applications", s.handleCreateAccountApplication, "POST")
+	public.handle("/products", s.handleProducts, "GET")
+	accountCreation.handle("/account-applications/{id}", s.handleAccountApplication, "GET", "PUT")
+	accountCreation.handle("/account-applications/{id}/document", s.handleApplicationDocument, "POST")
+	accountCreation.handle("/account-applications/{id}/submit", s.handleSubmitApplicationForKYC, "POST")
+	accountCreation.handle("/account-applications/{id}/activate", s.handleActivateApplication, "POST")
+
+	userTransfers.handle("/transfer", s.handleTransfer, "POST")
+	user.handle("/transfer-approvals", s.handleTransferApprovals, "GET")
+	userTransfers.handle("/transfer-approvals/{id}/approve", s.handleApproveTransfer, "POST")
+	user.handle("/transfer-approvals/{id}/reject", s.handleRejectTransfer, "POST")
+	user.handle("/invoices", s.handleInvoices, "GET", "POST")
+	user.handle("/invoices/{id}", s.handleGetInvoice, "GET")
+	userTransfers.handle("/invoices/{id}/pay", s.handlePayInvoice, "POST")
+	user.handle("/transactions/{id}/{ref}", s.handleTransactionLookup, "GET")
+	user.handle("/split-requests", s.handleSplitRequests, "GET", "POST")
+	userTransfers.handle("/split-requests/pay/{token}", s.handlePaySplitShare, "POST")
+	user.handle("/split-requests/{id}", s.handleGetSplitRequest, "GET")
+
+	user.handle("/mandates", s.handleMandates, "GET")
+	user.handle("/mandates/{id}/confirm", s.handleConfirmMandate, "POST")
+	user.handle("/mandates/{id}/cancel", s.handleCancelMandate, "POST")
+	apiKey.handle("/merchant/mandates", s.handleMerchantMandates, "GET", "POST")
+	keyTransfers.handle("/merchant/mandates/{id}/collect", s.handleCollectMandate, "POST")
+	apiKey.with(requireATMKey).handle("/atm/withdrawals", s.handleATMWithdrawal, "POST")
+	apiKey.handle("/merchant/plans", s.handleMerchantPlans, "GET", "POST")
+	keyTransfers.handle("/merchant/subscriptions", s.handleMerchantSubscriptions, "GET", "POST")
+	apiKey.handle("/merchant/subscriptions/{id}/plan", s.handleChangeSubscriptionPlan, "POST")
+	apiKey.handle("/merchant/subscriptions/{id}/cancel", s.handleCancelSubscription, "POST")
+	keyTransfers.handle("/merchant/charges", s.handleMerchantCharges, "GET", "POST")
+	apiKey.handle("/merchant/settlements", s.handleSettlementReport, "GET")
+	user.handle("/charges", s.handleCharges, "GET")
+	keyTransfers.handle("/charges/{id}/refund", s.handleRefundCharge, "POST")
+	userTransfers.handle("/charges/{id}/approve", s.handleApproveCharge, "POST")
+	user.handle("/charges/{id}/decline", s.handleDeclineCharge, "POST")
+
+	user.handle("/consents", s.handleConsents, "GET")
+	user.handle("/consents/{id}", s.handleGetConsent, "GET")
+	user.handle("/consents/{id}/authorise", s.handleAuthoriseConsent, "POST")
+	user.handle("/consents/{id}/reject", s.handleRejectConsent, "POST")
+	user.handle("/consents/{id}/revoke", s.handleRevokeConsent, "POST")
+	user.handle("/payment-consents/{id}", s.handleGetPaymentConsent, "GET")
+	user.handle("/payment-consents/{id}/authorise", s.handleAuthorisePaymentConsent, "POST")
+	user.handle("/payment-consents/{id}/reject", s.handleRejectPaymentConsent, "POST")
+	apiKey.handle("/open-banking/v1/consents", s.handleCreateConsent, "POST")
+	apiKey.handle("/open-banking/v1/consents/{id}", s.handleGetThirdPartyConsent, "GET")
+	apiKey.handle("/open-banking/v1/consents/{id}/token", s.handleConsentToken, "POST")
+	apiKey.handle("/open-banking/v1/payment-consents", s.handleCreatePaymentConsent, "POST")
+	apiKey.handle("/open-banking/v1/payment-consents/{id}", s.handleGetThirdPartyPaymentConsent, "GET")
+	keyTransfers.handle("/open-banking/v1/payments", s.handleSubmitPayment, "POST")
+	apiKey.handle("/open-banking/v1/payments/{id}", s.handleGetPayment, "GET")
+	apiKey.with(s.requireConsent(permissionAccounts)).handle("/open-banking/v1/accounts", s.handleOBAccounts, "GET")
+	apiKey.with(s.requireConsent(permissionAccounts)).handle("/open-banking/v1/accounts/{id}", s.handleOBAccount, "GET")
+	apiKey.with(s.requireConsent(permissionBalances)).handle("/open-banking/v1/accounts/{id}/balances", s.handleOBBalances, "GET")
+	apiKey.with(s.requireConsent(permissionTransactions)).handle("/open-banking/v1/accounts/{id}/transactions", s.handleOBTransactions, "GET")
+	apiKey.with(s.requireConsent(permissionFundsConfirmation)).handle("/open-banking/v1/accounts/{id}/funds-confirmation", s.handleOBFundsConfirmation, "GET")
+
+	user.handle("/billers", s.handleBillers, "GET")
+	user.handle("/transactions/{id}/attachments", s.handleAttachments, "GET", "POST")
+	user.handle("/transactions/{id}/attachments/{attachment}", s.handleAttachment, "GET", "DELETE")
+	user.handle("/transactions/{id}/receipt", s.handleTransactionReceipt, "GET")
+	user.handle("/transactions/{id}/note", s.handleTransactionNote, "PUT")
+	user.handle("/transactions/{id}/splits", s.handleCategorySplits, "PUT")
+	public.handle("/receipts/verify", s.handleVerifyReceipt, "POST")
+	public.handle("/calendar/business-day", s.handleBusinessDay, "GET")
+	public.handle("/sms/status/twilio", s.handleTwilioStatus, "POST")
+	user.handle("/me/preferences", s.handleUpdatePreferences, "PUT")
+	user.handle("/me/summary", s.handleUserSummary, "GET")
+	user.handle("/me/activity", s.handleMyActivity, "GET")
+	user.handle("/me/reactivate", s.handleReactivate, "POST")
+	user.handle("/me/reactivate/verify", s.handleVerifyReactivation, "POST")
+	user.handle("/me/unclaimed-funds", s.handleUnclaimedFunds, "GET")
+	user.handle("/me/unclaimed-funds/{id}/reclaim", s.handleRequestReclaim, "POST")
+	user.handle("/me/external-links", s.handleExternalLinks, "GET", "POST")
+	user.handle("/me/external-links/{id}", s.handleDeleteExternalLink, "DELETE")
+	user.handle("/me/external-links/{id}/sync", s.handleSyncExternalLink, "POST")
+	user.handle("/me/external-accounts/{id}/transactions", s.handleExternalTransactions, "GET")
+	user.handle("/notifications", s.handleGetNotifications, "GET")
+	user.handle("/me/notification-preferences", s.handleNotificationPreferences, "GET", "PUT")
+
+	user.handle("/webhooks", s.handleWebhooks, "GET", "POST")
+	user.handle("/webhooks/{id}/events", s.handleWebhookEvents, "GET")
+	user.handle("/webhooks/{id}/redeliver", s.handleRedeliverWebhook, "POST")
+
+	tickets.handle("/tickets", s.handleTickets, "GET", "POST")
+	tickets.handle("/tickets/{id}", s.handleGetTicket, "GET")
+	tickets.handle("/tickets/{id}/replies", s.handleReplyTicket, "POST")
+	admin.handle("/admin/tickets", s.handleAdminListTickets, "GET")
+	admin.handle("/admin/tickets/{id}/status", s.handleAdminUpdateTicketStatus, "PUT")
+
+	admin.handle("/admin/flags", s.handleGetFeatureFlags, "GET")
+	admin.handle("/admin/flags/{name}", s.handleSetFeatureFlag, "PUT")
+	admin.handle("/admin/read-only", s.handleReadOnly, "GET", "PUT")
+	admin.handle("/admin/config/reload", s.handleReloadConfig, "POST")
+	admin.handle("/admin/logging", s.handleLogging, "GET", "PUT")
+	admin.handle("/admin/logging/captures", s.handleCreateLogCapture, "POST")
+	admin.handle("/admin/logging/captures/{id}", s.handleDeleteLogCapture, "DELETE")
+	admin.handle("/admin/tenants", s.handleTenants, "GET", "POST")
+	sandbox.handle("/sandbox/accounts/{id}/mint", s.handleSandboxMint, "POST")
+	sandbox.handle("/sandbox/webhooks/test", s.handleSandboxWebhookTest, "POST")
+	sandboxAdmin.handle("/sandbox/jobs/{job}", s.handleSandboxJob, "POST")
+	sandboxAdmin.handle("/sandbox/clock", s.handleSandboxClock, "GET", "POST")
+	admin.handle("/admin/audit", s.handleGetAuditLog, "GET")
+	admin.handle("/admin/audit/verify", s.handleVerifyAuditChain, "GET")
+	admin.handle("/admin/audit/anchors", s.handleAuditAnchor, "POST")
+	admin.handle("/admin/api-keys", s.handleAPIKeys, "GET", "POST")
+	admin.handle("/admin/api-keys/{id}/revoke", s.handleRevokeAPIKey, "POST")
+	admin.handle("/admin/api-keys/{id}/quotas", s.handleAPIKeyQuotas, "GET", "PUT")
+	admin.handle("/admin/dead-letters", s.handleDeadLetters, "GET")
+	admin.handle("/admin/dead-letters/requeue", s.handleRequeueDeadLetters, "POST")
+	admin.handle("/admin/dead-letters/purge", s.handlePurgeDeadLetters, "POST")
+	admin.handle("/admin/merchants", s.handleMerchants, "GET", "POST")
+	admin.handle("/admin/billers", s.handleAdminBillers, "GET", "POST")
+	admin.handle("/admin/billers/{id}", s.handleDeleteBiller, "DELETE")
+	admin.handle("/admin/fx-rates", s.handleFXRates, "GET", "POST")
+	admin.handle("/admin/merchant-directory", s.handleMerchantDirectory, "GET", "POST")
+	admin.handle("/admin/merchant-directory/{id}", s.handleDeleteDirectoryEntry, "DELETE")
+	admin.handle("/admin/accounts/{id}/as-of", s.handleAccountAsOf, "GET")
+	admin.handle("/admin/accounts/{id}/graph", s.handleTransferGraph, "GET")
+	admin.handle("/admin/screening/denylist", s.handleDenylist, "GET", "POST")
+	admin.handle("/admin/screening/denylist/{id}", s.handleDeleteDenylistEntry, "DELETE")
+	admin.handle("/admin/screening/reviews", s.handleScreeningReviews, "GET")
+	admin.handle("/admin/screening/reviews/{id}/clear", s.resolveScreeningReview(screeningClear), "POST")
+	admin.handle("/admin/screening/reviews/{id}/block", s.resolveScreeningReview(screeningBlocked), "POST")
+	admin.handle("/admin/products", s.handleAdminProducts, "GET", "POST")
+	admin.handle("/admin/products/{id}", s.handleAdminProduct, "GET", "PUT", "DELETE")
+	admin.handle("/admin/account-applications", s.handleAdminAccountApplications, "GET")
+	admin.handle("/admin/account-applications/{id}", s.handleAdminAccountApplication, "GET")
+	admin.handle("/admin/account-applications/{id}/document", s.handleAdminApplicationDocument, "GET")
+	admin.handle("/admin/account-applications/{id}/approve", s.reviewAccountApplication(applicationApproved), "POST")
+	admin.handle("/admin/account-applications/{id}/reject", s.reviewAccountApplication(applicationRejected), "POST")
+	admin.handle("/admin/accounts/{id}/sar", s.handleCreateSAR, "POST")
+	admin.handle("/admin/sar/{id}", s.handleGetSAR, "GET")
+	admin.handle("/admin/holidays", s.handleHolidays, "GET", "POST")
+	admin.handle("/admin/holidays/{date}", s.handleDeleteHoliday, "DELETE")
+	admin.handle("/admin/eod", s.handleEndOfDay, "GET", "POST")
+	admin.handle("/admin/archives", s.handleLedgerArchives, "GET")
+	admin.handle("/admin/archives/{id}", s.handleDownloadArchive, "GET")
+	admin.handle("/admin/archives/{id}/verify", s.handleVerifyArchive, "GET")
+	admin.handle("/admin/trial-balance", s.handleTrialBalance, "GET")
+	admin.handle("/admin/profit-and-loss", s.handleProfitAndLoss, "GET")
+	admin.handle("/admin/gl/accounts", s.handleGLAccounts, "GET", "POST")
+	admin.handle("/admin/gl/mappings", s.handleGLMappings, "GET", "PUT")
+	admin.handle("/admin/accounts/by-external-id/{externalID}", s.handleUpsertAccountByExternalID, "PUT")
+	admin.handle("/admin/accounts/search", s.handleSearchAccounts, "GET")
+	admin.handle("/admin/accounts/{id}/activity", s.handleAccountActivity, "GET")
+	admin.handle("/admin/activity", s.handleTenantActivity, "GET")
+
+	admin.handle("/admin/adjustments", s.handleAdjustments, "GET", "POST")
+	admin.handle("/admin/adjustments/{id}/approve", s.handleApproveAdjustment, "POST")
+	admin.handle("/admin/adjustments/{id}/reject", s.handleRejectAdjustment, "POST")
+	admin.handle("/admin/segments", s.handleSegments, "GET", "POST")
+	admin.handle("/admin/segments/{id}", s.handleSegment, "GET", "PUT", "DELETE")
+	admin.handle("/admin/segments/{id}/members", s.handleSegmentMembers, "GET")
+	admin.handle("/admin/campaigns", s.handleCampaigns, "GET", "POST")
+	admin.handle("/admin/campaigns/{id}", s.handleGetCampaign, "GET")
+	admin.handle("/admin/campaigns/{id}/recipients", s.handleCampaignRecipients, "GET")
+	admin.handle("/admin/quarantine", s.handleQuarantine, "GET")
+	admin.handle("/admin/attachments/{id}/rescan", s.handleRescanAttachment, "POST")
+	admin.handle("/admin/escheatments", s.handleEscheatments, "GET", "POST")
+	admin.handle("/admin/escheatments/candidates", s.handleEscheatableAccounts, "GET")
+	admin.handle("/admin/escheatments/{id}/reclaim", s.handleReclaimEscheatment, "POST")
+	admin.handle("/sync/accounts", s.handleSyncAccounts, "GET")
+	admin.handle("/sync/transactions", s.handleSyncTransactions, "GET")
+	admin.handle("/admin/reconciliation", s.handleReconciliation, "GET", "POST")
+	admin.handle("/admin/invariants", s.handleInvariants, "GET", "POST")
+	admin.handle("/admin/metrics", s.handleMetrics, "GET")
+	admin.handle("/admin/seed", s.handleSeed, "POST")
+	admin.handle("/admin/emails", s.handleEmailTemplates, "GET")
+	admin.handle("/admin/emails/{name}/preview", s.handleEmailPreview, "GET")
+	admin.handle("/admin/sms", s.handleSMSMessages, "GET")
+	if s.cfg().Pprof {
+		router.handle("/debug/pprof/", admin.handler(s.handlePprof))
+	}
 
-	http.ListenAndServe(s.listenAddress, router)
+	return chain(router,
+		requestIDMiddleware,
+		s.securityHeadersMiddleware,
+		csrfMiddleware,
+		s.tenantMiddleware,
+		s.readOnlyMiddleware,
+		s.activityMiddleware,
+		s.requestLogMiddleware,
+	)
 }
 
 func (s *Apiserver) handleLogin(w http.ResponseWriter, r *http.Request) error {
@@ -45,21 +412,32 @@ func (s *Apiserver) handleLogin(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	err := s.store.CheckAuth(loginRequest.Email, loginRequest.Password)
+	t := requestTenant(r)
+	ipKey, emailKey := loginKeys(r, t.ID, loginRequest.Email)
+	if err := s.checkCaptcha(r, s.logins.Failures(ipKey, emailKey), loginRequest.CaptchaToken); err != nil {
+		return err
+	}
+	err := s.store.CheckAuth(t.ID, loginRequest.Email, loginRequest.Password)
 
 	if err != nil {
-
-		return writeJSON(w, http.StatusUnauthorized, ApiError{Error: err.Error()})
+		failures := s.logins.Fail(ipKey, emailKey)
+		sleepContext(r.Context(), loginDelay(s.cfg().LoginDelayBase, s.cfg().LoginDelayMax, failures))
+		return newAPIError(http.StatusUnauthorized, "auth_failed")
 	} else {
-		tokenString, JWTerr := CreateToken(loginRequest.Email)
-		if JWTerr != nil {
-			fmt.Print("No username found")
+		s.logins.Reset(emailKey)
+		acc, err := s.store.GetAccountByEmail(t.ID, loginRequest.Email)
+		if err != nil {
+			return err
+		}
+		stepUp, err := s.checkDevice(r, acc, loginRequest.DeviceFingerprint)
+		if err != nil {
+			return err
+		}
+		if stepUp != nil {
+			return writeJSON(w, http.StatusAccepted, stepUp)
 		}
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, tokenString)
+		return s.writeLogin(w, r, acc, t, loginRequest.Session)
 	}
-
-	return writeJSON(w, http.StatusOK, map[string]string{"message": "login successful"})
 }
 
 // handleAccount handles requests to the /account endpoint based on the HTTP method.
@@ -71,13 +449,13 @@ func (s *Apiserver) handleAccount(w http.ResponseWriter, r *http.Request) error
 		return s.handleCreateAccount(w, r)
 	}
 
-	return fmt.Errorf("unsupported method")
+	return newAPIError(http.StatusMethodNotAllowed, "unsupported_method")
 }
 
 // handleGetAccount handles GET requests to retrieve account information.
 func (s *Apiserver) handleGetAccountById(w http.ResponseWriter, r *http.Request) error {
 	if r.Method == "GET" {
-		vars := mux.Vars(r)["id"]
+		vars := r.PathValue("id")
 		id, err := strconv.Atoi(vars)
 		if err != nil {
 			return err // return error if conversion fails
@@ -86,64 +464,381 @@ func (s *Apiserver) handleGetAccountById(w http.ResponseWriter, r *http.Request)
 		if err != nil {
 			return err
 		}
+		if users.TenantID != requestTenant(r).ID {
+			return newAPIError(http.StatusNotFound, "account_not_found", id)
+		}
 
-		return writeJSON(w, http.StatusOK, users)
+		return s.writeLocalizedJSON(w, r, http.StatusOK, users)
 	} else {
-		s.handleDeleteAccount(w, r)
-		return nil
+		return s.handleDeleteAccount(w, r)
 	}
 }
 
 // get all users
 func (s *Apiserver) handleGetUsers(w http.ResponseWriter, r *http.Request) error {
-	// Retrieve all users from the database
-	users, err := s.store.GetUsers()
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	users, total, err := s.store.GetUsers(requestTenant(r).ID, page)
+	if err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, paginate(users, total, page, func(a *account) cursor { return cursor{ID: a.ID} }))
+
+}
+
+// minSearchLength is the shortest query accepted by account search; shorter
+// ones match most of the table and cannot use the trigram indexes.
+const minSearchLength = 3
+
+// handleSearchAccounts finds the tenant's accounts by ?q= in their name or
+// email and by meta.<key>= values of their metadata.
+func (s *Apiserver) handleSearchAccounts(w http.ResponseWriter, r *http.Request) error {
+	metadata, err := metadataFilter(r)
+	if err != nil {
+		return err
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if utf8.RuneCountInString(query) < minSearchLength && (query != "" || len(metadata) == 0) {
+		return newAPIError(http.StatusBadRequest, "search_too_short", minSearchLength)
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	accounts, total, err := s.store.SearchAccounts(requestTenant(r).ID, query, metadata, page)
+	if err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, paginate(accounts, total, page, func(a *account) cursor { return cursor{ID: a.ID} }))
+}
+
+// overviewTransactions is the number of recent ledger entries in an overview.
+const overviewTransactions = 10
+
+type AccountOverview struct {
+	Account            *account       `json:"account"`
+	RecentTransactions []*ledgerEntry `json:"recent_transactions"`
+	Pending            *PendingItems  `json:"pending"`
+}
+
+// PendingItems is money waiting to move in or out of an account.
+type PendingItems struct {
+	// Approvals are transfers the account sent or co-signs that wait for
+	// the co-signer.
+	Approvals []*transferApproval `json:"approvals"`
+	CashCodes []*cashCode         `json:"cash_codes"`
+	// Claims are transfers to the holder's email or phone waiting to be
+	// collected.
+	Claims []*transferClaim `json:"claims"`
+}
+
+func (o *AccountOverview) formatMoney(locale string) {
+	o.Account.formatMoney(locale)
+}
+
+// pendingItems gathers what is pending for an account.
+func (s *Apiserver) pendingItems(acc *account) (*PendingItems, error) {
+	p := &PendingItems{Approvals: make([]*transferApproval, 0), CashCodes: make([]*cashCode, 0)}
+	approvals, err := s.store.GetTransferApprovals(acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range approvals {
+		if a.Status == approvalPending {
+			p.Approvals = append(p.Approvals, a)
+		}
+	}
+	codes, err := s.store.GetCashCodes(acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		if c.Status == cashCodePending {
+			p.CashCodes = append(p.CashCodes, c)
+		}
+	}
+	contact, err := s.store.GetAccountContact(acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	if p.Claims, err = s.store.GetClaimsForAccount(contact); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handleAccountOverview returns an account with its recent transactions and
+// pending items in one response, so clients do not need a request per
+// panel.
+func (s *Apiserver) handleAccountOverview(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	entries, _, err := s.store.GetLedgerEntries(acc.ID, pageRequest{Limit: overviewTransactions})
+	if err != nil {
+		return err
+	}
+	if len(entries) > overviewTransactions {
+		entries = entries[:overviewTransactions]
+	}
+	if err := s.enrich(acc.TenantID, entries); err != nil {
+		return err
+	}
+	pending, err := s.pendingItems(acc)
+	if err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, &AccountOverview{Account: acc, RecentTransactions: entries, Pending: pending})
+}
+
+func ledgerCursor(e *ledgerEntry) cursor { return cursor{e.CreatedAt, e.ID} }
+
+// handleAccountTransactions returns the transaction history of an account,
+// newest first, a page at a time, narrowed by the optional search filters.
+// With ?format=csv, ofx or qif the whole filtered history is downloaded as
+// a file instead, or with &async=true exported by a job to download from
+// once it is done.
+func (s *Apiserver) handleAccountTransactions(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	filter, err := parseTransactionFilter(r)
+	if err != nil {
+		return err
+	}
+	filter.personal = responseViewer(w).accountID == acc.ID
+	format := r.URL.Query().Get("format")
+	download := format != "" && format != "json"
+	if download {
+		if err := validateExportFormat(format); err != nil {
+			return err
+		}
+		if r.URL.Query().Get("async") == "true" {
+			return s.startStatementExport(w, r, acc, filter, format)
+		}
+		st, err := s.exportStatement(acc, filter)
+		if err != nil {
+			return err
+		}
+		return writeStatement(w, format, st)
+	}
+	entries, total, err := s.store.SearchLedgerEntries(acc.ID, filter, page)
 	if err != nil {
 		return err
 	}
-	return writeJSON(w, http.StatusOK, users)
+	if err := s.enrich(acc.TenantID, entries); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(entries, total, page, ledgerCursor))
+}
 
+// exportStatement loads the filtered history of acc, up to maxExportRows
+// entries, as a statement.
+func (s *Apiserver) exportStatement(acc *account, filter transactionFilter) (*statement, error) {
+	entries, _, err := s.store.SearchLedgerEntries(acc.ID, filter, pageRequest{Limit: maxExportRows})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.enrich(acc.TenantID, entries); err != nil {
+		return nil, err
+	}
+	if len(entries) > maxExportRows {
+		entries = entries[:maxExportRows]
+	}
+	st := &statement{Account: acc, Entries: entries, From: filter.From, To: clock.Now()}
+	if filter.To != nil {
+		st.To = *filter.To
+	}
+	return st, nil
 }
 
-// handleCreateAccount handles POST requests to create a new account.
+// startStatementExport exports a statement of acc in a job.
+func (s *Apiserver) startStatementExport(w http.ResponseWriter, r *http.Request, acc *account, filter transactionFilter, format string) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	viewer := responseViewer(w)
+	j, err := s.startJob(jobStatementExport, caller, func(run *jobRun) error {
+		st, err := s.exportStatement(acc, filter)
+		if err != nil {
+			return err
+		}
+		run.progress(50)
+		redactAccounts(st, viewer)
+		data, err := encodeStatement(format, st)
+		if err != nil {
+			return err
+		}
+		if err := run.file(statementFilename(format, acc, st.To), exportContentTypes[format], data); err != nil {
+			return err
+		}
+		return run.result(map[string]any{"account_id": acc.ID, "format": format, "entries": len(st.Entries)})
+	})
+	if err != nil {
+		return err
+	}
+	return writeJobAccepted(w, j)
+}
+
+// authorizedAccount loads the account in the {id} path if the caller owns it
+// or is an admin of its tenant.
+func (s *Apiserver) authorizedAccount(r *http.Request) (*account, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return nil, err
+	}
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != caller.TenantID || (acc.ID != caller.ID && !isAdmin(r)) {
+		return nil, newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	return acc, nil
+}
+
+// maxLookupBatch caps the number of IDs accepted by /accounts/lookup.
+const maxLookupBatch = 100
+
+type LookupAccountsRequest struct {
+	IDs []int `json:"ids"`
+}
+
+type LookupAccountsResponse struct {
+	Accounts []*account `json:"accounts"`
+	Missing  []int      `json:"missing"`
+}
+
+func (l *LookupAccountsResponse) formatMoney(locale string) {
+	for _, a := range l.Accounts {
+		a.formatMoney(locale)
+	}
+}
+
+// handleLookupAccounts returns many accounts in one round-trip, listing the
+// IDs that were not found.
+func (s *Apiserver) handleLookupAccounts(w http.ResponseWriter, r *http.Request) error {
+	req := LookupAccountsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.IDs) == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "ids")
+	}
+	if len(req.IDs) > maxLookupBatch {
+		return newAPIError(http.StatusBadRequest, "batch_too_large", maxLookupBatch)
+	}
+
+	accounts, err := s.store.GetAccountsByIDs(requestTenant(r).ID, req.IDs)
+	if err != nil {
+		return err
+	}
+	found := make(map[int]bool, len(accounts))
+	for _, a := range accounts {
+		found[a.ID] = true
+	}
+	missing := make([]int, 0)
+	for _, id := range req.IDs {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true
+		}
+	}
+
+	return s.writeLocalizedJSON(w, r, http.StatusOK, &LookupAccountsResponse{Accounts: accounts, Missing: missing})
+}
+
+// handleCreateAccount handles POST requests to create a new account. In
+// production accounts are only opened through an application; see
+// handleCreateAccountApplication.
 func (s *Apiserver) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	if s.cfg().Environment == envProduction {
+		return newAPIError(http.StatusForbidden, "account_application_required")
+	}
 	CreateAccountReq := CreateAccountRequest{}
 	if err := json.NewDecoder(r.Body).Decode(&CreateAccountReq); err != nil {
 		return err
 	}
 
-	acc, err := NewAccount(CreateAccountReq.Email, CreateAccountReq.Password, CreateAccountReq.Name, CreateAccountReq.Number, CreateAccountReq.Balance)
+	acc, err := NewAccount(requestTenant(r).ID, CreateAccountReq.Email, CreateAccountReq.Password, CreateAccountReq.Name, CreateAccountReq.Number, CreateAccountReq.Balance)
 	if err != nil {
 		return err
 	}
+	if CreateAccountReq.Phone != "" {
+		phone, ok := normalizeContact(CreateAccountReq.Phone)
+		if !ok || strings.Contains(phone, "@") {
+			return newAPIError(http.StatusBadRequest, "invalid_phone", CreateAccountReq.Phone)
+		}
+		acc.Phone = phone
+	}
+	if CreateAccountReq.Currency != "" {
+		if _, ok := currencies[CreateAccountReq.Currency]; !ok {
+			return newAPIError(http.StatusBadRequest, "unsupported_currency", CreateAccountReq.Currency)
+		}
+		acc.Currency = CreateAccountReq.Currency
+	}
+	p, err := s.openingProduct(acc.TenantID, CreateAccountReq.Product, CreateAccountReq.Currency)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		if CreateAccountReq.Balance < p.MinOpeningBalance {
+			return newAPIError(http.StatusUnprocessableEntity, "below_min_opening_balance", p.Code, formatDecimalAmount(p.MinOpeningBalance, p.Currency))
+		}
+		applyProduct(acc, p)
+	}
 
 	if err := s.store.CreateAccount(acc); err != nil {
 		return err
 	}
+	s.audit(r, "account.created", "account", acc.ID, accountProfile{
+		Email:    acc.Email,
+		Name:     acc.Name,
+		Number:   acc.Number,
+		Role:     acc.Role,
+		Currency: acc.Currency,
+	})
+	s.screenAccount(acc)
+	CreateAccountReq.Password = ""
 	return writeJSON(w, http.StatusOK, CreateAccountReq)
 }
 
-// handleDeleteAccount handles DELETE requests to delete an account.
+// handleDeleteAccount handles DELETE requests to delete an account, which
+// only its holder or an admin may.
 func (s *Apiserver) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
-	vars := mux.Vars(r)["id"]
-	id, err := strconv.Atoi(vars)
+	acc, err := s.authorizedAccount(r)
 	if err != nil {
 		return err
 	}
-	users := s.store.DeleteAccount(id)
-
-	return writeJSON(w, http.StatusOK, users)
-
+	if err := s.store.DeleteAccount(acc.ID); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": acc.ID})
 }
 
-// handleTransfer handles POST requests to transfer funds between accounts.
-func (s *Apiserver) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	// Implement funds transfer logic here
-	return nil
+// writeJSON writes v in the standard response envelope, unless it already is one,
+// with the accounts in it redacted for the caller (see redactAccounts).
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	env, ok := v.(*envelope)
+	if !ok {
+		env = &envelope{Data: v}
+	}
+	env.RequestID = w.Header().Get(requestIDHeader)
+	redactAccounts(env.Data, responseViewer(w))
+	return encodeJSON(w, status, env)
 }
 
-// writeJSON writes a JSON response to the ResponseWriter.
-func writeJSON(w http.ResponseWriter, status int, v any) error {
+func encodeJSON(w http.ResponseWriter, status int, v any) error {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(v)
@@ -153,62 +848,95 @@ func writeJSON(w http.ResponseWriter, status int, v any) error {
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
 type ApiError struct {
-	Error string `json:"error"`
+	Error     string `json:"error"`
+	Code      string `json:"code,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
-// makeHandler wraps an apiFunc and converts it to an http.HandlerFunc.
-func makeHandler(fn apiFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if err := fn(w, r); err != nil {
-			writeJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
-		}
+// currentAccount loads the account belonging to the authenticated caller.
+func (s *Apiserver) currentAccount(r *http.Request) (*account, error) {
+	email := requestEmail(r)
+	if email == "" {
+		return nil, newAPIError(http.StatusUnauthorized, "not_authenticated")
 	}
-
+	return s.store.GetAccountByEmail(requestTenant(r).ID, email)
 }
 
-func ProtectedHandler(fn apiFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprint(w, "Missing authorization header")
-			return
-		}
-		tokenString := authHeader[len("Bearer "):]
-
-		err := verifyToken(tokenString)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintf(w, "Invalid token: %v", err)
-			return
-		}
-
-		if err := fn(w, r); err != nil {
-			writeJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
-		}
+// pathID parses the {id} route variable as an integer.
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("id"))
 	}
+	return id, nil
 }
 
 // main function initializes and runs the API server.
 
 func main() {
+	seed := flag.Int64("seed", 0, "populate the default tenant with fake data generated from this seed, then exit")
+	seedAccounts := flag.Int("seed-accounts", 20, "number of accounts created by -seed")
+	flag.Parse()
+
+	src, err := configFileSource(getEnv("CONFIG_FILE", ""))
+	if err != nil {
+		logln("Failed to read config file:", err)
+		return
+	}
+	cfg := LoadConfig(src)
+	if err := setLogLevel(cfg.LogLevel); err != nil {
+		logln("Invalid LOG_LEVEL:", cfg.LogLevel)
+		return
+	}
+	if cfg.FakeClock {
+		if cfg.Environment == envProduction {
+			logln("BANK_FAKE_CLOCK cannot be used in production")
+			return
+		}
+		// Sandbox deployments start at the real time and can fast-forward
+		// through /sandbox/clock.
+		clock = newFakeClock(time.Now())
+	}
+	if cfg.Environment == envProduction && cfg.SMTPAddress == "" && cfg.SMSProvider != "twilio" {
+		logln("production needs SMTP_ADDRESS or SMS_PROVIDER=twilio to deliver login codes")
+		return
+	}
+	tokenSettings.Issuer = cfg.JWTIssuer
+	tokenSettings.AccessTTL = cfg.AccessTokenTTL
+	tokenSettings.RefreshTTL = cfg.RefreshTokenTTL
+	tokenSettings.Leeway = cfg.JWTLeeway
+	keys, err := loadSigningKeys(cfg.JWTSigningKeyFiles)
+	if err != nil {
+		logln("Failed to load JWT signing keys:", err)
+		return
+	}
+	signingKeys = keys
 
-	store, err := NewPostgresStorage()
+	store, err := NewPostgresStorage(cfg.DatabaseDSN)
 
 	if err != nil {
-		fmt.Println("Failed to initialize storage:", err)
+		logln("Failed to initialize storage:", err)
 		return
 	}
 	defer store.Close()
 
 	// Initialize the database (create tables)
 	if err := store.Init(); err != nil {
-		fmt.Println("Failed to initialize database:", err)
+		logln("Failed to initialize database:", err)
+		return
+	}
+
+	if *seed != 0 {
+		summary, err := seedDatabase(store, defaultTenantID, *seed, *seedAccounts)
+		if err != nil {
+			logln("Failed to seed database:", err)
+			return
+		}
+		logf("Seeded %d accounts (%d already present) with %d transactions\n", summary.Accounts, summary.Skipped, summary.Transactions)
 		return
 	}
 
-	server := NewApiServer(":3000")
-	server.store = store
+	server := NewApiServer(cfg)
+	server.store = wrapStorage(cacheStorage(store, cfg.CacheTTL))
 	server.Run()
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createMandatesTable = `
+        CREATE TABLE IF NOT EXISTS mandates (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            merchant_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            customer_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            description TEXT NOT NULL DEFAULT '',
+            max_per_payment INT NOT NULL CHECK (max_per_payment > 0),
+            monthly_limit INT NOT NULL CHECK (monthly_limit > 0),
+            status TEXT NOT NULL DEFAULT 'pending',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            confirmed_at TIMESTAMPTZ,
+            cancelled_at TIMESTAMPTZ
+        )
+    `
+
+const createMandatePaymentsTable = `
+        CREATE TABLE IF NOT EXISTS mandate_payments (
+            id SERIAL PRIMARY KEY,
+            mandate_id INT NOT NULL REFERENCES mandates(id) ON DELETE CASCADE,
+            transfer_id INT NOT NULL REFERENCES transfers(id),
+            amount INT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Mandate statuses. A mandate is created pending and can only be collected
+// against once the customer has confirmed it.
+const (
+	mandatePending   = "pending"
+	mandateActive    = "active"
+	mandateCancelled = "cancelled"
+)
+
+var (
+	errMandateNotActive   = errors.New("mandate is not active")
+	errMandateLimit       = errors.New("payment exceeds mandate limit")
+	errMandateMonthlyUsed = errors.New("payment exceeds mandate monthly limit")
+)
+
+// mandate authorises a merchant to pull payments from a customer's account,
+// each no larger than MaxPerPayment and together no more than MonthlyLimit
+// per calendar month (UTC).
+type mandate struct {
+	ID                int        `json:"id"`
+	TenantID          int        `json:"tenant_id"`
+	MerchantAccountID int        `json:"merchant_account_id"`
+	CustomerAccountID int        `json:"customer_account_id"`
+	Description       string     `json:"description"`
+	MaxPerPayment     int        `json:"max_per_payment"`
+	MonthlyLimit      int        `json:"monthly_limit"`
+	Status            string     `json:"status"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ConfirmedAt       *time.Time `json:"confirmed_at,omitempty"`
+	CancelledAt       *time.Time `json:"cancelled_at,omitempty"`
+}
+
+type CreateMandateRequest struct {
+	Customer      SplitParticipant `json:"customer"`
+	Description   string           `json:"description"`
+	MaxPerPayment int              `json:"max_per_payment"`
+	MonthlyLimit  int              `json:"monthly_limit"`
+}
+
+type CollectMandateRequest struct {
+	Amount int    `json:"amount"`
+	Memo   string `json:"memo"`
+}
+
+// MandateStorage holds the direct debit mandate storage operations.
+type MandateStorage interface {
+	CreateMandate(*mandate) error
+	GetMandate(id int) (*mandate, error)
+	GetMandatesByMerchant(accountID int, page pageRequest) ([]*mandate, int, error)
+	GetMandatesByCustomer(accountID int, page pageRequest) ([]*mandate, int, error)
+	SetMandateStatus(m *mandate, from []string, to string) error
+	CollectMandate(mandateID int, t *transfer) error
+}
+
+const selectMandates = "SELECT id, tenant_id, merchant_account_id, customer_account_id, description, max_per_payment, monthly_limit, status, created_at, confirmed_at, cancelled_at FROM mandates "
+
+func scanMandate(row interface{ Scan(...any) error }) (*mandate, error) {
+	m := &mandate{}
+	err := row.Scan(&m.ID, &m.TenantID, &m.MerchantAccountID, &m.CustomerAccountID, &m.Description, &m.MaxPerPayment, &m.MonthlyLimit, &m.Status, &m.CreatedAt, &m.ConfirmedAt, &m.CancelledAt)
+	return m, err
+}
+
+// CreateMandate stores a pending mandate.
+func (s *PostgresStorage) CreateMandate(m *mandate) error {
+	return s.db.QueryRow(
+		"INSERT INTO mandates (tenant_id, merchant_account_id, customer_account_id, description, max_per_payment, monthly_limit, status) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+		m.TenantID, m.MerchantAccountID, m.CustomerAccountID, m.Description, m.MaxPerPayment, m.MonthlyLimit, m.Status,
+	).Scan(&m.ID, &m.CreatedAt)
+}
+
+// GetMandate retrieves a mandate by its ID.
+func (s *PostgresStorage) GetMandate(id int) (*mandate, error) {
+	return scanMandate(s.db.QueryRow(selectMandates+"WHERE id = $1", id))
+}
+
+// GetMandatesByMerchant returns a page of the mandates a merchant holds,
+// newest first, and their total count.
+func (s *PostgresStorage) GetMandatesByMerchant(accountID int, page pageRequest) ([]*mandate, int, error) {
+	return s.queryMandates("merchant_account_id", accountID, page)
+}
+
+// GetMandatesByCustomer returns a page of the mandates given by a customer,
+// newest first, and their total count.
+func (s *PostgresStorage) GetMandatesByCustomer(accountID int, page pageRequest) ([]*mandate, int, error) {
+	return s.queryMandates("customer_account_id", accountID, page)
+}
+
+func (s *PostgresStorage) queryMandates(column string, accountID int, page pageRequest) ([]*mandate, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM mandates WHERE "+column+" = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	rows, err := s.db.Query(selectMandates+"WHERE "+column+" = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	mandates := make([]*mandate, 0)
+	for rows.Next() {
+		m, err := scanMandate(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		mandates = append(mandates, m)
+	}
+	return mandates, total, rows.Err()
+}
+
+// SetMandateStatus moves a mandate to a new status, provided it is still in
+// one of the from statuses, and refreshes m.
+func (s *PostgresStorage) SetMandateStatus(m *mandate, from []string, to string) error {
+	row := s.db.QueryRow(`
+        UPDATE mandates SET status = $2,
+            confirmed_at = CASE WHEN $2 = 'active' THEN now() ELSE confirmed_at END,
+            cancelled_at = CASE WHEN $2 = 'cancelled' THEN now() ELSE cancelled_at END
+        WHERE id = $1 AND status = ANY($3)
+        RETURNING id, tenant_id, merchant_account_id, customer_account_id, description, max_per_payment, monthly_limit, status, created_at, confirmed_at, cancelled_at`,
+		m.ID, to, pq.Array(from),
+	)
+	updated, err := scanMandate(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errMandateNotActive
+	}
+	if err != nil {
+		return err
+	}
+	*m = *updated
+	return nil
+}
+
+// CollectMandate makes a transfer under a mandate, checking the mandate's
+// status and limits while holding its row lock so concurrent collections
+// cannot exceed the monthly limit.
+func (s *PostgresStorage) CollectMandate(mandateID int, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := collectMandate(tx, mandateID, t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// collectMandate is CollectMandate within the caller's transaction.
+func collectMandate(tx *sql.Tx, mandateID int, t *transfer) error {
+	m, err := scanMandate(tx.QueryRow(selectMandates+"WHERE id = $1 FOR UPDATE", mandateID))
+	if err != nil {
+		return err
+	}
+	if m.Status != mandateActive {
+		return errMandateNotActive
+	}
+	if t.Amount > m.MaxPerPayment {
+		return errMandateLimit
+	}
+	var collected int
+	err = tx.QueryRow(
+		"SELECT COALESCE(SUM(amount), 0) FROM mandate_payments WHERE mandate_id = $1 AND created_at >= date_trunc('month', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'",
+		mandateID,
+	).Scan(&collected)
+	if err != nil {
+		return err
+	}
+	if collected+t.Amount > m.MonthlyLimit {
+		return errMandateMonthlyUsed
+	}
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO mandate_payments (mandate_id, transfer_id, amount) VALUES ($1, $2, $3)", mandateID, t.ID, t.Amount)
+	return err
+}
+
+// merchantMandate loads a mandate held by the calling merchant.
+func (s *Apiserver) merchantMandate(r *http.Request) (*mandate, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.store.GetMandate(id)
+	if err != nil || m.MerchantAccountID != requestAPIKey(r).AccountID {
+		return nil, newAPIError(http.StatusNotFound, "mandate_not_found", id)
+	}
+	return m, nil
+}
+
+// customerMandate loads a mandate given by the caller.
+func (s *Apiserver) customerMandate(r *http.Request) (*account, *mandate, error) {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := s.store.GetMandate(id)
+	if err != nil || m.CustomerAccountID != caller.ID {
+		return nil, nil, newAPIError(http.StatusNotFound, "mandate_not_found", id)
+	}
+	return caller, m, nil
+}
+
+// handleMerchantMandates lists the merchant's mandates (GET) or requests a
+// new one from a customer (POST), who must confirm it before it can be used.
+func (s *Apiserver) handleMerchantMandates(w http.ResponseWriter, r *http.Request) error {
+	merchant, err := s.store.GetAccountByID(requestAPIKey(r).AccountID)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		mandates, total, err := s.store.GetMandatesByMerchant(merchant.ID, page)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, paginate(mandates, total, page, func(m *mandate) cursor { return cursor{m.CreatedAt, m.ID} }))
+	}
+
+	req := CreateMandateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.MaxPerPayment <= 0 || req.MonthlyLimit <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	customer, err := s.resolveParticipant(merchant.TenantID, req.Customer)
+	if err != nil {
+		return err
+	}
+	if customer.ID == merchant.ID {
+		return newAPIError(http.StatusBadRequest, "same_account_transfer")
+	}
+	if customer.Currency != merchant.Currency {
+		return newAPIError(http.StatusBadRequest, "currency_mismatch", merchant.Currency, customer.Currency)
+	}
+
+	m := &mandate{
+		TenantID:          merchant.TenantID,
+		MerchantAccountID: merchant.ID,
+		CustomerAccountID: customer.ID,
+		Description:       strings.TrimSpace(req.Description),
+		MaxPerPayment:     req.MaxPerPayment,
+		MonthlyLimit:      req.MonthlyLimit,
+		Status:            mandatePending,
+	}
+	if err := s.store.CreateMandate(m); err != nil {
+		return err
+	}
+	s.notify(customer.ID, "mandate_requested", fmt.Sprintf("%s requested a direct debit mandate of up to %s per month for %q. Confirm: POST /mandates/%d/confirm",
+		merchant.Name, formatMoney(m.MonthlyLimit, merchant.Currency, defaultLocale), m.Description, m.ID))
+	return writeJSON(w, http.StatusCreated, m)
+}
+
+// handleCollectMandate pulls a payment from the customer under an active mandate.
+func (s *Apiserver) handleCollectMandate(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.merchantMandate(r)
+	if err != nil {
+		return err
+	}
+	req := CollectMandateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	customer, err := s.store.GetAccountByID(m.CustomerAccountID)
+	if err != nil {
+		return err
+	}
+	memo := req.Memo
+	if memo == "" {
+		memo = m.Description
+	}
+	t, err := s.newTransfer(customer, m.MerchantAccountID, req.Amount, memo)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.CollectMandate(m.ID, t); err != nil {
+		return collectFailed(err, m)
+	}
+	s.transferCompleted(t)
+	s.notify(customer.ID, "mandate_collected", fmt.Sprintf("%s was collected under your direct debit mandate %d (ref %s)",
+		formatMoney(t.Amount, t.Currency, defaultLocale), m.ID, t.Reference))
+	return writeJSON(w, http.StatusCreated, t)
+}
+
+// collectFailed maps the storage errors of a collection under m to API errors.
+func collectFailed(err error, m *mandate) error {
+	switch {
+	case errors.Is(err, errMandateNotActive):
+		return newAPIError(http.StatusConflict, "mandate_not_active", m.ID)
+	case errors.Is(err, errMandateLimit):
+		return newAPIError(http.StatusUnprocessableEntity, "mandate_limit_exceeded", m.MaxPerPayment)
+	case errors.Is(err, errMandateMonthlyUsed):
+		return newAPIError(http.StatusUnprocessableEntity, "mandate_monthly_limit_exceeded", m.MonthlyLimit)
+	}
+	return transferFailed(err)
+}
+
+// handleMandates lists the mandates the caller has given, newest first.
+func (s *Apiserver) handleMandates(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	mandates, total, err := s.store.GetMandatesByCustomer(caller.ID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(mandates, total, page, func(m *mandate) cursor { return cursor{m.CreatedAt, m.ID} }))
+}
+
+// handleConfirmMandate lets the customer activate a pending mandate.
+func (s *Apiserver) handleConfirmMandate(w http.ResponseWriter, r *http.Request) error {
+	_, m, err := s.customerMandate(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetMandateStatus(m, []string{mandatePending}, mandateActive); errors.Is(err, errMandateNotActive) {
+		return newAPIError(http.StatusConflict, "mandate_not_pending", m.ID)
+	} else if err != nil {
+		return err
+	}
+	s.notify(m.MerchantAccountID, "mandate_confirmed", fmt.Sprintf("Direct debit mandate %d was confirmed", m.ID))
+	return writeJSON(w, http.StatusOK, m)
+}
+
+// handleCancelMandate lets the customer cancel a mandate; no further payments
+// can be collected under it.
+func (s *Apiserver) handleCancelMandate(w http.ResponseWriter, r *http.Request) error {
+	_, m, err := s.customerMandate(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetMandateStatus(m, []string{mandatePending, mandateActive}, mandateCancelled); errors.Is(err, errMandateNotActive) {
+		return newAPIError(http.StatusConflict, "mandate_not_active", m.ID)
+	} else if err != nil {
+		return err
+	}
+	s.notify(m.MerchantAccountID, "mandate_cancelled", fmt.Sprintf("Direct debit mandate %d was cancelled by the customer", m.ID))
+	return writeJSON(w, http.StatusOK, m)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createMerchantsTable = `
+        CREATE TABLE IF NOT EXISTS merchants (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT UNIQUE NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            settlement_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            fee_bps INT NOT NULL CHECK (fee_bps BETWEEN 0 AND 10000),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// maxFeeBPS is a fee of the whole charge, in basis points.
+const maxFeeBPS = 10000
+
+// merchant is an account that takes payments through the charge API, using
+// API keys issued for the account. Charges settle into SettlementAccountID
+// less a fee of FeeBPS basis points.
+type merchant struct {
+	ID                  int       `json:"id"`
+	TenantID            int       `json:"tenant_id"`
+	AccountID           int       `json:"account_id"`
+	SettlementAccountID int       `json:"settlement_account_id"`
+	Name                string    `json:"name"`
+	FeeBPS              int       `json:"fee_bps"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+type CreateMerchantRequest struct {
+	AccountID           int    `json:"account_id"`
+	SettlementAccountID int    `json:"settlement_account_id"`
+	Name                string `json:"name"`
+	FeeBPS              int    `json:"fee_bps"`
+}
+
+// MerchantStorage holds the merchant storage operations.
+type MerchantStorage interface {
+	CreateMerchant(*merchant) error
+	GetMerchants(tenantID int) ([]*merchant, error)
+	GetMerchant(id int) (*merchant, error)
+	GetMerchantByAccount(accountID int) (*merchant, error)
+}
+
+const selectMerchants = "SELECT id, tenant_id, account_id, settlement_account_id, name, fee_bps, created_at FROM merchants "
+
+func scanMerchant(row interface{ Scan(...any) error }) (*merchant, error) {
+	m := &merchant{}
+	err := row.Scan(&m.ID, &m.TenantID, &m.AccountID, &m.SettlementAccountID, &m.Name, &m.FeeBPS, &m.CreatedAt)
+	return m, err
+}
+
+// CreateMerchant registers an account as a merchant.
+func (s *PostgresStorage) CreateMerchant(m *merchant) error {
+	return s.db.QueryRow(
+		"INSERT INTO merchants (tenant_id, account_id, settlement_account_id, name, fee_bps) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		m.TenantID, m.AccountID, m.SettlementAccountID, m.Name, m.FeeBPS,
+	).Scan(&m.ID, &m.CreatedAt)
+}
+
+// GetMerchants lists a tenant's merchants.
+func (s *PostgresStorage) GetMerchants(tenantID int) ([]*merchant, error) {
+	rows, err := s.db.Query(selectMerchants+"WHERE tenant_id = $1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	merchants := make([]*merchant, 0)
+	for rows.Next() {
+		m, err := scanMerchant(rows)
+		if err != nil {
+			return nil, err
+		}
+		merchants = append(merchants, m)
+	}
+	return merchants, rows.Err()
+}
+
+// GetMerchant retrieves a merchant by its ID.
+func (s *PostgresStorage) GetMerchant(id int) (*merchant, error) {
+	return scanMerchant(s.db.QueryRow(selectMerchants+"WHERE id = $1", id))
+}
+
+// GetMerchantByAccount retrieves the merchant an account belongs to.
+func (s *PostgresStorage) GetMerchantByAccount(accountID int) (*merchant, error) {
+	return scanMerchant(s.db.QueryRow(selectMerchants+"WHERE account_id = $1", accountID))
+}
+
+// chargeFee is the merchant's fee on a charge, rounded down to a minor unit.
+func (m *merchant) chargeFee(amount int) int {
+	return amount * m.FeeBPS / 10000
+}
+
+// currentMerchant loads the merchant whose API key authenticated the request.
+func (s *Apiserver) currentMerchant(r *http.Request) (*merchant, error) {
+	m, err := s.store.GetMerchantByAccount(requestAPIKey(r).AccountID)
+	if err != nil {
+		return nil, newAPIError(http.StatusForbidden, "merchant_required")
+	}
+	return m, nil
+}
+
+// handleMerchants lists the tenant's merchants (GET) or registers an account
+// as a merchant (POST).
+func (s *Apiserver) handleMerchants(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		merchants, err := s.store.GetMerchants(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, merchants)
+	}
+
+	req := CreateMerchantRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if req.FeeBPS < 0 || req.FeeBPS > maxFeeBPS {
+		return newAPIError(http.StatusBadRequest, "invalid_fee", maxFeeBPS)
+	}
+	acc, err := s.store.GetAccountByID(req.AccountID)
+	if err != nil || acc.TenantID != tenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", req.AccountID)
+	}
+	if _, err := s.store.GetMerchantByAccount(acc.ID); err == nil {
+		return newAPIError(http.StatusConflict, "merchant_exists", acc.ID)
+	}
+	settlement, err := s.store.GetAccountByID(req.SettlementAccountID)
+	if err != nil || settlement.TenantID != tenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", req.SettlementAccountID)
+	}
+	if settlement.Currency != acc.Currency {
+		return newAPIError(http.StatusBadRequest, "currency_mismatch", acc.Currency, settlement.Currency)
+	}
+
+	m := &merchant{
+		TenantID:            tenantID,
+		AccountID:           acc.ID,
+		SettlementAccountID: settlement.ID,
+		Name:                req.Name,
+		FeeBPS:              req.FeeBPS,
+	}
+	if err := s.store.CreateMerchant(m); err != nil {
+		return err
+	}
+	s.audit(r, "merchant.created", "merchant", m.ID, m)
+	return writeJSON(w, http.StatusCreated, m)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on account metadata, which holds references for integrators
+// rather than documents.
+const (
+	maxMetadataKeys        = 50
+	maxMetadataKeyLength   = 40
+	maxMetadataValueLength = 500
+)
+
+// metadataQueryPrefix marks the admin search parameters that filter on
+// metadata: ?meta.crm_id=42 matches accounts whose crm_id is "42".
+const metadataQueryPrefix = "meta."
+
+var errTooManyMetadataKeys = errors.New("too many metadata keys")
+
+// MetadataStorage holds the account metadata storage operations.
+type MetadataStorage interface {
+	GetAccountMetadata(id int) (map[string]string, error)
+	UpdateAccountMetadata(id int, set map[string]string, remove []string) (map[string]string, error)
+}
+
+// GetAccountMetadata returns the metadata of an account.
+func (s *PostgresStorage) GetAccountMetadata(id int) (map[string]string, error) {
+	var raw []byte
+	if err := s.db.QueryRow("SELECT metadata FROM accounts WHERE id = $1", id).Scan(&raw); err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	return metadata, json.Unmarshal(raw, &metadata)
+}
+
+// UpdateAccountMetadata sets and removes keys of an account's metadata and
+// returns the result. It returns errTooManyMetadataKeys, changing nothing,
+// if the account would end up with more than maxMetadataKeys.
+func (s *PostgresStorage) UpdateAccountMetadata(id int, set map[string]string, remove []string) (map[string]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var raw []byte
+	if err := tx.QueryRow("SELECT metadata FROM accounts WHERE id = $1 FOR UPDATE", id).Scan(&raw); err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return nil, err
+	}
+	for k, v := range set {
+		metadata[k] = v
+	}
+	for _, k := range remove {
+		delete(metadata, k)
+	}
+	if len(metadata) > maxMetadataKeys {
+		return nil, errTooManyMetadataKeys
+	}
+	if raw, err = json.Marshal(metadata); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE accounts SET metadata = $1 WHERE id = $2", raw, id); err != nil {
+		return nil, err
+	}
+	return metadata, tx.Commit()
+}
+
+func validMetadataKey(k string) bool {
+	if k == "" || len(k) > maxMetadataKeyLength {
+		return false
+	}
+	for _, c := range k {
+		if !(c == '_' || c == '-' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataFilter returns the metadata an admin search must match, from its
+// meta.* query parameters.
+func metadataFilter(r *http.Request) (map[string]string, error) {
+	filter := map[string]string{}
+	for param, values := range r.URL.Query() {
+		k, ok := strings.CutPrefix(param, metadataQueryPrefix)
+		if !ok {
+			continue
+		}
+		if !validMetadataKey(k) {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_metadata_key", k)
+		}
+		filter[k] = values[0]
+	}
+	return filter, nil
+}
+
+// handleAccountMetadata returns an account's metadata (GET) or updates it
+// (PATCH). A PATCH body maps keys to their new string values; a null
+// value removes the key and keys not mentioned are left alone.
+func (s *Apiserver) handleAccountMetadata(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		metadata, err := s.store.GetAccountMetadata(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, metadata)
+	}
+
+	req := map[string]*string{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	set, remove := map[string]string{}, []string{}
+	for k, v := range req {
+		if !validMetadataKey(k) {
+			return newAPIError(http.StatusBadRequest, "invalid_metadata_key", k)
+		}
+		if v == nil {
+			remove = append(remove, k)
+			continue
+		}
+		if utf8.RuneCountInString(*v) > maxMetadataValueLength {
+			return newAPIError(http.StatusBadRequest, "metadata_value_too_long", k, maxMetadataValueLength)
+		}
+		set[k] = *v
+	}
+	metadata, err := s.store.UpdateAccountMetadata(acc.ID, set, remove)
+	if errors.Is(err, errTooManyMetadataKeys) {
+		return newAPIError(http.StatusBadRequest, "too_many_metadata_keys", maxMetadataKeys)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "account.metadata_updated", "account", acc.ID, req)
+	return writeJSON(w, http.StatusOK, metadata)
+}
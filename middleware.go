@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// middleware wraps a handler with a concern shared by many routes, such as
+// authentication or a feature flag. Concerns of every request, like request
+// IDs, security headers and request logging, are router middleware instead.
+type middleware func(apiFunc) apiFunc
+
+// requestTimeout bounds the work of a request that honours its context,
+// such as outbound calls and login delays, within the server's write
+// timeout.
+const requestTimeout = 25 * time.Second
+
+// routeMux routes requests by method and path pattern. A request to a known
+// path with a method it does not take is answered with a 405 listing the
+// methods it does, rather than reaching a handler, and OPTIONS requests to
+// a known path are answered with the methods it takes, for discovery and
+// CORS preflights.
+type routeMux struct {
+	*http.ServeMux
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux()}
+}
+
+// routeMethods are the methods a 405 may list as allowed.
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// handle routes the methods of path to h, or all methods if none are given.
+func (m *routeMux) handle(path string, h http.Handler, methods ...string) {
+	if len(methods) == 0 {
+		m.Handle(path, h)
+	}
+	for _, method := range methods {
+		m.Handle(method+" "+path, h)
+	}
+}
+
+// allowed returns the methods the path of r takes, OPTIONS included, or
+// nil if no route has the path.
+func (m *routeMux) allowed(r *http.Request) []string {
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := *r
+		probe.Method = method
+		if _, pattern := m.Handler(&probe); pattern != "" {
+			allowed = append(allowed, method)
+		}
+	}
+	if allowed == nil {
+		return nil
+	}
+	return append(allowed, "OPTIONS")
+}
+
+func (m *routeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := m.Handler(r); pattern == "" {
+		if allowed := m.allowed(r); allowed != nil {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeError(w, r, newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", r.Method, strings.Join(allowed, ", ")))
+			return
+		}
+	}
+	m.ServeMux.ServeHTTP(w, r)
+}
+
+// chain wraps h in middlewares, the first outermost.
+func chain(h http.Handler, middlewares ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// routeGroup registers routes behind a shared chain of middleware, the
+// first outermost. Groups derive from one another to add to the chain.
+type routeGroup struct {
+	router      *routeMux
+	middlewares []middleware
+}
+
+func newRouteGroup(router *routeMux, middlewares ...middleware) *routeGroup {
+	return &routeGroup{router: router, middlewares: middlewares}
+}
+
+// with returns a group running the middlewares after those of g.
+func (g *routeGroup) with(middlewares ...middleware) *routeGroup {
+	return &routeGroup{router: g.router, middlewares: append(slices.Clone(g.middlewares), middlewares...)}
+}
+
+// handler wraps fn in the group's middleware and writes the error it
+// returns, if any.
+func (g *routeGroup) handler(fn apiFunc) http.HandlerFunc {
+	for i := len(g.middlewares) - 1; i >= 0; i-- {
+		fn = g.middlewares[i](fn)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(w, r); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// handle routes the methods of path to fn, recording path as the route of
+// the requests it serves.
+func (g *routeGroup) handle(path string, fn apiFunc, methods ...string) {
+	h := g.handler(fn)
+	g.router.handle(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, rc := contextOf(r)
+		rc.route = path
+		h(w, r)
+	}), methods...)
+}
+
+// recoverPanic answers a panicking handler with a 500 and logs the stack,
+// rather than dropping the connection.
+func recoverPanic(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				logf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				err = newAPIError(http.StatusInternalServerError, "internal_error")
+			}
+		}()
+		return next(w, r)
+	}
+}
+
+// withTimeout gives the request context a deadline.
+func withTimeout(d time.Duration) middleware {
+	return func(next apiFunc) apiFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			return next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// authenticate requires a valid access token of the request's tenant and
+// responds as its holder sees things.
+func authenticate(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		tokenString, _ := bearerToken(r)
+		if tokenString == "" {
+			return newAPIError(http.StatusUnauthorized, "missing_authorization")
+		}
+		claims, err := verifyToken(tokenString, requestTenant(r).JWTAudience)
+		if err != nil {
+			return newAPIError(http.StatusUnauthorized, "invalid_token")
+		}
+
+		r = setRequestCaller(r, claims)
+		trackActivity(r, claims)
+		return next(&viewerWriter{ResponseWriter: w, viewer: requestCaller(r)}, r)
+	}
+}
+
+// requireAdmin only lets tokens with the admin role through. It runs after
+// authenticate.
+func requireAdmin(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if !isAdmin(r) {
+			return newAPIError(http.StatusForbidden, "admin_required")
+		}
+		return next(w, r)
+	}
+}
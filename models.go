@@ -2,43 +2,94 @@
 package main
 
 import (
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
 type CreateAccountRequest struct {
 	Email    string `json:"email"`
-	Password string `json:"password"`
+	Phone    string `json:"phone,omitempty"`
+	Password string `json:"password,omitempty"`
 	Name     string `json:"name"`
 	Number   string `json:"number"`
 	Balance  int    `json:"balance"`
+	Currency string `json:"currency"`
+	Product  string `json:"product,omitempty"`
 }
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email             string `json:"email"`
+	Password          string `json:"password"`
+	DeviceFingerprint string `json:"device_fingerprint,omitempty"`
+	Session           bool   `json:"session,omitempty"`
+	CaptchaToken      string `json:"captcha_token,omitempty"`
+}
+type LoginResponse struct {
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	CSRFToken    string `json:"csrf_token,omitempty"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 // account struct represents an account entity.
 type account struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Password string `json:"-"`
 	ID       int    `json:"id"`
+	TenantID int    `json:"tenant_id"`
 	Name     string `json:"name"`
 	Number   string `json:"number"`
 	Balance  int    `json:"balance"`
+	Role     string `json:"role"`
+
+	Currency         string `json:"currency"`
+	Locale           string `json:"locale,omitempty"`
+	Timezone         string `json:"timezone,omitempty"`
+	BalanceFormatted string `json:"balance_formatted,omitempty"`
+
+	// ProductID is the product the account was opened on, which set its
+	// currency and overdraft limit.
+	ProductID      *int `json:"product_id,omitempty"`
+	OverdraftLimit int  `json:"overdraft_limit,omitempty"`
+
+	// Dormant accounts cannot send money until the holder reactivates
+	// them; see runDormancy.
+	Dormant   bool       `json:"dormant"`
+	DormantAt *time.Time `json:"dormant_at,omitempty"`
+
+	// ExternalID is the account's identifier in an upstream system that
+	// keeps it in sync; see handleUpsertAccountByExternalID.
+	ExternalID string `json:"external_id,omitempty"`
+
+	// Metadata holds integrators' own references, such as CRM IDs. It is
+	// only loaded by admin search and the metadata endpoint.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+const (
+	roleCustomer = "customer"
+	roleAdmin    = "admin"
+)
+
 // NewAccount creates a new account instance.
-func NewAccount(email string, password string, name, number string, balance int) (*account, error) {
+func NewAccount(tenantID int, email string, password string, name, number string, balance int) (*account, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
 	}
 
 	return &account{
+		TenantID: tenantID,
 		Email:    email,
 		Password: string(hashedPassword),
 		Name:     name,
 		Number:   number,
 		Balance:  balance,
+		Role:     roleCustomer,
+		Currency: defaultCurrency,
 	}, nil
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	defaultCurrency = "INR"
+	defaultLocale   = "en-IN"
+)
+
+// currency describes how amounts of a currency are written.
+type currency struct {
+	Symbol   string
+	Exponent int // number of minor-unit digits, e.g. 2 for paise
+}
+
+var currencies = map[string]currency{
+	"INR": {Symbol: "₹", Exponent: 2},
+	"USD": {Symbol: "$", Exponent: 2},
+	"EUR": {Symbol: "€", Exponent: 2},
+	"GBP": {Symbol: "£", Exponent: 2},
+	"JPY": {Symbol: "¥", Exponent: 0},
+	"NPR": {Symbol: "रू", Exponent: 2},
+}
+
+// numberFormat describes the digit grouping conventions of a locale.
+type numberFormat struct {
+	Group        string
+	Decimal      string
+	SymbolAfter  bool
+	IndianGroups bool // 12,34,567 instead of 1,234,567
+}
+
+var locales = map[string]numberFormat{
+	"en-IN": {Group: ",", Decimal: ".", IndianGroups: true},
+	"hi-IN": {Group: ",", Decimal: ".", IndianGroups: true},
+	"ne-NP": {Group: ",", Decimal: ".", IndianGroups: true},
+	"en-US": {Group: ",", Decimal: "."},
+	"en-GB": {Group: ",", Decimal: "."},
+	"de-DE": {Group: ".", Decimal: ",", SymbolAfter: true},
+	"fr-FR": {Group: " ", Decimal: ",", SymbolAfter: true},
+}
+
+// Money is an amount in minor units together with its display form.
+type Money struct {
+	MinorUnits int    `json:"minor_units"`
+	Currency   string `json:"currency"`
+	Formatted  string `json:"formatted"`
+}
+
+// NewMoney builds a Money value formatted for the given locale.
+func NewMoney(minorUnits int, currencyCode, locale string) Money {
+	return Money{MinorUnits: minorUnits, Currency: currencyCode, Formatted: formatMoney(minorUnits, currencyCode, locale)}
+}
+
+// formatMoney renders minor units as a human readable amount, e.g. 123456
+// INR in en-IN becomes "₹1,234.56". Unknown currencies fall back to their code
+// and unknown locales to en-US style grouping.
+func formatMoney(minorUnits int, currencyCode, locale string) string {
+	cur, ok := currencies[currencyCode]
+	if !ok {
+		cur = currency{Symbol: currencyCode + " ", Exponent: 2}
+	}
+	nf, ok := locales[locale]
+	if !ok {
+		nf = locales["en-US"]
+	}
+
+	sign := ""
+	if minorUnits < 0 {
+		sign = "-"
+		minorUnits = -minorUnits
+	}
+
+	digits := fmt.Sprintf("%0*d", cur.Exponent+1, minorUnits)
+	whole, frac := digits[:len(digits)-cur.Exponent], digits[len(digits)-cur.Exponent:]
+
+	number := groupDigits(whole, nf)
+	if cur.Exponent > 0 {
+		number += nf.Decimal + frac
+	}
+	if nf.SymbolAfter {
+		return sign + number + " " + strings.TrimSpace(cur.Symbol)
+	}
+	return sign + cur.Symbol + number
+}
+
+// groupDigits inserts group separators into a string of digits.
+func groupDigits(whole string, nf numberFormat) string {
+	if len(whole) <= 3 {
+		return whole
+	}
+	head, tail := whole[:len(whole)-3], whole[len(whole)-3:]
+	size := 3
+	if nf.IndianGroups {
+		size = 2
+	}
+	var groups []string
+	for len(head) > size {
+		groups = append([]string{head[len(head)-size:]}, groups...)
+		head = head[:len(head)-size]
+	}
+	groups = append([]string{head}, groups...)
+	return strings.Join(append(groups, tail), nf.Group)
+}
+
+// moneyFormatter is implemented by response types that carry amounts which
+// should be rendered for the caller's locale before being written.
+type moneyFormatter interface {
+	formatMoney(locale string)
+}
+
+// formatMoney fills in the display form of the account balance.
+func (a *account) formatMoney(locale string) {
+	if a.Currency == "" {
+		a.Currency = defaultCurrency
+	}
+	a.BalanceFormatted = formatMoney(a.Balance, a.Currency, locale)
+}
+
+// writeLocalizedJSON is writeJSON for payloads with amounts: values (or slice
+// elements, or the data of an envelope) implementing moneyFormatter are
+// formatted for the request locale.
+func (s *Apiserver) writeLocalizedJSON(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	localizeMoney(v, s.requestLocale(r))
+	return writeJSON(w, status, v)
+}
+
+func localizeMoney(v any, locale string) {
+	if env, ok := v.(*envelope); ok {
+		localizeMoney(env.Data, locale)
+	} else if f, ok := v.(moneyFormatter); ok {
+		f.formatMoney(locale)
+	} else if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		for i := 0; i < rv.Len(); i++ {
+			if f, ok := rv.Index(i).Interface().(moneyFormatter); ok {
+				f.formatMoney(locale)
+			}
+		}
+	}
+}
+
+// requestLocale picks the caller's saved locale preference, then the first
+// supported Accept-Language entry, then the default locale.
+func (s *Apiserver) requestLocale(r *http.Request) string {
+	if requestEmail(r) != "" {
+		if acc, err := s.currentAccount(r); err == nil && acc.Locale != "" {
+			return acc.Locale
+		}
+	}
+	if locale := requestCtx(r).locale; locale != "" {
+		return locale
+	}
+	return defaultLocale
+}
+
+// PreferencesRequest sets the caller's locale, time zone or both; a field
+// left out keeps its value.
+type PreferencesRequest struct {
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// handleUpdatePreferences saves the caller's display locale and the time
+// zone their payments and statements are scheduled in.
+func (s *Apiserver) handleUpdatePreferences(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := PreferencesRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if _, ok := locales[req.Locale]; !ok && (req.Locale != "" || req.Timezone == "") {
+		return newAPIError(http.StatusBadRequest, "unsupported_locale", req.Locale)
+	}
+	if req.Timezone != "" {
+		if _, err := loadTimezone(req.Timezone); err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_timezone", req.Timezone)
+		}
+	}
+	changes := map[string]fieldChange{}
+	if req.Locale != "" && req.Locale != acc.Locale {
+		if err := s.store.UpdateAccountLocale(acc.ID, req.Locale); err != nil {
+			return err
+		}
+		changes["locale"] = fieldChange{From: acc.Locale, To: req.Locale}
+	}
+	if req.Timezone != "" && req.Timezone != acc.Timezone {
+		if err := s.store.UpdateAccountTimezone(acc.ID, req.Timezone); err != nil {
+			return err
+		}
+		changes["timezone"] = fieldChange{From: acc.Timezone, To: req.Timezone}
+	}
+	if len(changes) > 0 {
+		s.audit(r, "account.updated", "account", acc.ID, changes)
+	}
+	return writeJSON(w, http.StatusOK, PreferencesRequest{Locale: cmp.Or(req.Locale, acc.Locale), Timezone: cmp.Or(req.Timezone, acc.Timezone)})
+}
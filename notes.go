@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const createTransactionNotesTable = `
+        CREATE TABLE IF NOT EXISTS transaction_notes (
+            ledger_entry_id INT PRIMARY KEY REFERENCES ledger_entries(id) ON DELETE CASCADE,
+            note TEXT NOT NULL DEFAULT '',
+            tags TEXT[] NOT NULL DEFAULT '{}',
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createTransactionNoteTagsIndex = `CREATE INDEX IF NOT EXISTS transaction_notes_tags_idx ON transaction_notes USING GIN (tags)`
+
+// Limits of the notes and tags holders keep on their transactions.
+const (
+	maxNoteLength = 500
+	maxEntryTags  = 10
+)
+
+// tagPattern is what a tag looks like once lowercased.
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}_-]{0,31}$`)
+
+// transactionNote is the holder's own note and tags on a ledger entry. It
+// is kept apart from the ledger, which never changes.
+type transactionNote struct {
+	EntryID   int       `json:"entry_id"`
+	Note      string    `json:"note"`
+	Tags      []string  `json:"tags"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type TransactionNoteRequest struct {
+	Note string   `json:"note"`
+	Tags []string `json:"tags"`
+}
+
+// NoteStorage holds the storage operations on transaction notes.
+type NoteStorage interface {
+	SetTransactionNote(n *transactionNote) error
+	GetAccountTags(accountID int) ([]*tagCount, error)
+}
+
+// SetTransactionNote saves the note and tags of an entry, removing them
+// when both are empty.
+func (s *PostgresStorage) SetTransactionNote(n *transactionNote) error {
+	if n.Note == "" && len(n.Tags) == 0 {
+		_, err := s.db.Exec("DELETE FROM transaction_notes WHERE ledger_entry_id = $1", n.EntryID)
+		n.UpdatedAt = clock.Now()
+		return err
+	}
+	return s.db.QueryRow(`
+        INSERT INTO transaction_notes (ledger_entry_id, note, tags) VALUES ($1, $2, $3)
+        ON CONFLICT (ledger_entry_id) DO UPDATE SET note = EXCLUDED.note, tags = EXCLUDED.tags, updated_at = now()
+        RETURNING updated_at`,
+		n.EntryID, n.Note, pq.Array(n.Tags),
+	).Scan(&n.UpdatedAt)
+}
+
+// GetAccountTags lists the tags used on an account's entries, most used
+// first.
+func (s *PostgresStorage) GetAccountTags(accountID int) ([]*tagCount, error) {
+	rows, err := s.db.Query(`
+        SELECT tag, COUNT(*) FROM transaction_notes tn
+        JOIN ledger_entries e ON e.id = tn.ledger_entry_id, unnest(tn.tags) AS tag
+        WHERE e.account_id = $1
+        GROUP BY tag ORDER BY 2 DESC, 1`,
+		accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]*tagCount, 0)
+	for rows.Next() {
+		t := &tagCount{}
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// normalizeTags lowercases and deduplicates tags, keeping their order.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, newAPIError(http.StatusBadRequest, "invalid_tag", tag)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxEntryTags {
+		return nil, newAPIError(http.StatusBadRequest, "too_many_tags", maxEntryTags)
+	}
+	return normalized, nil
+}
+
+// handleTransactionNote sets the caller's note and tags on one of their
+// transactions, replacing any they had. Empty ones clear it. Notes are
+// personal, so admins cannot set them and only the holder sees them.
+func (s *Apiserver) handleTransactionNote(w http.ResponseWriter, r *http.Request) error {
+	e, acc, err := s.authorizedEntry(r)
+	if err != nil {
+		return err
+	}
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	if acc.ID != caller.ID {
+		return newAPIError(http.StatusNotFound, "transaction_not_found", e.ID)
+	}
+	req := TransactionNoteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	n := &transactionNote{EntryID: e.ID, Note: strings.TrimSpace(req.Note)}
+	if utf8.RuneCountInString(n.Note) > maxNoteLength {
+		return newAPIError(http.StatusBadRequest, "note_too_long", maxNoteLength)
+	}
+	if n.Tags, err = normalizeTags(req.Tags); err != nil {
+		return err
+	}
+	if err := s.store.SetTransactionNote(n); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, n)
+}
+
+// handleAccountTags lists the tags the holder has used on the account's
+// transactions, for filtering its history with ?tag=.
+func (s *Apiserver) handleAccountTags(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	tags, err := s.store.GetAccountTags(acc.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, tags)
+}
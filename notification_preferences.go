@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Each holder chooses the channels of every notification kind, quiet hours
+// in their time zone and whether low priority notifications are batched
+// into a daily digest. Holders without a row get the defaults.
+const createNotificationPreferencesTable = `
+        CREATE TABLE IF NOT EXISTS notification_preferences (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            channels JSONB NOT NULL DEFAULT '{}',
+            quiet_start TEXT NOT NULL DEFAULT '',
+            quiet_end TEXT NOT NULL DEFAULT '',
+            timezone TEXT NOT NULL DEFAULT '',
+            digest BOOLEAN NOT NULL DEFAULT false,
+            digest_hour INT NOT NULL DEFAULT 8,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Notifications held back by quiet hours or for a digest wait in the
+// outbox until deliver_after.
+const createNotificationOutboxTable = `
+        CREATE TABLE IF NOT EXISTS notification_outbox (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            kind TEXT NOT NULL,
+            channel TEXT NOT NULL,
+            message TEXT NOT NULL,
+            email JSONB,
+            sms TEXT NOT NULL DEFAULT '',
+            digest BOOLEAN NOT NULL DEFAULT false,
+            deliver_after TIMESTAMPTZ NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Delivery channels of notifications and campaigns.
+const (
+	channelInApp = "in_app"
+	channelEmail = "email"
+	channelSMS   = "sms"
+	channelPush  = "push"
+)
+
+var notificationChannels = []string{channelInApp, channelEmail, channelSMS, channelPush}
+
+type notificationPriority int
+
+// High priority notifications are delivered during quiet hours; low
+// priority ones go into the daily digest of holders who chose one.
+const (
+	priorityLow notificationPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+// notificationKinds are the kinds of notification the server sends and
+// their priority.
+var notificationKinds = map[string]notificationPriority{
+	"account_dormant":             priorityNormal,
+	"account_reactivated":         priorityHigh,
+	"alert":                       priorityHigh,
+	"balance_adjusted":            priorityNormal,
+	"bill_paid":                   priorityLow,
+	"bill_payment_failed":         priorityNormal,
+	"cash_withdrawn":              priorityLow,
+	"charge_declined":             priorityNormal,
+	"charge_requested":            priorityNormal,
+	"charge_succeeded":            priorityLow,
+	"claim_collected":             priorityLow,
+	"claim_expired":               priorityNormal,
+	"consent_authorised":          priorityHigh,
+	"cosigner_added":              priorityHigh,
+	"deposit":                     priorityLow,
+	"dormancy_warning":            priorityNormal,
+	"funds_escheated":             priorityNormal,
+	"funds_reclaimed":             priorityNormal,
+	"geo_blocked":                 priorityHigh,
+	"geo_review":                  priorityHigh,
+	"invoice_paid":                priorityLow,
+	"invoice_received":            priorityNormal,
+	"low_balance":                 priorityNormal,
+	"mandate_cancelled":           priorityNormal,
+	"mandate_collected":           priorityLow,
+	"mandate_confirmed":           priorityNormal,
+	"mandate_requested":           priorityNormal,
+	"new_device":                  priorityHigh,
+	"password_changed":            priorityHigh,
+	"payee_added":                 priorityHigh,
+	"payee_allowlist_ending":      priorityNormal,
+	"split_paid":                  priorityLow,
+	"split_request":               priorityNormal,
+	"subscription_charged":        priorityLow,
+	"subscription_payment_failed": priorityNormal,
+	"subscription_started":        priorityNormal,
+	"ticket_reply":                priorityLow,
+	"ticket_status":               priorityLow,
+	"transfer_approval_requested": priorityHigh,
+	"transfer_approved":           priorityNormal,
+	"transfer_received":           priorityLow,
+	"transfer_rejected":           priorityNormal,
+}
+
+// defaultNotificationChannels are the channels of kind for holders who did
+// not choose any.
+func defaultNotificationChannels(kind string) []string {
+	if kind == "low_balance" {
+		return []string{channelInApp, channelEmail, channelSMS}
+	}
+	return []string{channelInApp}
+}
+
+// notificationDigestBatch is how many held notifications the outbox job
+// loads at once.
+const notificationDigestBatch = 500
+
+// quietHours is a daily window, given as "15:04" times in the holder's
+// time zone, during which only high priority notifications interrupt.
+// It wraps past midnight when End is before Start.
+type quietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// notificationPreferences are how a holder wants to be notified. Channels
+// maps notification kinds to their channels; kinds missing from it use
+// the defaults. Quiet hours and digests follow the account's time zone
+// unless Timezone sets another.
+type notificationPreferences struct {
+	Channels   map[string][]string `json:"channels"`
+	QuietHours *quietHours         `json:"quiet_hours,omitempty"`
+	Timezone   string              `json:"timezone"`
+	Digest     bool                `json:"digest"`
+	DigestHour int                 `json:"digest_hour"`
+}
+
+func defaultNotificationPreferences() *notificationPreferences {
+	return &notificationPreferences{Channels: map[string][]string{}, DigestHour: 8}
+}
+
+// channelsFor returns the channels notifications of kind go out on.
+func (p *notificationPreferences) channelsFor(kind string) []string {
+	if channels, ok := p.Channels[kind]; ok {
+		return channels
+	}
+	return defaultNotificationChannels(kind)
+}
+
+func (p *notificationPreferences) location() *time.Location {
+	loc, err := loadTimezone(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// deliverAfter is when a notification of kind may interrupt the holder on
+// a channel other than in-app: at the next digest for low priority ones
+// when digests are on, at the end of quiet hours for all but high priority
+// ones, and otherwise now.
+func (p *notificationPreferences) deliverAfter(kind string, now time.Time) (time.Time, bool) {
+	local := now.In(p.location())
+	priority, ok := notificationKinds[kind]
+	if !ok {
+		priority = priorityNormal
+	}
+	if p.Digest && priority == priorityLow {
+		next := time.Date(local.Year(), local.Month(), local.Day(), p.DigestHour, 0, 0, 0, local.Location())
+		if !next.After(local) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next, true
+	}
+	if p.QuietHours != nil && priority < priorityHigh {
+		if end, quiet := p.QuietHours.endAfter(local); quiet {
+			return end, false
+		}
+	}
+	return now, false
+}
+
+// endAfter reports whether local falls in the quiet hours and if so when
+// they end.
+func (q *quietHours) endAfter(local time.Time) (time.Time, bool) {
+	start, _ := parseClockTime(q.Start)
+	end, _ := parseClockTime(q.End)
+	minute := local.Hour()*60 + local.Minute()
+	quiet := start <= minute && minute < end
+	if end < start {
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
+
+// parseClockTime parses a "15:04" time of day into minutes after midnight.
+func parseClockTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// notificationContent is what a notification says. In-app and push
+// notifications and digests show Message; emails render Email, or the
+// generic notification template, and texts send SMS, or Message.
+type notificationContent struct {
+	Message string
+	Email   *notificationEmail
+	SMS     string
+}
+
+// notificationEmail names an email template and what it is given as .Data.
+type notificationEmail struct {
+	Template string `json:"template"`
+	Data     any    `json:"data"`
+}
+
+// queuedNotification is a notification held in the outbox for one channel.
+type queuedNotification struct {
+	ID           int
+	AccountID    int
+	Kind         string
+	Channel      string
+	Content      notificationContent
+	Digest       bool
+	DeliverAfter time.Time
+	CreatedAt    time.Time
+}
+
+// PushSender sends push notifications to an account holder's devices.
+type PushSender interface {
+	SendPush(acc *account, kind, message string) error
+}
+
+// logPushSender prints push notifications to the server log, for local
+// development.
+type logPushSender struct{}
+
+func (logPushSender) SendPush(acc *account, kind, message string) error {
+	fmt.Printf("push %s to account %d: %s\n", kind, acc.ID, message)
+	return nil
+}
+
+// NotificationPreferenceStorage holds the notification preference and
+// outbox storage operations.
+type NotificationPreferenceStorage interface {
+	// GetNotificationPreferences returns the defaults for holders who
+	// have not saved any.
+	GetNotificationPreferences(accountID int) (*notificationPreferences, error)
+	SaveNotificationPreferences(accountID int, p *notificationPreferences) error
+	QueueNotification(*queuedNotification) error
+	// TakeDueNotifications removes and returns the tenant's held
+	// notifications due by now, oldest first.
+	TakeDueNotifications(tenantID int, now time.Time, limit int) ([]*queuedNotification, error)
+}
+
+func (s *PostgresStorage) GetNotificationPreferences(accountID int) (*notificationPreferences, error) {
+	p := defaultNotificationPreferences()
+	var channels []byte
+	var start, end sql.NullString
+	var digest sql.NullBool
+	var digestHour sql.NullInt64
+	err := s.db.QueryRow(`
+        SELECT p.channels, p.quiet_start, p.quiet_end, COALESCE(NULLIF(p.timezone, ''), a.timezone), p.digest, p.digest_hour
+        FROM accounts a LEFT JOIN notification_preferences p ON p.account_id = a.id
+        WHERE a.id = $1`, accountID,
+	).Scan(&channels, &start, &end, &p.Timezone, &digest, &digestHour)
+	if err != nil {
+		return nil, err
+	}
+	if channels == nil {
+		return p, nil
+	}
+	p.Digest, p.DigestHour = digest.Bool, int(digestHour.Int64)
+	if err := json.Unmarshal(channels, &p.Channels); err != nil {
+		return nil, err
+	}
+	if start.String != "" {
+		p.QuietHours = &quietHours{Start: start.String, End: end.String}
+	}
+	return p, nil
+}
+
+func (s *PostgresStorage) SaveNotificationPreferences(accountID int, p *notificationPreferences) error {
+	channels, err := json.Marshal(p.Channels)
+	if err != nil {
+		return err
+	}
+	q := quietHours{}
+	if p.QuietHours != nil {
+		q = *p.QuietHours
+	}
+	_, err = s.db.Exec(`
+        INSERT INTO notification_preferences (account_id, channels, quiet_start, quiet_end, timezone, digest, digest_hour, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (account_id) DO UPDATE SET channels = $2, quiet_start = $3, quiet_end = $4, timezone = $5, digest = $6, digest_hour = $7, updated_at = $8`,
+		accountID, channels, q.Start, q.End, p.Timezone, p.Digest, p.DigestHour, clock.Now())
+	return err
+}
+
+func (s *PostgresStorage) QueueNotification(n *queuedNotification) error {
+	var email []byte
+	if n.Content.Email != nil {
+		var err error
+		if email, err = json.Marshal(n.Content.Email); err != nil {
+			return err
+		}
+	}
+	return s.db.QueryRow(
+		"INSERT INTO notification_outbox (account_id, kind, channel, message, email, sms, digest, deliver_after) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at",
+		n.AccountID, n.Kind, n.Channel, n.Content.Message, email, n.Content.SMS, n.Digest, n.DeliverAfter,
+	).Scan(&n.ID, &n.CreatedAt)
+}
+
+func (s *PostgresStorage) TakeDueNotifications(tenantID int, now time.Time, limit int) ([]*queuedNotification, error) {
+	rows, err := s.db.Query(`
+        DELETE FROM notification_outbox WHERE id IN (
+            SELECT o.id FROM notification_outbox o JOIN accounts a ON a.id = o.account_id
+            WHERE a.tenant_id = $1 AND o.deliver_after <= $2
+            ORDER BY o.id LIMIT $3 FOR UPDATE OF o SKIP LOCKED)
+        RETURNING id, account_id, kind, channel, message, email, sms, digest, deliver_after, created_at`,
+		tenantID, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queued := make([]*queuedNotification, 0)
+	for rows.Next() {
+		n := &queuedNotification{}
+		var email []byte
+		if err := rows.Scan(&n.ID, &n.AccountID, &n.Kind, &n.Channel, &n.Content.Message, &email, &n.Content.SMS, &n.Digest, &n.DeliverAfter, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		if email != nil {
+			n.Content.Email = &notificationEmail{}
+			if err := json.Unmarshal(email, n.Content.Email); err != nil {
+				return nil, err
+			}
+		}
+		queued = append(queued, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(queued, func(a, b *queuedNotification) int { return a.ID - b.ID })
+	return queued, nil
+}
+
+// deliverNotification sends a notification to acc on a channel other than
+// in-app. Channels the server cannot send on, and texts to holders without
+// a phone, are skipped.
+func (s *Apiserver) deliverNotification(acc *account, kind, channel string, content notificationContent) error {
+	switch channel {
+	case channelEmail:
+		if s.mailer == nil {
+			return nil
+		}
+		email := content.Email
+		if email == nil {
+			email = &notificationEmail{Template: "notification", Data: notificationEmailData{Message: content.Message}}
+		}
+		return emailSender{mailer: s.mailer}.send(email.Template, acc, email.Data)
+	case channelSMS:
+		if s.sms == nil || acc.Phone == "" {
+			return nil
+		}
+		body := content.SMS
+		if body == "" {
+			body = content.Message
+		}
+		return s.sendSMS(acc, kind, body)
+	case channelPush:
+		return s.push.SendPush(acc, kind, content.Message)
+	}
+	return nil
+}
+
+// deliverDigest sends a holder's held low priority notifications for one
+// channel as a single summary.
+func (s *Apiserver) deliverDigest(acc *account, channel string, items []*queuedNotification) error {
+	digest := notificationDigestEmail{}
+	for _, n := range items {
+		digest.Items = append(digest.Items, notificationDigestItem{Kind: n.Kind, Message: n.Content.Message, At: n.CreatedAt})
+	}
+	summary := translate(accountLanguage(acc), "notification_digest", len(items))
+	return s.deliverNotification(acc, "digest", channel, notificationContent{
+		Message: summary,
+		Email:   &notificationEmail{Template: "notification_digest", Data: digest},
+	})
+}
+
+// NotificationOutboxResult is what a run of the outbox job delivered.
+type NotificationOutboxResult struct {
+	Delivered int `json:"delivered"`
+	Digests   int `json:"digests"`
+	Failed    int `json:"failed"`
+}
+
+// runNotificationOutbox delivers the tenant's held notifications that are
+// due, sending each holder's digest items per channel as one summary.
+// Notifications are taken out of the outbox before they are sent, so a
+// failed delivery is logged and not retried.
+func (s *Apiserver) runNotificationOutbox(tenantID int) (*NotificationOutboxResult, error) {
+	result := &NotificationOutboxResult{}
+	for {
+		queued, err := s.store.TakeDueNotifications(tenantID, clock.Now(), notificationDigestBatch)
+		if err != nil {
+			return nil, err
+		}
+		if len(queued) == 0 {
+			return result, nil
+		}
+		type digestKey struct {
+			accountID int
+			channel   string
+		}
+		digests := map[digestKey][]*queuedNotification{}
+		var order []digestKey
+		accounts := map[int]*account{}
+		for _, n := range queued {
+			acc, ok := accounts[n.AccountID]
+			if !ok {
+				if acc, err = s.store.GetAccountContact(n.AccountID); err != nil {
+					logf("notifications: failed to load account %d: %v\n", n.AccountID, err)
+					result.Failed++
+					continue
+				}
+				accounts[n.AccountID] = acc
+			}
+			if n.Digest {
+				key := digestKey{n.AccountID, n.Channel}
+				if digests[key] == nil {
+					order = append(order, key)
+				}
+				digests[key] = append(digests[key], n)
+				continue
+			}
+			if err := s.deliverNotification(acc, n.Kind, n.Channel, n.Content); err != nil {
+				logf("notifications: failed to send %s %s to account %d: %v\n", n.Channel, n.Kind, n.AccountID, err)
+				result.Failed++
+				continue
+			}
+			result.Delivered++
+		}
+		for _, key := range order {
+			if err := s.deliverDigest(accounts[key.accountID], key.channel, digests[key]); err != nil {
+				logf("notifications: failed to send %s digest to account %d: %v\n", key.channel, key.accountID, err)
+				result.Failed++
+				continue
+			}
+			result.Digests++
+		}
+	}
+}
+
+func (s *Apiserver) startNotificationOutboxJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("notifications: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runNotificationOutbox(t.ID); err != nil {
+					logf("notifications: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
+
+// effectiveNotificationPreferences lists the channels of every kind, the
+// defaults included.
+func effectiveNotificationPreferences(p *notificationPreferences) *notificationPreferences {
+	out := *p
+	out.Channels = make(map[string][]string, len(notificationKinds))
+	for kind := range notificationKinds {
+		out.Channels[kind] = p.channelsFor(kind)
+	}
+	return &out
+}
+
+// handleNotificationPreferences returns (GET) or replaces (PUT) the
+// caller's notification preferences. Kinds left out of the channels, and
+// any other setting left out, keep their defaults.
+func (s *Apiserver) handleNotificationPreferences(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		p, err := s.store.GetNotificationPreferences(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, effectiveNotificationPreferences(p))
+	}
+
+	req := defaultNotificationPreferences()
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.Channels == nil {
+		req.Channels = map[string][]string{}
+	}
+	for kind, channels := range req.Channels {
+		if _, ok := notificationKinds[kind]; !ok {
+			return newAPIError(http.StatusBadRequest, "unknown_notification_kind", kind)
+		}
+		for _, channel := range channels {
+			if !slices.Contains(notificationChannels, channel) {
+				return newAPIError(http.StatusBadRequest, "invalid_channel", channel)
+			}
+		}
+	}
+	if q := req.QuietHours; q != nil {
+		start, err := parseClockTime(q.Start)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_time_of_day", q.Start)
+		}
+		end, err := parseClockTime(q.End)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_time_of_day", q.End)
+		}
+		if start == end {
+			return newAPIError(http.StatusBadRequest, "empty_quiet_hours")
+		}
+	}
+	if _, err := loadTimezone(req.Timezone); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_timezone", req.Timezone)
+	}
+	if req.DigestHour < 0 || req.DigestHour > 23 {
+		return newAPIError(http.StatusBadRequest, "invalid_digest_hour", req.DigestHour)
+	}
+	if err := s.store.SaveNotificationPreferences(acc.ID, req); err != nil {
+		return err
+	}
+	s.audit(r, "notification_preferences.updated", "account", acc.ID, req)
+	return writeJSON(w, http.StatusOK, effectiveNotificationPreferences(req))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const createNotificationsTable = `
+        CREATE TABLE IF NOT EXISTS notifications (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            kind TEXT NOT NULL,
+            message TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// notification is an in-app message shown to an account holder.
+type notification struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"account_id"`
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotificationStorage holds the notification storage operations.
+type NotificationStorage interface {
+	CreateNotification(*notification) error
+	GetNotifications(accountID int, page pageRequest) ([]*notification, int, error)
+}
+
+// CreateNotification stores a new notification for an account.
+func (s *PostgresStorage) CreateNotification(n *notification) error {
+	return s.db.QueryRow(
+		"INSERT INTO notifications (account_id, kind, message, tenant_id) VALUES ($1, $2, $3, (SELECT tenant_id FROM accounts WHERE id = $1)) RETURNING id, created_at",
+		n.AccountID, n.Kind, n.Message,
+	).Scan(&n.ID, &n.CreatedAt)
+}
+
+// GetNotifications returns a page of an account's notifications, newest
+// first, and their total count.
+func (s *PostgresStorage) GetNotifications(accountID int, page pageRequest) ([]*notification, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM notifications WHERE account_id = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	rows, err := s.db.Query("SELECT id, account_id, kind, message, created_at FROM notifications WHERE account_id = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	notifications := make([]*notification, 0)
+	for rows.Next() {
+		n := &notification{}
+		if err := rows.Scan(&n.ID, &n.AccountID, &n.Kind, &n.Message, &n.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, total, rows.Err()
+}
+
+// notify notifies an account holder with message on the channels they
+// chose for kind.
+func (s *Apiserver) notify(accountID int, kind, message string) {
+	s.notifyContent(accountID, kind, notificationContent{Message: message})
+}
+
+// notifyContent notifies an account holder on the channels they chose for
+// kind. In-app notifications are recorded and published to the account's
+// webhooks at once; the other channels wait in the outbox for the end of
+// quiet hours or the next digest when the holder's preferences say so.
+// Failures are only logged so they never break the request that triggered
+// them.
+func (s *Apiserver) notifyContent(accountID int, kind string, content notificationContent) {
+	prefs, err := s.store.GetNotificationPreferences(accountID)
+	if err != nil {
+		logf("failed to load notification preferences of account %d: %v\n", accountID, err)
+		prefs = defaultNotificationPreferences()
+	}
+	now := clock.Now()
+	var acc *account
+	for _, channel := range prefs.channelsFor(kind) {
+		if channel == channelInApp {
+			n := &notification{AccountID: accountID, Kind: kind, Message: content.Message}
+			if err := s.store.CreateNotification(n); err != nil {
+				logf("failed to create %s notification for account %d: %v\n", kind, accountID, err)
+				continue
+			}
+			s.publishEvent(accountID, "notification."+kind, n)
+			continue
+		}
+		if after, digest := prefs.deliverAfter(kind, now); after.After(now) {
+			n := &queuedNotification{AccountID: accountID, Kind: kind, Channel: channel, Content: content, Digest: digest, DeliverAfter: after}
+			if err := s.store.QueueNotification(n); err != nil {
+				logf("failed to queue %s %s notification for account %d: %v\n", channel, kind, accountID, err)
+			}
+			continue
+		}
+		if acc == nil {
+			if acc, err = s.store.GetAccountContact(accountID); err != nil {
+				logf("failed to load account %d for its %s notification: %v\n", accountID, kind, err)
+				return
+			}
+		}
+		if err := s.deliverNotification(acc, kind, channel, content); err != nil {
+			logf("failed to send %s %s notification to account %d: %v\n", channel, kind, accountID, err)
+		}
+	}
+}
+
+// handleGetNotifications returns the caller's notifications.
+func (s *Apiserver) handleGetNotifications(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	notifications, total, err := s.store.GetNotifications(acc.ID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(notifications, total, page, func(n *notification) cursor { return cursor{n.CreatedAt, n.ID} }))
+}
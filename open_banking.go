@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createConsentsTable = `
+        CREATE TABLE IF NOT EXISTS ob_consents (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            api_key_id INT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+            permissions TEXT[] NOT NULL,
+            account_ids INT[] NOT NULL DEFAULT '{}',
+            holder_account_id INT REFERENCES accounts(id) ON DELETE CASCADE,
+            status TEXT NOT NULL DEFAULT 'awaiting_authorisation',
+            token_hash TEXT UNIQUE,
+            expires_at TIMESTAMPTZ NOT NULL,
+            authorised_at TIMESTAMPTZ,
+            revoked_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Data a consent can grant access to.
+const (
+	permissionAccounts     = "accounts"
+	permissionBalances     = "balances"
+	permissionTransactions = "transactions"
+	// permissionFundsConfirmation answers whether an amount is available
+	// without showing the balance.
+	permissionFundsConfirmation = "funds_confirmation"
+)
+
+var consentPermissions = []string{permissionAccounts, permissionBalances, permissionTransactions, permissionFundsConfirmation}
+
+// Consent statuses. A consent is expired once past its expiry while
+// awaiting authorisation or authorised; that status is derived, not stored.
+const (
+	consentAwaiting   = "awaiting_authorisation"
+	consentAuthorised = "authorised"
+	consentRejected   = "rejected"
+	consentRevoked    = "revoked"
+	consentExpired    = "expired"
+)
+
+// maxConsentDuration is the longest a consent can last, and how long it
+// lasts unless the third party asks for less.
+const maxConsentDuration = 90 * 24 * time.Hour
+
+var (
+	errConsentNotAwaiting = errors.New("consent is not awaiting authorisation")
+	errConsentTokenIssued = errors.New("consent token already issued")
+)
+
+// consent lets a third party, identified by its API key, read some data of
+// some of a customer's accounts until it expires or the customer revokes
+// it. The third party gets an access token for it once authorised.
+type consent struct {
+	ID              int        `json:"id"`
+	TenantID        int        `json:"tenant_id"`
+	APIKeyID        int        `json:"api_key_id"`
+	Permissions     []string   `json:"permissions"`
+	AccountIDs      []int      `json:"account_ids"`
+	HolderAccountID *int       `json:"holder_account_id,omitempty"`
+	Status          string     `json:"status"`
+	TokenIssued     bool       `json:"token_issued"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	AuthorisedAt    *time.Time `json:"authorised_at,omitempty"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type CreateConsentRequest struct {
+	Permissions []string   `json:"permissions"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+type AuthoriseConsentRequest struct {
+	AccountIDs []int `json:"account_ids"`
+}
+
+// ConsentToken is the access token of a consent, returned once.
+type ConsentToken struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// obAccount is an account as shown to third parties.
+type obAccount struct {
+	ID       int    `json:"id"`
+	Number   string `json:"number"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+}
+
+// obBalance is the balance of an account as shown to third parties.
+type obBalance struct {
+	AccountID int       `json:"account_id"`
+	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
+	At        time.Time `json:"at"`
+}
+
+// ConsentStorage holds the open banking consent storage operations.
+type ConsentStorage interface {
+	CreateConsent(*consent) error
+	GetConsent(tenantID, id int) (*consent, error)
+	GetConsentByToken(tokenHash string) (*consent, error)
+	GetConsentsByHolder(accountID int) ([]*consent, error)
+	AuthoriseConsent(c *consent, holderAccountID int, accountIDs []int) error
+	RejectConsent(*consent) error
+	RevokeConsent(*consent) error
+	IssueConsentToken(c *consent, tokenHash string) error
+}
+
+const consentColumns = "id, tenant_id, api_key_id, permissions, account_ids, holder_account_id, status, token_hash IS NOT NULL, expires_at, authorised_at, revoked_at, created_at"
+
+func scanConsent(row interface{ Scan(...any) error }) (*consent, error) {
+	c := &consent{}
+	var accountIDs []int64
+	err := row.Scan(&c.ID, &c.TenantID, &c.APIKeyID, pq.Array(&c.Permissions), pq.Array(&accountIDs), &c.HolderAccountID, &c.Status, &c.TokenIssued, &c.ExpiresAt, &c.AuthorisedAt, &c.RevokedAt, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.AccountIDs = make([]int, len(accountIDs))
+	for i, id := range accountIDs {
+		c.AccountIDs[i] = int(id)
+	}
+	if (c.Status == consentAwaiting || c.Status == consentAuthorised) && !clock.Now().Before(c.ExpiresAt) {
+		c.Status = consentExpired
+	}
+	return c, nil
+}
+
+// CreateConsent stores a new consent awaiting authorisation.
+func (s *PostgresStorage) CreateConsent(c *consent) error {
+	return s.db.QueryRow(
+		"INSERT INTO ob_consents (tenant_id, api_key_id, permissions, status, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		c.TenantID, c.APIKeyID, pq.Array(c.Permissions), c.Status, c.ExpiresAt,
+	).Scan(&c.ID, &c.CreatedAt)
+}
+
+// GetConsent retrieves a tenant's consent.
+func (s *PostgresStorage) GetConsent(tenantID, id int) (*consent, error) {
+	return scanConsent(s.db.QueryRow("SELECT "+consentColumns+" FROM ob_consents WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+// GetConsentByToken retrieves the consent an access token was issued for.
+func (s *PostgresStorage) GetConsentByToken(tokenHash string) (*consent, error) {
+	return scanConsent(s.db.QueryRow("SELECT "+consentColumns+" FROM ob_consents WHERE token_hash = $1", tokenHash))
+}
+
+// GetConsentsByHolder lists the consents an account holder has
+// authorised, rejected or revoked, newest first.
+func (s *PostgresStorage) GetConsentsByHolder(accountID int) ([]*consent, error) {
+	rows, err := s.db.Query("SELECT "+consentColumns+" FROM ob_consents WHERE holder_account_id = $1 ORDER BY id DESC", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := make([]*consent, 0)
+	for rows.Next() {
+		c, err := scanConsent(rows)
+		if err != nil {
+			return nil, err
+		}
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
+
+// AuthoriseConsent grants a consent awaiting authorisation over the holder's
+// accounts.
+func (s *PostgresStorage) AuthoriseConsent(c *consent, holderAccountID int, accountIDs []int) error {
+	now := clock.Now()
+	err := s.db.QueryRow(`
+        UPDATE ob_consents SET status = $1, holder_account_id = $2, account_ids = $3, authorised_at = $4
+        WHERE id = $5 AND status = $6 AND expires_at > $4
+        RETURNING authorised_at`,
+		consentAuthorised, holderAccountID, pq.Array(accountIDs), now, c.ID, consentAwaiting,
+	).Scan(&c.AuthorisedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errConsentNotAwaiting
+	} else if err != nil {
+		return err
+	}
+	c.Status, c.HolderAccountID, c.AccountIDs = consentAuthorised, &holderAccountID, accountIDs
+	return nil
+}
+
+// RejectConsent turns down a consent awaiting authorisation.
+func (s *PostgresStorage) RejectConsent(c *consent) error {
+	res, err := s.db.Exec("UPDATE ob_consents SET status = $1 WHERE id = $2 AND status = $3", consentRejected, c.ID, consentAwaiting)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errConsentNotAwaiting
+	}
+	c.Status = consentRejected
+	return nil
+}
+
+// RevokeConsent withdraws a consent for good, whatever its status, so its
+// token stops working.
+func (s *PostgresStorage) RevokeConsent(c *consent) error {
+	now := clock.Now()
+	_, err := s.db.Exec("UPDATE ob_consents SET status = $1, revoked_at = $2 WHERE id = $3", consentRevoked, now, c.ID)
+	if err != nil {
+		return err
+	}
+	c.Status, c.RevokedAt = consentRevoked, &now
+	return nil
+}
+
+// IssueConsentToken stores the hash of the access token of an authorised
+// consent. Only one token is ever issued per consent.
+func (s *PostgresStorage) IssueConsentToken(c *consent, tokenHash string) error {
+	res, err := s.db.Exec("UPDATE ob_consents SET token_hash = $1 WHERE id = $2 AND token_hash IS NULL", tokenHash, c.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errConsentTokenIssued
+	}
+	c.TokenIssued = true
+	return nil
+}
+
+// requireConsent authenticates a third party by the access token of a
+// consent it was issued, which must be authorised, unexpired and grant the
+// permission. It runs after authenticateAPIKey.
+func (s *Apiserver) requireConsent(permission string) middleware {
+	return func(next apiFunc) apiFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			token, fromCookie := bearerToken(r)
+			if token == "" || fromCookie {
+				return newAPIError(http.StatusUnauthorized, "missing_authorization")
+			}
+			c, err := s.store.GetConsentByToken(hashAPIKey(token))
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && c.APIKeyID != requestAPIKey(r).ID) {
+				return newAPIError(http.StatusUnauthorized, "invalid_token")
+			} else if err != nil {
+				return err
+			}
+			if c.Status != consentAuthorised {
+				return newAPIError(http.StatusForbidden, "consent_inactive", c.Status)
+			}
+			if !slices.Contains(c.Permissions, permission) {
+				return newAPIError(http.StatusForbidden, "consent_permission", permission)
+			}
+			return next(w, setRequestConsent(r, c))
+		}
+	}
+}
+
+// consentAccount loads the account in the {id} path if the request's
+// consent covers it.
+func (s *Apiserver) consentAccount(r *http.Request) (*account, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(requestConsent(r).AccountIDs, id) {
+		return nil, newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	return s.store.GetAccountByID(id)
+}
+
+// thirdPartyConsent loads the consent in the {id} path if it belongs to the
+// calling third party.
+func (s *Apiserver) thirdPartyConsent(r *http.Request) (*consent, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.store.GetConsent(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && c.APIKeyID != requestAPIKey(r).ID) {
+		return nil, newAPIError(http.StatusNotFound, "consent_not_found", id)
+	}
+	return c, err
+}
+
+// handleCreateConsent lets a third party ask for access to the permissions
+// until the expiry, at most 90 days away. The customer then authorises it
+// with the consent ID.
+func (s *Apiserver) handleCreateConsent(w http.ResponseWriter, r *http.Request) error {
+	req := CreateConsentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.Permissions) == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "permissions")
+	}
+	for _, p := range req.Permissions {
+		if !slices.Contains(consentPermissions, p) {
+			return newAPIError(http.StatusBadRequest, "invalid_permission", p)
+		}
+	}
+	now := clock.Now()
+	expiresAt := now.Add(maxConsentDuration)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) || req.ExpiresAt.After(expiresAt) {
+			return newAPIError(http.StatusBadRequest, "invalid_consent_expiry", maxConsentDuration/(24*time.Hour))
+		}
+		expiresAt = *req.ExpiresAt
+	}
+	slices.Sort(req.Permissions)
+	c := &consent{
+		TenantID:    requestTenant(r).ID,
+		APIKeyID:    requestAPIKey(r).ID,
+		Permissions: slices.Compact(req.Permissions),
+		AccountIDs:  []int{},
+		Status:      consentAwaiting,
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.store.CreateConsent(c); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, c)
+}
+
+// handleGetThirdPartyConsent shows a third party one of its consents, so it
+// can tell when the customer has authorised it.
+func (s *Apiserver) handleGetThirdPartyConsent(w http.ResponseWriter, r *http.Request) error {
+	c, err := s.thirdPartyConsent(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleConsentToken issues the access token of an authorised consent to
+// the third party. The token is returned this once and lasts as long as
+// the consent.
+func (s *Apiserver) handleConsentToken(w http.ResponseWriter, r *http.Request) error {
+	c, err := s.thirdPartyConsent(r)
+	if err != nil {
+		return err
+	}
+	if c.Status != consentAuthorised {
+		return newAPIError(http.StatusConflict, "consent_inactive", c.Status)
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := "obt_" + hex.EncodeToString(b)
+	if err := s.store.IssueConsentToken(c, hashAPIKey(token)); errors.Is(err, errConsentTokenIssued) {
+		return newAPIError(http.StatusConflict, "consent_token_issued", c.ID)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, &ConsentToken{AccessToken: token, TokenType: "Bearer", ExpiresAt: c.ExpiresAt})
+}
+
+// handleConsents lists the consents the caller has decided on.
+func (s *Apiserver) handleConsents(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	consents, err := s.store.GetConsentsByHolder(acc.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, consents)
+}
+
+// customerConsent loads the consent in the {id} path for the caller: any
+// consent of the tenant awaiting authorisation, or one the caller decided.
+func (s *Apiserver) customerConsent(r *http.Request) (*account, *consent, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := s.store.GetConsent(acc.TenantID, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && c.HolderAccountID != nil && *c.HolderAccountID != acc.ID) {
+		return nil, nil, newAPIError(http.StatusNotFound, "consent_not_found", id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return acc, c, nil
+}
+
+// handleGetConsent shows the caller a consent, so they can see what a third
+// party is asking for before deciding.
+func (s *Apiserver) handleGetConsent(w http.ResponseWriter, r *http.Request) error {
+	_, c, err := s.customerConsent(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleAuthoriseConsent grants a consent over accounts the caller holds.
+func (s *Apiserver) handleAuthoriseConsent(w http.ResponseWriter, r *http.Request) error {
+	acc, c, err := s.customerConsent(r)
+	if err != nil {
+		return err
+	}
+	req := AuthoriseConsentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.AccountIDs) == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "account_ids")
+	}
+	held, err := s.store.GetAccountsByHolder(acc.TenantID, acc.Email)
+	if err != nil {
+		return err
+	}
+	for _, id := range req.AccountIDs {
+		if !slices.ContainsFunc(held, func(a *account) bool { return a.ID == id }) {
+			return newAPIError(http.StatusNotFound, "account_not_found", id)
+		}
+	}
+	slices.Sort(req.AccountIDs)
+	if err := s.store.AuthoriseConsent(c, acc.ID, slices.Compact(req.AccountIDs)); errors.Is(err, errConsentNotAwaiting) {
+		return newAPIError(http.StatusConflict, "consent_not_awaiting", c.ID, c.Status)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "consent.authorised", "consent", c.ID, c)
+	s.notify(acc.ID, "consent_authorised", fmt.Sprintf("You gave a third party access to your %v until %s", c.Permissions, c.ExpiresAt.UTC().Format(time.DateOnly)))
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleRejectConsent turns down a consent awaiting authorisation.
+func (s *Apiserver) handleRejectConsent(w http.ResponseWriter, r *http.Request) error {
+	acc, c, err := s.customerConsent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.RejectConsent(c); errors.Is(err, errConsentNotAwaiting) {
+		return newAPIError(http.StatusConflict, "consent_not_awaiting", c.ID, c.Status)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "consent.rejected", "consent", c.ID, nil)
+	c.HolderAccountID = &acc.ID
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleRevokeConsent withdraws a consent the caller authorised, cutting
+// the third party off right away.
+func (s *Apiserver) handleRevokeConsent(w http.ResponseWriter, r *http.Request) error {
+	_, c, err := s.customerConsent(r)
+	if err != nil {
+		return err
+	}
+	if c.HolderAccountID == nil {
+		return newAPIError(http.StatusConflict, "consent_not_authorised", c.ID)
+	}
+	if err := s.store.RevokeConsent(c); err != nil {
+		return err
+	}
+	s.audit(r, "consent.revoked", "consent", c.ID, nil)
+	return writeJSON(w, http.StatusOK, c)
+}
+
+func newOBAccount(a *account) *obAccount {
+	return &obAccount{ID: a.ID, Number: a.Number, Name: a.Name, Currency: a.Currency}
+}
+
+// handleOBAccounts lists the accounts the consent covers.
+func (s *Apiserver) handleOBAccounts(w http.ResponseWriter, r *http.Request) error {
+	c := requestConsent(r)
+	accounts, err := s.store.GetAccountsByIDs(c.TenantID, c.AccountIDs)
+	if err != nil {
+		return err
+	}
+	out := make([]*obAccount, 0, len(accounts))
+	for _, a := range accounts {
+		out = append(out, newOBAccount(a))
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+// handleOBAccount returns one account the consent covers.
+func (s *Apiserver) handleOBAccount(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.consentAccount(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, newOBAccount(acc))
+}
+
+// handleOBBalances returns the current balance of an account the consent
+// covers.
+func (s *Apiserver) handleOBBalances(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.consentAccount(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, &obBalance{AccountID: acc.ID, Amount: acc.Balance, Currency: acc.Currency, At: clock.Now()})
+}
+
+// handleOBTransactions returns the transactions of an account the consent
+// covers, newest first, a page at a time, with the history's filters.
+func (s *Apiserver) handleOBTransactions(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.consentAccount(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	filter, err := parseTransactionFilter(r)
+	if err != nil {
+		return err
+	}
+	entries, total, err := s.store.SearchLedgerEntries(acc.ID, filter, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(entries, total, page, ledgerCursor))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// outboundFailureThreshold consecutive failures of a host open its
+	// circuit: calls to it then fail fast for outboundOpenFor, after which
+	// a single trial call decides whether it closes again.
+	outboundFailureThreshold = 5
+	outboundOpenFor          = 30 * time.Second
+	// outboundRetryBase is the backoff ceiling of the first retry; it
+	// doubles with every further attempt.
+	outboundRetryBase = 250 * time.Millisecond
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+var (
+	errCircuitOpen      = errors.New("circuit breaker open")
+	errForbiddenAddress = errors.New("address is not public")
+)
+
+// sharedAddressSpace is the carrier-grade NAT range, which like the
+// private ranges is never reachable from the internet.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+var (
+	outboundRequests = expvar.NewMap("outbound_requests")
+	outboundCircuits = expvar.NewMap("outbound_circuits")
+)
+
+// circuitBreaker tracks the health of one host.
+type circuitBreaker struct {
+	state    expvar.String
+	failures int
+	openedAt time.Time
+	// trial is set while the one call allowed through a half-open circuit
+	// is in flight.
+	trial bool
+}
+
+// circuitBreakers holds a breaker per host, shared by every outbound
+// client so a host that is down is noticed whichever feature calls it.
+type circuitBreakers struct {
+	mu    sync.Mutex
+	hosts map[string]*circuitBreaker
+}
+
+var circuits = &circuitBreakers{hosts: map[string]*circuitBreaker{}}
+
+func (c *circuitBreakers) get(host string) *circuitBreaker {
+	b, ok := c.hosts[host]
+	if !ok {
+		b = &circuitBreaker{}
+		b.state.Set(circuitClosed)
+		c.hosts[host] = b
+		outboundCircuits.Set(host, &b.state)
+	}
+	return b
+}
+
+// Allow reports whether a call to the host may go out.
+func (c *circuitBreakers) Allow(host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.get(host)
+	switch b.state.Value() {
+	case circuitOpen:
+		if clock.Now().Sub(b.openedAt) < outboundOpenFor {
+			return false
+		}
+		b.state.Set(circuitHalfOpen)
+		b.trial = true
+		return true
+	case circuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// Record updates the host's breaker with the outcome of a call.
+func (c *circuitBreakers) Record(host string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.get(host)
+	b.trial = false
+	if ok {
+		b.failures = 0
+		b.state.Set(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state.Value() == circuitHalfOpen || b.failures >= outboundFailureThreshold {
+		if b.state.Value() != circuitOpen {
+			logf("outbound: circuit to %s opened after %d failures\n", host, b.failures)
+		}
+		b.state.Set(circuitOpen)
+		b.openedAt = clock.Now()
+	}
+}
+
+// outboundClient sends requests to third parties: webhook receivers, the
+// CAPTCHA service and any provider added later. Every call has a timeout,
+// transient failures are retried with jittered backoff, and calls to a host
+// whose circuit is open fail at once with errCircuitOpen.
+type outboundClient struct {
+	client   *http.Client
+	attempts int
+}
+
+func newOutboundClient(timeout time.Duration, attempts int) *outboundClient {
+	return &outboundClient{client: &http.Client{Timeout: timeout}, attempts: attempts}
+}
+
+// newPublicOutboundClient returns a client for URLs customers choose, such
+// as webhook receivers, that only connects to public addresses. The check
+// is made on the address being dialled, after DNS resolution, so a name
+// that later resolves to an internal address cannot be used to reach the
+// bank's own network. Loopback addresses are let through while
+// allowLoopback returns true, for local receivers in development. It never
+// uses a proxy, which would hide the address from the check.
+func newPublicOutboundClient(timeout time.Duration, attempts int, allowLoopback func() bool) *outboundClient {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) && !(ip.IsLoopback() && allowLoopback()) {
+				return fmt.Errorf("%s: %w", host, errForbiddenAddress)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &outboundClient{client: &http.Client{Timeout: timeout, Transport: transport}, attempts: attempts}
+}
+
+// publicAddress reports whether ip is reachable on the internet, rather
+// than loopback, private, link-local (which includes the cloud metadata
+// service at 169.254.169.254), multicast or unspecified.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// checkPublicHost resolves host and fails with errForbiddenAddress unless
+// every address it has is public, or loopback when allowLoopback is set.
+func checkPublicHost(ctx context.Context, host string, allowLoopback bool) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) && !(ip.IsLoopback() && allowLoopback) {
+			return fmt.Errorf("%s: %w", host, errForbiddenAddress)
+		}
+	}
+	return nil
+}
+
+// Do sends the request, retrying network errors and 429, 502, 503 and 504
+// responses. Requests with a body are only retried when it can be replayed.
+func (c *outboundClient) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if rc, ok := req.Context().Value(requestContextKey).(*requestContext); ok && rc.trace.traceID != "" {
+		req.Header.Set(traceparentHeader, rc.trace.child().header())
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(outboundRetryBase, attempt)):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			if req.Body != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+		if !circuits.Allow(host) {
+			outboundRequests.Add(host+":rejected", 1)
+			return nil, fmt.Errorf("%s: %w", host, errCircuitOpen)
+		}
+
+		resp, err := c.client.Do(req)
+		failed := err != nil || resp.StatusCode >= 500
+		circuits.Record(host, !failed)
+		if failed {
+			outboundRequests.Add(host+":failed", 1)
+		} else {
+			outboundRequests.Add(host+":ok", 1)
+		}
+
+		retry := err != nil || retryableStatus(resp.StatusCode)
+		replayable := req.Body == nil || req.GetBody != nil
+		if !retry || !replayable || attempt+1 >= c.attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns a random delay up to base doubled per attempt after the
+// first, so clients retrying together spread out.
+func backoff(base time.Duration, attempt int) time.Duration {
+	ceiling := base << (attempt - 1)
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// cursor marks the last row of a page. Lists are ordered by (created_at, id)
+// so new rows never shift the pages a client is walking through.
+type cursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// encodeCursor turns a cursor into the opaque string handed to clients.
+func encodeCursor(c cursor) string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	c := &cursor{}
+	if c.CreatedAt, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+		return nil, err
+	}
+	if c.ID, err = strconv.Atoi(id); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// pageRequest is the ?cursor=&limit= of a list request.
+type pageRequest struct {
+	After *cursor
+	Limit int
+}
+
+// parsePage reads the pagination parameters of a request.
+func parsePage(r *http.Request) (pageRequest, error) {
+	p := pageRequest{Limit: defaultPageSize}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return p, newAPIError(http.StatusBadRequest, "invalid_limit", maxPageSize)
+		}
+		p.Limit = limit
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return p, newAPIError(http.StatusBadRequest, "invalid_cursor")
+		}
+		p.After = c
+	}
+	return p, nil
+}
+
+// keyset returns the SQL condition selecting rows after the cursor in
+// newest-first order and the ORDER BY/LIMIT clause to end the query with.
+// Placeholders are numbered from n; the page size is fetched plus one to
+// detect a next page. An optional table alias qualifies the columns.
+func (p pageRequest) keyset(n int, alias string) (cond, order string, args []any) {
+	if alias != "" {
+		alias += "."
+	}
+	cond = "TRUE"
+	if p.After != nil {
+		cond = fmt.Sprintf("(%[1]screated_at, %[1]sid) < ($%[2]d, $%[3]d)", alias, n, n+1)
+		args = []any{p.After.CreatedAt, p.After.ID}
+		n += 2
+	}
+	order = fmt.Sprintf("ORDER BY %[1]screated_at DESC, %[1]sid DESC LIMIT $%[2]d", alias, n)
+	return cond, order, append(args, p.Limit+1)
+}
+
+// keysetByID is keyset for tables ordered by id alone, oldest first.
+func (p pageRequest) keysetByID(n int) (cond, order string, args []any) {
+	after := 0
+	if p.After != nil {
+		after = p.After.ID
+	}
+	return fmt.Sprintf("id > $%d", n), fmt.Sprintf("ORDER BY id LIMIT $%d", n+1), []any{after, p.Limit + 1}
+}
+
+// paginate trims the extra row fetched by keyset and wraps the page in an
+// envelope with the cursor of the next page, left empty on the last page.
+func paginate[T any](items []T, total int, p pageRequest, key func(T) cursor) *envelope {
+	page := &pagination{Total: total}
+	if len(items) > p.Limit {
+		items = items[:p.Limit]
+		page.NextCursor = encodeCursor(key(items[len(items)-1]))
+	}
+	return &envelope{Data: items, Pagination: page}
+}
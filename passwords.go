@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const createPasswordHistoryTable = `
+        CREATE TABLE IF NOT EXISTS password_history (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            hash TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordStorage holds the password change storage operations.
+type PasswordStorage interface {
+	GetPasswordHistory(accountID, depth int) (hashes []string, changedAt time.Time, err error)
+	ChangePassword(accountID int, hash string, depth int) error
+}
+
+// GetPasswordHistory returns the bcrypt hashes of an account's current
+// password and of the ones before it, up to depth in all, and when the
+// current one was set.
+func (s *PostgresStorage) GetPasswordHistory(accountID, depth int) ([]string, time.Time, error) {
+	var current string
+	var changedAt time.Time
+	err := s.db.QueryRow("SELECT password, password_changed_at FROM accounts WHERE id = $1", accountID).Scan(&current, &changedAt)
+	if err != nil {
+		return nil, changedAt, err
+	}
+	hashes := []string{current}
+	if depth <= 1 {
+		return hashes, changedAt, nil
+	}
+
+	rows, err := s.db.Query("SELECT hash FROM password_history WHERE account_id = $1 ORDER BY id DESC LIMIT $2", accountID, depth-1)
+	if err != nil {
+		return nil, changedAt, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, changedAt, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, changedAt, rows.Err()
+}
+
+// ChangePassword replaces an account's password, moving the old hash into
+// its history and dropping history beyond what depth needs.
+func (s *PostgresStorage) ChangePassword(accountID int, hash string, depth int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO password_history (account_id, hash) SELECT id, password FROM accounts WHERE id = $1", accountID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE accounts SET password = $1, password_changed_at = now() WHERE id = $2", hash, accountID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        DELETE FROM password_history WHERE account_id = $1 AND id NOT IN (
+            SELECT id FROM password_history WHERE account_id = $1 ORDER BY id DESC LIMIT $2
+        )`,
+		accountID, max(depth-1, 0),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleChangePassword changes the caller's password. The new password may
+// not be any of the last PasswordHistoryDepth ones, and the current one has
+// to be at least PasswordMinAge old so the history cannot be cycled through
+// in one sitting.
+func (s *Apiserver) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := ChangePasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if strings.TrimSpace(req.NewPassword) == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "new_password")
+	}
+	if err := s.store.CheckAuth(acc.TenantID, acc.Email, req.CurrentPassword); err != nil {
+		return newAPIError(http.StatusUnauthorized, "auth_failed")
+	}
+
+	depth := max(s.cfg().PasswordHistoryDepth, 1)
+	hashes, changedAt, err := s.store.GetPasswordHistory(acc.ID, depth)
+	if err != nil {
+		return err
+	}
+	if next := changedAt.Add(s.cfg().PasswordMinAge); clock.Now().Before(next) {
+		return newAPIError(http.StatusTooManyRequests, "password_too_recent", next.UTC().Format(time.RFC3339))
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.NewPassword)) == nil {
+			return newAPIError(http.StatusBadRequest, "password_reused", depth)
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ChangePassword(acc.ID, string(hash), depth); err != nil {
+		return err
+	}
+	s.audit(r, "account.password_changed", "account", acc.ID, nil)
+	s.notify(acc.ID, "password_changed", fmt.Sprintf("Your password was changed on %s", clock.Now().UTC().Format(time.RFC1123)))
+	return writeJSON(w, http.StatusOK, map[string]bool{"changed": true})
+}
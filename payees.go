@@ -0,0 +1,300 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createPayeesTable = `
+        CREATE TABLE IF NOT EXISTS payees (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            payee_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            trusted_at TIMESTAMPTZ NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (account_id, payee_account_id)
+        )
+    `
+
+const createPayeeAllowlistsTable = `
+        CREATE TABLE IF NOT EXISTS payee_allowlists (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            enabled_at TIMESTAMPTZ NOT NULL,
+            ends_at TIMESTAMPTZ
+        )
+    `
+
+// defaultPayeeCoolingOff is how long a new payee, or a request to turn the
+// allowlist off, waits before it takes effect unless PAYEE_COOLING_OFF says
+// otherwise.
+const defaultPayeeCoolingOff = 24 * time.Hour
+
+var errPayeeExists = errors.New("payee already added")
+
+// payee is an account its owner has verified and may pay once the
+// cooling-off period has passed, at TrustedAt.
+type payee struct {
+	ID             int       `json:"id"`
+	AccountID      int       `json:"account_id"`
+	PayeeAccountID int       `json:"payee_account_id"`
+	Name           string    `json:"name"`
+	Number         string    `json:"number"`
+	TrustedAt      time.Time `json:"trusted_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// payeeAllowlist limits an account's transfers to its trusted payees.
+// Turning it off only takes effect after the cooling-off period, at EndsAt,
+// so whoever takes over a session cannot lift it right away.
+type payeeAllowlist struct {
+	AccountID int        `json:"account_id"`
+	Active    bool       `json:"active"`
+	EnabledAt time.Time  `json:"enabled_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+}
+
+type AddPayeeRequest struct {
+	Payee SplitParticipant `json:"payee"`
+	Name  string           `json:"name,omitempty"`
+}
+
+// PayeeStorage holds the trusted payee storage operations.
+type PayeeStorage interface {
+	AddPayee(*payee) error
+	GetPayees(accountID int) ([]*payee, error)
+	GetPayee(accountID, payeeAccountID int) (*payee, error)
+	DeletePayee(accountID, id int) error
+	GetPayeeAllowlist(accountID int) (*payeeAllowlist, error)
+	EnablePayeeAllowlist(accountID int) (*payeeAllowlist, error)
+	EndPayeeAllowlist(accountID int, at time.Time) (*payeeAllowlist, error)
+}
+
+// AddPayee stores a new payee of an account. Adding an account that is
+// already a payee fails with errPayeeExists.
+func (s *PostgresStorage) AddPayee(p *payee) error {
+	err := s.db.QueryRow(
+		"INSERT INTO payees (account_id, payee_account_id, name, trusted_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING id, created_at",
+		p.AccountID, p.PayeeAccountID, p.Name, p.TrustedAt,
+	).Scan(&p.ID, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errPayeeExists
+	}
+	return err
+}
+
+const selectPayees = "SELECT p.id, p.account_id, p.payee_account_id, p.name, a.number, p.trusted_at, p.created_at FROM payees p JOIN accounts a ON a.id = p.payee_account_id "
+
+func scanPayee(row interface{ Scan(...any) error }) (*payee, error) {
+	p := &payee{}
+	err := row.Scan(&p.ID, &p.AccountID, &p.PayeeAccountID, &p.Name, &p.Number, &p.TrustedAt, &p.CreatedAt)
+	return p, err
+}
+
+// GetPayees lists an account's payees by name.
+func (s *PostgresStorage) GetPayees(accountID int) ([]*payee, error) {
+	rows, err := s.db.Query(selectPayees+"WHERE p.account_id = $1 ORDER BY p.name, p.id", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payees := make([]*payee, 0)
+	for rows.Next() {
+		p, err := scanPayee(rows)
+		if err != nil {
+			return nil, err
+		}
+		payees = append(payees, p)
+	}
+	return payees, rows.Err()
+}
+
+// GetPayee retrieves the payee entry of one account for another.
+func (s *PostgresStorage) GetPayee(accountID, payeeAccountID int) (*payee, error) {
+	return scanPayee(s.db.QueryRow(selectPayees+"WHERE p.account_id = $1 AND p.payee_account_id = $2", accountID, payeeAccountID))
+}
+
+// DeletePayee removes a payee of an account.
+func (s *PostgresStorage) DeletePayee(accountID, id int) error {
+	res, err := s.db.Exec("DELETE FROM payees WHERE id = $1 AND account_id = $2", id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanPayeeAllowlist(row *sql.Row) (*payeeAllowlist, error) {
+	l := &payeeAllowlist{}
+	if err := row.Scan(&l.AccountID, &l.EnabledAt, &l.EndsAt); err != nil {
+		return nil, err
+	}
+	l.Active = l.EndsAt == nil || clock.Now().Before(*l.EndsAt)
+	return l, nil
+}
+
+// GetPayeeAllowlist retrieves the allowlist setting of an account.
+func (s *PostgresStorage) GetPayeeAllowlist(accountID int) (*payeeAllowlist, error) {
+	return scanPayeeAllowlist(s.db.QueryRow("SELECT account_id, enabled_at, ends_at FROM payee_allowlists WHERE account_id = $1", accountID))
+}
+
+// EnablePayeeAllowlist turns the allowlist on for an account right away,
+// cancelling any pending end. An allowlist already active keeps its
+// enabled_at.
+func (s *PostgresStorage) EnablePayeeAllowlist(accountID int) (*payeeAllowlist, error) {
+	now := clock.Now()
+	return scanPayeeAllowlist(s.db.QueryRow(`
+        INSERT INTO payee_allowlists (account_id, enabled_at) VALUES ($1, $2)
+        ON CONFLICT (account_id) DO UPDATE SET
+            enabled_at = CASE WHEN payee_allowlists.ends_at IS NOT NULL AND payee_allowlists.ends_at <= $2 THEN $2 ELSE payee_allowlists.enabled_at END,
+            ends_at = NULL
+        RETURNING account_id, enabled_at, ends_at`,
+		accountID, now,
+	))
+}
+
+// EndPayeeAllowlist schedules the allowlist of an account to end. An end
+// already scheduled is kept if it is sooner.
+func (s *PostgresStorage) EndPayeeAllowlist(accountID int, at time.Time) (*payeeAllowlist, error) {
+	return scanPayeeAllowlist(s.db.QueryRow(
+		"UPDATE payee_allowlists SET ends_at = LEAST(COALESCE(ends_at, $2), $2) WHERE account_id = $1 RETURNING account_id, enabled_at, ends_at",
+		accountID, at,
+	))
+}
+
+// payeeCoolingOff is the configured cooling-off period.
+func (s *Apiserver) payeeCoolingOff() time.Duration {
+	return cmp.Or(s.cfg().PayeeCoolingOff, defaultPayeeCoolingOff)
+}
+
+// checkTrustedPayee refuses a payment to anyone but a trusted payee whose
+// cooling-off period has passed, when the payer has the allowlist on.
+func (s *Apiserver) checkTrustedPayee(fromAccountID, toAccountID int) error {
+	l, err := s.store.GetPayeeAllowlist(fromAccountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !l.Active {
+		return nil
+	}
+	p, err := s.store.GetPayee(fromAccountID, toAccountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusForbidden, "payee_not_trusted")
+	} else if err != nil {
+		return err
+	}
+	if clock.Now().Before(p.TrustedAt) {
+		return newAPIError(http.StatusForbidden, "payee_cooling_off", p.Name, p.TrustedAt.UTC().Format(time.DateTime))
+	}
+	return nil
+}
+
+// handlePayees lists an account's payees (GET) or verifies and adds one
+// (POST). A new payee can only be paid under the allowlist once the
+// cooling-off period has passed.
+func (s *Apiserver) handlePayees(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		payees, err := s.store.GetPayees(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, payees)
+	}
+
+	req := AddPayeeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	to, err := s.resolveParticipant(acc.TenantID, req.Payee)
+	if err != nil {
+		return err
+	}
+	if to.ID == acc.ID {
+		return newAPIError(http.StatusBadRequest, "same_account_transfer")
+	}
+	p := &payee{
+		AccountID:      acc.ID,
+		PayeeAccountID: to.ID,
+		Name:           cmp.Or(strings.TrimSpace(req.Name), to.Name),
+		Number:         to.Number,
+		TrustedAt:      clock.Now().Add(s.payeeCoolingOff()),
+	}
+	if err := s.store.AddPayee(p); errors.Is(err, errPayeeExists) {
+		return newAPIError(http.StatusConflict, "payee_exists", to.Number)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "payee.added", "payee", p.ID, p)
+	s.notify(acc.ID, "payee_added", fmt.Sprintf("%s (%s) was added as a payee. If this was not you, contact us right away", p.Name, p.Number))
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// handleDeletePayee removes a payee of an account.
+func (s *Apiserver) handleDeletePayee(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("payee"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("payee"))
+	}
+	if err := s.store.DeletePayee(acc.ID, id); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "payee_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "payee.deleted", "payee", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// handlePayeeAllowlist shows (GET), turns on (PUT) or turns off (DELETE) the
+// trusted payee allowlist of an account. Turning it on is immediate;
+// turning it off waits out the cooling-off period.
+func (s *Apiserver) handlePayeeAllowlist(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+
+	var l *payeeAllowlist
+	switch r.Method {
+	case "GET":
+		l, err = s.store.GetPayeeAllowlist(acc.ID)
+	case "PUT":
+		l, err = s.store.EnablePayeeAllowlist(acc.ID)
+		if err == nil {
+			s.audit(r, "payee_allowlist.enabled", "account", acc.ID, nil)
+		}
+	case "DELETE":
+		l, err = s.store.EndPayeeAllowlist(acc.ID, clock.Now().Add(s.payeeCoolingOff()))
+		if err == nil {
+			s.audit(r, "payee_allowlist.ended", "account", acc.ID, l)
+			s.notify(acc.ID, "payee_allowlist_ending", fmt.Sprintf("Your trusted payee allowlist will be turned off on %s. If this was not you, contact us right away", l.EndsAt.UTC().Format(time.DateTime)))
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "payee_allowlist_not_found", acc.ID)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, l)
+}
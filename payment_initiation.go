@@ -0,0 +1,513 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const createPaymentConsentsTable = `
+        CREATE TABLE IF NOT EXISTS ob_payment_consents (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            api_key_id INT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+            creditor_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            debtor_account_id INT REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            memo TEXT NOT NULL DEFAULT '',
+            redirect_uri TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'awaiting_authorisation',
+            expires_at TIMESTAMPTZ NOT NULL,
+            authorised_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createPaymentsTable = `
+        CREATE TABLE IF NOT EXISTS ob_payments (
+            id SERIAL PRIMARY KEY,
+            consent_id INT UNIQUE NOT NULL REFERENCES ob_payment_consents(id) ON DELETE CASCADE,
+            status TEXT NOT NULL,
+            failure TEXT NOT NULL DEFAULT '',
+            transfer_id INT REFERENCES transfers(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// consentConsumed is the status of a payment consent once a payment has
+// been submitted under it; each consent pays at most once.
+const consentConsumed = "consumed"
+
+// paymentConsentTTL is how long the customer has to authorise a payment
+// consent and the third party to submit the payment after that.
+const paymentConsentTTL = 24 * time.Hour
+
+// Payment statuses. A payment either completes as a transfer or fails
+// with the reason in Failure.
+const (
+	paymentCompleted = "completed"
+	paymentFailed    = "failed"
+)
+
+var errConsentNotAuthorised = errors.New("consent is not authorised")
+
+// paymentConsent is a third party's request to pay an amount into a
+// creditor account from an account the customer picks when authorising it.
+type paymentConsent struct {
+	ID                int        `json:"id"`
+	TenantID          int        `json:"tenant_id"`
+	APIKeyID          int        `json:"api_key_id"`
+	CreditorAccountID int        `json:"creditor_account_id"`
+	DebtorAccountID   *int       `json:"debtor_account_id,omitempty"`
+	Amount            int        `json:"amount"`
+	Currency          string     `json:"currency"`
+	Memo              string     `json:"memo"`
+	RedirectURI       string     `json:"redirect_uri"`
+	Status            string     `json:"status"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	AuthorisedAt      *time.Time `json:"authorised_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+
+	// RedirectURL is where the customer's app sends them back to the third
+	// party once they have decided on the consent.
+	RedirectURL string `json:"redirect_url,omitempty"`
+}
+
+// obPayment is a payment a third party submitted under a payment consent.
+type obPayment struct {
+	ID         int       `json:"id"`
+	ConsentID  int       `json:"consent_id"`
+	Status     string    `json:"status"`
+	Failure    string    `json:"failure,omitempty"`
+	TransferID *int      `json:"transfer_id,omitempty"`
+	Reference  string    `json:"reference,omitempty"`
+	Amount     int       `json:"amount"`
+	Currency   string    `json:"currency"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreatePaymentConsentRequest names the creditor by email or account
+// number.
+type CreatePaymentConsentRequest struct {
+	Creditor    SplitParticipant `json:"creditor"`
+	Amount      int              `json:"amount"`
+	Memo        string           `json:"memo"`
+	RedirectURI string           `json:"redirect_uri"`
+}
+
+type AuthorisePaymentConsentRequest struct {
+	AccountID int `json:"account_id"`
+}
+
+type SubmitPaymentRequest struct {
+	ConsentID int `json:"consent_id"`
+}
+
+// PaymentStorage holds the open banking payment initiation storage
+// operations.
+type PaymentStorage interface {
+	CreatePaymentConsent(*paymentConsent) error
+	GetPaymentConsent(tenantID, id int) (*paymentConsent, error)
+	AuthorisePaymentConsent(c *paymentConsent, debtorAccountID int) error
+	RejectPaymentConsent(*paymentConsent) error
+	SubmitPayment(p *obPayment, t *transfer) error
+	GetPayment(tenantID, id int) (*obPayment, int, error)
+}
+
+const paymentConsentColumns = "id, tenant_id, api_key_id, creditor_account_id, debtor_account_id, amount, currency, memo, redirect_uri, status, expires_at, authorised_at, created_at"
+
+func scanPaymentConsent(row interface{ Scan(...any) error }) (*paymentConsent, error) {
+	c := &paymentConsent{}
+	err := row.Scan(&c.ID, &c.TenantID, &c.APIKeyID, &c.CreditorAccountID, &c.DebtorAccountID, &c.Amount, &c.Currency, &c.Memo, &c.RedirectURI, &c.Status, &c.ExpiresAt, &c.AuthorisedAt, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if (c.Status == consentAwaiting || c.Status == consentAuthorised) && !clock.Now().Before(c.ExpiresAt) {
+		c.Status = consentExpired
+	}
+	return c, nil
+}
+
+// CreatePaymentConsent stores a payment consent awaiting authorisation.
+func (s *PostgresStorage) CreatePaymentConsent(c *paymentConsent) error {
+	return s.db.QueryRow(`
+        INSERT INTO ob_payment_consents (tenant_id, api_key_id, creditor_account_id, amount, currency, memo, redirect_uri, status, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at`,
+		c.TenantID, c.APIKeyID, c.CreditorAccountID, c.Amount, c.Currency, c.Memo, c.RedirectURI, c.Status, c.ExpiresAt,
+	).Scan(&c.ID, &c.CreatedAt)
+}
+
+// GetPaymentConsent retrieves a tenant's payment consent.
+func (s *PostgresStorage) GetPaymentConsent(tenantID, id int) (*paymentConsent, error) {
+	return scanPaymentConsent(s.db.QueryRow("SELECT "+paymentConsentColumns+" FROM ob_payment_consents WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+// AuthorisePaymentConsent approves a payment consent awaiting
+// authorisation, to be paid from the debtor account.
+func (s *PostgresStorage) AuthorisePaymentConsent(c *paymentConsent, debtorAccountID int) error {
+	now := clock.Now()
+	err := s.db.QueryRow(`
+        UPDATE ob_payment_consents SET status = $1, debtor_account_id = $2, authorised_at = $3
+        WHERE id = $4 AND status = $5 AND expires_at > $3
+        RETURNING authorised_at`,
+		consentAuthorised, debtorAccountID, now, c.ID, consentAwaiting,
+	).Scan(&c.AuthorisedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errConsentNotAwaiting
+	} else if err != nil {
+		return err
+	}
+	c.Status, c.DebtorAccountID = consentAuthorised, &debtorAccountID
+	return nil
+}
+
+// RejectPaymentConsent turns down a payment consent awaiting authorisation.
+func (s *PostgresStorage) RejectPaymentConsent(c *paymentConsent) error {
+	res, err := s.db.Exec("UPDATE ob_payment_consents SET status = $1 WHERE id = $2 AND status = $3", consentRejected, c.ID, consentAwaiting)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errConsentNotAwaiting
+	}
+	c.Status = consentRejected
+	return nil
+}
+
+// SubmitPayment consumes the authorised, unexpired consent of p and records
+// the payment, making transfer t if there is one, all or nothing. A failed
+// payment is recorded with no transfer and consumes the consent too.
+func (s *PostgresStorage) SubmitPayment(p *obPayment, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE ob_payment_consents SET status = $1 WHERE id = $2 AND status = $3 AND expires_at > $4",
+		consentConsumed, p.ConsentID, consentAuthorised, clock.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errConsentNotAuthorised
+	}
+	if t != nil {
+		if err := createTransfer(tx, t); err != nil {
+			return err
+		}
+		p.TransferID, p.Reference = &t.ID, t.Reference
+	}
+	err = tx.QueryRow(
+		"INSERT INTO ob_payments (consent_id, status, failure, transfer_id) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		p.ConsentID, p.Status, p.Failure, p.TransferID,
+	).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPayment retrieves a tenant's payment with the API key its consent was
+// given to.
+func (s *PostgresStorage) GetPayment(tenantID, id int) (*obPayment, int, error) {
+	p := &obPayment{}
+	var apiKeyID int
+	err := s.db.QueryRow(`
+        SELECT p.id, p.consent_id, p.status, p.failure, p.transfer_id, COALESCE(t.reference, ''), c.amount, c.currency, p.created_at, c.api_key_id
+        FROM ob_payments p
+        JOIN ob_payment_consents c ON c.id = p.consent_id
+        LEFT JOIN transfers t ON t.id = p.transfer_id
+        WHERE p.id = $1 AND c.tenant_id = $2`,
+		id, tenantID,
+	).Scan(&p.ID, &p.ConsentID, &p.Status, &p.Failure, &p.TransferID, &p.Reference, &p.Amount, &p.Currency, &p.CreatedAt, &apiKeyID)
+	return p, apiKeyID, err
+}
+
+// consentRedirect returns the redirect URI of a consent with the consent ID
+// and the customer's decision added to its query.
+func consentRedirect(redirectURI string, id int, status string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("consent_id", fmt.Sprint(id))
+	q.Set("status", status)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// thirdPartyPaymentConsent loads the payment consent in the {id} path if it
+// belongs to the calling third party.
+func (s *Apiserver) thirdPartyPaymentConsent(r *http.Request, id int) (*paymentConsent, error) {
+	c, err := s.store.GetPaymentConsent(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && c.APIKeyID != requestAPIKey(r).ID) {
+		return nil, newAPIError(http.StatusNotFound, "consent_not_found", id)
+	}
+	return c, err
+}
+
+// handleCreatePaymentConsent lets a third party ask a customer to pay an
+// amount into a creditor account. The customer authorises it with the
+// consent ID and is then sent back to the redirect URI.
+func (s *Apiserver) handleCreatePaymentConsent(w http.ResponseWriter, r *http.Request) error {
+	req := CreatePaymentConsentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Memo = strings.TrimSpace(req.Memo)
+	if req.Amount <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if utf8.RuneCountInString(req.Memo) > maxMemoLength {
+		return newAPIError(http.StatusBadRequest, "memo_too_long", maxMemoLength)
+	}
+	if u, err := url.Parse(req.RedirectURI); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return newAPIError(http.StatusBadRequest, "invalid_redirect_uri", req.RedirectURI)
+	}
+	tenantID := requestTenant(r).ID
+	creditor, err := s.resolveParticipant(tenantID, req.Creditor)
+	if err != nil {
+		return err
+	}
+
+	c := &paymentConsent{
+		TenantID:          tenantID,
+		APIKeyID:          requestAPIKey(r).ID,
+		CreditorAccountID: creditor.ID,
+		Amount:            req.Amount,
+		Currency:          creditor.Currency,
+		Memo:              req.Memo,
+		RedirectURI:       req.RedirectURI,
+		Status:            consentAwaiting,
+		ExpiresAt:         clock.Now().Add(paymentConsentTTL),
+	}
+	if err := s.store.CreatePaymentConsent(c); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, c)
+}
+
+// handleGetThirdPartyPaymentConsent shows a third party one of its payment
+// consents.
+func (s *Apiserver) handleGetThirdPartyPaymentConsent(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	c, err := s.thirdPartyPaymentConsent(r, id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// customerPaymentConsent loads the payment consent in the {id} path for the
+// caller: any consent of the tenant awaiting authorisation, or one paid from
+// the caller's accounts.
+func (s *Apiserver) customerPaymentConsent(r *http.Request) (*account, *paymentConsent, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := s.store.GetPaymentConsent(acc.TenantID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, newAPIError(http.StatusNotFound, "consent_not_found", id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if c.DebtorAccountID != nil {
+		debtor, err := s.store.GetAccountByID(*c.DebtorAccountID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if debtor.Email != acc.Email {
+			return nil, nil, newAPIError(http.StatusNotFound, "consent_not_found", id)
+		}
+	}
+	return acc, c, nil
+}
+
+// handleGetPaymentConsent shows the caller a payment consent, so they can
+// check the payee and amount before deciding.
+func (s *Apiserver) handleGetPaymentConsent(w http.ResponseWriter, r *http.Request) error {
+	_, c, err := s.customerPaymentConsent(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleAuthorisePaymentConsent approves a payment consent, to be paid
+// from one of the caller's accounts in the consent's currency.
+func (s *Apiserver) handleAuthorisePaymentConsent(w http.ResponseWriter, r *http.Request) error {
+	acc, c, err := s.customerPaymentConsent(r)
+	if err != nil {
+		return err
+	}
+	req := AuthorisePaymentConsentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	debtor := acc
+	if req.AccountID != 0 && req.AccountID != acc.ID {
+		if debtor, err = s.store.GetAccountByID(req.AccountID); err != nil || debtor.TenantID != acc.TenantID || debtor.Email != acc.Email {
+			return newAPIError(http.StatusNotFound, "account_not_found", req.AccountID)
+		}
+	}
+	if debtor.ID == c.CreditorAccountID {
+		return newAPIError(http.StatusBadRequest, "same_account_transfer")
+	}
+	if debtor.Currency != c.Currency {
+		return newAPIError(http.StatusBadRequest, "currency_mismatch", debtor.Currency, c.Currency)
+	}
+	if err := s.store.AuthorisePaymentConsent(c, debtor.ID); errors.Is(err, errConsentNotAwaiting) {
+		return newAPIError(http.StatusConflict, "consent_not_awaiting", c.ID, c.Status)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "payment_consent.authorised", "payment_consent", c.ID, c)
+	s.publishPaymentConsent(c)
+	c.RedirectURL = consentRedirect(c.RedirectURI, c.ID, c.Status)
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// handleRejectPaymentConsent turns down a payment consent.
+func (s *Apiserver) handleRejectPaymentConsent(w http.ResponseWriter, r *http.Request) error {
+	_, c, err := s.customerPaymentConsent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.RejectPaymentConsent(c); errors.Is(err, errConsentNotAwaiting) {
+		return newAPIError(http.StatusConflict, "consent_not_awaiting", c.ID, c.Status)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "payment_consent.rejected", "payment_consent", c.ID, nil)
+	s.publishPaymentConsent(c)
+	c.RedirectURL = consentRedirect(c.RedirectURI, c.ID, c.Status)
+	return writeJSON(w, http.StatusOK, c)
+}
+
+// publishPaymentConsent sends the customer's decision on a payment consent
+// to the webhooks of the account the third party's API key acts for.
+func (s *Apiserver) publishPaymentConsent(c *paymentConsent) {
+	k, err := s.store.GetAPIKey(c.TenantID, c.APIKeyID)
+	if err != nil {
+		logf("failed to load API key %d of payment consent %d: %v\n", c.APIKeyID, c.ID, err)
+		return
+	}
+	s.publishEvent(k.AccountID, "payment_consent."+c.Status, c)
+}
+
+// handleSubmitPayment makes the payment of an authorised payment consent
+// as a transfer from the customer's account. The payment is recorded even
+// when the transfer fails, and the outcome is also sent to the third
+// party's webhooks as payment.completed or payment.failed.
+func (s *Apiserver) handleSubmitPayment(w http.ResponseWriter, r *http.Request) error {
+	req := SubmitPaymentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	c, err := s.thirdPartyPaymentConsent(r, req.ConsentID)
+	if err != nil {
+		return err
+	}
+	if c.Status != consentAuthorised {
+		return newAPIError(http.StatusConflict, "consent_inactive", c.Status)
+	}
+	debtor, err := s.store.GetAccountByID(*c.DebtorAccountID)
+	if err != nil {
+		return err
+	}
+
+	p := &obPayment{ConsentID: c.ID, Status: paymentCompleted, Amount: c.Amount, Currency: c.Currency}
+	t, err := s.paymentTransfer(debtor, c)
+	if err == nil {
+		err = s.store.SubmitPayment(p, t)
+	}
+	if errors.Is(err, errConsentNotAuthorised) {
+		return newAPIError(http.StatusConflict, "consent_inactive", consentConsumed)
+	}
+	if err != nil {
+		failure, ok := paymentFailure(transferFailed(err))
+		if !ok {
+			return err
+		}
+		p.Status, p.Failure = paymentFailed, failure
+		if err := s.store.SubmitPayment(p, nil); errors.Is(err, errConsentNotAuthorised) {
+			return newAPIError(http.StatusConflict, "consent_inactive", consentConsumed)
+		} else if err != nil {
+			return err
+		}
+	} else {
+		s.transferCompleted(t)
+	}
+
+	k := requestAPIKey(r)
+	s.audit(r, "payment."+p.Status, "payment", p.ID, p)
+	s.publishEvent(k.AccountID, "payment."+p.Status, p)
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// paymentTransfer prepares the transfer paying a consent. Payments are
+// held to the same checks as the customer's own transfers, except that one
+// needing a co-signer's approval fails instead of waiting for it.
+func (s *Apiserver) paymentTransfer(debtor *account, c *paymentConsent) (*transfer, error) {
+	t, err := s.newTransfer(debtor, c.CreditorAccountID, c.Amount, c.Memo)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkTrustedPayee(debtor.ID, t.ToAccountID); err != nil {
+		return nil, err
+	}
+	if cs, err := s.store.GetCosigner(debtor.ID); err == nil && t.Amount > cs.Threshold {
+		return nil, newAPIError(http.StatusForbidden, "payment_needs_cosigner")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return t, nil
+}
+
+// paymentFailure returns the code of an API error that fails a payment, as
+// opposed to an internal error.
+func paymentFailure(err error) (string, bool) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return "", false
+	}
+	return apiErr.Code, true
+}
+
+// handleGetPayment returns one of the third party's payments.
+func (s *Apiserver) handleGetPayment(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	p, apiKeyID, err := s.store.GetPayment(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && apiKeyID != requestAPIKey(r).ID) {
+		return newAPIError(http.StatusNotFound, "payment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, p)
+}
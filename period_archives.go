@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Closed periods of the ledger are archived write-once: a period is
+// archived a single time, its file is never overwritten, and its checksum
+// is kept both beside the file and in the database. Deployments keeping
+// records for regulators back the FileStore with an object store under a
+// retention lock, which makes the files unalterable outright.
+const createLedgerArchivesTable = `
+        CREATE TABLE IF NOT EXISTS ledger_archives (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            period TEXT NOT NULL,
+            entries INT NOT NULL,
+            size INT NOT NULL,
+            sha256 TEXT NOT NULL,
+            file_key TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (tenant_id, period)
+        )
+    `
+
+var errPeriodArchived = errors.New("period has already been archived")
+
+// ledgerArchive is the archive of a closed day ("2006-01-02") or month
+// ("2006-01") of a tenant's ledger.
+type ledgerArchive struct {
+	ID        int       `json:"id"`
+	TenantID  int       `json:"tenant_id"`
+	Period    string    `json:"period"`
+	Entries   int       `json:"entries"`
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+	fileKey   string
+}
+
+// archiveVerification is the outcome of checking an archive: that its file
+// still has the checksum it was written with, and that the ledger still
+// holds exactly the entries archived.
+type archiveVerification struct {
+	Archive       *ledgerArchive `json:"archive"`
+	FileIntact    bool           `json:"file_intact"`
+	LedgerMatches bool           `json:"ledger_matches"`
+	Valid         bool           `json:"valid"`
+	Problem       string         `json:"problem,omitempty"`
+	CheckedAt     time.Time      `json:"checked_at"`
+}
+
+// ArchiveStorage holds the ledger archive storage operations.
+type ArchiveStorage interface {
+	// GetUnarchivedPeriods lists the closed days, and the months whose
+	// last day is closed, that have no archive yet, oldest first.
+	GetUnarchivedPeriods(tenantID int) ([]string, error)
+	GetTenantLedgerEntries(tenantID int, from, to time.Time) ([]*ledgerEntry, error)
+	CreateLedgerArchive(*ledgerArchive) error
+	GetLedgerArchives(tenantID int) ([]*ledgerArchive, error)
+	GetLedgerArchive(id int) (*ledgerArchive, error)
+}
+
+func (s *PostgresStorage) GetUnarchivedPeriods(tenantID int) ([]string, error) {
+	rows, err := s.db.Query(`
+        SELECT p.period FROM (
+            SELECT to_char(day, 'YYYY-MM-DD') AS period, day FROM ledger_days WHERE tenant_id = $1
+            UNION ALL
+            SELECT to_char(day, 'YYYY-MM'), day FROM ledger_days
+            WHERE tenant_id = $1 AND day = (date_trunc('month', day) + interval '1 month - 1 day')::date
+        ) p
+        WHERE NOT EXISTS (SELECT 1 FROM ledger_archives a WHERE a.tenant_id = $1 AND a.period = p.period)
+        ORDER BY p.day, length(p.period) DESC`,
+		tenantID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make([]string, 0)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+	return periods, rows.Err()
+}
+
+// GetTenantLedgerEntries returns the entries of every account of a tenant
+// posted in [from, to), in posting order.
+func (s *PostgresStorage) GetTenantLedgerEntries(tenantID int, from, to time.Time) ([]*ledgerEntry, error) {
+	rows, err := s.db.Query(`
+        SELECT l.id, l.account_id, l.amount, l.balance_after, l.kind, l.description, l.reference, l.created_at
+        FROM ledger_entries l JOIN accounts a ON a.id = l.account_id
+        WHERE a.tenant_id = $1 AND l.created_at >= $2 AND l.created_at < $3
+        ORDER BY l.id`,
+		tenantID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*ledgerEntry, 0)
+	for rows.Next() {
+		e := &ledgerEntry{}
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Amount, &e.BalanceAfter, &e.Kind, &e.Description, &e.Reference, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// CreateLedgerArchive records an archive, failing with errPeriodArchived
+// if the period already has one.
+func (s *PostgresStorage) CreateLedgerArchive(a *ledgerArchive) error {
+	err := s.db.QueryRow(
+		"INSERT INTO ledger_archives (tenant_id, period, entries, size, sha256, file_key, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING RETURNING id",
+		a.TenantID, a.Period, a.Entries, a.Size, a.SHA256, a.fileKey, a.CreatedAt,
+	).Scan(&a.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errPeriodArchived
+	}
+	return err
+}
+
+const selectLedgerArchive = "SELECT id, tenant_id, period, entries, size, sha256, file_key, created_at FROM ledger_archives "
+
+// GetLedgerArchives lists a tenant's archives, newest period first.
+func (s *PostgresStorage) GetLedgerArchives(tenantID int) ([]*ledgerArchive, error) {
+	rows, err := s.db.Query(selectLedgerArchive+"WHERE tenant_id = $1 ORDER BY period DESC", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archives := make([]*ledgerArchive, 0)
+	for rows.Next() {
+		a, err := scanLedgerArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, a)
+	}
+	return archives, rows.Err()
+}
+
+func (s *PostgresStorage) GetLedgerArchive(id int) (*ledgerArchive, error) {
+	return scanLedgerArchive(s.db.QueryRow(selectLedgerArchive+"WHERE id = $1", id))
+}
+
+func scanLedgerArchive(row interface{ Scan(...any) error }) (*ledgerArchive, error) {
+	a := &ledgerArchive{}
+	err := row.Scan(&a.ID, &a.TenantID, &a.Period, &a.Entries, &a.Size, &a.SHA256, &a.fileKey, &a.CreatedAt)
+	return a, err
+}
+
+// periodBounds returns the UTC instants a day or month period spans.
+func periodBounds(period string) (from, to time.Time, err error) {
+	if from, err = time.Parse(time.DateOnly, period); err == nil {
+		return from, from.AddDate(0, 0, 1), nil
+	}
+	if from, err = time.Parse("2006-01", period); err == nil {
+		return from, from.AddDate(0, 1, 0), nil
+	}
+	return from, to, err
+}
+
+// encodeArchive writes entries as the CSV an archive holds. It must stay
+// stable: verification re-encodes the ledger and compares checksums.
+func encodeArchive(entries []*ledgerEntry) ([]byte, error) {
+	records := [][]string{{"id", "account_id", "kind", "amount", "balance_after", "reference", "description", "created_at"}}
+	for _, e := range entries {
+		records = append(records, []string{
+			strconv.Itoa(e.ID), strconv.Itoa(e.AccountID), e.Kind, strconv.Itoa(e.Amount), strconv.Itoa(e.BalanceAfter),
+			e.Reference, e.Description, e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.WriteAll(records)
+	return buf.Bytes(), cw.Error()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// archivePeriod writes the archive of a closed period of a tenant's ledger.
+// A file already under its key is never replaced.
+func (s *Apiserver) archivePeriod(tenantID int, period string) (*ledgerArchive, error) {
+	from, to, err := periodBounds(period)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.store.GetTenantLedgerEntries(tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeArchive(entries)
+	if err != nil {
+		return nil, err
+	}
+	a := &ledgerArchive{
+		TenantID:  tenantID,
+		Period:    period,
+		Entries:   len(entries),
+		Size:      len(data),
+		SHA256:    sha256Hex(data),
+		CreatedAt: clock.Now(),
+		fileKey:   fmt.Sprintf("ledger-archives/%d/%s.csv", tenantID, period),
+	}
+	if existing, err := s.files.Get(a.fileKey); err == nil && sha256Hex(existing) != a.SHA256 {
+		return nil, fmt.Errorf("archive %s exists with different contents", a.fileKey)
+	} else if err != nil {
+		if err := s.files.Put(a.fileKey, data); err != nil {
+			return nil, err
+		}
+		manifest := fmt.Sprintf("%s  %s.csv\n", a.SHA256, period)
+		if err := s.files.Put(a.fileKey+".sha256", []byte(manifest)); err != nil {
+			return nil, err
+		}
+	}
+	return a, s.store.CreateLedgerArchive(a)
+}
+
+// archiveClosedPeriods archives the closed periods of a tenant that have
+// no archive yet.
+func (s *Apiserver) archiveClosedPeriods(tenantID int) ([]*ledgerArchive, error) {
+	periods, err := s.store.GetUnarchivedPeriods(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	archives := make([]*ledgerArchive, 0, len(periods))
+	for _, p := range periods {
+		a, err := s.archivePeriod(tenantID, p)
+		if errors.Is(err, errPeriodArchived) {
+			continue
+		}
+		if err != nil {
+			return archives, err
+		}
+		archives = append(archives, a)
+	}
+	return archives, nil
+}
+
+// verifyArchive checks an archive's file against its recorded and
+// side-by-side checksums, then re-encodes the period from the ledger to
+// catch entries altered since it closed.
+func (s *Apiserver) verifyArchive(a *ledgerArchive) (*archiveVerification, error) {
+	v := &archiveVerification{Archive: a, CheckedAt: clock.Now()}
+	data, err := s.files.Get(a.fileKey)
+	switch {
+	case err != nil:
+		v.Problem = "archive file is missing"
+	case sha256Hex(data) != a.SHA256:
+		v.Problem = "archive file does not match its checksum"
+	default:
+		manifest, err := s.files.Get(a.fileKey + ".sha256")
+		if err != nil || !bytes.HasPrefix(manifest, []byte(a.SHA256+" ")) {
+			v.Problem = "checksum file does not match the archive"
+		} else {
+			v.FileIntact = true
+		}
+	}
+
+	from, to, err := periodBounds(a.Period)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.store.GetTenantLedgerEntries(a.TenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	current, err := encodeArchive(entries)
+	if err != nil {
+		return nil, err
+	}
+	v.LedgerMatches = sha256Hex(current) == a.SHA256
+	if !v.LedgerMatches && v.Problem == "" {
+		v.Problem = "ledger entries of the period changed since it was archived"
+	}
+	v.Valid = v.FileIntact && v.LedgerMatches
+	return v, nil
+}
+
+// tenantArchive resolves the archive in the path within the caller's tenant.
+func (s *Apiserver) tenantArchive(r *http.Request) (*ledgerArchive, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.store.GetLedgerArchive(id)
+	if err != nil || a.TenantID != requestTenant(r).ID {
+		return nil, newAPIError(http.StatusNotFound, "archive_not_found", id)
+	}
+	return a, nil
+}
+
+// handleLedgerArchives lists the archives of the caller's tenant.
+func (s *Apiserver) handleLedgerArchives(w http.ResponseWriter, r *http.Request) error {
+	archives, err := s.store.GetLedgerArchives(requestTenant(r).ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, archives)
+}
+
+// handleDownloadArchive sends an archive file as stored, with the checksum
+// it was written with for the recipient to check.
+func (s *Apiserver) handleDownloadArchive(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.tenantArchive(r)
+	if err != nil {
+		return err
+	}
+	data, err := s.files.Get(a.fileKey)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("ledger-%s.csv", a.Period)))
+	w.Header().Set("X-Checksum-SHA256", a.SHA256)
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
+
+// handleVerifyArchive checks an archive is intact and still agrees with the
+// ledger.
+func (s *Apiserver) handleVerifyArchive(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.tenantArchive(r)
+	if err != nil {
+		return err
+	}
+	v, err := s.verifyArchive(a)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, v)
+}
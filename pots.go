@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const createPotsTable = `
+        CREATE TABLE IF NOT EXISTS pots (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            target INT NOT NULL DEFAULT 0,
+            balance INT NOT NULL DEFAULT 0 CHECK (balance >= 0),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+var errPotNotFound = errors.New("pot not found")
+
+// pot is money set aside within an account, optionally towards a target.
+// Pot funds stay part of the account balance but cannot be spent until
+// they are moved back to the main balance.
+type pot struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"account_id"`
+	Name      string    `json:"name"`
+	Target    int       `json:"target"`
+	Balance   int       `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreatePotRequest struct {
+	Name   string `json:"name"`
+	Target int    `json:"target"`
+}
+
+type PotTransferRequest struct {
+	Amount int `json:"amount"`
+}
+
+// PotsResponse lists an account's pots with the balance left to spend.
+type PotsResponse struct {
+	Pots             []*pot `json:"pots"`
+	Balance          int    `json:"balance"`
+	AvailableBalance int    `json:"available_balance"`
+}
+
+// PotStorage holds the pot storage operations.
+type PotStorage interface {
+	CreatePot(*pot) error
+	GetPots(accountID int) ([]*pot, error)
+	MovePotFunds(accountID, potID, amount int) (*pot, error)
+	DeletePot(accountID, potID int) error
+}
+
+// CreatePot inserts an empty pot.
+func (s *PostgresStorage) CreatePot(p *pot) error {
+	return s.db.QueryRow(
+		"INSERT INTO pots (account_id, name, target) VALUES ($1, $2, $3) RETURNING id, balance, created_at",
+		p.AccountID, p.Name, p.Target,
+	).Scan(&p.ID, &p.Balance, &p.CreatedAt)
+}
+
+// GetPots returns the pots of an account.
+func (s *PostgresStorage) GetPots(accountID int) ([]*pot, error) {
+	rows, err := s.db.Query("SELECT id, account_id, name, target, balance, created_at FROM pots WHERE account_id = $1 ORDER BY id", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pots := make([]*pot, 0)
+	for rows.Next() {
+		p := &pot{}
+		if err := rows.Scan(&p.ID, &p.AccountID, &p.Name, &p.Target, &p.Balance, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		pots = append(pots, p)
+	}
+	return pots, rows.Err()
+}
+
+// MovePotFunds moves amount from the main balance into a pot, or out of it
+// when amount is negative. Only the available balance can be put aside, and
+// never the overdraft.
+func (s *PostgresStorage) MovePotFunds(accountID, potID, amount int) (*pot, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the account serializes this with postEntries.
+	var available int
+	err = tx.QueryRow(
+		"SELECT balance - (SELECT COALESCE(SUM(balance), 0) FROM pots WHERE account_id = $1) FROM accounts WHERE id = $1 FOR UPDATE",
+		accountID,
+	).Scan(&available)
+	if err != nil {
+		return nil, err
+	}
+	if amount > available {
+		return nil, errInsufficientFunds
+	}
+
+	p := &pot{}
+	err = tx.QueryRow(
+		"SELECT id, account_id, name, target, balance, created_at FROM pots WHERE id = $1 AND account_id = $2",
+		potID, accountID,
+	).Scan(&p.ID, &p.AccountID, &p.Name, &p.Target, &p.Balance, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errPotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Balance+amount < 0 {
+		return nil, errInsufficientFunds
+	}
+	p.Balance += amount
+	if _, err := tx.Exec("UPDATE pots SET balance = $1 WHERE id = $2", p.Balance, p.ID); err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+// DeletePot removes a pot; its funds return to the main balance.
+func (s *PostgresStorage) DeletePot(accountID, potID int) error {
+	res, err := s.db.Exec("DELETE FROM pots WHERE id = $1 AND account_id = $2", potID, accountID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errPotNotFound
+	}
+	return nil
+}
+
+// handlePots lists (GET) or creates (POST) the pots of an account.
+func (s *Apiserver) handlePots(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		pots, err := s.store.GetPots(acc.ID)
+		if err != nil {
+			return err
+		}
+		resp := &PotsResponse{Pots: pots, Balance: acc.Balance, AvailableBalance: acc.Balance}
+		for _, p := range pots {
+			resp.AvailableBalance -= p.Balance
+		}
+		return writeJSON(w, http.StatusOK, resp)
+	}
+
+	req := CreatePotRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if req.Target < 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	p := &pot{AccountID: acc.ID, Name: req.Name, Target: req.Target}
+	if err := s.store.CreatePot(p); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// handlePotDeposit moves money from the main balance into a pot.
+func (s *Apiserver) handlePotDeposit(w http.ResponseWriter, r *http.Request) error {
+	return s.movePotFunds(w, r, 1)
+}
+
+// handlePotWithdraw moves money from a pot back to the main balance.
+func (s *Apiserver) handlePotWithdraw(w http.ResponseWriter, r *http.Request) error {
+	return s.movePotFunds(w, r, -1)
+}
+
+func (s *Apiserver) movePotFunds(w http.ResponseWriter, r *http.Request, sign int) error {
+	acc, potID, err := s.loadPot(r)
+	if err != nil {
+		return err
+	}
+	req := PotTransferRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Amount <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	p, err := s.store.MovePotFunds(acc.ID, potID, sign*req.Amount)
+	if errors.Is(err, errPotNotFound) {
+		return newAPIError(http.StatusNotFound, "pot_not_found", potID)
+	}
+	if errors.Is(err, errInsufficientFunds) {
+		return newAPIError(http.StatusUnprocessableEntity, "insufficient_funds")
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, p)
+}
+
+// handleDeletePot removes a pot, releasing its funds.
+func (s *Apiserver) handleDeletePot(w http.ResponseWriter, r *http.Request) error {
+	acc, potID, err := s.loadPot(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeletePot(acc.ID, potID); errors.Is(err, errPotNotFound) {
+		return newAPIError(http.StatusNotFound, "pot_not_found", potID)
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": potID})
+}
+
+// loadPot returns the account in the path, checked as authorizedAccount
+// does, and the {pot} ID.
+func (s *Apiserver) loadPot(r *http.Request) (*account, int, error) {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	potID, err := strconv.Atoi(r.PathValue("pot"))
+	if err != nil {
+		return nil, 0, newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("pot"))
+	}
+	return acc, potID, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// handlePprof serves the net/http/pprof profiles under /debug/pprof/ to
+// admins when Config.Pprof is set. The server's write timeout caps how long
+// a CPU profile or trace can run, so ask for less with ?seconds=, such as
+// /debug/pprof/profile?seconds=20. Profiles hold every tenant's data, so
+// only admins of the default tenant get them.
+func (s *Apiserver) handlePprof(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "pprof_default_only")
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Products are the kinds of account a tenant offers, such as a basic
+// checking account or a one-year term deposit. Admins configure their
+// rates, fees and limits, and accounts are opened on a product, which sets
+// their currency and overdraft limit. Changes to a product apply to
+// accounts opened afterwards.
+const createProductsTable = `
+        CREATE TABLE IF NOT EXISTS products (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            code TEXT NOT NULL,
+            name TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            currency TEXT NOT NULL,
+            interest_rate_bps INT NOT NULL DEFAULT 0,
+            monthly_fee INT NOT NULL DEFAULT 0,
+            overdraft_limit INT NOT NULL DEFAULT 0,
+            min_opening_balance INT NOT NULL DEFAULT 0,
+            term_months INT NOT NULL DEFAULT 0,
+            active BOOLEAN NOT NULL DEFAULT TRUE,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (tenant_id, code)
+        )
+    `
+
+// Product kinds. Term deposits and loans run for a term; only checking
+// accounts may be overdrawn.
+const (
+	productChecking    = "checking"
+	productSavings     = "savings"
+	productTermDeposit = "term_deposit"
+	productLoan        = "loan"
+)
+
+var productKinds = map[string]bool{
+	productChecking:    true,
+	productSavings:     true,
+	productTermDeposit: true,
+	productLoan:        true,
+}
+
+const (
+	// maxInterestRateBPS is 100% a year.
+	maxInterestRateBPS = 10000
+	maxProductTerm     = 600
+)
+
+var (
+	productCodePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+	errProductCodeExists = errors.New("product code already used")
+)
+
+// product is an account product. Amounts are in minor units of its
+// currency and the interest rate is yearly, in basis points. Accounts
+// opened at once with a balance must be opened with at least
+// MinOpeningBalance.
+type product struct {
+	ID                int       `json:"id"`
+	TenantID          int       `json:"tenant_id"`
+	Code              string    `json:"code"`
+	Name              string    `json:"name"`
+	Kind              string    `json:"kind"`
+	Currency          string    `json:"currency"`
+	InterestRateBPS   int       `json:"interest_rate_bps"`
+	MonthlyFee        int       `json:"monthly_fee"`
+	OverdraftLimit    int       `json:"overdraft_limit"`
+	MinOpeningBalance int       `json:"min_opening_balance"`
+	TermMonths        int       `json:"term_months,omitempty"`
+	Active            bool      `json:"active"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// ProductStorage holds the product catalog storage operations.
+type ProductStorage interface {
+	// CreateProduct adds a product, failing with errProductCodeExists if
+	// the tenant already has one with its code.
+	CreateProduct(*product) error
+	GetProducts(tenantID int, activeOnly bool) ([]*product, error)
+	GetProduct(tenantID, id int) (*product, error)
+	GetProductByCode(tenantID int, code string) (*product, error)
+	UpdateProduct(*product) error
+	DeactivateProduct(tenantID, id int) error
+}
+
+const selectProducts = `
+        SELECT id, tenant_id, code, name, kind, currency, interest_rate_bps, monthly_fee, overdraft_limit, min_opening_balance,
+            term_months, active, created_at, updated_at
+        FROM products `
+
+func scanProduct(row interface{ Scan(...any) error }) (*product, error) {
+	p := &product{}
+	err := row.Scan(&p.ID, &p.TenantID, &p.Code, &p.Name, &p.Kind, &p.Currency, &p.InterestRateBPS, &p.MonthlyFee, &p.OverdraftLimit,
+		&p.MinOpeningBalance, &p.TermMonths, &p.Active, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func (s *PostgresStorage) CreateProduct(p *product) error {
+	err := s.db.QueryRow(`
+        INSERT INTO products (tenant_id, code, name, kind, currency, interest_rate_bps, monthly_fee, overdraft_limit, min_opening_balance, term_months, active)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT DO NOTHING RETURNING id, created_at, updated_at`,
+		p.TenantID, p.Code, p.Name, p.Kind, p.Currency, p.InterestRateBPS, p.MonthlyFee, p.OverdraftLimit, p.MinOpeningBalance, p.TermMonths, p.Active,
+	).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errProductCodeExists
+	}
+	return err
+}
+
+// GetProducts lists a tenant's products by kind and name, leaving out the
+// retired ones if asked to.
+func (s *PostgresStorage) GetProducts(tenantID int, activeOnly bool) ([]*product, error) {
+	rows, err := s.db.Query(selectProducts+"WHERE tenant_id = $1 AND (active OR NOT $2) ORDER BY kind, name, id", tenantID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]*product, 0)
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+func (s *PostgresStorage) GetProduct(tenantID, id int) (*product, error) {
+	return scanProduct(s.db.QueryRow(selectProducts+"WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+func (s *PostgresStorage) GetProductByCode(tenantID int, code string) (*product, error) {
+	return scanProduct(s.db.QueryRow(selectProducts+"WHERE tenant_id = $1 AND code = $2", tenantID, code))
+}
+
+// UpdateProduct saves a product's name, parameters and whether it is
+// offered. Its code, kind and currency never change.
+func (s *PostgresStorage) UpdateProduct(p *product) error {
+	return s.db.QueryRow(`
+        UPDATE products SET name = $3, interest_rate_bps = $4, monthly_fee = $5, overdraft_limit = $6, min_opening_balance = $7,
+            term_months = $8, active = $9, updated_at = now()
+        WHERE id = $1 AND tenant_id = $2 RETURNING updated_at`,
+		p.ID, p.TenantID, p.Name, p.InterestRateBPS, p.MonthlyFee, p.OverdraftLimit, p.MinOpeningBalance, p.TermMonths, p.Active,
+	).Scan(&p.UpdatedAt)
+}
+
+// DeactivateProduct retires a product. Accounts opened on it keep it.
+func (s *PostgresStorage) DeactivateProduct(tenantID, id int) error {
+	res, err := s.db.Exec("UPDATE products SET active = FALSE, updated_at = now() WHERE id = $1 AND tenant_id = $2 AND active", id, tenantID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// checkProduct validates the parameters of p for its kind.
+func checkProduct(p *product) error {
+	switch {
+	case p.Name == "":
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	case !productCodePattern.MatchString(p.Code):
+		return newAPIError(http.StatusBadRequest, "invalid_product_code", p.Code)
+	case !productKinds[p.Kind]:
+		return newAPIError(http.StatusBadRequest, "invalid_product_kind", p.Kind)
+	}
+	if _, ok := currencies[p.Currency]; !ok {
+		return newAPIError(http.StatusBadRequest, "unsupported_currency", p.Currency)
+	}
+	switch {
+	case p.InterestRateBPS < 0 || p.InterestRateBPS > maxInterestRateBPS:
+		return newAPIError(http.StatusBadRequest, "invalid_product_parameter", "interest_rate_bps")
+	case p.MonthlyFee < 0:
+		return newAPIError(http.StatusBadRequest, "invalid_product_parameter", "monthly_fee")
+	case p.OverdraftLimit < 0:
+		return newAPIError(http.StatusBadRequest, "invalid_product_parameter", "overdraft_limit")
+	case p.MinOpeningBalance < 0:
+		return newAPIError(http.StatusBadRequest, "invalid_product_parameter", "min_opening_balance")
+	}
+	if p.OverdraftLimit > 0 && p.Kind != productChecking {
+		return newAPIError(http.StatusBadRequest, "product_parameter_not_applicable", "overdraft_limit", p.Kind)
+	}
+	termed := p.Kind == productTermDeposit || p.Kind == productLoan
+	if termed && (p.TermMonths <= 0 || p.TermMonths > maxProductTerm) {
+		return newAPIError(http.StatusBadRequest, "invalid_product_parameter", "term_months")
+	}
+	if !termed && p.TermMonths != 0 {
+		return newAPIError(http.StatusBadRequest, "product_parameter_not_applicable", "term_months", p.Kind)
+	}
+	return nil
+}
+
+// openingProduct looks up the product named by code that an account is
+// being opened on, checking the account's currency against it. Accounts
+// opened without a product get nil.
+func (s *Apiserver) openingProduct(tenantID int, code, currency string) (*product, error) {
+	if code == "" {
+		return nil, nil
+	}
+	p, err := s.store.GetProductByCode(tenantID, code)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !p.Active) {
+		return nil, newAPIError(http.StatusNotFound, "product_not_found", code)
+	} else if err != nil {
+		return nil, err
+	}
+	if currency != "" && currency != p.Currency {
+		return nil, newAPIError(http.StatusBadRequest, "product_currency_mismatch", p.Code, p.Currency)
+	}
+	return p, nil
+}
+
+// applyProduct opens acc on p.
+func applyProduct(acc *account, p *product) {
+	acc.ProductID, acc.Currency, acc.OverdraftLimit = &p.ID, p.Currency, p.OverdraftLimit
+}
+
+// handleProducts lists the products on offer, for customers choosing one.
+func (s *Apiserver) handleProducts(w http.ResponseWriter, r *http.Request) error {
+	products, err := s.store.GetProducts(requestTenant(r).ID, true)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, products)
+}
+
+// handleAdminProducts lists the tenant's products, retired ones included
+// (GET), or adds one (POST).
+func (s *Apiserver) handleAdminProducts(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		products, err := s.store.GetProducts(tenantID, false)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, products)
+	}
+
+	p := &product{Currency: defaultCurrency, Active: true}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		return err
+	}
+	p.TenantID = tenantID
+	p.Code, p.Name = strings.ToLower(strings.TrimSpace(p.Code)), strings.TrimSpace(p.Name)
+	if err := checkProduct(p); err != nil {
+		return err
+	}
+	if err := s.store.CreateProduct(p); errors.Is(err, errProductCodeExists) {
+		return newAPIError(http.StatusConflict, "product_code_exists", p.Code)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "product.created", "product", p.ID, p)
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// handleAdminProduct returns a product (GET), changes its name and
+// parameters (PUT), or retires it (DELETE).
+func (s *Apiserver) handleAdminProduct(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	tenantID := requestTenant(r).ID
+	p, err := s.store.GetProduct(tenantID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "product_not_found", id)
+	} else if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "PUT":
+		before := *p
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			return err
+		}
+		p.ID, p.TenantID, p.CreatedAt, p.UpdatedAt = before.ID, before.TenantID, before.CreatedAt, before.UpdatedAt
+		p.Name = strings.TrimSpace(p.Name)
+		switch {
+		case p.Code != before.Code:
+			return newAPIError(http.StatusBadRequest, "product_field_immutable", "code")
+		case p.Kind != before.Kind:
+			return newAPIError(http.StatusBadRequest, "product_field_immutable", "kind")
+		case p.Currency != before.Currency:
+			return newAPIError(http.StatusBadRequest, "product_field_immutable", "currency")
+		}
+		if err := checkProduct(p); err != nil {
+			return err
+		}
+		if err := s.store.UpdateProduct(p); err != nil {
+			return err
+		}
+		s.audit(r, "product.updated", "product", p.ID, p)
+	case "DELETE":
+		if err := s.store.DeactivateProduct(tenantID, id); errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusConflict, "product_retired", p.Code)
+		} else if err != nil {
+			return err
+		}
+		p.Active = false
+		s.audit(r, "product.retired", "product", p.ID, nil)
+	}
+	return writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createAPIKeyQuotasTable = `
+        CREATE TABLE IF NOT EXISTS api_key_quotas (
+            api_key_id INT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+            scope TEXT NOT NULL,
+            daily_limit INT NOT NULL CHECK (daily_limit >= 0),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (api_key_id, scope)
+        )
+    `
+
+const createAPIKeyUsageTable = `
+        CREATE TABLE IF NOT EXISTS api_key_usage (
+            api_key_id INT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+            scope TEXT NOT NULL,
+            day DATE NOT NULL,
+            count INT NOT NULL,
+            PRIMARY KEY (api_key_id, scope, day)
+        )
+    `
+
+// quotaScopeAll is the scope counting every request of a key. Any other
+// scope is an endpoint's route template, such as /merchant/charges.
+const quotaScopeAll = "*"
+
+var errQuotaExceeded = errors.New("api key quota exceeded")
+
+// quotaUsage is a key's request count today in one scope against its daily
+// limit, if it has one.
+type quotaUsage struct {
+	Scope      string `json:"scope"`
+	DailyLimit *int   `json:"daily_limit"`
+	Used       int    `json:"used"`
+}
+
+// remaining is how many more requests the scope allows today.
+func (u *quotaUsage) remaining() int {
+	return max(*u.DailyLimit-u.Used, 0)
+}
+
+type SetQuotaRequest struct {
+	Scope string `json:"scope"`
+	// DailyLimit is the number of requests allowed per UTC day. Null
+	// removes the quota, falling back to the default for "*".
+	DailyLimit *int `json:"daily_limit"`
+}
+
+// QuotaStorage holds the API key quota storage operations.
+type QuotaStorage interface {
+	GetAPIKeyQuotas(keyID int) (map[string]int, error)
+	SetAPIKeyQuota(keyID int, scope string, limit *int) error
+	GetAPIKeyUsage(keyID int, day time.Time) (map[string]int, error)
+	UseAPIKeyQuota(keyID int, day time.Time, usage []*quotaUsage) error
+}
+
+// GetAPIKeyQuotas returns a key's daily limits by scope.
+func (s *PostgresStorage) GetAPIKeyQuotas(keyID int) (map[string]int, error) {
+	rows, err := s.db.Query("SELECT scope, daily_limit FROM api_key_quotas WHERE api_key_id = $1", keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := map[string]int{}
+	for rows.Next() {
+		var scope string
+		var limit int
+		if err := rows.Scan(&scope, &limit); err != nil {
+			return nil, err
+		}
+		quotas[scope] = limit
+	}
+	return quotas, rows.Err()
+}
+
+// SetAPIKeyQuota sets the daily limit of a key in a scope, or removes it
+// when limit is nil.
+func (s *PostgresStorage) SetAPIKeyQuota(keyID int, scope string, limit *int) error {
+	if limit == nil {
+		_, err := s.db.Exec("DELETE FROM api_key_quotas WHERE api_key_id = $1 AND scope = $2", keyID, scope)
+		return err
+	}
+	_, err := s.db.Exec(`
+        INSERT INTO api_key_quotas (api_key_id, scope, daily_limit) VALUES ($1, $2, $3)
+        ON CONFLICT (api_key_id, scope) DO UPDATE SET daily_limit = EXCLUDED.daily_limit, updated_at = now()`,
+		keyID, scope, *limit)
+	return err
+}
+
+// GetAPIKeyUsage returns a key's request counts of a day by scope.
+func (s *PostgresStorage) GetAPIKeyUsage(keyID int, day time.Time) (map[string]int, error) {
+	rows, err := s.db.Query("SELECT scope, count FROM api_key_usage WHERE api_key_id = $1 AND day = $2", keyID, day.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[string]int{}
+	for rows.Next() {
+		var scope string
+		var count int
+		if err := rows.Scan(&scope, &count); err != nil {
+			return nil, err
+		}
+		usage[scope] = count
+	}
+	return usage, rows.Err()
+}
+
+// UseAPIKeyQuota counts a request against every scope, setting Used. If any
+// scope is at its limit it returns errQuotaExceeded and counts nothing, so
+// rejected requests do not eat into the quota.
+func (s *PostgresStorage) UseAPIKeyQuota(keyID int, day time.Time, usage []*quotaUsage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range usage {
+		if u.DailyLimit != nil && *u.DailyLimit <= 0 {
+			return errQuotaExceeded
+		}
+		err := tx.QueryRow(`
+            INSERT INTO api_key_usage (api_key_id, scope, day, count) VALUES ($1, $2, $3, 1)
+            ON CONFLICT (api_key_id, scope, day) DO UPDATE SET count = api_key_usage.count + 1
+            WHERE $4::INT IS NULL OR api_key_usage.count < $4
+            RETURNING count`,
+			keyID, u.Scope, day.Format(time.DateOnly), u.DailyLimit,
+		).Scan(&u.Used)
+		if errors.Is(err, sql.ErrNoRows) {
+			u.Used = *u.DailyLimit
+			return errQuotaExceeded
+		} else if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// quotaScope names the endpoint of a request by its route template, so
+// /charges/12/refund and /charges/13/refund share a quota.
+func quotaScope(r *http.Request) string {
+	if route := requestCtx(r).route; route != "" {
+		return route
+	}
+	return r.URL.Path
+}
+
+// quotaLimit returns the daily limit of a scope: the key's own quota, or
+// the configured default for all its requests together.
+func (s *Apiserver) quotaLimit(quotas map[string]int, scope string) *int {
+	if limit, ok := quotas[scope]; ok {
+		return &limit
+	}
+	if scope == quotaScopeAll && s.cfg().APIKeyDailyQuota > 0 {
+		limit := s.cfg().APIKeyDailyQuota
+		return &limit
+	}
+	return nil
+}
+
+// useQuota counts the request against the key's quota overall and for its
+// endpoint. The tightest limit is reported in X-Quota-* headers; once it
+// is used up the request is refused with 429 until the next UTC day.
+func (s *Apiserver) useQuota(w http.ResponseWriter, r *http.Request, k *apiKey) error {
+	quotas, err := s.store.GetAPIKeyQuotas(k.ID)
+	if err != nil {
+		return err
+	}
+	usage := []*quotaUsage{}
+	for _, scope := range []string{quotaScopeAll, quotaScope(r)} {
+		usage = append(usage, &quotaUsage{Scope: scope, DailyLimit: s.quotaLimit(quotas, scope)})
+	}
+	today := clock.Now().UTC().Truncate(24 * time.Hour)
+	err = s.store.UseAPIKeyQuota(k.ID, today, usage)
+	if err != nil && !errors.Is(err, errQuotaExceeded) {
+		return err
+	}
+
+	var tightest *quotaUsage
+	for _, u := range usage {
+		if u.DailyLimit != nil && (tightest == nil || u.remaining() < tightest.remaining()) {
+			tightest = u
+		}
+	}
+	if tightest == nil {
+		return nil
+	}
+	reset := today.Add(24 * time.Hour)
+	w.Header().Set("X-Quota-Scope", tightest.Scope)
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(*tightest.DailyLimit))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(tightest.remaining()))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if err != nil {
+		w.Header().Set("Retry-After", fmt.Sprint(int(reset.Sub(clock.Now()).Seconds())+1))
+		return newAPIError(http.StatusTooManyRequests, "quota_exceeded", tightest.Scope)
+	}
+	return nil
+}
+
+// handleAPIKeyQuotas shows a key's quotas with today's usage (GET) or sets
+// the quota of one scope (PUT).
+func (s *Apiserver) handleAPIKeyQuotas(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	k, err := s.store.GetAPIKey(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "api_key_not_found", id)
+	} else if err != nil {
+		return err
+	}
+
+	if r.Method == "PUT" {
+		req := SetQuotaRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		if req.Scope != quotaScopeAll && !strings.HasPrefix(req.Scope, "/") {
+			return newAPIError(http.StatusBadRequest, "invalid_quota_scope", req.Scope)
+		}
+		if req.DailyLimit != nil && *req.DailyLimit < 0 {
+			return newAPIError(http.StatusBadRequest, "invalid_quota")
+		}
+		if err := s.store.SetAPIKeyQuota(k.ID, req.Scope, req.DailyLimit); err != nil {
+			return err
+		}
+		s.audit(r, "api_key.quota_set", "api_key", k.ID, req)
+	}
+
+	quotas, err := s.store.GetAPIKeyQuotas(k.ID)
+	if err != nil {
+		return err
+	}
+	used, err := s.store.GetAPIKeyUsage(k.ID, clock.Now().UTC())
+	if err != nil {
+		return err
+	}
+	scopes := map[string]bool{quotaScopeAll: true}
+	for scope := range quotas {
+		scopes[scope] = true
+	}
+	for scope := range used {
+		scopes[scope] = true
+	}
+	usage := make([]*quotaUsage, 0, len(scopes))
+	for scope := range scopes {
+		usage = append(usage, &quotaUsage{Scope: scope, DailyLimit: s.quotaLimit(quotas, scope), Used: used[scope]})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Scope < usage[j].Scope })
+	return writeJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxTrackedRateKeys bounds the bucket table; full buckets are pruned
+// once it grows past this.
+const maxTrackedRateKeys = 10_000
+
+// rateBucket holds the requests a client may still make right away.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is an in-memory token bucket per client. Each bucket holds
+// up to burst requests and refills at perMinute requests a minute.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*rateBucket{}}
+}
+
+// Allow takes a request from the bucket of key, or returns how long until
+// the bucket holds one again.
+func (l *rateLimiter) Allow(key string, perMinute, burst int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now, capacity, rate := clock.Now(), float64(max(burst, 1)), float64(perMinute)/60
+	refill := func(b *rateBucket) {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxTrackedRateKeys {
+			for k, other := range l.buckets {
+				if refill(other); other.tokens >= capacity {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &rateBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	refill(b)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimit caps how fast one client IP may call the API of a tenant, per
+// RATE_LIMIT_PER_MINUTE with bursts of RATE_LIMIT_BURST. It runs before
+// authentication, so floods of bad credentials are turned away too.
+func (s *Apiserver) rateLimit(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		cfg := s.cfg()
+		if cfg.RateLimitPerMinute == 0 {
+			return next(w, r)
+		}
+		key := fmt.Sprintf("%d:%s", requestTenant(r).ID, clientIP(r))
+		if ok, wait := s.limits.Allow(key, cfg.RateLimitPerMinute, cfg.RateLimitBurst); !ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+			return newAPIError(http.StatusTooManyRequests, "rate_limited")
+		}
+		return next(w, r)
+	}
+}
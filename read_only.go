@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type ReadOnlyRequest struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+type ReadOnlyStatus struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// readOnlyExempt lists non-GET routes that must keep working in read-only
+// mode: logging in and refreshing tokens do not move money, and the toggle
+// has to be reachable to switch the mode off again.
+var readOnlyExempt = map[string]bool{
+	"/login":           true,
+	"/login/verify":    true,
+	"/token/refresh":   true,
+	"/admin/read-only": true,
+}
+
+// isMutating reports whether the request method can change state.
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// isReadOnly reports whether the deployment is in read-only mode. BANK_READ_ONLY
+// holds the instance read-only on its own, without the database, so it
+// still applies when the database cannot take writes, as in a failover.
+// Admins switch the mode with the writes feature flag, which survives
+// restarts and every instance sees within flagRefreshInterval.
+func (s *Apiserver) isReadOnly() bool {
+	return s.cfg().ReadOnly || !s.flags.Get(featureWrites).Enabled
+}
+
+// setReadOnly switches the admin read-only mode on or off for every
+// instance. It cannot lift BANK_READ_ONLY.
+func (s *Apiserver) setReadOnly(readOnly bool) error {
+	return s.flags.Set(&featureFlag{Name: featureWrites, Enabled: !readOnly})
+}
+
+// pausedForReadOnly reports whether a background job that posts ledger
+// entries or changes accounts must skip its run, as requests are refused,
+// while the deployment is read-only.
+func (s *Apiserver) pausedForReadOnly(job string) bool {
+	if !s.isReadOnly() {
+		return false
+	}
+	infof("%s: skipped while read-only\n", job)
+	return true
+}
+
+// readOnlyMiddleware rejects every mutating request with 503 while the server
+// is in read-only mode. Reads keep working.
+func (s *Apiserver) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMutating(r.Method) && !readOnlyExempt[r.URL.Path] && s.isReadOnly() {
+			w.Header().Set("Retry-After", "120")
+			writeError(w, r, newAPIError(http.StatusServiceUnavailable, "read_only"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleReadOnly reports (GET) or switches (PUT) the global read-only mode.
+// The mode applies to every tenant, so only admins of the default tenant
+// control it.
+func (s *Apiserver) handleReadOnly(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "read_only_default_only")
+	}
+	if r.Method == "PUT" {
+		req := ReadOnlyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		if err := s.setReadOnly(req.ReadOnly); err != nil {
+			return err
+		}
+		s.audit(r, "read_only.updated", "tenant", requestTenant(r).ID, req)
+	}
+	return writeJSON(w, http.StatusOK, ReadOnlyStatus{ReadOnly: s.isReadOnly()})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenReceipt is the typ claim of a receipt signature. Receipts carry no
+// expiry, so verifyToken would reject one even without it.
+const tokenReceipt = "receipt"
+
+// receipt confirms one transaction of an account. It is signed as a JWS
+// with the keys tokens are signed with, so anyone handed a receipt can
+// have the bank confirm it through /receipts/verify or, with asymmetric
+// keys, check it against /.well-known/jwks.json themselves.
+type receipt struct {
+	EntryID       int       `json:"entry_id"`
+	Reference     string    `json:"reference,omitempty"`
+	Kind          string    `json:"kind"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	Description   string    `json:"description"`
+	AccountName   string    `json:"account_name"`
+	AccountNumber string    `json:"account_number"`
+	Counterparty  string    `json:"counterparty,omitempty"`
+	Date          time.Time `json:"date"`
+	IssuedAt      time.Time `json:"issued_at"`
+}
+
+// signedReceipt is a receipt with its signature, a compact JWS whose
+// payload holds the receipt.
+type signedReceipt struct {
+	Receipt   *receipt `json:"receipt"`
+	Signature string   `json:"signature"`
+}
+
+type VerifyReceiptRequest struct {
+	Signature string `json:"signature"`
+}
+
+// ReceiptVerification tells whether a signature is the bank's and, if so,
+// the receipt it vouches for.
+type ReceiptVerification struct {
+	Valid   bool     `json:"valid"`
+	Receipt *receipt `json:"receipt,omitempty"`
+}
+
+type receiptClaims struct {
+	Type    string   `json:"typ"`
+	Receipt *receipt `json:"receipt"`
+	jwt.RegisteredClaims
+}
+
+// signReceipt signs a receipt.
+func signReceipt(rc *receipt) (string, error) {
+	return signClaims(&receiptClaims{
+		Type:    tokenReceipt,
+		Receipt: rc,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   tokenSettings.Issuer,
+			Subject:  fmt.Sprint(rc.EntryID),
+			IssuedAt: jwt.NewNumericDate(rc.IssuedAt),
+		},
+	})
+}
+
+// verifyReceipt checks that a receipt signature is ours and returns the
+// receipt it holds.
+func verifyReceipt(signature string) (*receipt, error) {
+	claims := &receiptClaims{}
+	_, err := jwt.ParseWithClaims(signature, claims, verificationKey,
+		jwt.WithValidMethods(tokenMethods()),
+		jwt.WithIssuer(tokenSettings.Issuer),
+		jwt.WithTimeFunc(clock.Now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != tokenReceipt || claims.Receipt == nil {
+		return nil, errors.New("not a receipt")
+	}
+	return claims.Receipt, nil
+}
+
+// receiptFormat reads ?format= of a receipt: json (the default) or pdf.
+func receiptFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "json":
+		return "json", nil
+	case "pdf":
+		return f, nil
+	default:
+		return "", newAPIError(http.StatusBadRequest, "invalid_format", f)
+	}
+}
+
+// handleTransactionReceipt returns a signed receipt of one of the caller's
+// transactions, by ledger entry ID, as JSON or, with ?format=pdf, as a
+// printable document showing the signature.
+func (s *Apiserver) handleTransactionReceipt(w http.ResponseWriter, r *http.Request) error {
+	format, err := receiptFormat(r)
+	if err != nil {
+		return err
+	}
+	e, acc, err := s.authorizedEntry(r)
+	if err != nil {
+		return err
+	}
+	if err := s.enrich(acc.TenantID, []*ledgerEntry{e}); err != nil {
+		return err
+	}
+
+	rc := &receipt{
+		EntryID:       e.ID,
+		Reference:     e.Reference,
+		Kind:          e.Kind,
+		Amount:        e.Amount,
+		Currency:      acc.Currency,
+		Description:   e.Description,
+		AccountName:   acc.Name,
+		AccountNumber: maskNumber(acc.Number),
+		Date:          e.CreatedAt,
+		IssuedAt:      clock.Now().Truncate(time.Second),
+	}
+	if e.Enrichment != nil {
+		rc.Counterparty = e.Enrichment.Counterparty
+	}
+	signature, err := signReceipt(rc)
+	if err != nil {
+		return err
+	}
+	s.audit(r, "receipt.issued", "ledger_entry", e.ID, nil)
+	if format == "pdf" {
+		return writePDF(w, fmt.Sprintf("receipt-%d.pdf", e.ID), receiptLines(rc, signature))
+	}
+	return writeJSON(w, http.StatusOK, &signedReceipt{Receipt: rc, Signature: signature})
+}
+
+// handleVerifyReceipt confirms a receipt signature for anyone holding one,
+// returning the receipt it vouches for so they can compare it with what
+// they were shown.
+func (s *Apiserver) handleVerifyReceipt(w http.ResponseWriter, r *http.Request) error {
+	req := VerifyReceiptRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	rc, err := verifyReceipt(strings.TrimSpace(req.Signature))
+	if err != nil {
+		return writeJSON(w, http.StatusOK, &ReceiptVerification{Valid: false})
+	}
+	return writeJSON(w, http.StatusOK, &ReceiptVerification{Valid: true, Receipt: rc})
+}
+
+// receiptAmount writes an amount with its currency code, since the PDF
+// fonts only cover ASCII.
+func receiptAmount(amount int, code string) string {
+	formatted := formatMoney(amount, code, "en-US")
+	if c, ok := currencies[code]; ok {
+		formatted = strings.Replace(formatted, c.Symbol, "", 1)
+	}
+	return code + " " + formatted
+}
+
+// receiptLines lays out a receipt for the PDF, ending with the signature
+// split over lines.
+func receiptLines(rc *receipt, signature string) []string {
+	lines := []string{
+		"Transaction receipt",
+		"",
+		"Date:       " + rc.Date.UTC().Format(time.DateTime) + " UTC",
+		"Reference:  " + rc.Reference,
+		"Type:       " + rc.Kind,
+		"Amount:     " + receiptAmount(rc.Amount, rc.Currency),
+		"Account:    " + rc.AccountName + " (" + rc.AccountNumber + ")",
+	}
+	if rc.Counterparty != "" {
+		lines = append(lines, "To/from:    "+rc.Counterparty)
+	}
+	lines = append(lines,
+		"Details:    "+rc.Description,
+		"Issued:     "+rc.IssuedAt.UTC().Format(time.DateTime)+" UTC",
+		"",
+		"Verify this receipt by posting the signature below to /receipts/verify.",
+		"",
+	)
+	for len(signature) > 0 {
+		n := min(len(signature), 80)
+		lines = append(lines, signature[:n])
+		signature = signature[n:]
+	}
+	return lines
+}
+
+// pdfPageLines is how many lines fit on a page of a rendered PDF.
+const pdfPageLines = 67
+
+// writePDF writes the lines as a PDF attachment in a monospaced font.
+// Characters outside printable ASCII are replaced with '?'.
+func writePDF(w http.ResponseWriter, filename string, lines []string) error {
+	return servePDF(w, filename, renderPDF(lines))
+}
+
+// servePDF writes a rendered PDF as an attachment.
+func servePDF(w http.ResponseWriter, filename string, data []byte) error {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(data)
+	return err
+}
+
+// renderPDF lays the lines out on A4 pages of pdfPageLines lines each.
+func renderPDF(lines []string) []byte {
+	pages := max(1, (len(lines)+pdfPageLines-1)/pdfPageLines)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	}
+	kids := make([]string, pages)
+	for p := range pages {
+		var content bytes.Buffer
+		content.WriteString("BT /F1 9 Tf 11 TL 50 790 Td\n")
+		for _, line := range lines[p*pdfPageLines : min(len(lines), (p+1)*pdfPageLines)] {
+			content.WriteString("(" + pdfEscape(line) + ") Tj T*\n")
+		}
+		content.WriteString("ET")
+		page := len(objects) + 1
+		kids[p] = fmt.Sprintf("%d 0 R", page)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", page+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages)
+
+	var doc bytes.Buffer
+	doc.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = doc.Len()
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&doc, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return doc.Bytes()
+}
+
+// pdfEscape makes text safe inside a PDF string literal.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
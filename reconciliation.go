@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const createReconciliationReportsTable = `
+        CREATE TABLE IF NOT EXISTS reconciliation_reports (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL DEFAULT 1,
+            accounts_checked INT NOT NULL,
+            discrepancies JSONB NOT NULL DEFAULT '[]',
+            run_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// balanceDiscrepancy is an account whose stored balance differs from the sum
+// of its ledger entries.
+type balanceDiscrepancy struct {
+	AccountID     int `json:"account_id"`
+	StoredBalance int `json:"stored_balance"`
+	LedgerBalance int `json:"ledger_balance"`
+	Difference    int `json:"difference"`
+}
+
+// reconciliationReport is the outcome of one reconciliation run.
+type reconciliationReport struct {
+	ID              int                   `json:"id"`
+	TenantID        int                   `json:"tenant_id"`
+	AccountsChecked int                   `json:"accounts_checked"`
+	Discrepancies   []*balanceDiscrepancy `json:"discrepancies"`
+	RunAt           time.Time             `json:"run_at"`
+}
+
+// ReconciliationStorage holds the reconciliation storage operations.
+type ReconciliationStorage interface {
+	ReconcileBalances(tenantID int) (*reconciliationReport, error)
+	GetReconciliationReports(tenantID int, limit int) ([]*reconciliationReport, error)
+}
+
+// ReconcileBalances recomputes every account balance of a tenant from the
+// ledger, compares it with the stored balance and saves the report.
+func (s *PostgresStorage) ReconcileBalances(tenantID int) (*reconciliationReport, error) {
+	report := &reconciliationReport{TenantID: tenantID, Discrepancies: []*balanceDiscrepancy{}}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// A repeatable-read snapshot keeps concurrent postings from showing up
+	// as false discrepancies.
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM accounts WHERE tenant_id = $1", tenantID).Scan(&report.AccountsChecked); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`
+        SELECT a.id, a.balance, COALESCE(SUM(l.amount), 0)
+        FROM accounts a
+        LEFT JOIN ledger_entries l ON l.account_id = a.id
+        WHERE a.tenant_id = $1
+        GROUP BY a.id
+        HAVING a.balance <> COALESCE(SUM(l.amount), 0)
+        ORDER BY a.id`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		d := &balanceDiscrepancy{}
+		if err := rows.Scan(&d.AccountID, &d.StoredBalance, &d.LedgerBalance); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Difference = d.StoredBalance - d.LedgerBalance
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	discrepancies, err := json.Marshal(report.Discrepancies)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(
+		"INSERT INTO reconciliation_reports (tenant_id, accounts_checked, discrepancies) VALUES ($1, $2, $3) RETURNING id, run_at",
+		tenantID, report.AccountsChecked, discrepancies,
+	).Scan(&report.ID, &report.RunAt)
+	return report, err
+}
+
+// GetReconciliationReports returns the most recent reports of a tenant.
+func (s *PostgresStorage) GetReconciliationReports(tenantID int, limit int) ([]*reconciliationReport, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, accounts_checked, discrepancies, run_at FROM reconciliation_reports WHERE tenant_id = $1 ORDER BY id DESC LIMIT $2", tenantID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]*reconciliationReport, 0)
+	for rows.Next() {
+		report := &reconciliationReport{}
+		var discrepancies []byte
+		if err := rows.Scan(&report.ID, &report.TenantID, &report.AccountsChecked, &discrepancies, &report.RunAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(discrepancies, &report.Discrepancies); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// runReconciliation reconciles every tenant once and logs any discrepancies.
+func (s *Apiserver) runReconciliation() {
+	tenants, err := s.store.GetTenants()
+	if err != nil {
+		logf("reconciliation: failed to load tenants: %v\n", err)
+		return
+	}
+	for _, t := range tenants {
+		report, err := s.store.ReconcileBalances(t.ID)
+		if err != nil {
+			logf("reconciliation: tenant %s failed: %v\n", t.Slug, err)
+			continue
+		}
+		for _, d := range report.Discrepancies {
+			logf("reconciliation: tenant %s account %d stored %d but ledger sums to %d\n", t.Slug, d.AccountID, d.StoredBalance, d.LedgerBalance)
+		}
+	}
+}
+
+// startReconciliationJob runs the reconciliation in the background on a
+// fixed interval. A zero interval disables the job.
+func (s *Apiserver) startReconciliationJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.runReconciliation()
+		}
+	}()
+}
+
+// handleReconciliation returns recent reports (GET) or runs a reconciliation
+// of the caller's tenant immediately (POST).
+func (s *Apiserver) handleReconciliation(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "POST" {
+		report, err := s.store.ReconcileBalances(tenantID)
+		if err != nil {
+			return err
+		}
+		s.audit(r, "reconciliation.run", "reconciliation_report", report.ID, map[string]int{"discrepancies": len(report.Discrepancies)})
+		return writeJSON(w, http.StatusOK, report)
+	}
+
+	reports, err := s.store.GetReconciliationReports(tenantID, 20)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, reports)
+}
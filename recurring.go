@@ -0,0 +1,193 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// recurringLookback is how much history recurring payments are detected in.
+const recurringLookback = 120 * 24 * time.Hour
+
+// minRecurringOccurrences is how many times a payment must have happened at
+// a steady interval to count as recurring.
+const minRecurringOccurrences = 3
+
+// recurringAmountTolerance is how far, in percent of the typical amount,
+// each occurrence of a recurring payment may be from it.
+const recurringAmountTolerance = 20
+
+// recurringKinds are the entry kinds recurring payments are detected among;
+// holds, pots and adjustments are left out.
+var recurringKinds = []string{entryTransferIn, entryTransferOut, entryDeposit, entryWithdrawal}
+
+// recurringPayment is money that has moved to or from the same counterparty
+// for a similar amount at a regular cadence. Amount is the typical (median)
+// amount, signed from the account's side.
+type recurringPayment struct {
+	Counterparty string    `json:"counterparty"`
+	Category     string    `json:"category,omitempty"`
+	Amount       int       `json:"amount"`
+	Interval     string    `json:"interval"`
+	Occurrences  int       `json:"occurrences"`
+	LastAt       time.Time `json:"last_at"`
+	NextAt       time.Time `json:"next_at"`
+}
+
+// RecurringStorage holds the recurring payment detection storage operations.
+type RecurringStorage interface {
+	GetRecurringCandidates(accountID int, since time.Time, withSubscriptions bool) ([]*ledgerEntry, error)
+}
+
+// GetRecurringCandidates returns an account's entries since the given time
+// that recurring payments may be detected in, oldest first. Subscription
+// renewals are left out unless asked for.
+func (s *PostgresStorage) GetRecurringCandidates(accountID int, since time.Time, withSubscriptions bool) ([]*ledgerEntry, error) {
+	return s.queryLedgerEntries(`
+        WHERE e.account_id = $1 AND e.created_at >= $2 AND e.kind = ANY($3)
+            AND ($4 OR NOT EXISTS (
+                SELECT 1 FROM subscription_charges sc JOIN transfers t ON t.id = sc.transfer_id
+                WHERE t.reference = e.reference
+            ))
+        ORDER BY e.created_at, e.id`,
+		accountID, since, pq.Array(recurringKinds), withSubscriptions,
+	)
+}
+
+// recurringPeriod classifies the gaps between occurrences of a payment as
+// weekly or monthly, or returns "" if they are not steady enough.
+func recurringPeriod(gaps []time.Duration) string {
+	const day = 24 * time.Hour
+	for _, p := range []struct {
+		interval string
+		min, max time.Duration
+	}{{"week", 6 * day, 8 * day}, {"month", 26 * day, 35 * day}} {
+		steady := true
+		for _, g := range gaps {
+			if g < p.min || g > p.max {
+				steady = false
+				break
+			}
+		}
+		if steady {
+			return p.interval
+		}
+	}
+	return ""
+}
+
+// detectRecurring groups entries, oldest first, by direction and
+// counterparty and keeps the groups with enough occurrences of similar
+// amounts at a steady weekly or monthly interval.
+func detectRecurring(entries []*ledgerEntry) []*recurringPayment {
+	groups := make(map[string][]*ledgerEntry)
+	var keys []string
+	for _, e := range entries {
+		name := e.Description
+		if e.Enrichment != nil && e.Enrichment.Counterparty != "" {
+			name = e.Enrichment.Counterparty
+		}
+		key := strings.ToLower(normalizeCounterparty(name))
+		if key == "" {
+			continue
+		}
+		if e.Amount < 0 {
+			key = "-" + key
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
+
+	payments := make([]*recurringPayment, 0)
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < minRecurringOccurrences {
+			continue
+		}
+		gaps := make([]time.Duration, 0, len(group)-1)
+		amounts := make([]int, 0, len(group))
+		for i, e := range group {
+			if i > 0 {
+				gaps = append(gaps, e.CreatedAt.Sub(group[i-1].CreatedAt))
+			}
+			amounts = append(amounts, e.Amount)
+		}
+		interval := recurringPeriod(gaps)
+		if interval == "" {
+			continue
+		}
+		slices.Sort(amounts)
+		typical := amounts[len(amounts)/2]
+		if !similarAmounts(amounts, typical) {
+			continue
+		}
+
+		last := group[len(group)-1]
+		p := &recurringPayment{
+			Counterparty: normalizeCounterparty(last.Description),
+			Amount:       typical,
+			Interval:     interval,
+			Occurrences:  len(group),
+			LastAt:       last.CreatedAt,
+			NextAt:       nextPeriod(last.CreatedAt, interval),
+		}
+		if last.Enrichment != nil {
+			p.Counterparty = cmp.Or(last.Enrichment.Counterparty, p.Counterparty)
+			p.Category = last.Enrichment.Category
+		}
+		payments = append(payments, p)
+	}
+	return payments
+}
+
+// similarAmounts reports whether every amount is within the tolerance of
+// the typical one.
+func similarAmounts(amounts []int, typical int) bool {
+	limit := abs(typical) * recurringAmountTolerance / 100
+	for _, a := range amounts {
+		if abs(a-typical) > limit {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// recurringPayments detects the recurring payments of an account in its
+// recent history.
+func (s *Apiserver) recurringPayments(acc *account, withSubscriptions bool) ([]*recurringPayment, error) {
+	entries, err := s.store.GetRecurringCandidates(acc.ID, clock.Now().Add(-recurringLookback), withSubscriptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.enrich(acc.TenantID, entries); err != nil {
+		return nil, err
+	}
+	return detectRecurring(entries), nil
+}
+
+// handleRecurringPayments lists the payments an account makes or receives
+// regularly, including its subscriptions, with when each is next expected.
+func (s *Apiserver) handleRecurringPayments(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	payments, err := s.recurringPayments(acc, true)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, payments)
+}
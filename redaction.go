@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accountView is how much of an account a response reveals.
+type accountView int
+
+const (
+	// viewPublic is what anyone may see of someone else's account: who
+	// holds it and its masked number.
+	viewPublic accountView = iota
+	// viewOwner is the holder's own account, without the references
+	// integrators keep on it. Its number is masked too; holders see it in
+	// full through handleRevealNumber.
+	viewOwner
+	// viewAdmin is everything but the password hash, which never leaves
+	// the server.
+	viewAdmin
+)
+
+// viewer is who a response is written for.
+type viewer struct {
+	accountID int
+	email     string
+	admin     bool
+}
+
+// viewerOf identifies the caller authenticated with claims.
+func viewerOf(claims jwt.MapClaims) viewer {
+	sub, _ := claims["sub"].(string)
+	id, _ := strconv.Atoi(sub)
+	email, _ := claims["email"].(string)
+	role, _ := claims["role"].(string)
+	return viewer{accountID: id, email: email, admin: role == roleAdmin}
+}
+
+// viewOf is the view the viewer gets of an account: admins see the
+// tenant's accounts in full and holders see all of their own accounts.
+func (v viewer) viewOf(a *account) accountView {
+	switch {
+	case v.admin:
+		return viewAdmin
+	case v.accountID != 0 && a.ID == v.accountID, v.email != "" && a.Email == v.email:
+		return viewOwner
+	}
+	return viewPublic
+}
+
+// viewerWriter is the ResponseWriter handed to authenticated handlers,
+// carrying the caller so writeJSON can redact what it writes for them.
+type viewerWriter struct {
+	http.ResponseWriter
+	viewer viewer
+}
+
+func (w *viewerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseViewer returns who w writes for. Responses of unauthenticated
+// requests are for anyone.
+func responseViewer(w http.ResponseWriter) viewer {
+	if vw, ok := w.(*viewerWriter); ok {
+		return vw.viewer
+	}
+	return viewer{}
+}
+
+// accountRedactor is implemented by accounts, types embedding them and
+// other types showing account numbers or what only holders may see.
+type accountRedactor interface {
+	redactFor(v viewer)
+}
+
+// redactFor clears the fields of the account the viewer may not see.
+func (a *account) redactFor(v viewer) {
+	if a == nil {
+		return
+	}
+	view := v.viewOf(a)
+	if view >= viewAdmin {
+		return
+	}
+	a.ExternalID, a.Metadata = "", nil
+	a.Number = maskNumber(a.Number)
+	if view >= viewOwner {
+		return
+	}
+	a.Email, a.Phone, a.Locale = "", "", ""
+	a.ProductID, a.OverdraftLimit = nil, 0
+}
+
+// redactFor masks the number of the payee's account for anyone but admins.
+func (p *payee) redactFor(v viewer) {
+	if !v.admin {
+		p.Number = maskNumber(p.Number)
+	}
+}
+
+// redactFor clears the holder's note and tags for anyone else, admins
+// included.
+func (e *ledgerEntry) redactFor(v viewer) {
+	if v.accountID == 0 || v.accountID != e.AccountID {
+		e.Note, e.Tags = "", nil
+	}
+}
+
+// redactAccounts redacts every account reachable from v through the
+// fields, elements and values JSON would encode. writeJSON runs it on
+// every response, so no handler can leak more of an account than its
+// caller may see.
+func redactAccounts(v any, vw viewer) {
+	redactValue(reflect.ValueOf(v), vw)
+}
+
+func redactValue(rv reflect.Value, vw viewer) {
+	if r, ok := asAccountRedactor(rv); ok {
+		r.redactFor(vw)
+		return
+	}
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !rv.IsNil() {
+			redactValue(rv.Elem(), vw)
+		}
+	case reflect.Struct:
+		for i := range rv.NumField() {
+			if rv.Type().Field(i).IsExported() {
+				redactValue(rv.Field(i), vw)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range rv.Len() {
+			redactValue(rv.Index(i), vw)
+		}
+	case reflect.Map:
+		for it := rv.MapRange(); it.Next(); {
+			redactValue(it.Value(), vw)
+		}
+	}
+}
+
+func asAccountRedactor(rv reflect.Value) (accountRedactor, bool) {
+	if rv.Kind() == reflect.Struct && rv.CanAddr() {
+		rv = rv.Addr()
+	}
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || !rv.CanInterface() {
+		return nil, false
+	}
+	r, ok := rv.Interface().(accountRedactor)
+	return r, ok
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const createRefundsTable = `
+        CREATE TABLE IF NOT EXISTS refunds (
+            id SERIAL PRIMARY KEY,
+            charge_id INT NOT NULL REFERENCES charges(id) ON DELETE CASCADE,
+            transfer_id INT NOT NULL REFERENCES transfers(id),
+            amount INT NOT NULL CHECK (amount > 0),
+            reason TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+var (
+	errChargeNotRefundable = errors.New("charge has not succeeded")
+	errRefundExceedsCharge = errors.New("refund exceeds the unrefunded amount of the charge")
+)
+
+// refund returns some or all of a succeeded charge to the customer from the
+// merchant's settlement account. The merchant's fee is not refunded.
+type refund struct {
+	ID         int       `json:"id"`
+	ChargeID   int       `json:"charge_id"`
+	TransferID int       `json:"transfer_id"`
+	Reference  string    `json:"reference"`
+	Amount     int       `json:"amount"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type RefundChargeRequest struct {
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// RefundStorage holds the refund storage operations.
+type RefundStorage interface {
+	RefundCharge(c *charge, rf *refund, t *transfer) error
+}
+
+// RefundCharge pays rf back to the customer with t and records it against
+// the charge, all or nothing. The charge row is locked so concurrent refunds
+// can never add up to more than was charged.
+func (s *PostgresStorage) RefundCharge(c *charge, rf *refund, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var amount, refunded int
+	if err := tx.QueryRow("SELECT status, amount, refunded FROM charges WHERE id = $1 FOR UPDATE", c.ID).Scan(&status, &amount, &refunded); err != nil {
+		return err
+	}
+	if status != chargeSucceeded {
+		return errChargeNotRefundable
+	}
+	if refunded+rf.Amount > amount {
+		return errRefundExceedsCharge
+	}
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	err = tx.QueryRow(
+		"INSERT INTO refunds (charge_id, transfer_id, amount, reason) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		c.ID, t.ID, rf.Amount, rf.Reason,
+	).Scan(&rf.ID, &rf.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRow("UPDATE charges SET refunded = refunded + $2 WHERE id = $1 RETURNING refunded", c.ID, rf.Amount).Scan(&c.Refunded); err != nil {
+		return err
+	}
+	rf.ChargeID, rf.TransferID, rf.Reference = c.ID, t.ID, t.Reference
+	return tx.Commit()
+}
+
+// handleRefundCharge refunds a charge of the calling merchant in full, or in
+// part when an amount is given. Refunds are paid from the settlement account
+// and their ledger entries name the charge and its original reference.
+func (s *Apiserver) handleRefundCharge(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.currentMerchant(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	c, err := s.store.GetCharge(id)
+	if err != nil || c.MerchantID != m.ID {
+		return newAPIError(http.StatusNotFound, "charge_not_found", id)
+	}
+	req := RefundChargeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if utf8.RuneCountInString(req.Reason) > maxMemoLength {
+		return newAPIError(http.StatusBadRequest, "memo_too_long", maxMemoLength)
+	}
+	if c.Status != chargeSucceeded {
+		return newAPIError(http.StatusConflict, "charge_not_refundable", c.ID)
+	}
+	if req.Amount == 0 {
+		req.Amount = c.Amount - c.Refunded
+	}
+	if req.Amount > c.Amount-c.Refunded {
+		return newAPIError(http.StatusUnprocessableEntity, "refund_exceeds_charge", c.Amount-c.Refunded)
+	}
+
+	settlement, err := s.store.GetAccountByID(m.SettlementAccountID)
+	if err != nil {
+		return err
+	}
+	t, err := s.newTransfer(settlement, c.CustomerAccountID, req.Amount, fmt.Sprintf("Refund of charge %d (ref %s)", c.ID, c.Reference))
+	if err != nil {
+		return err
+	}
+	rf := &refund{Amount: req.Amount, Reason: req.Reason}
+	switch err := s.store.RefundCharge(c, rf, t); {
+	case errors.Is(err, errChargeNotRefundable):
+		return newAPIError(http.StatusConflict, "charge_not_refundable", c.ID)
+	case errors.Is(err, errRefundExceedsCharge):
+		return newAPIError(http.StatusUnprocessableEntity, "refund_exceeds_charge", c.Amount-c.Refunded)
+	case err != nil:
+		return transferFailed(err)
+	}
+
+	s.transferCompleted(t)
+	s.publishEvent(m.AccountID, "charge.refunded", rf)
+	return writeJSON(w, http.StatusCreated, rf)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type contextKey string
+
+const requestContextKey contextKey = "request"
+
+// requestContext is what the middleware learns about a request on its way
+// through, for handlers to read back with the request* accessors rather
+// than parse headers and claims again. requestIDMiddleware attaches it,
+// and later middleware fills it in with the set* functions.
+type requestContext struct {
+	id string
+	// route is the path pattern the request was routed by, such as
+	// /account/{id}.
+	route    string
+	language string
+	// locale is the first supported locale of Accept-Language, if any.
+	locale  string
+	tenant  *tenant
+	claims  jwt.MapClaims
+	caller  viewer
+	apiKey  *apiKey
+	consent *consent
+	trace   traceContext
+}
+
+// newRequestContext reads what the headers of r tell about it.
+func newRequestContext(r *http.Request, id string) *requestContext {
+	rc := &requestContext{id: id, language: defaultLanguage}
+	languageFound := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if _, ok := locales[tag]; ok && rc.locale == "" {
+			rc.locale = tag
+		}
+		lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := catalogs[lang]; ok && !languageFound {
+			rc.language, languageFound = lang, true
+		}
+	}
+	return rc
+}
+
+// withRequestContext attaches a request context to r.
+func withRequestContext(r *http.Request, rc *requestContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey, rc))
+}
+
+// contextOf returns the request context of r, attaching one first if r
+// has none, as requests built outside the router do not.
+func contextOf(r *http.Request) (*http.Request, *requestContext) {
+	if rc, ok := r.Context().Value(requestContextKey).(*requestContext); ok {
+		return r, rc
+	}
+	rc := newRequestContext(r, r.Header.Get(requestIDHeader))
+	return withRequestContext(r, rc), rc
+}
+
+func requestCtx(r *http.Request) *requestContext {
+	_, rc := contextOf(r)
+	return rc
+}
+
+// setRequestTenant records the tenant the request was made to.
+func setRequestTenant(r *http.Request, t *tenant) *http.Request {
+	r, rc := contextOf(r)
+	rc.tenant = t
+	return r
+}
+
+// setRequestCaller records the user authenticated by claims.
+func setRequestCaller(r *http.Request, claims jwt.MapClaims) *http.Request {
+	r, rc := contextOf(r)
+	rc.claims, rc.caller = claims, viewerOf(claims)
+	return r
+}
+
+// setRequestAPIKey records the API key that authenticated the request.
+func setRequestAPIKey(r *http.Request, k *apiKey) *http.Request {
+	r, rc := contextOf(r)
+	rc.apiKey = k
+	return r
+}
+
+// setRequestConsent records the consent that authorised the request.
+func setRequestConsent(r *http.Request, c *consent) *http.Request {
+	r, rc := contextOf(r)
+	rc.consent = c
+	return r
+}
+
+// requestID returns the ID assigned to the request.
+func requestID(r *http.Request) string {
+	return requestCtx(r).id
+}
+
+// requestTenant returns the tenant resolved for the request.
+func requestTenant(r *http.Request) *tenant {
+	if t := requestCtx(r).tenant; t != nil {
+		return t
+	}
+	return &tenant{ID: defaultTenantID, Slug: "default", JWTAudience: "bank"}
+}
+
+// requestLanguage picks the first supported language of the request's
+// Accept-Language header, or the default one.
+func requestLanguage(r *http.Request) string {
+	return requestCtx(r).language
+}
+
+// requestCaller returns the authenticated user, or the zero viewer.
+func requestCaller(r *http.Request) viewer {
+	return requestCtx(r).caller
+}
+
+// requestClaims returns the claims of the caller's access token, if any.
+func requestClaims(r *http.Request) jwt.MapClaims {
+	return requestCtx(r).claims
+}
+
+// requestEmail returns the email of the authenticated caller, if any.
+func requestEmail(r *http.Request) string {
+	return requestCaller(r).email
+}
+
+// isAdmin reports whether the authenticated caller has the admin role.
+func isAdmin(r *http.Request) bool {
+	return requestCaller(r).admin
+}
+
+// requestAPIKey returns the key that authenticated the request, if any.
+func requestAPIKey(r *http.Request) *apiKey {
+	return requestCtx(r).apiKey
+}
+
+// requestConsent returns the consent that authorised the request.
+func requestConsent(r *http.Request) *consent {
+	return requestCtx(r).consent
+}
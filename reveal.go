@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// RevealNumberRequest completes a reveal with the step-up code sent to the
+// account holder. Without a challenge the request starts one.
+type RevealNumberRequest struct {
+	ChallengeID int    `json:"challenge_id"`
+	Code        string `json:"code"`
+}
+
+type revealedNumber struct {
+	AccountID int    `json:"account_id"`
+	Number    string `json:"number"`
+}
+
+// handleRevealNumber shows the holder the full number of their account,
+// which other responses mask. The first request sends a step-up code and
+// answers 202 with the challenge; repeating it with the code returns the
+// number. Each code reveals the number once, and reveals are audited.
+func (s *Apiserver) handleRevealNumber(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	if caller.ID != id {
+		return newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	req := RevealNumberRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if req.ChallengeID == 0 {
+		stepUp, err := s.startStepUp(r, caller)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusAccepted, stepUp)
+	}
+	if err := s.verifyStepUp(caller, req.ChallengeID, req.Code); err != nil {
+		return err
+	}
+	s.audit(r, "account.number_revealed", "account", caller.ID, nil)
+	return writeJSON(w, http.StatusOK, &revealedNumber{AccountID: caller.ID, Number: caller.Number})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const createRoundUpSettingsTable = `
+        CREATE TABLE IF NOT EXISTS roundup_settings (
+            account_id INT PRIMARY KEY REFERENCES accounts(id) ON DELETE CASCADE,
+            savings_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            enabled BOOLEAN NOT NULL DEFAULT true,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Ledger entry kinds of a round-up. Like transfers, the legs net to zero.
+const (
+	entryRoundUpOut = "roundup_out"
+	entryRoundUpIn  = "roundup_in"
+)
+
+// maxSummaryMonths caps ?months= of the round-up summary.
+const maxSummaryMonths = 24
+
+// roundUpSettings opts an account into rounding every outgoing transfer up to
+// the next whole currency unit and saving the difference.
+type roundUpSettings struct {
+	AccountID        int       `json:"account_id"`
+	SavingsAccountID int       `json:"savings_account_id"`
+	Enabled          bool      `json:"enabled"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type RoundUpRequest struct {
+	SavingsAccountID int  `json:"savings_account_id"`
+	Enabled          bool `json:"enabled"`
+}
+
+// roundUpMonth is the round-up savings of one calendar month (UTC).
+type roundUpMonth struct {
+	Month     string `json:"month"`
+	RoundUps  int    `json:"round_ups"`
+	Total     int    `json:"total"`
+	Formatted string `json:"total_formatted,omitempty"`
+}
+
+type RoundUpSummary struct {
+	AccountID int             `json:"account_id"`
+	Currency  string          `json:"currency"`
+	Months    []*roundUpMonth `json:"months"`
+}
+
+func (r *RoundUpSummary) formatMoney(locale string) {
+	for _, m := range r.Months {
+		m.Formatted = formatMoney(m.Total, r.Currency, locale)
+	}
+}
+
+// RoundUpStorage holds the round-up savings storage operations.
+type RoundUpStorage interface {
+	SetRoundUpSettings(*roundUpSettings) error
+	GetRoundUpSettings(accountID int) (*roundUpSettings, error)
+	DeleteRoundUpSettings(accountID int) error
+	GetRoundUpSummary(accountID int, since time.Time) ([]*roundUpMonth, error)
+}
+
+// SetRoundUpSettings creates or replaces the round-up settings of an account.
+func (s *PostgresStorage) SetRoundUpSettings(r *roundUpSettings) error {
+	return s.db.QueryRow(`
+        INSERT INTO roundup_settings (account_id, savings_account_id, enabled) VALUES ($1, $2, $3)
+        ON CONFLICT (account_id) DO UPDATE SET savings_account_id = EXCLUDED.savings_account_id, enabled = EXCLUDED.enabled, updated_at = now()
+        RETURNING updated_at`,
+		r.AccountID, r.SavingsAccountID, r.Enabled,
+	).Scan(&r.UpdatedAt)
+}
+
+// GetRoundUpSettings retrieves the round-up settings of an account.
+func (s *PostgresStorage) GetRoundUpSettings(accountID int) (*roundUpSettings, error) {
+	r := &roundUpSettings{}
+	err := s.db.QueryRow("SELECT account_id, savings_account_id, enabled, updated_at FROM roundup_settings WHERE account_id = $1", accountID).
+		Scan(&r.AccountID, &r.SavingsAccountID, &r.Enabled, &r.UpdatedAt)
+	return r, err
+}
+
+// DeleteRoundUpSettings turns round-ups off for an account.
+func (s *PostgresStorage) DeleteRoundUpSettings(accountID int) error {
+	_, err := s.db.Exec("DELETE FROM roundup_settings WHERE account_id = $1", accountID)
+	return err
+}
+
+// GetRoundUpSummary totals the round-ups saved from an account per month
+// since the given time, newest month first.
+func (s *PostgresStorage) GetRoundUpSummary(accountID int, since time.Time) ([]*roundUpMonth, error) {
+	rows, err := s.db.Query(`
+        SELECT to_char(date_trunc('month', created_at AT TIME ZONE 'UTC'), 'YYYY-MM') AS month, COUNT(*), -SUM(amount)
+        FROM ledger_entries
+        WHERE account_id = $1 AND kind = $2 AND created_at >= $3
+        GROUP BY month ORDER BY month DESC`,
+		accountID, entryRoundUpOut, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	months := make([]*roundUpMonth, 0)
+	for rows.Next() {
+		m := &roundUpMonth{}
+		if err := rows.Scan(&m.Month, &m.RoundUps, &m.Total); err != nil {
+			return nil, err
+		}
+		months = append(months, m)
+	}
+	return months, rows.Err()
+}
+
+// roundUpAmount is what it takes to round a debit of amount minor units up
+// to the next whole unit of the currency, e.g. 40 paise for ₹12.60.
+func roundUpAmount(amount int, currencyCode string) int {
+	unit := int(math.Pow10(currencies[currencyCode].Exponent))
+	return (unit - amount%unit) % unit
+}
+
+// postRoundUp saves the round-up of a debit into the linked savings account
+// within the caller's transaction. It returns the amount saved, which is
+// zero when the account has no active round-up, the debit is already a
+// whole amount, or the account cannot afford the extra debit; a round-up
+// never fails the payment it belongs to.
+func postRoundUp(tx *sql.Tx, settings *roundUpSettings, debit int, currencyCode, reference string) (int, error) {
+	if settings == nil || !settings.Enabled {
+		return 0, nil
+	}
+	amount := roundUpAmount(debit, currencyCode)
+	if amount == 0 {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec("SAVEPOINT roundup"); err != nil {
+		return 0, err
+	}
+	err := postEntries(tx,
+		&ledgerEntry{AccountID: settings.AccountID, Amount: -amount, Kind: entryRoundUpOut, Description: "Round-up of " + reference, Reference: reference},
+		&ledgerEntry{AccountID: settings.SavingsAccountID, Amount: amount, Kind: entryRoundUpIn, Description: "Round-up of " + reference, Reference: reference},
+	)
+	if errors.Is(err, errInsufficientFunds) {
+		_, err = tx.Exec("ROLLBACK TO SAVEPOINT roundup")
+		return 0, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("RELEASE SAVEPOINT roundup")
+	return amount, err
+}
+
+// handleRoundUp returns (GET), sets (PUT) or turns off (DELETE) the
+// round-up savings of an account.
+func (s *Apiserver) handleRoundUp(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		settings, err := s.store.GetRoundUpSettings(acc.ID)
+		if err != nil {
+			return newAPIError(http.StatusNotFound, "round_up_not_found", acc.ID)
+		}
+		return writeJSON(w, http.StatusOK, settings)
+	case "DELETE":
+		if err := s.store.DeleteRoundUpSettings(acc.ID); err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]int{"deleted": acc.ID})
+	}
+
+	req := RoundUpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.SavingsAccountID == acc.ID {
+		return newAPIError(http.StatusBadRequest, "same_account_transfer")
+	}
+	savings, err := s.store.GetAccountByID(req.SavingsAccountID)
+	if err != nil || savings.TenantID != acc.TenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", req.SavingsAccountID)
+	}
+	if savings.Currency != acc.Currency {
+		return newAPIError(http.StatusBadRequest, "currency_mismatch", acc.Currency, savings.Currency)
+	}
+
+	settings := &roundUpSettings{AccountID: acc.ID, SavingsAccountID: savings.ID, Enabled: req.Enabled}
+	if err := s.store.SetRoundUpSettings(settings); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, settings)
+}
+
+// handleRoundUpSummary returns the monthly round-up savings of an account
+// for the last ?months= months (12 by default).
+func (s *Apiserver) handleRoundUpSummary(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	months := 12
+	if v := r.URL.Query().Get("months"); v != "" {
+		if months, err = strconv.Atoi(v); err != nil || months < 1 || months > maxSummaryMonths {
+			return newAPIError(http.StatusBadRequest, "invalid_months", maxSummaryMonths)
+		}
+	}
+
+	now := clock.Now().UTC()
+	since := time.Date(now.Year(), now.Month()-time.Month(months-1), 1, 0, 0, 0, 0, time.UTC)
+	summary, err := s.store.GetRoundUpSummary(acc.ID, since)
+	if err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, &RoundUpSummary{AccountID: acc.ID, Currency: acc.Currency, Months: summary})
+}
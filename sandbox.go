@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxSandboxMint caps a single mint of test funds.
+const maxSandboxMint = 10_000_000
+
+// sandboxJobs are the scheduled jobs an integrator can run right away for
+// their sandbox tenant instead of waiting for the next tick.
+var sandboxJobs = map[string]func(s *Apiserver, tenantID int) (any, error){
+	"end-of-day": func(s *Apiserver, tenantID int) (any, error) {
+		if _, err := s.closeLedgerDays(tenantID); err != nil {
+			return nil, err
+		}
+		return s.eodStatus(tenantID)
+	},
+	"reconciliation": func(s *Apiserver, tenantID int) (any, error) {
+		return s.store.ReconcileBalances(tenantID)
+	},
+	"invariants": func(s *Apiserver, tenantID int) (any, error) {
+		return s.store.CheckInvariants(tenantID)
+	},
+	"claim-expiry": func(s *Apiserver, tenantID int) (any, error) {
+		return s.expireClaims(tenantID)
+	},
+	"billing": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runBilling(tenantID)
+	},
+	"cash-code-expiry": func(s *Apiserver, tenantID int) (any, error) {
+		return s.expireCashCodes(tenantID)
+	},
+	"transaction-exports": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runExports(tenantID)
+	},
+	"external-sync": func(s *Apiserver, tenantID int) (any, error) {
+		return s.syncExternalLinks(tenantID)
+	},
+	"bill-payments": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runBillPayments(tenantID)
+	},
+	"dormancy": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runDormancy(tenantID)
+	},
+	"campaigns": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runCampaigns(tenantID)
+	},
+	"scans": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runScans(tenantID)
+	},
+	"notifications": func(s *Apiserver, tenantID int) (any, error) {
+		return s.runNotificationOutbox(tenantID)
+	},
+}
+
+type MintRequest struct {
+	Amount int `json:"amount"`
+}
+
+type WebhookTestRequest struct {
+	EventType string         `json:"event_type"`
+	Data      map[string]any `json:"data"`
+}
+
+// sandboxOnly restricts a handler to sandbox tenants, whose accounts hold
+// test money only. Elsewhere the route does not exist.
+func sandboxOnly(fn apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if !requestTenant(r).Sandbox {
+			return newAPIError(http.StatusNotFound, "sandbox_only")
+		}
+		return fn(w, r)
+	}
+}
+
+// handleSandboxMint credits an account with test funds, booked as a deposit
+// so the sandbox books balance like real ones.
+func (s *Apiserver) handleSandboxMint(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	req := MintRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Amount <= 0 || req.Amount > maxSandboxMint {
+		return newAPIError(http.StatusBadRequest, "invalid_mint_amount", maxSandboxMint)
+	}
+
+	entry := &ledgerEntry{AccountID: acc.ID, Amount: req.Amount, Kind: entryDeposit, Description: "Sandbox test funds"}
+	if err := s.store.PostLedgerEntries(entry); err != nil {
+		return err
+	}
+	s.notify(acc.ID, "deposit", fmt.Sprintf("%d in test funds was added to your sandbox account", req.Amount))
+	s.checkBalanceAlerts(acc.ID)
+	return writeJSON(w, http.StatusOK, entry)
+}
+
+// handleSandboxJob runs one of the scheduled jobs for the caller's tenant
+// immediately and returns its result.
+func (s *Apiserver) handleSandboxJob(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("job")
+	job, ok := sandboxJobs[name]
+	if !ok {
+		return newAPIError(http.StatusNotFound, "unknown_job", name)
+	}
+	result, err := job(s, requestTenant(r).ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// handleSandboxWebhookTest publishes a test event to the caller's webhook
+// endpoints, sandbox.test unless another event type is given.
+func (s *Apiserver) handleSandboxWebhookTest(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := WebhookTestRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.EventType = strings.TrimSpace(req.EventType); req.EventType == "" {
+		req.EventType = "sandbox.test"
+	}
+	if req.Data == nil {
+		req.Data = map[string]any{}
+	}
+	req.Data["test"] = true
+
+	s.publishEvent(acc.ID, req.EventType, req.Data)
+	return writeJSON(w, http.StatusAccepted, req)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createSARReportsTable = `
+        CREATE TABLE IF NOT EXISTS sar_reports (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            review_id INT REFERENCES screening_reviews(id),
+            prepared_by INT NOT NULL,
+            file_key TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// maxSARTransactions caps the transactions one report can bundle.
+const maxSARTransactions = 100
+
+// sarSubject is the account a suspicious activity report is about.
+type sarSubject struct {
+	AccountID int `json:"account_id"`
+	accountProfile
+	Balance int `json:"balance"`
+}
+
+// sarDocument is what a suspicious activity report sets out. It is rendered
+// to a PDF when the report is generated, so later changes to the account
+// or its transactions do not alter a filed report.
+type sarDocument struct {
+	Subject      sarSubject       `json:"subject"`
+	Review       *screeningReview `json:"review,omitempty"`
+	Transactions []*transfer      `json:"transactions"`
+	Notes        string           `json:"notes"`
+	PreparedBy   int              `json:"prepared_by"`
+	PreparedAt   time.Time        `json:"prepared_at"`
+}
+
+// sarReport is a filed suspicious activity report. Its document is a PDF
+// in the file store.
+type sarReport struct {
+	ID         int       `json:"id"`
+	TenantID   int       `json:"tenant_id"`
+	AccountID  int       `json:"account_id"`
+	ReviewID   *int      `json:"review_id,omitempty"`
+	PreparedBy int       `json:"prepared_by"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	fileKey string
+}
+
+type CreateSARRequest struct {
+	ReviewID   int      `json:"review_id"`
+	References []string `json:"references"`
+	Notes      string   `json:"notes"`
+}
+
+// SARStorage holds the suspicious activity report storage operations.
+type SARStorage interface {
+	CreateSARReport(*sarReport) error
+	GetSARReport(tenantID, id int) (*sarReport, error)
+}
+
+// CreateSARReport records a report whose document has been stored.
+func (s *PostgresStorage) CreateSARReport(rep *sarReport) error {
+	return s.db.QueryRow(
+		"INSERT INTO sar_reports (tenant_id, account_id, review_id, prepared_by, file_key) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		rep.TenantID, rep.AccountID, rep.ReviewID, rep.PreparedBy, rep.fileKey,
+	).Scan(&rep.ID, &rep.CreatedAt)
+}
+
+// GetSARReport retrieves a tenant's report.
+func (s *PostgresStorage) GetSARReport(tenantID, id int) (*sarReport, error) {
+	rep := &sarReport{}
+	err := s.db.QueryRow("SELECT id, tenant_id, account_id, review_id, prepared_by, file_key, created_at FROM sar_reports WHERE id = $1 AND tenant_id = $2", id, tenantID).
+		Scan(&rep.ID, &rep.TenantID, &rep.AccountID, &rep.ReviewID, &rep.PreparedBy, &rep.fileKey, &rep.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// sarLines lays out a report for the PDF.
+func sarLines(doc *sarDocument) []string {
+	subject := doc.Subject
+	lines := []string{
+		"SUSPICIOUS ACTIVITY REPORT",
+		"",
+		fmt.Sprintf("Account:    %d (%s)", subject.AccountID, subject.Number),
+		"Name:       " + subject.Name,
+		"Email:      " + subject.Email,
+		"Balance:    " + receiptAmount(subject.Balance, subject.Currency),
+	}
+	if rv := doc.Review; rv != nil {
+		lines = append(lines, "", fmt.Sprintf("Screening review %d (%s), raised %s UTC", rv.ID, rv.Status, rv.CreatedAt.UTC().Format(time.DateTime)))
+		for _, hit := range rv.Hits {
+			lines = append(lines, fmt.Sprintf("  %s: %s (%s)", hit.Source, hit.Entry, hit.Reason))
+		}
+	}
+	lines = append(lines, "", fmt.Sprintf("Flagged transactions: %d", len(doc.Transactions)))
+	for _, t := range doc.Transactions {
+		lines = append(lines, fmt.Sprintf("  %s  %s  %d -> %d  %s", t.CreatedAt.UTC().Format(time.DateTime), t.Reference, t.FromAccountID, t.ToAccountID, receiptAmount(t.Amount, t.Currency)))
+	}
+	lines = append(lines, "", "Notes:")
+	for _, line := range strings.Split(doc.Notes, "\n") {
+		for len(line) > 90 {
+			lines = append(lines, "  "+line[:90])
+			line = line[90:]
+		}
+		lines = append(lines, "  "+line)
+	}
+	return append(lines, "", fmt.Sprintf("Prepared by account %d at %s UTC", doc.PreparedBy, doc.PreparedAt.Format(time.DateTime)))
+}
+
+// handleCreateSAR generates a suspicious activity report on an account,
+// bundling its profile, the flagged transfers given by reference, the
+// screening review that raised the concern (if any) and the reviewer's notes.
+func (s *Apiserver) handleCreateSAR(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	reviewer, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != reviewer.TenantID {
+		return newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	req := CreateSARRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Notes = strings.TrimSpace(req.Notes)
+	if req.Notes == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "notes")
+	}
+	if req.ReviewID == 0 && len(req.References) == 0 {
+		return newAPIError(http.StatusBadRequest, "required_field", "review_id or references")
+	}
+	if len(req.References) > maxSARTransactions {
+		return newAPIError(http.StatusBadRequest, "too_many_references", maxSARTransactions)
+	}
+
+	profile, err := s.store.GetAccountProfile(acc.ID)
+	if err != nil {
+		return err
+	}
+	rep := &sarReport{TenantID: acc.TenantID, AccountID: acc.ID, PreparedBy: reviewer.ID}
+	doc := &sarDocument{
+		Subject:      sarSubject{AccountID: acc.ID, accountProfile: *profile, Balance: acc.Balance},
+		Transactions: []*transfer{},
+		Notes:        req.Notes,
+		PreparedBy:   reviewer.ID,
+		PreparedAt:   clock.Now().UTC(),
+	}
+	if req.ReviewID != 0 {
+		rv, err := s.store.GetScreeningReview(acc.TenantID, req.ReviewID)
+		if err != nil || rv.AccountID != acc.ID {
+			return newAPIError(http.StatusNotFound, "screening_review_not_found", req.ReviewID)
+		}
+		rep.ReviewID, doc.Review = &rv.ID, rv
+	}
+	for _, ref := range req.References {
+		t, err := s.store.GetTransferByReference(acc.TenantID, ref)
+		if err != nil || (t.FromAccountID != acc.ID && t.ToAccountID != acc.ID) {
+			return newAPIError(http.StatusNotFound, "transfer_not_found", ref)
+		}
+		doc.Transactions = append(doc.Transactions, t)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	rep.fileKey = fmt.Sprintf("sar/%d/%d/%s.pdf", acc.TenantID, acc.ID, hex.EncodeToString(b))
+	if err := s.files.Put(rep.fileKey, renderPDF(sarLines(doc))); err != nil {
+		return err
+	}
+	if err := s.store.CreateSARReport(rep); err != nil {
+		if err := s.files.Delete(rep.fileKey); err != nil {
+			logf("sar: failed to delete %s: %v\n", rep.fileKey, err)
+		}
+		return err
+	}
+	s.audit(r, "sar.created", "sar_report", rep.ID, map[string]int{"account_id": acc.ID})
+	return writeJSON(w, http.StatusCreated, rep)
+}
+
+// handleGetSAR returns the PDF of a report. Every access is written to the
+// audit log.
+func (s *Apiserver) handleGetSAR(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	rep, err := s.store.GetSARReport(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "sar_not_found", id)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := s.files.Get(rep.fileKey)
+	if err != nil {
+		return err
+	}
+	s.audit(r, "sar.accessed", "sar_report", rep.ID, nil)
+	return servePDF(w, fmt.Sprintf("sar-%d.pdf", rep.ID), data)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scan statuses of uploaded files.
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+)
+
+var errFileInfected = errors.New("file is infected")
+
+// VirusScanner checks uploaded files. It returns an error wrapping
+// errFileInfected, naming what was found, for infected files, and other
+// errors when it could not scan. Without a scanner uploads count as clean.
+type VirusScanner interface {
+	Scan(filename string, data []byte) error
+}
+
+// clamdChunkSize is the largest chunk streamed to clamd at once.
+const clamdChunkSize = 64 << 10
+
+// clamdScanner scans files with a ClamAV daemon over TCP using its
+// INSTREAM command. Calls go through the outbound circuit breakers, so a
+// daemon that is down fails fast and files wait for the scan job.
+type clamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func newClamdScanner(address string) *clamdScanner {
+	return &clamdScanner{address: address, timeout: 30 * time.Second}
+}
+
+func (c *clamdScanner) Scan(filename string, data []byte) error {
+	if !circuits.Allow(c.address) {
+		outboundRequests.Add(c.address+":rejected", 1)
+		return fmt.Errorf("%s: %w", c.address, errCircuitOpen)
+	}
+	reply, err := c.instream(data)
+	circuits.Record(c.address, err == nil)
+	if err != nil {
+		outboundRequests.Add(c.address+":failed", 1)
+		return err
+	}
+	outboundRequests.Add(c.address+":ok", 1)
+
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND".
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", errFileInfected, strings.TrimSuffix(result, " FOUND"))
+	}
+	return fmt.Errorf("clamd: %s", result)
+}
+
+func (c *clamdScanner) instream(data []byte) (string, error) {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		chunk := data[:min(len(data), clamdChunkSize)]
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		w.Write(size)
+		w.Write(chunk)
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return string(bytes.TrimRight([]byte(reply), "\x00")), nil
+}
+
+// scanUpload scans a stored attachment and records the outcome. Infected
+// files stay in quarantine; files the scanner could not check stay pending
+// for the scan job to retry.
+func (s *Apiserver) scanUpload(a *attachment, data []byte) error {
+	status, result := scanClean, ""
+	if s.virusScanner != nil {
+		err := s.virusScanner.Scan(a.Filename, data)
+		switch {
+		case errors.Is(err, errFileInfected):
+			status, result = scanInfected, err.Error()
+			logf("scanning: attachment %d quarantined: %v\n", a.ID, err)
+		case err != nil:
+			logf("scanning: attachment %d not scanned: %v\n", a.ID, err)
+			return nil
+		}
+	}
+	if err := s.store.SetAttachmentScan(a.ID, status, result); err != nil {
+		return err
+	}
+	now := clock.Now()
+	a.ScanStatus, a.ScanResult, a.ScannedAt = status, result, &now
+	return nil
+}
+
+// runScans scans the tenant's attachments still pending and returns them.
+func (s *Apiserver) runScans(tenantID int) ([]*attachment, error) {
+	pending, err := s.store.GetAttachmentsByStatus(tenantID, scanPending)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range pending {
+		data, err := s.files.Get(a.storageKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.scanUpload(a, data); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// startScanJob retries scans of pending uploads in the background.
+func (s *Apiserver) startScanJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("scanning: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runScans(t.ID); err != nil {
+					logf("scanning: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleQuarantine lists the tenant's uploads that are infected, or with
+// ?status=pending those waiting to be scanned.
+func (s *Apiserver) handleQuarantine(w http.ResponseWriter, r *http.Request) error {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = scanInfected
+	}
+	if status != scanInfected && status != scanPending {
+		return newAPIError(http.StatusBadRequest, "invalid_scan_status", status)
+	}
+	attachments, err := s.store.GetAttachmentsByStatus(requestTenant(r).ID, status)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, attachments)
+}
+
+// handleRescanAttachment scans an upload again, for instance after the
+// scanner's signatures were corrected, releasing it if it is now clean.
+func (s *Apiserver) handleRescanAttachment(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	a, err := s.store.GetTenantAttachment(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "attachment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	data, err := s.files.Get(a.storageKey)
+	if err != nil {
+		return err
+	}
+	if err := s.scanUpload(a, data); err != nil {
+		return err
+	}
+	s.audit(r, "attachment.rescanned", "attachment", a.ID, map[string]string{"scan_status": a.ScanStatus})
+	return writeJSON(w, http.StatusOK, a)
+}
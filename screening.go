@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createDenylistTable = `
+        CREATE TABLE IF NOT EXISTS screening_denylist (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            name TEXT NOT NULL DEFAULT '',
+            email TEXT NOT NULL DEFAULT '',
+            reason TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createScreeningReviewsTable = `
+        CREATE TABLE IF NOT EXISTS screening_reviews (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            hits JSONB NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending',
+            reviewer_id INT,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            resolved_at TIMESTAMPTZ
+        )
+    `
+
+// Screening statuses of an account, and of the review of a screening hit.
+// An account with a pending review cannot send or receive transfers until an
+// admin clears it; a blocked account stays that way.
+const (
+	screeningClear   = "clear"
+	screeningPending = "pending"
+	screeningBlocked = "blocked"
+)
+
+var errReviewResolved = errors.New("screening review is already resolved")
+
+// screeningSubject is who is being screened.
+type screeningSubject struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// screeningHit is a list entry a subject matched.
+type screeningHit struct {
+	Source string `json:"source"`
+	Entry  string `json:"entry"`
+	Reason string `json:"reason"`
+}
+
+// Screener checks parties against sanctions and block lists. The server uses
+// the tenant's local denylist unless another implementation, such as a
+// client for a screening provider, is plugged in.
+type Screener interface {
+	Screen(tenantID int, subject screeningSubject) ([]screeningHit, error)
+}
+
+// denylistEntry blocks anyone with a matching name or email. Names match
+// case-insensitively and ignoring surrounding whitespace.
+type denylistEntry struct {
+	ID        int       `json:"id"`
+	TenantID  int       `json:"tenant_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// screeningReview is a screening hit waiting for, or resolved by, an admin.
+type screeningReview struct {
+	ID         int            `json:"id"`
+	TenantID   int            `json:"tenant_id"`
+	AccountID  int            `json:"account_id"`
+	Hits       []screeningHit `json:"hits"`
+	Status     string         `json:"status"`
+	ReviewerID *int           `json:"reviewer_id,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	ResolvedAt *time.Time     `json:"resolved_at,omitempty"`
+}
+
+// ScreeningStorage holds the screening storage operations.
+type ScreeningStorage interface {
+	CreateDenylistEntry(*denylistEntry) error
+	GetDenylist(tenantID int) ([]*denylistEntry, error)
+	DeleteDenylistEntry(tenantID, id int) error
+	MatchDenylist(tenantID int, subject screeningSubject) ([]*denylistEntry, error)
+	CreateScreeningReview(*screeningReview) error
+	GetScreeningReview(tenantID, id int) (*screeningReview, error)
+	GetScreeningReviews(tenantID int, status string, page pageRequest) ([]*screeningReview, int, error)
+	ResolveScreeningReview(tenantID, id, reviewerID int, status string) (*screeningReview, error)
+	GetScreeningStatuses(ids ...int) (map[int]string, error)
+}
+
+// CreateDenylistEntry adds an entry to a tenant's denylist.
+func (s *PostgresStorage) CreateDenylistEntry(e *denylistEntry) error {
+	return s.db.QueryRow(
+		"INSERT INTO screening_denylist (tenant_id, name, email, reason) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		e.TenantID, e.Name, e.Email, e.Reason,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+// GetDenylist lists a tenant's denylist.
+func (s *PostgresStorage) GetDenylist(tenantID int) ([]*denylistEntry, error) {
+	return s.queryDenylist("WHERE tenant_id = $1 ORDER BY id", tenantID)
+}
+
+// DeleteDenylistEntry removes an entry from a tenant's denylist.
+func (s *PostgresStorage) DeleteDenylistEntry(tenantID, id int) error {
+	_, err := s.db.Exec("DELETE FROM screening_denylist WHERE id = $1 AND tenant_id = $2", id, tenantID)
+	return err
+}
+
+// MatchDenylist returns the entries of a tenant's denylist matching a subject.
+func (s *PostgresStorage) MatchDenylist(tenantID int, subject screeningSubject) ([]*denylistEntry, error) {
+	return s.queryDenylist(`
+        WHERE tenant_id = $1 AND (
+            (name <> '' AND lower(trim(name)) = lower(trim($2))) OR
+            (email <> '' AND lower(email) = lower($3))
+        ) ORDER BY id`,
+		tenantID, subject.Name, subject.Email,
+	)
+}
+
+func (s *PostgresStorage) queryDenylist(where string, args ...any) ([]*denylistEntry, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, name, email, reason, created_at FROM screening_denylist "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*denylistEntry, 0)
+	for rows.Next() {
+		e := &denylistEntry{}
+		if err := rows.Scan(&e.ID, &e.TenantID, &e.Name, &e.Email, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// CreateScreeningReview opens a review of an account's screening hits and
+// holds the account until it is resolved.
+func (s *PostgresStorage) CreateScreeningReview(rv *screeningReview) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hits, err := json.Marshal(rv.Hits)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(
+		"INSERT INTO screening_reviews (tenant_id, account_id, hits, status) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		rv.TenantID, rv.AccountID, hits, screeningPending,
+	).Scan(&rv.ID, &rv.CreatedAt)
+	if err != nil {
+		return err
+	}
+	rv.Status = screeningPending
+	if _, err := tx.Exec("UPDATE accounts SET screening_status = $1 WHERE id = $2 AND screening_status = $3", screeningPending, rv.AccountID, screeningClear); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const selectScreeningReviews = "SELECT id, tenant_id, account_id, hits, status, reviewer_id, created_at, resolved_at FROM screening_reviews "
+
+func scanScreeningReview(row interface{ Scan(...any) error }) (*screeningReview, error) {
+	rv := &screeningReview{}
+	var hits []byte
+	if err := row.Scan(&rv.ID, &rv.TenantID, &rv.AccountID, &hits, &rv.Status, &rv.ReviewerID, &rv.CreatedAt, &rv.ResolvedAt); err != nil {
+		return nil, err
+	}
+	return rv, json.Unmarshal(hits, &rv.Hits)
+}
+
+// GetScreeningReview retrieves a tenant's review.
+func (s *PostgresStorage) GetScreeningReview(tenantID, id int) (*screeningReview, error) {
+	return scanScreeningReview(s.db.QueryRow(selectScreeningReviews+"WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+// GetScreeningReviews returns a page of a tenant's reviews with a status,
+// newest first, and their total count.
+func (s *PostgresStorage) GetScreeningReviews(tenantID int, status string, page pageRequest) ([]*screeningReview, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM screening_reviews WHERE tenant_id = $1 AND status = $2", tenantID, status)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(3, "")
+	rows, err := s.db.Query(selectScreeningReviews+"WHERE tenant_id = $1 AND status = $2 AND "+cond+" "+order, append([]any{tenantID, status}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	reviews := make([]*screeningReview, 0)
+	for rows.Next() {
+		rv, err := scanScreeningReview(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		reviews = append(reviews, rv)
+	}
+	return reviews, total, rows.Err()
+}
+
+// ResolveScreeningReview clears or blocks the account of a pending review.
+// A cleared account is released once none of its reviews is pending.
+func (s *PostgresStorage) ResolveScreeningReview(tenantID, id, reviewerID int, status string) (*screeningReview, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rv, err := scanScreeningReview(tx.QueryRow(selectScreeningReviews+"WHERE id = $1 AND tenant_id = $2 FOR UPDATE", id, tenantID))
+	if err != nil {
+		return nil, err
+	}
+	if rv.Status != screeningPending {
+		return nil, errReviewResolved
+	}
+	err = tx.QueryRow(
+		"UPDATE screening_reviews SET status = $2, reviewer_id = $3, resolved_at = now() WHERE id = $1 RETURNING status, reviewer_id, resolved_at",
+		id, status, reviewerID,
+	).Scan(&rv.Status, &rv.ReviewerID, &rv.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if status == screeningBlocked {
+		_, err = tx.Exec("UPDATE accounts SET screening_status = $1 WHERE id = $2", screeningBlocked, rv.AccountID)
+	} else {
+		_, err = tx.Exec(`
+            UPDATE accounts SET screening_status = $1 WHERE id = $2 AND screening_status = $3
+            AND NOT EXISTS (SELECT 1 FROM screening_reviews WHERE account_id = $2 AND status = $3)`,
+			screeningClear, rv.AccountID, screeningPending,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rv, tx.Commit()
+}
+
+// GetScreeningStatuses returns the screening status of each account.
+func (s *PostgresStorage) GetScreeningStatuses(ids ...int) (map[int]string, error) {
+	rows, err := s.db.Query("SELECT id, screening_status FROM accounts WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[int]string, len(ids))
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, err
+		}
+		statuses[id] = status
+	}
+	return statuses, rows.Err()
+}
+
+// denylistScreener is the Screener backed by the screening_denylist table.
+type denylistScreener struct {
+	store ScreeningStorage
+}
+
+func (d *denylistScreener) Screen(tenantID int, subject screeningSubject) ([]screeningHit, error) {
+	entries, err := d.store.MatchDenylist(tenantID, subject)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]screeningHit, 0, len(entries))
+	for _, e := range entries {
+		entry := e.Name
+		if entry == "" {
+			entry = e.Email
+		}
+		hits = append(hits, screeningHit{Source: "denylist", Entry: entry, Reason: e.Reason})
+	}
+	return hits, nil
+}
+
+// screenAccount screens a new account in the background. Hits put the
+// account on hold pending an admin's review; screening errors are logged
+// and leave the account clear, like failed notifications.
+func (s *Apiserver) screenAccount(acc *account) {
+	go func() {
+		hits, err := s.screener.Screen(acc.TenantID, screeningSubject{Name: acc.Name, Email: acc.Email})
+		if err != nil {
+			logf("screening: account %d failed: %v\n", acc.ID, err)
+			return
+		}
+		if len(hits) == 0 {
+			return
+		}
+		rv := &screeningReview{TenantID: acc.TenantID, AccountID: acc.ID, Hits: hits}
+		if err := s.store.CreateScreeningReview(rv); err != nil {
+			logf("screening: failed to open review of account %d: %v\n", acc.ID, err)
+		}
+	}()
+}
+
+// checkScreening refuses transfers involving an account that is held or
+// blocked by screening.
+func (s *Apiserver) checkScreening(ids ...int) error {
+	statuses, err := s.store.GetScreeningStatuses(ids...)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if status := statuses[id]; status != "" && status != screeningClear {
+			return newAPIError(http.StatusForbidden, "account_under_review", id)
+		}
+	}
+	return nil
+}
+
+type DenylistEntryRequest struct {
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+// handleDenylist lists the tenant's denylist (GET) or adds an entry (POST).
+func (s *Apiserver) handleDenylist(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		entries, err := s.store.GetDenylist(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, entries)
+	}
+
+	req := DenylistEntryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	e := &denylistEntry{TenantID: tenantID, Name: strings.TrimSpace(req.Name), Email: strings.TrimSpace(req.Email), Reason: req.Reason}
+	if e.Name == "" && e.Email == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name or email")
+	}
+	if err := s.store.CreateDenylistEntry(e); err != nil {
+		return err
+	}
+	s.audit(r, "denylist.added", "denylist_entry", e.ID, e)
+	return writeJSON(w, http.StatusCreated, e)
+}
+
+// handleDeleteDenylistEntry removes an entry from the tenant's denylist.
+func (s *Apiserver) handleDeleteDenylistEntry(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteDenylistEntry(requestTenant(r).ID, id); err != nil {
+		return err
+	}
+	s.audit(r, "denylist.removed", "denylist_entry", id, nil)
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// handleScreeningReviews lists the tenant's reviews with ?status=, pending
+// by default.
+func (s *Apiserver) handleScreeningReviews(w http.ResponseWriter, r *http.Request) error {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = screeningPending
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	reviews, total, err := s.store.GetScreeningReviews(requestTenant(r).ID, status, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(reviews, total, page, func(rv *screeningReview) cursor { return cursor{rv.CreatedAt, rv.ID} }))
+}
+
+// resolveScreeningReview returns a handler resolving a pending review with status.
+func (s *Apiserver) resolveScreeningReview(status string) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := pathID(r)
+		if err != nil {
+			return err
+		}
+		reviewer, err := s.currentAccount(r)
+		if err != nil {
+			return err
+		}
+		rv, err := s.store.ResolveScreeningReview(reviewer.TenantID, id, reviewer.ID, status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "screening_review_not_found", id)
+		}
+		if errors.Is(err, errReviewResolved) {
+			return newAPIError(http.StatusConflict, "screening_review_resolved", id)
+		}
+		if err != nil {
+			return err
+		}
+		s.audit(r, "screening."+status, "account", rv.AccountID, rv)
+		return writeJSON(w, http.StatusOK, rv)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secretPatterns find credentials in free text: JWTs, API keys, bearer
+// tokens, bcrypt hashes and key=value pairs naming a secret.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), redacted},
+	{regexp.MustCompile(`sk_[0-9a-f]{16,}`), "sk_" + redacted},
+	{regexp.MustCompile(`(?i)bearer\s+\S+`), "Bearer " + redacted},
+	{regexp.MustCompile(`\$2[aby]\$\d{2}\$[./A-Za-z0-9]{53}`), redacted},
+	{regexp.MustCompile(`(?i)\b(password|passwd|secret|token)(["']?\s*[:=]\s*["']?)[^\s"'&,}]+`), "${1}${2}" + redacted},
+}
+
+// longNumber matches account and card numbers. Shorter runs of digits are
+// amounts, IDs and limits, which stay readable.
+var longNumber = regexp.MustCompile(`\b\d{10,19}\b`)
+
+// secretFields are JSON keys whose values are never written out.
+var secretFields = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"api_key":       true,
+	"key_hash":      true,
+	"code_hash":     true,
+	"captcha_token": true,
+	"csrf_token":    true,
+}
+
+// numberFields are JSON keys holding account numbers, masked to the last 4.
+var numberFields = map[string]bool{
+	"number":         true,
+	"account_number": true,
+}
+
+// maskNumber keeps the last four digits of a number.
+func maskNumber(n string) string {
+	if len(n) <= 4 {
+		return n
+	}
+	return strings.Repeat("*", len(n)-4) + n[len(n)-4:]
+}
+
+// scrub removes secrets from text and masks long numbers to their last 4
+// digits. Everything written to the log or returned as an error message
+// passes through it.
+func scrub(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return longNumber.ReplaceAllStringFunc(s, maskNumber)
+}
+
+// scrubJSON redacts secret fields and masks account numbers in a JSON
+// document, such as the details of an audit entry.
+func scrubJSON(data []byte) []byte {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []byte(scrub(string(data)))
+	}
+	out, err := json.Marshal(scrubValue("", v))
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func scrubValue(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			v[k] = scrubValue(k, val)
+		}
+		return v
+	case []any:
+		for i, val := range v {
+			v[i] = scrubValue(key, val)
+		}
+		return v
+	case string:
+		switch {
+		case secretFields[key]:
+			return redacted
+		case numberFields[key]:
+			return maskNumber(v)
+		}
+		return scrub(v)
+	}
+	return v
+}
+
+// logf writes a scrubbed line to the server log, at every log level. See
+// infof and debugf for the lines levels hide.
+func logf(format string, args ...any) {
+	fmt.Print(scrub(fmt.Sprintf(format, args...)))
+}
+
+// logln is logf with fmt.Println formatting.
+func logln(args ...any) {
+	fmt.Print(scrub(fmt.Sprintln(args...)))
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createSavedSearchesTable = `
+        CREATE TABLE IF NOT EXISTS saved_searches (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            kind TEXT NOT NULL DEFAULT '',
+            min_amount INT,
+            max_amount INT,
+            query TEXT NOT NULL DEFAULT '',
+            tag TEXT NOT NULL DEFAULT '',
+            export_frequency TEXT NOT NULL DEFAULT '',
+            export_format TEXT NOT NULL DEFAULT 'csv',
+            exported_until TIMESTAMPTZ,
+            next_export_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Export frequencies of a saved search.
+const (
+	exportWeekly  = "weekly"
+	exportMonthly = "monthly"
+)
+
+var exportFrequencies = []string{exportWeekly, exportMonthly}
+
+// maxExportRows caps the transactions in one emailed export.
+const maxExportRows = 10000
+
+// transactionFilter narrows an account's transactions. Amounts are compared
+// with the size of the movement, whichever its direction; the query matches
+// the description or the enriched counterparty, and the holder's notes when
+// personal is set.
+type transactionFilter struct {
+	Kind      string     `json:"kind,omitempty"`
+	MinAmount *int       `json:"min_amount,omitempty"`
+	MaxAmount *int       `json:"max_amount,omitempty"`
+	Query     string     `json:"query,omitempty"`
+	Tag       string     `json:"tag,omitempty"`
+	From      *time.Time `json:"-"`
+	To        *time.Time `json:"-"`
+	// personal is set when the holder searches their own transactions.
+	// Notes and tags are theirs alone, so nobody else can search by them.
+	personal bool
+}
+
+// savedSearch is a named transaction filter, optionally exported by email on
+// a schedule. Each export covers the transactions since the previous one.
+type savedSearch struct {
+	ID        int    `json:"id"`
+	AccountID int    `json:"account_id"`
+	Name      string `json:"name"`
+	transactionFilter
+	ExportFrequency string     `json:"export_frequency,omitempty"`
+	ExportFormat    string     `json:"export_format,omitempty"`
+	ExportedUntil   *time.Time `json:"exported_until,omitempty"`
+	NextExportAt    *time.Time `json:"next_export_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type SavedSearchRequest struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	MinAmount *int   `json:"min_amount"`
+	MaxAmount *int   `json:"max_amount"`
+	Query     string `json:"query"`
+	Tag       string `json:"tag"`
+}
+
+type ExportSubscriptionRequest struct {
+	Frequency string `json:"frequency"`
+	// Format is csv unless given; see exportFormats.
+	Format string `json:"format"`
+}
+
+// SearchStorage holds the transaction search storage operations.
+type SearchStorage interface {
+	SearchLedgerEntries(accountID int, f transactionFilter, page pageRequest) ([]*ledgerEntry, int, error)
+	CreateSavedSearch(*savedSearch) error
+	GetSavedSearches(accountID int) ([]*savedSearch, error)
+	GetSavedSearch(accountID, id int) (*savedSearch, error)
+	DeleteSavedSearch(accountID, id int) error
+	SetSearchExport(accountID, id int, frequency, format string, from time.Time, next *time.Time) (*savedSearch, error)
+	GetDueExports(tenantID int, now time.Time) ([]*savedSearch, error)
+	MarkExportSent(id int, until, next time.Time) error
+}
+
+// ExportSender emails scheduled transaction exports to account holders. The
+// server logs them unless an email provider is plugged in.
+type ExportSender interface {
+	SendExport(acc *account, search *savedSearch, filename string, data []byte) error
+}
+
+// logExportSender prints exports to the server log, for local development.
+type logExportSender struct{}
+
+func (logExportSender) SendExport(acc *account, search *savedSearch, filename string, data []byte) error {
+	fmt.Printf("export %q for account %d (%s): %s, %d bytes\n", search.Name, acc.ID, acc.Email, filename, len(data))
+	return nil
+}
+
+// nextExport returns the first export time of the schedule after now. The
+// schedule steps in the time zone of from, keeping its local time of day.
+func nextExport(frequency string, from, now time.Time) time.Time {
+	for !from.After(now) {
+		if frequency == exportMonthly {
+			from = from.AddDate(0, 1, 0)
+		} else {
+			from = from.AddDate(0, 0, 7)
+		}
+	}
+	return from
+}
+
+const selectSavedSearches = `
+        SELECT id, account_id, name, kind, min_amount, max_amount, query, tag, export_frequency, export_format, exported_until, next_export_at, created_at
+        FROM saved_searches `
+
+func scanSavedSearch(row interface{ Scan(...any) error }) (*savedSearch, error) {
+	ss := &savedSearch{}
+	var minAmount, maxAmount sql.NullInt64
+	var exportedUntil, nextExportAt sql.NullTime
+	err := row.Scan(&ss.ID, &ss.AccountID, &ss.Name, &ss.Kind, &minAmount, &maxAmount, &ss.Query, &ss.Tag, &ss.ExportFrequency, &ss.ExportFormat, &exportedUntil, &nextExportAt, &ss.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if minAmount.Valid {
+		v := int(minAmount.Int64)
+		ss.MinAmount = &v
+	}
+	if maxAmount.Valid {
+		v := int(maxAmount.Int64)
+		ss.MaxAmount = &v
+	}
+	if exportedUntil.Valid {
+		ss.ExportedUntil = &exportedUntil.Time
+	}
+	if nextExportAt.Valid {
+		ss.NextExportAt = &nextExportAt.Time
+	}
+	return ss, nil
+}
+
+func (s *PostgresStorage) querySavedSearches(where string, args ...any) ([]*savedSearch, error) {
+	rows, err := s.db.Query(selectSavedSearches+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := make([]*savedSearch, 0)
+	for rows.Next() {
+		ss, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, ss)
+	}
+	return searches, rows.Err()
+}
+
+// transactionFilterCond matches the entries of account $1 against a filter
+// bound to $2 through $9.
+const transactionFilterCond = `
+        e.account_id = $1
+        AND ($2 = '' OR e.kind = $2)
+        AND ($3::int IS NULL OR abs(e.amount) >= $3)
+        AND ($4::int IS NULL OR abs(e.amount) <= $4)
+        AND ($5 = '' OR e.description ILIKE '%' || $5 || '%' OR n.counterparty ILIKE '%' || $5 || '%'
+            OR ($9 AND tn.note ILIKE '%' || $5 || '%'))
+        AND ($6::timestamptz IS NULL OR e.created_at >= $6)
+        AND ($7::timestamptz IS NULL OR e.created_at < $7)
+        AND ($8 = '' OR NOT $9 OR $8 = ANY(tn.tags))`
+
+// SearchLedgerEntries returns a page of an account's entries matching the
+// filter, newest first, and their total count.
+func (s *PostgresStorage) SearchLedgerEntries(accountID int, f transactionFilter, page pageRequest) ([]*ledgerEntry, int, error) {
+	args := []any{accountID, f.Kind, f.MinAmount, f.MaxAmount, f.Query, f.From, f.To, f.Tag, f.personal}
+	total, err := s.count(`
+        SELECT COUNT(*) FROM ledger_entries e LEFT JOIN ledger_enrichments n ON n.ledger_entry_id = e.id
+        LEFT JOIN transaction_notes tn ON tn.ledger_entry_id = e.id WHERE`+transactionFilterCond, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, pageArgs := page.keyset(len(args)+1, "e")
+	entries, err := s.queryLedgerEntries("WHERE"+transactionFilterCond+" AND "+cond+" "+order, append(args, pageArgs...)...)
+	return entries, total, err
+}
+
+// CreateSavedSearch stores a new saved search.
+func (s *PostgresStorage) CreateSavedSearch(ss *savedSearch) error {
+	return s.db.QueryRow(
+		"INSERT INTO saved_searches (account_id, name, kind, min_amount, max_amount, query, tag) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+		ss.AccountID, ss.Name, ss.Kind, ss.MinAmount, ss.MaxAmount, ss.Query, ss.Tag,
+	).Scan(&ss.ID, &ss.CreatedAt)
+}
+
+// GetSavedSearches lists an account's saved searches.
+func (s *PostgresStorage) GetSavedSearches(accountID int) ([]*savedSearch, error) {
+	return s.querySavedSearches("WHERE account_id = $1 ORDER BY id", accountID)
+}
+
+// GetSavedSearch retrieves a saved search of an account.
+func (s *PostgresStorage) GetSavedSearch(accountID, id int) (*savedSearch, error) {
+	return scanSavedSearch(s.db.QueryRow(selectSavedSearches+"WHERE id = $1 AND account_id = $2", id, accountID))
+}
+
+// DeleteSavedSearch removes a saved search of an account, ending its export.
+func (s *PostgresStorage) DeleteSavedSearch(accountID, id int) error {
+	res, err := s.db.Exec("DELETE FROM saved_searches WHERE id = $1 AND account_id = $2", id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetSearchExport subscribes a saved search to exports in the format at the
+// frequency, covering transactions from the given time, or with an empty
+// frequency unsubscribes it.
+func (s *PostgresStorage) SetSearchExport(accountID, id int, frequency, format string, from time.Time, next *time.Time) (*savedSearch, error) {
+	var until *time.Time
+	if frequency != "" {
+		until = &from
+	}
+	return scanSavedSearch(s.db.QueryRow(`
+        UPDATE saved_searches SET export_frequency = $3, export_format = $6, exported_until = $4, next_export_at = $5
+        WHERE id = $1 AND account_id = $2
+        RETURNING id, account_id, name, kind, min_amount, max_amount, query, tag, export_frequency, export_format, exported_until, next_export_at, created_at`,
+		id, accountID, frequency, until, next, format,
+	))
+}
+
+// GetDueExports lists the saved searches of a tenant whose export is due.
+func (s *PostgresStorage) GetDueExports(tenantID int, now time.Time) ([]*savedSearch, error) {
+	return s.querySavedSearches(
+		"WHERE next_export_at <= $2 AND account_id IN (SELECT id FROM accounts WHERE tenant_id = $1) ORDER BY next_export_at, id",
+		tenantID, now,
+	)
+}
+
+// MarkExportSent records that a saved search was exported up to until and
+// schedules its next export.
+func (s *PostgresStorage) MarkExportSent(id int, until, next time.Time) error {
+	_, err := s.db.Exec("UPDATE saved_searches SET exported_until = $2, next_export_at = $3 WHERE id = $1", id, until, next)
+	return err
+}
+
+// parseTransactionFilter reads a filter from the query string: ?kind=,
+// ?min_amount=, ?max_amount=, ?q=, ?tag= and the ?from= and ?to= timestamps.
+func parseTransactionFilter(r *http.Request) (transactionFilter, error) {
+	q := r.URL.Query()
+	f := transactionFilter{Kind: q.Get("kind"), Query: strings.TrimSpace(q.Get("q")), Tag: strings.ToLower(strings.TrimSpace(q.Get("tag")))}
+	for name, dst := range map[string]**int{"min_amount": &f.MinAmount, "max_amount": &f.MaxAmount} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return f, newAPIError(http.StatusBadRequest, "invalid_amount")
+			}
+			*dst = &n
+		}
+	}
+	for name, dst := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, newAPIError(http.StatusBadRequest, "invalid_timestamp", v)
+			}
+			*dst = &t
+		}
+	}
+	return f, validateFilter(f)
+}
+
+func validateFilter(f transactionFilter) error {
+	if f.MinAmount != nil && f.MaxAmount != nil && *f.MinAmount > *f.MaxAmount {
+		return newAPIError(http.StatusBadRequest, "invalid_amount_range")
+	}
+	if f.Tag != "" && !tagPattern.MatchString(f.Tag) {
+		return newAPIError(http.StatusBadRequest, "invalid_tag", f.Tag)
+	}
+	return nil
+}
+
+// handleSavedSearches lists an account's saved searches (GET) or saves a new
+// one (POST).
+func (s *Apiserver) handleSavedSearches(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		searches, err := s.store.GetSavedSearches(acc.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, searches)
+	}
+
+	req := SavedSearchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	ss := &savedSearch{
+		AccountID: acc.ID,
+		Name:      strings.TrimSpace(req.Name),
+		transactionFilter: transactionFilter{
+			Kind:      strings.TrimSpace(req.Kind),
+			MinAmount: req.MinAmount,
+			MaxAmount: req.MaxAmount,
+			Query:     strings.TrimSpace(req.Query),
+			Tag:       strings.ToLower(strings.TrimSpace(req.Tag)),
+		},
+	}
+	if ss.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if (ss.MinAmount != nil && *ss.MinAmount < 0) || (ss.MaxAmount != nil && *ss.MaxAmount < 0) {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if err := validateFilter(ss.transactionFilter); err != nil {
+		return err
+	}
+	if err := s.store.CreateSavedSearch(ss); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, ss)
+}
+
+// savedSearch loads the saved search in the {search} path of the account.
+func (s *Apiserver) savedSearch(r *http.Request, acc *account) (*savedSearch, error) {
+	id, err := strconv.Atoi(r.PathValue("search"))
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_id", r.PathValue("search"))
+	}
+	ss, err := s.store.GetSavedSearch(acc.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, newAPIError(http.StatusNotFound, "saved_search_not_found", id)
+	}
+	return ss, err
+}
+
+// handleDeleteSavedSearch removes a saved search of an account.
+func (s *Apiserver) handleDeleteSavedSearch(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	ss, err := s.savedSearch(r, acc)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteSavedSearch(acc.ID, ss.ID); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": ss.ID})
+}
+
+// handleSavedSearchTransactions runs a saved search, returning a page of the
+// matching transactions, newest first.
+func (s *Apiserver) handleSavedSearchTransactions(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	ss, err := s.savedSearch(r, acc)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	f := ss.transactionFilter
+	f.personal = responseViewer(w).accountID == acc.ID
+	entries, total, err := s.store.SearchLedgerEntries(acc.ID, f, page)
+	if err != nil {
+		return err
+	}
+	if err := s.enrich(acc.TenantID, entries); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(entries, total, page, ledgerCursor))
+}
+
+// handleSearchExport subscribes a saved search to a weekly or monthly
+// emailed CSV export (PUT) or unsubscribes it (DELETE). The first export
+// covers the transactions from the time of subscribing.
+func (s *Apiserver) handleSearchExport(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	ss, err := s.savedSearch(r, acc)
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	if r.Method == "DELETE" {
+		ss, err = s.store.SetSearchExport(acc.ID, ss.ID, "", exportCSV, now, nil)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, ss)
+	}
+
+	req := ExportSubscriptionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if !slices.Contains(exportFrequencies, req.Frequency) {
+		return newAPIError(http.StatusBadRequest, "invalid_export_frequency", req.Frequency, strings.Join(exportFrequencies, ", "))
+	}
+	format := cmp.Or(req.Format, exportCSV)
+	if err := validateExportFormat(format); err != nil {
+		return err
+	}
+	next := nextExport(req.Frequency, now.In(accountLocation(acc)), now)
+	ss, err = s.store.SetSearchExport(acc.ID, ss.ID, req.Frequency, format, now, &next)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, ss)
+}
+
+// exportRecord is a transaction as a row of an export, timed in loc.
+func exportRecord(e *ledgerEntry, loc *time.Location) []string {
+	counterparty, category := "", ""
+	if e.Enrichment != nil {
+		counterparty, category = e.Enrichment.Counterparty, e.Enrichment.Category
+	}
+	return []string{
+		e.CreatedAt.In(loc).Format(time.RFC3339), e.Reference, e.Kind, e.Description, counterparty, category,
+		strconv.Itoa(e.Amount), strconv.Itoa(e.BalanceAfter), e.Note, strings.Join(e.Tags, " "),
+	}
+}
+
+// runExports emails the due exports of a tenant. An export that fails to go
+// out stays due and is retried on the next run.
+func (s *Apiserver) runExports(tenantID int) ([]*savedSearch, error) {
+	now := clock.Now()
+	due, err := s.store.GetDueExports(tenantID, now)
+	if err != nil {
+		return nil, err
+	}
+	sent := make([]*savedSearch, 0, len(due))
+	for _, ss := range due {
+		if err := s.sendExport(tenantID, ss, now); err != nil {
+			logf("exports: saved search %d failed: %v\n", ss.ID, err)
+			continue
+		}
+		sent = append(sent, ss)
+	}
+	return sent, nil
+}
+
+func (s *Apiserver) sendExport(tenantID int, ss *savedSearch, now time.Time) error {
+	acc, err := s.store.GetAccountContact(ss.AccountID)
+	if err != nil {
+		return err
+	}
+	f := ss.transactionFilter
+	f.From, f.To, f.personal = ss.ExportedUntil, &now, true
+	entries, _, err := s.store.SearchLedgerEntries(acc.ID, f, pageRequest{Limit: maxExportRows})
+	if err != nil {
+		return err
+	}
+	if len(entries) > maxExportRows {
+		entries = entries[:maxExportRows]
+	}
+	if err := s.enrich(tenantID, entries); err != nil {
+		return err
+	}
+
+	data, err := encodeStatement(ss.ExportFormat, &statement{Account: acc, Entries: entries, From: ss.ExportedUntil, To: now})
+	if err != nil {
+		return err
+	}
+	if err := s.exports.SendExport(acc, ss, statementFilename(ss.ExportFormat, acc, now), data); err != nil {
+		return err
+	}
+	return s.store.MarkExportSent(ss.ID, now, nextExport(ss.ExportFrequency, ss.NextExportAt.In(accountLocation(acc)), now))
+}
+
+// startExportJob sends the scheduled transaction exports in the background
+// on a fixed interval. A zero interval disables the job.
+func (s *Apiserver) startExportJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("exports: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runExports(t.ID); err != nil {
+					logf("exports: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// Ledger entry kinds for money entering and leaving the bank.
+const (
+	entryDeposit    = "deposit"
+	entryWithdrawal = "withdrawal"
+)
+
+var (
+	seedFirstNames = []string{"Aarav", "Asha", "Bikash", "Diya", "Ishaan", "Kabir", "Maya", "Nisha", "Pranav", "Rujin", "Sagar", "Sita", "Tara", "Vikram", "Yash", "Zoya"}
+	seedLastNames  = []string{"Adhikari", "Bhattarai", "Gurung", "Iyer", "Joshi", "Karki", "Mehta", "Patel", "Rai", "Shah", "Sharma", "Shrestha", "Thapa", "Verma"}
+	seedDeposits   = []string{"Salary", "Freelance payment", "Cash deposit", "Interest", "Refund"}
+	seedDebits     = []string{"ATM withdrawal", "Groceries", "Electricity bill", "Mobile recharge", "Rent", "Restaurant", "Fuel", "Online shopping"}
+)
+
+// seedPassword is the password of every seeded account.
+const seedPassword = "password123"
+
+type SeedRequest struct {
+	Seed     int64 `json:"seed"`
+	Accounts int   `json:"accounts"`
+}
+
+// seedSummary reports what a seed run created.
+type seedSummary struct {
+	Seed         int64 `json:"seed"`
+	Accounts     int   `json:"accounts"`
+	Skipped      int   `json:"skipped"`
+	Transactions int   `json:"transactions"`
+}
+
+// seedDatabase fills a tenant with realistic fake accounts and transaction
+// history. The same seed always produces the same data, and accounts that
+// already exist are left alone so the loader can be re-run safely.
+func seedDatabase(store Storage, tenantID int, seed int64, accounts int) (*seedSummary, error) {
+	rng := rand.New(rand.NewSource(seed))
+	summary := &seedSummary{Seed: seed}
+
+	for i := 0; i < accounts; i++ {
+		first := seedFirstNames[rng.Intn(len(seedFirstNames))]
+		last := seedLastNames[rng.Intn(len(seedLastNames))]
+		email := fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(first), strings.ToLower(last), i)
+		number := fmt.Sprintf("%010d", rng.Int63n(1e10))
+		opening := (1000 + rng.Intn(499000)) * 100
+
+		// Draw the transactions before any early exit so skipping an
+		// existing account does not shift the data of the ones after it.
+		type seedTx struct {
+			amount      int
+			description string
+		}
+		var history []seedTx
+		for n := 5 + rng.Intn(11); n > 0; n-- {
+			if rng.Intn(3) == 0 {
+				history = append(history, seedTx{(500 + rng.Intn(80000)) * 100, seedDeposits[rng.Intn(len(seedDeposits))]})
+			} else {
+				history = append(history, seedTx{-(50 + rng.Intn(20000)) * 100, seedDebits[rng.Intn(len(seedDebits))]})
+			}
+		}
+
+		if _, err := store.GetAccountByEmail(tenantID, email); err == nil {
+			summary.Skipped++
+			continue
+		}
+		acc, err := NewAccount(tenantID, email, seedPassword, first+" "+last, number, opening)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.CreateAccount(acc); err != nil {
+			return nil, fmt.Errorf("failed to seed account %s: %w", email, err)
+		}
+		summary.Accounts++
+
+		balance := opening
+		for _, t := range history {
+			if balance+t.amount < 0 {
+				continue
+			}
+			kind := entryDeposit
+			if t.amount < 0 {
+				kind = entryWithdrawal
+			}
+			entry := &ledgerEntry{AccountID: acc.ID, Amount: t.amount, Kind: kind, Description: t.description}
+			if err := store.PostLedgerEntries(entry); err != nil {
+				return nil, fmt.Errorf("failed to seed transactions for %s: %w", email, err)
+			}
+			balance = entry.BalanceAfter
+			summary.Transactions++
+		}
+	}
+	return summary, nil
+}
+
+// handleSeed seeds the caller's tenant. It is only available in development.
+func (s *Apiserver) handleSeed(w http.ResponseWriter, r *http.Request) error {
+	if s.cfg().Environment != envDevelopment {
+		return newAPIError(http.StatusForbidden, "dev_only")
+	}
+	req := SeedRequest{Seed: 1, Accounts: 20}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+	}
+	if req.Accounts <= 0 || req.Accounts > 1000 {
+		return newAPIError(http.StatusBadRequest, "seed_accounts_range")
+	}
+	summary, err := seedDatabase(s.store, requestTenant(r).ID, req.Seed, req.Accounts)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, summary)
+}
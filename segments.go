@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createSegmentsTable = `
+        CREATE TABLE IF NOT EXISTS segments (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            name TEXT NOT NULL,
+            filter JSONB NOT NULL,
+            created_by INT NOT NULL REFERENCES accounts(id),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (tenant_id, name)
+        )
+    `
+
+var errSegmentExists = errors.New("segment name already taken")
+
+// segmentFilter selects customers of a tenant. Every set field narrows the
+// selection; an empty filter is every customer.
+type segmentFilter struct {
+	Currency   string `json:"currency,omitempty"`
+	MinBalance *int   `json:"min_balance,omitempty"`
+	MaxBalance *int   `json:"max_balance,omitempty"`
+	// ActiveSince keeps customers active at or after the time, and
+	// InactiveSince those with no activity since it; see
+	// accountLastActivity. The day counts do the same relative to when the
+	// filter is evaluated, which suits saved segments.
+	ActiveSince   *time.Time `json:"active_since,omitempty"`
+	InactiveSince *time.Time `json:"inactive_since,omitempty"`
+	ActiveWithin  *int       `json:"active_within_days,omitempty"`
+	InactiveFor   *int       `json:"inactive_for_days,omitempty"`
+	NoLoginFor    *int       `json:"no_login_for_days,omitempty"`
+	Dormant       *bool      `json:"dormant,omitempty"`
+}
+
+// lastLogin is when the account, aliased a, last logged in from any device.
+const lastLogin = "(SELECT MAX(d.last_seen_at) FROM known_devices d WHERE d.account_id = a.id)"
+
+// where returns the SQL condition on accounts, aliased a, selecting the
+// filter as of now, numbering its placeholders from n.
+func (f segmentFilter) where(n int, now time.Time) (string, []any) {
+	conds := []string{"a.role = 'customer'"}
+	args := []any{}
+	add := func(cond string, arg any) {
+		conds = append(conds, strings.ReplaceAll(cond, "$?", fmt.Sprintf("$%d", n+len(args))))
+		args = append(args, arg)
+	}
+	daysAgo := func(days int) time.Time { return now.AddDate(0, 0, -days) }
+	if f.Currency != "" {
+		add("a.currency = $?", f.Currency)
+	}
+	if f.MinBalance != nil {
+		add("a.balance >= $?", *f.MinBalance)
+	}
+	if f.MaxBalance != nil {
+		add("a.balance <= $?", *f.MaxBalance)
+	}
+	if f.ActiveSince != nil {
+		add(accountLastActivity+" >= $?", *f.ActiveSince)
+	}
+	if f.InactiveSince != nil {
+		add(accountLastActivity+" < $?", *f.InactiveSince)
+	}
+	if f.ActiveWithin != nil {
+		add(accountLastActivity+" >= $?", daysAgo(*f.ActiveWithin))
+	}
+	if f.InactiveFor != nil {
+		add(accountLastActivity+" < $?", daysAgo(*f.InactiveFor))
+	}
+	if f.NoLoginFor != nil {
+		add("COALESCE("+lastLogin+" < $?, TRUE)", daysAgo(*f.NoLoginFor))
+	}
+	if f.Dormant != nil {
+		add("(a.dormant_at IS NOT NULL) = $?", *f.Dormant)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (f segmentFilter) validate() error {
+	for field, v := range map[string]*int{"active_within_days": f.ActiveWithin, "inactive_for_days": f.InactiveFor, "no_login_for_days": f.NoLoginFor} {
+		if v != nil && *v <= 0 {
+			return newAPIError(http.StatusBadRequest, "invalid_segment", field)
+		}
+	}
+	if f.MinBalance != nil && f.MaxBalance != nil && *f.MinBalance > *f.MaxBalance {
+		return newAPIError(http.StatusBadRequest, "invalid_segment", "min_balance")
+	}
+	return nil
+}
+
+// segment is a filter saved by admins under a name, evaluated afresh
+// whenever it is used.
+type segment struct {
+	ID        int           `json:"id"`
+	TenantID  int           `json:"tenant_id"`
+	Name      string        `json:"name"`
+	Filter    segmentFilter `json:"filter"`
+	CreatedBy int           `json:"created_by"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// segmentStats summarizes the customers a filter selects.
+type segmentStats struct {
+	Members      int `json:"members"`
+	TotalBalance int `json:"total_balance"`
+}
+
+// segmentMember is a customer in a segment.
+type segmentMember struct {
+	ID           int       `json:"id"`
+	Email        string    `json:"email"`
+	Name         string    `json:"name"`
+	Number       string    `json:"number"`
+	Balance      int       `json:"balance"`
+	Currency     string    `json:"currency"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+type SegmentRequest struct {
+	Name   string        `json:"name"`
+	Filter segmentFilter `json:"filter"`
+}
+
+// SegmentStorage holds the customer segment storage operations.
+type SegmentStorage interface {
+	CreateSegment(*segment) error
+	GetSegment(tenantID, id int) (*segment, error)
+	GetSegments(tenantID int) ([]*segment, error)
+	UpdateSegment(*segment) error
+	DeleteSegment(tenantID, id int) error
+	GetSegmentStats(tenantID int, f segmentFilter) (*segmentStats, error)
+	GetSegmentMembers(tenantID int, f segmentFilter, page pageRequest) ([]*segmentMember, error)
+}
+
+// CreateSegment stores a segment. It returns errSegmentExists if the
+// tenant already has a segment of that name.
+func (s *PostgresStorage) CreateSegment(seg *segment) error {
+	filter, err := json.Marshal(seg.Filter)
+	if err != nil {
+		return err
+	}
+	err = s.db.QueryRow(
+		"INSERT INTO segments (tenant_id, name, filter, created_by) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING id, created_at",
+		seg.TenantID, seg.Name, filter, seg.CreatedBy,
+	).Scan(&seg.ID, &seg.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errSegmentExists
+	}
+	return err
+}
+
+const selectSegments = "SELECT id, tenant_id, name, filter, created_by, created_at FROM segments "
+
+func scanSegment(row interface{ Scan(...any) error }) (*segment, error) {
+	seg := &segment{}
+	var filter []byte
+	if err := row.Scan(&seg.ID, &seg.TenantID, &seg.Name, &filter, &seg.CreatedBy, &seg.CreatedAt); err != nil {
+		return nil, err
+	}
+	return seg, json.Unmarshal(filter, &seg.Filter)
+}
+
+// GetSegment retrieves a segment of a tenant.
+func (s *PostgresStorage) GetSegment(tenantID, id int) (*segment, error) {
+	return scanSegment(s.db.QueryRow(selectSegments+"WHERE id = $1 AND tenant_id = $2", id, tenantID))
+}
+
+// GetSegments lists the tenant's segments by name.
+func (s *PostgresStorage) GetSegments(tenantID int) ([]*segment, error) {
+	rows, err := s.db.Query(selectSegments+"WHERE tenant_id = $1 ORDER BY name", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := make([]*segment, 0)
+	for rows.Next() {
+		seg, err := scanSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, rows.Err()
+}
+
+// UpdateSegment renames a segment or replaces its filter. It returns
+// sql.ErrNoRows if the tenant has no such segment and errSegmentExists if
+// the new name is taken.
+func (s *PostgresStorage) UpdateSegment(seg *segment) error {
+	filter, err := json.Marshal(seg.Filter)
+	if err != nil {
+		return err
+	}
+	var taken bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM segments WHERE tenant_id = $1 AND name = $2 AND id <> $3)", seg.TenantID, seg.Name, seg.ID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return errSegmentExists
+	}
+	return s.db.QueryRow(
+		"UPDATE segments SET name = $1, filter = $2 WHERE id = $3 AND tenant_id = $4 RETURNING created_by, created_at",
+		seg.Name, filter, seg.ID, seg.TenantID,
+	).Scan(&seg.CreatedBy, &seg.CreatedAt)
+}
+
+// DeleteSegment deletes a segment. Campaigns sent to it keep their copy of
+// its filter. It returns sql.ErrNoRows if the tenant has no such segment.
+func (s *PostgresStorage) DeleteSegment(tenantID, id int) error {
+	res, err := s.db.Exec("DELETE FROM segments WHERE id = $1 AND tenant_id = $2", id, tenantID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetSegmentStats counts the tenant's customers a filter selects and adds
+// up their balances.
+func (s *PostgresStorage) GetSegmentStats(tenantID int, f segmentFilter) (*segmentStats, error) {
+	cond, args := f.where(2, clock.Now())
+	stats := &segmentStats{}
+	err := s.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(a.balance), 0) FROM accounts a WHERE a.tenant_id = $1 AND "+cond,
+		append([]any{tenantID}, args...)...).Scan(&stats.Members, &stats.TotalBalance)
+	return stats, err
+}
+
+// GetSegmentMembers returns a page of the tenant's customers a filter
+// selects, in id order.
+func (s *PostgresStorage) GetSegmentMembers(tenantID int, f segmentFilter, page pageRequest) ([]*segmentMember, error) {
+	cond, args := f.where(2, clock.Now())
+	pageCond, order, pageArgs := page.keysetByID(2 + len(args))
+	rows, err := s.db.Query(
+		"SELECT a.id, a.email, a.name, a.number, a.balance, a.currency, "+accountLastActivity+" FROM accounts a WHERE a.tenant_id = $1 AND "+cond+" AND "+pageCond+" "+order,
+		append(append([]any{tenantID}, args...), pageArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*segmentMember, 0)
+	for rows.Next() {
+		m := &segmentMember{}
+		if err := rows.Scan(&m.ID, &m.Email, &m.Name, &m.Number, &m.Balance, &m.Currency, &m.LastActivity); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// segmentResponse is a segment with the current size of its membership.
+type segmentResponse struct {
+	*segment
+	Stats *segmentStats `json:"stats"`
+}
+
+// handleSegments lists the tenant's segments (GET) or saves a new one
+// (POST).
+func (s *Apiserver) handleSegments(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	if r.Method == "GET" {
+		segments, err := s.store.GetSegments(tenantID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, segments)
+	}
+
+	admin, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req, err := decodeSegmentRequest(r)
+	if err != nil {
+		return err
+	}
+	seg := &segment{TenantID: tenantID, Name: req.Name, Filter: req.Filter, CreatedBy: admin.ID}
+	if err := s.store.CreateSegment(seg); errors.Is(err, errSegmentExists) {
+		return newAPIError(http.StatusConflict, "segment_exists", seg.Name)
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, "segment.created", "segment", seg.ID, seg)
+	return s.writeSegment(w, http.StatusCreated, seg)
+}
+
+func decodeSegmentRequest(r *http.Request) (*SegmentRequest, error) {
+	req := &SegmentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if err := req.Filter.validate(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *Apiserver) writeSegment(w http.ResponseWriter, status int, seg *segment) error {
+	stats, err := s.store.GetSegmentStats(seg.TenantID, seg.Filter)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, status, &segmentResponse{segment: seg, Stats: stats})
+}
+
+// handleSegment shows a segment with its current size (GET), replaces its
+// name and filter (PUT) or deletes it (DELETE).
+func (s *Apiserver) handleSegment(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	tenantID := requestTenant(r).ID
+
+	switch r.Method {
+	case "PUT":
+		req, err := decodeSegmentRequest(r)
+		if err != nil {
+			return err
+		}
+		seg := &segment{ID: id, TenantID: tenantID, Name: req.Name, Filter: req.Filter}
+		err = s.store.UpdateSegment(seg)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return newAPIError(http.StatusNotFound, "segment_not_found", id)
+		case errors.Is(err, errSegmentExists):
+			return newAPIError(http.StatusConflict, "segment_exists", seg.Name)
+		case err != nil:
+			return err
+		}
+		s.audit(r, "segment.updated", "segment", id, seg)
+		return s.writeSegment(w, http.StatusOK, seg)
+	case "DELETE":
+		if err := s.store.DeleteSegment(tenantID, id); errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "segment_not_found", id)
+		} else if err != nil {
+			return err
+		}
+		s.audit(r, "segment.deleted", "segment", id, nil)
+		return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+	}
+
+	seg, err := s.store.GetSegment(tenantID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "segment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	return s.writeSegment(w, http.StatusOK, seg)
+}
+
+// handleSegmentMembers pages through the customers currently in a segment.
+func (s *Apiserver) handleSegmentMembers(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	seg, err := s.store.GetSegment(requestTenant(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "segment_not_found", id)
+	} else if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	stats, err := s.store.GetSegmentStats(seg.TenantID, seg.Filter)
+	if err != nil {
+		return err
+	}
+	members, err := s.store.GetSegmentMembers(seg.TenantID, seg.Filter, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(members, stats.Members, page, func(m *segmentMember) cursor { return cursor{ID: m.ID} }))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Browser clients can log in with "session": true to get their token in an
+// HttpOnly cookie instead of the response body. Cookies are sent by the
+// browser on its own, so every mutating request authenticated by the cookie
+// must echo the CSRF cookie in the X-CSRF-Token header (double submit): a
+// page on another origin can make the browser send cookies but cannot read
+// them.
+const (
+	sessionCookie = "bank_session"
+	csrfCookie    = "bank_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// bearerToken returns the token authenticating a request: the bearer token
+// of the Authorization header or else the session cookie.
+func bearerToken(r *http.Request) (token string, fromCookie bool) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		return strings.TrimPrefix(h, "Bearer "), false
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		return c.Value, true
+	}
+	return "", false
+}
+
+// csrfExempt lists the routes that start a session: a browser holding a
+// stale session cookie must still be able to log in again.
+var csrfExempt = map[string]bool{
+	"/login":         true,
+	"/login/verify":  true,
+	"/token/refresh": true,
+}
+
+// csrfMiddleware rejects mutating requests authenticated by the session
+// cookie unless they carry the matching CSRF token. Bearer token requests
+// are not exposed to CSRF and pass through.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, fromCookie := bearerToken(r); fromCookie && isMutating(r.Method) && !csrfExempt[r.URL.Path] {
+			c, err := r.Cookie(csrfCookie)
+			header := r.Header.Get(csrfHeader)
+			if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(header)) != 1 {
+				writeError(w, r, newAPIError(http.StatusForbidden, "csrf_failed"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeLogin answers a successful login with an access and a refresh token,
+// or for session logins with the session and CSRF cookies and the CSRF
+// token to send back. Sessions last as long as their access token and are
+// not refreshed.
+func (s *Apiserver) writeLogin(w http.ResponseWriter, r *http.Request, acc *account, t *tenant, session bool) error {
+	token, err := CreateToken(acc, t)
+	if err != nil {
+		return err
+	}
+	s.recordActivity(acc.ID, activityLogin)
+	if !session {
+		refresh, err := createRefreshToken(acc, t)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, LoginResponse{Token: token, RefreshToken: refresh})
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	csrf := hex.EncodeToString(b)
+	secure := r.TLS != nil || s.cfg().Environment == envProduction
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", MaxAge: int(tokenSettings.AccessTTL.Seconds()), HttpOnly: true, Secure: secure, SameSite: http.SameSiteStrictMode})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: csrf, Path: "/", MaxAge: int(tokenSettings.AccessTTL.Seconds()), Secure: secure, SameSite: http.SameSiteStrictMode})
+	return writeJSON(w, http.StatusOK, LoginResponse{CSRFToken: csrf})
+}
+
+// handleLogout ends a cookie session by expiring its cookies.
+func (s *Apiserver) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+	}
+	return writeJSON(w, http.StatusOK, map[string]bool{"logged_out": true})
+}
+
+// handleRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. The account is looked up again so a deleted account or
+// a changed role is picked up.
+func (s *Apiserver) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	req := RefreshTokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	t := requestTenant(r)
+	claims, err := verifyRefreshToken(req.RefreshToken, t.JWTAudience)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, "invalid_token")
+	}
+	sub, _ := claims.GetSubject()
+	id, err := strconv.Atoi(sub)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, "invalid_token")
+	}
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != t.ID {
+		return newAPIError(http.StatusUnauthorized, "invalid_token")
+	}
+	return s.writeLogin(w, r, acc, t, false)
+}
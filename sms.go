@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Text messages sent to account holders are recorded with the status their
+// provider last reported, and every status callback is kept beside them.
+// Message bodies are not stored, as they may hold codes.
+const createSMSMessagesTable = `
+        CREATE TABLE IF NOT EXISTS sms_messages (
+            id SERIAL PRIMARY KEY,
+            account_id INT REFERENCES accounts(id) ON DELETE CASCADE,
+            to_number TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            provider TEXT NOT NULL,
+            provider_id TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL,
+            error_code TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createSMSStatusCallbacksTable = `
+        CREATE TABLE IF NOT EXISTS sms_status_callbacks (
+            id SERIAL PRIMARY KEY,
+            message_id INT NOT NULL REFERENCES sms_messages(id) ON DELETE CASCADE,
+            status TEXT NOT NULL,
+            error_code TEXT NOT NULL DEFAULT '',
+            received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Statuses of a text message. Providers report their own, such as Twilio's
+// "delivered" and "undelivered"; these are the ones the server sets.
+const (
+	smsQueued = "queued"
+	smsSent   = "sent"
+	smsFailed = "failed"
+)
+
+// smsFinalStatuses are not replaced by statuses reported out of order
+// after them.
+var smsFinalStatuses = []string{"delivered", "undelivered", "failed"}
+
+const twilioAPIURL = "https://api.twilio.com"
+
+// smsMessage is a text message sent to an account holder.
+type smsMessage struct {
+	ID         int       `json:"id"`
+	AccountID  int       `json:"account_id"`
+	To         string    `json:"to"`
+	Kind       string    `json:"kind"`
+	Provider   string    `json:"provider"`
+	ProviderID string    `json:"provider_id,omitempty"`
+	Status     string    `json:"status"`
+	ErrorCode  string    `json:"error_code,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SMSSender sends text messages and returns the provider's ID of the
+// message, if it has one.
+type SMSSender interface {
+	Provider() string
+	SendSMS(to, body string) (string, error)
+}
+
+// SMSStorage holds the text message storage operations.
+type SMSStorage interface {
+	CreateSMSMessage(*smsMessage) error
+	UpdateSMSMessage(*smsMessage) error
+	// RecordSMSStatus records a status callback for the provider's message
+	// and returns sql.ErrNoRows if there is no such message.
+	RecordSMSStatus(provider, providerID, status, errorCode string, now time.Time) error
+	GetSMSMessages(accountID int) ([]*smsMessage, error)
+}
+
+func (s *PostgresStorage) CreateSMSMessage(m *smsMessage) error {
+	return s.db.QueryRow(
+		"INSERT INTO sms_messages (account_id, to_number, kind, provider, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $6) RETURNING id",
+		m.AccountID, m.To, m.Kind, m.Provider, m.Status, m.CreatedAt,
+	).Scan(&m.ID)
+}
+
+func (s *PostgresStorage) UpdateSMSMessage(m *smsMessage) error {
+	_, err := s.db.Exec(
+		"UPDATE sms_messages SET provider_id = $2, status = $3, error_code = $4, updated_at = $5 WHERE id = $1",
+		m.ID, m.ProviderID, m.Status, m.ErrorCode, m.UpdatedAt,
+	)
+	return err
+}
+
+func (s *PostgresStorage) RecordSMSStatus(provider, providerID, status, errorCode string, now time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	var current string
+	err = tx.QueryRow(
+		"SELECT id, status FROM sms_messages WHERE provider = $1 AND provider_id = $2 FOR UPDATE",
+		provider, providerID,
+	).Scan(&id, &current)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO sms_status_callbacks (message_id, status, error_code, received_at) VALUES ($1, $2, $3, $4)", id, status, errorCode, now); err != nil {
+		return err
+	}
+	if !slices.Contains(smsFinalStatuses, current) {
+		if _, err := tx.Exec("UPDATE sms_messages SET status = $2, error_code = $3, updated_at = $4 WHERE id = $1", id, status, errorCode, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) GetSMSMessages(accountID int) ([]*smsMessage, error) {
+	rows, err := s.db.Query(`
+        SELECT id, account_id, to_number, kind, provider, provider_id, status, error_code, created_at, updated_at
+        FROM sms_messages WHERE account_id = $1 ORDER BY id DESC LIMIT 100`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*smsMessage, 0)
+	for rows.Next() {
+		m := &smsMessage{}
+		if err := rows.Scan(&m.ID, &m.AccountID, &m.To, &m.Kind, &m.Provider, &m.ProviderID, &m.Status, &m.ErrorCode, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// consoleSMSSender prints text messages to the server log, for local
+// development.
+type consoleSMSSender struct{}
+
+func (consoleSMSSender) Provider() string { return "console" }
+
+func (consoleSMSSender) SendSMS(to, body string) (string, error) {
+	logf("sms to %s: %s\n", to, body)
+	return "", nil
+}
+
+// twilioSMSSender sends text messages through Twilio's Messages API.
+type twilioSMSSender struct {
+	baseURL        string
+	accountSID     string
+	authToken      string
+	from           string
+	statusCallback string
+	client         *outboundClient
+}
+
+func newTwilioSMSSender(cfg *Config) *twilioSMSSender {
+	return &twilioSMSSender{
+		baseURL:        twilioAPIURL,
+		accountSID:     cfg.TwilioAccountSID,
+		authToken:      cfg.TwilioAuthToken,
+		from:           cfg.SMSSenderID,
+		statusCallback: cfg.SMSStatusCallbackURL,
+		// Creating a message is not idempotent, so a timed-out send is
+		// never retried: it may already have gone out.
+		client: newOutboundClient(10*time.Second, 1),
+	}
+}
+
+func (t *twilioSMSSender) Provider() string { return "twilio" }
+
+func (t *twilioSMSSender) SendSMS(to, body string) (string, error) {
+	form := url.Values{"To": {to}, "From": {t.from}, "Body": {body}}
+	if t.statusCallback != "" {
+		form.Set("StatusCallback", t.statusCallback)
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", t.baseURL, url.PathEscape(t.accountSID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(t.accountSID, t.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		SID     string `json:"sid"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("twilio: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("twilio: %s: error %d: %s", resp.Status, result.Code, result.Message)
+	}
+	return result.SID, nil
+}
+
+// twilioSignature is the X-Twilio-Signature of a callback to callbackURL
+// with the form params: the base64 HMAC-SHA1, keyed with the auth token,
+// of the URL followed by each param name and value in name order.
+func twilioSignature(authToken, callbackURL string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var b strings.Builder
+	b.WriteString(callbackURL)
+	for _, k := range keys {
+		for _, v := range params[k] {
+			b.WriteString(k + v)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSMSSender returns the sender SMSProvider names, or nil if it names
+// none.
+func newSMSSender(cfg *Config) SMSSender {
+	switch cfg.SMSProvider {
+	case "twilio":
+		return newTwilioSMSSender(cfg)
+	case "console":
+		return consoleSMSSender{}
+	}
+	return nil
+}
+
+// sendSMS texts body to the phone of acc, recording the message as kind.
+func (s *Apiserver) sendSMS(acc *account, kind, body string) error {
+	m := &smsMessage{AccountID: acc.ID, To: acc.Phone, Kind: kind, Provider: s.sms.Provider(), Status: smsQueued, CreatedAt: clock.Now()}
+	if err := s.store.CreateSMSMessage(m); err != nil {
+		return err
+	}
+	providerID, sendErr := s.sms.SendSMS(acc.Phone, body)
+	m.ProviderID, m.Status, m.UpdatedAt = providerID, smsSent, clock.Now()
+	if sendErr != nil {
+		m.Status = smsFailed
+	}
+	if err := s.store.UpdateSMSMessage(m); err != nil {
+		logf("failed to record sms %d: %v\n", m.ID, err)
+	}
+	return sendErr
+}
+
+// smsOTPSender texts codes to account holders with a phone number and
+// leaves the rest to fallback.
+type smsOTPSender struct {
+	s        *Apiserver
+	fallback OTPSender
+}
+
+func (o smsOTPSender) SendOTP(acc *account, code string) error {
+	if acc.Phone == "" {
+		return o.fallback.SendOTP(acc, code)
+	}
+	return o.s.sendSMS(acc, "login_code", translate(accountLanguage(acc), "sms_login_code", code, int(challengeTTL.Minutes())))
+}
+
+// handleTwilioStatus records a delivery status Twilio reports for a text
+// message. Callbacks must carry Twilio's signature of the configured
+// callback URL.
+func (s *Apiserver) handleTwilioStatus(w http.ResponseWriter, r *http.Request) error {
+	cfg := s.cfg()
+	if cfg.SMSProvider != "twilio" || cfg.SMSStatusCallbackURL == "" {
+		return newAPIError(http.StatusNotFound, "sms_callbacks_disabled")
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	want := twilioSignature(cfg.TwilioAuthToken, cfg.SMSStatusCallbackURL, r.PostForm)
+	if !hmac.Equal([]byte(r.Header.Get("X-Twilio-Signature")), []byte(want)) {
+		return newAPIError(http.StatusForbidden, "invalid_signature")
+	}
+	sid, status := r.PostForm.Get("MessageSid"), r.PostForm.Get("MessageStatus")
+	if sid == "" || status == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "MessageSid and MessageStatus")
+	}
+	err := s.store.RecordSMSStatus("twilio", sid, status, r.PostForm.Get("ErrorCode"), clock.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, "sms_not_found", sid)
+	} else if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleSMSMessages lists the latest text messages sent to the account in
+// ?account_id=, with their delivery status.
+func (s *Apiserver) handleSMSMessages(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.URL.Query().Get("account_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "required_field", "account_id")
+	}
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil || acc.TenantID != requestTenant(r).ID {
+		return newAPIError(http.StatusNotFound, "account_not_found", id)
+	}
+	messages, err := s.store.GetSMSMessages(id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, messages)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const createBalanceSnapshotsTable = `
+        CREATE TABLE IF NOT EXISTS balance_snapshots (
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            taken_at TIMESTAMPTZ NOT NULL,
+            balance INT NOT NULL,
+            PRIMARY KEY (account_id, taken_at)
+        )
+    `
+
+// balanceAsOf selects the balance of each account a at time $1: the latest
+// snapshot at or before $1 plus the ledger entries posted since it. Without
+// a snapshot the whole ledger of the account is summed.
+const balanceAsOf = `
+        COALESCE(p.balance, 0) + COALESCE((
+            SELECT SUM(l.amount) FROM ledger_entries l
+            WHERE l.account_id = a.id AND l.created_at > COALESCE(p.taken_at, '-infinity') AND l.created_at <= $1
+        ), 0)
+        FROM accounts a LEFT JOIN LATERAL (
+            SELECT balance, taken_at FROM balance_snapshots
+            WHERE account_id = a.id AND taken_at <= $1 ORDER BY taken_at DESC LIMIT 1
+        ) p ON true `
+
+// BalanceAt is the balance of an account at a point in time.
+type BalanceAt struct {
+	AccountID        int       `json:"account_id"`
+	At               time.Time `json:"at"`
+	Balance          int       `json:"balance"`
+	Currency         string    `json:"currency"`
+	BalanceFormatted string    `json:"balance_formatted,omitempty"`
+}
+
+func (b *BalanceAt) formatMoney(locale string) {
+	b.BalanceFormatted = formatMoney(b.Balance, b.Currency, locale)
+}
+
+// SnapshotStorage holds the balance snapshot storage operations.
+type SnapshotStorage interface {
+	SnapshotBalances(at time.Time) (int, error)
+	GetBalanceAt(accountID int, at time.Time) (int, error)
+}
+
+// SnapshotBalances records the balance of every account at a past time,
+// building on each account's previous snapshot. Existing snapshots are kept.
+// It returns the number of snapshots taken.
+func (s *PostgresStorage) SnapshotBalances(at time.Time) (int, error) {
+	res, err := s.db.Exec(`
+        INSERT INTO balance_snapshots (account_id, taken_at, balance)
+        SELECT a.id, $1, `+balanceAsOf+`
+        ON CONFLICT DO NOTHING`,
+		at,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// GetBalanceAt returns the balance of an account at a time.
+func (s *PostgresStorage) GetBalanceAt(accountID int, at time.Time) (int, error) {
+	var balance int
+	err := s.db.QueryRow("SELECT "+balanceAsOf+"WHERE a.id = $2", at, accountID).Scan(&balance)
+	return balance, err
+}
+
+// runBalanceSnapshots snapshots every balance as of the start of the current
+// day (UTC). Entries from before midnight have long been committed by the
+// time the job runs, so the snapshot never misses a late commit.
+func (s *Apiserver) runBalanceSnapshots() {
+	midnight := clock.Now().UTC().Truncate(24 * time.Hour)
+	if _, err := s.store.SnapshotBalances(midnight); err != nil {
+		logf("balance snapshots: failed for %s: %v\n", midnight.Format(time.DateOnly), err)
+	}
+}
+
+// startBalanceSnapshotJob takes the daily balance snapshots in the background,
+// checking on a fixed interval. A zero interval disables the job.
+func (s *Apiserver) startBalanceSnapshotJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.runBalanceSnapshots()
+		}
+	}()
+}
+
+// handleBalanceAt returns the balance of an account at ?at= (RFC 3339), or
+// now when it is left out.
+func (s *Apiserver) handleBalanceAt(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.authorizedAccount(r)
+	if err != nil {
+		return err
+	}
+	at := clock.Now().UTC()
+	if v := r.URL.Query().Get("at"); v != "" {
+		if at, err = time.Parse(time.RFC3339, v); err != nil {
+			return newAPIError(http.StatusBadRequest, "invalid_timestamp", v)
+		}
+	}
+	balance, err := s.store.GetBalanceAt(acc.ID, at)
+	if err != nil {
+		return err
+	}
+	return s.writeLocalizedJSON(w, r, http.StatusOK, &BalanceAt{AccountID: acc.ID, At: at, Balance: balance, Currency: acc.Currency})
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createSplitRequestsTable = `
+        CREATE TABLE IF NOT EXISTS split_requests (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            requester_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            reference TEXT NOT NULL DEFAULT '',
+            description TEXT NOT NULL DEFAULT '',
+            amount INT NOT NULL,
+            currency TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createSplitSharesTable = `
+        CREATE TABLE IF NOT EXISTS split_shares (
+            id SERIAL PRIMARY KEY,
+            split_id INT NOT NULL REFERENCES split_requests(id) ON DELETE CASCADE,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL,
+            pay_token TEXT UNIQUE NOT NULL,
+            transfer_id INT REFERENCES transfers(id),
+            paid_at TIMESTAMPTZ
+        )
+    `
+
+// maxSplitParticipants caps the friends a bill can be split with.
+const maxSplitParticipants = 20
+
+var errSharePaid = errors.New("split share has already been paid")
+
+// splitRequest asks friends to pay their share of an expense. The amount is
+// split equally between the requester and every participant; the requester
+// absorbs any remainder.
+type splitRequest struct {
+	ID          int           `json:"id"`
+	TenantID    int           `json:"tenant_id"`
+	RequesterID int           `json:"requester_id"`
+	Reference   string        `json:"reference,omitempty"`
+	Description string        `json:"description"`
+	Amount      int           `json:"amount"`
+	Currency    string        `json:"currency"`
+	Shares      []*splitShare `json:"shares"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// splitShare is what one participant owes. PayToken identifies the share in
+// its pay link and is only shown to that participant.
+type splitShare struct {
+	ID         int        `json:"id"`
+	SplitID    int        `json:"split_id"`
+	AccountID  int        `json:"account_id"`
+	Amount     int        `json:"amount"`
+	PayToken   string     `json:"pay_token,omitempty"`
+	TransferID *int       `json:"transfer_id,omitempty"`
+	PaidAt     *time.Time `json:"paid_at,omitempty"`
+}
+
+type SplitParticipant struct {
+	Email  string `json:"email"`
+	Number string `json:"number"`
+}
+
+type CreateSplitRequest struct {
+	Amount       int                `json:"amount"`
+	Reference    string             `json:"reference"`
+	Description  string             `json:"description"`
+	Participants []SplitParticipant `json:"participants"`
+}
+
+// SplitStorage holds the expense splitting storage operations.
+type SplitStorage interface {
+	CreateSplitRequest(*splitRequest) error
+	GetSplitRequest(id int) (*splitRequest, error)
+	GetSplitRequestsByRequester(accountID int, page pageRequest) ([]*splitRequest, int, error)
+	GetSplitShareByToken(token string) (*splitShare, error)
+	PaySplitShare(shareID int, t *transfer) error
+}
+
+// CreateSplitRequest inserts a split request with its shares.
+func (s *PostgresStorage) CreateSplitRequest(sr *splitRequest) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO split_requests (tenant_id, requester_id, reference, description, amount, currency) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		sr.TenantID, sr.RequesterID, sr.Reference, sr.Description, sr.Amount, sr.Currency,
+	).Scan(&sr.ID, &sr.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, share := range sr.Shares {
+		share.SplitID = sr.ID
+		err := tx.QueryRow(
+			"INSERT INTO split_shares (split_id, account_id, amount, pay_token) VALUES ($1, $2, $3, $4) RETURNING id",
+			share.SplitID, share.AccountID, share.Amount, share.PayToken,
+		).Scan(&share.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const selectSplitRequests = "SELECT id, tenant_id, requester_id, reference, description, amount, currency, created_at FROM split_requests "
+
+// GetSplitRequest retrieves a split request with its shares.
+func (s *PostgresStorage) GetSplitRequest(id int) (*splitRequest, error) {
+	requests, err := s.querySplitRequests("WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return requests[0], nil
+}
+
+// GetSplitRequestsByRequester returns a page of the split requests an
+// account made, newest first, and their total count.
+func (s *PostgresStorage) GetSplitRequestsByRequester(accountID int, page pageRequest) ([]*splitRequest, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM split_requests WHERE requester_id = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	requests, err := s.querySplitRequests("WHERE requester_id = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return requests, total, err
+}
+
+// querySplitRequests loads split requests and, in one more query, their shares.
+func (s *PostgresStorage) querySplitRequests(where string, args ...any) ([]*splitRequest, error) {
+	rows, err := s.db.Query(selectSplitRequests+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make([]*splitRequest, 0)
+	byID := map[int]*splitRequest{}
+	ids := []int{}
+	for rows.Next() {
+		sr := &splitRequest{Shares: []*splitShare{}}
+		if err := rows.Scan(&sr.ID, &sr.TenantID, &sr.RequesterID, &sr.Reference, &sr.Description, &sr.Amount, &sr.Currency, &sr.CreatedAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, sr)
+		byID[sr.ID] = sr
+		ids = append(ids, sr.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return requests, nil
+	}
+
+	shareRows, err := s.db.Query("SELECT id, split_id, account_id, amount, pay_token, transfer_id, paid_at FROM split_shares WHERE split_id = ANY($1) ORDER BY id", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer shareRows.Close()
+	for shareRows.Next() {
+		share, err := scanSplitShare(shareRows)
+		if err != nil {
+			return nil, err
+		}
+		byID[share.SplitID].Shares = append(byID[share.SplitID].Shares, share)
+	}
+	return requests, shareRows.Err()
+}
+
+func scanSplitShare(row interface{ Scan(...any) error }) (*splitShare, error) {
+	share := &splitShare{}
+	var transferID sql.NullInt64
+	if err := row.Scan(&share.ID, &share.SplitID, &share.AccountID, &share.Amount, &share.PayToken, &transferID, &share.PaidAt); err != nil {
+		return nil, err
+	}
+	if transferID.Valid {
+		id := int(transferID.Int64)
+		share.TransferID = &id
+	}
+	return share, nil
+}
+
+// GetSplitShareByToken retrieves a share by the token of its pay link.
+func (s *PostgresStorage) GetSplitShareByToken(token string) (*splitShare, error) {
+	return scanSplitShare(s.db.QueryRow("SELECT id, split_id, account_id, amount, pay_token, transfer_id, paid_at FROM split_shares WHERE pay_token = $1", token))
+}
+
+// PaySplitShare makes the transfer paying a share and marks it paid, all or
+// nothing; a share can only ever be paid once.
+func (s *PostgresStorage) PaySplitShare(shareID int, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var paidAt *time.Time
+	if err := tx.QueryRow("SELECT paid_at FROM split_shares WHERE id = $1 FOR UPDATE", shareID).Scan(&paidAt); err != nil {
+		return err
+	}
+	if paidAt != nil {
+		return errSharePaid
+	}
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE split_shares SET paid_at = now(), transfer_id = $1 WHERE id = $2", t.ID, shareID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitPayLink is the path a participant calls to pay their share.
+func splitPayLink(token string) string {
+	return "/split-requests/pay/" + token
+}
+
+// resolveParticipant finds a participant's account by email or account number.
+func (s *Apiserver) resolveParticipant(tenantID int, p SplitParticipant) (*account, error) {
+	switch {
+	case p.Email != "":
+		acc, err := s.store.GetAccountByEmail(tenantID, p.Email)
+		if err != nil {
+			return nil, newAPIError(http.StatusNotFound, "participant_not_found", p.Email)
+		}
+		return acc, nil
+	case p.Number != "":
+		acc, err := s.store.GetAccountByNumber(tenantID, p.Number)
+		if errors.Is(err, errAmbiguousNumber) {
+			return nil, newAPIError(http.StatusBadRequest, "ambiguous_account_number", p.Number)
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusNotFound, "participant_not_found", p.Number)
+		}
+		return acc, nil
+	}
+	return nil, newAPIError(http.StatusBadRequest, "required_field", "participant email or number")
+}
+
+// handleSplitRequests lists the caller's split requests (GET) or splits an
+// expense with friends (POST), notifying each with a link to pay.
+func (s *Apiserver) handleSplitRequests(w http.ResponseWriter, r *http.Request) error {
+	requester, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		requests, total, err := s.store.GetSplitRequestsByRequester(requester.ID, page)
+		if err != nil {
+			return err
+		}
+		for _, sr := range requests {
+			hidePayTokens(sr, requester.ID)
+		}
+		return writeJSON(w, http.StatusOK, paginate(requests, total, page, func(sr *splitRequest) cursor { return cursor{sr.CreatedAt, sr.ID} }))
+	}
+
+	req := CreateSplitRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if len(req.Participants) == 0 || len(req.Participants) > maxSplitParticipants {
+		return newAPIError(http.StatusBadRequest, "split_participants_range", maxSplitParticipants)
+	}
+	if req.Reference != "" {
+		t, err := s.store.GetTransferByReference(requester.TenantID, req.Reference)
+		if err != nil || (t.FromAccountID != requester.ID && t.ToAccountID != requester.ID) {
+			return newAPIError(http.StatusNotFound, "transfer_not_found", req.Reference)
+		}
+		if req.Amount == 0 {
+			req.Amount = t.Amount
+		}
+	}
+
+	sr := &splitRequest{
+		TenantID:    requester.TenantID,
+		RequesterID: requester.ID,
+		Reference:   req.Reference,
+		Description: strings.TrimSpace(req.Description),
+		Amount:      req.Amount,
+		Currency:    requester.Currency,
+	}
+	share := req.Amount / (len(req.Participants) + 1)
+	if share <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	seen := map[int]bool{requester.ID: true}
+	for _, p := range req.Participants {
+		acc, err := s.resolveParticipant(requester.TenantID, p)
+		if err != nil {
+			return err
+		}
+		if seen[acc.ID] {
+			return newAPIError(http.StatusBadRequest, "duplicate_participant", acc.ID)
+		}
+		seen[acc.ID] = true
+		if acc.Currency != requester.Currency {
+			return newAPIError(http.StatusBadRequest, "currency_mismatch", requester.Currency, acc.Currency)
+		}
+		token, err := newPayToken()
+		if err != nil {
+			return err
+		}
+		sr.Shares = append(sr.Shares, &splitShare{AccountID: acc.ID, Amount: share, PayToken: token})
+	}
+	if err := s.store.CreateSplitRequest(sr); err != nil {
+		return err
+	}
+
+	for _, share := range sr.Shares {
+		s.notify(share.AccountID, "split_request", fmt.Sprintf("%s asked you to pay %s for %q. Pay: POST %s",
+			requester.Name, formatMoney(share.Amount, sr.Currency, defaultLocale), sr.Description, splitPayLink(share.PayToken)))
+	}
+	hidePayTokens(sr, requester.ID)
+	return writeJSON(w, http.StatusCreated, sr)
+}
+
+// handleGetSplitRequest returns a split request to its requester or a participant.
+func (s *Apiserver) handleGetSplitRequest(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	sr, err := s.store.GetSplitRequest(id)
+	if err != nil || !splitParty(sr, caller.ID) {
+		return newAPIError(http.StatusNotFound, "split_request_not_found", id)
+	}
+	hidePayTokens(sr, caller.ID)
+	return writeJSON(w, http.StatusOK, sr)
+}
+
+// handlePaySplitShare pays the caller's share through its pay link.
+func (s *Apiserver) handlePaySplitShare(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	share, err := s.store.GetSplitShareByToken(r.PathValue("token"))
+	if err != nil || share.AccountID != caller.ID {
+		return newAPIError(http.StatusNotFound, "split_share_not_found")
+	}
+	if share.PaidAt != nil {
+		return newAPIError(http.StatusConflict, "split_already_paid")
+	}
+	sr, err := s.store.GetSplitRequest(share.SplitID)
+	if err != nil {
+		return err
+	}
+
+	t, err := s.newTransfer(caller, sr.RequesterID, share.Amount, "Split: "+sr.Description)
+	if err != nil {
+		return err
+	}
+	if err := s.checkTrustedPayee(caller.ID, sr.RequesterID); err != nil {
+		return err
+	}
+	if err := s.checkCosignerThreshold(caller.ID, t.Amount); err != nil {
+		return err
+	}
+	if err := s.store.PaySplitShare(share.ID, t); errors.Is(err, errSharePaid) {
+		return newAPIError(http.StatusConflict, "split_already_paid")
+	} else if err != nil {
+		return transferFailed(err)
+	}
+	s.transferCompleted(t)
+	s.notify(sr.RequesterID, "split_paid", fmt.Sprintf("%s paid their share of %q", caller.Name, sr.Description))
+	return writeJSON(w, http.StatusOK, t)
+}
+
+func splitParty(sr *splitRequest, accountID int) bool {
+	if sr.RequesterID == accountID {
+		return true
+	}
+	for _, share := range sr.Shares {
+		if share.AccountID == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// hidePayTokens blanks the pay tokens of every share not owed by accountID.
+func hidePayTokens(sr *splitRequest, accountID int) {
+	for _, share := range sr.Shares {
+		if share.AccountID != accountID {
+			share.PayToken = ""
+		}
+	}
+}
+
+func newPayToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
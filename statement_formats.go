@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats transaction history is exported in: a spreadsheet, or files the
+// desktop accounting tools like GnuCash and Quicken import.
+const (
+	exportCSV = "csv"
+	exportOFX = "ofx"
+	exportQIF = "qif"
+)
+
+var exportFormats = []string{exportCSV, exportOFX, exportQIF}
+
+var exportContentTypes = map[string]string{
+	exportCSV: "text/csv",
+	exportOFX: "application/x-ofx",
+	exportQIF: "application/qif",
+}
+
+// statement is the transactions of an account over a period, as exported.
+type statement struct {
+	Account *account
+	Entries []*ledgerEntry // newest first
+	From    *time.Time
+	To      time.Time
+}
+
+// encodeStatement writes the statement in the export format.
+func encodeStatement(format string, st *statement) ([]byte, error) {
+	switch format {
+	case exportOFX:
+		return encodeOFX(st), nil
+	case exportQIF:
+		return encodeQIF(st), nil
+	}
+	records := [][]string{{"date", "reference", "kind", "description", "counterparty", "category", "amount", "balance_after", "note", "tags"}}
+	for _, e := range st.Entries {
+		records = append(records, exportRecord(e, accountLocation(st.Account)))
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.WriteAll(records)
+	return buf.Bytes(), cw.Error()
+}
+
+// statementFilename names the export of an account's statement up to a
+// time, dated in the holder's time zone. A masked number only shows its
+// last digits.
+func statementFilename(format string, acc *account, to time.Time) string {
+	return fmt.Sprintf("transactions-%s-%s.%s", strings.TrimLeft(acc.Number, "*"), localDate(acc, to), format)
+}
+
+// formatDecimalAmount writes minor units in major units, like "-1234.50",
+// as accounting files expect.
+func formatDecimalAmount(minorUnits int, currencyCode string) string {
+	exponent := 2
+	if cur, ok := currencies[currencyCode]; ok {
+		exponent = cur.Exponent
+	}
+	sign := ""
+	if minorUnits < 0 {
+		sign, minorUnits = "-", -minorUnits
+	}
+	if exponent == 0 {
+		return sign + strconv.Itoa(minorUnits)
+	}
+	digits := fmt.Sprintf("%0*d", exponent+1, minorUnits)
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+// payeeOf is who an exported transaction was with: its enriched
+// counterparty, or failing that its description.
+func payeeOf(e *ledgerEntry) string {
+	if e.Enrichment != nil {
+		return cmp.Or(e.Enrichment.Counterparty, e.Description)
+	}
+	return e.Description
+}
+
+var ofxEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", " ", "\n", " ")
+
+const ofxTime = "20060102150405"
+
+// encodeOFX writes the statement as an OFX 1.02 bank statement, the SGML
+// flavour every desktop tool reads. Transactions are identified by their
+// ledger entry ID so importing overlapping statements skips duplicates.
+func encodeOFX(st *statement) []byte {
+	acc := st.Account
+	var b strings.Builder
+	b.WriteString("OFXHEADER:100\r\nDATA:OFXSGML\r\nVERSION:102\r\nSECURITY:NONE\r\nENCODING:UTF-8\r\nCHARSET:NONE\r\nCOMPRESSION:NONE\r\nOLDFILEUID:NONE\r\nNEWFILEUID:NONE\r\n\r\n")
+	b.WriteString("<OFX>\n<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS>")
+	fmt.Fprintf(&b, "<DTSERVER>%s<LANGUAGE>ENG</SONRS></SIGNONMSGSRSV1>\n", clock.Now().UTC().Format(ofxTime))
+	b.WriteString("<BANKMSGSRSV1><STMTTRNRS><TRNUID>0<STATUS><CODE>0<SEVERITY>INFO</STATUS>\n<STMTRS>")
+	fmt.Fprintf(&b, "<CURDEF>%s<BANKACCTFROM><BANKID>%d<ACCTID>%s<ACCTTYPE>CHECKING</BANKACCTFROM>\n", acc.Currency, acc.TenantID, ofxEscaper.Replace(acc.Number))
+
+	start := st.To
+	if st.From != nil {
+		start = *st.From
+	} else if n := len(st.Entries); n > 0 {
+		start = st.Entries[n-1].CreatedAt
+	}
+	fmt.Fprintf(&b, "<BANKTRANLIST><DTSTART>%s<DTEND>%s\n", start.UTC().Format(ofxTime), st.To.UTC().Format(ofxTime))
+	for i := len(st.Entries) - 1; i >= 0; i-- {
+		e := st.Entries[i]
+		trnType := "CREDIT"
+		if e.Amount < 0 {
+			trnType = "DEBIT"
+		}
+		name := []rune(payeeOf(e))
+		if len(name) > 32 {
+			name = name[:32]
+		}
+		fmt.Fprintf(&b, "<STMTTRN><TRNTYPE>%s<DTPOSTED>%s<TRNAMT>%s<FITID>%d<NAME>%s<MEMO>%s</STMTTRN>\n",
+			trnType, e.CreatedAt.UTC().Format(ofxTime), formatDecimalAmount(e.Amount, acc.Currency), e.ID,
+			ofxEscaper.Replace(string(name)), ofxEscaper.Replace(e.Description))
+	}
+	b.WriteString("</BANKTRANLIST>")
+
+	balance, balanceAt := acc.Balance, st.To
+	if len(st.Entries) > 0 {
+		balance, balanceAt = st.Entries[0].BalanceAfter, st.Entries[0].CreatedAt
+	}
+	fmt.Fprintf(&b, "<LEDGERBAL><BALAMT>%s<DTASOF>%s</LEDGERBAL>\n", formatDecimalAmount(balance, acc.Currency), balanceAt.UTC().Format(ofxTime))
+	b.WriteString("</STMTRS></STMTTRNRS></BANKMSGSRSV1>\n</OFX>\n")
+	return []byte(b.String())
+}
+
+// encodeQIF writes the statement as a QIF bank register, oldest first,
+// dated month first as Quicken expects and in the holder's time zone. The category of each transaction
+// is its enriched one, so imports land in matching accounts.
+func encodeQIF(st *statement) []byte {
+	var b strings.Builder
+	loc := accountLocation(st.Account)
+	b.WriteString("!Type:Bank\n")
+	for i := len(st.Entries) - 1; i >= 0; i-- {
+		e := st.Entries[i]
+		fmt.Fprintf(&b, "D%s\nT%s\n", e.CreatedAt.In(loc).Format("01/02/2006"), formatDecimalAmount(e.Amount, st.Account.Currency))
+		if e.Reference != "" {
+			fmt.Fprintf(&b, "N%s\n", qifLine(e.Reference))
+		}
+		fmt.Fprintf(&b, "P%s\nM%s\n", qifLine(payeeOf(e)), qifLine(cmp.Or(e.Note, e.Description)))
+		if e.Enrichment != nil && e.Enrichment.Category != "" {
+			fmt.Fprintf(&b, "L%s\n", qifLine(e.Enrichment.Category))
+		}
+		b.WriteString("^\n")
+	}
+	return []byte(b.String())
+}
+
+// qifLine keeps a value on its line of a QIF record.
+func qifLine(v string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+}
+
+// writeStatement sends the statement as a file download, redacted for the
+// caller as writeJSON would.
+func writeStatement(w http.ResponseWriter, format string, st *statement) error {
+	redactAccounts(st, responseViewer(w))
+	data, err := encodeStatement(format, st)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", statementFilename(format, st.Account, st.To)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
+
+// validateExportFormat checks format is one history is exported in.
+func validateExportFormat(format string) error {
+	if !slices.Contains(exportFormats, format) {
+		return newAPIError(http.StatusBadRequest, "invalid_export_format", format, strings.Join(exportFormats, ", "))
+	}
+	return nil
+}
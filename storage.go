@@ -2,21 +2,103 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Storage interface for account storage operations.
 type Storage interface {
-	CheckAuth(string, string) error
+	CheckAuth(int, string, string) error
 	CreateAccount(*account) error
 	DeleteAccount(int) error
 	UpdateAccount(*account) error
 	GetAccountByID(int) (*account, error)
-	GetUsers() ([]*account, error)
+	// GetAccountContact is GetAccountByID with the holder's email, phone
+	// and locale, for messages sent to them.
+	GetAccountContact(id int) (*account, error)
+	GetAccountsByIDs(tenantID int, ids []int) ([]*account, error)
+	GetAccountByEmail(int, string) (*account, error)
+	GetAccountsByHolder(tenantID int, email string) ([]*account, error)
+	GetAccountByNumber(tenantID int, number string) (*account, error)
+	GetUsers(tenantID int, page pageRequest) ([]*account, int, error)
+	SearchAccounts(tenantID int, query string, metadata map[string]string, page pageRequest) ([]*account, int, error)
+	UpdateAccountLocale(id int, locale string) error
+	UpdateAccountTimezone(id int, timezone string) error
 	Close()
+
+	NotificationStorage
+	TicketStorage
+	FeatureFlagStorage
+	TenantStorage
+	WebhookStorage
+	LedgerStorage
+	AuditStorage
+	AdjustmentStorage
+	ReconciliationStorage
+	InvariantStorage
+	TransferStorage
+	BalanceAlertStorage
+	RoundUpStorage
+	PotStorage
+	SplitStorage
+	APIKeyStorage
+	MandateStorage
+	MerchantStorage
+	ChargeStorage
+	RefundStorage
+	SnapshotStorage
+	AccountHistoryStorage
+	AMLStorage
+	ScreeningStorage
+	SARStorage
+	HolidayStorage
+	EODStorage
+	GLStorage
+	DeviceStorage
+	PasswordStorage
+	ClaimStorage
+	InvoiceStorage
+	SubscriptionStorage
+	CashCodeStorage
+	CosignerStorage
+	PayeeStorage
+	GeoStorage
+	EnrichmentStorage
+	SearchStorage
+	ForecastStorage
+	RecurringStorage
+	FXStorage
+	ConsentStorage
+	PaymentStorage
+	AggregationStorage
+	BillerStorage
+	QuotaStorage
+	DeadLetterStorage
+	DormancyStorage
+	EscheatmentStorage
+	CampaignStorage
+	SegmentStorage
+	MetadataStorage
+	ExternalIDStorage
+	SyncStorage
+	AttachmentStorage
+	ActivityStorage
+	NoteStorage
+	CategorySplitStorage
+	ImportStorage
+	FundsCheckStorage
+	AuditChainStorage
+	ArchiveStorage
+	JobStorage
+	SMSStorage
+	NotificationPreferenceStorage
+	AccountApplicationStorage
+	ProductStorage
 }
 
 // PostgresStorage struct for PostgreSQL storage.
@@ -24,10 +106,9 @@ type PostgresStorage struct {
 	db *sql.DB
 }
 
-// NewPostgresStorage initializes a new PostgresStorage instance.
-
-func NewPostgresStorage() (*PostgresStorage, error) {
-	connStr := "user=postgres password=postgres sslmode=disable"
+// NewPostgresStorage initializes a new PostgresStorage instance. connStr
+// points at the server; the bank database is created on it if missing.
+func NewPostgresStorage(connStr string) (*PostgresStorage, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -49,6 +130,7 @@ func NewPostgresStorage() (*PostgresStorage, error) {
 	}
 
 	// Connect to the newly created or existing database
+	db.Close()
 	db, err = sql.Open("postgres", connStr+" dbname=bank")
 	if err != nil {
 		return nil, err
@@ -57,9 +139,7 @@ func NewPostgresStorage() (*PostgresStorage, error) {
 	return &PostgresStorage{db: db}, nil
 }
 
-// Init initializes the database by creating necessary tables.
-func (s *PostgresStorage) Init() error {
-	_, err := s.db.Exec(`
+const createAccountsTable = `
         CREATE TABLE IF NOT EXISTS accounts (
             id SERIAL PRIMARY KEY,
             email TEXT UNIQUE NOT NULL,
@@ -68,23 +148,177 @@ func (s *PostgresStorage) Init() error {
             number TEXT,
             balance INT
         )
-    `)
-	return err
+    `
+
+// Init initializes the database by creating necessary tables.
+func (s *PostgresStorage) Init() error {
+	schema := []string{
+		createAccountsTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'customer'`,
+		createNotificationsTable,
+		createSupportTicketsTable,
+		createTicketMessagesTable,
+		createFeatureFlagsTable,
+	}
+	schema = append(schema, tenantSchema...)
+	schema = append(schema,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'INR'`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT ''`,
+		createWebhookEndpointsTable,
+		createWebhookEventsTable,
+		createLedgerEntriesTable,
+		createPotsTable,
+		`CREATE INDEX IF NOT EXISTS ledger_entries_account_created_idx ON ledger_entries (account_id, created_at, id)`,
+		createAuditLogTable,
+		createAdjustmentsTable,
+		createAdjustmentApprovalsTable,
+		createReconciliationReportsTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_limit INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS reference TEXT NOT NULL DEFAULT ''`,
+		createTransfersTable,
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS accounts_name_trgm_idx ON accounts USING gin (name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS accounts_email_trgm_idx ON accounts USING gin (email gin_trgm_ops)`,
+		createBalanceAlertsTable,
+		createRoundUpSettingsTable,
+		createSplitRequestsTable,
+		createSplitSharesTable,
+		createAPIKeysTable,
+		`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'merchant'`,
+		createMandatesTable,
+		createMandatePaymentsTable,
+		createMerchantsTable,
+		createChargesTable,
+		`ALTER TABLE charges ADD COLUMN IF NOT EXISTS refunded INT NOT NULL DEFAULT 0`,
+		createRefundsTable,
+		createBalanceSnapshotsTable,
+		`CREATE INDEX IF NOT EXISTS transfers_from_account_idx ON transfers (from_account_id)`,
+		`CREATE INDEX IF NOT EXISTS transfers_to_account_idx ON transfers (to_account_id)`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS screening_status TEXT NOT NULL DEFAULT 'clear'`,
+		createDenylistTable,
+		createScreeningReviewsTable,
+		createSARReportsTable,
+		createHolidaysTable,
+		createLedgerDaysTable,
+		createDailyAccountTotalsTable,
+		createGLEntriesTable,
+		glBackfill(),
+		createGLAccountsTable,
+		createGLMappingsTable,
+		createKnownDevicesTable,
+		createLoginChallengesTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+		createPasswordHistoryTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS phone TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS accounts_tenant_phone_idx ON accounts (tenant_id, phone) WHERE phone IS NOT NULL`,
+		createTransferClaimsTable,
+		createClaimChallengesTable,
+		createInvoicesTable,
+		createInvoiceLinesTable,
+		createPlansTable,
+		createSubscriptionsTable,
+		createSubscriptionChargesTable,
+		createCashCodesTable,
+		createCashCodeAttemptsTable,
+		createCosignersTable,
+		createTransferApprovalsTable,
+		createPayeesTable,
+		createPayeeAllowlistsTable,
+		createGeoControlsTable,
+		createTravelNoticesTable,
+		createAccountCountriesTable,
+		createMerchantDirectoryTable,
+		createLedgerEnrichmentsTable,
+		createSavedSearchesTable,
+		createFXRatesTable,
+		createConsentsTable,
+		createPaymentConsentsTable,
+		createPaymentsTable,
+		createExternalLinksTable,
+		createExternalAccountsTable,
+		createExternalTransactionsTable,
+		createBillersTable,
+		createSavedBillersTable,
+		createBillPaymentsTable,
+		createAPIKeyQuotasTable,
+		createAPIKeyUsageTable,
+		createWebhookErrorsTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS dormancy_warned_at TIMESTAMPTZ`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS dormant_at TIMESTAMPTZ`,
+		createEscheatmentsTable,
+		createCampaignsTable,
+		createCampaignRecipientsTable,
+		createSegmentsTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'`,
+		`CREATE INDEX IF NOT EXISTS accounts_metadata_idx ON accounts USING GIN (metadata jsonb_path_ops)`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS external_id TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS accounts_tenant_external_id_idx ON accounts (tenant_id, external_id) WHERE external_id IS NOT NULL`,
+		`ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS segment_id INT REFERENCES segments(id) ON DELETE SET NULL`,
+		createAttachmentsTable,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS scan_status TEXT NOT NULL DEFAULT 'pending'`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS scan_result TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMPTZ`,
+		createAccountActivityTable,
+		createTransactionNotesTable,
+		createTransactionNoteTagsIndex,
+		`ALTER TABLE saved_searches ADD COLUMN IF NOT EXISTS tag TEXT NOT NULL DEFAULT ''`,
+		createTransactionSplitsTable,
+		createImportedTransactionsTable,
+		`ALTER TABLE saved_searches ADD COLUMN IF NOT EXISTS export_format TEXT NOT NULL DEFAULT 'csv'`,
+		createFundsChecksTable,
+		`ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS prev_hash TEXT`,
+		`ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS hash TEXT`,
+		createAuditAnchorsTable,
+		createLedgerArchivesTable,
+		createJobsTable,
+		createSMSMessagesTable,
+		createSMSStatusCallbacksTable,
+		createNotificationPreferencesTable,
+		createNotificationOutboxTable,
+		createAccountApplicationsTable,
+		createAccountApplicationEventsTable,
+		createProductsTable,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS product_id INT REFERENCES products(id)`,
+		`ALTER TABLE account_applications ADD COLUMN IF NOT EXISTS product_id INT REFERENCES products(id)`,
+	)
+	schema = append(schema, trackChanges...)
+	for _, stmt := range schema {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// CreateAccount inserts a new account into the database.
+// CreateAccount inserts a new account into the database. A non-zero
+// starting balance is posted to the ledger as an opening entry.
 func (s *PostgresStorage) CreateAccount(a *account) error {
-	err := s.db.QueryRow(
-		"INSERT INTO accounts (email, password, name, number, balance) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		a.Email, a.Password, a.Name, a.Number, a.Balance,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO accounts (tenant_id, email, phone, password, name, number, balance, role, currency, product_id, overdraft_limit) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, 0, $7, $8, $9, $10) RETURNING id",
+		a.TenantID, a.Email, a.Phone, a.Password, a.Name, a.Number, a.Role, a.Currency, a.ProductID, a.OverdraftLimit,
 	).Scan(&a.ID)
-	return err
+	if err != nil {
+		return err
+	}
+	if a.Balance != 0 {
+		if err := postEntries(tx, &ledgerEntry{AccountID: a.ID, Amount: a.Balance, Kind: entryOpening, Description: "Opening balance"}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // CheckAuth checks if the provided email and password match the stored account.
 
-func (s *PostgresStorage) CheckAuth(email string, password string) error {
-	row := s.db.QueryRow("SELECT password FROM accounts WHERE email = $1", email)
+func (s *PostgresStorage) CheckAuth(tenantID int, email string, password string) error {
+	row := s.db.QueryRow("SELECT password FROM accounts WHERE tenant_id = $1 AND email = $2", tenantID, email)
 	a := &account{}
 	err := row.Scan(&a.Password)
 	if err != nil {
@@ -99,32 +333,96 @@ func (s *PostgresStorage) CheckAuth(email string, password string) error {
 	return nil
 }
 
-func (s *PostgresStorage) GetUsers() ([]*account, error) {
-	rows, err := s.db.Query("SELECT id, name, number, balance FROM accounts") // could be replaced with "SELECT * FROM accounts"
+// GetUsers returns a page of a tenant's accounts in id order and their total count.
+func (s *PostgresStorage) GetUsers(tenantID int, page pageRequest) ([]*account, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM accounts WHERE tenant_id = $1", tenantID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keysetByID(2)
+	rows, err := s.db.Query("SELECT id, tenant_id, name, number, balance, currency FROM accounts WHERE tenant_id = $1 AND "+cond+" "+order, append([]any{tenantID}, args...)...)
 
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	accounts := make([]*account, 0)
 	for rows.Next() {
 		a := &account{}
-		err := rows.Scan(&a.ID, &a.Name, &a.Number, &a.Balance)
+		err := rows.Scan(&a.ID, &a.TenantID, &a.Name, &a.Number, &a.Balance, &a.Currency)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		accounts = append(accounts, a)
 	}
 
-	return accounts, nil
+	return accounts, total, rows.Err()
+}
+
+// SearchAccounts returns a page of a tenant's accounts whose name or email
+// contains query, case-insensitively, and whose metadata has all the given
+// values, and the total number of matches. Either filter may be empty. The
+// trigram indexes on name and email keep the ILIKE from scanning the table,
+// and the GIN index on metadata serves the containment test.
+func (s *PostgresStorage) SearchAccounts(tenantID int, query string, metadata map[string]string, page pageRequest) ([]*account, int, error) {
+	where, args := "tenant_id = $1", []any{tenantID}
+	if query != "" {
+		args = append(args, "%"+likeEscaper.Replace(query)+"%")
+		where += fmt.Sprintf(" AND (name ILIKE $%[1]d OR email ILIKE $%[1]d)", len(args))
+	}
+	if len(metadata) > 0 {
+		raw, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+		args = append(args, raw)
+		where += fmt.Sprintf(" AND metadata @> $%d", len(args))
+	}
+	total, err := s.count("SELECT COUNT(*) FROM accounts WHERE "+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, pageArgs := page.keysetByID(len(args) + 1)
+	rows, err := s.db.Query(
+		"SELECT id, tenant_id, email, name, number, balance, role, currency, metadata FROM accounts WHERE "+where+" AND "+cond+" "+order,
+		append(args, pageArgs...)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*account, 0)
+	for rows.Next() {
+		a := &account{}
+		var raw []byte
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.Email, &a.Name, &a.Number, &a.Balance, &a.Role, &a.Currency, &raw); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(raw, &a.Metadata); err != nil {
+			return nil, 0, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, total, rows.Err()
+}
+
+// likeEscaper escapes the LIKE wildcards in user input.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// count runs a SELECT COUNT(*) query, used for the totals of list pages.
+func (s *PostgresStorage) count(query string, args ...any) (int, error) {
+	var n int
+	err := s.db.QueryRow(query, args...).Scan(&n)
+	return n, err
 }
 
 // DeleteAccount deletes an account from the database by its ID.
 
 func (s *PostgresStorage) DeleteAccount(id int) error {
 	_, err := s.db.Exec("DELETE FROM accounts WHERE id = $1", id)
-	fmt.Printf("Deleted account with id: %d\n", id)
+	infof("Deleted account with id: %d\n", id)
 	return err
 }
 
@@ -136,12 +434,112 @@ func (s *PostgresStorage) UpdateAccount(a *account) error {
 
 // GetAccountByID retrieves an account from the database by its ID.
 func (s *PostgresStorage) GetAccountByID(id int) (*account, error) {
-	row := s.db.QueryRow("SELECT id, name, number, balance FROM accounts WHERE id = $1", id)
+	row := s.db.QueryRow("SELECT id, tenant_id, name, number, balance, currency, timezone, dormant_at, COALESCE(external_id, ''), product_id, overdraft_limit FROM accounts WHERE id = $1", id)
 	a := &account{}
-	err := row.Scan(&a.ID, &a.Name, &a.Number, &a.Balance)
+	err := row.Scan(&a.ID, &a.TenantID, &a.Name, &a.Number, &a.Balance, &a.Currency, &a.Timezone, &a.DormantAt, &a.ExternalID, &a.ProductID, &a.OverdraftLimit)
+	a.Dormant = a.DormantAt != nil
 	return a, err
 }
 
+func (s *PostgresStorage) GetAccountContact(id int) (*account, error) {
+	a := &account{}
+	err := s.db.QueryRow(
+		"SELECT id, tenant_id, email, COALESCE(phone, ''), name, number, balance, currency, locale, timezone FROM accounts WHERE id = $1", id,
+	).Scan(&a.ID, &a.TenantID, &a.Email, &a.Phone, &a.Name, &a.Number, &a.Balance, &a.Currency, &a.Locale, &a.Timezone)
+	return a, err
+}
+
+// GetAccountsByIDs retrieves the accounts of a tenant with the given IDs in
+// one query. IDs that do not exist are skipped.
+func (s *PostgresStorage) GetAccountsByIDs(tenantID int, ids []int) ([]*account, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, name, number, balance, currency FROM accounts WHERE tenant_id = $1 AND id = ANY($2) ORDER BY id", tenantID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*account, 0, len(ids))
+	for rows.Next() {
+		a := &account{}
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.Name, &a.Number, &a.Balance, &a.Currency); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// GetAccountByEmail retrieves an account of a tenant from the database by its email.
+func (s *PostgresStorage) GetAccountByEmail(tenantID int, email string) (*account, error) {
+	row := s.db.QueryRow("SELECT id, tenant_id, email, COALESCE(phone, ''), name, number, balance, role, currency, locale, timezone, dormant_at FROM accounts WHERE tenant_id = $1 AND email = $2", tenantID, email)
+	a := &account{}
+	err := row.Scan(&a.ID, &a.TenantID, &a.Email, &a.Phone, &a.Name, &a.Number, &a.Balance, &a.Role, &a.Currency, &a.Locale, &a.Timezone, &a.DormantAt)
+	a.Dormant = a.DormantAt != nil
+	return a, err
+}
+
+// GetAccountsByHolder lists the accounts of a tenant held under an email.
+func (s *PostgresStorage) GetAccountsByHolder(tenantID int, email string) ([]*account, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, email, name, number, balance, role, currency, locale FROM accounts WHERE tenant_id = $1 AND email = $2 ORDER BY id", tenantID, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*account, 0)
+	for rows.Next() {
+		a := &account{}
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.Email, &a.Name, &a.Number, &a.Balance, &a.Role, &a.Currency, &a.Locale); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// errAmbiguousNumber is returned when several accounts share a number.
+var errAmbiguousNumber = errors.New("account number is not unique")
+
+// GetAccountByNumber retrieves a tenant's account by its account number.
+func (s *PostgresStorage) GetAccountByNumber(tenantID int, number string) (*account, error) {
+	rows, err := s.db.Query("SELECT id, tenant_id, email, name, number, balance, role, currency FROM accounts WHERE tenant_id = $1 AND number = $2 LIMIT 2", tenantID, number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found *account
+	for rows.Next() {
+		if found != nil {
+			return nil, errAmbiguousNumber
+		}
+		found = &account{}
+		if err := rows.Scan(&found.ID, &found.TenantID, &found.Email, &found.Name, &found.Number, &found.Balance, &found.Role, &found.Currency); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return found, nil
+}
+
+// UpdateAccountLocale stores the display locale preferred by an account holder.
+func (s *PostgresStorage) UpdateAccountLocale(id int, locale string) error {
+	_, err := s.db.Exec("UPDATE accounts SET locale = $1 WHERE id = $2", locale, id)
+	return err
+}
+
+// UpdateAccountTimezone stores the time zone an account holder is
+// scheduled in.
+func (s *PostgresStorage) UpdateAccountTimezone(id int, timezone string) error {
+	_, err := s.db.Exec("UPDATE accounts SET timezone = $1 WHERE id = $2", timezone, id)
+	return err
+}
+
 // Close closes the database connection.
 func (s *PostgresStorage) Close() {
 	s.db.Close()
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const createPlansTable = `
+        CREATE TABLE IF NOT EXISTS plans (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            merchant_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            amount INT NOT NULL CHECK (amount > 0),
+            billing_interval TEXT NOT NULL CHECK (billing_interval IN ('week', 'month', 'year')),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createSubscriptionsTable = `
+        CREATE TABLE IF NOT EXISTS subscriptions (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            plan_id INT NOT NULL REFERENCES plans(id),
+            mandate_id INT NOT NULL REFERENCES mandates(id) ON DELETE CASCADE,
+            status TEXT NOT NULL DEFAULT 'active',
+            current_period_start TIMESTAMPTZ NOT NULL,
+            current_period_end TIMESTAMPTZ NOT NULL,
+            next_charge_at TIMESTAMPTZ NOT NULL,
+            proration INT NOT NULL DEFAULT 0,
+            failed_attempts INT NOT NULL DEFAULT 0,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            cancelled_at TIMESTAMPTZ
+        )
+    `
+
+const createSubscriptionChargesTable = `
+        CREATE TABLE IF NOT EXISTS subscription_charges (
+            id SERIAL PRIMARY KEY,
+            subscription_id INT NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+            transfer_id INT REFERENCES transfers(id),
+            amount INT NOT NULL,
+            status TEXT NOT NULL,
+            failure TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Billing intervals of a plan.
+var billingIntervals = []string{"week", "month", "year"}
+
+// nextPeriod returns the end of the billing period starting at start.
+func nextPeriod(start time.Time, interval string) time.Time {
+	switch interval {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "year":
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// Subscription statuses. A subscription whose renewal failed is past due
+// while the charge is retried, and is cancelled once the retries run out or
+// its mandate can no longer be collected against.
+const (
+	subscriptionActive    = "active"
+	subscriptionPastDue   = "past_due"
+	subscriptionCancelled = "cancelled"
+)
+
+// billingRetryDelays is the dunning schedule: how long after each failed
+// renewal the charge is tried again. A failure after the last retry cancels
+// the subscription.
+var billingRetryDelays = []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 5 * 24 * time.Hour}
+
+var errSubscriptionNotDue = errors.New("subscription is not due")
+
+// plan is a price a merchant charges every billing interval.
+type plan struct {
+	ID                int       `json:"id"`
+	TenantID          int       `json:"tenant_id"`
+	MerchantAccountID int       `json:"merchant_account_id"`
+	Name              string    `json:"name"`
+	Amount            int       `json:"amount"`
+	Interval          string    `json:"interval"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// subscription bills a customer for a plan at the start of every period,
+// collecting under the customer's mandate to the merchant. Proration is
+// carried into the next charge: positive after an upgrade, negative after a
+// downgrade.
+type subscription struct {
+	ID                 int        `json:"id"`
+	TenantID           int        `json:"tenant_id"`
+	PlanID             int        `json:"plan_id"`
+	MandateID          int        `json:"mandate_id"`
+	Status             string     `json:"status"`
+	CurrentPeriodStart time.Time  `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time  `json:"current_period_end"`
+	NextChargeAt       time.Time  `json:"next_charge_at"`
+	Proration          int        `json:"proration"`
+	FailedAttempts     int        `json:"failed_attempts"`
+	CreatedAt          time.Time  `json:"created_at"`
+	CancelledAt        *time.Time `json:"cancelled_at,omitempty"`
+}
+
+type CreatePlanRequest struct {
+	Name     string `json:"name"`
+	Amount   int    `json:"amount"`
+	Interval string `json:"interval"`
+}
+
+type CreateSubscriptionRequest struct {
+	PlanID    int `json:"plan_id"`
+	MandateID int `json:"mandate_id"`
+}
+
+type ChangePlanRequest struct {
+	PlanID int `json:"plan_id"`
+}
+
+// SubscriptionStorage holds the recurring billing storage operations.
+type SubscriptionStorage interface {
+	CreatePlan(*plan) error
+	GetPlan(id int) (*plan, error)
+	GetPlans(merchantAccountID int) ([]*plan, error)
+	CreateSubscription(sub *subscription, t *transfer) error
+	GetSubscription(id int) (*subscription, error)
+	GetSubscriptionsByMerchant(accountID int, page pageRequest) ([]*subscription, int, error)
+	GetDueSubscriptions(tenantID int, now time.Time) ([]*subscription, error)
+	ChargeSubscription(sub *subscription, p *plan, t *transfer, loc *time.Location) error
+	FailSubscriptionCharge(sub *subscription, amount int, failure string) error
+	UpdateSubscription(sub *subscription) error
+}
+
+// CreatePlan stores a merchant's plan.
+func (s *PostgresStorage) CreatePlan(p *plan) error {
+	return s.db.QueryRow(
+		"INSERT INTO plans (tenant_id, merchant_account_id, name, amount, billing_interval) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		p.TenantID, p.MerchantAccountID, p.Name, p.Amount, p.Interval,
+	).Scan(&p.ID, &p.CreatedAt)
+}
+
+const selectPlans = "SELECT id, tenant_id, merchant_account_id, name, amount, billing_interval, created_at FROM plans "
+
+func scanPlan(row interface{ Scan(...any) error }) (*plan, error) {
+	p := &plan{}
+	err := row.Scan(&p.ID, &p.TenantID, &p.MerchantAccountID, &p.Name, &p.Amount, &p.Interval, &p.CreatedAt)
+	return p, err
+}
+
+// GetPlan retrieves a plan by its ID.
+func (s *PostgresStorage) GetPlan(id int) (*plan, error) {
+	return scanPlan(s.db.QueryRow(selectPlans+"WHERE id = $1", id))
+}
+
+// GetPlans lists a merchant's plans.
+func (s *PostgresStorage) GetPlans(merchantAccountID int) ([]*plan, error) {
+	rows, err := s.db.Query(selectPlans+"WHERE merchant_account_id = $1 ORDER BY id", merchantAccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := make([]*plan, 0)
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+const selectSubscriptions = "SELECT id, tenant_id, plan_id, mandate_id, status, current_period_start, current_period_end, next_charge_at, proration, failed_attempts, created_at, cancelled_at FROM subscriptions "
+
+func scanSubscription(row interface{ Scan(...any) error }) (*subscription, error) {
+	sub := &subscription{}
+	err := row.Scan(&sub.ID, &sub.TenantID, &sub.PlanID, &sub.MandateID, &sub.Status, &sub.CurrentPeriodStart, &sub.CurrentPeriodEnd, &sub.NextChargeAt, &sub.Proration, &sub.FailedAttempts, &sub.CreatedAt, &sub.CancelledAt)
+	return sub, err
+}
+
+// CreateSubscription collects the first period under the mandate and
+// stores the subscription, all or nothing.
+func (s *PostgresStorage) CreateSubscription(sub *subscription, t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := collectMandate(tx, sub.MandateID, t); err != nil {
+		return err
+	}
+	err = tx.QueryRow(
+		"INSERT INTO subscriptions (tenant_id, plan_id, mandate_id, status, current_period_start, current_period_end, next_charge_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+		sub.TenantID, sub.PlanID, sub.MandateID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.NextChargeAt,
+	).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO subscription_charges (subscription_id, transfer_id, amount, status) VALUES ($1, $2, $3, 'paid')", sub.ID, t.ID, t.Amount); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSubscription retrieves a subscription by its ID.
+func (s *PostgresStorage) GetSubscription(id int) (*subscription, error) {
+	return scanSubscription(s.db.QueryRow(selectSubscriptions+"WHERE id = $1", id))
+}
+
+// GetSubscriptionsByMerchant returns a page of a merchant's subscriptions,
+// newest first, and their total count.
+func (s *PostgresStorage) GetSubscriptionsByMerchant(accountID int, page pageRequest) ([]*subscription, int, error) {
+	const byMerchant = "plan_id IN (SELECT id FROM plans WHERE merchant_account_id = $1)"
+	total, err := s.count("SELECT COUNT(*) FROM subscriptions WHERE "+byMerchant, accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	subs, err := s.querySubscriptions("WHERE "+byMerchant+" AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return subs, total, err
+}
+
+// GetDueSubscriptions returns a tenant's subscriptions with a renewal or
+// retry due.
+func (s *PostgresStorage) GetDueSubscriptions(tenantID int, now time.Time) ([]*subscription, error) {
+	return s.querySubscriptions("WHERE tenant_id = $1 AND status IN ('active', 'past_due') AND next_charge_at <= $2 ORDER BY next_charge_at", tenantID, now)
+}
+
+func (s *PostgresStorage) querySubscriptions(where string, args ...any) ([]*subscription, error) {
+	rows, err := s.db.Query(selectSubscriptions+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]*subscription, 0)
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// ChargeSubscription collects a due renewal under the subscription's mandate
+// and starts its next period. Without a transfer, when proration covers the
+// whole renewal, only the period moves on and what is left of the credit is
+// carried again. A subscription changed since sub was loaded fails with
+// errSubscriptionNotDue. sub is updated to its new state. The next period
+// steps in loc, the customer's time zone.
+func (s *PostgresStorage) ChargeSubscription(sub *subscription, p *plan, t *transfer, loc *time.Location) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	locked, err := scanSubscription(tx.QueryRow(selectSubscriptions+"WHERE id = $1 FOR UPDATE", sub.ID))
+	if err != nil {
+		return err
+	}
+	if locked.Status == subscriptionCancelled || locked.NextChargeAt.After(clock.Now()) || locked.PlanID != sub.PlanID || locked.Proration != sub.Proration {
+		return errSubscriptionNotDue
+	}
+
+	next := *locked
+	next.Status, next.FailedAttempts = subscriptionActive, 0
+	next.CurrentPeriodStart = locked.CurrentPeriodEnd
+	next.CurrentPeriodEnd = nextPeriod(locked.CurrentPeriodEnd.In(loc), p.Interval)
+	next.NextChargeAt = next.CurrentPeriodEnd
+	next.Proration = min(p.Amount+locked.Proration, 0)
+	if t != nil {
+		if err := collectMandate(tx, sub.MandateID, t); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO subscription_charges (subscription_id, transfer_id, amount, status) VALUES ($1, $2, $3, 'paid')", sub.ID, t.ID, t.Amount); err != nil {
+			return err
+		}
+	}
+	if err := updateSubscription(tx, &next); err != nil {
+		return err
+	}
+	*sub = next
+	return tx.Commit()
+}
+
+// FailSubscriptionCharge records a failed renewal and stores the status and
+// retry time the caller gave sub.
+func (s *PostgresStorage) FailSubscriptionCharge(sub *subscription, amount int, failure string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO subscription_charges (subscription_id, amount, status, failure) VALUES ($1, $2, 'failed', $3)", sub.ID, amount, failure); err != nil {
+		return err
+	}
+	if err := updateSubscription(tx, sub); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateSubscription stores a subscription's plan, status, schedule and
+// proration.
+func (s *PostgresStorage) UpdateSubscription(sub *subscription) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateSubscription(tx, sub); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateSubscription(tx *sql.Tx, sub *subscription) error {
+	_, err := tx.Exec(`
+        UPDATE subscriptions SET plan_id = $2, status = $3, current_period_start = $4, current_period_end = $5,
+            next_charge_at = $6, proration = $7, failed_attempts = $8, cancelled_at = $9
+        WHERE id = $1`,
+		sub.ID, sub.PlanID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.NextChargeAt, sub.Proration, sub.FailedAttempts, sub.CancelledAt,
+	)
+	return err
+}
+
+// prorate is what switching from one plan amount to another costs for the
+// rest of the current period: the difference, scaled by the share of the
+// period left. It is negative for downgrades.
+func prorate(sub *subscription, from, to int, now time.Time) int {
+	period := int64(sub.CurrentPeriodEnd.Sub(sub.CurrentPeriodStart) / time.Second)
+	left := int64(sub.CurrentPeriodEnd.Sub(now) / time.Second)
+	if period <= 0 || left <= 0 {
+		return 0
+	}
+	return int(int64(to-from) * min(left, period) / period)
+}
+
+// merchantPlan loads a plan of the calling merchant.
+func (s *Apiserver) merchantPlan(r *http.Request, id int) (*plan, error) {
+	p, err := s.store.GetPlan(id)
+	if err != nil || p.MerchantAccountID != requestAPIKey(r).AccountID {
+		return nil, newAPIError(http.StatusNotFound, "plan_not_found", id)
+	}
+	return p, nil
+}
+
+// merchantSubscription loads a subscription to a plan of the calling
+// merchant, with its plan.
+func (s *Apiserver) merchantSubscription(r *http.Request) (*subscription, *plan, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub, err := s.store.GetSubscription(id)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusNotFound, "subscription_not_found", id)
+	}
+	p, err := s.merchantPlan(r, sub.PlanID)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusNotFound, "subscription_not_found", id)
+	}
+	return sub, p, nil
+}
+
+// handleMerchantPlans lists the merchant's plans (GET) or adds one (POST).
+func (s *Apiserver) handleMerchantPlans(w http.ResponseWriter, r *http.Request) error {
+	merchant, err := s.store.GetAccountByID(requestAPIKey(r).AccountID)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		plans, err := s.store.GetPlans(merchant.ID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, plans)
+	}
+
+	req := CreatePlanRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	p := &plan{
+		TenantID:          merchant.TenantID,
+		MerchantAccountID: merchant.ID,
+		Name:              strings.TrimSpace(req.Name),
+		Amount:            req.Amount,
+		Interval:          req.Interval,
+	}
+	if p.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "name")
+	}
+	if p.Amount <= 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if !slices.Contains(billingIntervals, p.Interval) {
+		return newAPIError(http.StatusBadRequest, "invalid_interval", p.Interval, strings.Join(billingIntervals, ", "))
+	}
+	if err := s.store.CreatePlan(p); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// handleMerchantSubscriptions lists the merchant's subscriptions (GET) or
+// subscribes a customer to a plan under an active mandate (POST), charging
+// the first period right away.
+func (s *Apiserver) handleMerchantSubscriptions(w http.ResponseWriter, r *http.Request) error {
+	merchant, err := s.store.GetAccountByID(requestAPIKey(r).AccountID)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		subs, total, err := s.store.GetSubscriptionsByMerchant(merchant.ID, page)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, paginate(subs, total, page, func(sub *subscription) cursor { return cursor{sub.CreatedAt, sub.ID} }))
+	}
+
+	req := CreateSubscriptionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	p, err := s.merchantPlan(r, req.PlanID)
+	if err != nil {
+		return err
+	}
+	m, err := s.store.GetMandate(req.MandateID)
+	if err != nil || m.MerchantAccountID != merchant.ID {
+		return newAPIError(http.StatusNotFound, "mandate_not_found", req.MandateID)
+	}
+	customer, err := s.store.GetAccountByID(m.CustomerAccountID)
+	if err != nil {
+		return err
+	}
+	t, err := s.newTransfer(customer, merchant.ID, p.Amount, "Subscription: "+p.Name)
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now()
+	sub := &subscription{
+		TenantID:           merchant.TenantID,
+		PlanID:             p.ID,
+		MandateID:          m.ID,
+		Status:             subscriptionActive,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   nextPeriod(now.In(accountLocation(customer)), p.Interval),
+	}
+	sub.NextChargeAt = sub.CurrentPeriodEnd
+	if err := s.store.CreateSubscription(sub, t); err != nil {
+		return collectFailed(err, m)
+	}
+	s.transferCompleted(t)
+	s.notify(customer.ID, "subscription_started", fmt.Sprintf("You subscribed to %s for %s per %s. Next charge: %s",
+		p.Name, formatMoney(p.Amount, t.Currency, defaultLocale), p.Interval, localDate(customer, sub.NextChargeAt)))
+	return writeJSON(w, http.StatusCreated, sub)
+}
+
+// handleChangeSubscriptionPlan moves a subscription to another plan of the
+// merchant. The difference for the rest of the current period is added to,
+// or taken off, the next charge.
+func (s *Apiserver) handleChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) error {
+	sub, from, err := s.merchantSubscription(r)
+	if err != nil {
+		return err
+	}
+	req := ChangePlanRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	to, err := s.merchantPlan(r, req.PlanID)
+	if err != nil {
+		return err
+	}
+	if sub.Status == subscriptionCancelled {
+		return newAPIError(http.StatusConflict, "subscription_cancelled", sub.ID)
+	}
+	sub.Proration += prorate(sub, from.Amount, to.Amount, clock.Now())
+	sub.PlanID = to.ID
+	if err := s.store.UpdateSubscription(sub); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, sub)
+}
+
+// handleCancelSubscription stops a subscription; it is not charged again.
+func (s *Apiserver) handleCancelSubscription(w http.ResponseWriter, r *http.Request) error {
+	sub, _, err := s.merchantSubscription(r)
+	if err != nil {
+		return err
+	}
+	if sub.Status == subscriptionCancelled {
+		return newAPIError(http.StatusConflict, "subscription_cancelled", sub.ID)
+	}
+	now := clock.Now()
+	sub.Status, sub.CancelledAt = subscriptionCancelled, &now
+	if err := s.store.UpdateSubscription(sub); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, sub)
+}
+
+// runBilling charges a tenant's subscriptions with a renewal or retry due.
+func (s *Apiserver) runBilling(tenantID int) ([]*subscription, error) {
+	due, err := s.store.GetDueSubscriptions(tenantID, clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range due {
+		if err := s.renewSubscription(sub); err != nil {
+			logf("billing: subscription %d failed: %v\n", sub.ID, err)
+		}
+	}
+	return due, nil
+}
+
+// renewSubscription charges one due renewal: the plan amount plus any
+// proration. A charge the customer cannot cover right now is retried on the
+// dunning schedule; one the mandate no longer allows cancels the
+// subscription.
+func (s *Apiserver) renewSubscription(sub *subscription) error {
+	p, err := s.store.GetPlan(sub.PlanID)
+	if err != nil {
+		return err
+	}
+	m, err := s.store.GetMandate(sub.MandateID)
+	if err != nil {
+		return err
+	}
+	customer, err := s.store.GetAccountByID(m.CustomerAccountID)
+	if err != nil {
+		return err
+	}
+
+	amount := p.Amount + sub.Proration
+	var t *transfer
+	if amount > 0 {
+		if t, err = s.newTransfer(customer, m.MerchantAccountID, amount, "Subscription: "+p.Name); err != nil {
+			return s.subscriptionChargeFailed(sub, p, m, customer, amount, err)
+		}
+	}
+	err = s.store.ChargeSubscription(sub, p, t, accountLocation(customer))
+	if errors.Is(err, errSubscriptionNotDue) {
+		return nil
+	} else if err != nil {
+		return s.subscriptionChargeFailed(sub, p, m, customer, amount, err)
+	}
+	if t != nil {
+		s.transferCompleted(t)
+		s.notify(customer.ID, "subscription_charged", fmt.Sprintf("%s was charged for %s (ref %s). Next charge: %s",
+			formatMoney(t.Amount, t.Currency, defaultLocale), p.Name, t.Reference, localDate(customer, sub.NextChargeAt)))
+	}
+	return nil
+}
+
+// subscriptionChargeFailed schedules the next attempt of a failed renewal,
+// or cancels the subscription once the dunning schedule is used up or the
+// failure is not one waiting can fix, and tells both parties. Errors that
+// are not about the charge itself are returned, leaving the renewal due.
+func (s *Apiserver) subscriptionChargeFailed(sub *subscription, p *plan, m *mandate, customer *account, amount int, cause error) error {
+	retryable := errors.Is(cause, errInsufficientFunds) || errors.Is(cause, errMandateMonthlyUsed)
+	var apiErr *apiError
+	if !retryable && !errors.Is(cause, errMandateNotActive) && !errors.Is(cause, errMandateLimit) && !errors.As(cause, &apiErr) {
+		return cause
+	}
+
+	now := clock.Now()
+	due := formatMoney(amount, customer.Currency, defaultLocale)
+	sub.FailedAttempts++
+	var message string
+	if retryable && sub.FailedAttempts <= len(billingRetryDelays) {
+		sub.Status = subscriptionPastDue
+		sub.NextChargeAt = now.Add(billingRetryDelays[sub.FailedAttempts-1])
+		message = fmt.Sprintf("We could not collect %s for %s. We will try again on %s; please make sure the funds are available",
+			due, p.Name, localDate(customer, sub.NextChargeAt))
+	} else {
+		sub.Status, sub.CancelledAt = subscriptionCancelled, &now
+		message = fmt.Sprintf("Your subscription to %s was cancelled because %s could not be collected", p.Name, due)
+	}
+	if err := s.store.FailSubscriptionCharge(sub, amount, cause.Error()); err != nil {
+		return err
+	}
+	s.notify(customer.ID, "subscription_payment_failed", message)
+	s.notify(m.MerchantAccountID, "subscription_payment_failed", fmt.Sprintf("Renewal of subscription %d for %s failed (%v); it is now %s", sub.ID, due, cause, sub.Status))
+	return nil
+}
+
+// startBillingJob charges due subscriptions in the background on a fixed
+// interval. A zero interval disables the job.
+func (s *Apiserver) startBillingJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.pausedForReadOnly("billing") {
+				continue
+			}
+			tenants, err := s.store.GetTenants()
+			if err != nil {
+				logf("billing: failed to load tenants: %v\n", err)
+				continue
+			}
+			for _, t := range tenants {
+				if _, err := s.runBilling(t.ID); err != nil {
+					logf("billing: tenant %s failed: %v\n", t.Slug, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// summaryActivity is how many recent transactions the summary shows.
+const summaryActivity = 5
+
+// upcomingWindow is how far ahead the summary lists upcoming payments.
+const upcomingWindow = 14 * 24 * time.Hour
+
+// summaryAccount is one of the caller's accounts with its balance in the
+// summary's base currency, left out when there is no rate to convert it.
+type summaryAccount struct {
+	*account
+	BaseBalance *int `json:"base_balance,omitempty"`
+}
+
+// summaryExternalAccount is an account the caller linked at another bank,
+// as of its last sync, with its balance in the summary's base currency.
+type summaryExternalAccount struct {
+	*externalAccount
+	Institution string `json:"institution"`
+	BaseBalance *int   `json:"base_balance,omitempty"`
+}
+
+// UserSummary is everything the home screen of a mobile app needs in one
+// call: the caller's accounts, those linked at other banks and their total
+// in a base currency, the latest transactions across the caller's accounts
+// and the payments coming up.
+type UserSummary struct {
+	Currency          string                    `json:"currency"`
+	NetWorth          int                       `json:"net_worth"`
+	NetWorthFormatted string                    `json:"net_worth_formatted,omitempty"`
+	Accounts          []*summaryAccount         `json:"accounts"`
+	ExternalAccounts  []*summaryExternalAccount `json:"external_accounts"`
+	MissingRates      []string                  `json:"missing_rates,omitempty"`
+	RecentActivity    []*ledgerEntry            `json:"recent_activity"`
+	Upcoming          []*forecastItem           `json:"upcoming"`
+}
+
+func (u *UserSummary) formatMoney(locale string) {
+	for _, a := range u.Accounts {
+		a.formatMoney(locale)
+	}
+	u.NetWorthFormatted = formatMoney(u.NetWorth, u.Currency, locale)
+}
+
+// addBalance converts a balance to the summary's currency and adds it to
+// the net worth, or records the missing rate if it cannot be converted.
+func (u *UserSummary) addBalance(balance int, currency string, rates []*fxRate) *int {
+	var converted int
+	if currency == u.Currency {
+		converted = balance
+	} else if i := slices.IndexFunc(rates, func(f *fxRate) bool { return f.Currency == currency && f.Base == u.Currency }); i >= 0 {
+		converted = convertMoney(balance, currency, u.Currency, rates[i].Rate)
+	} else {
+		if !slices.Contains(u.MissingRates, currency) {
+			u.MissingRates = append(u.MissingRates, currency)
+		}
+		return nil
+	}
+	u.NetWorth += converted
+	return &converted
+}
+
+// handleUserSummary aggregates the accounts the caller holds here and at
+// other banks, converting their balances to ?currency= (the caller's own
+// currency by default) at the tenant's exchange rates. Balances with no rate
+// to the base currency are listed in missing_rates and left out of the net
+// worth.
+func (s *Apiserver) handleUserSummary(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	base := caller.Currency
+	if v := r.URL.Query().Get("currency"); v != "" {
+		if _, ok := currencies[v]; !ok {
+			return newAPIError(http.StatusBadRequest, "unsupported_currency", v)
+		}
+		base = v
+	}
+	accounts, err := s.store.GetAccountsByHolder(caller.TenantID, caller.Email)
+	if err != nil {
+		return err
+	}
+	rates, err := s.store.GetFXRates(caller.TenantID)
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now().UTC()
+	summary := &UserSummary{Currency: base, ExternalAccounts: make([]*summaryExternalAccount, 0), RecentActivity: make([]*ledgerEntry, 0), Upcoming: make([]*forecastItem, 0)}
+	for _, acc := range accounts {
+		summary.Accounts = append(summary.Accounts, &summaryAccount{account: acc, BaseBalance: summary.addBalance(acc.Balance, acc.Currency, rates)})
+
+		entries, _, err := s.store.GetLedgerEntries(acc.ID, pageRequest{Limit: summaryActivity})
+		if err != nil {
+			return err
+		}
+		summary.RecentActivity = append(summary.RecentActivity, entries...)
+		upcoming, err := s.projectedItems(acc, now, now.Add(upcomingWindow))
+		if err != nil {
+			return err
+		}
+		summary.Upcoming = append(summary.Upcoming, upcoming...)
+	}
+
+	links, err := s.store.GetExternalLinks(caller.ID)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		for _, a := range l.Accounts {
+			summary.ExternalAccounts = append(summary.ExternalAccounts, &summaryExternalAccount{externalAccount: a, Institution: l.Institution, BaseBalance: summary.addBalance(a.Balance, a.Currency, rates)})
+		}
+	}
+
+	slices.SortFunc(summary.RecentActivity, func(a, b *ledgerEntry) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	if len(summary.RecentActivity) > summaryActivity {
+		summary.RecentActivity = summary.RecentActivity[:summaryActivity]
+	}
+	if err := s.enrich(caller.TenantID, summary.RecentActivity); err != nil {
+		return err
+	}
+	slices.SortStableFunc(summary.Upcoming, func(a, b *forecastItem) int { return strings.Compare(a.Date, b.Date) })
+	return s.writeLocalizedJSON(w, r, http.StatusOK, summary)
+}
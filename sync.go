@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// trackChanges gives every table created_at and updated_at columns and
+// keeps updated_at current with a trigger, so downstream systems can
+// replicate rows incrementally. It runs last in Init and picks up tables
+// added by later features on its own. An update that sets updated_at
+// itself keeps that value.
+var trackChanges = []string{
+	`CREATE OR REPLACE FUNCTION set_updated_at() RETURNS trigger AS $$
+    BEGIN
+        IF NEW.updated_at IS NOT DISTINCT FROM OLD.updated_at THEN
+            NEW.updated_at = now();
+        END IF;
+        RETURN NEW;
+    END
+    $$ LANGUAGE plpgsql`,
+	`DO $$
+    DECLARE
+        t TEXT;
+        col TEXT;
+    BEGIN
+        FOR t IN SELECT tablename FROM pg_tables WHERE schemaname = current_schema() LOOP
+            FOREACH col IN ARRAY ARRAY['created_at', 'updated_at'] LOOP
+                IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = t AND column_name = col) THEN
+                    EXECUTE format('ALTER TABLE %I ADD COLUMN %I TIMESTAMPTZ NOT NULL DEFAULT now()', t, col);
+                END IF;
+            END LOOP;
+            IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = t || '_updated_at' AND tgrelid = t::regclass) THEN
+                EXECUTE format('CREATE TRIGGER %I BEFORE UPDATE ON %I FOR EACH ROW EXECUTE FUNCTION set_updated_at()', t || '_updated_at', t);
+            END IF;
+        END LOOP;
+    END
+    $$`,
+	`CREATE INDEX IF NOT EXISTS accounts_tenant_updated_idx ON accounts (tenant_id, updated_at, id)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entries_updated_idx ON ledger_entries (updated_at, id)`,
+}
+
+// syncAccount is an account as replicated downstream.
+type syncAccount struct {
+	*account
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// syncEntry is a ledger entry as replicated downstream.
+type syncEntry struct {
+	*ledgerEntry
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// syncBatch is one batch of changes. Since is passed back as ?since= to
+// continue after the batch, and stays put when there is nothing new.
+type syncBatch[T any] struct {
+	Changes []T    `json:"changes"`
+	Since   string `json:"since"`
+	HasMore bool   `json:"has_more"`
+}
+
+// SyncStorage holds the change feeds read by downstream replicas.
+type SyncStorage interface {
+	GetAccountChanges(tenantID int, after cursor, settle time.Duration, limit int) ([]*syncAccount, error)
+	GetLedgerChanges(tenantID int, after cursor, settle time.Duration, limit int) ([]*syncEntry, error)
+}
+
+// GetAccountChanges returns up to limit of the tenant's accounts changed
+// after the cursor, in (updated_at, id) order. Changes younger than settle
+// are held back so transactions still in flight when the batch is read,
+// which may commit with an earlier updated_at, are not skipped.
+func (s *PostgresStorage) GetAccountChanges(tenantID int, after cursor, settle time.Duration, limit int) ([]*syncAccount, error) {
+	rows, err := s.db.Query(`
+        SELECT id, tenant_id, email, COALESCE(phone, ''), name, number, balance, role, currency, locale, dormant_at,
+            COALESCE(external_id, ''), metadata, created_at, updated_at
+        FROM accounts
+        WHERE tenant_id = $1 AND (updated_at, id) > ($2, $3) AND updated_at < now() - make_interval(secs => $4)
+        ORDER BY updated_at, id LIMIT $5`,
+		tenantID, after.CreatedAt, after.ID, settle.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*syncAccount, 0)
+	for rows.Next() {
+		a := &syncAccount{account: &account{}}
+		var metadata []byte
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.Email, &a.Phone, &a.Name, &a.Number, &a.Balance, &a.Role, &a.Currency, &a.Locale, &a.DormantAt,
+			&a.ExternalID, &metadata, &a.CreatedAt, &a.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &a.Metadata); err != nil {
+			return nil, err
+		}
+		a.Dormant = a.DormantAt != nil
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// GetLedgerChanges returns up to limit ledger entries of the tenant's
+// accounts changed after the cursor, like GetAccountChanges.
+func (s *PostgresStorage) GetLedgerChanges(tenantID int, after cursor, settle time.Duration, limit int) ([]*syncEntry, error) {
+	rows, err := s.db.Query(`
+        SELECT e.id, e.account_id, e.amount, e.balance_after, e.kind, e.description, e.reference, e.created_at, e.updated_at
+        FROM ledger_entries e JOIN accounts a ON a.id = e.account_id
+        WHERE a.tenant_id = $1 AND (e.updated_at, e.id) > ($2, $3) AND e.updated_at < now() - make_interval(secs => $4)
+        ORDER BY e.updated_at, e.id LIMIT $5`,
+		tenantID, after.CreatedAt, after.ID, settle.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*syncEntry, 0)
+	for rows.Next() {
+		e := &syncEntry{ledgerEntry: &ledgerEntry{}}
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Amount, &e.BalanceAfter, &e.Kind, &e.Description, &e.Reference, &e.CreatedAt, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// parseSince reads ?since=, either a value returned by an earlier batch or
+// an RFC 3339 time to start from. Without it the feed starts at the
+// beginning.
+func parseSince(r *http.Request) (cursor, error) {
+	v := r.URL.Query().Get("since")
+	if v == "" {
+		return cursor{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return cursor{CreatedAt: t}, nil
+	}
+	c, err := decodeCursor(v)
+	if err != nil {
+		return cursor{}, newAPIError(http.StatusBadRequest, "invalid_cursor")
+	}
+	return *c, nil
+}
+
+// serveChanges answers a change feed request with the batch read by get.
+func serveChanges[T any](w http.ResponseWriter, r *http.Request, get func(after cursor, limit int) ([]T, error), key func(T) cursor) error {
+	after, err := parseSince(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	changes, err := get(after, page.Limit+1)
+	if err != nil {
+		return err
+	}
+	batch := &syncBatch[T]{Changes: changes}
+	if len(changes) > page.Limit {
+		batch.Changes, batch.HasMore = changes[:page.Limit], true
+	}
+	if n := len(batch.Changes); n > 0 {
+		after = key(batch.Changes[n-1])
+	}
+	batch.Since = encodeCursor(after)
+	return writeJSON(w, http.StatusOK, batch)
+}
+
+// handleSyncAccounts streams the tenant's account changes to downstream
+// replicas. Deleted accounts do not appear.
+func (s *Apiserver) handleSyncAccounts(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	return serveChanges(w, r, func(after cursor, limit int) ([]*syncAccount, error) {
+		return s.store.GetAccountChanges(tenantID, after, s.cfg().SyncSettle, limit)
+	}, func(a *syncAccount) cursor { return cursor{a.UpdatedAt, a.ID} })
+}
+
+// handleSyncTransactions streams the ledger entries of the tenant's
+// accounts to downstream replicas.
+func (s *Apiserver) handleSyncTransactions(w http.ResponseWriter, r *http.Request) error {
+	tenantID := requestTenant(r).ID
+	return serveChanges(w, r, func(after cursor, limit int) ([]*syncEntry, error) {
+		return s.store.GetLedgerChanges(tenantID, after, s.cfg().SyncSettle, limit)
+	}, func(e *syncEntry) cursor { return cursor{e.UpdatedAt, e.ID} })
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const createTenantsTable = `
+        CREATE TABLE IF NOT EXISTS tenants (
+            id SERIAL PRIMARY KEY,
+            slug TEXT UNIQUE NOT NULL,
+            name TEXT NOT NULL,
+            jwt_audience TEXT UNIQUE NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// defaultTenantID is the tenant that owns all rows created before
+// multi-tenancy and every request that does not name a tenant.
+const defaultTenantID = 1
+
+// tenantSchema seeds the default tenant and scopes the existing tables by tenant.
+var tenantSchema = []string{
+	createTenantsTable,
+	`INSERT INTO tenants (id, slug, name, jwt_audience) VALUES (1, 'default', 'Default Bank', 'bank') ON CONFLICT DO NOTHING`,
+	`SELECT setval('tenants_id_seq', GREATEST((SELECT MAX(id) FROM tenants), 1))`,
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS tenant_id INT NOT NULL DEFAULT 1 REFERENCES tenants(id)`,
+	`ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_email_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS accounts_tenant_email_idx ON accounts (tenant_id, email)`,
+	`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS tenant_id INT NOT NULL DEFAULT 1 REFERENCES tenants(id)`,
+	`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS tenant_id INT NOT NULL DEFAULT 1 REFERENCES tenants(id)`,
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS sandbox BOOLEAN NOT NULL DEFAULT false`,
+}
+
+// tenant is a bank brand served by this deployment.
+type tenant struct {
+	ID          int       `json:"id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	JWTAudience string    `json:"jwt_audience"`
+	Sandbox     bool      `json:"sandbox"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type CreateTenantRequest struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	JWTAudience string `json:"jwt_audience"`
+	Sandbox     bool   `json:"sandbox"`
+}
+
+// TenantStorage holds the tenant storage operations.
+type TenantStorage interface {
+	CreateTenant(*tenant) error
+	GetTenantBySlug(string) (*tenant, error)
+	GetTenants() ([]*tenant, error)
+}
+
+// CreateTenant inserts a new tenant.
+func (s *PostgresStorage) CreateTenant(t *tenant) error {
+	return s.db.QueryRow(
+		"INSERT INTO tenants (slug, name, jwt_audience, sandbox) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		t.Slug, t.Name, t.JWTAudience, t.Sandbox,
+	).Scan(&t.ID, &t.CreatedAt)
+}
+
+// GetTenantBySlug retrieves a tenant by its slug.
+func (s *PostgresStorage) GetTenantBySlug(slug string) (*tenant, error) {
+	t := &tenant{}
+	err := s.db.QueryRow("SELECT id, slug, name, jwt_audience, sandbox, created_at FROM tenants WHERE slug = $1", slug).
+		Scan(&t.ID, &t.Slug, &t.Name, &t.JWTAudience, &t.Sandbox, &t.CreatedAt)
+	return t, err
+}
+
+// GetTenants returns every tenant.
+func (s *PostgresStorage) GetTenants() ([]*tenant, error) {
+	rows, err := s.db.Query("SELECT id, slug, name, jwt_audience, sandbox, created_at FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := make([]*tenant, 0)
+	for rows.Next() {
+		t := &tenant{}
+		if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.JWTAudience, &t.Sandbox, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// tenantSlug picks the tenant named by the X-Tenant header, or else by the
+// first label of a subdomain host such as acme.bank.example.com.
+func tenantSlug(r *http.Request) string {
+	if slug := r.Header.Get("X-Tenant"); slug != "" {
+		return slug
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	if labels := strings.Split(host, "."); len(labels) >= 3 {
+		return labels[0]
+	}
+	return ""
+}
+
+// tenantMiddleware resolves the tenant of every request and stores it in the
+// request context.
+func (s *Apiserver) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug := tenantSlug(r)
+		if slug == "" {
+			slug = "default"
+		}
+		t, err := s.store.GetTenantBySlug(slug)
+		if err != nil {
+			writeError(w, r, newAPIError(http.StatusNotFound, "unknown_tenant", slug))
+			return
+		}
+		next.ServeHTTP(w, setRequestTenant(r, t))
+	})
+}
+
+// handleTenants lists (GET) or creates (POST) tenants. Only admins of the
+// default tenant manage other tenants.
+func (s *Apiserver) handleTenants(w http.ResponseWriter, r *http.Request) error {
+	if requestTenant(r).ID != defaultTenantID {
+		return newAPIError(http.StatusForbidden, "tenants_default_only")
+	}
+
+	if r.Method == "GET" {
+		tenants, err := s.store.GetTenants()
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, tenants)
+	}
+
+	req := CreateTenantRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Slug == "" || req.Name == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "slug and name")
+	}
+	if req.JWTAudience == "" {
+		req.JWTAudience = "bank-" + req.Slug
+	}
+	t := &tenant{Slug: req.Slug, Name: req.Name, JWTAudience: req.JWTAudience, Sandbox: req.Sandbox}
+	if err := s.store.CreateTenant(t); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, t)
+}
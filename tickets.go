@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const createSupportTicketsTable = `
+        CREATE TABLE IF NOT EXISTS support_tickets (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            transaction_id INT,
+            subject TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'open',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createTicketMessagesTable = `
+        CREATE TABLE IF NOT EXISTS ticket_messages (
+            id SERIAL PRIMARY KEY,
+            ticket_id INT NOT NULL REFERENCES support_tickets(id) ON DELETE CASCADE,
+            author_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            from_admin BOOLEAN NOT NULL DEFAULT false,
+            body TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const (
+	ticketOpen     = "open"
+	ticketPending  = "pending"
+	ticketResolved = "resolved"
+	ticketClosed   = "closed"
+)
+
+var ticketStatuses = map[string]bool{
+	ticketOpen:     true,
+	ticketPending:  true,
+	ticketResolved: true,
+	ticketClosed:   true,
+}
+
+// supportTicket is a customer support conversation, optionally about a transaction.
+type supportTicket struct {
+	ID            int              `json:"id"`
+	AccountID     int              `json:"account_id"`
+	TenantID      int              `json:"tenant_id"`
+	TransactionID *int             `json:"transaction_id,omitempty"`
+	Subject       string           `json:"subject"`
+	Status        string           `json:"status"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	Messages      []*ticketMessage `json:"messages,omitempty"`
+}
+
+// ticketMessage is a single reply on a support ticket.
+type ticketMessage struct {
+	ID        int       `json:"id"`
+	TicketID  int       `json:"ticket_id"`
+	AuthorID  int       `json:"author_id"`
+	FromAdmin bool      `json:"from_admin"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateTicketRequest struct {
+	Subject       string `json:"subject"`
+	Message       string `json:"message"`
+	TransactionID *int   `json:"transaction_id"`
+}
+
+type TicketReplyRequest struct {
+	Message string `json:"message"`
+}
+
+type TicketStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// TicketStorage holds the support ticket storage operations.
+type TicketStorage interface {
+	CreateTicket(*supportTicket, *ticketMessage) error
+	GetTicket(int) (*supportTicket, error)
+	GetTicketsByAccount(accountID int, page pageRequest) ([]*supportTicket, int, error)
+	GetTicketsByStatus(tenantID int, status string, page pageRequest) ([]*supportTicket, int, error)
+	AddTicketMessage(*ticketMessage) error
+	UpdateTicketStatus(id int, status string) error
+}
+
+// CreateTicket inserts a ticket together with its opening message.
+func (s *PostgresStorage) CreateTicket(t *supportTicket, m *ticketMessage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO support_tickets (account_id, transaction_id, subject, status, tenant_id) VALUES ($1, $2, $3, $4, (SELECT tenant_id FROM accounts WHERE id = $1)) RETURNING id, tenant_id, created_at, updated_at",
+		t.AccountID, t.TransactionID, t.Subject, t.Status,
+	).Scan(&t.ID, &t.TenantID, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	m.TicketID = t.ID
+	err = tx.QueryRow(
+		"INSERT INTO ticket_messages (ticket_id, author_id, from_admin, body) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		m.TicketID, m.AuthorID, m.FromAdmin, m.Body,
+	).Scan(&m.ID, &m.CreatedAt)
+	if err != nil {
+		return err
+	}
+	t.Messages = []*ticketMessage{m}
+
+	return tx.Commit()
+}
+
+// GetTicket retrieves a ticket and its messages by ID.
+func (s *PostgresStorage) GetTicket(id int) (*supportTicket, error) {
+	t := &supportTicket{}
+	var transactionID sql.NullInt64
+	err := s.db.QueryRow(
+		"SELECT id, account_id, tenant_id, transaction_id, subject, status, created_at, updated_at FROM support_tickets WHERE id = $1", id,
+	).Scan(&t.ID, &t.AccountID, &t.TenantID, &transactionID, &t.Subject, &t.Status, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if transactionID.Valid {
+		txID := int(transactionID.Int64)
+		t.TransactionID = &txID
+	}
+
+	rows, err := s.db.Query("SELECT id, ticket_id, author_id, from_admin, body, created_at FROM ticket_messages WHERE ticket_id = $1 ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &ticketMessage{}
+		if err := rows.Scan(&m.ID, &m.TicketID, &m.AuthorID, &m.FromAdmin, &m.Body, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Messages = append(t.Messages, m)
+	}
+	return t, rows.Err()
+}
+
+// GetTicketsByAccount returns a page of the tickets opened by an account, newest first.
+func (s *PostgresStorage) GetTicketsByAccount(accountID int, page pageRequest) ([]*supportTicket, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM support_tickets WHERE account_id = $1", accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	tickets, err := s.queryTickets("WHERE account_id = $1 AND "+cond+" "+order, append([]any{accountID}, args...)...)
+	return tickets, total, err
+}
+
+// GetTicketsByStatus returns a page of a tenant's tickets in the given
+// status, or of all of them if status is empty, newest first.
+func (s *PostgresStorage) GetTicketsByStatus(tenantID int, status string, page pageRequest) ([]*supportTicket, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM support_tickets WHERE tenant_id = $1 AND ($2 = '' OR status = $2)", tenantID, status)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(3, "")
+	tickets, err := s.queryTickets("WHERE tenant_id = $1 AND ($2 = '' OR status = $2) AND "+cond+" "+order, append([]any{tenantID, status}, args...)...)
+	return tickets, total, err
+}
+
+func (s *PostgresStorage) queryTickets(where string, args ...any) ([]*supportTicket, error) {
+	rows, err := s.db.Query("SELECT id, account_id, tenant_id, transaction_id, subject, status, created_at, updated_at FROM support_tickets "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := make([]*supportTicket, 0)
+	for rows.Next() {
+		t := &supportTicket{}
+		var transactionID sql.NullInt64
+		if err := rows.Scan(&t.ID, &t.AccountID, &t.TenantID, &transactionID, &t.Subject, &t.Status, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if transactionID.Valid {
+			txID := int(transactionID.Int64)
+			t.TransactionID = &txID
+		}
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+// AddTicketMessage appends a reply to a ticket and bumps its updated_at.
+func (s *PostgresStorage) AddTicketMessage(m *ticketMessage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO ticket_messages (ticket_id, author_id, from_admin, body) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		m.TicketID, m.AuthorID, m.FromAdmin, m.Body,
+	).Scan(&m.ID, &m.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE support_tickets SET updated_at = now() WHERE id = $1", m.TicketID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateTicketStatus changes the status of a ticket.
+func (s *PostgresStorage) UpdateTicketStatus(id int, status string) error {
+	res, err := s.db.Exec("UPDATE support_tickets SET status = $1, updated_at = now() WHERE id = $2", status, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return newAPIError(http.StatusNotFound, "ticket_not_found", id)
+	}
+	return nil
+}
+
+func ticketCursor(t *supportTicket) cursor { return cursor{t.CreatedAt, t.ID} }
+
+// handleTickets lists the caller's tickets (GET) or opens a new one (POST).
+func (s *Apiserver) handleTickets(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		page, err := parsePage(r)
+		if err != nil {
+			return err
+		}
+		tickets, total, err := s.store.GetTicketsByAccount(acc.ID, page)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, paginate(tickets, total, page, ticketCursor))
+	}
+
+	req := CreateTicketRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Subject == "" || req.Message == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "subject and message")
+	}
+	// transaction_id has no foreign key, so a ticket may only name one of
+	// the caller's own transactions.
+	if req.TransactionID != nil {
+		e, err := s.store.GetLedgerEntry(*req.TransactionID)
+		if err != nil || e.AccountID != acc.ID {
+			return newAPIError(http.StatusNotFound, "transaction_not_found", *req.TransactionID)
+		}
+	}
+
+	t := &supportTicket{AccountID: acc.ID, TransactionID: req.TransactionID, Subject: req.Subject, Status: ticketOpen}
+	m := &ticketMessage{AuthorID: acc.ID, Body: req.Message}
+	if err := s.store.CreateTicket(t, m); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, t)
+}
+
+// handleGetTicket returns a ticket with its messages to its owner or an admin.
+func (s *Apiserver) handleGetTicket(w http.ResponseWriter, r *http.Request) error {
+	t, _, err := s.loadTicket(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, t)
+}
+
+// handleReplyTicket adds a message to a ticket. Admin replies notify the ticket owner.
+func (s *Apiserver) handleReplyTicket(w http.ResponseWriter, r *http.Request) error {
+	t, acc, err := s.loadTicket(r)
+	if err != nil {
+		return err
+	}
+	if t.Status == ticketClosed {
+		return newAPIError(http.StatusConflict, "ticket_closed", t.ID)
+	}
+
+	req := TicketReplyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Message == "" {
+		return newAPIError(http.StatusBadRequest, "required_field", "message")
+	}
+
+	m := &ticketMessage{TicketID: t.ID, AuthorID: acc.ID, FromAdmin: isAdmin(r), Body: req.Message}
+	if err := s.store.AddTicketMessage(m); err != nil {
+		return err
+	}
+	if m.FromAdmin && acc.ID != t.AccountID {
+		s.notify(t.AccountID, "ticket_reply", fmt.Sprintf("Support replied to your ticket #%d: %s", t.ID, t.Subject))
+	}
+	return writeJSON(w, http.StatusCreated, m)
+}
+
+// handleAdminListTickets lists tickets, optionally filtered by ?status=.
+func (s *Apiserver) handleAdminListTickets(w http.ResponseWriter, r *http.Request) error {
+	status := r.URL.Query().Get("status")
+	if status != "" && !ticketStatuses[status] {
+		return newAPIError(http.StatusBadRequest, "unknown_ticket_status", status)
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	tickets, total, err := s.store.GetTicketsByStatus(requestTenant(r).ID, status, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(tickets, total, page, ticketCursor))
+}
+
+// handleAdminUpdateTicketStatus changes a ticket's status and notifies its owner.
+func (s *Apiserver) handleAdminUpdateTicketStatus(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+	req := TicketStatusRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if !ticketStatuses[req.Status] {
+		return newAPIError(http.StatusBadRequest, "unknown_ticket_status", req.Status)
+	}
+
+	t, err := s.store.GetTicket(id)
+	if err != nil || t.TenantID != requestTenant(r).ID {
+		return newAPIError(http.StatusNotFound, "ticket_not_found", id)
+	}
+	if err := s.store.UpdateTicketStatus(id, req.Status); err != nil {
+		return err
+	}
+	t.Status = req.Status
+	s.notify(t.AccountID, "ticket_status", fmt.Sprintf("Your ticket #%d is now %s", t.ID, t.Status))
+	return writeJSON(w, http.StatusOK, t)
+}
+
+// loadTicket fetches the ticket named in the path and checks the caller may see it.
+func (s *Apiserver) loadTicket(r *http.Request) (*supportTicket, *account, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := s.store.GetTicket(id)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusNotFound, "ticket_not_found", id)
+	}
+	if t.TenantID != acc.TenantID || (t.AccountID != acc.ID && !isAdmin(r)) {
+		return nil, nil, newAPIError(http.StatusNotFound, "ticket_not_found", id)
+	}
+	return t, acc, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+	_ "time/tzdata" // holders' time zones must load on hosts without zoneinfo
+)
+
+// Holders may set an IANA time zone, such as "Asia/Kathmandu". Their
+// scheduled payments fall due on their local date, their export schedules
+// and subscription periods step in local time so they keep the same time
+// of day across DST changes, and their statements are dated locally.
+// Holders without one are scheduled in UTC.
+
+// loadTimezone loads the named time zone, or UTC for an empty name.
+func loadTimezone(name string) (*time.Location, error) {
+	return time.LoadLocation(name)
+}
+
+// accountLocation is the time zone acc is scheduled in.
+func accountLocation(acc *account) *time.Location {
+	loc, err := loadTimezone(acc.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// localDate is the date, as YYYY-MM-DD, that t falls on for acc.
+func localDate(acc *account, t time.Time) string {
+	return t.In(accountLocation(acc)).Format(time.DateOnly)
+}
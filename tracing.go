@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// traceparentHeader carries the W3C trace context of a request, so its
+// spans join those of the callers and services it talks to.
+const traceparentHeader = "traceparent"
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// traceContext is the span a request is served in.
+type traceContext struct {
+	traceID string
+	spanID  string
+	// parentID is the caller's span, if the request came with one.
+	parentID string
+	flags    string
+}
+
+// header returns the traceparent of the span.
+func (t traceContext) header() string {
+	return "00-" + t.traceID + "-" + t.spanID + "-" + t.flags
+}
+
+// child returns a new span of the same trace under t.
+func (t traceContext) child() traceContext {
+	return traceContext{traceID: t.traceID, spanID: randomHex(8), parentID: t.spanID, flags: t.flags}
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent reads a traceparent header, rejecting the all-zero IDs
+// the spec reserves as invalid.
+func parseTraceparent(v string) (traceContext, bool) {
+	m := traceparentPattern.FindStringSubmatch(v)
+	if m == nil || m[1] == "00000000000000000000000000000000" || m[2] == "0000000000000000" {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: m[1], spanID: m[2], flags: m[3]}, true
+}
+
+// trace serves the request in a span of the caller's trace, or starts a
+// trace if it came without one, and returns the span in the traceparent
+// response header. The request log and outbound calls carry the span on.
+func trace(next apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		r, rc := contextOf(r)
+		parent, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+		if !ok {
+			parent = traceContext{traceID: randomHex(16), flags: "01"}
+		}
+		rc.trace = parent.child()
+		w.Header().Set(traceparentHeader, rc.trace.header())
+		return next(w, r)
+	}
+}
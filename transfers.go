@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const createTransfersTable = `
+        CREATE TABLE IF NOT EXISTS transfers (
+            id SERIAL PRIMARY KEY,
+            tenant_id INT NOT NULL REFERENCES tenants(id),
+            reference TEXT UNIQUE NOT NULL,
+            from_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            to_account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            amount INT NOT NULL CHECK (amount > 0),
+            currency TEXT NOT NULL,
+            memo TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+// Ledger entry kinds of a transfer. The two legs always net to zero.
+const (
+	entryTransferOut = "transfer_out"
+	entryTransferIn  = "transfer_in"
+)
+
+// maxMemoLength caps the user-supplied memo of a transfer, in characters.
+const maxMemoLength = 140
+
+// transfer moves money between two accounts of a tenant. Its reference is
+// generated by the bank and is shown to both parties.
+type transfer struct {
+	ID            int       `json:"id"`
+	TenantID      int       `json:"tenant_id"`
+	Reference     string    `json:"reference"`
+	FromAccountID int       `json:"from_account_id"`
+	ToAccountID   int       `json:"to_account_id"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	Memo          string    `json:"memo"`
+	RoundUp       int       `json:"round_up,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	roundUpAccountID int // savings account credited with RoundUp
+	invoiceID        int // invoice the transfer paid, see matchInvoice
+}
+
+// TransferRequest addresses the recipient by account ID or, with
+// ToContact, by email address or phone number.
+type TransferRequest struct {
+	ToAccountID int    `json:"to_account_id"`
+	ToContact   string `json:"to_contact,omitempty"`
+	Amount      int    `json:"amount"`
+	Memo        string `json:"memo"`
+}
+
+// TransferStorage holds the transfer storage operations.
+type TransferStorage interface {
+	CreateTransfer(*transfer) error
+	GetTransferByReference(tenantID int, reference string) (*transfer, error)
+}
+
+// CreateTransfer records a transfer and posts both of its ledger legs, plus
+// the sender's round-up if they have one.
+func (s *PostgresStorage) CreateTransfer(t *transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createTransfer(tx, t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createTransfer is CreateTransfer within the caller's transaction, for
+// records that must be written atomically with a transfer.
+func createTransfer(tx *sql.Tx, t *transfer) error {
+	roundUp := &roundUpSettings{AccountID: t.FromAccountID}
+	err := tx.QueryRow("SELECT savings_account_id, enabled FROM roundup_settings WHERE account_id = $1", t.FromAccountID).
+		Scan(&roundUp.SavingsAccountID, &roundUp.Enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		roundUp = nil
+	} else if err != nil {
+		return err
+	}
+
+	// Lock every account involved in id order so opposite transfers cannot deadlock.
+	ids := []int{t.FromAccountID, t.ToAccountID}
+	if roundUp != nil {
+		ids = append(ids, roundUp.SavingsAccountID)
+	}
+	if _, err := tx.Exec("SELECT 1 FROM accounts WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array(ids)); err != nil {
+		return err
+	}
+	err = tx.QueryRow(
+		"INSERT INTO transfers (tenant_id, reference, from_account_id, to_account_id, amount, currency, memo) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+		t.TenantID, t.Reference, t.FromAccountID, t.ToAccountID, t.Amount, t.Currency, t.Memo,
+	).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return err
+	}
+	err = postEntries(tx,
+		&ledgerEntry{AccountID: t.FromAccountID, Amount: -t.Amount, Kind: entryTransferOut, Description: t.Memo, Reference: t.Reference},
+		&ledgerEntry{AccountID: t.ToAccountID, Amount: t.Amount, Kind: entryTransferIn, Description: t.Memo, Reference: t.Reference},
+	)
+	if err != nil {
+		return err
+	}
+	if t.RoundUp, err = postRoundUp(tx, roundUp, t.Amount, t.Currency, t.Reference); err != nil {
+		return err
+	}
+	if t.RoundUp > 0 {
+		t.roundUpAccountID = roundUp.SavingsAccountID
+	}
+	return matchInvoice(tx, t)
+}
+
+// GetTransferByReference retrieves a tenant's transfer by its reference.
+func (s *PostgresStorage) GetTransferByReference(tenantID int, reference string) (*transfer, error) {
+	t := &transfer{}
+	err := s.db.QueryRow(
+		"SELECT id, tenant_id, reference, from_account_id, to_account_id, amount, currency, memo, created_at FROM transfers WHERE tenant_id = $1 AND reference = $2",
+		tenantID, reference,
+	).Scan(&t.ID, &t.TenantID, &t.Reference, &t.FromAccountID, &t.ToAccountID, &t.Amount, &t.Currency, &t.Memo, &t.CreatedAt)
+	return t, err
+}
+
+// referenceAlphabet leaves out characters that are easily confused when a
+// reference is read out over the phone (0/O, 1/I/L).
+const referenceAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// newTransferReference returns a reference such as TRF-20240115-7KQ3M9XA.
+func newTransferReference(now time.Time) (string, error) {
+	return newReference("TRF-", now)
+}
+
+// newReference returns a reference made of the prefix, the date and eight
+// random characters.
+func newReference(prefix string, now time.Time) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = referenceAlphabet[int(b[i])%len(referenceAlphabet)]
+	}
+	return prefix + now.UTC().Format("20060102") + "-" + string(b), nil
+}
+
+// newTransfer validates a transfer from an account and assigns it a
+// reference. The transfer is not stored.
+func (s *Apiserver) newTransfer(from *account, toAccountID, amount int, memo string) (*transfer, error) {
+	memo = strings.TrimSpace(memo)
+	if amount <= 0 {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_amount")
+	}
+	if utf8.RuneCountInString(memo) > maxMemoLength {
+		return nil, newAPIError(http.StatusBadRequest, "memo_too_long", maxMemoLength)
+	}
+	if toAccountID == from.ID {
+		return nil, newAPIError(http.StatusBadRequest, "same_account_transfer")
+	}
+	to, err := s.store.GetAccountByID(toAccountID)
+	if err != nil || to.TenantID != from.TenantID {
+		return nil, newAPIError(http.StatusNotFound, "account_not_found", toAccountID)
+	}
+	if to.Currency != from.Currency {
+		return nil, newAPIError(http.StatusBadRequest, "currency_mismatch", from.Currency, to.Currency)
+	}
+	if err := s.checkScreening(from.ID, to.ID); err != nil {
+		return nil, err
+	}
+	if err := s.checkDormancy(from.ID); err != nil {
+		return nil, err
+	}
+
+	reference, err := newTransferReference(clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &transfer{
+		TenantID:      from.TenantID,
+		Reference:     reference,
+		FromAccountID: from.ID,
+		ToAccountID:   to.ID,
+		Amount:        amount,
+		Currency:      from.Currency,
+		Memo:          memo,
+	}, nil
+}
+
+// transferFailed maps the storage errors of a transfer to API errors.
+func transferFailed(err error) error {
+	if errors.Is(err, errInsufficientFunds) {
+		return newAPIError(http.StatusUnprocessableEntity, "insufficient_funds")
+	}
+	if errors.Is(err, errDayClosed) {
+		return newAPIError(http.StatusConflict, "ledger_day_closed")
+	}
+	return err
+}
+
+// transferCompleted runs the side effects of a stored transfer.
+func (s *Apiserver) transferCompleted(t *transfer) {
+	s.checkBalanceAlerts(t.FromAccountID, t.ToAccountID)
+	if t.roundUpAccountID != 0 {
+		s.checkBalanceAlerts(t.roundUpAccountID)
+	}
+	s.notify(t.ToAccountID, "transfer_received", fmt.Sprintf("You received %s (ref %s)", formatMoney(t.Amount, t.Currency, defaultLocale), t.Reference))
+	if t.invoiceID != 0 {
+		s.notifyInvoicePaid(t)
+	}
+}
+
+// handleTransfer moves money from the caller's account to another account
+// of the same tenant and currency, or to a contact (see
+// handleTransferToContact).
+func (s *Apiserver) handleTransfer(w http.ResponseWriter, r *http.Request) error {
+	from, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	req := TransferRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.ToAccountID == 0 && req.ToContact != "" {
+		return s.handleTransferToContact(w, r, from, req)
+	}
+	t, err := s.newTransfer(from, req.ToAccountID, req.Amount, req.Memo)
+	if err != nil {
+		return err
+	}
+	if err := s.checkTrustedPayee(from.ID, t.ToAccountID); err != nil {
+		return err
+	}
+	if a, err := s.holdForCosigner(r, t); err != nil {
+		return err
+	} else if a != nil {
+		return writeJSON(w, http.StatusAccepted, a)
+	}
+	if err := s.store.CreateTransfer(t); err != nil {
+		return transferFailed(err)
+	}
+	s.transferCompleted(t)
+	return writeJSON(w, http.StatusCreated, t)
+}
+
+// handleTransactionLookup serves GET /transactions/by-reference/{ref}.
+// net/http patterns cannot tell that path apart from the
+// /transactions/{id}/... routes, so it is routed as
+// /transactions/{id}/{ref} and answers only when {id} is by-reference, as
+// the path was before patterns were used.
+func (s *Apiserver) handleTransactionLookup(w http.ResponseWriter, r *http.Request) error {
+	if r.PathValue("id") != "by-reference" {
+		http.NotFound(w, r)
+		return nil
+	}
+	return s.handleGetTransferByReference(w, r)
+}
+
+// handleGetTransferByReference returns a transfer to either party or an
+// admin of the tenant.
+func (s *Apiserver) handleGetTransferByReference(w http.ResponseWriter, r *http.Request) error {
+	caller, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+	reference := r.PathValue("ref")
+	t, err := s.store.GetTransferByReference(caller.TenantID, reference)
+	if err != nil || (t.FromAccountID != caller.ID && t.ToAccountID != caller.ID && !isAdmin(r)) {
+		return newAPIError(http.StatusNotFound, "transfer_not_found", reference)
+	}
+	return writeJSON(w, http.StatusOK, t)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const createWebhookEndpointsTable = `
+        CREATE TABLE IF NOT EXISTS webhook_endpoints (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            url TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            event_types TEXT[] NOT NULL DEFAULT '{}',
+            active BOOLEAN NOT NULL DEFAULT true,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `
+
+const createWebhookEventsTable = `
+        CREATE TABLE IF NOT EXISTS webhook_events (
+            id SERIAL PRIMARY KEY,
+            endpoint_id INT NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+            event_type TEXT NOT NULL,
+            payload JSONB NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending',
+            attempts INT NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            delivered_at TIMESTAMPTZ
+        )
+    `
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// Webhook deliveries are signed so receivers can check that a request came
+// from the bank and was not replayed. Every delivery carries the header
+//
+//	X-Bank-Signature: t=<unix seconds>,v1=<hex signature>
+//
+// where the signature is HMAC-SHA256, keyed with the endpoint secret, over
+// "<t>.<raw request body>". Receivers recompute it, compare in constant time
+// and reject deliveries whose timestamp is older than webhookTolerance.
+// VerifyWebhookSignature is the reference implementation.
+const (
+	webhookSignatureHeader = "X-Bank-Signature"
+	webhookTolerance       = 5 * time.Minute
+	webhookMaxAttempts     = 3
+)
+
+const (
+	// maxRedeliverEvents caps the events one redelivery request replays.
+	maxRedeliverEvents = 100
+	// redeliverWindow is how far back undelivered events can be replayed.
+	redeliverWindow = 7 * 24 * time.Hour
+)
+
+var (
+	// allowLoopbackWebhooks lets webhooks be delivered to this machine, so
+	// receivers can run locally in development.
+	allowLoopbackWebhooks atomic.Bool
+	// webhookClient makes a single attempt per delivery; deliverWebhook
+	// owns the retries so each is counted on the event. It only connects to
+	// public addresses.
+	webhookClient = newPublicOutboundClient(10*time.Second, 1, allowLoopbackWebhooks.Load)
+)
+
+// webhookEndpoint is a URL that receives events for an account.
+type webhookEndpoint struct {
+	ID         int       `json:"id"`
+	AccountID  int       `json:"account_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// webhookEvent is one event queued for delivery to one endpoint.
+type webhookEvent struct {
+	ID          int             `json:"id"`
+	EndpointID  int             `json:"endpoint_id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+}
+
+type CreateWebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+type RedeliverRequest struct {
+	EventIDs []int     `json:"event_ids"`
+	Since    time.Time `json:"since"`
+}
+
+// WebhookStorage holds the webhook storage operations.
+type WebhookStorage interface {
+	CreateWebhookEndpoint(*webhookEndpoint) error
+	GetWebhookEndpoint(int) (*webhookEndpoint, error)
+	GetWebhookEndpoints(accountID int) ([]*webhookEndpoint, error)
+	CreateWebhookEvent(*webhookEvent) error
+	GetWebhookEvents(endpointID int, page pageRequest) ([]*webhookEvent, int, error)
+	GetRedeliverableEvents(endpointID int, ids []int, since time.Time) ([]*webhookEvent, error)
+	UpdateWebhookEvent(*webhookEvent) error
+}
+
+// CreateWebhookEndpoint inserts a new endpoint.
+func (s *PostgresStorage) CreateWebhookEndpoint(e *webhookEndpoint) error {
+	return s.db.QueryRow(
+		"INSERT INTO webhook_endpoints (account_id, url, secret, event_types) VALUES ($1, $2, $3, $4) RETURNING id, active, created_at",
+		e.AccountID, e.URL, e.Secret, pq.Array(e.EventTypes),
+	).Scan(&e.ID, &e.Active, &e.CreatedAt)
+}
+
+// GetWebhookEndpoint retrieves an endpoint, including its secret, by ID.
+func (s *PostgresStorage) GetWebhookEndpoint(id int) (*webhookEndpoint, error) {
+	e := &webhookEndpoint{}
+	err := s.db.QueryRow("SELECT id, account_id, url, secret, event_types, active, created_at FROM webhook_endpoints WHERE id = $1", id).
+		Scan(&e.ID, &e.AccountID, &e.URL, &e.Secret, pq.Array(&e.EventTypes), &e.Active, &e.CreatedAt)
+	return e, err
+}
+
+// GetWebhookEndpoints returns the active endpoints of an account.
+func (s *PostgresStorage) GetWebhookEndpoints(accountID int) ([]*webhookEndpoint, error) {
+	rows, err := s.db.Query("SELECT id, account_id, url, secret, event_types, active, created_at FROM webhook_endpoints WHERE account_id = $1 AND active ORDER BY id", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := make([]*webhookEndpoint, 0)
+	for rows.Next() {
+		e := &webhookEndpoint{}
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.URL, &e.Secret, pq.Array(&e.EventTypes), &e.Active, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+// CreateWebhookEvent queues an event for an endpoint.
+func (s *PostgresStorage) CreateWebhookEvent(ev *webhookEvent) error {
+	return s.db.QueryRow(
+		"INSERT INTO webhook_events (endpoint_id, event_type, payload, status) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		ev.EndpointID, ev.EventType, []byte(ev.Payload), ev.Status,
+	).Scan(&ev.ID, &ev.CreatedAt)
+}
+
+// GetWebhookEvents returns a page of an endpoint's events, newest first.
+func (s *PostgresStorage) GetWebhookEvents(endpointID int, page pageRequest) ([]*webhookEvent, int, error) {
+	total, err := s.count("SELECT COUNT(*) FROM webhook_events WHERE endpoint_id = $1", endpointID)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, order, args := page.keyset(2, "")
+	events, err := s.queryWebhookEvents("WHERE endpoint_id = $1 AND "+cond+" "+order, append([]any{endpointID}, args...)...)
+	return events, total, err
+}
+
+// GetRedeliverableEvents returns the events of an endpoint to replay: the
+// listed IDs if any are given, otherwise the oldest maxRedeliverEvents
+// undelivered events since the given time.
+func (s *PostgresStorage) GetRedeliverableEvents(endpointID int, ids []int, since time.Time) ([]*webhookEvent, error) {
+	if len(ids) > 0 {
+		return s.queryWebhookEvents("WHERE endpoint_id = $1 AND id = ANY($2) ORDER BY id", endpointID, pq.Array(ids))
+	}
+	return s.queryWebhookEvents("WHERE endpoint_id = $1 AND status <> 'delivered' AND created_at >= $2 ORDER BY id LIMIT $3", endpointID, since, maxRedeliverEvents)
+}
+
+func (s *PostgresStorage) queryWebhookEvents(where string, args ...any) ([]*webhookEvent, error) {
+	rows, err := s.db.Query("SELECT id, endpoint_id, event_type, payload, status, attempts, last_error, created_at, delivered_at FROM webhook_events "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*webhookEvent, 0)
+	for rows.Next() {
+		ev := &webhookEvent{}
+		var payload []byte
+		if err := rows.Scan(&ev.ID, &ev.EndpointID, &ev.EventType, &payload, &ev.Status, &ev.Attempts, &ev.LastError, &ev.CreatedAt, &ev.DeliveredAt); err != nil {
+			return nil, err
+		}
+		ev.Payload = payload
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// UpdateWebhookEvent stores the outcome of a delivery attempt.
+func (s *PostgresStorage) UpdateWebhookEvent(ev *webhookEvent) error {
+	_, err := s.db.Exec(
+		"UPDATE webhook_events SET status = $1, attempts = $2, last_error = $3, delivered_at = $4 WHERE id = $5",
+		ev.Status, ev.Attempts, ev.LastError, ev.DeliveredAt, ev.ID,
+	)
+	return err
+}
+
+// signWebhook computes the X-Bank-Signature header value for a body.
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + webhookMAC(secret, t, body)
+}
+
+func webhookMAC(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks a X-Bank-Signature header the way a receiver
+// should: the signature must match and the timestamp must be recent.
+func VerifyWebhookSignature(secret, header string, body []byte, now time.Time) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+	ts, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return fmt.Errorf("malformed signature header")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return fmt.Errorf("signature timestamp outside tolerance")
+	}
+	if !hmac.Equal([]byte(v1), []byte(webhookMAC(secret, t, body))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// publishEvent queues an event for every endpoint of the account subscribed
+// to it and delivers it in the background.
+func (s *Apiserver) publishEvent(accountID int, eventType string, data any) {
+	endpoints, err := s.store.GetWebhookEndpoints(accountID)
+	if err != nil {
+		logf("failed to load webhook endpoints for account %d: %v\n", accountID, err)
+		return
+	}
+	payload, err := json.Marshal(map[string]any{"type": eventType, "data": data})
+	if err != nil {
+		logf("failed to encode %s event: %v\n", eventType, err)
+		return
+	}
+	for _, e := range endpoints {
+		if !subscribed(e, eventType) {
+			continue
+		}
+		ev := &webhookEvent{EndpointID: e.ID, EventType: eventType, Payload: payload, Status: webhookPending}
+		if err := s.store.CreateWebhookEvent(ev); err != nil {
+			logf("failed to queue %s event for endpoint %d: %v\n", eventType, e.ID, err)
+			continue
+		}
+		go s.deliverWebhook(e, ev)
+	}
+}
+
+// subscribed reports whether an endpoint wants an event type. An empty
+// subscription list means every event.
+func subscribed(e *webhookEndpoint, eventType string) bool {
+	if len(e.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range e.EventTypes {
+		if t == eventType || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverWebhook posts an event to its endpoint, retrying with backoff until
+// the endpoint's circuit opens, and records the outcome.
+func (s *Apiserver) deliverWebhook(e *webhookEndpoint, ev *webhookEvent) {
+	for attempt := 0; attempt < webhookMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(2*time.Second, attempt))
+		}
+		ev.Attempts++
+		err := postWebhook(e, ev)
+		if err == nil {
+			now := time.Now()
+			ev.Status, ev.LastError, ev.DeliveredAt = webhookDelivered, "", &now
+			break
+		}
+		ev.Status, ev.LastError = webhookFailed, err.Error()
+		if err := s.store.RecordWebhookError(ev.ID, ev.LastError); err != nil {
+			logf("failed to record error of webhook event %d: %v\n", ev.ID, err)
+		}
+		if errors.Is(err, errCircuitOpen) {
+			break
+		}
+	}
+	if err := s.store.UpdateWebhookEvent(ev); err != nil {
+		logf("failed to record delivery of webhook event %d: %v\n", ev.ID, err)
+	}
+}
+
+func postWebhook(e *webhookEndpoint, ev *webhookEvent) error {
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(ev.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bank-Event", ev.EventType)
+	req.Header.Set("X-Bank-Event-ID", strconv.Itoa(ev.ID))
+	req.Header.Set(webhookSignatureHeader, signWebhook(e.Secret, time.Now(), ev.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkWebhookURL checks that a webhook URL is https and points at a
+// public host, so customers cannot make the bank call its own network.
+// Development allows plain http and this machine, for local receivers.
+func checkWebhookURL(ctx context.Context, raw string, dev bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return newAPIError(http.StatusBadRequest, "invalid_url", raw)
+	}
+	if u.Scheme != "https" && !dev {
+		return newAPIError(http.StatusBadRequest, "webhook_https_required")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		host = "127.0.0.1"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := checkPublicHost(ctx, host, dev); errors.Is(err, errForbiddenAddress) {
+		return newAPIError(http.StatusBadRequest, "webhook_address_forbidden", u.Hostname())
+	} else if err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_url", raw)
+	}
+	return nil
+}
+
+// handleWebhooks lists the caller's endpoints (GET) or registers a new one
+// (POST). The signing secret is only returned on creation.
+func (s *Apiserver) handleWebhooks(w http.ResponseWriter, r *http.Request) error {
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "GET" {
+		endpoints, err := s.store.GetWebhookEndpoints(acc.ID)
+		if err != nil {
+			return err
+		}
+		for _, e := range endpoints {
+			e.Secret = ""
+		}
+		return writeJSON(w, http.StatusOK, endpoints)
+	}
+
+	req := CreateWebhookRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if err := checkWebhookURL(r.Context(), req.URL, s.cfg().Environment == envDevelopment); err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+	e := &webhookEndpoint{AccountID: acc.ID, URL: req.URL, Secret: secret, EventTypes: req.EventTypes}
+	if e.EventTypes == nil {
+		e.EventTypes = []string{}
+	}
+	if err := s.store.CreateWebhookEndpoint(e); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, e)
+}
+
+// handleWebhookEvents lists the events of one of the caller's endpoints.
+func (s *Apiserver) handleWebhookEvents(w http.ResponseWriter, r *http.Request) error {
+	e, err := s.loadWebhookEndpoint(r)
+	if err != nil {
+		return err
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	events, total, err := s.store.GetWebhookEvents(e.ID, page)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, paginate(events, total, page, func(ev *webhookEvent) cursor { return cursor{ev.CreatedAt, ev.ID} }))
+}
+
+// handleRedeliverWebhook replays the listed events of an endpoint, or its
+// undelivered events since a point in time (the last 24 hours by default, at
+// most redeliverWindow ago). A request replays at most maxRedeliverEvents,
+// one after another in the background; callers repeat it for the rest.
+func (s *Apiserver) handleRedeliverWebhook(w http.ResponseWriter, r *http.Request) error {
+	e, err := s.loadWebhookEndpoint(r)
+	if err != nil {
+		return err
+	}
+	req := RedeliverRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+	}
+	if len(req.EventIDs) > maxRedeliverEvents {
+		return newAPIError(http.StatusBadRequest, "too_many_redeliveries", maxRedeliverEvents)
+	}
+	now := clock.Now()
+	if req.Since.IsZero() {
+		req.Since = now.Add(-24 * time.Hour)
+	} else if req.Since.Before(now.Add(-redeliverWindow)) {
+		return newAPIError(http.StatusBadRequest, "redeliver_window", int(redeliverWindow.Hours()/24))
+	}
+
+	events, err := s.store.GetRedeliverableEvents(e.ID, req.EventIDs, req.Since)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		ev.Status = webhookPending
+	}
+	go func() {
+		for _, ev := range events {
+			s.deliverWebhook(e, ev)
+		}
+	}()
+	return writeJSON(w, http.StatusAccepted, map[string]int{"redelivering": len(events)})
+}
+
+// loadWebhookEndpoint fetches the endpoint named in the path if the caller owns it.
+func (s *Apiserver) loadWebhookEndpoint(r *http.Request) (*webhookEndpoint, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	acc, err := s.currentAccount(r)
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.store.GetWebhookEndpoint(id)
+	if err != nil || e.AccountID != acc.ID {
+		return nil, newAPIError(http.StatusNotFound, "webhook_not_found", id)
+	}
+	return e, nil
+}